@@ -0,0 +1,78 @@
+// Команда rotate-secrets перешифровывает секреты в БД.
+//
+// Примеры:
+//
+//	go run ./cmd/rotate-secrets -dry-run          # сколько значений нужно перешифровать
+//	go run ./cmd/rotate-secrets                   # зашифровать открытые значения и захешировать резервные коды 2FA
+//	go run ./cmd/rotate-secrets -new-data-key     # выпустить новый ключ данных и перешифровать всё
+//	go run ./cmd/rotate-secrets -rewrap           # перешифровать ключи данных новым мастер-ключом
+//
+// Ротация мастер-ключа: добавить новую версию в SECRETS_MASTER_KEYS
+// ("1:<old>,2:<new>"), запустить с -rewrap, затем удалить старую версию.
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+
+	"github.com/joho/godotenv"
+
+	"subscription-system/config"
+	"subscription-system/database"
+	"subscription-system/internal/secrets"
+	"subscription-system/models"
+)
+
+func main() {
+	newDataKey := flag.Bool("new-data-key", false, "выпустить новый ключ данных перед перешифрованием")
+	rewrap := flag.Bool("rewrap", false, "перешифровать ключи данных активным мастер-ключом")
+	dryRun := flag.Bool("dry-run", false, "только посчитать значения, требующие перешифрования")
+	flag.Parse()
+
+	if err := godotenv.Load(); err != nil {
+		log.Println("⚠️ .env file not found, using system environment")
+	}
+	cfg := config.Load()
+	if cfg.SecretsMasterKeys == "" {
+		log.Fatal("❌ SECRETS_MASTER_KEYS не задан")
+	}
+
+	if err := database.InitDB(cfg); err != nil {
+		log.Fatalf("❌ Ошибка подключения к БД: %v", err)
+	}
+	defer database.CloseDB()
+
+	ctx := context.Background()
+	if err := secrets.Init(ctx, cfg.SecretsMasterKeys, cfg.SecretsMasterKeyVersion); err != nil {
+		log.Fatalf("❌ Ошибка инициализации шифрования: %v", err)
+	}
+
+	if *rewrap && !*dryRun {
+		n, err := secrets.RewrapDataKeys(ctx)
+		if err != nil {
+			log.Fatalf("❌ Ошибка перешифрования ключей данных: %v", err)
+		}
+		log.Printf("🔑 Ключей данных перешифровано мастер-ключом: %d", n)
+	}
+
+	if *newDataKey && !*dryRun {
+		version, err := secrets.RotateDataKey(ctx)
+		if err != nil {
+			log.Fatalf("❌ Ошибка выпуска ключа данных: %v", err)
+		}
+		log.Printf("🔑 Активный ключ данных: v%d", version)
+	}
+
+	stats, err := models.ReencryptSecrets(ctx, *dryRun)
+	if err != nil {
+		log.Fatalf("❌ Ошибка перешифрования: %v", err)
+	}
+	action, codesAction := "перешифровано", "захешированы"
+	if *dryRun {
+		action, codesAction = "требуют перешифрования", "требуют хеширования"
+	}
+	log.Printf("✅ Значений %s: api_keys=%d, twofa=%d, integration_credentials=%d, crm_mailboxes=%d, webhook_endpoints=%d",
+		action, stats.APIKeys, stats.TwoFA, stats.IntegrationCredentials, stats.Mailboxes, stats.WebhookEndpoints)
+	log.Printf("✅ Резервные коды 2FA %s у пользователей: %d", codesAction, stats.TwoFABackupCodes)
+}
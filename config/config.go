@@ -8,10 +8,14 @@ import (
     "time"
 )
 
+// DefaultJWTSecret – ключ JWT по умолчанию для разработки; как FILE_URL_SECRET не принимается
+const DefaultJWTSecret = "default-access-secret"
+
 type Config struct {
     Port           string
     Env            string
     LogLevel       string
+    LogFormat      string // json или console
     StaticPath     string
     FrontendPath   string
     TemplatesPath  string
@@ -33,6 +37,65 @@ type Config struct {
 
     SkipAuth bool // если true – отключает проверку JWT (для разработки)
 
+    // Шифрование секретов в БД: "1:<base64 32 байта>,2:<...>"
+    SecretsMasterKeys       string
+    SecretsMasterKeyVersion int // 0 – последняя версия из SecretsMasterKeys
+
+    // Rate limit: memory (один инстанс) или postgres (общий для всех инстансов)
+    RateLimitBackend       string
+    RateLimitPerMinute     int // /api для анонимных и пользователей без тарифа
+    RateLimitAuthPerMinute int // /api/auth по IP
+
+    // OpenTelemetry: адрес OTLP/HTTP коллектора (пусто – трейсы не экспортируются)
+    OTLPEndpoint    string
+    OTelServiceName string
+
+    // Prometheus: Bearer-токен для /metrics (пусто – /metrics не регистрируется)
+    MetricsToken string
+
+    // Внешний адрес сервиса для ссылок в письмах и ICS-фиде (пусто – берётся из запроса)
+    PublicURL string
+
+    // Исходящие вебхуки: разрешить адреса во внутренней сети (только для разработки)
+    WebhookAllowPrivate bool
+
+    // Продавец в шапке коммерческих предложений: название и реквизиты (ИНН, адрес, контакты)
+    QuoteSellerName    string
+    QuoteSellerDetails string
+
+    // Корзина CRM: через сколько дней удалённые клиенты, сделки, активности, теги и вложения стираются окончательно
+    CRMTrashRetentionDays int
+
+    // Почтовый канал CRM: период синхронизации ящиков пользователей (IMAP) и глубина первой синхронизации;
+    // EmailAllowPrivate разрешает почтовые серверы во внутренней сети (локальный тестовый сервер)
+    EmailSyncIntervalMinutes int
+    EmailSyncInitialDays     int
+    EmailAllowPrivate        bool
+
+    // Выручка подписок (MRR): сколько дней неоплаченная подписка после конца периода ещё считается платящей
+    RevenueGraceDays int
+
+    // Прогноз оттока подписчиков: горизонт прогноза, пороги риска (в процентах) и исполнитель задач по риску
+    ChurnHorizonDays       int
+    ChurnHighRiskPercent   int
+    ChurnMediumRiskPercent int
+    ChurnTaskAssigneeID    string
+
+    // События продукта: сколько месяцев хранятся помесячные партиции (0 – без удаления)
+    ProductEventsRetentionMonths int
+
+    // Хранилище файлов (вложения, аудио, документы): local – каталог FileStoragePath, s3 – S3-совместимое (AWS, MinIO)
+    FileStorage     string
+    FileStoragePath string
+    S3Endpoint      string // https://storage.yandexcloud.net, http://minio:9000
+    S3Region        string
+    S3Bucket        string
+    S3AccessKey     string
+    S3SecretKey     string
+    S3PathStyle     bool   // адрес вида endpoint/bucket/key (нужен для MinIO)
+    FileURLSecret   string // ключ подписи временных ссылок на файлы, обязателен и не совпадает с JWT_ACCESS_SECRET
+    UploadMaxMB     int    // лимит размера загрузки, если тариф его не задаёт
+
     // API ключи для AI-агента
     OpenRouterAPIKey string // ключ для OpenRouter
     YandexFolderID   string
@@ -58,6 +121,7 @@ func Load() *Config {
         Port:           getEnv("PORT", "8080"),
         Env:            getEnv("GIN_MODE", "debug"),
         LogLevel:       getEnv("LOG_LEVEL", "info"),
+        LogFormat:      getEnv("LOG_FORMAT", "json"),
         StaticPath:     getEnv("STATIC_PATH", "./static"),
         FrontendPath:   getEnv("FRONTEND_PATH", "./frontend"),
         TemplatesPath:  getEnv("TEMPLATES_PATH", "./templates/*.html"),
@@ -72,13 +136,58 @@ func Load() *Config {
         DBName:     getEnv("DB_NAME", "postgres"),
         DBSSLMode:  getEnv("DB_SSLMODE", "disable"),
 
-        JWTSecret:        getEnv("JWT_ACCESS_SECRET", "default-access-secret"),
+        JWTSecret:        getEnv("JWT_ACCESS_SECRET", DefaultJWTSecret),
         JWTRefreshSecret: getEnv("JWT_REFRESH_SECRET", "default-refresh-secret"),
         JWTAccessExpiry:  getEnvAsDuration("JWT_ACCESS_EXPIRY", 15*time.Minute),
         JWTRefreshExpiry: getEnvAsDuration("JWT_REFRESH_EXPIRY", 30*24*time.Hour),
 
         SkipAuth: getEnvAsBool("SKIP_AUTH", false),
 
+        SecretsMasterKeys:       getEnv("SECRETS_MASTER_KEYS", ""),
+        SecretsMasterKeyVersion: getEnvAsInt("SECRETS_MASTER_KEY_VERSION", 0),
+
+        RateLimitBackend:       getEnv("RATE_LIMIT_BACKEND", "memory"),
+        RateLimitPerMinute:     getEnvAsInt("RATE_LIMIT_PER_MINUTE", 30),
+        RateLimitAuthPerMinute: getEnvAsInt("RATE_LIMIT_AUTH_PER_MINUTE", 3),
+
+        OTLPEndpoint:    getEnv("OTEL_EXPORTER_OTLP_ENDPOINT", ""),
+        OTelServiceName: getEnv("OTEL_SERVICE_NAME", "subscription-system"),
+
+        MetricsToken: getEnv("METRICS_TOKEN", ""),
+
+        PublicURL: strings.TrimRight(getEnv("PUBLIC_URL", ""), "/"),
+
+        WebhookAllowPrivate: getEnvAsBool("WEBHOOK_ALLOW_PRIVATE", false),
+
+        QuoteSellerName:    getEnv("QUOTE_SELLER_NAME", "SaaSPro"),
+        QuoteSellerDetails: getEnv("QUOTE_SELLER_DETAILS", ""),
+
+        CRMTrashRetentionDays: getEnvAsInt("CRM_TRASH_RETENTION_DAYS", 30),
+
+        EmailSyncIntervalMinutes: getEnvAsInt("EMAIL_SYNC_INTERVAL_MINUTES", 5),
+        EmailSyncInitialDays:     getEnvAsInt("EMAIL_SYNC_INITIAL_DAYS", 30),
+        EmailAllowPrivate:        getEnvAsBool("EMAIL_ALLOW_PRIVATE", false),
+
+        RevenueGraceDays: getEnvAsInt("REVENUE_GRACE_DAYS", 7),
+
+        ChurnHorizonDays:       getEnvAsInt("CHURN_HORIZON_DAYS", 30),
+        ChurnHighRiskPercent:   getEnvAsInt("CHURN_HIGH_RISK_PERCENT", 60),
+        ChurnMediumRiskPercent: getEnvAsInt("CHURN_MEDIUM_RISK_PERCENT", 30),
+        ChurnTaskAssigneeID:    getEnv("CHURN_TASK_ASSIGNEE_ID", ""),
+
+        ProductEventsRetentionMonths: getEnvAsInt("PRODUCT_EVENTS_RETENTION_MONTHS", 13),
+
+        FileStorage:     getEnv("FILE_STORAGE", "local"),
+        FileStoragePath: getEnv("FILE_STORAGE_PATH", "./uploads"),
+        S3Endpoint:      strings.TrimRight(getEnv("S3_ENDPOINT", ""), "/"),
+        S3Region:        getEnv("S3_REGION", "us-east-1"),
+        S3Bucket:        getEnv("S3_BUCKET", ""),
+        S3AccessKey:     getEnv("S3_ACCESS_KEY", ""),
+        S3SecretKey:     getEnv("S3_SECRET_KEY", ""),
+        S3PathStyle:     getEnvAsBool("S3_PATH_STYLE", true),
+        FileURLSecret:   getEnv("FILE_URL_SECRET", ""),
+        UploadMaxMB:     getEnvAsInt("UPLOAD_MAX_MB", 10),
+
         // AI ключи
         OpenRouterAPIKey: getEnv("OPENROUTER_API_KEY", ""),
         YandexFolderID:   getEnv("YANDEX_FOLDER_ID", ""),
@@ -103,8 +212,8 @@ func Load() *Config {
         cfg.TrustedProxies = strings.Split(proxies, ",")
     }
 
-    log.Printf("📋 Конфигурация загружена: порт=%s, режим=%s, БД=%s, SkipAuth=%v, OpenRouterKeySet=%v, TelegramSet=%v",
-        cfg.Port, cfg.Env, cfg.DBName, cfg.SkipAuth, cfg.OpenRouterAPIKey != "", cfg.TelegramBotToken != "")
+    log.Printf("📋 Конфигурация загружена: порт=%s, режим=%s, БД=%s, SkipAuth=%v, OpenRouterKeySet=%v, TelegramSet=%v, SecretsKeySet=%v",
+        cfg.Port, cfg.Env, cfg.DBName, cfg.SkipAuth, cfg.OpenRouterAPIKey != "", cfg.TelegramBotToken != "", cfg.SecretsMasterKeys != "")
     return cfg
 }
 
@@ -2,10 +2,13 @@ package database
 
 import (
     "context"
+    "errors"
     "fmt"
     "log"
     "subscription-system/config"
+    "subscription-system/tracing"
 
+    "github.com/jackc/pgx/v5"
     "github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -15,8 +18,14 @@ func InitDB(cfg *config.Config) error {
     dsn := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=%s",
         cfg.DBHost, cfg.DBPort, cfg.DBUser, cfg.DBPassword, cfg.DBName, cfg.DBSSLMode)
 
-    var err error
-    Pool, err = pgxpool.New(context.Background(), dsn)
+    poolConfig, err := pgxpool.ParseConfig(dsn)
+    if err != nil {
+        return fmt.Errorf("invalid database config: %w", err)
+    }
+    // Спан OpenTelemetry на каждый SQL-запрос
+    poolConfig.ConnConfig.Tracer = tracing.PgxTracer{}
+
+    Pool, err = pgxpool.NewWithConfig(context.Background(), poolConfig)
     if err != nil {
         return fmt.Errorf("unable to connect to database: %w", err)
     }
@@ -51,6 +60,12 @@ func InitDB(cfg *config.Config) error {
     if err := createReferralsTable(); err != nil {
         return fmt.Errorf("failed to create referrals table: %w", err)
     }
+    if err := createSecretTables(); err != nil {
+        return fmt.Errorf("failed to create secret tables: %w", err)
+    }
+    if err := createRateLimitTable(); err != nil {
+        return fmt.Errorf("failed to create rate limit table: %w", err)
+    }
     if err := createTwoFATable(); err != nil {
         return fmt.Errorf("failed to create twofa table: %w", err)
     }
@@ -69,6 +84,63 @@ func InitDB(cfg *config.Config) error {
     if err := createCRMTables(); err != nil {
         return fmt.Errorf("failed to create CRM tables: %w", err)
     }
+    if err := createPipelineTables(); err != nil {
+        return fmt.Errorf("failed to create pipeline tables: %w", err)
+    }
+    if err := createCustomFieldTables(); err != nil {
+        return fmt.Errorf("failed to create custom field tables: %w", err)
+    }
+    if err := createImportTables(); err != nil {
+        return fmt.Errorf("failed to create import tables: %w", err)
+    }
+    if err := createTaskTables(); err != nil {
+        return fmt.Errorf("failed to create task tables: %w", err)
+    }
+    if err := createRealtimeTables(); err != nil {
+        return fmt.Errorf("failed to create realtime tables: %w", err)
+    }
+    if err := createWebhookTables(); err != nil {
+        return fmt.Errorf("failed to create webhook tables: %w", err)
+    }
+    if err := createLeadFormTables(); err != nil {
+        return fmt.Errorf("failed to create lead form tables: %w", err)
+    }
+    if err := createCatalogTables(); err != nil {
+        return fmt.Errorf("failed to create catalog tables: %w", err)
+    }
+    if err := createLeadScoringTables(); err != nil {
+        return fmt.Errorf("failed to create lead scoring tables: %w", err)
+    }
+    if err := createSavedViewTables(); err != nil {
+        return fmt.Errorf("failed to create saved view tables: %w", err)
+    }
+    if err := createFileStorageTables(); err != nil {
+        return fmt.Errorf("failed to create file storage tables: %w", err)
+    }
+    if err := createTrashTables(); err != nil {
+        return fmt.Errorf("failed to create trash tables: %w", err)
+    }
+    if err := createEmailChannelTables(); err != nil {
+        return fmt.Errorf("failed to create email channel tables: %w", err)
+    }
+    if err := createRevenueTables(); err != nil {
+        return fmt.Errorf("failed to create revenue tables: %w", err)
+    }
+    if err := createCohortTables(); err != nil {
+        return fmt.Errorf("failed to create cohort tables: %w", err)
+    }
+    if err := createChurnTables(); err != nil {
+        return fmt.Errorf("failed to create churn tables: %w", err)
+    }
+    if err := createProductEventTables(); err != nil {
+        return fmt.Errorf("failed to create product event tables: %w", err)
+    }
+    if err := createReportTables(); err != nil {
+        return fmt.Errorf("failed to create report tables: %w", err)
+    }
+    if err := createAlertTables(); err != nil {
+        return fmt.Errorf("failed to create alert tables: %w", err)
+    }
     if err := createTestUser(); err != nil {
         return err
     }
@@ -243,6 +315,42 @@ func createSubscriptionsTables() error {
         log.Println("✅ Базовые тарифы с AI-возможностями добавлены")
     }
 
+    // Лимит запросов к API в минуту по тарифу
+    _, err = Pool.Exec(context.Background(), `
+        ALTER TABLE subscription_plans ADD COLUMN IF NOT EXISTS rate_limit_per_minute INT;
+
+        UPDATE subscription_plans SET rate_limit_per_minute = CASE code
+            WHEN 'basic' THEN 60
+            WHEN 'family' THEN 120
+            WHEN 'pro' THEN 300
+            WHEN 'enterprise' THEN 1200
+            ELSE 60 END
+        WHERE rate_limit_per_minute IS NULL;
+
+        ALTER TABLE subscription_plans ALTER COLUMN rate_limit_per_minute SET DEFAULT 60;
+    `)
+    if err != nil {
+        log.Printf("⚠️ Не удалось добавить rate_limit_per_minute: %v", err)
+    }
+
+    // Максимальный размер загружаемого файла по тарифу, МБ
+    _, err = Pool.Exec(context.Background(), `
+        ALTER TABLE subscription_plans ADD COLUMN IF NOT EXISTS max_upload_mb INT;
+
+        UPDATE subscription_plans SET max_upload_mb = CASE code
+            WHEN 'basic' THEN 10
+            WHEN 'family' THEN 25
+            WHEN 'pro' THEN 50
+            WHEN 'enterprise' THEN 200
+            ELSE 10 END
+        WHERE max_upload_mb IS NULL;
+
+        ALTER TABLE subscription_plans ALTER COLUMN max_upload_mb SET DEFAULT 10;
+    `)
+    if err != nil {
+        log.Printf("⚠️ Не удалось добавить max_upload_mb: %v", err)
+    }
+
     log.Println("✅ Таблицы подписок готовы")
     return nil
 }
@@ -275,10 +383,111 @@ func createAPIKeysTable() error {
         return err
     }
 
+    // Скоупы, срок действия, лимиты и allowlist по IP.
+    // Существующие ключи получают скоуп '*', чтобы не сломать интеграции.
+    _, err = Pool.Exec(context.Background(), `
+        ALTER TABLE api_keys
+        ADD COLUMN IF NOT EXISTS provider_credentials JSONB DEFAULT '{}',
+        ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{*}',
+        ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP,
+        ADD COLUMN IF NOT EXISTS rate_limit_per_minute INT NOT NULL DEFAULT 0,
+        ADD COLUMN IF NOT EXISTS allowed_cidrs TEXT[] NOT NULL DEFAULT '{}',
+        ADD COLUMN IF NOT EXISTS rotated_from UUID REFERENCES api_keys(id) ON DELETE SET NULL,
+        ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP,
+        ADD COLUMN IF NOT EXISTS last_used_ip VARCHAR(45);
+    `)
+    if err != nil {
+        return err
+    }
+
+    // Статистика использования по ключам (по дням)
+    _, err = Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS api_key_usage (
+            key_id UUID NOT NULL REFERENCES api_keys(id) ON DELETE CASCADE,
+            day DATE NOT NULL,
+            requests BIGINT NOT NULL DEFAULT 0,
+            rejected BIGINT NOT NULL DEFAULT 0,
+            PRIMARY KEY (key_id, day)
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_api_keys_expires ON api_keys(expires_at);
+    `)
+    if err != nil {
+        return err
+    }
+
+    // Открытый префикс ключа: по нему VerifyAPIKey находит строку, не проверяя bcrypt
+    // каждого ключа. У старых ключей префикс заполняется при первом успешном запросе.
+    _, err = Pool.Exec(context.Background(), `
+        ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS key_prefix VARCHAR(32);
+        CREATE INDEX IF NOT EXISTS idx_api_keys_key_prefix ON api_keys(key_prefix);
+    `)
+    if err != nil {
+        return err
+    }
+
     log.Println("✅ Таблица api_keys готова")
     return nil
 }
 
+// createRateLimitTable создаёт таблицу бакетов для общего rate limit (RATE_LIMIT_BACKEND=postgres).
+// UNLOGGED: после сбоя лимиты просто начинаются заново.
+func createRateLimitTable() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE UNLOGGED TABLE IF NOT EXISTS rate_limit_buckets (
+            key TEXT PRIMARY KEY,
+            tokens DOUBLE PRECISION NOT NULL,
+            allowed BOOLEAN NOT NULL DEFAULT true,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_rate_limit_buckets_updated ON rate_limit_buckets(updated_at);
+    `)
+    if err != nil {
+        return err
+    }
+
+    log.Println("✅ Таблица rate_limit_buckets готова")
+    return nil
+}
+
+// createSecretTables создаёт таблицы для шифрования секретов (envelope encryption).
+// Ключи данных хранятся только в зашифрованном мастер-ключом виде.
+func createSecretTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS secret_data_keys (
+            version SERIAL PRIMARY KEY,
+            master_version INT NOT NULL,
+            wrapped_key TEXT NOT NULL,
+            active BOOLEAN NOT NULL DEFAULT false,
+            created_at TIMESTAMP DEFAULT NOW()
+        );
+
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_secret_data_keys_active ON secret_data_keys(active) WHERE active;
+
+        CREATE TABLE IF NOT EXISTS integration_credentials (
+            provider VARCHAR(50) PRIMARY KEY,
+            credentials_enc TEXT NOT NULL,
+            updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            updated_at TIMESTAMP DEFAULT NOW()
+        );
+
+        ALTER TABLE api_keys ADD COLUMN IF NOT EXISTS provider_credentials_enc TEXT NOT NULL DEFAULT '';
+    `)
+    if err != nil {
+        return err
+    }
+
+    // Зашифрованный секрет 2FA длиннее исходного base32
+    _, err = Pool.Exec(context.Background(), `ALTER TABLE twofa ALTER COLUMN secret TYPE TEXT`)
+    if err != nil {
+        log.Printf("⚠️ Не удалось расширить twofa.secret: %v", err)
+    }
+
+    log.Println("✅ Таблицы шифрования секретов готовы")
+    return nil
+}
+
 // createReferralsTable создаёт таблицу для рефералов
 func createReferralsTable() error {
     _, err := Pool.Exec(context.Background(), `
@@ -677,6 +886,984 @@ func createCRMTables() error {
     return nil
 }
 
+// createPipelineTables создаёт воронки продаж и их этапы. Общая воронка по умолчанию
+// засевается прежними зашитыми этапами, а существующие сделки привязываются к ней.
+func createPipelineTables() error {
+    ctx := context.Background()
+    _, err := Pool.Exec(ctx, `
+        CREATE TABLE IF NOT EXISTS crm_pipelines (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- NULL – общая воронка
+            name VARCHAR(255) NOT NULL,
+            is_default BOOLEAN NOT NULL DEFAULT false,
+            sort_order INT NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT NOW(),
+            updated_at TIMESTAMP DEFAULT NOW()
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_crm_pipelines_user ON crm_pipelines(user_id);
+        -- не больше одной воронки по умолчанию на владельца (и одной общей)
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_crm_pipelines_default
+            ON crm_pipelines (COALESCE(user_id, '00000000-0000-0000-0000-000000000000'::uuid))
+            WHERE is_default;
+
+        CREATE TABLE IF NOT EXISTS crm_pipeline_stages (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            pipeline_id UUID NOT NULL REFERENCES crm_pipelines(id) ON DELETE CASCADE,
+            code VARCHAR(50) NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            sort_order INT NOT NULL DEFAULT 0,
+            probability INT NOT NULL DEFAULT 0 CHECK (probability BETWEEN 0 AND 100),
+            is_won BOOLEAN NOT NULL DEFAULT false,
+            is_lost BOOLEAN NOT NULL DEFAULT false,
+            rotting_days INT, -- NULL – сделки на этапе не «протухают»
+            UNIQUE (pipeline_id, code)
+        );
+
+        ALTER TABLE crm_deals
+        ADD COLUMN IF NOT EXISTS pipeline_id UUID REFERENCES crm_pipelines(id) ON DELETE RESTRICT,
+        ADD COLUMN IF NOT EXISTS stage_changed_at TIMESTAMP;
+
+        CREATE INDEX IF NOT EXISTS idx_crm_deals_pipeline_stage ON crm_deals(pipeline_id, stage);
+    `)
+    if err != nil {
+        return err
+    }
+
+    // Время последней смены этапа нужно для «протухания»; для старых сделок берём updated_at
+    _, err = Pool.Exec(ctx, `
+        UPDATE crm_deals SET stage_changed_at = COALESCE(updated_at, created_at, NOW()) WHERE stage_changed_at IS NULL;
+        ALTER TABLE crm_deals ALTER COLUMN stage_changed_at SET DEFAULT NOW();
+    `)
+    if err != nil {
+        log.Printf("⚠️ Не удалось заполнить stage_changed_at в crm_deals: %v", err)
+    }
+
+    var defaultID string
+    err = Pool.QueryRow(ctx, `
+        INSERT INTO crm_pipelines (name, is_default, sort_order)
+        SELECT 'Основная воронка', true, 0
+        WHERE NOT EXISTS (SELECT 1 FROM crm_pipelines WHERE user_id IS NULL AND is_default)
+        RETURNING id
+    `).Scan(&defaultID)
+    switch {
+    case err == nil:
+        _, err = Pool.Exec(ctx, `
+            INSERT INTO crm_pipeline_stages (pipeline_id, code, name, sort_order, probability, is_won, is_lost, rotting_days)
+            VALUES
+                ($1, 'lead', 'Лид', 1, 10, false, false, 14),
+                ($1, 'negotiation', 'Переговоры', 2, 40, false, false, 14),
+                ($1, 'proposal', 'Предложение', 3, 70, false, false, 7),
+                ($1, 'closed_won', 'Успешно закрыта', 4, 100, true, false, NULL),
+                ($1, 'closed_lost', 'Проиграна', 5, 0, false, true, NULL)
+        `, defaultID)
+        if err != nil {
+            return err
+        }
+        log.Println("✅ Создана общая воронка продаж по умолчанию")
+    case errors.Is(err, pgx.ErrNoRows):
+        err = Pool.QueryRow(ctx, `SELECT id FROM crm_pipelines WHERE user_id IS NULL AND is_default`).Scan(&defaultID)
+        if err != nil {
+            return err
+        }
+    default:
+        return err
+    }
+
+    // Сделки без воронки (старые или созданные в обход API) попадают в общую воронку.
+    // Этапы, которых в ней нет, добавляются как есть, чтобы не потерять данные.
+    _, err = Pool.Exec(ctx, `
+        UPDATE crm_deals SET stage = (
+            SELECT code FROM crm_pipeline_stages
+            WHERE pipeline_id = $1 AND NOT is_won AND NOT is_lost
+            ORDER BY sort_order LIMIT 1
+        )
+        WHERE pipeline_id IS NULL AND COALESCE(stage, '') = ''
+    `, defaultID)
+    if err != nil {
+        return err
+    }
+    _, err = Pool.Exec(ctx, `
+        INSERT INTO crm_pipeline_stages (pipeline_id, code, name, sort_order)
+        SELECT DISTINCT $1::uuid, stage, stage, 100
+        FROM crm_deals
+        WHERE pipeline_id IS NULL
+        ON CONFLICT (pipeline_id, code) DO NOTHING
+    `, defaultID)
+    if err != nil {
+        return err
+    }
+    tag, err := Pool.Exec(ctx, `UPDATE crm_deals SET pipeline_id = $1 WHERE pipeline_id IS NULL`, defaultID)
+    if err != nil {
+        return err
+    }
+    if tag.RowsAffected() > 0 {
+        log.Printf("🔀 %d сделок привязано к воронке по умолчанию", tag.RowsAffected())
+    }
+
+    log.Println("✅ Таблицы воронок продаж готовы")
+    return nil
+}
+
+// createCustomFieldTables создаёт схему пользовательских полей. Значения хранятся
+// в JSONB-колонке custom_fields самой сущности: ключ поля -> значение
+func createCustomFieldTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_custom_fields (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            entity_type VARCHAR(20) NOT NULL CHECK (entity_type IN ('customer', 'deal')),
+            key VARCHAR(50) NOT NULL,
+            label VARCHAR(255) NOT NULL,
+            field_type VARCHAR(20) NOT NULL CHECK (field_type IN ('text', 'number', 'date', 'select', 'multi_select', 'user', 'url')),
+            options JSONB NOT NULL DEFAULT '[]', -- варианты для select / multi_select
+            required BOOLEAN NOT NULL DEFAULT false,
+            sort_order INT NOT NULL DEFAULT 0,
+            created_at TIMESTAMP DEFAULT NOW(),
+            updated_at TIMESTAMP DEFAULT NOW(),
+            UNIQUE (entity_type, key)
+        );
+
+        ALTER TABLE crm_customers ADD COLUMN IF NOT EXISTS custom_fields JSONB NOT NULL DEFAULT '{}';
+        ALTER TABLE crm_deals ADD COLUMN IF NOT EXISTS custom_fields JSONB NOT NULL DEFAULT '{}';
+
+        CREATE INDEX IF NOT EXISTS idx_crm_customers_custom_fields ON crm_customers USING GIN (custom_fields);
+        CREATE INDEX IF NOT EXISTS idx_crm_deals_custom_fields ON crm_deals USING GIN (custom_fields);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблица пользовательских полей CRM готова")
+    return nil
+}
+
+// createImportTables создаёт задания импорта CRM из CSV/XLSX и шаблоны сопоставления колонок
+func createImportTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_import_jobs (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            entity_type VARCHAR(20) NOT NULL CHECK (entity_type IN ('customer', 'deal')),
+            file_name VARCHAR(255) NOT NULL,
+            file_path TEXT NOT NULL,
+            headers JSONB NOT NULL DEFAULT '[]',
+            options JSONB NOT NULL DEFAULT '{}', -- сопоставление колонок и правила дедупликации
+            dry_run BOOLEAN NOT NULL DEFAULT false,
+            status VARCHAR(20) NOT NULL DEFAULT 'uploaded',
+            total_rows INT NOT NULL DEFAULT 0,
+            processed_rows INT NOT NULL DEFAULT 0,
+            created_count INT NOT NULL DEFAULT 0,
+            updated_count INT NOT NULL DEFAULT 0,
+            skipped_count INT NOT NULL DEFAULT 0,
+            error_count INT NOT NULL DEFAULT 0,
+            row_errors JSONB NOT NULL DEFAULT '[]',
+            error TEXT,
+            created_at TIMESTAMP DEFAULT NOW(),
+            started_at TIMESTAMP,
+            finished_at TIMESTAMP
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_crm_import_jobs_user ON crm_import_jobs(user_id, created_at DESC);
+
+        CREATE TABLE IF NOT EXISTS crm_import_templates (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name VARCHAR(255) NOT NULL,
+            entity_type VARCHAR(20) NOT NULL CHECK (entity_type IN ('customer', 'deal')),
+            mapping JSONB NOT NULL DEFAULT '{}',
+            created_at TIMESTAMP DEFAULT NOW(),
+            UNIQUE (user_id, entity_type, name)
+        );
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы импорта CRM готовы")
+    return nil
+}
+
+// createTaskTables создаёт задачи CRM, журнал отправленных напоминаний и секретные ссылки на ICS-календарь.
+// Время задач хранится с часовым поясом: оно уходит во внешние календари и в напоминания.
+func createTaskTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_tasks (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE SET NULL,       -- автор
+            assignee_id UUID REFERENCES users(id) ON DELETE SET NULL,   -- исполнитель (NULL – автор)
+            title VARCHAR(255) NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            due_at TIMESTAMPTZ NOT NULL,
+            duration_minutes INT NOT NULL DEFAULT 30 CHECK (duration_minutes > 0),
+            priority VARCHAR(10) NOT NULL DEFAULT 'normal' CHECK (priority IN ('low', 'normal', 'high', 'urgent')),
+            customer_id UUID REFERENCES crm_customers(id) ON DELETE CASCADE,
+            deal_id UUID REFERENCES crm_deals(id) ON DELETE CASCADE,
+            recurrence VARCHAR(10) NOT NULL DEFAULT 'none'
+                CHECK (recurrence IN ('none', 'daily', 'weekdays', 'weekly', 'monthly', 'yearly')),
+            recurrence_until DATE,
+            reminder_offsets INT[] NOT NULL DEFAULT '{}', -- минуты до due_at
+            completed BOOLEAN NOT NULL DEFAULT false,
+            completed_at TIMESTAMPTZ,
+            completed_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+
+        CREATE INDEX IF NOT EXISTS idx_crm_tasks_assignee ON crm_tasks(assignee_id, due_at) WHERE NOT completed;
+        CREATE INDEX IF NOT EXISTS idx_crm_tasks_user ON crm_tasks(user_id, due_at);
+        CREATE INDEX IF NOT EXISTS idx_crm_tasks_deal ON crm_tasks(deal_id);
+        CREATE INDEX IF NOT EXISTS idx_crm_tasks_customer ON crm_tasks(customer_id);
+        CREATE INDEX IF NOT EXISTS idx_crm_tasks_open_due ON crm_tasks(due_at) WHERE NOT completed;
+
+        -- одно напоминание на срок задачи и смещение: при переносе срока напоминания уходят заново
+        CREATE TABLE IF NOT EXISTS crm_task_reminders (
+            task_id UUID NOT NULL REFERENCES crm_tasks(id) ON DELETE CASCADE,
+            due_at TIMESTAMPTZ NOT NULL,
+            offset_minutes INT NOT NULL,
+            sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            error TEXT,
+            PRIMARY KEY (task_id, due_at, offset_minutes)
+        );
+
+        CREATE TABLE IF NOT EXISTS crm_calendar_feeds (
+            user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+            token VARCHAR(64) UNIQUE NOT NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+
+        ALTER TABLE user_notification_settings
+        ADD COLUMN IF NOT EXISTS task_reminder_offsets INT[] NOT NULL DEFAULT '{15}';
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы задач CRM готовы")
+    return nil
+}
+
+// createRealtimeTables создаёт журнал событий CRM для живых обновлений.
+// Журнал нужен, чтобы переподключившийся клиент дополучил пропущенное по Last-Event-ID,
+// а экземпляры приложения узнают о новых записях через NOTIFY crm_events.
+func createRealtimeTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_events (
+            id BIGSERIAL PRIMARY KEY,
+            type VARCHAR(50) NOT NULL,
+            entity_type VARCHAR(20) NOT NULL,
+            entity_id UUID,
+            owner_id UUID,
+            actor_id UUID,
+            payload JSONB NOT NULL DEFAULT '{}',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_events_owner ON crm_events(owner_id, id);
+        CREATE INDEX IF NOT EXISTS idx_crm_events_created ON crm_events(created_at);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Журнал событий CRM готов")
+    return nil
+}
+
+// createWebhookTables создаёт подписки на исходящие вебхуки и исходящую очередь доставок.
+// Доставка – одно событие для одного адреса; каждая попытка пишется в webhook_attempts.
+func createWebhookTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS webhook_endpoints (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            url TEXT NOT NULL,
+            description VARCHAR(255) NOT NULL DEFAULT '',
+            event_types TEXT[] NOT NULL DEFAULT '{}',
+            secret TEXT NOT NULL,
+            active BOOLEAN NOT NULL DEFAULT true,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_webhook_endpoints_user ON webhook_endpoints(user_id);
+
+        CREATE TABLE IF NOT EXISTS webhook_deliveries (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            endpoint_id UUID NOT NULL REFERENCES webhook_endpoints(id) ON DELETE CASCADE,
+            event_id UUID NOT NULL,
+            event_type VARCHAR(50) NOT NULL,
+            payload JSONB NOT NULL,
+            status VARCHAR(20) NOT NULL DEFAULT 'pending',
+            attempts INT NOT NULL DEFAULT 0,
+            next_attempt_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            last_status_code INT,
+            last_error TEXT,
+            redelivery_of UUID,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            delivered_at TIMESTAMPTZ
+        );
+        CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_due ON webhook_deliveries(next_attempt_at) WHERE status = 'pending';
+        CREATE INDEX IF NOT EXISTS idx_webhook_deliveries_endpoint ON webhook_deliveries(endpoint_id, created_at DESC);
+
+        CREATE TABLE IF NOT EXISTS webhook_attempts (
+            id BIGSERIAL PRIMARY KEY,
+            delivery_id UUID NOT NULL REFERENCES webhook_deliveries(id) ON DELETE CASCADE,
+            attempt INT NOT NULL,
+            status_code INT,
+            error TEXT,
+            response_body TEXT,
+            duration_ms INT NOT NULL DEFAULT 0,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_webhook_attempts_delivery ON webhook_attempts(delivery_id);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы вебхуков готовы")
+    return nil
+}
+
+// createLeadFormTables создаёт формы захвата лидов и журнал заявок со всех каналов
+// (формы на сайтах, заявка на услуги, AI-консультант)
+func createLeadFormTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS lead_forms (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name VARCHAR(255) NOT NULL,
+            public_key VARCHAR(64) NOT NULL UNIQUE,
+            fields JSONB NOT NULL DEFAULT '[]',
+            source VARCHAR(255) NOT NULL DEFAULT '',
+            assignment JSONB NOT NULL DEFAULT '{}',
+            assignment_cursor BIGINT NOT NULL DEFAULT 0,
+            create_deal BOOLEAN NOT NULL DEFAULT false,
+            pipeline_id UUID REFERENCES crm_pipelines(id) ON DELETE SET NULL,
+            stage VARCHAR(50) NOT NULL DEFAULT '',
+            deal_title VARCHAR(255) NOT NULL DEFAULT '',
+            deal_value DECIMAL(12,2) NOT NULL DEFAULT 0,
+            channels TEXT[] NOT NULL DEFAULT '{}', -- внутренние каналы, заявки которых принимает форма
+            allowed_origins TEXT[] NOT NULL DEFAULT '{}',
+            rate_limit_per_hour INT NOT NULL DEFAULT 10,
+            success_message TEXT NOT NULL DEFAULT '',
+            redirect_url TEXT NOT NULL DEFAULT '',
+            active BOOLEAN NOT NULL DEFAULT true,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_lead_forms_user ON lead_forms(user_id);
+        CREATE INDEX IF NOT EXISTS idx_lead_forms_channels ON lead_forms USING GIN (channels);
+
+        CREATE TABLE IF NOT EXISTS lead_submissions (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            form_id UUID REFERENCES lead_forms(id) ON DELETE SET NULL,
+            channel VARCHAR(30) NOT NULL,
+            external_ref VARCHAR(100), -- ID исходной записи канала (service_requests, консультации)
+            payload JSONB NOT NULL DEFAULT '{}',
+            utm JSONB NOT NULL DEFAULT '{}',
+            ip VARCHAR(64),
+            user_agent TEXT,
+            referrer TEXT,
+            status VARCHAR(20) NOT NULL, -- created, matched, spam, invalid
+            customer_id UUID REFERENCES crm_customers(id) ON DELETE SET NULL,
+            deal_id UUID REFERENCES crm_deals(id) ON DELETE SET NULL,
+            assigned_to UUID REFERENCES users(id) ON DELETE SET NULL,
+            error TEXT,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_lead_submissions_form ON lead_submissions(form_id, created_at DESC);
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_lead_submissions_external
+            ON lead_submissions(channel, external_ref) WHERE external_ref IS NOT NULL;
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы форм захвата лидов готовы")
+    return nil
+}
+
+// createCatalogTables создаёт прайс-лист, позиции сделок, коммерческие предложения
+// и заказы, в которые превращаются выигранные сделки
+func createCatalogTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_products (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- NULL – общий прайс-лист
+            sku VARCHAR(64) NOT NULL,
+            name VARCHAR(255) NOT NULL,
+            description TEXT NOT NULL DEFAULT '',
+            unit VARCHAR(20) NOT NULL DEFAULT 'шт',
+            price DECIMAL(14,2) NOT NULL DEFAULT 0, -- без НДС
+            currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+            vat_rate DECIMAL(5,2) NOT NULL DEFAULT 20,
+            active BOOLEAN NOT NULL DEFAULT true,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_crm_products_sku ON crm_products(COALESCE(user_id::text, ''), lower(sku));
+
+        CREATE TABLE IF NOT EXISTS crm_deal_items (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            deal_id UUID NOT NULL REFERENCES crm_deals(id) ON DELETE CASCADE,
+            product_id UUID REFERENCES crm_products(id) ON DELETE SET NULL,
+            sku VARCHAR(64) NOT NULL DEFAULT '',
+            name VARCHAR(255) NOT NULL,
+            unit VARCHAR(20) NOT NULL DEFAULT 'шт',
+            quantity DECIMAL(14,3) NOT NULL DEFAULT 1,
+            price DECIMAL(14,2) NOT NULL DEFAULT 0,
+            currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+            discount DECIMAL(5,2) NOT NULL DEFAULT 0, -- скидка в процентах
+            vat_rate DECIMAL(5,2) NOT NULL DEFAULT 0,
+            sort_order INT NOT NULL DEFAULT 0
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_deal_items_deal ON crm_deal_items(deal_id, sort_order);
+
+        CREATE SEQUENCE IF NOT EXISTS crm_quote_number_seq;
+        CREATE TABLE IF NOT EXISTS crm_quotes (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            deal_id UUID NOT NULL REFERENCES crm_deals(id) ON DELETE CASCADE,
+            user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+            number VARCHAR(32) NOT NULL,
+            version INT NOT NULL DEFAULT 1,
+            status VARCHAR(20) NOT NULL DEFAULT 'draft',
+            customer JSONB NOT NULL DEFAULT '{}', -- реквизиты клиента на момент выпуска
+            items JSONB NOT NULL DEFAULT '[]',
+            currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+            subtotal DECIMAL(14,2) NOT NULL DEFAULT 0,
+            discount_total DECIMAL(14,2) NOT NULL DEFAULT 0,
+            tax_total DECIMAL(14,2) NOT NULL DEFAULT 0,
+            total DECIMAL(14,2) NOT NULL DEFAULT 0,
+            valid_until DATE,
+            notes TEXT NOT NULL DEFAULT '',
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            UNIQUE (number, version)
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_quotes_deal ON crm_quotes(deal_id, created_at DESC);
+
+        CREATE TABLE IF NOT EXISTS crm_orders (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE SET NULL,
+            deal_id UUID REFERENCES crm_deals(id) ON DELETE SET NULL,
+            quote_id UUID REFERENCES crm_quotes(id) ON DELETE SET NULL,
+            customer_id UUID REFERENCES crm_customers(id) ON DELETE SET NULL,
+            customer_name VARCHAR(255) NOT NULL DEFAULT '',
+            customer_phone VARCHAR(50) NOT NULL DEFAULT '',
+            customer_email VARCHAR(255) NOT NULL DEFAULT '',
+            products JSONB NOT NULL DEFAULT '[]',
+            total_amount DECIMAL(14,2) NOT NULL DEFAULT 0,
+            currency VARCHAR(3) NOT NULL DEFAULT 'RUB',
+            delivery_type VARCHAR(20) NOT NULL DEFAULT 'pickup',
+            delivery_address JSONB NOT NULL DEFAULT '{}',
+            status VARCHAR(20) NOT NULL DEFAULT 'new',
+            tracking_number VARCHAR(100) NOT NULL DEFAULT '',
+            estimated_delivery TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_crm_orders_deal ON crm_orders(deal_id) WHERE deal_id IS NOT NULL;
+        CREATE INDEX IF NOT EXISTS idx_crm_orders_user ON crm_orders(user_id, created_at DESC);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы каталога, КП и заказов готовы")
+    return nil
+}
+
+// createLeadScoringTables создаёт модели лид-скоринга (правила с весами) и рассчитанные
+// оценки клиентов с разбором по правилам; crm_customers.lead_score остаётся итогом в долях единицы
+func createLeadScoringTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_scoring_models (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- NULL – общая модель
+            rules JSONB NOT NULL DEFAULT '[]',
+            decay_half_life_days INT NOT NULL DEFAULT 30,
+            updated_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_crm_scoring_models_owner ON crm_scoring_models(COALESCE(user_id::text, ''));
+
+        CREATE TABLE IF NOT EXISTS crm_lead_scores (
+            customer_id UUID PRIMARY KEY REFERENCES crm_customers(id) ON DELETE CASCADE,
+            model_id UUID REFERENCES crm_scoring_models(id) ON DELETE SET NULL, -- NULL – встроенная модель
+            score DECIMAL(5,2) NOT NULL DEFAULT 0, -- 0..100
+            contributions JSONB NOT NULL DEFAULT '[]',
+            computed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_lead_scores_computed ON crm_lead_scores(computed_at);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы лид-скоринга готовы")
+    return nil
+}
+
+// createSavedViewTables создаёт сохранённые представления списков клиентов и сделок
+// (фильтр и сортировка на языке фильтров CRM)
+func createSavedViewTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_saved_views (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- NULL – общее представление
+            entity_type VARCHAR(20) NOT NULL, -- 'customer' или 'deal'
+            name VARCHAR(255) NOT NULL,
+            filter JSONB,
+            sort JSONB NOT NULL DEFAULT '[]',
+            columns JSONB NOT NULL DEFAULT '[]',
+            sort_order INT NOT NULL DEFAULT 0,
+            created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_saved_views_owner ON crm_saved_views(entity_type, user_id);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблица сохранённых представлений CRM готова")
+    return nil
+}
+
+// createFileStorageTables создаёт реестр содержимого файлового хранилища. Файл хранится один раз
+// на SHA-256; вложения сделок, аудио транскрибации, документы базы знаний и файлы импорта CRM
+// ссылаются на него по file_hash.
+func createFileStorageTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS file_blobs (
+            sha256 VARCHAR(64) PRIMARY KEY,
+            storage_key VARCHAR(255) NOT NULL,
+            size BIGINT NOT NULL,
+            mime_type VARCHAR(255) NOT NULL,
+            thumbnail_key VARCHAR(255),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            last_used_at TIMESTAMPTZ NOT NULL DEFAULT NOW() -- защита свежих загрузок от очистки
+        );
+        CREATE INDEX IF NOT EXISTS idx_file_blobs_last_used ON file_blobs(last_used_at);
+
+        ALTER TABLE deal_attachments ADD COLUMN IF NOT EXISTS file_hash VARCHAR(64);
+        CREATE INDEX IF NOT EXISTS idx_deal_attachments_hash ON deal_attachments(file_hash);
+
+        ALTER TABLE IF EXISTS audio_transcriptions ADD COLUMN IF NOT EXISTS file_hash VARCHAR(64);
+        ALTER TABLE IF EXISTS knowledge_docs ADD COLUMN IF NOT EXISTS file_hash VARCHAR(64);
+        ALTER TABLE crm_import_jobs ADD COLUMN IF NOT EXISTS file_hash VARCHAR(64); -- file_path – ключ в хранилище
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы файлового хранилища готовы")
+    return nil
+}
+
+// createTrashTables включает мягкое удаление сущностей CRM. Удалённая строка получает deleted_at,
+// deleted_by и deletion_id – id записи корзины crm_trash; дочерние строки (сделки клиента, вложения,
+// активности) помечаются тем же deletion_id и восстанавливаются вместе с родителем.
+func createTrashTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_trash (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            entity_type VARCHAR(20) NOT NULL, -- customer, deal, activity, tag, attachment
+            entity_id UUID NOT NULL,
+            title TEXT NOT NULL DEFAULT '',
+            owner_id UUID REFERENCES users(id) ON DELETE SET NULL, -- владелец сущности; NULL – общая (теги)
+            deleted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            deleted_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            children JSONB NOT NULL DEFAULT '{}'
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_trash_owner ON crm_trash(owner_id, deleted_at DESC);
+        CREATE INDEX IF NOT EXISTS idx_crm_trash_deleted_at ON crm_trash(deleted_at);
+
+        ALTER TABLE crm_customers
+            ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+            ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            ADD COLUMN IF NOT EXISTS deletion_id UUID;
+        ALTER TABLE crm_deals
+            ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+            ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            ADD COLUMN IF NOT EXISTS deletion_id UUID;
+        ALTER TABLE deal_attachments
+            ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+            ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            ADD COLUMN IF NOT EXISTS deletion_id UUID;
+        ALTER TABLE IF EXISTS activities
+            ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+            ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            ADD COLUMN IF NOT EXISTS deletion_id UUID;
+        ALTER TABLE IF EXISTS tags
+            ADD COLUMN IF NOT EXISTS deleted_at TIMESTAMPTZ,
+            ADD COLUMN IF NOT EXISTS deleted_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            ADD COLUMN IF NOT EXISTS deletion_id UUID;
+
+        CREATE INDEX IF NOT EXISTS idx_crm_customers_deletion ON crm_customers(deletion_id) WHERE deletion_id IS NOT NULL;
+        CREATE INDEX IF NOT EXISTS idx_crm_deals_deletion ON crm_deals(deletion_id) WHERE deletion_id IS NOT NULL;
+        CREATE INDEX IF NOT EXISTS idx_deal_attachments_deletion ON deal_attachments(deletion_id) WHERE deletion_id IS NOT NULL;
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Корзина CRM готова")
+    return nil
+}
+
+// createEmailChannelTables создаёт почтовые ящики пользователей, переписку с клиентами и шаблоны писем
+func createEmailChannelTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS crm_mailboxes (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            email VARCHAR(255) NOT NULL,
+            display_name VARCHAR(255) NOT NULL DEFAULT '',
+            imap_host VARCHAR(255) NOT NULL DEFAULT '',
+            imap_port INT NOT NULL DEFAULT 993,
+            imap_security VARCHAR(10) NOT NULL DEFAULT 'tls', -- tls, starttls, none
+            imap_username VARCHAR(255) NOT NULL DEFAULT '',
+            imap_password_enc TEXT NOT NULL DEFAULT '',
+            imap_folder VARCHAR(255) NOT NULL DEFAULT 'INBOX',
+            smtp_host VARCHAR(255) NOT NULL DEFAULT '',
+            smtp_port INT NOT NULL DEFAULT 465,
+            smtp_security VARCHAR(10) NOT NULL DEFAULT 'tls',
+            smtp_username VARCHAR(255) NOT NULL DEFAULT '',
+            smtp_password_enc TEXT NOT NULL DEFAULT '',
+            sync_enabled BOOLEAN NOT NULL DEFAULT true,
+            uid_validity BIGINT NOT NULL DEFAULT 0,
+            last_uid BIGINT NOT NULL DEFAULT 0,
+            last_sync_at TIMESTAMPTZ,
+            last_error TEXT,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            UNIQUE (user_id, email)
+        );
+
+        CREATE TABLE IF NOT EXISTS crm_email_threads (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            mailbox_id UUID NOT NULL REFERENCES crm_mailboxes(id) ON DELETE CASCADE,
+            customer_id UUID REFERENCES crm_customers(id) ON DELETE SET NULL,
+            subject TEXT NOT NULL DEFAULT '',
+            message_count INT NOT NULL DEFAULT 0,
+            last_message_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_email_threads_customer ON crm_email_threads(customer_id, last_message_at DESC);
+        CREATE INDEX IF NOT EXISTS idx_crm_email_threads_mailbox ON crm_email_threads(mailbox_id, last_message_at DESC);
+
+        CREATE TABLE IF NOT EXISTS crm_email_messages (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            mailbox_id UUID NOT NULL REFERENCES crm_mailboxes(id) ON DELETE CASCADE,
+            thread_id UUID NOT NULL REFERENCES crm_email_threads(id) ON DELETE CASCADE,
+            customer_id UUID REFERENCES crm_customers(id) ON DELETE SET NULL,
+            deal_id UUID REFERENCES crm_deals(id) ON DELETE SET NULL,
+            direction VARCHAR(3) NOT NULL, -- in, out
+            message_id TEXT NOT NULL, -- заголовок Message-ID без угловых скобок
+            in_reply_to TEXT NOT NULL DEFAULT '',
+            refs TEXT[] NOT NULL DEFAULT '{}',
+            from_addr VARCHAR(255) NOT NULL DEFAULT '',
+            from_name VARCHAR(255) NOT NULL DEFAULT '',
+            to_addrs TEXT[] NOT NULL DEFAULT '{}',
+            cc_addrs TEXT[] NOT NULL DEFAULT '{}',
+            subject TEXT NOT NULL DEFAULT '',
+            body_text TEXT NOT NULL DEFAULT '',
+            body_html TEXT NOT NULL DEFAULT '',
+            imap_uid BIGINT,
+            template_id UUID,
+            sent_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            tracking_token VARCHAR(64) UNIQUE,
+            open_count INT NOT NULL DEFAULT 0,
+            opened_at TIMESTAMPTZ,
+            sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            UNIQUE (mailbox_id, message_id)
+        );
+        CREATE INDEX IF NOT EXISTS idx_crm_email_messages_thread ON crm_email_messages(thread_id, sent_at);
+
+        CREATE TABLE IF NOT EXISTS crm_email_templates (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- NULL – общий шаблон (создаёт администратор)
+            name VARCHAR(255) NOT NULL,
+            subject TEXT NOT NULL DEFAULT '',
+            body TEXT NOT NULL DEFAULT '', -- HTML с полями подстановки {customer.name}, {deal.title}, ...
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Почтовый канал CRM готов")
+    return nil
+}
+
+// createRevenueTables создаёт таблицы метрик выручки подписок: текущий MRR клиентов,
+// движения MRR по дням и дневные итоги. Внешних ключей нет намеренно: история не должна
+// исчезать вместе с пользователем, а удаление пользователя засчитывается как отток.
+func createRevenueTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS revenue_customer_mrr (
+            user_id UUID PRIMARY KEY,
+            mrr DECIMAL(12,2) NOT NULL DEFAULT 0,
+            plan_id INT,
+            first_paid_on DATE NOT NULL,
+            last_change_on DATE NOT NULL,
+            churned_on DATE
+        );
+
+        CREATE TABLE IF NOT EXISTS revenue_mrr_movements (
+            id BIGSERIAL PRIMARY KEY,
+            day DATE NOT NULL,
+            user_id UUID NOT NULL,
+            kind VARCHAR(20) NOT NULL, -- new, expansion, contraction, churn, reactivation
+            plan_from INT,
+            plan_to INT,
+            mrr_from DECIMAL(12,2) NOT NULL,
+            mrr_to DECIMAL(12,2) NOT NULL,
+            delta DECIMAL(12,2) NOT NULL
+        );
+        CREATE INDEX IF NOT EXISTS idx_revenue_mrr_movements_day ON revenue_mrr_movements(day);
+        CREATE INDEX IF NOT EXISTS idx_revenue_mrr_movements_user ON revenue_mrr_movements(user_id, day);
+
+        CREATE TABLE IF NOT EXISTS revenue_daily (
+            day DATE PRIMARY KEY,
+            mrr DECIMAL(14,2) NOT NULL,
+            paying_customers INT NOT NULL,
+            new_mrr DECIMAL(14,2) NOT NULL DEFAULT 0,
+            expansion_mrr DECIMAL(14,2) NOT NULL DEFAULT 0,
+            contraction_mrr DECIMAL(14,2) NOT NULL DEFAULT 0,
+            churned_mrr DECIMAL(14,2) NOT NULL DEFAULT 0,
+            reactivation_mrr DECIMAL(14,2) NOT NULL DEFAULT 0,
+            new_customers INT NOT NULL DEFAULT 0,
+            churned_customers INT NOT NULL DEFAULT 0,
+            reactivated_customers INT NOT NULL DEFAULT 0,
+            payments_revenue DECIMAL(14,2) NOT NULL DEFAULT 0,
+            computed_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы метрик выручки готовы")
+    return nil
+}
+
+// createCohortTables создаёт таблицы когортного анализа: определения когорт, участников
+// (когорта каждого субъекта фиксируется один раз) и периоды, в которых субъект вернулся.
+// Расчёт инкрементальный – computed_through отмечает, до какого момента события уже учтены.
+func createCohortTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS analytics_cohort_definitions (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID REFERENCES users(id) ON DELETE CASCADE, -- NULL – по всему сервису (администратор)
+            name VARCHAR(255) NOT NULL,
+            cohort_event VARCHAR(50) NOT NULL,
+            retention_event VARCHAR(50) NOT NULL,
+            granularity VARCHAR(10) NOT NULL DEFAULT 'month',
+            periods INT NOT NULL DEFAULT 12,
+            computed_through TIMESTAMP,
+            created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_analytics_cohort_definitions_user ON analytics_cohort_definitions(user_id);
+
+        CREATE TABLE IF NOT EXISTS analytics_cohort_members (
+            definition_id UUID NOT NULL REFERENCES analytics_cohort_definitions(id) ON DELETE CASCADE,
+            subject_id UUID NOT NULL, -- пользователь или клиент CRM, в зависимости от события
+            joined_at TIMESTAMP NOT NULL,
+            cohort_start DATE NOT NULL,
+            PRIMARY KEY (definition_id, subject_id)
+        );
+        CREATE INDEX IF NOT EXISTS idx_analytics_cohort_members_start ON analytics_cohort_members(definition_id, cohort_start);
+
+        CREATE TABLE IF NOT EXISTS analytics_cohort_retention (
+            definition_id UUID NOT NULL,
+            subject_id UUID NOT NULL,
+            period INT NOT NULL,
+            PRIMARY KEY (definition_id, subject_id, period),
+            FOREIGN KEY (definition_id, subject_id)
+                REFERENCES analytics_cohort_members(definition_id, subject_id) ON DELETE CASCADE
+        );
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы когортного анализа готовы")
+    return nil
+}
+
+// createChurnTables создаёт таблицы прогноза оттока: версии обученных моделей с метриками
+// качества и текущий прогноз по каждому платящему пользователю с вкладом факторов.
+func createChurnTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS analytics_churn_models (
+            id SERIAL PRIMARY KEY, -- номер версии
+            algorithm VARCHAR(30) NOT NULL DEFAULT 'logistic_regression',
+            horizon_days INT NOT NULL,
+            features JSONB NOT NULL, -- имя, вес, среднее и разброс каждого признака
+            intercept DOUBLE PRECISION NOT NULL,
+            metrics JSONB NOT NULL, -- AUC, log loss, Brier, калибровка на отложенной выборке
+            trained_from DATE NOT NULL,
+            trained_to DATE NOT NULL,
+            is_active BOOLEAN NOT NULL DEFAULT false,
+            created_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            trained_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_analytics_churn_models_active ON analytics_churn_models(is_active) WHERE is_active;
+
+        CREATE TABLE IF NOT EXISTS analytics_churn_predictions (
+            user_id UUID PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+            model_id INT NOT NULL REFERENCES analytics_churn_models(id) ON DELETE CASCADE,
+            churn_probability DOUBLE PRECISION NOT NULL,
+            risk_level VARCHAR(10) NOT NULL, -- low, medium, high
+            factors JSONB NOT NULL DEFAULT '[]', -- вклад признаков в логит, по убыванию модуля
+            predicted_date DATE NOT NULL, -- конец горизонта прогноза
+            high_risk_since TIMESTAMPTZ,
+            task_id UUID REFERENCES crm_tasks(id) ON DELETE SET NULL,
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_analytics_churn_predictions_risk ON analytics_churn_predictions(churn_probability DESC);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы прогноза оттока готовы")
+    return nil
+}
+
+// createProductEventTables создаёт журнал событий продукта, разбитый на помесячные партиции.
+// Сами партиции создаёт и удаляет по сроку хранения ProductEventService.
+func createProductEventTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS product_events (
+            id BIGSERIAL,
+            insert_id UUID, -- ключ клиента: повтор пакета с тем же ключом и временем не дублирует событие
+            event VARCHAR(100) NOT NULL,
+            user_id UUID,
+            account_id UUID,
+            session_id VARCHAR(100),
+            source VARCHAR(20) NOT NULL, -- server, web, miniapp
+            plan VARCHAR(50), -- код тарифа пользователя на момент события
+            properties JSONB NOT NULL DEFAULT '{}',
+            occurred_at TIMESTAMPTZ NOT NULL,
+            received_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            PRIMARY KEY (id, occurred_at),
+            UNIQUE (insert_id, occurred_at)
+        ) PARTITION BY RANGE (occurred_at);
+
+        CREATE INDEX IF NOT EXISTS idx_product_events_event ON product_events(event, occurred_at);
+        CREATE INDEX IF NOT EXISTS idx_product_events_user ON product_events(user_id, occurred_at);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблица событий продукта готова")
+    return nil
+}
+
+// createReportTables создаёт подписки на отчёты по расписанию, их получателей
+// (почта или чат Telegram, у каждого своя ссылка отписки) и историю доставки.
+func createReportTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS report_subscriptions (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            name VARCHAR(255) NOT NULL,
+            report VARCHAR(30) NOT NULL, -- pipeline_summary, sales_forecast, mrr, ai_usage, agent_results
+            filters JSONB NOT NULL DEFAULT '{}',
+            cadence VARCHAR(10) NOT NULL, -- daily, weekly, monthly
+            send_hour SMALLINT NOT NULL DEFAULT 9,
+            send_minute SMALLINT NOT NULL DEFAULT 0,
+            weekday SMALLINT NOT NULL DEFAULT 1, -- для weekly: 1 – понедельник … 7 – воскресенье
+            month_day SMALLINT NOT NULL DEFAULT 1, -- для monthly: 1–28
+            timezone VARCHAR(64) NOT NULL DEFAULT 'UTC',
+            formats TEXT[] NOT NULL DEFAULT '{}', -- вложения письма: xlsx, pdf
+            enabled BOOLEAN NOT NULL DEFAULT true,
+            next_run_at TIMESTAMPTZ NOT NULL,
+            last_run_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_report_subscriptions_user ON report_subscriptions(user_id);
+        CREATE INDEX IF NOT EXISTS idx_report_subscriptions_due ON report_subscriptions(next_run_at) WHERE enabled;
+
+        CREATE TABLE IF NOT EXISTS report_recipients (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            subscription_id UUID NOT NULL REFERENCES report_subscriptions(id) ON DELETE CASCADE,
+            channel VARCHAR(10) NOT NULL, -- email, telegram
+            address VARCHAR(255) NOT NULL, -- адрес почты или id чата Telegram
+            unsubscribe_token VARCHAR(64) NOT NULL UNIQUE,
+            unsubscribed_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            UNIQUE (subscription_id, channel, address)
+        );
+
+        CREATE TABLE IF NOT EXISTS report_deliveries (
+            id BIGSERIAL PRIMARY KEY,
+            subscription_id UUID NOT NULL REFERENCES report_subscriptions(id) ON DELETE CASCADE,
+            recipient_id UUID REFERENCES report_recipients(id) ON DELETE SET NULL,
+            channel VARCHAR(10) NOT NULL,
+            address VARCHAR(255) NOT NULL,
+            status VARCHAR(10) NOT NULL, -- sent, failed
+            error TEXT,
+            period_from DATE NOT NULL,
+            period_to DATE NOT NULL, -- не включая
+            sent_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_report_deliveries_subscription ON report_deliveries(subscription_id, sent_at DESC);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы отчётов по расписанию готовы")
+    return nil
+}
+
+// createAlertTables создаёт правила оповещений по дневным метрикам сервиса и сами оповещения.
+// На правило приходится не больше одного незакрытого оповещения (open или snoozed).
+func createAlertTables() error {
+    _, err := Pool.Exec(context.Background(), `
+        CREATE TABLE IF NOT EXISTS analytics_alert_rules (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+            account_id TEXT, -- не используется: метрики считаются по всему сервису
+            name VARCHAR(255) NOT NULL,
+            metric VARCHAR(50) NOT NULL, -- revenue, new_customers, active_subscriptions
+            kind VARCHAR(10) NOT NULL, -- threshold, zscore, seasonal
+            direction VARCHAR(10) NOT NULL DEFAULT 'below', -- above, below, both
+            threshold DOUBLE PRECISION NOT NULL, -- граница значения или допустимое отклонение в сигмах
+            window_days INT NOT NULL DEFAULT 28, -- для seasonal – число недель
+            min_points INT NOT NULL DEFAULT 7,
+            severity VARCHAR(10) NOT NULL DEFAULT 'warning', -- info, warning, critical
+            channels TEXT[] NOT NULL DEFAULT '{telegram,email}',
+            enabled BOOLEAN NOT NULL DEFAULT true,
+            last_evaluated_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE INDEX IF NOT EXISTS idx_analytics_alert_rules_user ON analytics_alert_rules(user_id);
+
+        CREATE TABLE IF NOT EXISTS analytics_alerts (
+            id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+            rule_id UUID NOT NULL REFERENCES analytics_alert_rules(id) ON DELETE CASCADE,
+            status VARCHAR(10) NOT NULL DEFAULT 'open', -- open, snoozed, resolved
+            first_metric_date DATE NOT NULL,
+            last_metric_date DATE NOT NULL,
+            value DOUBLE PRECISION NOT NULL,
+            expected DOUBLE PRECISION,
+            score DOUBLE PRECISION,
+            occurrences INT NOT NULL DEFAULT 1,
+            message TEXT NOT NULL DEFAULT '',
+            snoozed_until TIMESTAMPTZ,
+            resolved_at TIMESTAMPTZ,
+            resolved_by UUID REFERENCES users(id) ON DELETE SET NULL,
+            resolution VARCHAR(10), -- manual, auto
+            notified_at TIMESTAMPTZ,
+            created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+            updated_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+        );
+        CREATE UNIQUE INDEX IF NOT EXISTS idx_analytics_alerts_active ON analytics_alerts(rule_id) WHERE status <> 'resolved';
+        CREATE INDEX IF NOT EXISTS idx_analytics_alerts_rule ON analytics_alerts(rule_id, created_at DESC);
+    `)
+    if err != nil {
+        return err
+    }
+    log.Println("✅ Таблицы оповещений по метрикам готовы")
+    return nil
+}
+
 // createTestUser создаёт тестового пользователя, если таблица пуста
 func createTestUser() error {
     var count int
@@ -4,6 +4,7 @@ import (
     "encoding/json"
     "net/http"
     "strconv"
+    "strings"
     "subscription-system/database"
     "subscription-system/models"
     "github.com/gin-gonic/gin"
@@ -32,6 +33,8 @@ func AdminCreatePlanHandler(c *gin.Context) {
         MaxUsers     int      `json:"max_users"`
         AIQuota      int64    `json:"ai_quota"`
         AIModels     []string `json:"ai_models"`
+        RateLimit    *int     `json:"rate_limit_per_minute" binding:"omitempty,gt=0"`
+        MaxUploadMB  *int     `json:"max_upload_mb" binding:"omitempty,gt=0"`
         IsActive     bool     `json:"is_active"`
         SortOrder    int      `json:"sort_order"`
     }
@@ -43,14 +46,27 @@ func AdminCreatePlanHandler(c *gin.Context) {
     featuresJSON, _ := json.Marshal(req.Features)
     aiModelsJSON, _ := json.Marshal(req.AIModels)
 
+    columns := `name, code, description, price_monthly, price_yearly, currency, features, max_users, ai_quota, ai_models, is_active, sort_order`
+    args := []interface{}{req.Name, req.Code, req.Description, req.PriceMonthly, req.PriceYearly, req.Currency,
+        featuresJSON, req.MaxUsers, req.AIQuota, aiModelsJSON, req.IsActive, req.SortOrder}
+    // Не заданные лимиты не передаём, чтобы сработали DEFAULT колонок (60 запросов в минуту, 10 МБ)
+    if req.RateLimit != nil {
+        columns += `, rate_limit_per_minute`
+        args = append(args, *req.RateLimit)
+    }
+    if req.MaxUploadMB != nil {
+        columns += `, max_upload_mb`
+        args = append(args, *req.MaxUploadMB)
+    }
+    placeholders := make([]string, len(args))
+    for i := range args {
+        placeholders[i] = "$" + strconv.Itoa(i+1)
+    }
+
     var id int
-    err := database.Pool.QueryRow(c.Request.Context(), `
-        INSERT INTO subscription_plans 
-            (name, code, description, price_monthly, price_yearly, currency, features, max_users, ai_quota, ai_models, is_active, sort_order)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
-        RETURNING id
-    `, req.Name, req.Code, req.Description, req.PriceMonthly, req.PriceYearly, req.Currency,
-        featuresJSON, req.MaxUsers, req.AIQuota, aiModelsJSON, req.IsActive, req.SortOrder).Scan(&id)
+    err := database.Pool.QueryRow(c.Request.Context(),
+        `INSERT INTO subscription_plans (`+columns+`) VALUES (`+strings.Join(placeholders, ", ")+`) RETURNING id`,
+        args...).Scan(&id)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
         return
@@ -78,6 +94,8 @@ func AdminUpdatePlanHandler(c *gin.Context) {
         MaxUsers     int      `json:"max_users"`
         AIQuota      int64    `json:"ai_quota"`
         AIModels     []string `json:"ai_models"`
+        RateLimit    int      `json:"rate_limit_per_minute" binding:"omitempty,gt=0"`
+        MaxUploadMB  int      `json:"max_upload_mb" binding:"omitempty,gt=0"`
         IsActive     *bool    `json:"is_active"`
         SortOrder    int      `json:"sort_order"`
     }
@@ -143,6 +161,16 @@ func AdminUpdatePlanHandler(c *gin.Context) {
         args = append(args, aiModelsJSON)
         argPos++
     }
+    if req.RateLimit != 0 {
+        query += `, rate_limit_per_minute = $` + strconv.Itoa(argPos)
+        args = append(args, req.RateLimit)
+        argPos++
+    }
+    if req.MaxUploadMB != 0 {
+        query += `, max_upload_mb = $` + strconv.Itoa(argPos)
+        args = append(args, req.MaxUploadMB)
+        argPos++
+    }
     if req.IsActive != nil {
         query += `, is_active = $` + strconv.Itoa(argPos)
         args = append(args, *req.IsActive)
@@ -1,11 +1,15 @@
 package handlers
 
 import (
+"errors"
 "net/http"
 "strconv"
+"subscription-system/logging"
 "subscription-system/models"
+"subscription-system/services"
 
 "github.com/gin-gonic/gin"
+"go.uber.org/zap"
 )
 
 // AdminSubscriptionsHandler отображает страницу со списком подписок
@@ -60,6 +64,7 @@ if err != nil {
 c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось отменить подписку"})
 return
 }
+enqueueSubscriptionWebhook(c, subID, models.WebhookEventSubscriptionCanceled, gin.H{"immediate": req.Immediate})
 c.JSON(http.StatusOK, gin.H{"message": "Подписка отменена"})
 }
 
@@ -71,5 +76,51 @@ if err != nil {
 c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось активировать подписку"})
 return
 }
+enqueueSubscriptionWebhook(c, subID, models.WebhookEventSubscriptionReactivate, nil)
 c.JSON(http.StatusOK, gin.H{"message": "Подписка реактивирована"})
 }
+
+// enqueueSubscriptionWebhook отправляет подписчикам вебхуков событие с текущим состоянием подписки
+func enqueueSubscriptionWebhook(c *gin.Context, subID, eventType string, extra gin.H) {
+ownerID, data, err := models.SubscriptionEventData(c.Request.Context(), subID)
+if err != nil {
+logging.FromContext(c.Request.Context()).Warn("⚠️ Не удалось подготовить вебхук подписки",
+zap.String("event_type", eventType), zap.String("subscription_id", subID), zap.Error(err))
+return
+}
+for k, v := range extra {
+data[k] = v
+}
+enqueueWebhook(c, &ownerID, eventType, data)
+}
+
+// AdminCompletePaymentHandler – ручное проведение платежа: платёж помечается completed,
+// последняя активная подписка пользователя продлевается на месяц
+func AdminCompletePaymentHandler(c *gin.Context) {
+payment, err := models.AdminCompletePayment(c.Request.Context(), c.Param("id"))
+if errors.Is(err, models.ErrPaymentNotPending) {
+c.JSON(http.StatusNotFound, gin.H{"error": "Платёж не найден или уже проведён"})
+return
+}
+if err != nil {
+logging.FromContext(c.Request.Context()).Error("❌ Ошибка проведения платежа", zap.String("payment_id", c.Param("id")), zap.Error(err))
+c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось провести платёж"})
+return
+}
+enqueueWebhook(c, &payment.UserID, models.WebhookEventPaymentSucceeded, map[string]interface{}{
+"payment_id":   payment.ID,
+"user_id":      payment.UserID,
+"amount":       payment.Amount,
+"currency":     payment.Currency,
+"method":       payment.Method,
+"plan_name":    payment.PlanName,
+"completed_at": payment.CompletedAt,
+})
+services.TrackProductEvent(payment.UserID, models.ProductEventPaymentSucceeded, map[string]interface{}{
+"amount": payment.Amount, "currency": payment.Currency, "method": payment.Method,
+})
+if payment.SubscriptionID != "" {
+enqueueSubscriptionWebhook(c, payment.SubscriptionID, models.WebhookEventSubscriptionRenewed, gin.H{"payment_id": payment.ID})
+}
+c.JSON(http.StatusOK, payment)
+}
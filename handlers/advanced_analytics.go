@@ -4,23 +4,54 @@ import (
 "net/http"
 
 "github.com/gin-gonic/gin"
+"github.com/google/uuid"
+
+"subscription-system/models"
 )
 
-// GetLTVPredictions - получение прогнозов LTV
+// GetLTVPredictions - прогноз LTV: средний по текущему оттоку и по когортам первой оплаты (только администратор)
 func GetLTVPredictions(c *gin.Context) {
+if !isAdmin(c) {
+c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+return
+}
+summary, err := models.GetRevenueSummary(c.Request.Context())
+if err != nil {
+respondRevenueError(c, err)
+return
+}
+cohorts, err := models.GetRevenueCohorts(c.Request.Context(), 12)
+if err != nil {
+respondRevenueError(c, err)
+return
+}
 c.JSON(http.StatusOK, gin.H{
-"predictions": []gin.H{},
-"total": 0,
+"predicted_ltv": summary.PredictedLTV,
+"arpu": summary.ARPU,
+"monthly_logo_churn": summary.MonthlyLogoChurn,
+"expected_lifetime_months": summary.ExpectedLifetimeMonths,
+"predictions": cohorts,
+"total": len(cohorts),
 })
 }
 
-// GetCustomerLTV - прогноз LTV для конкретного клиента
+// GetCustomerLTV - выручка и прогноз LTV пользователя-подписчика (администратор или сам пользователь)
 func GetCustomerLTV(c *gin.Context) {
-c.JSON(http.StatusOK, gin.H{
-"customer_id": c.Param("id"),
-"predicted_ltv": 0,
-"confidence": 0,
-})
+id, err := uuid.Parse(c.Param("id"))
+if err != nil {
+c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+return
+}
+if !isAdmin(c) && getUserIDFromContext(c) != id.String() {
+c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+return
+}
+ltv, err := models.GetCustomerRevenue(c.Request.Context(), id)
+if err != nil {
+respondRevenueError(c, err)
+return
+}
+c.JSON(http.StatusOK, ltv)
 }
 
 // GetInsights - получение бизнес-инсайтов
@@ -39,12 +70,18 @@ c.JSON(http.StatusOK, gin.H{
 })
 }
 
-// RunCohortAnalysis - запуск когортного анализа
+// RunCohortAnalysis - матрица удержания по определению когорт (?definition_id=, ?periods=)
 func RunCohortAnalysis(c *gin.Context) {
-c.JSON(http.StatusOK, gin.H{
-"cohorts": []gin.H{},
-"months": 6,
-})
+id := c.Query("definition_id")
+if id == "" {
+c.JSON(http.StatusBadRequest, gin.H{"error": "definition_id is required"})
+return
+}
+matrix, ok := cohortMatrix(c, id)
+if !ok {
+return
+}
+c.JSON(http.StatusOK, matrix)
 }
 
 // GetPayments - получение списка платежей
@@ -6,7 +6,6 @@ import (
     "encoding/json"
     "fmt"
     "io"
-    "log"
     "net/http"
     "os"
     "strconv"
@@ -14,12 +13,16 @@ import (
     "time"
 
     "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
     "github.com/jackc/pgx/v5"
 
     "subscription-system/config"
     "subscription-system/database"
+    "subscription-system/logging"
     "subscription-system/internal/yandex_search"
     "subscription-system/models"
+    "subscription-system/monitoring"
+    "subscription-system/tracing"
 )
 
 type AskRequest struct {
@@ -60,16 +63,18 @@ type YandexGPTResponse struct {
 
 // ========== НОВЫЕ ФУНКЦИИ ДЛЯ РЕКОМЕНДАЦИЙ ==========
 
-// getStuckDeals возвращает сделки, которые не двигаются более 7 дней
+// getStuckDeals возвращает «протухшие» сделки: этап не менялся дольше порога rotting_days
+// этого этапа (для этапов без порога – дольше 7 дней)
 func getStuckDeals(ctx context.Context, userID string) ([]string, error) {
     rows, err := database.Pool.Query(ctx, `
-        SELECT d.title, d.stage, d.updated_at, c.name
+        SELECT d.title, COALESCE(ps.name, d.stage), d.stage_changed_at, c.name
         FROM crm_deals d
         JOIN crm_customers c ON c.id = d.customer_id
-        WHERE d.user_id = $1::uuid
-          AND d.stage NOT IN ('closed_won', 'closed_lost')
-          AND d.updated_at < NOW() - INTERVAL '7 days'
-        ORDER BY d.updated_at
+        LEFT JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+        WHERE d.user_id = $1::uuid AND d.deleted_at IS NULL
+          AND NOT COALESCE(ps.is_won OR ps.is_lost, false)
+          AND d.stage_changed_at < NOW() - COALESCE(ps.rotting_days, 7) * INTERVAL '1 day'
+        ORDER BY d.stage_changed_at
         LIMIT 10
     `, userID)
     if err != nil {
@@ -85,7 +90,7 @@ func getStuckDeals(ctx context.Context, userID string) ([]string, error) {
             continue
         }
         days := int(time.Since(updatedAt).Hours() / 24)
-        line := fmt.Sprintf("📌 Сделка \"%s\" (клиент: %s) на стадии \"%s\" не обновлялась %d дней. Рекомендуется связаться с клиентом.",
+        line := fmt.Sprintf("📌 Сделка \"%s\" (клиент: %s) на стадии \"%s\" не двигалась %d дней. Рекомендуется связаться с клиентом.",
             title, customerName, stage, days)
         recommendations = append(recommendations, line)
     }
@@ -97,7 +102,7 @@ func getInactiveHighValueClients(ctx context.Context, userID string) ([]string,
     rows, err := database.Pool.Query(ctx, `
         SELECT name, email, lead_score, last_seen
         FROM crm_customers
-        WHERE user_id = $1::uuid
+        WHERE user_id = $1::uuid AND deleted_at IS NULL
           AND lead_score > 0.5
           AND last_seen < NOW() - INTERVAL '14 days'
         ORDER BY lead_score DESC
@@ -130,9 +135,9 @@ func getUpcomingDeals(ctx context.Context, userID string) ([]string, error) {
         SELECT d.title, d.value, d.expected_close, c.name
         FROM crm_deals d
         JOIN crm_customers c ON c.id = d.customer_id
-        WHERE d.user_id = $1::uuid
+        WHERE d.user_id = $1::uuid AND d.deleted_at IS NULL
           AND d.expected_close BETWEEN NOW() AND NOW() + INTERVAL '7 days'
-          AND d.stage NOT IN ('closed_won', 'closed_lost')
+          AND ` + models.OpenDealSQL("d") + `
         ORDER BY d.expected_close
     `, userID)
     if err != nil {
@@ -161,17 +166,17 @@ func getSummaryStats(ctx context.Context, userID string) (map[string]interface{}
     stats := make(map[string]interface{})
 
     var totalDeals, activeDeals int
-    database.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM crm_deals WHERE user_id = $1", userID).Scan(&totalDeals)
-    database.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM crm_deals WHERE user_id = $1 AND stage NOT IN ('closed_won','closed_lost')", userID).Scan(&activeDeals)
+    database.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM crm_deals WHERE user_id = $1 AND deleted_at IS NULL", userID).Scan(&totalDeals)
+    database.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM crm_deals d WHERE d.user_id = $1 AND d.deleted_at IS NULL AND "+models.OpenDealSQL("d"), userID).Scan(&activeDeals)
     stats["total_deals"] = totalDeals
     stats["active_deals"] = activeDeals
 
     var totalCustomers int
-    database.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM crm_customers WHERE user_id = $1", userID).Scan(&totalCustomers)
+    database.Pool.QueryRow(ctx, "SELECT COUNT(*) FROM crm_customers WHERE user_id = $1 AND deleted_at IS NULL", userID).Scan(&totalCustomers)
     stats["total_customers"] = totalCustomers
 
     var totalValue float64
-    database.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(value),0) FROM crm_deals WHERE user_id = $1", userID).Scan(&totalValue)
+    database.Pool.QueryRow(ctx, "SELECT COALESCE(SUM(value),0) FROM crm_deals WHERE user_id = $1 AND deleted_at IS NULL", userID).Scan(&totalValue)
     stats["total_value"] = totalValue
 
     return stats, nil
@@ -188,7 +193,7 @@ func getCRMStats(ctx context.Context, userID string) (map[string]interface{}, er
     // Общее количество клиентов
     var totalCustomers int
     err := database.Pool.QueryRow(ctx, `
-        SELECT COUNT(*) FROM crm_customers WHERE user_id = $1::uuid
+        SELECT COUNT(*) FROM crm_customers WHERE user_id = $1::uuid AND deleted_at IS NULL
     `, userID).Scan(&totalCustomers)
     if err != nil && err != pgx.ErrNoRows {
         return nil, err
@@ -198,7 +203,7 @@ func getCRMStats(ctx context.Context, userID string) (map[string]interface{}, er
     // Общее количество сделок
     var totalDeals int
     err = database.Pool.QueryRow(ctx, `
-        SELECT COUNT(*) FROM crm_deals WHERE user_id = $1::uuid
+        SELECT COUNT(*) FROM crm_deals WHERE user_id = $1::uuid AND deleted_at IS NULL
     `, userID).Scan(&totalDeals)
     if err != nil && err != pgx.ErrNoRows {
         return nil, err
@@ -208,7 +213,7 @@ func getCRMStats(ctx context.Context, userID string) (map[string]interface{}, er
     // Общая сумма сделок
     var totalValue float64
     err = database.Pool.QueryRow(ctx, `
-        SELECT COALESCE(SUM(value), 0) FROM crm_deals WHERE user_id = $1::uuid
+        SELECT COALESCE(SUM(value), 0) FROM crm_deals WHERE user_id = $1::uuid AND deleted_at IS NULL
     `, userID).Scan(&totalValue)
     if err != nil && err != pgx.ErrNoRows {
         return nil, err
@@ -218,7 +223,7 @@ func getCRMStats(ctx context.Context, userID string) (map[string]interface{}, er
     // Распределение по стадиям
     rows, err := database.Pool.Query(ctx, `
         SELECT stage, COUNT(*) FROM crm_deals 
-        WHERE user_id = $1::uuid GROUP BY stage
+        WHERE user_id = $1::uuid AND deleted_at IS NULL GROUP BY stage
     `, userID)
     if err != nil {
         return nil, err
@@ -244,7 +249,7 @@ func getRecentCRMRecords(ctx context.Context, userID string, limit int) (custome
     rows, err := database.Pool.Query(ctx, `
         SELECT name, email, company, status
         FROM crm_customers
-        WHERE user_id = $1::uuid
+        WHERE user_id = $1::uuid AND deleted_at IS NULL
         ORDER BY created_at DESC
         LIMIT $2
     `, userID, limit)
@@ -265,7 +270,7 @@ func getRecentCRMRecords(ctx context.Context, userID string, limit int) (custome
     rows, err = database.Pool.Query(ctx, `
         SELECT title, value, stage, expected_close
         FROM crm_deals
-        WHERE user_id = $1::uuid
+        WHERE user_id = $1::uuid AND deleted_at IS NULL
         ORDER BY created_at DESC
         LIMIT $2
     `, userID, limit)
@@ -299,7 +304,7 @@ func searchCRM(ctx context.Context, userID, query string) ([]string, error) {
     rows, err := database.Pool.Query(ctx, `
         SELECT name, email, company, status
         FROM crm_customers
-        WHERE user_id = $1::uuid
+        WHERE user_id = $1::uuid AND deleted_at IS NULL
           AND (name ILIKE '%' || $2 || '%' 
                OR email ILIKE '%' || $2 || '%' 
                OR company ILIKE '%' || $2 || '%')
@@ -321,7 +326,7 @@ func searchCRM(ctx context.Context, userID, query string) ([]string, error) {
     rows, err = database.Pool.Query(ctx, `
         SELECT title, value, stage
         FROM crm_deals
-        WHERE user_id = $1::uuid
+        WHERE user_id = $1::uuid AND deleted_at IS NULL
           AND (title ILIKE '%' || $2 || '%' 
                OR comment ILIKE '%' || $2 || '%')
         LIMIT 5
@@ -593,7 +598,7 @@ func AIAskHandler(c *gin.Context) {
             // Получаем статистику CRM
             stats, err := getCRMStats(c.Request.Context(), userID.(string))
             if err != nil {
-                log.Printf("⚠️ Ошибка получения CRM-статистики: %v", err)
+                logging.FromContext(c.Request.Context()).Warn("⚠️ Ошибка получения CRM-статистики", zap.Error(err))
             } else {
                 extraInfo = append(extraInfo, fmt.Sprintf("📊 Статистика CRM:\n- Клиентов: %v\n- Сделок: %v\n- Общая сумма: %.2f руб.",
                     stats["total_customers"], stats["total_deals"], stats["total_value"]))
@@ -609,7 +614,7 @@ func AIAskHandler(c *gin.Context) {
             // Получаем последние записи
             recentCustomers, recentDeals, err := getRecentCRMRecords(c.Request.Context(), userID.(string), 5)
             if err != nil {
-                log.Printf("⚠️ Ошибка получения последних записей CRM: %v", err)
+                logging.FromContext(c.Request.Context()).Warn("⚠️ Ошибка получения последних записей CRM", zap.Error(err))
             } else {
                 if len(recentCustomers) > 0 {
                     extraInfo = append(extraInfo, "🆕 Последние клиенты:\n"+strings.Join(recentCustomers, "\n"))
@@ -624,7 +629,7 @@ func AIAskHandler(c *gin.Context) {
             if strings.Contains(lowerQ, "найди") || strings.Contains(lowerQ, "поиск") || strings.Contains(lowerQ, "кто") || strings.Contains(lowerQ, "что") {
                 searchResults, err := searchCRM(c.Request.Context(), userID.(string), req.Question)
                 if err != nil {
-                    log.Printf("⚠️ Ошибка поиска по CRM: %v", err)
+                    logging.FromContext(c.Request.Context()).Warn("⚠️ Ошибка поиска по CRM", zap.Error(err))
                 } else if len(searchResults) > 0 {
                     extraInfo = append(extraInfo, "🔍 Результаты поиска по CRM:\n"+strings.Join(searchResults, "\n"))
                 }
@@ -689,7 +694,7 @@ func AIAskHandler(c *gin.Context) {
         // База знаний платформы
         kbDocs, err := models.SearchSimilar(userID.(string), req.Question, 5)
         if err != nil {
-            log.Printf("Ошибка поиска в KB: %v", err)
+            logging.FromContext(c.Request.Context()).Warn("⚠️ Ошибка поиска в KB", zap.Error(err))
             kbDocs = []models.KnowledgeBase{}
         }
         if len(kbDocs) > 0 {
@@ -711,8 +716,7 @@ func AIAskHandler(c *gin.Context) {
     contextPrompt := sb.String()
 
     // ПРОВЕРКА: выводим ключи для отладки
-    log.Printf("YandexFolderID: %s", cfg.YandexFolderID)
-    log.Printf("YandexAPIKey: %s", maskString(cfg.YandexAPIKey))
+    logging.FromContext(c.Request.Context()).Debug("YandexGPT config", zap.String("folder_id", cfg.YandexFolderID), zap.String("api_key", maskString(cfg.YandexAPIKey)))
 
     if cfg.YandexFolderID == "" || cfg.YandexAPIKey == "" {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "YandexGPT API key not configured"})
@@ -732,7 +736,7 @@ func AIAskHandler(c *gin.Context) {
                 WHERE user_id = $1::uuid AND status = 'active'
             `, userID)
             if err != nil {
-                log.Printf("❌ Ошибка сброса квоты: %v", err)
+                logging.FromContext(c.Request.Context()).Error("❌ Ошибка сброса квоты", zap.Error(err))
             }
             subscription.AIQuotaUsed = 0
         }
@@ -768,10 +772,10 @@ func AIAskHandler(c *gin.Context) {
     }
 
     jsonData, _ := json.Marshal(yandexReq)
-    log.Println("📤 Отправка запроса в YandexGPT")
+    logging.FromContext(c.Request.Context()).Info("📤 Отправка запроса в YandexGPT")
 
-    client := &http.Client{Timeout: 30 * time.Second}
-    apiReq, err := http.NewRequest("POST", "https://llm.api.cloud.yandex.net/foundationModels/v1/completion", bytes.NewBuffer(jsonData))
+    client := tracing.NewHTTPClient("yandexgpt", 30*time.Second)
+    apiReq, err := http.NewRequestWithContext(c.Request.Context(), "POST", "https://llm.api.cloud.yandex.net/foundationModels/v1/completion", bytes.NewBuffer(jsonData))
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
         return
@@ -783,17 +787,18 @@ func AIAskHandler(c *gin.Context) {
 
     resp, err := client.Do(apiReq)
     if err != nil {
-        log.Printf("❌ Ошибка вызова YandexGPT: %v", err)
+        monitoring.AIRequestErrorsTotal.WithLabelValues("yandexgpt", "transport").Inc()
+        logging.FromContext(c.Request.Context()).Error("❌ Ошибка вызова YandexGPT", zap.Error(err))
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to call YandexGPT"})
         return
     }
     defer resp.Body.Close()
 
     bodyBytes, _ := io.ReadAll(resp.Body)
-    log.Printf("📥 Код ответа от YandexGPT: %d", resp.StatusCode)
-    log.Printf("📥 Тело ответа: %s", string(bodyBytes))
+    logging.FromContext(c.Request.Context()).Info("📥 Ответ YandexGPT", zap.Int("status", resp.StatusCode), zap.Int("bytes", len(bodyBytes)))
 
     if resp.StatusCode != http.StatusOK {
+        monitoring.AIRequestErrorsTotal.WithLabelValues("yandexgpt", "status").Inc()
         c.JSON(http.StatusInternalServerError, gin.H{
             "error":  "YandexGPT returned error",
             "status": resp.StatusCode,
@@ -804,11 +809,16 @@ func AIAskHandler(c *gin.Context) {
 
     var yandexResp YandexGPTResponse
     if err := json.Unmarshal(bodyBytes, &yandexResp); err != nil {
-        log.Printf("❌ Ошибка парсинга ответа: %v", err)
+        monitoring.AIRequestErrorsTotal.WithLabelValues("yandexgpt", "parse").Inc()
+        logging.FromContext(c.Request.Context()).Error("❌ Ошибка парсинга ответа YandexGPT", zap.Error(err))
         c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid response from YandexGPT"})
         return
     }
 
+    if tokens, err := strconv.Atoi(yandexResp.Result.Usage.TotalTokens); err == nil {
+        monitoring.AITokensTotal.WithLabelValues("yandexgpt", "yandexgpt-lite").Add(float64(tokens))
+    }
+
     if len(yandexResp.Result.Alternatives) == 0 {
         c.JSON(http.StatusOK, gin.H{
             "answer": "Не удалось получить ответ от AI.",
@@ -829,7 +839,7 @@ func AIAskHandler(c *gin.Context) {
             WHERE user_id = $2::uuid AND status = 'active'
         `, totalTokens, userID)
         if err != nil {
-            log.Printf("❌ Ошибка обновления ai_quota_used: %v", err)
+            logging.FromContext(c.Request.Context()).Error("❌ Ошибка обновления ai_quota_used", zap.Error(err))
         } else {
             caps := plan.GetAICapabilities()
             maxRequests := int(caps["max_requests"].(float64))
@@ -839,7 +849,7 @@ func AIAskHandler(c *gin.Context) {
                 "SELECT ai_quota_used FROM user_subscriptions WHERE user_id = $1::uuid AND status = 'active'",
                 userID).Scan(&newUsed)
 
-            log.Printf("✅ Списано %d токенов, осталось %d", totalTokens, maxRequests-newUsed)
+            logging.FromContext(c.Request.Context()).Info("✅ Списаны токены", zap.Int("tokens", totalTokens), zap.Int("remaining", maxRequests-newUsed))
         }
     }
     // ========== КОНЕЦ СПИСЫВАНИЯ ТОКЕНОВ ==========
@@ -1,7 +1,6 @@
 package handlers
 
 import (
-    "context"
     "fmt"
     "log"
     "net/http"
@@ -10,7 +9,7 @@ import (
 
     "github.com/gin-gonic/gin"
     "github.com/google/uuid"
-    "subscription-system/database"
+    "subscription-system/models"
 )
 
 type ConsultantRequest struct {
@@ -207,8 +206,8 @@ func handleCollectingMode(session *ConsultantSession, userMessage string, c *gin
         session.Data["name"] = name
         session.Data["contact"] = contact
 
-        // Сохраняем в базу данных
-        go saveConsultationToDB(session)
+        // Заявка сразу попадает в CRM как лид
+        saveConsultationLead(c, session)
 
         // Отправляем уведомление администратору
         notifyAdminAboutConsultation(session)
@@ -247,24 +246,17 @@ func findAnswer(question string) string {
     return "Я могу рассказать о тарифах, функциях CRM, интеграциях, оплате, поддержке, а также помочь оформить заявку на индивидуальную разработку. Что вас интересует?"
 }
 
-// Сохранение в базу данных
-func saveConsultationToDB(session *ConsultantSession) {
-    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-    defer cancel()
-
-    _, err := database.Pool.Exec(ctx, `
-        INSERT INTO individual_consultations 
-        (session_id, user_id, name, contact, service_type, description, budget, deadline, status, created_at, updated_at)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW(), NOW())
-    `, session.SessionID, session.UserID, session.Data["name"], session.Data["contact"],
-        session.Data["service_type"], session.Data["description"], session.Data["budget"],
-        session.Data["deadline"], "new")
-
+// saveConsultationLead проводит собранную заявку через общий поток лидов (клиент, ответственный, сделка).
+// Ошибка не прерывает диалог: заявка остаётся в логе уведомления администратора.
+func saveConsultationLead(c *gin.Context, session *ConsultantSession) {
+    in := models.ConsultantLead("", session.Data, nil)
+    in.IP, in.UserAgent = c.ClientIP(), c.Request.UserAgent()
+    res, err := captureChannelLead(c, in)
     if err != nil {
-        log.Printf("Ошибка сохранения консультации: %v", err)
-    } else {
-        log.Printf("✅ Консультация сохранена в БД, session_id: %s", session.SessionID)
+        log.Printf("❌ Ошибка сохранения заявки консультанта %s: %v", session.SessionID, err)
+        return
     }
+    log.Printf("✅ Заявка консультанта сохранена как лид, клиент %s, session_id: %s", res.CustomerID, session.SessionID)
 }
 
 // Уведомление администратора
@@ -0,0 +1,297 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Оповещения по дневным метрикам аналитики (выручка, новые клиенты, подписки): правила
+// с порогом или статистической проверкой, список оповещений, откладывание и закрытие.
+// Проверку по расписанию и уведомления ведёт AlertService.
+
+var alertService *services.AlertService
+
+// alertMaxSnooze – дольше откладывать нельзя, чтобы оповещение не потерялось
+const alertMaxSnooze = 30 * 24 * time.Hour
+
+// InitAlerts подключает сервис оповещений (вызывается из main)
+func InitAlerts(s *services.AlertService) {
+	alertService = s
+}
+
+// respondAlertError переводит ошибки оповещений в HTTP-ответ
+func respondAlertError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidAlertRule):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrAlertRuleNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert rule not found"})
+	case errors.Is(err, models.ErrAlertNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Alert not found"})
+	case errors.Is(err, models.ErrAlertResolved):
+		c.JSON(http.StatusConflict, gin.H{"error": "Alert is already resolved"})
+	default:
+		log.Printf("❌ Ошибка оповещений по метрикам: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// alertRuleRequest – тело создания и изменения правила; пустые поля не меняются
+type alertRuleRequest struct {
+	AccountID  *string   `json:"account_id"`
+	Name       *string   `json:"name"`
+	Metric     *string   `json:"metric"`
+	Kind       *string   `json:"kind"`
+	Direction  *string   `json:"direction"`
+	Threshold  *float64  `json:"threshold"`
+	WindowDays *int      `json:"window_days"`
+	MinPoints  *int      `json:"min_points"`
+	Severity   *string   `json:"severity"`
+	Channels   *[]string `json:"channels"`
+	Enabled    *bool     `json:"enabled"`
+}
+
+func (r *alertRuleRequest) apply(rule *models.AlertRule) {
+	if r.AccountID != nil {
+		rule.AccountID = r.AccountID
+	}
+	if r.Name != nil {
+		rule.Name = *r.Name
+	}
+	if r.Metric != nil {
+		rule.Metric = *r.Metric
+	}
+	if r.Kind != nil {
+		rule.Kind = *r.Kind
+	}
+	if r.Direction != nil {
+		rule.Direction = *r.Direction
+	}
+	if r.Threshold != nil {
+		rule.Threshold = *r.Threshold
+	}
+	if r.WindowDays != nil {
+		rule.WindowDays = *r.WindowDays
+	}
+	if r.MinPoints != nil {
+		rule.MinPoints = *r.MinPoints
+	}
+	if r.Severity != nil {
+		rule.Severity = *r.Severity
+	}
+	if r.Channels != nil {
+		rule.Channels = *r.Channels
+		if rule.Channels == nil {
+			rule.Channels = []string{}
+		}
+	}
+	if r.Enabled != nil {
+		rule.Enabled = *r.Enabled
+	}
+}
+
+// bindAlertRule собирает новое правило из тела запроса; при ошибке ответ уже отправлен
+func bindAlertRule(c *gin.Context) (*models.AlertRule, bool) {
+	var req alertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	rule := &models.AlertRule{UserID: getUserIDFromContext(c), Kind: models.AlertKindZScore, Enabled: true}
+	req.apply(rule)
+	if err := rule.Normalize(); err != nil {
+		respondAlertError(c, err)
+		return nil, false
+	}
+	return rule, true
+}
+
+// GetAlertOptions – метрики и допустимые значения полей правила
+func GetAlertOptions(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"metrics":    models.AlertMetrics,
+		"kinds":      []string{models.AlertKindThreshold, models.AlertKindZScore, models.AlertKindSeasonal},
+		"directions": []string{models.AlertDirectionAbove, models.AlertDirectionBelow, models.AlertDirectionBoth},
+		"severities": []string{models.AlertSeverityInfo, models.AlertSeverityWarning, models.AlertSeverityCritical},
+		"channels":   []string{models.AlertChannelTelegram, models.AlertChannelEmail},
+	})
+}
+
+// GetAlertRules – правила оповещений
+func GetAlertRules(c *gin.Context) {
+	page, pageSize := getPaginationParams(c)
+	rules, total, err := models.ListAlertRules(c.Request.Context(), pageSize, (page-1)*pageSize)
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        rules,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetAlertRule – правило
+func GetAlertRule(c *gin.Context) {
+	rule, err := models.GetAlertRule(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// CreateAlertRule создаёт правило (по умолчанию – zscore, падение на 3σ за 28 дней);
+// уведомления получает создатель правила
+func CreateAlertRule(c *gin.Context) {
+	rule, ok := bindAlertRule(c)
+	if !ok {
+		return
+	}
+	if err := models.CreateAlertRule(c.Request.Context(), rule); err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, rule)
+}
+
+// TestAlertRule проверяет правило из тела запроса на текущих данных, ничего не сохраняя
+func TestAlertRule(c *gin.Context) {
+	rule, ok := bindAlertRule(c)
+	if !ok {
+		return
+	}
+	ev, err := models.EvaluateAlertRule(c.Request.Context(), rule)
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, ev)
+}
+
+// UpdateAlertRule меняет правило; незакрытое оповещение следующая проверка оценит по новым условиям
+func UpdateAlertRule(c *gin.Context) {
+	rule, err := models.GetAlertRule(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	var req alertRuleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.apply(rule)
+	if err := rule.Normalize(); err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	if err := models.UpdateAlertRule(c.Request.Context(), rule); err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, rule)
+}
+
+// DeleteAlertRule удаляет правило вместе с его оповещениями
+func DeleteAlertRule(c *gin.Context) {
+	if err := models.DeleteAlertRule(c.Request.Context(), c.Param("id")); err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Alert rule deleted"})
+}
+
+// CheckAlertRule проверяет правило немедленно: как по расписанию, с открытием или закрытием
+// оповещения и уведомлениями
+func CheckAlertRule(c *gin.Context) {
+	rule, err := models.GetAlertRule(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	ev, t, err := alertService.Check(c.Request.Context(), rule)
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"evaluation": ev, "alert": t.Alert, "event": t.Event})
+}
+
+// GetAlerts – оповещения, новые сначала (?status=open|snoozed|resolved, ?rule_id=)
+func GetAlerts(c *gin.Context) {
+	status := c.Query("status")
+	if status != "" && status != models.AlertStatusOpen && status != models.AlertStatusSnoozed && status != models.AlertStatusResolved {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be open, snoozed or resolved"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	list, total, err := models.ListAlerts(c.Request.Context(), status, c.Query("rule_id"), pageSize, (page-1)*pageSize)
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        list,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetAlert – оповещение
+func GetAlert(c *gin.Context) {
+	a, err := models.GetAlert(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// SnoozeAlert откладывает оповещение на minutes минут или до until
+func SnoozeAlert(c *gin.Context) {
+	var req struct {
+		Minutes int        `json:"minutes"`
+		Until   *time.Time `json:"until"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	until := time.Now().Add(time.Duration(req.Minutes) * time.Minute)
+	if req.Until != nil {
+		until = *req.Until
+	}
+	if !until.After(time.Now()) || time.Until(until) > alertMaxSnooze {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Snooze must end in the future and within 30 days"})
+		return
+	}
+	a, err := models.SnoozeAlert(c.Request.Context(), c.Param("id"), until)
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
+
+// ResolveAlert закрывает оповещение вручную
+func ResolveAlert(c *gin.Context) {
+	a, err := models.ResolveAlert(c.Request.Context(), c.Param("id"), getUserIDFromContext(c))
+	if err != nil {
+		respondAlertError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, a)
+}
@@ -1,12 +1,47 @@
 package handlers
 
 import (
+    "errors"
+    "io"
+    "log"
     "net/http"
+    "strconv"
     "subscription-system/models"
+    "time"
 
     "github.com/gin-gonic/gin"
 )
 
+// apiKeyPolicyRequest - ограничения ключа в запросах создания и обновления
+type apiKeyPolicyRequest struct {
+    Scopes             []string   `json:"scopes"`
+    ExpiresAt          *time.Time `json:"expires_at"`
+    ExpiresInDays      int        `json:"expires_in_days"`
+    RateLimitPerMinute int        `json:"rate_limit_per_minute"`
+    AllowedCIDRs       []string   `json:"allowed_cidrs"`
+}
+
+// toOptions проверяет запрос и превращает его в models.APIKeyOptions
+func (r apiKeyPolicyRequest) toOptions() (models.APIKeyOptions, error) {
+    opts := models.APIKeyOptions{
+        Scopes:             r.Scopes,
+        ExpiresAt:          r.ExpiresAt,
+        RateLimitPerMinute: r.RateLimitPerMinute,
+        AllowedCIDRs:       r.AllowedCIDRs,
+    }
+    if opts.ExpiresAt == nil && r.ExpiresInDays > 0 {
+        expiresAt := time.Now().AddDate(0, 0, r.ExpiresInDays)
+        opts.ExpiresAt = &expiresAt
+    }
+    err := models.ValidateAPIKeyOptions(&opts)
+    return opts, err
+}
+
+// canManageAPIKey - управлять ключом может владелец или администратор
+func canManageAPIKey(c *gin.Context, key *models.APIKey) bool {
+    return isAdmin(c) || key.UserID == getUserIDFromContext(c)
+}
+
 // CreateAPIKeyHandler - создание ключа
 func CreateAPIKeyHandler(c *gin.Context) {
     var req struct {
@@ -14,6 +49,7 @@ func CreateAPIKeyHandler(c *gin.Context) {
         Name     string                 `json:"name" binding:"required"`
         Creds    map[string]interface{} `json:"credentials"`
         Quota    int64                  `json:"quota_limit"`
+        apiKeyPolicyRequest
     }
 
     if err := c.ShouldBindJSON(&req); err != nil {
@@ -21,7 +57,13 @@ func CreateAPIKeyHandler(c *gin.Context) {
         return
     }
 
-    rawKey, apiKey, err := models.GenerateAPIKey(req.UserID, req.Name, req.Creds, req.Quota)
+    opts, err := req.toOptions()
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    rawKey, apiKey, err := models.GenerateScopedAPIKey(req.UserID, req.Name, req.Creds, req.Quota, opts)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
         return
@@ -34,6 +76,118 @@ func CreateAPIKeyHandler(c *gin.Context) {
     })
 }
 
+// GetAPIKeyScopesHandler - список доступных скоупов
+func GetAPIKeyScopesHandler(c *gin.Context) {
+    c.JSON(http.StatusOK, gin.H{"scopes": models.APIKeyScopes})
+}
+
+// UpdateAPIKeyPolicyHandler - изменение скоупов, срока действия, лимита и allowlist
+func UpdateAPIKeyPolicyHandler(c *gin.Context) {
+    key, err := models.GetAPIKeyByID(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+        return
+    }
+    if !canManageAPIKey(c, key) {
+        c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+        return
+    }
+
+    var req apiKeyPolicyRequest
+    if err := c.ShouldBindJSON(&req); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    opts, err := req.toOptions()
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    if err := models.UpdateAPIKeyPolicy(key.ID, opts); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// RotateAPIKeyHandler - ротация ключа с окном перекрытия
+func RotateAPIKeyHandler(c *gin.Context) {
+    key, err := models.GetAPIKeyByID(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+        return
+    }
+    if !canManageAPIKey(c, key) {
+        c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+        return
+    }
+
+    var req struct {
+        OverlapHours *int `json:"overlap_hours"`
+    }
+    if err := c.ShouldBindJSON(&req); err != nil && err != io.EOF {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+    overlap := 24 * time.Hour
+    if req.OverlapHours != nil {
+        overlap = time.Duration(*req.OverlapHours) * time.Hour
+    }
+
+    rawKey, newKey, oldExpiresAt, err := models.RotateAPIKey(key.ID, overlap)
+    if err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, gin.H{
+        "success":        true,
+        "raw_key":        rawKey, // показываем только один раз!
+        "api_key":        newKey,
+        "old_key_id":     key.ID,
+        "old_expires_at": oldExpiresAt,
+    })
+}
+
+// GetAPIKeyUsageHandler - использование ключа по дням
+func GetAPIKeyUsageHandler(c *gin.Context) {
+    key, err := models.GetAPIKeyByID(c.Param("id"))
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "key not found"})
+        return
+    }
+    if !canManageAPIKey(c, key) {
+        c.JSON(http.StatusForbidden, gin.H{"error": "access denied"})
+        return
+    }
+
+    days, err := strconv.Atoi(c.DefaultQuery("days", "30"))
+    if err != nil || days < 1 || days > 365 {
+        days = 30
+    }
+    usage, err := models.GetAPIKeyUsage(key.ID, days)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    var total, rejected int64
+    for _, u := range usage {
+        total += u.Requests
+        rejected += u.Rejected
+    }
+    c.JSON(http.StatusOK, gin.H{
+        "key_id":       key.ID,
+        "days":         days,
+        "usage":        usage,
+        "total":        total,
+        "rejected":     rejected,
+        "last_used_at": key.LastUsedAt,
+        "last_used_ip": key.LastUsedIP,
+    })
+}
+
 // GetUserAPIKeysHandler - список ключей пользователя
 func GetUserAPIKeysHandler(c *gin.Context) {
     userID := c.Query("user_id")
@@ -87,6 +241,11 @@ func ValidateAPIKeyHandler(c *gin.Context) {
     }
 
     apiKey, err := models.VerifyAPIKey(req.Key)
+    if err != nil && !errors.Is(err, models.ErrInvalidAPIKey) {
+        log.Printf("❌ Ошибка проверки API-ключа: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "API key verification failed"})
+        return
+    }
     if err != nil {
         c.JSON(http.StatusUnauthorized, gin.H{
             "valid": false,
@@ -95,10 +254,20 @@ func ValidateAPIKeyHandler(c *gin.Context) {
         return
     }
 
+    if apiKey.IsExpired() {
+        c.JSON(http.StatusUnauthorized, gin.H{
+            "valid": false,
+            "error": "key expired",
+        })
+        return
+    }
+
     c.JSON(http.StatusOK, gin.H{
-        "valid":   true,
-        "user_id": apiKey.UserID,
-        "quota":   apiKey.QuotaLimit - apiKey.QuotaUsed,
+        "valid":      true,
+        "user_id":    apiKey.UserID,
+        "quota":      apiKey.QuotaLimit - apiKey.QuotaUsed,
+        "scopes":     apiKey.Scopes,
+        "expires_at": apiKey.ExpiresAt,
     })
 }
 
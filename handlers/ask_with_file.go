@@ -7,14 +7,17 @@ import (
     "encoding/json"
     "fmt"
     "io"
-    "log"
     "net/http"
     "os"
     "time"
 
     "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
     "subscription-system/config"
     "subscription-system/database"
+    "subscription-system/logging"
+    "subscription-system/monitoring"
+    "subscription-system/tracing"
 )
 
 type VisionRequest struct {
@@ -40,7 +43,7 @@ func AskWithFileHandler(c *gin.Context) {
             var id string
             err := database.Pool.QueryRow(c.Request.Context(), "SELECT id FROM users ORDER BY created_at LIMIT 1").Scan(&id)
             if err != nil {
-                log.Printf("AskWithFileHandler: no users found: %v", err)
+                logging.FromContext(c.Request.Context()).Error("AskWithFileHandler: no users found", zap.Error(err))
                 c.JSON(http.StatusInternalServerError, gin.H{"error": "no users found"})
                 return
             }
@@ -54,7 +57,7 @@ func AskWithFileHandler(c *gin.Context) {
     question := c.PostForm("question")
     file, header, err := c.Request.FormFile("file")
     if err != nil {
-        log.Printf("AskWithFileHandler: no file uploaded: %v", err)
+        logging.FromContext(c.Request.Context()).Warn("AskWithFileHandler: no file uploaded", zap.Error(err))
         c.JSON(http.StatusBadRequest, gin.H{"error": "file required"})
         return
     }
@@ -62,7 +65,7 @@ func AskWithFileHandler(c *gin.Context) {
 
     fileBytes, err := io.ReadAll(file)
     if err != nil {
-        log.Printf("AskWithFileHandler: failed to read file: %v", err)
+        logging.FromContext(c.Request.Context()).Error("AskWithFileHandler: failed to read file", zap.Error(err))
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file"})
         return
     }
@@ -77,7 +80,7 @@ func AskWithFileHandler(c *gin.Context) {
 
     openRouterKey := os.Getenv("OPENROUTER_API_KEY")
     if openRouterKey == "" {
-        log.Printf("AskWithFileHandler: OPENROUTER_API_KEY not set")
+        logging.FromContext(c.Request.Context()).Error("AskWithFileHandler: OPENROUTER_API_KEY not set")
         c.JSON(http.StatusInternalServerError, gin.H{"error": "OpenRouter key not configured"})
         return
     }
@@ -122,30 +125,32 @@ func AskWithFileHandler(c *gin.Context) {
     }
 
     jsonBody, _ := json.Marshal(visionReq)
-    log.Printf("AskWithFileHandler: sending request to OpenRouter, model=%s, question=%s", visionReq.Model, question)
+    logging.FromContext(c.Request.Context()).Info("AskWithFileHandler: sending request to OpenRouter", zap.String("model", visionReq.Model), zap.Int("question_len", len(question)))
 
-    req, err := http.NewRequest("POST", "https://openrouter.ai/api/v1/chat/completions", bytes.NewBuffer(jsonBody))
+    req, err := http.NewRequestWithContext(c.Request.Context(), "POST", "https://openrouter.ai/api/v1/chat/completions", bytes.NewBuffer(jsonBody))
     if err != nil {
-        log.Printf("AskWithFileHandler: error creating request: %v", err)
+        logging.FromContext(c.Request.Context()).Error("AskWithFileHandler: error creating request", zap.Error(err))
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to create request"})
         return
     }
     req.Header.Set("Authorization", "Bearer "+openRouterKey)
     req.Header.Set("Content-Type", "application/json")
 
-    client := &http.Client{Timeout: 30 * time.Second}
+    client := tracing.NewHTTPClient("openrouter", 30*time.Second)
     resp, err := client.Do(req)
     if err != nil {
-        log.Printf("AskWithFileHandler: OpenRouter request failed: %v", err)
+        monitoring.AIRequestErrorsTotal.WithLabelValues("openrouter", "transport").Inc()
+        logging.FromContext(c.Request.Context()).Error("AskWithFileHandler: OpenRouter request failed", zap.Error(err))
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to call AI: " + err.Error()})
         return
     }
     defer resp.Body.Close()
 
     bodyBytes, _ := io.ReadAll(resp.Body)
-    log.Printf("AskWithFileHandler: OpenRouter response status=%d, body=%s", resp.StatusCode, string(bodyBytes))
+    logging.FromContext(c.Request.Context()).Info("AskWithFileHandler: OpenRouter response", zap.Int("status", resp.StatusCode), zap.Int("bytes", len(bodyBytes)))
 
     if resp.StatusCode != http.StatusOK {
+        monitoring.AIRequestErrorsTotal.WithLabelValues("openrouter", "status").Inc()
         // Пытаемся распарсить ошибку OpenRouter
         var errResp struct {
             Error struct {
@@ -161,18 +166,29 @@ func AskWithFileHandler(c *gin.Context) {
     }
 
     var result struct {
+        Model   string `json:"model"`
         Choices []struct {
             Message struct {
                 Content string `json:"content"`
             } `json:"message"`
         } `json:"choices"`
+        Usage struct {
+            TotalTokens int `json:"total_tokens"`
+        } `json:"usage"`
     }
     if err := json.Unmarshal(bodyBytes, &result); err != nil {
-        log.Printf("AskWithFileHandler: JSON parse error: %v", err)
+        monitoring.AIRequestErrorsTotal.WithLabelValues("openrouter", "parse").Inc()
+        logging.FromContext(c.Request.Context()).Error("AskWithFileHandler: JSON parse error", zap.Error(err))
         c.JSON(http.StatusInternalServerError, gin.H{"error": "invalid response"})
         return
     }
 
+    model := result.Model
+    if model == "" {
+        model = visionReq.Model
+    }
+    monitoring.AITokensTotal.WithLabelValues("openrouter", model).Add(float64(result.Usage.TotalTokens))
+
     if len(result.Choices) == 0 {
         c.JSON(http.StatusOK, gin.H{"answer": "No response from AI"})
         return
@@ -7,10 +7,13 @@ import (
     "time"
 
     "github.com/gin-gonic/gin"
+    "go.uber.org/zap"
     "golang.org/x/crypto/bcrypt"
     "subscription-system/config"
     "subscription-system/database"
+    "subscription-system/logging"
     "subscription-system/models"
+    "subscription-system/services"
     "subscription-system/utils"
 )
 
@@ -90,7 +93,7 @@ func LoginHandler(c *gin.Context) {
          VALUES ($1, $2, NOW() + $3 * interval '1 second', NOW())`,
         user.ID, refreshToken, int(refreshExpiry.Seconds()))
     if err != nil {
-        log.Printf("⚠️ Failed to save refresh token: %v", err)
+        logging.FromContext(c.Request.Context()).Warn("⚠️ Failed to save refresh token", zap.Error(err))
     }
 
     // Проверяем устройство
@@ -117,6 +120,7 @@ func LoginHandler(c *gin.Context) {
     database.Pool.Exec(context.Background(),
         "INSERT INTO login_history (user_id, ip_address, user_agent, login_time) VALUES ($1, $2, $3, $4)",
         userID, c.ClientIP(), c.GetHeader("User-Agent"), time.Now())
+    services.TrackProductEvent(userID, models.ProductEventLoggedIn, map[string]interface{}{"remember": req.Remember})
 
     c.JSON(http.StatusOK, gin.H{
         "success":       true,
@@ -148,7 +152,7 @@ func LogoutHandler(c *gin.Context) {
     _, err := database.Pool.Exec(c.Request.Context(),
         "DELETE FROM user_tokens WHERE token = $1", req.RefreshToken)
     if err != nil {
-        log.Printf("⚠️ Failed to delete refresh token: %v", err)
+        logging.FromContext(c.Request.Context()).Warn("⚠️ Failed to delete refresh token", zap.Error(err))
     }
 
     // Очищаем куки, если они используются
@@ -211,20 +215,23 @@ func RegisterHandler(c *gin.Context) {
     // Генерируем код подтверждения
     verificationCode, err := GenerateVerificationCode(user.ID, "email")
     if err != nil {
-        log.Printf("❌ Failed to generate verification code: %v", err)
+        logging.FromContext(c.Request.Context()).Error("❌ Failed to generate verification code", zap.Error(err))
     } else {
         // Отправляем код на email (в фоне)
+        logger := logging.FromContext(c.Request.Context()).With(zap.String("user_id", user.ID))
         go func() {
             emailService := utils.NewEmailService(config.Load())
             err := emailService.SendVerificationEmail(user.Email, user.Name, verificationCode)
             if err != nil {
-                log.Printf("❌ Failed to send verification email: %v", err)
+                logger.Error("❌ Failed to send verification email", zap.Error(err))
             } else {
-                log.Printf("✅ Verification email sent to %s", user.Email)
+                logger.Info("✅ Verification email sent")
             }
         }()
     }
 
+    services.TrackProductEvent(user.ID, models.ProductEventSignedUp, nil)
+
     // Генерируем токены (хотя пользователь ещё не верифицирован)
     accessToken, refreshToken, err := utils.GenerateTokens(user.ID, user.Role)
     if err != nil {
@@ -0,0 +1,123 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Прогноз оттока платящих подписчиков: версии модели (обучение, метрики, ручная активация)
+// и текущие прогнозы с вкладом признаков. Расписание ведёт ChurnService.
+
+var churnService *services.ChurnService
+
+// InitChurn подключает сервис прогноза оттока (вызывается из main)
+func InitChurn(s *services.ChurnService) {
+	churnService = s
+}
+
+// respondChurnError переводит ошибки прогноза оттока в HTTP-ответ
+func respondChurnError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrNotEnoughChurnData), errors.Is(err, models.ErrInvalidChurnHorizon):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrNoActiveChurnModel):
+		c.JSON(http.StatusConflict, gin.H{"error": "No active churn model, train one first"})
+	case errors.Is(err, models.ErrChurnModelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Churn model not found"})
+	case errors.Is(err, models.ErrChurnPredictionAbsent):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Churn prediction not found"})
+	default:
+		log.Printf("❌ Ошибка прогноза оттока: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// GetChurnModels – версии модели с метриками на отложенной выборке
+func GetChurnModels(c *gin.Context) {
+	list, err := models.ListChurnModels(c.Request.Context())
+	if err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// TrainChurnModel обучает новую версию; активной она становится, только если не хуже действующей
+func TrainChurnModel(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	m, err := churnService.Train(c.Request.Context(), &userID)
+	if err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, m)
+}
+
+// ActivateChurnModel делает версию активной (в том числе откат к прежней) и пересчитывает прогнозы
+func ActivateChurnModel(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid model version"})
+		return
+	}
+	m, err := models.ActivateChurnModel(c.Request.Context(), id)
+	if err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	log.Printf("📉 Модель оттока v%d активирована администратором %s", m.ID, getUserIDFromContext(c))
+	if _, err := churnService.Score(c.Request.Context()); err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// GetChurnPredictions – прогнозы по убыванию вероятности (?risk=low|medium|high)
+func GetChurnPredictions(c *gin.Context) {
+	risk := c.Query("risk")
+	if risk != "" && risk != models.ChurnRiskLow && risk != models.ChurnRiskMedium && risk != models.ChurnRiskHigh {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "risk must be low, medium or high"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	list, total, err := models.ListChurnPredictions(c.Request.Context(), risk, pageSize, (page-1)*pageSize)
+	if err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        list,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetUserChurnPrediction – прогноз подписчика со всеми факторами
+func GetUserChurnPrediction(c *gin.Context) {
+	p, err := models.GetChurnPrediction(c.Request.Context(), c.Param("user_id"))
+	if err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, p)
+}
+
+// ScoreChurn пересчитывает прогнозы активной моделью немедленно
+func ScoreChurn(c *gin.Context) {
+	scored, err := churnService.Score(c.Request.Context())
+	if err != nil {
+		respondChurnError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"scored": scored})
+}
@@ -0,0 +1,280 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+
+	"subscription-system/models"
+)
+
+// Когортный анализ удержания: определения когорт (событие входа, событие удержания, шаг),
+// треугольная матрица (RunCohortAnalysis) и её выгрузка в CSV/XLSX.
+
+// respondCohortError переводит ошибки когортного анализа в HTTP-ответ
+func respondCohortError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidCohortDefinition):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrCohortDefinitionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Cohort definition not found"})
+	default:
+		log.Printf("❌ Ошибка когортного анализа: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// cohortDefinitionRequest – тело создания и изменения определения; пустые поля не меняются
+type cohortDefinitionRequest struct {
+	Name           *string `json:"name"`
+	CohortEvent    *string `json:"cohort_event"`
+	RetentionEvent *string `json:"retention_event"`
+	Granularity    *string `json:"granularity"`
+	Periods        *int    `json:"periods"`
+	Global         bool    `json:"global"`
+}
+
+func (r *cohortDefinitionRequest) apply(d *models.CohortDefinition) {
+	if r.Name != nil {
+		d.Name = *r.Name
+	}
+	if r.CohortEvent != nil {
+		d.CohortEvent = *r.CohortEvent
+	}
+	if r.RetentionEvent != nil {
+		d.RetentionEvent = *r.RetentionEvent
+	}
+	if r.Granularity != nil {
+		d.Granularity = *r.Granularity
+	}
+	if r.Periods != nil {
+		d.Periods = *r.Periods
+	}
+}
+
+// loadCohortDefinition загружает доступное пользователю определение; при ошибке ответ уже отправлен
+func loadCohortDefinition(c *gin.Context, id string) (*models.CohortDefinition, bool) {
+	d, err := models.GetCohortDefinition(c.Request.Context(), id)
+	if err == nil && !d.CanView(getUserIDFromContext(c), isAdmin(c)) {
+		err = models.ErrCohortDefinitionNotFound
+	}
+	if err != nil {
+		respondCohortError(c, err)
+		return nil, false
+	}
+	return d, true
+}
+
+// GetCohortEvents – события, из которых собираются определения когорт
+func GetCohortEvents(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"cohort_events":    models.CohortEntryEvents,
+		"retention_events": models.CohortRetentionEvents,
+		"granularities":    []string{models.RevenueGranularityDay, models.RevenueGranularityWeek, models.RevenueGranularityMonth},
+	})
+}
+
+// GetCohortDefinitions – свои определения; администратору – и определения по всему сервису
+func GetCohortDefinitions(c *gin.Context) {
+	defs, err := models.ListCohortDefinitions(c.Request.Context(), getUserIDFromContext(c), isAdmin(c))
+	if err != nil {
+		respondCohortError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": defs})
+}
+
+// CreateCohortDefinition создаёт определение; global – по всему сервису (только администратор)
+func CreateCohortDefinition(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req cohortDefinitionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Global && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create service-wide cohorts"})
+		return
+	}
+	d := &models.CohortDefinition{CreatedBy: &userID}
+	if !req.Global {
+		d.UserID = &userID
+	}
+	req.apply(d)
+	if err := d.Normalize(); err != nil {
+		respondCohortError(c, err)
+		return
+	}
+	if err := models.CreateCohortDefinition(c.Request.Context(), d); err != nil {
+		respondCohortError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, d)
+}
+
+// UpdateCohortDefinition меняет определение; смена событий или шага пересчитывает когорты заново
+func UpdateCohortDefinition(c *gin.Context) {
+	d, ok := loadCohortDefinition(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	var req cohortDefinitionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.apply(d)
+	if err := d.Normalize(); err != nil {
+		respondCohortError(c, err)
+		return
+	}
+	if err := models.UpdateCohortDefinition(c.Request.Context(), d); err != nil {
+		respondCohortError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+// DeleteCohortDefinition удаляет определение и посчитанные когорты
+func DeleteCohortDefinition(c *gin.Context) {
+	d, ok := loadCohortDefinition(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if err := models.DeleteCohortDefinition(c.Request.Context(), d.ID); err != nil {
+		respondCohortError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Cohort definition deleted"})
+}
+
+// cohortMatrix досчитывает определение по новым событиям и собирает матрицу (?periods= сужает её)
+func cohortMatrix(c *gin.Context, id string) (*models.CohortMatrix, bool) {
+	d, ok := loadCohortDefinition(c, id)
+	if !ok {
+		return nil, false
+	}
+	if v := c.Query("periods"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > d.Periods {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("periods must be between 1 and %d", d.Periods)})
+			return nil, false
+		}
+		d.Periods = n
+	}
+	if _, _, err := models.ComputeCohorts(c.Request.Context(), d.ID); err != nil {
+		respondCohortError(c, err)
+		return nil, false
+	}
+	matrix, err := models.GetCohortMatrix(c.Request.Context(), d)
+	if err != nil {
+		respondCohortError(c, err)
+		return nil, false
+	}
+	return matrix, true
+}
+
+// cohortTable – матрица в виде таблицы для выгрузки: когорта, размер, доли удержания по периодам
+func cohortTable(m *models.CohortMatrix) [][]string {
+	header := []string{"Когорта", "Размер"}
+	for p := 0; p < m.Periods; p++ {
+		header = append(header, "Период "+strconv.Itoa(p))
+	}
+	table := [][]string{header}
+	for _, row := range m.Rows {
+		line := []string{row.Cohort, strconv.Itoa(row.Size)}
+		for p := 0; p < m.Periods; p++ {
+			cell := ""
+			if p < len(row.Rates) {
+				cell = strconv.FormatFloat(row.Rates[p]*100, 'f', 1, 64) + "%"
+			}
+			line = append(line, cell)
+		}
+		table = append(table, line)
+	}
+	average := []string{"Среднее", ""}
+	for _, v := range m.Average {
+		cell := ""
+		if v != nil {
+			cell = strconv.FormatFloat(*v*100, 'f', 1, 64) + "%"
+		}
+		average = append(average, cell)
+	}
+	return append(table, average)
+}
+
+// ExportCohorts выгружает матрицу удержания (?format=csv|xlsx)
+func ExportCohorts(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "xlsx" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be csv or xlsx"})
+		return
+	}
+	matrix, ok := cohortMatrix(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	table := cohortTable(matrix)
+	filename := "cohorts-" + matrix.Definition.Granularity + "." + format
+
+	if format == "csv" {
+		buf := new(bytes.Buffer)
+		writer := csv.NewWriter(buf)
+		writer.WriteAll(table)
+		c.Header("Content-Description", "File Transfer")
+		c.Header("Content-Disposition", "attachment; filename="+filename)
+		c.Data(http.StatusOK, "text/csv", buf.Bytes())
+		return
+	}
+
+	f := excelize.NewFile()
+	defer f.Close()
+	sheet := "Когорты"
+	f.SetSheetName("Sheet1", sheet)
+	for i, line := range table {
+		for j, value := range line {
+			cell, _ := excelize.CoordinatesToCellName(j+1, i+1)
+			// Размеры и доли пишутся числами, чтобы таблицу можно было считать дальше
+			switch {
+			case i > 0 && j == 1 && value != "":
+				n, _ := strconv.Atoi(value)
+				f.SetCellValue(sheet, cell, n)
+			case i > 0 && j > 1 && value != "":
+				v, _ := strconv.ParseFloat(value[:len(value)-1], 64)
+				f.SetCellValue(sheet, cell, v/100)
+			default:
+				f.SetCellValue(sheet, cell, value)
+			}
+		}
+	}
+	header, _ := f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true},
+		Fill: excelize.Fill{Type: "pattern", Color: []string{"#DDDDDD"}, Pattern: 1},
+	})
+	percent, _ := f.NewStyle(&excelize.Style{NumFmt: 10})
+	lastHeader, _ := excelize.CoordinatesToCellName(len(table[0]), 1)
+	f.SetCellStyle(sheet, "A1", lastHeader, header)
+	lastCell, _ := excelize.CoordinatesToCellName(len(table[0]), len(table))
+	f.SetCellStyle(sheet, "C2", lastCell, percent)
+	f.SetColWidth(sheet, "A", "A", 14)
+
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate Excel"})
+		return
+	}
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", "attachment; filename="+filename)
+	c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
+}
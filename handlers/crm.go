@@ -6,19 +6,18 @@ import (
     "database/sql"
     "encoding/csv"
     "encoding/json"
+    "errors"
     "fmt"
     "log"
     "net/http"
-    "os"
-    "path/filepath"
     "strconv"
     "time"
 
     "github.com/gin-gonic/gin"
-    "github.com/google/uuid"
     "github.com/xuri/excelize/v2"
     "subscription-system/config"
     "subscription-system/database"
+    "subscription-system/models"
     "subscription-system/services"
 )
 
@@ -51,6 +50,8 @@ type Customer struct {
     Notes       string          `json:"notes,omitempty"`
     // ДОБАВЛЕНО: теги
     Tags        []string        `json:"tags,omitempty"`
+    // Пользовательские поля: ключ -> значение (схема в crm_custom_fields)
+    CustomFields map[string]interface{} `json:"custom_fields,omitempty"`
 }
 
 // Deal представляет сделку в CRM
@@ -59,6 +60,7 @@ type Deal struct {
     CustomerID    string     `json:"customer_id"`
     Title         string     `json:"title"`
     Value         float64    `json:"value"`
+    PipelineID    string     `json:"pipeline_id,omitempty"`
     Stage         string     `json:"stage"`
     Probability   int        `json:"probability"`
     Responsible   string     `json:"responsible"`
@@ -74,6 +76,8 @@ type Deal struct {
     NextActionDate  *time.Time `json:"next_action_date,omitempty"`
     // ДОБАВЛЕНО: теги
     Tags            []string   `json:"tags,omitempty"`
+    // Пользовательские поля: ключ -> значение (схема в crm_custom_fields)
+    CustomFields    map[string]interface{} `json:"custom_fields,omitempty"`
 }
 
 // HistoryRecord представляет запись истории
@@ -153,31 +157,10 @@ func isAdmin(c *gin.Context) bool {
 
 // ========== РАСЧЁТ ЛИД-СКОРА ==========
 
-// calculateLeadScore вычисляет скор для клиента на основе его сделок
-func calculateLeadScore(ctx context.Context, customerID string) (float64, error) {
-    var totalValue float64
-    err := database.Pool.QueryRow(ctx, `
-        SELECT COALESCE(SUM(value), 0) FROM crm_deals WHERE customer_id = $1
-    `, customerID).Scan(&totalValue)
-    if err != nil {
-        return 0, err
-    }
-    score := totalValue / 10000
-    if score > 1 {
-        score = 1
-    }
-    return score, nil
-}
-
-// updateLeadScore обновляет скор для клиента
+// updateLeadScore пересчитывает скор клиента по действующей модели скоринга
+// (правила и затухание – в models/lead_scoring.go)
 func updateLeadScore(ctx context.Context, customerID string) error {
-    score, err := calculateLeadScore(ctx, customerID)
-    if err != nil {
-        return err
-    }
-    _, err = database.Pool.Exec(ctx, `
-        UPDATE crm_customers SET lead_score = $1 WHERE id = $2
-    `, score, customerID)
+    _, err := models.RecalculateLeadScore(ctx, customerID)
     return err
 }
 
@@ -215,9 +198,9 @@ func GetEntityHistory(c *gin.Context) {
         var ownerID string
         var err error
         if entityType == "customer" {
-            err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1", entityID).Scan(&ownerID)
+            err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1 AND deleted_at IS NULL", entityID).Scan(&ownerID)
         } else {
-            err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", entityID).Scan(&ownerID)
+            err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", entityID).Scan(&ownerID)
         }
         if err != nil {
             c.JSON(http.StatusNotFound, gin.H{"error": "Entity not found"})
@@ -279,146 +262,36 @@ func CRMHealthHandler(c *gin.Context) {
 }
 
 func GetCustomers(c *gin.Context) {
-    userID := getUserIDFromContext(c)
-    isAdmin := isAdmin(c)
-
-    status := c.Query("status")
-    search := c.Query("search")
-    city := c.Query("city")
-    createdFrom := c.Query("created_from")
-    createdTo := c.Query("created_to")
-    tagID := c.Query("tag_id") // ДОБАВЛЕНО
     page, pageSize := getPaginationParams(c)
     offset := (page - 1) * pageSize
 
-    // ---- Подсчёт общего количества записей с учётом всех фильтров и прав ----
-    countQuery := `SELECT COUNT(DISTINCT crm_customers.id) FROM crm_customers`
-    countArgs := []interface{}{}
-    joins := ""
-    whereClause := ""
-
-    if !isAdmin && userID != "" {
-        whereClause += " user_id = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, userID)
-    }
-
-    if tagID != "" {
-        joins += " INNER JOIN customer_tags ON crm_customers.id = customer_tags.customer_id"
-        whereClause += " AND customer_tags.tag_id = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, tagID)
-    }
-    if status != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " status = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, status)
-    }
-    if search != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " (name ILIKE '%' || $" + strconv.Itoa(len(countArgs)+1) + " || '%' OR email ILIKE '%' || $" + strconv.Itoa(len(countArgs)+1) + " || '%' OR city ILIKE '%' || $" + strconv.Itoa(len(countArgs)+1) + " || '%')"
-        countArgs = append(countArgs, search)
-    }
-    if city != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " city = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, city)
-    }
-    if createdFrom != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " created_at >= $" + strconv.Itoa(len(countArgs)+1) + "::date"
-        countArgs = append(countArgs, createdFrom)
-    }
-    if createdTo != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " created_at < ($" + strconv.Itoa(len(countArgs)+1) + "::date + '1 day'::interval)"
-        countArgs = append(countArgs, createdTo)
+    // Отбор: права, ?filter, ?view и прежние параметры (status, search, city, created_from/to, tag_id, cf.*)
+    q, err := crmListQuery(c, models.FilterEntityCustomer)
+    if err != nil {
+        respondViewError(c, err)
+        return
     }
-
-    fullCountQuery := countQuery + joins
-    if whereClause != "" {
-        fullCountQuery += " WHERE" + whereClause
+    _, where, orderBy, args, err := q.SQL(c.Request.Context(), nil)
+    if err != nil {
+        respondViewError(c, err)
+        return
     }
 
     var total int
-    err := database.Pool.QueryRow(c.Request.Context(), fullCountQuery, countArgs...).Scan(&total)
+    err = database.Pool.QueryRow(c.Request.Context(), `SELECT COUNT(*) FROM crm_customers WHERE `+where, args...).Scan(&total)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
     }
 
-    // ---- Запрос данных с теми же фильтрами и пагинацией ----
-    query := `SELECT DISTINCT crm_customers.id, crm_customers.name, crm_customers.email, crm_customers.phone,
+    fullDataQuery := `SELECT crm_customers.id, crm_customers.name, crm_customers.email, crm_customers.phone,
                      crm_customers.company, crm_customers.status, crm_customers.responsible,
                      crm_customers.source, crm_customers.comment, crm_customers.lead_score,
                      crm_customers.created_at, crm_customers.last_seen, crm_customers.city,
-                     crm_customers.social_media, crm_customers.birthday, crm_customers.notes
-              FROM crm_customers`
-    args := []interface{}{}
-    joinsData := ""
-    whereData := ""
-
-    if tagID != "" {
-        joinsData += " INNER JOIN customer_tags ON crm_customers.id = customer_tags.customer_id"
-        whereData += " customer_tags.tag_id = $" + strconv.Itoa(len(args)+1)
-        args = append(args, tagID)
-    }
-    if !isAdmin && userID != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " user_id = $" + strconv.Itoa(len(args)+1)
-        args = append(args, userID)
-    }
-    if status != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " status = $" + strconv.Itoa(len(args)+1)
-        args = append(args, status)
-    }
-    if search != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " (name ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%' OR email ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%' OR city ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%')"
-        args = append(args, search)
-    }
-    if city != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " city = $" + strconv.Itoa(len(args)+1)
-        args = append(args, city)
-    }
-    if createdFrom != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " created_at >= $" + strconv.Itoa(len(args)+1) + "::date"
-        args = append(args, createdFrom)
-    }
-    if createdTo != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " created_at < ($" + strconv.Itoa(len(args)+1) + "::date + '1 day'::interval)"
-        args = append(args, createdTo)
-    }
-
-    fullDataQuery := query + joinsData
-    if whereData != "" {
-        fullDataQuery += " WHERE" + whereData
-    }
-    fullDataQuery += " ORDER BY created_at DESC LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
+                     crm_customers.social_media, crm_customers.birthday, crm_customers.notes,
+                     crm_customers.custom_fields
+              FROM crm_customers WHERE ` + where + ` ORDER BY ` + orderBy +
+        ` LIMIT $` + strconv.Itoa(len(args)+1) + ` OFFSET $` + strconv.Itoa(len(args)+2)
     args = append(args, pageSize, offset)
 
     rows, err := database.Pool.Query(c.Request.Context(), fullDataQuery, args...)
@@ -433,12 +306,14 @@ func GetCustomers(c *gin.Context) {
         var cst Customer
         var socialMedia []byte
         var birthday sql.NullTime
+        var customFields []byte
         err := rows.Scan(&cst.ID, &cst.Name, &cst.Email, &cst.Phone, &cst.Company, &cst.Status,
             &cst.Responsible, &cst.Source, &cst.Comment, &cst.LeadScore, &cst.CreatedAt, &cst.LastSeen,
-            &cst.City, &socialMedia, &birthday, &cst.Notes)
+            &cst.City, &socialMedia, &birthday, &cst.Notes, &customFields)
         if err != nil {
             continue
         }
+        cst.CustomFields = decodeCustomFields(customFields)
         if socialMedia != nil {
             cst.SocialMedia = json.RawMessage(socialMedia)
         }
@@ -476,28 +351,38 @@ func CreateCustomer(c *gin.Context) {
 
     // Проверка на существующий email
     if req.Email != "" {
-        var exists bool
+        var exists, inTrash bool
         err := database.Pool.QueryRow(c.Request.Context(),
-            "SELECT EXISTS(SELECT 1 FROM crm_customers WHERE email = $1)", req.Email).Scan(&exists)
+            "SELECT COUNT(*) > 0, COALESCE(BOOL_AND(deleted_at IS NOT NULL), false) FROM crm_customers WHERE email = $1", req.Email).Scan(&exists, &inTrash)
         if err != nil {
             log.Printf("❌ CreateCustomer check email error: %v", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking email"})
             return
         }
+        if exists && inTrash {
+            c.JSON(http.StatusConflict, gin.H{"error": "Клиент с таким email находится в корзине – восстановите его"})
+            return
+        }
         if exists {
             c.JSON(http.StatusConflict, gin.H{"error": "Клиент с таким email уже существует"})
             return
         }
     }
 
+    customFields, err := models.ApplyCustomFieldValues(c.Request.Context(), models.CustomFieldEntityCustomer, nil, req.CustomFields)
+    if err != nil {
+        respondCustomFieldError(c, err)
+        return
+    }
+
     var id string
-    err := database.Pool.QueryRow(c.Request.Context(), `
-        INSERT INTO crm_customers (name, email, phone, company, status, responsible, source, comment, user_id, created_at, last_seen, city, social_media, birthday, notes)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW(), NOW(), $10, $11, $12, $13)
+    err = database.Pool.QueryRow(c.Request.Context(), `
+        INSERT INTO crm_customers (name, email, phone, company, status, responsible, source, comment, user_id, created_at, last_seen, city, social_media, birthday, notes, custom_fields)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, NOW(), NOW(), $10, $11, $12, $13, $14)
         RETURNING id
     `, req.Name, req.Email, req.Phone, req.Company, req.Status,
         req.Responsible, req.Source, req.Comment, userID,
-        req.City, req.SocialMedia, req.Birthday, req.Notes).Scan(&id)
+        req.City, req.SocialMedia, req.Birthday, req.Notes, customFields).Scan(&id)
 
     if err != nil {
         log.Printf("❌ CreateCustomer insert error: %v", err)
@@ -517,11 +402,14 @@ func CreateCustomer(c *gin.Context) {
     }
 
     if notifier != nil {
-        notifier.NotifyCustomerCreated(req.Name, req.Email, req.Phone, req.Company, req.Responsible)
+        notifier.NotifyCustomerCreated(c.Request.Context(), req.Name, req.Email, req.Phone, req.Company, req.Responsible)
     }
 
     go addHistory(c.Request.Context(), "customer", id, "create", &userID, nil)
 
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerCreated, EntityType: "customer", EntityID: id,
+        Payload: gin.H{"name": req.Name, "company": req.Company, "status": req.Status, "responsible": req.Responsible}})
+
     c.JSON(http.StatusCreated, gin.H{"id": id})
 }
 
@@ -539,7 +427,7 @@ func UpdateCustomer(c *gin.Context) {
 
     // Проверка прав доступа
     var ownerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1", id).Scan(&ownerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1 AND deleted_at IS NULL", id).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
         return
@@ -553,16 +441,28 @@ func UpdateCustomer(c *gin.Context) {
     var oldData Customer
     var oldSocialMedia []byte
     var oldBirthday sql.NullTime
+    var oldCustomFields []byte
     err = database.Pool.QueryRow(c.Request.Context(), `
-        SELECT name, email, phone, company, status, responsible, source, comment, city, social_media, birthday, notes
-        FROM crm_customers WHERE id = $1
+        SELECT name, email, phone, company, status, responsible, source, comment, city, social_media, birthday, notes, custom_fields
+        FROM crm_customers WHERE id = $1 AND deleted_at IS NULL
     `, id).Scan(&oldData.Name, &oldData.Email, &oldData.Phone, &oldData.Company,
         &oldData.Status, &oldData.Responsible, &oldData.Source, &oldData.Comment,
-        &oldData.City, &oldSocialMedia, &oldBirthday, &oldData.Notes)
+        &oldData.City, &oldSocialMedia, &oldBirthday, &oldData.Notes, &oldCustomFields)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
     }
+    oldData.CustomFields = decodeCustomFields(oldCustomFields)
+
+    // Без custom_fields в запросе значения не трогаем; иначе это частичное обновление (null удаляет поле)
+    customFields := oldData.CustomFields
+    if req.CustomFields != nil {
+        customFields, err = models.ApplyCustomFieldValues(c.Request.Context(), models.CustomFieldEntityCustomer, oldData.CustomFields, req.CustomFields)
+        if err != nil {
+            respondCustomFieldError(c, err)
+            return
+        }
+    }
     if oldSocialMedia != nil {
         oldData.SocialMedia = json.RawMessage(oldSocialMedia)
     }
@@ -572,14 +472,18 @@ func UpdateCustomer(c *gin.Context) {
 
     // Если email меняется, проверяем, не занят ли он другим клиентом
     if req.Email != "" && req.Email != oldData.Email {
-        var exists bool
+        var exists, inTrash bool
         err := database.Pool.QueryRow(c.Request.Context(),
-            "SELECT EXISTS(SELECT 1 FROM crm_customers WHERE email = $1 AND id != $2)", req.Email, id).Scan(&exists)
+            "SELECT COUNT(*) > 0, COALESCE(BOOL_AND(deleted_at IS NOT NULL), false) FROM crm_customers WHERE email = $1 AND id != $2", req.Email, id).Scan(&exists, &inTrash)
         if err != nil {
             log.Printf("❌ UpdateCustomer check email error: %v", err)
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error checking email"})
             return
         }
+        if exists && inTrash {
+            c.JSON(http.StatusConflict, gin.H{"error": "Клиент с таким email находится в корзине – восстановите его"})
+            return
+        }
         if exists {
             c.JSON(http.StatusConflict, gin.H{"error": "Клиент с таким email уже существует"})
             return
@@ -590,11 +494,11 @@ func UpdateCustomer(c *gin.Context) {
         UPDATE crm_customers
         SET name = $1, email = $2, phone = $3, company = $4, status = $5,
             responsible = $6, source = $7, comment = $8, last_seen = NOW(),
-            city = $9, social_media = $10, birthday = $11, notes = $12
+            city = $9, social_media = $10, birthday = $11, notes = $12, custom_fields = $14
         WHERE id = $13
     `, req.Name, req.Email, req.Phone, req.Company, req.Status,
         req.Responsible, req.Source, req.Comment,
-        req.City, req.SocialMedia, req.Birthday, req.Notes, id)
+        req.City, req.SocialMedia, req.Birthday, req.Notes, id, customFields)
 
     if err != nil {
         log.Printf("❌ UpdateCustomer error: %v", err)
@@ -614,7 +518,7 @@ func UpdateCustomer(c *gin.Context) {
     }
 
     if notifier != nil {
-        notifier.NotifyCustomerUpdated(id, req.Name, req.Email, req.Phone)
+        notifier.NotifyCustomerUpdated(c.Request.Context(), id, req.Name, req.Email, req.Phone)
     }
 
     changes := make(map[string]interface{})
@@ -664,22 +568,27 @@ func UpdateCustomer(c *gin.Context) {
     if oldData.Notes != req.Notes {
         changes["notes"] = map[string]string{"old": oldData.Notes, "new": req.Notes}
     }
+    if cfChanges := customFieldChanges(oldData.CustomFields, customFields); len(cfChanges) > 0 {
+        changes["custom_fields"] = cfChanges
+    }
 
     if len(changes) > 0 {
         go addHistory(c.Request.Context(), "customer", id, "update", &userID, changes)
+        publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerUpdated, EntityType: "customer", EntityID: id,
+            Payload: gin.H{"name": req.Name, "fields": changedFields(changes)}})
     }
 
     c.JSON(http.StatusOK, gin.H{"success": true})
 }
 
-// DeleteCustomer удаляет клиента
+// DeleteCustomer перемещает клиента в корзину вместе с его сделками, вложениями и активностями
 func DeleteCustomer(c *gin.Context) {
     id := c.Param("id")
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
 
     var ownerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1", id).Scan(&ownerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1 AND deleted_at IS NULL", id).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
         return
@@ -689,22 +598,27 @@ func DeleteCustomer(c *gin.Context) {
         return
     }
 
-    go addHistory(c.Request.Context(), "customer", id, "delete", &userID, nil)
-
-    _, err = database.Pool.Exec(c.Request.Context(), "DELETE FROM crm_customers WHERE id = $1", id)
+    items, err := models.MoveToTrash(c.Request.Context(), models.TrashEntityCustomer, []string{id}, &userID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
-    c.JSON(http.StatusOK, gin.H{"success": true})
+    go addHistory(context.Background(), "customer", id, "delete", &userID, nil)
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerDeleted, EntityType: "customer", EntityID: id, OwnerID: &ownerID,
+        Payload: gin.H{"trash_id": items[0].ID}})
+    c.JSON(http.StatusOK, gin.H{"success": true, "trash_id": items[0].ID})
 }
 
 // ========== МАССОВЫЕ ОПЕРАЦИИ ДЛЯ КЛИЕНТОВ ==========
 
 func BatchDeleteCustomers(c *gin.Context) {
-    var ids []string
-    if err := c.ShouldBindJSON(&ids); err != nil || len(ids) == 0 {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+    // Тело – массив ID либо {"ids"|"filter"|"view_id"}
+    ids, ok := bindBatchIDs(c, models.FilterEntityCustomer)
+    if !ok {
+        return
+    }
+    if len(ids) == 0 {
+        c.JSON(http.StatusOK, gin.H{"success": true, "deleted": 0})
         return
     }
 
@@ -722,7 +636,7 @@ func BatchDeleteCustomers(c *gin.Context) {
         var count int
         err := tx.QueryRow(c.Request.Context(), `
             SELECT COUNT(*) FROM crm_customers 
-            WHERE id = ANY($1) AND user_id != $2
+            WHERE id = ANY($1) AND user_id != $2 AND deleted_at IS NULL
         `, ids, userID).Scan(&count)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -741,9 +655,15 @@ func BatchDeleteCustomers(c *gin.Context) {
         }
     }
 
-    _, err = tx.Exec(c.Request.Context(), "DELETE FROM crm_customers WHERE id = ANY($1)", ids)
+    owners := crmEntityOwners(c.Request.Context(), "crm_customers", ids)
+
+    items, err := models.MoveToTrashTx(c.Request.Context(), tx, models.TrashEntityCustomer, ids, &userID)
+    if errors.Is(err, models.ErrNotInTrash) {
+        c.JSON(http.StatusOK, gin.H{"success": true, "deleted": 0})
+        return
+    }
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
 
@@ -752,18 +672,35 @@ func BatchDeleteCustomers(c *gin.Context) {
         return
     }
 
-    c.JSON(http.StatusOK, gin.H{"success": true, "deleted": len(ids)})
+    trashIDs := make([]string, 0, len(items))
+    for _, item := range items {
+        trashIDs = append(trashIDs, item.ID)
+        publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerDeleted, EntityType: "customer", EntityID: item.EntityID,
+            OwnerID: owners[item.EntityID], Payload: gin.H{"trash_id": item.ID}})
+    }
+
+    c.JSON(http.StatusOK, gin.H{"success": true, "deleted": len(items), "trash_ids": trashIDs})
 }
 
 func BatchUpdateCustomersStatus(c *gin.Context) {
     var req struct {
-        IDs    []string `json:"ids"`
-        Status string   `json:"status"`
+        crmBatchSelection
+        Status string `json:"status"`
     }
-    if err := c.ShouldBindJSON(&req); err != nil || len(req.IDs) == 0 || req.Status == "" {
+    if err := c.ShouldBindJSON(&req); err != nil || req.Status == "" {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
         return
     }
+    ids, err := req.resolve(c, models.FilterEntityCustomer)
+    if err != nil {
+        respondViewError(c, err)
+        return
+    }
+    if len(ids) == 0 {
+        c.JSON(http.StatusOK, gin.H{"success": true, "updated": 0})
+        return
+    }
+    req.IDs = ids
 
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
@@ -779,7 +716,7 @@ func BatchUpdateCustomersStatus(c *gin.Context) {
         var count int
         err := tx.QueryRow(c.Request.Context(), `
             SELECT COUNT(*) FROM crm_customers 
-            WHERE id = ANY($1) AND user_id != $2
+            WHERE id = ANY($1) AND user_id != $2 AND deleted_at IS NULL
         `, req.IDs, userID).Scan(&count)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -801,7 +738,7 @@ func BatchUpdateCustomersStatus(c *gin.Context) {
         }
     }
 
-    _, err = tx.Exec(c.Request.Context(), "UPDATE crm_customers SET status = $1 WHERE id = ANY($2)", req.Status, req.IDs)
+    _, err = tx.Exec(c.Request.Context(), "UPDATE crm_customers SET status = $1 WHERE id = ANY($2) AND deleted_at IS NULL", req.Status, req.IDs)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
@@ -812,198 +749,45 @@ func BatchUpdateCustomersStatus(c *gin.Context) {
         return
     }
 
+    for _, id := range req.IDs {
+        publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerUpdated, EntityType: "customer", EntityID: id,
+            Payload: gin.H{"fields": []string{"status"}, "status": req.Status}})
+    }
+
     c.JSON(http.StatusOK, gin.H{"success": true, "updated": len(req.IDs)})
 }
 
 func GetDeals(c *gin.Context) {
-    userID := getUserIDFromContext(c)
-    isAdmin := isAdmin(c)
-
-    stage := c.Query("stage")
-    search := c.Query("search")
-    category := c.Query("category")
-    valueMin := c.Query("value_min")
-    valueMax := c.Query("value_max")
-    closeFrom := c.Query("close_from")
-    closeTo := c.Query("close_to")
-    tagID := c.Query("tag_id") // ДОБАВЛЕНО
-    hasNextAction := c.Query("has_next_action") // ДОБАВЛЕНО для календаря
     page, pageSize := getPaginationParams(c)
     offset := (page - 1) * pageSize
 
-    // ---- Подсчёт общего количества записей с учётом всех фильтров и прав ----
-    countQuery := `SELECT COUNT(DISTINCT crm_deals.id) FROM crm_deals`
-    countArgs := []interface{}{}
-    joins := ""
-    whereClause := ""
-
-    if !isAdmin && userID != "" {
-        whereClause += " user_id = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, userID)
-    }
-
-    if tagID != "" {
-        joins += " INNER JOIN deal_tags ON crm_deals.id = deal_tags.deal_id"
-        whereClause += " AND deal_tags.tag_id = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, tagID)
-    }
-    if stage != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " stage = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, stage)
-    }
-    if search != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " title ILIKE '%' || $" + strconv.Itoa(len(countArgs)+1) + " || '%'"
-        countArgs = append(countArgs, search)
-    }
-    if category != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " product_category = $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, category)
-    }
-    if valueMin != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " value >= $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, valueMin)
-    }
-    if valueMax != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " value <= $" + strconv.Itoa(len(countArgs)+1)
-        countArgs = append(countArgs, valueMax)
-    }
-    if closeFrom != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " expected_close >= $" + strconv.Itoa(len(countArgs)+1) + "::date"
-        countArgs = append(countArgs, closeFrom)
-    }
-    if closeTo != "" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " expected_close < ($" + strconv.Itoa(len(countArgs)+1) + "::date + '1 day'::interval)"
-        countArgs = append(countArgs, closeTo)
-    }
-    // ДОБАВЛЕНО: фильтр по наличию даты следующего действия
-    if hasNextAction == "true" {
-        if whereClause != "" {
-            whereClause += " AND"
-        }
-        whereClause += " next_action_date IS NOT NULL"
+    // Отбор: права, ?filter, ?view и прежние параметры (stage, pipeline_id, search, category,
+    // value_min/max, close_from/to, tag_id, has_next_action, cf.*)
+    q, err := crmListQuery(c, models.FilterEntityDeal)
+    if err != nil {
+        respondViewError(c, err)
+        return
     }
-
-    fullCountQuery := countQuery + joins
-    if whereClause != "" {
-        fullCountQuery += " WHERE" + whereClause
+    _, where, orderBy, args, err := q.SQL(c.Request.Context(), nil)
+    if err != nil {
+        respondViewError(c, err)
+        return
     }
 
     var total int
-    err := database.Pool.QueryRow(c.Request.Context(), fullCountQuery, countArgs...).Scan(&total)
+    err = database.Pool.QueryRow(c.Request.Context(), `SELECT COUNT(*) FROM crm_deals WHERE `+where, args...).Scan(&total)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
     }
 
-    // ---- Запрос данных с теми же фильтрами и пагинацией ----
-    query := `SELECT DISTINCT crm_deals.id, crm_deals.customer_id, crm_deals.title, crm_deals.value,
-                     crm_deals.stage, crm_deals.probability, crm_deals.responsible, crm_deals.source,
+    fullDataQuery := `SELECT crm_deals.id, crm_deals.customer_id, crm_deals.title, crm_deals.value,
+                     COALESCE(crm_deals.pipeline_id::text, ''), crm_deals.stage, crm_deals.probability, crm_deals.responsible, crm_deals.source,
                      crm_deals.comment, crm_deals.expected_close, crm_deals.created_at, crm_deals.closed_at,
-                     crm_deals.product_category, crm_deals.discount, crm_deals.next_action_date
-              FROM crm_deals`
-    args := []interface{}{}
-    joinsData := ""
-    whereData := ""
-
-    // ДОБАВЛЕНО: фильтр по наличию даты следующего действия (ПЕРЕНЕСЁН ПОСЛЕ ОБЪЯВЛЕНИЯ whereData)
-    if hasNextAction == "true" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " next_action_date IS NOT NULL"
-    }
-
-    if tagID != "" {
-        joinsData += " INNER JOIN deal_tags ON crm_deals.id = deal_tags.deal_id"
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " deal_tags.tag_id = $" + strconv.Itoa(len(args)+1)
-        args = append(args, tagID)
-    }
-    if !isAdmin && userID != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " user_id = $" + strconv.Itoa(len(args)+1)
-        args = append(args, userID)
-    }
-    if stage != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " stage = $" + strconv.Itoa(len(args)+1)
-        args = append(args, stage)
-    }
-    if search != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " title ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%'"
-        args = append(args, search)
-    }
-    if category != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " product_category = $" + strconv.Itoa(len(args)+1)
-        args = append(args, category)
-    }
-    if valueMin != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " value >= $" + strconv.Itoa(len(args)+1)
-        args = append(args, valueMin)
-    }
-    if valueMax != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " value <= $" + strconv.Itoa(len(args)+1)
-        args = append(args, valueMax)
-    }
-    if closeFrom != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " expected_close >= $" + strconv.Itoa(len(args)+1) + "::date"
-        args = append(args, closeFrom)
-    }
-    if closeTo != "" {
-        if whereData != "" {
-            whereData += " AND"
-        }
-        whereData += " expected_close < ($" + strconv.Itoa(len(args)+1) + "::date + '1 day'::interval)"
-        args = append(args, closeTo)
-    }
-
-    fullDataQuery := query + joinsData
-    if whereData != "" {
-        fullDataQuery += " WHERE" + whereData
-    }
-    fullDataQuery += " ORDER BY created_at DESC LIMIT $" + strconv.Itoa(len(args)+1) + " OFFSET $" + strconv.Itoa(len(args)+2)
+                     crm_deals.product_category, crm_deals.discount, crm_deals.next_action_date,
+                     crm_deals.custom_fields
+              FROM crm_deals WHERE ` + where + ` ORDER BY ` + orderBy +
+        ` LIMIT $` + strconv.Itoa(len(args)+1) + ` OFFSET $` + strconv.Itoa(len(args)+2)
     args = append(args, pageSize, offset)
 
     rows, err := database.Pool.Query(c.Request.Context(), fullDataQuery, args...)
@@ -1017,12 +801,14 @@ func GetDeals(c *gin.Context) {
     for rows.Next() {
         var d Deal
         var nextActionDate sql.NullTime
-        err := rows.Scan(&d.ID, &d.CustomerID, &d.Title, &d.Value, &d.Stage, &d.Probability,
+        var customFields []byte
+        err := rows.Scan(&d.ID, &d.CustomerID, &d.Title, &d.Value, &d.PipelineID, &d.Stage, &d.Probability,
             &d.Responsible, &d.Source, &d.Comment, &d.ExpectedClose, &d.CreatedAt, &d.ClosedAt,
-            &d.ProductCategory, &d.Discount, &nextActionDate)
+            &d.ProductCategory, &d.Discount, &nextActionDate, &customFields)
         if err != nil {
             continue
         }
+        d.CustomFields = decodeCustomFields(customFields)
         if nextActionDate.Valid {
             d.NextActionDate = &nextActionDate.Time
         }
@@ -1054,13 +840,43 @@ func CreateDeal(c *gin.Context) {
         return
     }
 
-    err := database.Pool.QueryRow(c.Request.Context(), `
-        INSERT INTO crm_deals (customer_id, title, value, stage, probability, responsible, source, comment, expected_close, user_id, created_at, product_category, discount, next_action_date)
-        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), $11, $12, $13)
+    // Клиент из корзины не принимает новых сделок
+    var customerExists bool
+    err := database.Pool.QueryRow(c.Request.Context(),
+        "SELECT EXISTS(SELECT 1 FROM crm_customers WHERE id::text = $1 AND deleted_at IS NULL)", d.CustomerID).Scan(&customerExists)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        return
+    }
+    if !customerExists {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Customer not found"})
+        return
+    }
+
+    // Этап проверяется по воронке сделки; без воронки – воронка пользователя по умолчанию
+    pipeline, stage, err := resolveDealStage(c.Request.Context(), userID, isAdmin(c), d.PipelineID, d.Stage)
+    if err != nil {
+        respondPipelineError(c, err)
+        return
+    }
+    d.PipelineID = pipeline.ID
+    d.Stage = stage.Code
+    if d.Probability == 0 {
+        d.Probability = stage.Probability
+    }
+    d.CustomFields, err = models.ApplyCustomFieldValues(c.Request.Context(), models.CustomFieldEntityDeal, nil, d.CustomFields)
+    if err != nil {
+        respondCustomFieldError(c, err)
+        return
+    }
+
+    err = database.Pool.QueryRow(c.Request.Context(), `
+        INSERT INTO crm_deals (customer_id, title, value, pipeline_id, stage, probability, responsible, source, comment, expected_close, user_id, created_at, product_category, discount, next_action_date, stage_changed_at, closed_at, custom_fields)
+        VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, NOW(), $12, $13, $14, NOW(), CASE WHEN $15 THEN NOW() END, $16)
         RETURNING id
-    `, d.CustomerID, d.Title, d.Value, d.Stage, d.Probability,
+    `, d.CustomerID, d.Title, d.Value, d.PipelineID, d.Stage, d.Probability,
         d.Responsible, d.Source, d.Comment, d.ExpectedClose, userID,
-        d.ProductCategory, d.Discount, d.NextActionDate).Scan(&d.ID)
+        d.ProductCategory, d.Discount, d.NextActionDate, stage.IsClosed(), d.CustomFields).Scan(&d.ID)
 
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1079,11 +895,14 @@ func CreateDeal(c *gin.Context) {
     }
 
     if notifier != nil {
-        notifier.NotifyDealCreated(d.Title, d.Value, d.Stage, d.Responsible, d.CustomerID)
+        notifier.NotifyDealCreated(c.Request.Context(), d.Title, d.Value, d.Stage, d.Responsible, d.CustomerID)
     }
 
     go addHistory(c.Request.Context(), "deal", d.ID, "create", &userID, nil)
 
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealCreated, EntityType: "deal", EntityID: d.ID,
+        Payload: gin.H{"title": d.Title, "value": d.Value, "pipeline_id": d.PipelineID, "stage": d.Stage, "customer_id": d.CustomerID}})
+
     c.JSON(http.StatusCreated, d)
 }
 
@@ -1099,14 +918,14 @@ func UpdateDeal(c *gin.Context) {
     isAdmin := isAdmin(c)
 
     var oldCustomerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT customer_id FROM crm_deals WHERE id = $1", id).Scan(&oldCustomerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT customer_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", id).Scan(&oldCustomerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
     }
 
     var ownerID string
-    err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", id).Scan(&ownerID)
+    err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", id).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
@@ -1118,12 +937,13 @@ func UpdateDeal(c *gin.Context) {
 
     var oldData Deal
     var oldNextActionDate sql.NullTime
+    var oldCustomFields []byte
     err = database.Pool.QueryRow(c.Request.Context(), `
-        SELECT title, value, stage, probability, responsible, source, comment, expected_close, customer_id, product_category, discount, next_action_date
-        FROM crm_deals WHERE id = $1
-    `, id).Scan(&oldData.Title, &oldData.Value, &oldData.Stage, &oldData.Probability,
+        SELECT title, value, COALESCE(pipeline_id::text, ''), stage, probability, responsible, source, comment, expected_close, customer_id, product_category, discount, next_action_date, custom_fields
+        FROM crm_deals WHERE id = $1 AND deleted_at IS NULL
+    `, id).Scan(&oldData.Title, &oldData.Value, &oldData.PipelineID, &oldData.Stage, &oldData.Probability,
         &oldData.Responsible, &oldData.Source, &oldData.Comment, &oldData.ExpectedClose, &oldData.CustomerID,
-        &oldData.ProductCategory, &oldData.Discount, &oldNextActionDate)
+        &oldData.ProductCategory, &oldData.Discount, &oldNextActionDate, &oldCustomFields)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
@@ -1131,16 +951,53 @@ func UpdateDeal(c *gin.Context) {
     if oldNextActionDate.Valid {
         oldData.NextActionDate = &oldNextActionDate.Time
     }
+    oldData.CustomFields = decodeCustomFields(oldCustomFields)
+
+    // Без custom_fields в запросе значения не трогаем; иначе это частичное обновление (null удаляет поле)
+    customFields := oldData.CustomFields
+    if d.CustomFields != nil {
+        customFields, err = models.ApplyCustomFieldValues(c.Request.Context(), models.CustomFieldEntityDeal, oldData.CustomFields, d.CustomFields)
+        if err != nil {
+            respondCustomFieldError(c, err)
+            return
+        }
+    }
+
+    // Без pipeline_id сделка остаётся в своей воронке; без этапа – на прежнем этапе
+    if d.PipelineID == "" {
+        d.PipelineID = oldData.PipelineID
+    }
+    if d.Stage == "" && d.PipelineID == oldData.PipelineID {
+        d.Stage = oldData.Stage
+    }
+    pipeline, stage, err := resolveDealStage(c.Request.Context(), userID, isAdmin, d.PipelineID, d.Stage)
+    if err != nil {
+        respondPipelineError(c, err)
+        return
+    }
+    d.PipelineID = pipeline.ID
+    d.Stage = stage.Code
+
+    // Сумма сделки с позициями считается из них и вручную не меняется
+    if itemsTotal, hasItems, err := models.DealItemsTotal(c.Request.Context(), id); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        return
+    } else if hasItems {
+        d.Value = itemsTotal
+    }
 
     _, err = database.Pool.Exec(c.Request.Context(), `
         UPDATE crm_deals
         SET title = $1, value = $2, stage = $3, probability = $4,
             responsible = $5, source = $6, comment = $7, expected_close = $8, updated_at = NOW(),
-            product_category = $9, discount = $10, next_action_date = $11
+            product_category = $9, discount = $10, next_action_date = $11,
+            stage_changed_at = CASE WHEN stage IS DISTINCT FROM $3 OR pipeline_id IS DISTINCT FROM $13::uuid THEN NOW() ELSE stage_changed_at END,
+            closed_at = CASE WHEN $14 THEN COALESCE(closed_at, NOW()) END,
+            pipeline_id = $13, custom_fields = $15
         WHERE id = $12
     `, d.Title, d.Value, d.Stage, d.Probability,
         d.Responsible, d.Source, d.Comment, d.ExpectedClose,
-        d.ProductCategory, d.Discount, d.NextActionDate, id)
+        d.ProductCategory, d.Discount, d.NextActionDate, id, d.PipelineID, stage.IsClosed(), customFields)
 
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1168,7 +1025,7 @@ func UpdateDeal(c *gin.Context) {
     }
 
     if notifier != nil {
-        notifier.NotifyDealUpdated(id, d.Title, d.Value, d.Stage)
+        notifier.NotifyDealUpdated(c.Request.Context(), id, d.Title, d.Value, d.Stage)
     }
 
     changes := make(map[string]interface{})
@@ -1178,6 +1035,9 @@ func UpdateDeal(c *gin.Context) {
     if oldData.Value != d.Value {
         changes["value"] = map[string]float64{"old": oldData.Value, "new": d.Value}
     }
+    if oldData.PipelineID != d.PipelineID {
+        changes["pipeline_id"] = map[string]string{"old": oldData.PipelineID, "new": d.PipelineID}
+    }
     if oldData.Stage != d.Stage {
         changes["stage"] = map[string]string{"old": oldData.Stage, "new": d.Stage}
     }
@@ -1228,8 +1088,17 @@ func UpdateDeal(c *gin.Context) {
         }
         changes["next_action_date"] = map[string]string{"old": oldStr, "new": newStr}
     }
+    if cfChanges := customFieldChanges(oldData.CustomFields, customFields); len(cfChanges) > 0 {
+        changes["custom_fields"] = cfChanges
+    }
     if len(changes) > 0 {
         go addHistory(c.Request.Context(), "deal", id, "update", &userID, changes)
+        eventType := models.CRMEventDealUpdated
+        if oldData.Stage != d.Stage || oldData.PipelineID != d.PipelineID {
+            eventType = models.CRMEventDealStageChanged
+        }
+        publishCRMEvent(c, &models.CRMEvent{Type: eventType, EntityType: "deal", EntityID: id,
+            Payload: gin.H{"title": d.Title, "pipeline_id": d.PipelineID, "stage": d.Stage, "old_stage": oldData.Stage, "fields": changedFields(changes)}})
     }
 
     c.JSON(http.StatusOK, gin.H{"success": true})
@@ -1249,17 +1118,17 @@ func UpdateDealStage(c *gin.Context) {
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
 
-    var oldStage string
+    var oldStage, pipelineID string
     var oldProb int
     var customerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT stage, probability, customer_id FROM crm_deals WHERE id = $1", id).Scan(&oldStage, &oldProb, &customerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT stage, COALESCE(pipeline_id::text, ''), probability, customer_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", id).Scan(&oldStage, &pipelineID, &oldProb, &customerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
     }
 
     var ownerID string
-    err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", id).Scan(&ownerID)
+    err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", id).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
@@ -1269,11 +1138,23 @@ func UpdateDealStage(c *gin.Context) {
         return
     }
 
+    _, stage, err := resolveDealStage(c.Request.Context(), userID, isAdmin, pipelineID, req.Stage)
+    if err != nil {
+        respondPipelineError(c, err)
+        return
+    }
+    req.Stage = stage.Code
+    if req.Probability == 0 {
+        req.Probability = stage.Probability
+    }
+
     _, err = database.Pool.Exec(c.Request.Context(), `
         UPDATE crm_deals
-        SET stage = $1, probability = $2, updated_at = NOW()
+        SET stage = $1, probability = $2, updated_at = NOW(),
+            stage_changed_at = CASE WHEN stage IS DISTINCT FROM $1 THEN NOW() ELSE stage_changed_at END,
+            closed_at = CASE WHEN $4 THEN COALESCE(closed_at, NOW()) END
         WHERE id = $3
-    `, req.Stage, req.Probability, id)
+    `, req.Stage, req.Probability, id, stage.IsClosed())
 
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1293,6 +1174,12 @@ func UpdateDealStage(c *gin.Context) {
     }
     if len(changes) > 0 {
         go addHistory(c.Request.Context(), "deal", id, "update", &userID, changes)
+        eventType := models.CRMEventDealUpdated
+        if oldStage != req.Stage {
+            eventType = models.CRMEventDealStageChanged
+        }
+        publishCRMEvent(c, &models.CRMEvent{Type: eventType, EntityType: "deal", EntityID: id,
+            Payload: gin.H{"pipeline_id": pipelineID, "stage": req.Stage, "old_stage": oldStage, "probability": req.Probability}})
     }
 
     c.JSON(http.StatusOK, gin.H{"success": true})
@@ -1304,14 +1191,14 @@ func DeleteDeal(c *gin.Context) {
     isAdmin := isAdmin(c)
 
     var customerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT customer_id FROM crm_deals WHERE id = $1", id).Scan(&customerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT customer_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", id).Scan(&customerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
     }
 
     var ownerID string
-    err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", id).Scan(&ownerID)
+    err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", id).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
@@ -1321,27 +1208,32 @@ func DeleteDeal(c *gin.Context) {
         return
     }
 
-    go addHistory(c.Request.Context(), "deal", id, "delete", &userID, nil)
-
-    _, err = database.Pool.Exec(c.Request.Context(), "DELETE FROM crm_deals WHERE id = $1", id)
+    items, err := models.MoveToTrash(c.Request.Context(), models.TrashEntityDeal, []string{id}, &userID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
+    go addHistory(context.Background(), "deal", id, "delete", &userID, nil)
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealDeleted, EntityType: "deal", EntityID: id, OwnerID: &ownerID,
+        Payload: gin.H{"trash_id": items[0].ID}})
 
     if err := updateLeadScore(c.Request.Context(), customerID); err != nil {
         log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", customerID, err)
     }
 
-    c.JSON(http.StatusOK, gin.H{"success": true})
+    c.JSON(http.StatusOK, gin.H{"success": true, "trash_id": items[0].ID})
 }
 
 // ========== МАССОВЫЕ ОПЕРАЦИИ ДЛЯ СДЕЛОК ==========
 
 func BatchDeleteDeals(c *gin.Context) {
-    var ids []string
-    if err := c.ShouldBindJSON(&ids); err != nil || len(ids) == 0 {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+    // Тело – массив ID либо {"ids"|"filter"|"view_id"}
+    ids, ok := bindBatchIDs(c, models.FilterEntityDeal)
+    if !ok {
+        return
+    }
+    if len(ids) == 0 {
+        c.JSON(http.StatusOK, gin.H{"success": true, "deleted": 0})
         return
     }
 
@@ -1359,7 +1251,7 @@ func BatchDeleteDeals(c *gin.Context) {
         var count int
         err := tx.QueryRow(c.Request.Context(), `
             SELECT COUNT(*) FROM crm_deals 
-            WHERE id = ANY($1) AND user_id != $2
+            WHERE id = ANY($1) AND user_id != $2 AND deleted_at IS NULL
         `, ids, userID).Scan(&count)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1371,7 +1263,7 @@ func BatchDeleteDeals(c *gin.Context) {
         }
     }
 
-    rows, err := tx.Query(c.Request.Context(), "SELECT DISTINCT customer_id FROM crm_deals WHERE id = ANY($1)", ids)
+    rows, err := tx.Query(c.Request.Context(), "SELECT DISTINCT customer_id FROM crm_deals WHERE id = ANY($1) AND deleted_at IS NULL", ids)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
@@ -1392,9 +1284,15 @@ func BatchDeleteDeals(c *gin.Context) {
         }
     }
 
-    _, err = tx.Exec(c.Request.Context(), "DELETE FROM crm_deals WHERE id = ANY($1)", ids)
+    owners := crmEntityOwners(c.Request.Context(), "crm_deals", ids)
+
+    items, err := models.MoveToTrashTx(c.Request.Context(), tx, models.TrashEntityDeal, ids, &userID)
+    if errors.Is(err, models.ErrNotInTrash) {
+        c.JSON(http.StatusOK, gin.H{"success": true, "deleted": 0})
+        return
+    }
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
 
@@ -1403,25 +1301,42 @@ func BatchDeleteDeals(c *gin.Context) {
         return
     }
 
+    trashIDs := make([]string, 0, len(items))
+    for _, item := range items {
+        trashIDs = append(trashIDs, item.ID)
+        publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealDeleted, EntityType: "deal", EntityID: item.EntityID,
+            OwnerID: owners[item.EntityID], Payload: gin.H{"trash_id": item.ID}})
+    }
+
     for _, cid := range customerIDs {
         if err := updateLeadScore(c.Request.Context(), cid); err != nil {
             log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", cid, err)
         }
     }
 
-    c.JSON(http.StatusOK, gin.H{"success": true, "deleted": len(ids)})
+    c.JSON(http.StatusOK, gin.H{"success": true, "deleted": len(items), "trash_ids": trashIDs})
 }
 
 func BatchUpdateDealsStage(c *gin.Context) {
     var req struct {
-        IDs         []string `json:"ids"`
-        Stage       string   `json:"stage"`
-        Probability int      `json:"probability"`
+        crmBatchSelection
+        Stage       string `json:"stage"`
+        Probability int    `json:"probability"`
     }
-    if err := c.ShouldBindJSON(&req); err != nil || len(req.IDs) == 0 || req.Stage == "" {
+    if err := c.ShouldBindJSON(&req); err != nil || req.Stage == "" {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
         return
     }
+    ids, err := req.resolve(c, models.FilterEntityDeal)
+    if err != nil {
+        respondViewError(c, err)
+        return
+    }
+    if len(ids) == 0 {
+        c.JSON(http.StatusOK, gin.H{"success": true, "updated": 0})
+        return
+    }
+    req.IDs = ids
 
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
@@ -1437,7 +1352,7 @@ func BatchUpdateDealsStage(c *gin.Context) {
         var count int
         err := tx.QueryRow(c.Request.Context(), `
             SELECT COUNT(*) FROM crm_deals 
-            WHERE id = ANY($1) AND user_id != $2
+            WHERE id = ANY($1) AND user_id != $2 AND deleted_at IS NULL
         `, req.IDs, userID).Scan(&count)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1449,7 +1364,24 @@ func BatchUpdateDealsStage(c *gin.Context) {
         }
     }
 
-    rows, err := tx.Query(c.Request.Context(), "SELECT DISTINCT customer_id FROM crm_deals WHERE id = ANY($1)", req.IDs)
+    // Этап должен существовать в воронке каждой из выбранных сделок
+    var foreign int
+    err = tx.QueryRow(c.Request.Context(), `
+        SELECT COUNT(*) FROM crm_deals d
+        WHERE d.id = ANY($1) AND d.deleted_at IS NULL AND NOT EXISTS (
+            SELECT 1 FROM crm_pipeline_stages ps WHERE ps.pipeline_id = d.pipeline_id AND ps.code = $2
+        )
+    `, req.IDs, req.Stage).Scan(&foreign)
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        return
+    }
+    if foreign > 0 {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "Stage does not belong to the pipeline of every selected deal"})
+        return
+    }
+
+    rows, err := tx.Query(c.Request.Context(), "SELECT DISTINCT customer_id FROM crm_deals WHERE id = ANY($1) AND deleted_at IS NULL", req.IDs)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
@@ -1474,10 +1406,16 @@ func BatchUpdateDealsStage(c *gin.Context) {
         }
     }
 
+    // probability = 0 – взять вероятность этапа по умолчанию
     _, err = tx.Exec(c.Request.Context(), `
-        UPDATE crm_deals 
-        SET stage = $1, probability = $2, updated_at = NOW() 
-        WHERE id = ANY($3)
+        UPDATE crm_deals d
+        SET stage = $1,
+            probability = CASE WHEN $2 = 0 THEN ps.probability ELSE $2 END,
+            updated_at = NOW(),
+            stage_changed_at = CASE WHEN d.stage IS DISTINCT FROM $1 THEN NOW() ELSE d.stage_changed_at END,
+            closed_at = CASE WHEN ps.is_won OR ps.is_lost THEN COALESCE(d.closed_at, NOW()) END
+        FROM crm_pipeline_stages ps
+        WHERE d.id = ANY($3) AND d.deleted_at IS NULL AND ps.pipeline_id = d.pipeline_id AND ps.code = $1
     `, req.Stage, req.Probability, req.IDs)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1489,6 +1427,11 @@ func BatchUpdateDealsStage(c *gin.Context) {
         return
     }
 
+    for _, id := range req.IDs {
+        publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealStageChanged, EntityType: "deal", EntityID: id,
+            Payload: gin.H{"stage": req.Stage}})
+    }
+
     for _, cid := range customerIDs {
         if err := updateLeadScore(c.Request.Context(), cid); err != nil {
             log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", cid, err)
@@ -1500,13 +1443,23 @@ func BatchUpdateDealsStage(c *gin.Context) {
 
 func BatchUpdateDealsResponsible(c *gin.Context) {
     var req struct {
-        IDs         []string `json:"ids"`
-        Responsible string   `json:"responsible"`
+        crmBatchSelection
+        Responsible string `json:"responsible"`
     }
-    if err := c.ShouldBindJSON(&req); err != nil || len(req.IDs) == 0 {
+    if err := c.ShouldBindJSON(&req); err != nil {
         c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
         return
     }
+    ids, err := req.resolve(c, models.FilterEntityDeal)
+    if err != nil {
+        respondViewError(c, err)
+        return
+    }
+    if len(ids) == 0 {
+        c.JSON(http.StatusOK, gin.H{"success": true, "updated": 0})
+        return
+    }
+    req.IDs = ids
 
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
@@ -1522,7 +1475,7 @@ func BatchUpdateDealsResponsible(c *gin.Context) {
         var count int
         err := tx.QueryRow(c.Request.Context(), `
             SELECT COUNT(*) FROM crm_deals 
-            WHERE id = ANY($1) AND user_id != $2
+            WHERE id = ANY($1) AND user_id != $2 AND deleted_at IS NULL
         `, req.IDs, userID).Scan(&count)
         if err != nil {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1534,7 +1487,7 @@ func BatchUpdateDealsResponsible(c *gin.Context) {
         }
     }
 
-    rows, err := tx.Query(c.Request.Context(), "SELECT DISTINCT customer_id FROM crm_deals WHERE id = ANY($1)", req.IDs)
+    rows, err := tx.Query(c.Request.Context(), "SELECT DISTINCT customer_id FROM crm_deals WHERE id = ANY($1) AND deleted_at IS NULL", req.IDs)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
@@ -1561,7 +1514,7 @@ func BatchUpdateDealsResponsible(c *gin.Context) {
     _, err = tx.Exec(c.Request.Context(), `
         UPDATE crm_deals 
         SET responsible = $1, updated_at = NOW() 
-        WHERE id = ANY($2)
+        WHERE id = ANY($2) AND deleted_at IS NULL
     `, req.Responsible, req.IDs)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1573,6 +1526,11 @@ func BatchUpdateDealsResponsible(c *gin.Context) {
         return
     }
 
+    for _, id := range req.IDs {
+        publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealUpdated, EntityType: "deal", EntityID: id,
+            Payload: gin.H{"fields": []string{"responsible"}, "responsible": req.Responsible}})
+    }
+
     for _, cid := range customerIDs {
         if err := updateLeadScore(c.Request.Context(), cid); err != nil {
             log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", cid, err)
@@ -1589,26 +1547,20 @@ func GetCRMStats(c *gin.Context) {
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
 
-    userFilter := ""
+    userFilter := " WHERE deleted_at IS NULL"
     args := []interface{}{}
     if !isAdmin && userID != "" {
-        userFilter = " WHERE user_id = $" + strconv.Itoa(len(args)+1)
+        userFilter += " AND user_id = $" + strconv.Itoa(len(args)+1)
         args = append(args, userID)
     }
 
+    // Этапы упорядочены по воронкам; одинаковые коды из разных воронок объединяются
     rows, err := database.Pool.Query(ctx, `
-        SELECT stage, COUNT(*) as count, COALESCE(SUM(value), 0) as total_value
-        FROM crm_deals`+userFilter+`
-        GROUP BY stage
-        ORDER BY 
-            CASE stage
-                WHEN 'lead' THEN 1
-                WHEN 'negotiation' THEN 2
-                WHEN 'proposal' THEN 3
-                WHEN 'closed_won' THEN 4
-                WHEN 'closed_lost' THEN 5
-                ELSE 6
-            END
+        SELECT d.stage, COUNT(*) as count, COALESCE(SUM(d.value), 0) as total_value
+        FROM (SELECT * FROM crm_deals`+userFilter+`) d
+        LEFT JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+        GROUP BY d.stage
+        ORDER BY MIN(COALESCE(ps.sort_order, 1000)), d.stage
     `, args...)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -1636,7 +1588,7 @@ func GetCRMStats(c *gin.Context) {
             COUNT(*) as deals_created,
             COALESCE(SUM(value), 0) as total_value
         FROM crm_deals`+userFilter+`
-        WHERE created_at >= NOW() - INTERVAL '12 months'
+        AND created_at >= NOW() - INTERVAL '12 months'
         GROUP BY date_trunc('month', created_at)
         ORDER BY month
     `, args...)
@@ -1663,13 +1615,13 @@ func GetCRMStats(c *gin.Context) {
     var totalDeals, totalCustomers int
     var totalValue float64
     if !isAdmin && userID != "" {
-        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_deals WHERE user_id = $1`, userID).Scan(&totalDeals)
-        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_customers WHERE user_id = $1`, userID).Scan(&totalCustomers)
-        database.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(value), 0) FROM crm_deals WHERE user_id = $1`, userID).Scan(&totalValue)
+        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_deals WHERE user_id = $1 AND deleted_at IS NULL`, userID).Scan(&totalDeals)
+        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_customers WHERE user_id = $1 AND deleted_at IS NULL`, userID).Scan(&totalCustomers)
+        database.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(value), 0) FROM crm_deals WHERE user_id = $1 AND deleted_at IS NULL`, userID).Scan(&totalValue)
     } else {
-        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_deals`).Scan(&totalDeals)
-        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_customers`).Scan(&totalCustomers)
-        database.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(value), 0) FROM crm_deals`).Scan(&totalValue)
+        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_deals WHERE deleted_at IS NULL`).Scan(&totalDeals)
+        database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_customers WHERE deleted_at IS NULL`).Scan(&totalCustomers)
+        database.Pool.QueryRow(ctx, `SELECT COALESCE(SUM(value), 0) FROM crm_deals WHERE deleted_at IS NULL`).Scan(&totalValue)
     }
 
     c.JSON(http.StatusOK, gin.H{
@@ -1713,7 +1665,7 @@ func GetCRMAdvancedStats(c *gin.Context) {
             COUNT(*) as deals_count,
             COALESCE(SUM(value), 0) as total_value
         FROM crm_deals
-        WHERE 1=1 ` + dateFilter + userFilter + `
+        WHERE deleted_at IS NULL ` + dateFilter + userFilter + `
         GROUP BY responsible
         ORDER BY total_value DESC
     `
@@ -1745,7 +1697,7 @@ func GetCRMAdvancedStats(c *gin.Context) {
             COUNT(*) as deals_count,
             COALESCE(SUM(value), 0) as total_value
         FROM crm_deals
-        WHERE 1=1 ` + dateFilter + userFilter + `
+        WHERE deleted_at IS NULL ` + dateFilter + userFilter + `
         GROUP BY source
         ORDER BY total_value DESC
     `
@@ -1777,7 +1729,7 @@ func GetCRMAdvancedStats(c *gin.Context) {
             COUNT(*) as deals_created,
             COALESCE(SUM(value), 0) as total_value
         FROM crm_deals
-        WHERE 1=1 ` + dateFilter + userFilter + `
+        WHERE deleted_at IS NULL ` + dateFilter + userFilter + `
         GROUP BY date_trunc('month', created_at)
         ORDER BY month
     `
@@ -1813,100 +1765,72 @@ func GetCRMAdvancedStats(c *gin.Context) {
 // ========== НОВЫЕ ФУНКЦИИ АНАЛИТИКИ ==========
 
 // getUserFilterSQL возвращает SQL-условие для фильтрации по текущему пользователю
-// и соответствующие аргументы для параметризованного запроса.
-// Используется во всех функциях аналитики для не-админов.
-func getUserFilterSQL(c *gin.Context) (string, []interface{}) {
+// (и без сделок из корзины) и аргументы, дописанные к args (нумерация параметров продолжается).
+// Используется во всех функциях аналитики; crm_deals в запросе – алиас d.
+func getUserFilterSQL(c *gin.Context, args []interface{}) (string, []interface{}) {
     userID := getUserIDFromContext(c)
     isAdmin := isAdmin(c)
     if isAdmin || userID == "" {
-        return "", nil
+        return " AND d.deleted_at IS NULL", args
     }
-    return " AND user_id = $" + strconv.Itoa(1), []interface{}{userID}
+    return " AND d.deleted_at IS NULL AND d.user_id = $" + strconv.Itoa(len(args)+1), append(args, userID)
 }
 
-// GetSalesForecast возвращает прогноз продаж на 3 месяца
-// на основе среднемесячных значений за последние 6 месяцев и текущих сделок.
+// GetSalesForecast возвращает прогноз продаж воронки (?pipeline_id, по умолчанию – основная)
+// на 3 месяца на основе среднемесячных выигранных сделок за 6 месяцев и открытых сделок.
+// Выигранные и проигранные этапы берутся из настроек воронки.
 func GetSalesForecast(c *gin.Context) {
-    ctx := c.Request.Context()
-    userFilter, args := getUserFilterSQL(c)
-
-    var avgMonthly float64
-    queryAvg := `
-        SELECT COALESCE(AVG(monthly_total), 0)
-        FROM (
-            SELECT DATE_TRUNC('month', created_at) as month, SUM(value) as monthly_total
-            FROM crm_deals
-            WHERE stage = 'closed_won'` + userFilter + `
-            AND created_at >= NOW() - INTERVAL '6 months'
-            GROUP BY DATE_TRUNC('month', created_at)
-        ) t
-    `
-    err := database.Pool.QueryRow(ctx, queryAvg, args...).Scan(&avgMonthly)
-    if err != nil {
-        log.Printf("❌ GetSalesForecast avg error: %v", err)
+    pipeline, ok := pipelineFromQuery(c)
+    if !ok {
+        return
     }
-
-    var weightedForecast float64
-    queryWeighted := `
-        SELECT COALESCE(SUM(value * probability::float / 100), 0)
-        FROM crm_deals
-        WHERE stage NOT IN ('closed_won', 'closed_lost')` + userFilter
-    err = database.Pool.QueryRow(ctx, queryWeighted, args...).Scan(&weightedForecast)
-    if err != nil {
-        log.Printf("❌ GetSalesForecast weighted error: %v", err)
+    ownerID := getUserIDFromContext(c)
+    if isAdmin(c) {
+        ownerID = ""
     }
-
-    var conversion float64
-    queryConv := `
-        SELECT 
-            COALESCE(
-                SUM(CASE WHEN stage = 'closed_won' THEN 1 ELSE 0 END) * 1.0 / 
-                NULLIF(SUM(CASE WHEN stage IN ('closed_won', 'closed_lost') THEN 1 ELSE 0 END), 0),
-                0
-            ) * 100
-        FROM crm_deals
-        WHERE 1=1` + userFilter
-    err = database.Pool.QueryRow(ctx, queryConv, args...).Scan(&conversion)
+    forecast, err := models.GetSalesForecast(c.Request.Context(), pipeline.ID, ownerID)
     if err != nil {
-        log.Printf("❌ GetSalesForecast conversion error: %v", err)
-    }
-
-    months := make([]map[string]interface{}, 3)
-    for i := 0; i < 3; i++ {
-        monthTime := time.Now().AddDate(0, i+1, 0)
-        monthStr := monthTime.Format("2006-01")
-        months[i] = map[string]interface{}{
-            "month": monthStr,
-            "value": avgMonthly,
-        }
+        log.Printf("❌ GetSalesForecast error: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        return
     }
-
-    c.JSON(http.StatusOK, gin.H{
-        "avg_monthly_value": avgMonthly,
-        "weighted_forecast": weightedForecast,
-        "conversion":        conversion,
-        "months":            months,
-    })
+    c.JSON(http.StatusOK, forecast)
 }
 
-// GetStageConversion возвращает конверсию по этапам воронки продаж.
+// GetStageConversion возвращает конверсию по этапам воронки (?pipeline_id, по умолчанию – основная)
+// в порядке этапов; percent – доля от количества сделок на предыдущем этапе.
 func GetStageConversion(c *gin.Context) {
     ctx := c.Request.Context()
-    userFilter, args := getUserFilterSQL(c)
-
-    stages := []string{"lead", "negotiation", "proposal", "closed_won", "closed_lost"}
-    result := make([]map[string]interface{}, 0, len(stages))
+    pipeline, ok := pipelineFromQuery(c)
+    if !ok {
+        return
+    }
+    userFilter, args := getUserFilterSQL(c, []interface{}{pipeline.ID})
 
-    var prevCount int
-    for i, stage := range stages {
+    counts := make(map[string]int, len(pipeline.Stages))
+    rows, err := database.Pool.Query(ctx, `
+        SELECT d.stage, COUNT(*) FROM crm_deals d
+        WHERE d.pipeline_id = $1`+userFilter+`
+        GROUP BY d.stage
+    `, args...)
+    if err != nil {
+        log.Printf("❌ GetStageConversion error: %v", err)
+        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        return
+    }
+    for rows.Next() {
+        var stage string
         var count int
-        query := `SELECT COUNT(*) FROM crm_deals WHERE stage = $1` + userFilter
-        queryArgs := append([]interface{}{stage}, args...)
-        err := database.Pool.QueryRow(ctx, query, queryArgs...).Scan(&count)
-        if err != nil {
-            log.Printf("❌ GetStageConversion error for stage %s: %v", stage, err)
-            count = 0
+        if err := rows.Scan(&stage, &count); err == nil {
+            counts[stage] = count
         }
+    }
+    rows.Close()
+
+    result := make([]map[string]interface{}, 0, len(pipeline.Stages))
+    var prevCount int
+    for i, stage := range pipeline.Stages {
+        count := counts[stage.Code]
 
         percent := 0.0
         if i > 0 && prevCount > 0 {
@@ -1914,7 +1838,10 @@ func GetStageConversion(c *gin.Context) {
         }
 
         result = append(result, gin.H{
-            "stage":   stage,
+            "stage":   stage.Code,
+            "name":    stage.Name,
+            "is_won":  stage.IsWon,
+            "is_lost": stage.IsLost,
             "count":   count,
             "percent": percent,
         })
@@ -1927,7 +1854,54 @@ func GetStageConversion(c *gin.Context) {
 
 // ========== ВЛОЖЕНИЯ К СДЕЛКАМ ==========
 
-const uploadDir = "./uploads/crm"
+// dealAttachment – вложение с владельцем сделки. FileHash пуст у вложений, загруженных до перехода
+// на файловое хранилище: они лежат на локальном диске по FilePath.
+type dealAttachment struct {
+    ID           string
+    DealID       string
+    OwnerID      string
+    FileName     string
+    FilePath     string
+    FileSize     int64
+    MimeType     string
+    FileHash     *string
+    ThumbnailKey *string
+}
+
+func (a *dealAttachment) downloadOptions(inline bool) services.DownloadOptions {
+    return services.DownloadOptions{FileName: a.FileName, ContentType: a.MimeType, Inline: inline}
+}
+
+// loadDealAttachment загружает вложение и проверяет доступ к сделке; при ошибке ответ уже отправлен
+func loadDealAttachment(c *gin.Context) (*dealAttachment, bool) {
+    attachmentID := c.Param("attachment_id")
+    if attachmentID == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "attachment_id required"})
+        return nil, false
+    }
+
+    var a dealAttachment
+    var ownerID sql.NullString
+    err := database.Pool.QueryRow(c.Request.Context(), `
+        SELECT da.id, d.id, d.user_id, da.file_name, da.file_path, da.file_size, COALESCE(da.mime_type, ''),
+               da.file_hash, b.thumbnail_key
+        FROM deal_attachments da
+        JOIN crm_deals d ON d.id = da.deal_id
+        LEFT JOIN file_blobs b ON b.sha256 = da.file_hash
+        WHERE da.id = $1 AND da.deleted_at IS NULL AND d.deleted_at IS NULL
+    `, attachmentID).Scan(&a.ID, &a.DealID, &ownerID, &a.FileName, &a.FilePath, &a.FileSize, &a.MimeType, &a.FileHash, &a.ThumbnailKey)
+    if err != nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+        return nil, false
+    }
+    a.OwnerID = ownerID.String
+
+    if !isAdmin(c) && a.OwnerID != getUserIDFromContext(c) {
+        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+        return nil, false
+    }
+    return &a, true
+}
 
 func UploadDealAttachment(c *gin.Context) {
     dealID := c.Param("id")
@@ -1940,7 +1914,7 @@ func UploadDealAttachment(c *gin.Context) {
     isAdmin := isAdmin(c)
 
     var ownerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", dealID).Scan(&ownerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", dealID).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
@@ -1950,45 +1924,36 @@ func UploadDealAttachment(c *gin.Context) {
         return
     }
 
-    file, err := c.FormFile("file")
+    blob, fileName, _, err := receiveUpload(c, "file", services.UploadPolicyAttachment)
     if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "No file uploaded"})
-        return
-    }
-
-    if err := os.MkdirAll(uploadDir, 0755); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Cannot create upload directory"})
-        return
-    }
-
-    ext := filepath.Ext(file.Filename)
-    newFileName := uuid.New().String() + ext
-    filePath := filepath.Join(uploadDir, newFileName)
-
-    if err := c.SaveUploadedFile(file, filePath); err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+        respondUploadError(c, err)
         return
     }
 
     var attachmentID string
+    var uploadedAt time.Time
     err = database.Pool.QueryRow(c.Request.Context(), `
-        INSERT INTO deal_attachments (deal_id, file_name, file_path, file_size, mime_type, uploaded_by)
-        VALUES ($1, $2, $3, $4, $5, $6)
-        RETURNING id
-    `, dealID, file.Filename, filePath, file.Size, file.Header.Get("Content-Type"), userID).Scan(&attachmentID)
+        INSERT INTO deal_attachments (deal_id, file_name, file_path, file_size, mime_type, file_hash, uploaded_by)
+        VALUES ($1, $2, $3, $4, $5, $6, $7)
+        RETURNING id, uploaded_at
+    `, dealID, fileName, blob.StorageKey, blob.Size, blob.MimeType, blob.SHA256, userID).Scan(&attachmentID, &uploadedAt)
 
     if err != nil {
-        os.Remove(filePath)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
         return
     }
 
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventAttachmentUploaded, EntityType: "deal", EntityID: dealID, OwnerID: &ownerID,
+        Payload: gin.H{"attachment_id": attachmentID, "file_name": fileName, "file_size": blob.Size}})
+
     c.JSON(http.StatusOK, gin.H{
-        "id":          attachmentID,
-        "file_name":   file.Filename,
-        "file_size":   file.Size,
-        "mime_type":   file.Header.Get("Content-Type"),
-        "uploaded_at": time.Now(),
+        "id":            attachmentID,
+        "file_name":     fileName,
+        "file_size":     blob.Size,
+        "mime_type":     blob.MimeType,
+        "sha256":        blob.SHA256,
+        "has_thumbnail": blob.ThumbnailKey != nil,
+        "uploaded_at":   uploadedAt,
     })
 }
 
@@ -2003,7 +1968,7 @@ func GetDealAttachments(c *gin.Context) {
     isAdmin := isAdmin(c)
 
     var ownerID string
-    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", dealID).Scan(&ownerID)
+    err := database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", dealID).Scan(&ownerID)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
         return
@@ -2014,10 +1979,12 @@ func GetDealAttachments(c *gin.Context) {
     }
 
     rows, err := database.Pool.Query(c.Request.Context(), `
-        SELECT id, file_name, file_path, file_size, mime_type, uploaded_by, uploaded_at
-        FROM deal_attachments
-        WHERE deal_id = $1
-        ORDER BY uploaded_at DESC
+        SELECT da.id, da.file_name, da.file_path, da.file_size, COALESCE(da.mime_type, ''), da.file_hash,
+               b.thumbnail_key IS NOT NULL, da.uploaded_by, da.uploaded_at
+        FROM deal_attachments da
+        LEFT JOIN file_blobs b ON b.sha256 = da.file_hash
+        WHERE da.deal_id = $1 AND da.deleted_at IS NULL
+        ORDER BY da.uploaded_at DESC
     `, dealID)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -2026,20 +1993,22 @@ func GetDealAttachments(c *gin.Context) {
     defer rows.Close()
 
     type Attachment struct {
-        ID         string    `json:"id"`
-        FileName   string    `json:"file_name"`
-        FilePath   string    `json:"file_path"`
-        FileSize   int64     `json:"file_size"`
-        MimeType   string    `json:"mime_type"`
-        UploadedBy *string   `json:"uploaded_by,omitempty"`
-        UploadedAt time.Time `json:"uploaded_at"`
+        ID           string    `json:"id"`
+        FileName     string    `json:"file_name"`
+        FilePath     string    `json:"file_path"`
+        FileSize     int64     `json:"file_size"`
+        MimeType     string    `json:"mime_type"`
+        SHA256       *string   `json:"sha256,omitempty"`
+        HasThumbnail bool      `json:"has_thumbnail"`
+        UploadedBy   *string   `json:"uploaded_by,omitempty"`
+        UploadedAt   time.Time `json:"uploaded_at"`
     }
 
     attachments := []Attachment{} // важно: инициализируем пустым срезом, а не nil
     for rows.Next() {
         var a Attachment
         var uploadedBy sql.NullString
-        err := rows.Scan(&a.ID, &a.FileName, &a.FilePath, &a.FileSize, &a.MimeType, &uploadedBy, &a.UploadedAt)
+        err := rows.Scan(&a.ID, &a.FileName, &a.FilePath, &a.FileSize, &a.MimeType, &a.SHA256, &a.HasThumbnail, &uploadedBy, &a.UploadedAt)
         if err != nil {
             continue
         }
@@ -2051,138 +2020,98 @@ func GetDealAttachments(c *gin.Context) {
 
     c.JSON(http.StatusOK, attachments) // теперь всегда массив, даже пустой
 }
+
 func DownloadDealAttachment(c *gin.Context) {
-    attachmentID := c.Param("attachment_id")
-    if attachmentID == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "attachment_id required"})
+    a, ok := loadDealAttachment(c)
+    if !ok {
         return
     }
-
-    userID := getUserIDFromContext(c)
-    isAdmin := isAdmin(c)
-
-    var dealID string
-    var filePath, fileName string
-    err := database.Pool.QueryRow(c.Request.Context(), `
-        SELECT da.file_path, da.file_name, d.user_id
-        FROM deal_attachments da
-        JOIN crm_deals d ON d.id = da.deal_id
-        WHERE da.id = $1
-    `, attachmentID).Scan(&filePath, &fileName, &dealID)
-    if err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+    if a.FileHash == nil {
+        c.FileAttachment(a.FilePath, a.FileName)
         return
     }
+    serveStoredFile(c, a.FilePath, a.FileSize, a.downloadOptions(false))
+}
 
-    if !isAdmin && dealID != userID {
-        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+// DownloadDealAttachmentThumbnail отдаёт JPEG-миниатюру вложения-изображения
+func DownloadDealAttachmentThumbnail(c *gin.Context) {
+    a, ok := loadDealAttachment(c)
+    if !ok {
         return
     }
-
-    c.FileAttachment(filePath, fileName)
+    if a.ThumbnailKey == nil {
+        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment has no thumbnail"})
+        return
+    }
+    serveStoredFile(c, *a.ThumbnailKey, -1, services.DownloadOptions{ContentType: "image/jpeg", Inline: true})
 }
 
-func DeleteDealAttachment(c *gin.Context) {
-    attachmentID := c.Param("attachment_id")
-    if attachmentID == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "attachment_id required"})
+// GetDealAttachmentURL выдаёт временную ссылку на скачивание (?thumbnail=true – на миниатюру,
+// ?inline=true – для просмотра в браузере, ?ttl= – срок в секундах)
+func GetDealAttachmentURL(c *gin.Context) {
+    a, ok := loadDealAttachment(c)
+    if !ok {
         return
     }
-
-    userID := getUserIDFromContext(c)
-    isAdmin := isAdmin(c)
-
-    var dealID, filePath string
-    err := database.Pool.QueryRow(c.Request.Context(), `
-        SELECT da.file_path, d.user_id
-        FROM deal_attachments da
-        JOIN crm_deals d ON d.id = da.deal_id
-        WHERE da.id = $1
-    `, attachmentID).Scan(&filePath, &dealID)
-    if err != nil {
-        c.JSON(http.StatusNotFound, gin.H{"error": "Attachment not found"})
+    if a.FileHash == nil {
+        c.JSON(http.StatusConflict, gin.H{"error": "Attachment was uploaded before file storage migration; use the download endpoint"})
         return
     }
+    if c.Query("thumbnail") == "true" {
+        if a.ThumbnailKey == nil {
+            c.JSON(http.StatusNotFound, gin.H{"error": "Attachment has no thumbnail"})
+            return
+        }
+        signedFileURL(c, *a.ThumbnailKey, services.DownloadOptions{ContentType: "image/jpeg", Inline: true})
+        return
+    }
+    signedFileURL(c, a.FilePath, a.downloadOptions(c.Query("inline") == "true"))
+}
 
-    if !isAdmin && dealID != userID {
-        c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+func DeleteDealAttachment(c *gin.Context) {
+    a, ok := loadDealAttachment(c)
+    if !ok {
         return
     }
 
-    _, err = database.Pool.Exec(c.Request.Context(), "DELETE FROM deal_attachments WHERE id = $1", attachmentID)
+    // В корзину: содержимое остаётся в хранилище до окончательного удаления записи
+    userID := getUserIDFromContext(c)
+    items, err := models.MoveToTrash(c.Request.Context(), models.TrashEntityAttachment, []string{a.ID}, &userID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
 
-    os.Remove(filePath)
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventAttachmentDeleted, EntityType: "deal", EntityID: a.DealID, OwnerID: &a.OwnerID,
+        Payload: gin.H{"attachment_id": a.ID, "trash_id": items[0].ID}})
 
-    c.JSON(http.StatusOK, gin.H{"success": true})
+    c.JSON(http.StatusOK, gin.H{"success": true, "trash_id": items[0].ID})
 }
 
 // ========== ЭКСПОРТ ==========
 
-func exportFilteredCustomers(c *gin.Context) ([]Customer, error) {
-    userID := getUserIDFromContext(c)
-    isAdmin := isAdmin(c)
-    status := c.Query("status")
-    search := c.Query("search")
-    city := c.Query("city")
-    createdFrom := c.Query("created_from")
-    createdTo := c.Query("created_to")
-
-    query := `SELECT id, name, email, phone, company, status, responsible, source, comment, created_at, last_seen, city, social_media, birthday, notes
-              FROM crm_customers`
-    args := []interface{}{}
-    where := ""
-
-    if !isAdmin && userID != "" {
-        where += " user_id = $" + strconv.Itoa(len(args)+1)
-        args = append(args, userID)
-    }
-    if status != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " status = $" + strconv.Itoa(len(args)+1)
-        args = append(args, status)
-    }
-    if search != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " (name ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%' OR email ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%' OR city ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%')"
-        args = append(args, search)
-    }
-    if city != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " city = $" + strconv.Itoa(len(args)+1)
-        args = append(args, city)
-    }
-    if createdFrom != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " created_at >= $" + strconv.Itoa(len(args)+1) + "::date"
-        args = append(args, createdFrom)
+// exportFilteredCustomers возвращает клиентов для экспорта и схему их пользовательских полей
+// (по ней строятся дополнительные колонки)
+func exportFilteredCustomers(c *gin.Context) ([]Customer, []*models.CustomField, error) {
+    q, err := crmListQuery(c, models.FilterEntityCustomer)
+    if err != nil {
+        return nil, nil, err
     }
-    if createdTo != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " created_at < ($" + strconv.Itoa(len(args)+1) + "::date + '1 day'::interval)"
-        args = append(args, createdTo)
+    _, where, orderBy, args, err := q.SQL(c.Request.Context(), nil)
+    if err != nil {
+        return nil, nil, err
     }
-    if where != "" {
-        query += " WHERE" + where
+    fields, err := models.ListCustomFields(c.Request.Context(), models.CustomFieldEntityCustomer)
+    if err != nil {
+        return nil, nil, err
     }
-    query += " ORDER BY created_at DESC"
+
+    query := `SELECT id, name, email, phone, company, status, responsible, source, comment, created_at, last_seen, city, social_media, birthday, notes, custom_fields
+              FROM crm_customers WHERE ` + where + ` ORDER BY ` + orderBy
 
     rows, err := database.Pool.Query(c.Request.Context(), query, args...)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     defer rows.Close()
 
@@ -2191,12 +2120,14 @@ func exportFilteredCustomers(c *gin.Context) ([]Customer, error) {
         var cst Customer
         var socialMedia []byte
         var birthday sql.NullTime
+        var customFields []byte
         err := rows.Scan(&cst.ID, &cst.Name, &cst.Email, &cst.Phone, &cst.Company, &cst.Status,
             &cst.Responsible, &cst.Source, &cst.Comment, &cst.CreatedAt, &cst.LastSeen,
-            &cst.City, &socialMedia, &birthday, &cst.Notes)
+            &cst.City, &socialMedia, &birthday, &cst.Notes, &customFields)
         if err != nil {
             continue
         }
+        cst.CustomFields = decodeCustomFields(customFields)
         if socialMedia != nil {
             cst.SocialMedia = json.RawMessage(socialMedia)
         }
@@ -2206,13 +2137,13 @@ func exportFilteredCustomers(c *gin.Context) ([]Customer, error) {
         // ДОБАВЛЕНО: теги не экспортируем в CSV/Excel (можно добавить при желании)
         customers = append(customers, cst)
     }
-    return customers, nil
+    return customers, fields, nil
 }
 
 func ExportCustomersCSV(c *gin.Context) {
-    customers, err := exportFilteredCustomers(c)
+    customers, fields, err := exportFilteredCustomers(c)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondViewError(c, err)
         return
     }
 
@@ -2220,14 +2151,15 @@ func ExportCustomersCSV(c *gin.Context) {
     writer := csv.NewWriter(buf)
     defer writer.Flush()
 
-    writer.Write([]string{"ID", "Имя", "Email", "Телефон", "Компания", "Статус", "Ответственный", "Источник", "Комментарий", "Дата создания", "Последний визит", "Город", "Соцсети", "День рождения", "Заметки"})
+    writer.Write(append([]string{"ID", "Имя", "Email", "Телефон", "Компания", "Статус", "Ответственный", "Источник", "Комментарий", "Дата создания", "Последний визит", "Город", "Соцсети", "День рождения", "Заметки"},
+        customFieldHeaders(fields)...))
 
     for _, cst := range customers {
         birthday := ""
         if cst.Birthday != nil {
             birthday = cst.Birthday.Format("2006-01-02")
         }
-        writer.Write([]string{
+        writer.Write(append([]string{
             cst.ID,
             cst.Name,
             cst.Email,
@@ -2243,7 +2175,7 @@ func ExportCustomersCSV(c *gin.Context) {
             string(cst.SocialMedia),
             birthday,
             cst.Notes,
-        })
+        }, customFieldRow(fields, cst.CustomFields)...))
     }
 
     c.Header("Content-Description", "File Transfer")
@@ -2252,9 +2184,9 @@ func ExportCustomersCSV(c *gin.Context) {
 }
 
 func ExportCustomersExcel(c *gin.Context) {
-    customers, err := exportFilteredCustomers(c)
+    customers, fields, err := exportFilteredCustomers(c)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondViewError(c, err)
         return
     }
 
@@ -2269,6 +2201,7 @@ func ExportCustomersExcel(c *gin.Context) {
         cell := fmt.Sprintf("%c%d", 'A'+i, 1)
         f.SetCellValue(sheet, cell, h)
     }
+    setCustomFieldHeaders(f, sheet, len(headers)+1, fields)
 
     for i, cst := range customers {
         row := i + 2
@@ -2291,13 +2224,15 @@ func ExportCustomersExcel(c *gin.Context) {
         f.SetCellValue(sheet, fmt.Sprintf("M%d", row), string(cst.SocialMedia))
         f.SetCellValue(sheet, fmt.Sprintf("N%d", row), birthday)
         f.SetCellValue(sheet, fmt.Sprintf("O%d", row), cst.Notes)
+        setCustomFieldCells(f, sheet, len(headers)+1, row, fields, cst.CustomFields)
     }
 
     style, _ := f.NewStyle(&excelize.Style{
         Font: &excelize.Font{Bold: true},
         Fill: excelize.Fill{Type: "pattern", Color: []string{"#DDDDDD"}, Pattern: 1},
     })
-    f.SetCellStyle(sheet, "A1", "O1", style)
+    lastHeader, _ := excelize.CoordinatesToCellName(len(headers)+len(fields), 1)
+    f.SetCellStyle(sheet, "A1", lastHeader, style)
 
     for i := 1; i <= 15; i++ {
         col := string(rune('A' + i - 1))
@@ -2315,83 +2250,27 @@ func ExportCustomersExcel(c *gin.Context) {
     c.Data(http.StatusOK, "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", buf.Bytes())
 }
 
-func exportFilteredDeals(c *gin.Context) ([]Deal, error) {
-    userID := getUserIDFromContext(c)
-    isAdmin := isAdmin(c)
-    stage := c.Query("stage")
-    search := c.Query("search")
-    category := c.Query("category")
-    valueMin := c.Query("value_min")
-    valueMax := c.Query("value_max")
-    closeFrom := c.Query("close_from")
-    closeTo := c.Query("close_to")
-
-    query := `SELECT id, customer_id, title, value, stage, probability, responsible, source, comment, expected_close, created_at, closed_at, product_category, discount, next_action_date
-              FROM crm_deals`
-    args := []interface{}{}
-    where := ""
-
-    if !isAdmin && userID != "" {
-        where += " user_id = $" + strconv.Itoa(len(args)+1)
-        args = append(args, userID)
-    }
-    if stage != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " stage = $" + strconv.Itoa(len(args)+1)
-        args = append(args, stage)
-    }
-    if search != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " title ILIKE '%' || $" + strconv.Itoa(len(args)+1) + " || '%'"
-        args = append(args, search)
-    }
-    if category != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " product_category = $" + strconv.Itoa(len(args)+1)
-        args = append(args, category)
-    }
-    if valueMin != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " value >= $" + strconv.Itoa(len(args)+1)
-        args = append(args, valueMin)
-    }
-    if valueMax != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " value <= $" + strconv.Itoa(len(args)+1)
-        args = append(args, valueMax)
-    }
-    if closeFrom != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " expected_close >= $" + strconv.Itoa(len(args)+1) + "::date"
-        args = append(args, closeFrom)
+// exportFilteredDeals возвращает сделки для экспорта и схему их пользовательских полей
+func exportFilteredDeals(c *gin.Context) ([]Deal, []*models.CustomField, error) {
+    q, err := crmListQuery(c, models.FilterEntityDeal)
+    if err != nil {
+        return nil, nil, err
     }
-    if closeTo != "" {
-        if where != "" {
-            where += " AND"
-        }
-        where += " expected_close < ($" + strconv.Itoa(len(args)+1) + "::date + '1 day'::interval)"
-        args = append(args, closeTo)
+    _, where, orderBy, args, err := q.SQL(c.Request.Context(), nil)
+    if err != nil {
+        return nil, nil, err
     }
-    if where != "" {
-        query += " WHERE" + where
+    fields, err := models.ListCustomFields(c.Request.Context(), models.CustomFieldEntityDeal)
+    if err != nil {
+        return nil, nil, err
     }
-    query += " ORDER BY created_at DESC"
+
+    query := `SELECT id, customer_id, title, value, stage, probability, responsible, source, comment, expected_close, created_at, closed_at, product_category, discount, next_action_date, custom_fields
+              FROM crm_deals WHERE ` + where + ` ORDER BY ` + orderBy
 
     rows, err := database.Pool.Query(c.Request.Context(), query, args...)
     if err != nil {
-        return nil, err
+        return nil, nil, err
     }
     defer rows.Close()
 
@@ -2399,25 +2278,27 @@ func exportFilteredDeals(c *gin.Context) ([]Deal, error) {
     for rows.Next() {
         var d Deal
         var nextActionDate sql.NullTime
+        var customFields []byte
         err := rows.Scan(&d.ID, &d.CustomerID, &d.Title, &d.Value, &d.Stage, &d.Probability,
             &d.Responsible, &d.Source, &d.Comment, &d.ExpectedClose, &d.CreatedAt, &d.ClosedAt,
-            &d.ProductCategory, &d.Discount, &nextActionDate)
+            &d.ProductCategory, &d.Discount, &nextActionDate, &customFields)
         if err != nil {
             continue
         }
+        d.CustomFields = decodeCustomFields(customFields)
         if nextActionDate.Valid {
             d.NextActionDate = &nextActionDate.Time
         }
         // ДОБАВЛЕНО: теги не экспортируем
         deals = append(deals, d)
     }
-    return deals, nil
+    return deals, fields, nil
 }
 
 func ExportDealsCSV(c *gin.Context) {
-    deals, err := exportFilteredDeals(c)
+    deals, fields, err := exportFilteredDeals(c)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondViewError(c, err)
         return
     }
 
@@ -2425,7 +2306,8 @@ func ExportDealsCSV(c *gin.Context) {
     writer := csv.NewWriter(buf)
     defer writer.Flush()
 
-    writer.Write([]string{"ID", "Клиент ID", "Название", "Сумма", "Стадия", "Вероятность", "Ответственный", "Источник", "Комментарий", "Ожидаемая дата", "Дата создания", "Дата закрытия", "Категория", "Скидка", "Следующее действие"})
+    writer.Write(append([]string{"ID", "Клиент ID", "Название", "Сумма", "Стадия", "Вероятность", "Ответственный", "Источник", "Комментарий", "Ожидаемая дата", "Дата создания", "Дата закрытия", "Категория", "Скидка", "Следующее действие"},
+        customFieldHeaders(fields)...))
 
     for _, d := range deals {
         expectedClose := ""
@@ -2440,7 +2322,7 @@ func ExportDealsCSV(c *gin.Context) {
         if d.NextActionDate != nil {
             nextAction = d.NextActionDate.Format("2006-01-02")
         }
-        writer.Write([]string{
+        writer.Write(append([]string{
             d.ID,
             d.CustomerID,
             d.Title,
@@ -2456,7 +2338,7 @@ func ExportDealsCSV(c *gin.Context) {
             d.ProductCategory,
             strconv.FormatFloat(d.Discount, 'f', 2, 64),
             nextAction,
-        })
+        }, customFieldRow(fields, d.CustomFields)...))
     }
 
     c.Header("Content-Description", "File Transfer")
@@ -2465,9 +2347,9 @@ func ExportDealsCSV(c *gin.Context) {
 }
 
 func ExportDealsExcel(c *gin.Context) {
-    deals, err := exportFilteredDeals(c)
+    deals, fields, err := exportFilteredDeals(c)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondViewError(c, err)
         return
     }
 
@@ -2482,6 +2364,7 @@ func ExportDealsExcel(c *gin.Context) {
         cell := fmt.Sprintf("%c%d", 'A'+i, 1)
         f.SetCellValue(sheet, cell, h)
     }
+    setCustomFieldHeaders(f, sheet, len(headers)+1, fields)
 
     for i, d := range deals {
         row := i + 2
@@ -2512,13 +2395,15 @@ func ExportDealsExcel(c *gin.Context) {
         f.SetCellValue(sheet, fmt.Sprintf("M%d", row), d.ProductCategory)
         f.SetCellValue(sheet, fmt.Sprintf("N%d", row), d.Discount)
         f.SetCellValue(sheet, fmt.Sprintf("O%d", row), nextAction)
+        setCustomFieldCells(f, sheet, len(headers)+1, row, fields, d.CustomFields)
     }
 
     style, _ := f.NewStyle(&excelize.Style{
         Font: &excelize.Font{Bold: true},
         Fill: excelize.Fill{Type: "pattern", Color: []string{"#DDDDDD"}, Pattern: 1},
     })
-    f.SetCellStyle(sheet, "A1", "O1", style)
+    lastHeader, _ := excelize.CoordinatesToCellName(len(headers)+len(fields), 1)
+    f.SetCellStyle(sheet, "A1", lastHeader, style)
 
     for i := 1; i <= 15; i++ {
         col := string(rune('A' + i - 1))
@@ -2541,7 +2426,7 @@ func ExportDealsExcel(c *gin.Context) {
 // GetTags возвращает список всех тегов
 func GetTags(c *gin.Context) {
     rows, err := database.Pool.Query(c.Request.Context(), `
-        SELECT id, name, color, created_at FROM tags ORDER BY name
+        SELECT id, name, color, created_at FROM tags WHERE deleted_at IS NULL ORDER BY name
     `)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
@@ -2614,12 +2499,14 @@ func UpdateTag(c *gin.Context) {
 // DeleteTag удаляет тег
 func DeleteTag(c *gin.Context) {
     id := c.Param("id")
-    _, err := database.Pool.Exec(c.Request.Context(), "DELETE FROM tags WHERE id = $1", id)
+    userID := getUserIDFromContext(c)
+    // Связи с клиентами и сделками сохраняются, но удалённый тег нигде не показывается
+    items, err := models.MoveToTrash(c.Request.Context(), models.TrashEntityTag, []string{id}, &userID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
-    c.JSON(http.StatusOK, gin.H{"success": true})
+    c.JSON(http.StatusOK, gin.H{"success": true, "trash_id": items[0].ID})
 }
 
 // getTagsForEntity возвращает список ID тегов для сущности
@@ -2632,7 +2519,10 @@ func getTagsForEntity(ctx context.Context, entityType, entityID string) ([]strin
     } else {
         return nil, fmt.Errorf("invalid entity type")
     }
-    rows, err := database.Pool.Query(ctx, fmt.Sprintf("SELECT tag_id FROM %s WHERE %s_id = $1", table, entityType), entityID)
+    rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+        SELECT et.tag_id FROM %s et JOIN tags t ON t.id = et.tag_id
+        WHERE et.%s_id = $1 AND t.deleted_at IS NULL
+    `, table, entityType), entityID)
     if err != nil {
         return nil, err
     }
@@ -2664,8 +2554,11 @@ func updateEntityTags(ctx context.Context, entityType, entityID string, tagIDs [
     }
     defer tx.Rollback(ctx)
 
-    // Удаляем старые связи
-    if _, err := tx.Exec(ctx, fmt.Sprintf("DELETE FROM %s WHERE %s_id = $1", table, entityType), entityID); err != nil {
+    // Удаляем старые связи; связи с тегами из корзины остаются – они вернутся вместе с тегом
+    if _, err := tx.Exec(ctx, fmt.Sprintf(`
+        DELETE FROM %s WHERE %s_id = $1
+          AND tag_id NOT IN (SELECT id FROM tags WHERE deleted_at IS NOT NULL)
+    `, table, entityType), entityID); err != nil {
         return err
     }
 
@@ -2713,6 +2606,9 @@ func AddActivity(c *gin.Context) {
         return
     }
 
+    publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventActivityAdded, EntityType: req.EntityType, EntityID: req.EntityID,
+        Payload: gin.H{"activity_id": id, "activity_type": req.ActivityType}})
+
     c.JSON(http.StatusCreated, gin.H{"id": id})
 }
 
@@ -2729,7 +2625,7 @@ func GetActivities(c *gin.Context) {
        SELECT a.id, a.entity_type, a.entity_id, a.activity_type, a.content, a.user_id, u.email as user_name, a.created_at
         FROM activities a
         LEFT JOIN users u ON u.id = a.user_id
-        WHERE a.entity_type = $1 AND a.entity_id = $2
+        WHERE a.entity_type = $1 AND a.entity_id = $2 AND a.deleted_at IS NULL
         ORDER BY a.created_at DESC
     `, entityType, entityID)
     if err != nil {
@@ -2773,7 +2669,7 @@ func DeleteActivity(c *gin.Context) {
     var entityType, entityID string
     var activityUserID sql.NullString
     err := database.Pool.QueryRow(c.Request.Context(), `
-        SELECT entity_type, entity_id, user_id FROM activities WHERE id = $1
+        SELECT entity_type, entity_id, user_id FROM activities WHERE id = $1 AND deleted_at IS NULL
     `, activityID).Scan(&entityType, &entityID, &activityUserID)
     if err != nil {
         if err == sql.ErrNoRows {
@@ -2790,9 +2686,9 @@ func DeleteActivity(c *gin.Context) {
         } else {
             var ownerID string
             if entityType == "deal" {
-                err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1", entityID).Scan(&ownerID)
+                err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_deals WHERE id = $1 AND deleted_at IS NULL", entityID).Scan(&ownerID)
             } else if entityType == "customer" {
-                err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1", entityID).Scan(&ownerID)
+                err = database.Pool.QueryRow(c.Request.Context(), "SELECT user_id FROM crm_customers WHERE id = $1 AND deleted_at IS NULL", entityID).Scan(&ownerID)
             } else {
                 c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entity type"})
                 return
@@ -2808,13 +2704,13 @@ func DeleteActivity(c *gin.Context) {
         }
     }
 
-    _, err = database.Pool.Exec(c.Request.Context(), "DELETE FROM activities WHERE id = $1", activityID)
+    items, err := models.MoveToTrash(c.Request.Context(), models.TrashEntityActivity, []string{activityID}, &userID)
     if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+        respondTrashError(c, err)
         return
     }
 
-    c.JSON(http.StatusOK, gin.H{"success": true})
+    c.JSON(http.StatusOK, gin.H{"success": true, "trash_id": items[0].ID})
 }
 
 // CalendarHandler отображает страницу календаря сделок
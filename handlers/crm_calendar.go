@@ -0,0 +1,408 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+// Календарь CRM: задачи (с повторами) и открытые сделки с ожидаемым закрытием и следующим действием.
+// JSON для страницы /calendar и ICS-фид по секретной ссылке для Google/Outlook/Apple календарей.
+
+const (
+	calendarMaxRange       = 366 * 24 * time.Hour
+	calendarMaxOccurrences = 400
+	icsPastWindow          = 90 * 24 * time.Hour
+	icsFutureWindow        = 365 * 24 * time.Hour
+)
+
+// publicURL – внешний адрес приложения для ссылок (фид календаря, код форм); пусто – адрес берётся из запроса
+var publicURL string
+
+// InitCalendar запоминает внешний адрес сервиса (вызывается из main)
+func InitCalendar(cfg *config.Config) {
+	publicURL = cfg.PublicURL
+}
+
+var taskPriorityColors = map[string]string{
+	models.TaskPriorityLow:    "#6c757d",
+	models.TaskPriorityNormal: "#0d6efd",
+	models.TaskPriorityHigh:   "#fd7e14",
+	models.TaskPriorityUrgent: "#dc3545",
+}
+
+// icsPriorities – PRIORITY из RFC 5545: 1 – наивысший, 9 – низший
+var icsPriorities = map[string]int{
+	models.TaskPriorityUrgent: 1,
+	models.TaskPriorityHigh:   3,
+	models.TaskPriorityNormal: 5,
+	models.TaskPriorityLow:    9,
+}
+
+// calendarEvent – событие в формате FullCalendar
+type calendarEvent struct {
+	ID              string                 `json:"id"`
+	Title           string                 `json:"title"`
+	Start           string                 `json:"start"`
+	End             string                 `json:"end,omitempty"`
+	AllDay          bool                   `json:"allDay"`
+	BackgroundColor string                 `json:"backgroundColor"`
+	Editable        bool                   `json:"editable"`
+	ExtendedProps   map[string]interface{} `json:"extendedProps"`
+}
+
+// parseCalendarBound принимает то, что присылает FullCalendar: RFC 3339, локальное время или дату
+func parseCalendarBound(s string) (time.Time, error) {
+	if t, err := parseTaskTime(s); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", s, time.Local)
+}
+
+// GetCalendarEvents возвращает события календаря за ?start=&end= (по умолчанию – текущий месяц)
+func GetCalendarEvents(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	now := time.Now()
+	from := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local)
+	to := from.AddDate(0, 1, 0)
+	var err error
+	if v := c.Query("start"); v != "" {
+		if from, err = parseCalendarBound(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid start"})
+			return
+		}
+	}
+	if v := c.Query("end"); v != "" {
+		if to, err = parseCalendarBound(v); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid end"})
+			return
+		}
+	}
+	if !to.After(from) || to.Sub(from) > calendarMaxRange {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "end must be after start and within a year"})
+		return
+	}
+
+	events, err := buildCalendarEvents(c, userID, isAdmin(c), from, to)
+	if err != nil {
+		log.Printf("❌ Ошибка загрузки календаря: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, events)
+}
+
+func buildCalendarEvents(c *gin.Context, userID string, admin bool, from, to time.Time) ([]calendarEvent, error) {
+	ctx := c.Request.Context()
+	tasks, err := models.ListCalendarTasks(ctx, userID, admin, from, to)
+	if err != nil {
+		return nil, err
+	}
+	deals, err := models.ListCalendarDeals(ctx, userID, admin, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	events := make([]calendarEvent, 0, len(tasks)+len(deals))
+	for _, t := range tasks {
+		for i, due := range t.Occurrences(from, to, calendarMaxOccurrences) {
+			title := t.Title
+			if t.Completed {
+				title = "✓ " + title
+			}
+			color := taskPriorityColors[t.Priority]
+			if t.Completed {
+				color = "#198754"
+			}
+			events = append(events, calendarEvent{
+				ID:              fmt.Sprintf("task-%s-%d", t.ID, i),
+				Title:           title,
+				Start:           due.Format(time.RFC3339),
+				End:             due.Add(time.Duration(t.DurationMinutes) * time.Minute).Format(time.RFC3339),
+				BackgroundColor: color,
+				// переносится только сам срок, не будущие повторы
+				Editable: i == 0 && !t.Completed,
+				ExtendedProps: map[string]interface{}{
+					"type":          "task",
+					"task_id":       t.ID,
+					"priority":      t.Priority,
+					"completed":     t.Completed,
+					"recurrence":    t.Recurrence,
+					"occurrence":    i,
+					"deal_id":       t.DealID,
+					"customer_id":   t.CustomerID,
+					"deal_title":    t.DealTitle,
+					"customer_name": t.CustomerName,
+					"assignee_name": t.AssigneeName,
+				},
+			})
+		}
+	}
+	for _, d := range deals {
+		props := map[string]interface{}{
+			"deal_id":     d.ID,
+			"customer_id": d.CustomerID,
+			"value":       d.Value,
+			"stage":       d.Stage,
+			"responsible": d.Responsible,
+		}
+		if d.ExpectedClose != nil && !d.ExpectedClose.Before(truncateToDay(from)) && d.ExpectedClose.Before(to) {
+			events = append(events, calendarEvent{
+				ID:              "deal-close-" + d.ID,
+				Title:           "💰 " + d.Title,
+				Start:           d.ExpectedClose.Format("2006-01-02"),
+				AllDay:          true,
+				BackgroundColor: "#6f42c1",
+				ExtendedProps:   withType(props, "deal_close"),
+			})
+		}
+		if d.NextActionDate != nil && !d.NextActionDate.Before(from) && d.NextActionDate.Before(to) {
+			events = append(events, calendarEvent{
+				ID:              "deal-action-" + d.ID,
+				Title:           "📌 " + d.Title,
+				Start:           d.NextActionDate.Format("2006-01-02"),
+				AllDay:          true,
+				BackgroundColor: "#ffc107",
+				Editable:        true,
+				ExtendedProps:   withType(props, "deal_action"),
+			})
+		}
+	}
+	return events, nil
+}
+
+func withType(props map[string]interface{}, eventType string) map[string]interface{} {
+	out := make(map[string]interface{}, len(props)+1)
+	for k, v := range props {
+		out[k] = v
+	}
+	out["type"] = eventType
+	return out
+}
+
+func truncateToDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+// publicBaseURL – внешний адрес приложения без завершающего слеша
+func publicBaseURL(c *gin.Context) string {
+	if publicURL != "" {
+		return publicURL
+	}
+	scheme := "http"
+	if c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return scheme + "://" + c.Request.Host
+}
+
+// calendarFeedURL – полная ссылка на ICS-фид
+func calendarFeedURL(c *gin.Context, token string) string {
+	return publicBaseURL(c) + "/calendar/feed/" + token + ".ics"
+}
+
+// GetCalendarFeed возвращает секретную ссылку на ICS-фид пользователя (создаёт при первом запросе)
+func GetCalendarFeed(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	token, err := models.CalendarFeedToken(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("❌ Ошибка получения токена календаря: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": calendarFeedURL(c, token)})
+}
+
+// ResetCalendarFeed выдаёт новую ссылку; подписки по старой перестают обновляться
+func ResetCalendarFeed(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	token, err := models.ResetCalendarFeedToken(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("❌ Ошибка сброса токена календаря: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": calendarFeedURL(c, token)})
+}
+
+// CalendarICS отдаёт ICS-фид по секретному токену (без авторизации – её не умеют календари).
+// В фиде задачи за последние 90 дней и на год вперёд (с развёрнутыми повторами и напоминаниями)
+// и открытые сделки: ожидаемое закрытие и следующее действие как события на весь день.
+func CalendarICS(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".ics")
+	userID, admin, err := models.CalendarFeedUser(c.Request.Context(), token)
+	if errors.Is(err, models.ErrTaskNotFound) {
+		c.String(http.StatusNotFound, "calendar not found")
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Ошибка ICS-фида: %v", err)
+		c.String(http.StatusInternalServerError, "database error")
+		return
+	}
+
+	now := time.Now()
+	from, to := now.Add(-icsPastWindow), now.Add(icsFutureWindow)
+	tasks, err := models.ListCalendarTasks(c.Request.Context(), userID, admin, from, to)
+	if err != nil {
+		log.Printf("❌ Ошибка ICS-фида: %v", err)
+		c.String(http.StatusInternalServerError, "database error")
+		return
+	}
+	deals, err := models.ListCalendarDeals(c.Request.Context(), userID, admin, from, to)
+	if err != nil {
+		log.Printf("❌ Ошибка ICS-фида: %v", err)
+		c.String(http.StatusInternalServerError, "database error")
+		return
+	}
+
+	ics := newICSWriter()
+	ics.line("BEGIN:VCALENDAR")
+	ics.line("VERSION:2.0")
+	ics.line("PRODID:-//SaaSPro//CRM Calendar//RU")
+	ics.line("CALSCALE:GREGORIAN")
+	ics.line("METHOD:PUBLISH")
+	ics.prop("X-WR-CALNAME", "SaaSPro CRM")
+	ics.line("X-PUBLISHED-TTL:PT15M")
+	ics.line("REFRESH-INTERVAL;VALUE=DURATION:PT15M")
+
+	stamp := icsTime(now)
+	for _, t := range tasks {
+		for _, due := range t.Occurrences(from, to, calendarMaxOccurrences) {
+			ics.line("BEGIN:VEVENT")
+			ics.line("UID:task-" + t.ID + "-" + icsTime(due) + "@saaspro")
+			ics.line("DTSTAMP:" + stamp)
+			ics.line("LAST-MODIFIED:" + icsTime(t.UpdatedAt))
+			ics.line("DTSTART:" + icsTime(due))
+			ics.line("DTEND:" + icsTime(due.Add(time.Duration(t.DurationMinutes)*time.Minute)))
+			summary := t.Title
+			if t.Completed {
+				summary = "✓ " + summary
+			}
+			ics.prop("SUMMARY", summary)
+			if desc := taskICSDescription(t); desc != "" {
+				ics.prop("DESCRIPTION", desc)
+			}
+			ics.line(fmt.Sprintf("PRIORITY:%d", icsPriorities[t.Priority]))
+			ics.line("CATEGORIES:CRM,TASK")
+			if !t.Completed && due.After(now) {
+				for _, offset := range t.ReminderOffsets {
+					ics.line("BEGIN:VALARM")
+					ics.line("ACTION:DISPLAY")
+					ics.prop("DESCRIPTION", t.Title)
+					ics.line(fmt.Sprintf("TRIGGER:-PT%dM", offset))
+					ics.line("END:VALARM")
+				}
+			}
+			ics.line("END:VEVENT")
+		}
+	}
+	for _, d := range deals {
+		desc := fmt.Sprintf("Сумма: %.2f ₽\nЭтап: %s", d.Value, d.Stage)
+		if d.Responsible != "" {
+			desc += "\nОтветственный: " + d.Responsible
+		}
+		if d.ExpectedClose != nil {
+			ics.allDayEvent("deal-close-"+d.ID, *d.ExpectedClose, "💰 Закрытие: "+d.Title, desc, stamp, d.UpdatedAt)
+		}
+		if d.NextActionDate != nil {
+			ics.allDayEvent("deal-action-"+d.ID, *d.NextActionDate, "📌 "+d.Title, desc, stamp, d.UpdatedAt)
+		}
+	}
+	ics.line("END:VCALENDAR")
+
+	c.Header("Cache-Control", "private, max-age=300")
+	c.Header("Content-Disposition", `inline; filename="crm.ics"`)
+	c.Data(http.StatusOK, "text/calendar; charset=utf-8", []byte(ics.String()))
+}
+
+// taskICSDescription – описание задачи со связанной сделкой и клиентом
+func taskICSDescription(t *models.Task) string {
+	parts := make([]string, 0, 4)
+	if t.Description != "" {
+		parts = append(parts, t.Description)
+	}
+	if t.DealTitle != "" {
+		parts = append(parts, "Сделка: "+t.DealTitle)
+	}
+	if t.CustomerName != "" {
+		parts = append(parts, "Клиент: "+t.CustomerName)
+	}
+	if t.AssigneeName != "" {
+		parts = append(parts, "Исполнитель: "+t.AssigneeName)
+	}
+	return strings.Join(parts, "\n")
+}
+
+// icsTime – время в UTC в формате RFC 5545
+func icsTime(t time.Time) string {
+	return t.UTC().Format("20060102T150405Z")
+}
+
+// icsWriter собирает ICS: строки через CRLF, длинные строки переносятся по 75 байт (RFC 5545, 3.1)
+type icsWriter struct {
+	b strings.Builder
+}
+
+func newICSWriter() *icsWriter {
+	return &icsWriter{}
+}
+
+func (w *icsWriter) line(s string) {
+	for len(s) > 75 {
+		cut := 75
+		// не разрываем многобайтовый символ UTF-8
+		for cut > 0 && s[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		w.b.WriteString(s[:cut] + "\r\n")
+		// строка-продолжение начинается с пробела, он занимает один байт из 75
+		s = " " + s[cut:]
+	}
+	w.b.WriteString(s + "\r\n")
+}
+
+// prop пишет текстовое свойство с экранированием
+func (w *icsWriter) prop(name, value string) {
+	value = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+	w.line(name + ":" + value)
+}
+
+func (w *icsWriter) allDayEvent(uid string, day time.Time, summary, description, stamp string, modified time.Time) {
+	w.line("BEGIN:VEVENT")
+	w.line("UID:" + uid + "@saaspro")
+	w.line("DTSTAMP:" + stamp)
+	w.line("LAST-MODIFIED:" + icsTime(modified))
+	w.line("DTSTART;VALUE=DATE:" + day.Format("20060102"))
+	w.line("DTEND;VALUE=DATE:" + day.AddDate(0, 0, 1).Format("20060102"))
+	w.prop("SUMMARY", summary)
+	w.prop("DESCRIPTION", description)
+	w.line("CATEGORIES:CRM,DEAL")
+	w.line("TRANSP:TRANSPARENT")
+	w.line("END:VEVENT")
+}
+
+func (w *icsWriter) String() string {
+	return w.b.String()
+}
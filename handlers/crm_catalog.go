@@ -0,0 +1,295 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+	"subscription-system/models"
+)
+
+// Прайс-лист и позиции сделок. Общий прайс-лист ведёт администратор, свои товары – любой
+// пользователь. Сумма сделки с позициями считается из них; без позиций задаётся вручную, как раньше.
+
+// errDealNotFound – сделки нет или она чужая
+var errDealNotFound = errors.New("deal not found")
+
+// respondCatalogError переводит ошибки каталога, КП и заказов в HTTP-ответ
+func respondCatalogError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidProduct), errors.Is(err, models.ErrInvalidDealItem),
+		errors.Is(err, models.ErrInvalidQuote), errors.Is(err, models.ErrInvalidOrder):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrProductNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Product not found"})
+	case errors.Is(err, errDealNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
+	case errors.Is(err, models.ErrQuoteNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quote not found"})
+	case errors.Is(err, models.ErrOrderNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Order not found"})
+	case errors.Is(err, models.ErrDealNotWon):
+		c.JSON(http.StatusConflict, gin.H{"error": "Only a won deal can be converted into an order"})
+	default:
+		log.Printf("❌ Ошибка работы с каталогом и документами сделки: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// checkDealAccess возвращает владельца сделки, если пользователь может с ней работать
+func checkDealAccess(ctx context.Context, dealID, userID string, admin bool) (*string, error) {
+	var ownerID *string
+	err := database.Pool.QueryRow(ctx, `SELECT user_id::text FROM crm_deals WHERE id::text = $1 AND deleted_at IS NULL`, dealID).Scan(&ownerID)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !admin && (ownerID == nil || *ownerID != userID)) {
+		return nil, errDealNotFound
+	}
+	return ownerID, err
+}
+
+// loadDealParam проверяет доступ к сделке из :id и возвращает её владельца
+func loadDealParam(c *gin.Context) (*string, bool) {
+	ownerID, err := checkDealAccess(c.Request.Context(), c.Param("id"), getUserIDFromContext(c), isAdmin(c))
+	if err != nil {
+		respondCatalogError(c, err)
+		return nil, false
+	}
+	return ownerID, true
+}
+
+// loadProduct загружает товар из :id и проверяет права (edit – на изменение)
+func loadProduct(c *gin.Context, edit bool) (*models.Product, bool) {
+	userID := getUserIDFromContext(c)
+	product, err := models.GetProduct(c.Request.Context(), c.Param("id"))
+	if err == nil && !product.CanView(userID, isAdmin(c)) {
+		err = models.ErrProductNotFound
+	}
+	if err != nil {
+		respondCatalogError(c, err)
+		return nil, false
+	}
+	if edit && !product.CanEdit(userID, isAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return product, true
+}
+
+// productRequest – тело создания и изменения товара; при изменении отсутствующие поля не трогаются
+type productRequest struct {
+	SKU         *string  `json:"sku"`
+	Name        *string  `json:"name"`
+	Description *string  `json:"description"`
+	Unit        *string  `json:"unit"`
+	Price       *float64 `json:"price"`
+	Currency    *string  `json:"currency"`
+	VATRate     *float64 `json:"vat_rate"`
+	Active      *bool    `json:"active"`
+	Shared      bool     `json:"shared"`
+}
+
+func (r *productRequest) apply(p *models.Product) {
+	if r.SKU != nil {
+		p.SKU = *r.SKU
+	}
+	if r.Name != nil {
+		p.Name = *r.Name
+	}
+	if r.Description != nil {
+		p.Description = *r.Description
+	}
+	if r.Unit != nil {
+		p.Unit = *r.Unit
+	}
+	if r.Price != nil {
+		p.Price = *r.Price
+	}
+	if r.Currency != nil {
+		p.Currency = *r.Currency
+	}
+	if r.VATRate != nil {
+		p.VATRate = *r.VATRate
+	}
+	if r.Active != nil {
+		p.Active = *r.Active
+	}
+}
+
+// GetProducts возвращает прайс-лист: ?search= по артикулу и названию, ?active=true, постранично
+func GetProducts(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	products, total, err := models.ListProducts(c.Request.Context(), models.ProductFilter{
+		UserID:     userID,
+		IsAdmin:    isAdmin(c),
+		Search:     c.Query("search"),
+		ActiveOnly: c.Query("active") == "true",
+		Limit:      pageSize,
+		Offset:     (page - 1) * pageSize,
+	})
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        products,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetProduct возвращает товар
+func GetProduct(c *gin.Context) {
+	product, ok := loadProduct(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, product)
+}
+
+// CreateProduct добавляет товар. Товар общего прайс-листа (shared) может создать только администратор.
+func CreateProduct(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req productRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Shared && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can edit the shared price list"})
+		return
+	}
+	product := &models.Product{Active: true, VATRate: models.DefaultProductVATRate}
+	if !req.Shared {
+		product.UserID = &userID
+	}
+	req.apply(product)
+	if err := product.Normalize(); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	if err := models.CreateProduct(c.Request.Context(), product); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, product)
+}
+
+// UpdateProduct меняет товар (частичное обновление); цены в уже созданных позициях сделок не меняются
+func UpdateProduct(c *gin.Context) {
+	product, ok := loadProduct(c, true)
+	if !ok {
+		return
+	}
+	var req productRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.apply(product)
+	if err := product.Normalize(); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	if err := models.UpdateProduct(c.Request.Context(), product); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, product)
+}
+
+// DeleteProduct удаляет товар из прайс-листа
+func DeleteProduct(c *gin.Context) {
+	product, ok := loadProduct(c, true)
+	if !ok {
+		return
+	}
+	if err := models.DeleteProduct(c.Request.Context(), product.ID); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Product deleted"})
+}
+
+// GetDealItems возвращает позиции сделки с итогами
+func GetDealItems(c *gin.Context) {
+	if _, ok := loadDealParam(c); !ok {
+		return
+	}
+	items, err := models.GetDealItems(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"items": items, "totals": models.SumDealItems(items)})
+}
+
+// ReplaceDealItems заменяет позиции сделки целиком и пересчитывает её сумму.
+// Позиция с product_id берёт из прайс-листа всё, что не указано явно (цена, НДС, артикул).
+func ReplaceDealItems(c *gin.Context) {
+	ownerID, ok := loadDealParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Items []*models.DealItem `json:"items"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := getUserIDFromContext(c)
+	dealID := c.Param("id")
+	for _, item := range req.Items {
+		if item == nil {
+			respondCatalogError(c, models.ErrInvalidDealItem)
+			return
+		}
+		if item.ProductID != nil && *item.ProductID != "" {
+			product, err := models.GetProduct(c.Request.Context(), *item.ProductID)
+			if err == nil && !product.CanView(userID, isAdmin(c)) {
+				err = models.ErrProductNotFound
+			}
+			if err != nil {
+				respondCatalogError(c, err)
+				return
+			}
+			item.FillFromProduct(product)
+		} else {
+			item.ProductID = nil
+		}
+		if err := item.Normalize(); err != nil {
+			respondCatalogError(c, err)
+			return
+		}
+	}
+	totals, err := models.ReplaceDealItems(c.Request.Context(), dealID, req.Items)
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+
+	changes := map[string]interface{}{"items": len(req.Items)}
+	if len(req.Items) > 0 {
+		changes["value"] = totals.Total
+	}
+	go addHistory(context.Background(), "deal", dealID, "items", &userID, changes)
+	publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealUpdated, EntityType: "deal", EntityID: dealID, OwnerID: ownerID,
+		Payload: gin.H{"fields": []string{"items", "value"}, "value": totals.Total}})
+
+	c.JSON(http.StatusOK, gin.H{"items": req.Items, "totals": totals})
+}
@@ -0,0 +1,195 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/xuri/excelize/v2"
+
+	"subscription-system/models"
+)
+
+// customFieldFilterPrefix – фильтры по пользовательским полям: ?cf.<key>=v, ?cf.<key>.min=, ?cf.<key>.max=
+// (переводятся в язык фильтров, см. legacyCRMFilter); сортировка – ?sort=cf.<key>&order=asc|desc
+const customFieldFilterPrefix = "cf."
+
+// respondCustomFieldError переводит ошибки пользовательских полей в HTTP-ответ
+func respondCustomFieldError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidCustomField):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrCustomFieldNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Custom field not found"})
+	default:
+		log.Printf("❌ Ошибка работы с пользовательскими полями: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// decodeCustomFields разбирает JSONB-колонку custom_fields
+func decodeCustomFields(raw []byte) map[string]interface{} {
+	values := map[string]interface{}{}
+	if len(raw) > 0 {
+		if err := json.Unmarshal(raw, &values); err != nil {
+			log.Printf("⚠️ Некорректное значение custom_fields: %v", err)
+		}
+	}
+	return values
+}
+
+// customFieldChanges – изменившиеся пользовательские поля для истории: ключ -> {old, new}
+func customFieldChanges(oldValues, newValues map[string]interface{}) map[string]interface{} {
+	changes := make(map[string]interface{})
+	for key, newValue := range newValues {
+		oldJSON, _ := json.Marshal(oldValues[key])
+		newJSON, _ := json.Marshal(newValue)
+		if string(oldJSON) != string(newJSON) {
+			changes[key] = map[string]interface{}{"old": oldValues[key], "new": newValue}
+		}
+	}
+	for key, oldValue := range oldValues {
+		if _, ok := newValues[key]; !ok {
+			changes[key] = map[string]interface{}{"old": oldValue, "new": nil}
+		}
+	}
+	return changes
+}
+
+// GetCustomFields возвращает схему пользовательских полей сущности (?entity=customer|deal)
+func GetCustomFields(c *gin.Context) {
+	entity := c.DefaultQuery("entity", models.CustomFieldEntityCustomer)
+	if !models.IsCustomFieldEntity(entity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entity must be customer or deal"})
+		return
+	}
+	fields, err := models.ListCustomFields(c.Request.Context(), entity)
+	if err != nil {
+		respondCustomFieldError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, fields)
+}
+
+// CreateCustomField создаёт пользовательское поле (только администратор)
+func CreateCustomField(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	var field models.CustomField
+	if err := c.ShouldBindJSON(&field); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.CreateCustomField(c.Request.Context(), &field); err != nil {
+		respondCustomFieldError(c, err)
+		return
+	}
+	log.Printf("🧩 Создано пользовательское поле %s.%s (%s)", field.EntityType, field.Key, field.FieldType)
+	c.JSON(http.StatusCreated, field)
+}
+
+// UpdateCustomField меняет подпись, варианты, обязательность и порядок поля (только администратор).
+// Сущность, ключ и тип поля не меняются.
+func UpdateCustomField(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	field, err := models.GetCustomField(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondCustomFieldError(c, err)
+		return
+	}
+
+	var req struct {
+		Label     *string  `json:"label"`
+		Options   []string `json:"options"`
+		Required  *bool    `json:"required"`
+		SortOrder *int     `json:"sort_order"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Label != nil {
+		field.Label = *req.Label
+	}
+	if req.Options != nil {
+		field.Options = req.Options
+	}
+	if req.Required != nil {
+		field.Required = *req.Required
+	}
+	if req.SortOrder != nil {
+		field.SortOrder = *req.SortOrder
+	}
+
+	if err := models.UpdateCustomField(c.Request.Context(), field); err != nil {
+		respondCustomFieldError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, field)
+}
+
+// DeleteCustomField удаляет поле и его значения у всех записей (только администратор)
+func DeleteCustomField(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return
+	}
+	field, err := models.GetCustomField(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondCustomFieldError(c, err)
+		return
+	}
+	if err := models.DeleteCustomField(c.Request.Context(), field); err != nil {
+		respondCustomFieldError(c, err)
+		return
+	}
+	log.Printf("🗑️ Удалено пользовательское поле %s.%s", field.EntityType, field.Key)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// customFieldHeaders – заголовки дополнительных колонок экспорта
+func customFieldHeaders(fields []*models.CustomField) []string {
+	headers := make([]string, 0, len(fields))
+	for _, f := range fields {
+		headers = append(headers, f.Label)
+	}
+	return headers
+}
+
+// customFieldRow – значения пользовательских полей в порядке колонок экспорта
+func customFieldRow(fields []*models.CustomField, values map[string]interface{}) []string {
+	row := make([]string, 0, len(fields))
+	for _, f := range fields {
+		row = append(row, f.Format(values[f.Key]))
+	}
+	return row
+}
+
+// setCustomFieldHeaders пишет заголовки пользовательских полей в Excel начиная с колонки firstCol (1 – A)
+func setCustomFieldHeaders(f *excelize.File, sheet string, firstCol int, fields []*models.CustomField) {
+	for i, field := range fields {
+		cell, _ := excelize.CoordinatesToCellName(firstCol+i, 1)
+		f.SetCellValue(sheet, cell, field.Label)
+		col, _ := excelize.ColumnNumberToName(firstCol + i)
+		f.SetColWidth(sheet, col, col, 20)
+	}
+}
+
+// setCustomFieldCells пишет значения пользовательских полей строки row; числа остаются числами
+func setCustomFieldCells(f *excelize.File, sheet string, firstCol, row int, fields []*models.CustomField, values map[string]interface{}) {
+	for i, field := range fields {
+		cell, _ := excelize.CoordinatesToCellName(firstCol+i, row)
+		if n, ok := values[field.Key].(float64); ok {
+			f.SetCellValue(sheet, cell, n)
+			continue
+		}
+		f.SetCellValue(sheet, cell, field.Format(values[field.Key]))
+	}
+}
@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+)
+
+const (
+	defaultDuplicateMinScore = 0.7
+	defaultDuplicateGroups   = 50
+)
+
+// respondMergeError переводит ошибки поиска дублей и слияния в HTTP-ответ
+func respondMergeError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidMerge):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrCustomerNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrMergeNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Merge not found"})
+	case errors.Is(err, models.ErrMergeReverted):
+		c.JSON(http.StatusConflict, gin.H{"error": "Merge already reverted"})
+	default:
+		log.Printf("❌ Ошибка слияния клиентов CRM: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// GetCustomerDuplicates возвращает группы возможных дублей клиентов.
+// ?min_score=0.7 – порог оценки пары (0..1), ?limit=50 – число групп.
+func GetCustomerDuplicates(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	minScore, err := strconv.ParseFloat(c.DefaultQuery("min_score", "0.7"), 64)
+	if err != nil || minScore < 0 || minScore > 1 {
+		minScore = defaultDuplicateMinScore
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit <= 0 || limit > 500 {
+		limit = defaultDuplicateGroups
+	}
+
+	groups, err := models.FindDuplicates(c.Request.Context(), userID, isAdmin(c), minScore, limit)
+	if err != nil {
+		respondMergeError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"groups": groups, "total": len(groups)})
+}
+
+// MergeCustomers сливает клиентов merge_ids в survivor_id.
+// Тело: {survivor_id, merge_ids, fields: {поле|cf.<key>: id клиента, чьё значение оставить}}.
+func MergeCustomers(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req models.MergeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	result, err := models.MergeCustomers(c.Request.Context(), req, userID, isAdmin(c))
+	if err != nil {
+		respondMergeError(c, err)
+		return
+	}
+	if err := updateLeadScore(c.Request.Context(), result.SurvivorID); err != nil {
+		log.Printf("⚠️ Не удалось пересчитать лид-скор клиента %s: %v", result.SurvivorID, err)
+	}
+	publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomersMerged, EntityType: "customer", EntityID: result.SurvivorID,
+		Payload: gin.H{"merge_id": result.MergeID, "merged_ids": result.MergedIDs}})
+	log.Printf("🔗 Клиенты %v слиты в %s (сделок: %d, активностей: %d)",
+		result.MergedIDs, result.SurvivorID, result.MovedDeals, result.MovedActivities)
+	c.JSON(http.StatusOK, result)
+}
+
+// RevertCustomerMerge отменяет слияние по id записи истории (merge_id из ответа MergeCustomers)
+func RevertCustomerMerge(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	survivorID, restored, err := models.RevertMerge(c.Request.Context(), c.Param("id"), userID, isAdmin(c))
+	if err != nil {
+		respondMergeError(c, err)
+		return
+	}
+	// сделки вернулись к восстановленным клиентам – скор меняется у всех, включая выжившего
+	for _, id := range append([]string{survivorID}, restored...) {
+		if err := updateLeadScore(c.Request.Context(), id); err != nil {
+			log.Printf("⚠️ Не удалось пересчитать лид-скор клиента %s: %v", id, err)
+		}
+	}
+	publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerUpdated, EntityType: "customer", EntityID: survivorID,
+		Payload: gin.H{"unmerged_ids": restored}})
+	for _, id := range restored {
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerCreated, EntityType: "customer", EntityID: id})
+	}
+	log.Printf("↩️ Слияние %s отменено, восстановлены клиенты %v", c.Param("id"), restored)
+	c.JSON(http.StatusOK, gin.H{"success": true, "restored": restored})
+}
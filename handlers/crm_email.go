@@ -0,0 +1,564 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Почтовый канал CRM: ящики пользователей (IMAP/SMTP), переписка с клиентами, шаблоны писем
+// с полями подстановки и отслеживание открытий пикселем.
+
+const emailSendMaxRecipients = 20
+
+// trackingPixelGIF – прозрачный GIF 1×1
+var trackingPixelGIF = []byte{
+	0x47, 0x49, 0x46, 0x38, 0x39, 0x61, 0x01, 0x00, 0x01, 0x00, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00,
+	0xff, 0xff, 0xff, 0x21, 0xf9, 0x04, 0x01, 0x00, 0x00, 0x00, 0x00, 0x2c, 0x00, 0x00, 0x00, 0x00,
+	0x01, 0x00, 0x01, 0x00, 0x00, 0x02, 0x02, 0x44, 0x01, 0x00, 0x3b,
+}
+
+// errCustomerNotFound – клиента нет, он в корзине или чужой
+var errCustomerNotFound = errors.New("customer not found")
+
+var emailChannel *services.EmailChannelService
+
+// InitEmailChannel подключает сервис почтового канала (вызывается из main)
+func InitEmailChannel(s *services.EmailChannelService) {
+	emailChannel = s
+}
+
+// respondEmailError переводит ошибки почтового канала в HTTP-ответ
+func respondEmailError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidMailbox), errors.Is(err, models.ErrInvalidEmailTemplate):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrMailboxNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Mailbox not found"})
+	case errors.Is(err, models.ErrEmailTemplateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email template not found"})
+	case errors.Is(err, models.ErrEmailThreadNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Email thread not found"})
+	case errors.Is(err, errCustomerNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
+	case errors.Is(err, errDealNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Deal not found"})
+	case errors.Is(err, services.ErrMailboxBusy):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("❌ Ошибка почтового канала CRM: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// checkCustomerAccess возвращает адрес клиента, если пользователь может с ним работать
+func checkCustomerAccess(ctx context.Context, customerID, userID string, admin bool) (string, error) {
+	var ownerID *string
+	var email string
+	err := database.Pool.QueryRow(ctx, `SELECT user_id::text, email FROM crm_customers WHERE id::text = $1 AND deleted_at IS NULL`,
+		customerID).Scan(&ownerID, &email)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !admin && (ownerID == nil || *ownerID != userID)) {
+		return "", errCustomerNotFound
+	}
+	return email, err
+}
+
+// ========== ПОЧТОВЫЕ ЯЩИКИ ==========
+
+// loadMailbox загружает ящик из :id; ящиком пользуется только владелец, администратор может его отключить
+func loadMailbox(c *gin.Context, allowAdmin bool) (*models.Mailbox, bool) {
+	mb, err := models.GetMailbox(c.Request.Context(), c.Param("id"))
+	userID := getUserIDFromContext(c)
+	if err == nil && mb.UserID != userID && !(allowAdmin && isAdmin(c)) {
+		err = models.ErrMailboxNotFound
+	}
+	if err != nil {
+		respondEmailError(c, err)
+		return nil, false
+	}
+	return mb, true
+}
+
+// GetMailboxes возвращает ящики текущего пользователя
+func GetMailboxes(c *gin.Context) {
+	list, err := models.ListMailboxes(c.Request.Context(), getUserIDFromContext(c))
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list})
+}
+
+// CreateMailbox подключает ящик текущему пользователю
+func CreateMailbox(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req models.MailboxInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	mb, err := models.CreateMailbox(c.Request.Context(), userID, &req)
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, mb)
+}
+
+// UpdateMailbox меняет параметры ящика; пароль без изменений можно не передавать
+func UpdateMailbox(c *gin.Context) {
+	mb, ok := loadMailbox(c, false)
+	if !ok {
+		return
+	}
+	var req models.MailboxInput
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	updated, err := models.UpdateMailbox(c.Request.Context(), mb.ID, &req)
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, updated)
+}
+
+// DeleteMailbox отключает ящик вместе с синхронизированной из него перепиской
+func DeleteMailbox(c *gin.Context) {
+	mb, ok := loadMailbox(c, true)
+	if !ok {
+		return
+	}
+	if err := models.DeleteMailbox(c.Request.Context(), mb.ID); err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// TestMailbox проверяет подключение к IMAP и SMTP ящика
+func TestMailbox(c *gin.Context) {
+	mb, ok := loadMailbox(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, emailChannel.TestMailbox(c.Request.Context(), mb))
+}
+
+// SyncMailbox забирает новые письма ящика, не дожидаясь фоновой синхронизации
+func SyncMailbox(c *gin.Context) {
+	mb, ok := loadMailbox(c, false)
+	if !ok {
+		return
+	}
+	res, err := emailChannel.SyncMailbox(c.Request.Context(), mb)
+	if err != nil && !errors.Is(err, services.ErrMailboxBusy) && !errors.Is(err, models.ErrInvalidMailbox) {
+		// Ошибка почтового сервера – не ошибка сервиса: показываем её пользователю
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error(), "result": res})
+		return
+	}
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, res)
+}
+
+// ========== ШАБЛОНЫ ==========
+
+// loadEmailTemplate загружает шаблон из :id и проверяет права (edit – на изменение)
+func loadEmailTemplate(c *gin.Context, edit bool) (*models.EmailTemplate, bool) {
+	userID := getUserIDFromContext(c)
+	t, err := models.GetEmailTemplate(c.Request.Context(), c.Param("id"))
+	if err == nil && !t.CanView(userID, isAdmin(c)) {
+		err = models.ErrEmailTemplateNotFound
+	}
+	if err != nil {
+		respondEmailError(c, err)
+		return nil, false
+	}
+	if edit && !t.CanEdit(userID, isAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return t, true
+}
+
+// GetEmailTemplates возвращает общие и свои шаблоны и список полей подстановки
+func GetEmailTemplates(c *gin.Context) {
+	list, err := models.ListEmailTemplates(c.Request.Context(), getUserIDFromContext(c))
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": list, "merge_fields": models.EmailMergeFields})
+}
+
+// GetEmailTemplate возвращает шаблон
+func GetEmailTemplate(c *gin.Context) {
+	t, ok := loadEmailTemplate(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// CreateEmailTemplate создаёт шаблон; общий ("shared": true) – только администратор
+func CreateEmailTemplate(c *gin.Context) {
+	var req struct {
+		Name    string `json:"name"`
+		Subject string `json:"subject"`
+		Body    string `json:"body"`
+		Shared  bool   `json:"shared"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Shared && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admin can create shared templates"})
+		return
+	}
+	t := &models.EmailTemplate{Name: req.Name, Subject: req.Subject, Body: req.Body}
+	if !req.Shared {
+		userID := getUserIDFromContext(c)
+		t.UserID = &userID
+	}
+	if err := t.Normalize(); err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	if err := models.CreateEmailTemplate(c.Request.Context(), t); err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, t)
+}
+
+// UpdateEmailTemplate меняет название, тему и текст шаблона
+func UpdateEmailTemplate(c *gin.Context) {
+	t, ok := loadEmailTemplate(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name    *string `json:"name"`
+		Subject *string `json:"subject"`
+		Body    *string `json:"body"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name != nil {
+		t.Name = *req.Name
+	}
+	if req.Subject != nil {
+		t.Subject = *req.Subject
+	}
+	if req.Body != nil {
+		t.Body = *req.Body
+	}
+	if err := t.Normalize(); err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	if err := models.UpdateEmailTemplate(c.Request.Context(), t); err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// DeleteEmailTemplate удаляет шаблон
+func DeleteEmailTemplate(c *gin.Context) {
+	t, ok := loadEmailTemplate(c, true)
+	if !ok {
+		return
+	}
+	if err := models.DeleteEmailTemplate(c.Request.Context(), t.ID); err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ========== ПЕРЕПИСКА И ОТПРАВКА ==========
+
+// emailComposeRequest – письмо клиенту: шаблон или своя тема и текст (HTML), поля подстановки
+// заполняются по клиенту, сделке и отправителю
+type emailComposeRequest struct {
+	MailboxID  string   `json:"mailbox_id"`
+	CustomerID string   `json:"customer_id"`
+	DealID     string   `json:"deal_id"`
+	ThreadID   string   `json:"thread_id"`
+	TemplateID string   `json:"template_id"`
+	To         []string `json:"to"` // по умолчанию – адрес клиента
+	Subject    string   `json:"subject"`
+	Body       string   `json:"body"`
+	TrackOpens *bool    `json:"track_opens"`
+}
+
+// renderCompose проверяет доступ к клиенту, сделке и шаблону и подставляет поля.
+// Возвращает тему, HTML и адрес клиента; при ошибке ответ уже отправлен.
+func renderCompose(c *gin.Context, req *emailComposeRequest) (subject, body, customerEmail string, ok bool) {
+	ctx := c.Request.Context()
+	userID := getUserIDFromContext(c)
+	admin := isAdmin(c)
+	if req.CustomerID != "" {
+		email, err := checkCustomerAccess(ctx, req.CustomerID, userID, admin)
+		if err != nil {
+			respondEmailError(c, err)
+			return "", "", "", false
+		}
+		customerEmail = email
+	}
+	if req.DealID != "" {
+		if _, err := checkDealAccess(ctx, req.DealID, userID, admin); err != nil {
+			respondEmailError(c, err)
+			return "", "", "", false
+		}
+		var dealCustomerID string
+		if err := database.Pool.QueryRow(ctx, `SELECT customer_id::text FROM crm_deals WHERE id::text = $1`, req.DealID).Scan(&dealCustomerID); err != nil {
+			respondEmailError(c, err)
+			return "", "", "", false
+		}
+		if req.CustomerID != "" && req.CustomerID != dealCustomerID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Deal belongs to another customer"})
+			return "", "", "", false
+		}
+	}
+	subject, body = req.Subject, req.Body
+	if req.TemplateID != "" {
+		t, err := models.GetEmailTemplate(ctx, req.TemplateID)
+		if err == nil && !t.CanView(userID, admin) {
+			err = models.ErrEmailTemplateNotFound
+		}
+		if err != nil {
+			respondEmailError(c, err)
+			return "", "", "", false
+		}
+		if strings.TrimSpace(subject) == "" {
+			subject = t.Subject
+		}
+		if strings.TrimSpace(body) == "" {
+			body = t.Body
+		}
+	}
+	data, err := models.LoadEmailMergeData(ctx, req.CustomerID, req.DealID, userID)
+	if err != nil {
+		respondEmailError(c, err)
+		return "", "", "", false
+	}
+	subject, body = models.RenderEmail(subject, body, data)
+	return strings.TrimSpace(subject), body, customerEmail, true
+}
+
+// PreviewEmail показывает письмо с подставленными полями, ничего не отправляя
+func PreviewEmail(c *gin.Context) {
+	var req emailComposeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	subject, body, _, ok := renderCompose(c, &req)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"subject": subject, "body": body})
+}
+
+// SendEmail отправляет письмо клиенту из ящика пользователя. Письмо попадает в переписку
+// клиента и в его активности; с track_opens (по умолчанию) в письмо добавляется пиксель.
+func SendEmail(c *gin.Context) {
+	var req emailComposeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	userID := getUserIDFromContext(c)
+
+	mb, err := models.GetMailbox(ctx, req.MailboxID)
+	if err == nil && mb.UserID != userID {
+		err = models.ErrMailboxNotFound
+	}
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	if req.ThreadID != "" {
+		thread, err := models.GetEmailThread(ctx, req.ThreadID)
+		if err == nil && thread.MailboxID != mb.ID {
+			err = models.ErrEmailThreadNotFound
+		}
+		if err != nil {
+			respondEmailError(c, err)
+			return
+		}
+		if req.CustomerID == "" && thread.CustomerID != nil {
+			req.CustomerID = *thread.CustomerID
+		}
+		if strings.TrimSpace(req.Subject) == "" && req.TemplateID == "" {
+			req.Subject = thread.Subject
+			if !strings.HasPrefix(strings.ToLower(req.Subject), "re:") {
+				req.Subject = "Re: " + req.Subject
+			}
+		}
+	}
+	if req.CustomerID == "" && req.DealID != "" {
+		database.Pool.QueryRow(ctx, `SELECT customer_id::text FROM crm_deals WHERE id::text = $1 AND deleted_at IS NULL`, req.DealID).Scan(&req.CustomerID)
+	}
+	if req.CustomerID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "customer_id, deal_id or thread_id is required"})
+		return
+	}
+	subject, body, customerEmail, ok := renderCompose(c, &req)
+	if !ok {
+		return
+	}
+	if subject == "" || strings.TrimSpace(body) == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "subject and body (or template_id) are required"})
+		return
+	}
+
+	to := req.To
+	if len(to) == 0 {
+		to = []string{customerEmail}
+	}
+	if len(to) > emailSendMaxRecipients {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Too many recipients"})
+		return
+	}
+	for i, addr := range to {
+		parsed, err := mail.ParseAddress(addr)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid recipient: " + addr})
+			return
+		}
+		to[i] = strings.ToLower(parsed.Address)
+	}
+
+	sendReq := &services.EmailSendRequest{
+		Mailbox:    mb,
+		To:         to,
+		CustomerID: &req.CustomerID,
+		ThreadID:   req.ThreadID,
+		Subject:    subject,
+		HTML:       body,
+		TrackOpens: req.TrackOpens == nil || *req.TrackOpens,
+		BaseURL:    publicBaseURL(c),
+		SentBy:     userID,
+	}
+	if req.DealID != "" {
+		sendReq.DealID = &req.DealID
+	}
+	if req.TemplateID != "" {
+		sendReq.TemplateID = &req.TemplateID
+	}
+	msg, err := emailChannel.Send(ctx, sendReq)
+	if err != nil {
+		if errors.Is(err, models.ErrInvalidMailbox) || errors.Is(err, models.ErrEmailThreadNotFound) {
+			respondEmailError(c, err)
+			return
+		}
+		log.Printf("⚠️ Не удалось отправить письмо из ящика %s: %v", mb.Email, err)
+		c.JSON(http.StatusBadGateway, gin.H{"error": "Failed to send email: " + err.Error()})
+		return
+	}
+	publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventEmailSent, EntityType: "customer", EntityID: req.CustomerID,
+		Payload: gin.H{"message_id": msg.ID, "thread_id": msg.ThreadID, "deal_id": msg.DealID, "direction": msg.Direction,
+			"subject": msg.Subject, "from": msg.FromAddr, "to": msg.To}})
+	c.JSON(http.StatusCreated, msg)
+}
+
+// GetEmailThreads возвращает цепочки писем: свои ящики (администратор – все, ?user_id) или клиента (?customer_id)
+func GetEmailThreads(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	page, pageSize := getPaginationParams(c)
+	filter := models.EmailThreadFilter{CustomerID: c.Query("customer_id"), UserID: userID, Limit: pageSize, Offset: (page - 1) * pageSize}
+	if isAdmin(c) {
+		filter.UserID = c.Query("user_id")
+	}
+	if filter.CustomerID != "" {
+		// По клиенту видна вся переписка с ним, из любых ящиков
+		if _, err := checkCustomerAccess(c.Request.Context(), filter.CustomerID, userID, isAdmin(c)); err != nil {
+			respondEmailError(c, err)
+			return
+		}
+		filter.UserID = ""
+	}
+	threads, total, err := models.ListEmailThreads(c.Request.Context(), filter)
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        threads,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetCustomerEmails – переписка клиента из :id
+func GetCustomerEmails(c *gin.Context) {
+	q := c.Request.URL.Query()
+	q.Set("customer_id", c.Param("id"))
+	c.Request.URL.RawQuery = q.Encode()
+	GetEmailThreads(c)
+}
+
+// GetEmailThread возвращает цепочку с письмами
+func GetEmailThread(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	thread, err := models.GetEmailThread(c.Request.Context(), c.Param("id"))
+	if err == nil && !thread.CanView(userID, isAdmin(c)) {
+		err = models.ErrEmailThreadNotFound
+		if thread.CustomerID != nil {
+			if _, accessErr := checkCustomerAccess(c.Request.Context(), *thread.CustomerID, userID, false); accessErr == nil {
+				err = nil
+			}
+		}
+	}
+	if err != nil {
+		respondEmailError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, thread)
+}
+
+// TrackEmailOpen – пиксель отслеживания открытий (/api/public/email/open/<token>.gif).
+// Всегда отдаёт картинку, чтобы по ответу нельзя было перебирать токены.
+func TrackEmailOpen(c *gin.Context) {
+	token := strings.TrimSuffix(c.Param("token"), ".gif")
+	msg, err := models.RecordEmailOpen(c.Request.Context(), token)
+	if err != nil {
+		log.Printf("⚠️ Не удалось учесть открытие письма: %v", err)
+	}
+	if msg != nil && msg.OpenCount == 1 && msg.CustomerID != nil {
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventEmailOpened, EntityType: "customer", EntityID: *msg.CustomerID,
+			Payload: gin.H{"message_id": msg.ID, "thread_id": msg.ThreadID, "deal_id": msg.DealID, "subject": msg.Subject}})
+		if err := updateLeadScore(c.Request.Context(), *msg.CustomerID); err != nil {
+			log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", *msg.CustomerID, err)
+		}
+	}
+	c.Header("Cache-Control", "no-store, no-cache, must-revalidate, private")
+	c.Data(http.StatusOK, "image/gif", trackingPixelGIF)
+}
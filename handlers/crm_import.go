@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Импорт клиентов и сделок: загрузка файла -> сопоставление колонок -> dry-run -> импорт.
+// Проверка и импорт выполняются в фоне, клиент опрашивает GET /api/crm/imports/:id.
+
+const (
+	importMaxFileSize  = 20 << 20
+	importSampleRows   = 5
+	importErrorsInJSON = 100
+)
+
+// respondImportError переводит ошибки импорта в HTTP-ответ
+func respondImportError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrImportNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Import not found"})
+	case errors.Is(err, models.ErrTemplateNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Template not found"})
+	case errors.Is(err, models.ErrImportRunning):
+		c.JSON(http.StatusConflict, gin.H{"error": "Import is already running"})
+	default:
+		log.Printf("❌ Ошибка импорта CRM: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// loadImportJob загружает задание из :id и проверяет доступ
+func loadImportJob(c *gin.Context) (*models.ImportJob, bool) {
+	job, err := models.GetImportJob(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondImportError(c, err)
+		return nil, false
+	}
+	if !job.CanAccess(getUserIDFromContext(c), isAdmin(c)) {
+		respondImportError(c, models.ErrImportNotFound)
+		return nil, false
+	}
+	return job, true
+}
+
+// importJobResponse – задание с прогрессом; ошибки по строкам обрезаются, полный список – в отчёте
+func importJobResponse(job *models.ImportJob) gin.H {
+	rowErrors := job.Errors
+	if len(rowErrors) > importErrorsInJSON {
+		rowErrors = rowErrors[:importErrorsInJSON]
+	}
+	if rowErrors == nil {
+		rowErrors = []models.ImportRowError{}
+	}
+	return gin.H{
+		"job":      job,
+		"progress": job.Progress(),
+		"errors":   rowErrors,
+	}
+}
+
+// UploadImportFile принимает CSV/XLSX (multipart: file, entity=customer|deal), сохраняет файл и
+// возвращает заголовки, первые строки и предложенное сопоставление колонок
+func UploadImportFile(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+
+	// Файл, на который не сослалось задание, удалит очистка хранилища
+	blob, fileName, form, err := receiveUpload(c, "file", services.UploadPolicyImport)
+	if err != nil {
+		respondUploadError(c, err)
+		return
+	}
+	entity := form["entity"]
+	if entity == "" {
+		entity = models.CustomFieldEntityCustomer
+	}
+	if !models.IsCustomFieldEntity(entity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entity must be customer or deal"})
+		return
+	}
+	if blob.Size > importMaxFileSize {
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": "File is larger than 20 MB"})
+		return
+	}
+
+	data, err := fileService.ReadAll(c.Request.Context(), blob.StorageKey)
+	if err != nil {
+		respondUploadError(c, err)
+		return
+	}
+	headers, rows, err := readImportFile(fileName, data)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	fields, err := models.ListCustomFields(c.Request.Context(), entity)
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+
+	job := &models.ImportJob{
+		UserID:     userID,
+		EntityType: entity,
+		FileName:   fileName,
+		FilePath:   blob.StorageKey,
+		FileHash:   &blob.SHA256,
+		Headers:    headers,
+		TotalRows:  len(rows),
+		Options:    models.ImportOptions{Mapping: suggestImportMapping(entity, headers, fields)},
+	}
+	if err := models.CreateImportJob(c.Request.Context(), job); err != nil {
+		respondImportError(c, err)
+		return
+	}
+
+	sample := rows
+	if len(sample) > importSampleRows {
+		sample = sample[:importSampleRows]
+	}
+	targets := append([]string{}, importFields[entity]...)
+	for _, f := range fields {
+		targets = append(targets, customFieldFilterPrefix+f.Key)
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"job":               job,
+		"sample":            sample,
+		"suggested_mapping": job.Options.Mapping,
+		"fields":            targets,
+	})
+}
+
+// RunImport запускает проверку (dry_run=true) или импорт в фоне.
+// Тело: {mapping, dedup_by, on_duplicate, dry_run, template_id}; без mapping берётся шаблон
+// или сопоставление, предложенное при загрузке.
+func RunImport(c *gin.Context) {
+	job, ok := loadImportJob(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		models.ImportOptions
+		DryRun     bool   `json:"dry_run"`
+		TemplateID string `json:"template_id"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	opts := req.ImportOptions
+	if len(opts.Mapping) == 0 && req.TemplateID != "" {
+		templates, err := models.ListImportTemplates(c.Request.Context(), getUserIDFromContext(c), job.EntityType)
+		if err != nil {
+			respondImportError(c, err)
+			return
+		}
+		// колонки шаблона, которых нет в этом файле, пропускаются
+		headers := make(map[string]bool, len(job.Headers))
+		for _, h := range job.Headers {
+			headers[h] = true
+		}
+		for _, t := range templates {
+			if t.ID != req.TemplateID {
+				continue
+			}
+			opts.Mapping = make(map[string]string)
+			for column, target := range t.Mapping {
+				if headers[column] {
+					opts.Mapping[column] = target
+				}
+			}
+		}
+		if len(opts.Mapping) == 0 {
+			respondImportError(c, models.ErrTemplateNotFound)
+			return
+		}
+	}
+	if len(opts.Mapping) == 0 {
+		opts.Mapping = job.Options.Mapping
+	}
+
+	fields, err := models.CustomFieldsByKey(c.Request.Context(), job.EntityType)
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+	if err := validateImportOptions(job, &opts, fields); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := models.StartImportJob(c.Request.Context(), job, opts, req.DryRun); err != nil {
+		respondImportError(c, err)
+		return
+	}
+	// ответ собирается до запуска: дальше задание меняет фоновая горутина
+	c.JSON(http.StatusAccepted, importJobResponse(job))
+	go runImportJob(job, isAdmin(c))
+}
+
+// GetImports возвращает последние задания импорта
+func GetImports(c *gin.Context) {
+	jobs, err := models.ListImportJobs(c.Request.Context(), getUserIDFromContext(c), isAdmin(c), 50)
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// GetImport возвращает состояние задания: статус, прогресс, счётчики и первые ошибки
+func GetImport(c *gin.Context) {
+	job, ok := loadImportJob(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, importJobResponse(job))
+}
+
+// DownloadImportErrors отдаёт CSV со строками, которые не удалось импортировать:
+// исходные колонки файла плюс номер строки и текст ошибки. Исправленный файл можно загрузить снова.
+func DownloadImportErrors(c *gin.Context) {
+	job, ok := loadImportJob(c)
+	if !ok {
+		return
+	}
+
+	messages := make(map[int][]string)
+	var order []int
+	for _, e := range job.Errors {
+		if _, ok := messages[e.Row]; !ok {
+			order = append(order, e.Row)
+		}
+		msg := e.Message
+		if e.Column != "" {
+			msg = e.Column + ": " + msg
+		}
+		messages[e.Row] = append(messages[e.Row], msg)
+	}
+
+	// Исходные строки подставляются, пока файл на месте; без файла отчёт содержит только ошибки
+	_, rows, err := loadImportFile(c.Request.Context(), job)
+	if err != nil {
+		rows = nil
+	}
+
+	buf := new(bytes.Buffer)
+	writer := csv.NewWriter(buf)
+	writer.Write(append([]string{"Строка", "Ошибка"}, job.Headers...))
+	for _, rowNum := range order {
+		record := []string{strconv.Itoa(rowNum), strings.Join(messages[rowNum], "; ")}
+		if i := rowNum - 2; i >= 0 && i < len(rows) {
+			record = append(record, rows[i]...)
+		}
+		writer.Write(record)
+	}
+	writer.Flush()
+
+	c.Header("Content-Description", "File Transfer")
+	c.Header("Content-Disposition", "attachment; filename=import-errors-"+job.ID+".csv")
+	c.Data(http.StatusOK, "text/csv", buf.Bytes())
+}
+
+// DeleteImport удаляет задание; файл в хранилище удалит очистка, когда на него не останется ссылок
+func DeleteImport(c *gin.Context) {
+	job, ok := loadImportJob(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteImportJob(c.Request.Context(), job.ID); err != nil {
+		respondImportError(c, err)
+		return
+	}
+	if job.FileHash == nil {
+		if err := os.Remove(job.FilePath); err != nil && !os.IsNotExist(err) {
+			log.Printf("⚠️ Не удалось удалить файл импорта %s: %v", job.FilePath, err)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// GetImportTemplates возвращает сохранённые сопоставления колонок (?entity=customer|deal)
+func GetImportTemplates(c *gin.Context) {
+	templates, err := models.ListImportTemplates(c.Request.Context(), getUserIDFromContext(c), c.Query("entity"))
+	if err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, templates)
+}
+
+// SaveImportTemplate сохраняет сопоставление колонок под именем (повтор имени перезаписывает шаблон)
+func SaveImportTemplate(c *gin.Context) {
+	var t models.ImportTemplate
+	if err := c.ShouldBindJSON(&t); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" || len(t.Mapping) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "name and mapping are required"})
+		return
+	}
+	if !models.IsCustomFieldEntity(t.EntityType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entity_type must be customer or deal"})
+		return
+	}
+	t.UserID = getUserIDFromContext(c)
+	if err := models.SaveImportTemplate(c.Request.Context(), &t); err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, t)
+}
+
+// DeleteImportTemplate удаляет шаблон пользователя
+func DeleteImportTemplate(c *gin.Context) {
+	if err := models.DeleteImportTemplate(c.Request.Context(), getUserIDFromContext(c), c.Param("id")); err != nil {
+		respondImportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
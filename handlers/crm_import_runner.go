@@ -0,0 +1,1070 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/xuri/excelize/v2"
+
+	"subscription-system/database"
+	"subscription-system/models"
+)
+
+// Разбор файлов импорта и построчная обработка. Проверка (dry-run) проходит тот же путь,
+// что и импорт, только без записи в БД, поэтому её ошибки совпадают с ошибками импорта.
+
+const (
+	importMaxRows       = 50000
+	importProgressEvery = 100
+)
+
+// Поля CRM, в которые можно сопоставить колонку (плюс cf.<key> для пользовательских полей)
+var importFields = map[string][]string{
+	models.CustomFieldEntityCustomer: {
+		"name", "email", "phone", "company", "status", "responsible", "source",
+		"comment", "city", "birthday", "notes", "tags",
+	},
+	models.CustomFieldEntityDeal: {
+		"title", "value", "customer_id", "customer_email", "customer_phone", "pipeline", "stage",
+		"probability", "responsible", "source", "comment", "expected_close",
+		"product_category", "discount", "next_action_date", "tags",
+	},
+}
+
+// importHeaderSynonyms – заголовки наших выгрузок, amoCRM и типичных таблиц (в нормализованном виде)
+var importHeaderSynonyms = map[string]map[string]string{
+	models.CustomFieldEntityCustomer: {
+		"имя": "name", "фио": "name", "полное имя": "name", "контакт": "name", "клиент": "name",
+		"полное имя контакта": "name", "name": "name", "full name": "name",
+		"email": "email", "e-mail": "email", "почта": "email", "эл. почта": "email",
+		"рабочий email": "email", "личный email": "email",
+		"телефон": "phone", "рабочий телефон": "phone", "мобильный телефон": "phone",
+		"мобильный": "phone", "phone": "phone",
+		"компания": "company", "организация": "company", "название компании": "company", "company": "company",
+		"статус": "status", "status": "status",
+		"ответственный": "responsible", "responsible": "responsible",
+		"источник": "source", "source": "source",
+		"комментарий": "comment", "примечание": "comment", "comment": "comment",
+		"город": "city", "city": "city",
+		"день рождения": "birthday", "дата рождения": "birthday", "birthday": "birthday",
+		"заметки": "notes", "notes": "notes",
+		"теги": "tags", "тэги": "tags", "tags": "tags",
+	},
+	models.CustomFieldEntityDeal: {
+		"название": "title", "название сделки": "title", "сделка": "title", "title": "title",
+		"сумма": "value", "бюджет": "value", "стоимость": "value", "value": "value",
+		"клиент id": "customer_id", "customer_id": "customer_id",
+		"email": "customer_email", "email клиента": "customer_email", "email контакта": "customer_email",
+		"рабочий email (контакт)": "customer_email", "рабочий email": "customer_email",
+		"телефон": "customer_phone", "телефон клиента": "customer_phone", "телефон контакта": "customer_phone",
+		"рабочий телефон (контакт)": "customer_phone", "рабочий телефон": "customer_phone",
+		"воронка": "pipeline", "pipeline": "pipeline",
+		"стадия": "stage", "этап": "stage", "этап сделки": "stage", "статус": "stage", "stage": "stage",
+		"вероятность": "probability", "probability": "probability",
+		"ответственный": "responsible", "responsible": "responsible",
+		"источник": "source", "source": "source",
+		"комментарий": "comment", "примечание": "comment", "comment": "comment",
+		"ожидаемая дата": "expected_close", "дата закрытия": "expected_close",
+		"планируемая дата закрытия": "expected_close", "expected_close": "expected_close",
+		"категория": "product_category", "категория товара": "product_category",
+		"скидка": "discount", "discount": "discount",
+		"следующее действие": "next_action_date", "дата следующего действия": "next_action_date",
+		"теги": "tags", "тэги": "tags", "tags": "tags",
+	},
+}
+
+var nonDigits = regexp.MustCompile(`\D`)
+
+// normalizeImportHeader приводит заголовок к виду для поиска синонима
+func normalizeImportHeader(h string) string {
+	h = strings.ToLower(strings.TrimSpace(h))
+	h = strings.ReplaceAll(h, "ё", "е")
+	h = strings.Trim(h, "*:")
+	return strings.Join(strings.Fields(h), " ")
+}
+
+// suggestImportMapping угадывает поле CRM для каждой колонки; нераспознанные колонки не попадают в результат
+func suggestImportMapping(entityType string, headers []string, fields []*models.CustomField) map[string]string {
+	byLabel := make(map[string]string, len(fields)*2)
+	for _, f := range fields {
+		byLabel[normalizeImportHeader(f.Label)] = customFieldFilterPrefix + f.Key
+		byLabel[f.Key] = customFieldFilterPrefix + f.Key
+	}
+	mapping := make(map[string]string)
+	used := make(map[string]bool)
+	for _, h := range headers {
+		norm := normalizeImportHeader(h)
+		target, ok := importHeaderSynonyms[entityType][norm]
+		if !ok {
+			target, ok = byLabel[norm]
+		}
+		// одно поле – одна колонка: при повторе (например, два телефона) берётся первая
+		if ok && !used[target] {
+			mapping[h] = target
+			used[target] = true
+		}
+	}
+	return mapping
+}
+
+// validateImportOptions проверяет сопоставление и правила дедупликации перед запуском
+func validateImportOptions(job *models.ImportJob, opts *models.ImportOptions, fields map[string]*models.CustomField) error {
+	known := make(map[string]bool)
+	for _, f := range importFields[job.EntityType] {
+		known[f] = true
+	}
+	headers := make(map[string]bool, len(job.Headers))
+	for _, h := range job.Headers {
+		headers[h] = true
+	}
+
+	targets := make(map[string]bool)
+	for column, target := range opts.Mapping {
+		if target == "" {
+			delete(opts.Mapping, column)
+			continue
+		}
+		if !headers[column] {
+			return fmt.Errorf("column %q is not in the file", column)
+		}
+		if strings.HasPrefix(target, customFieldFilterPrefix) {
+			if _, ok := fields[strings.TrimPrefix(target, customFieldFilterPrefix)]; !ok {
+				return fmt.Errorf("unknown custom field %q", target)
+			}
+		} else if !known[target] {
+			return fmt.Errorf("unknown field %q", target)
+		}
+		if targets[target] {
+			return fmt.Errorf("field %q is mapped to more than one column", target)
+		}
+		targets[target] = true
+	}
+
+	if job.EntityType == models.CustomFieldEntityCustomer {
+		if !targets["name"] && !targets["email"] && !targets["phone"] {
+			return errors.New("map at least one of name, email or phone")
+		}
+	} else {
+		if !targets["title"] {
+			return errors.New("title must be mapped")
+		}
+		if !targets["customer_id"] && !targets["customer_email"] && !targets["customer_phone"] {
+			return errors.New("map customer_id, customer_email or customer_phone to link deals to customers")
+		}
+	}
+
+	if opts.DedupBy == "" {
+		opts.DedupBy = models.ImportDedupEmailPhone
+	}
+	switch opts.DedupBy {
+	case models.ImportDedupEmail, models.ImportDedupPhone, models.ImportDedupEmailPhone, models.ImportDedupNone:
+	default:
+		return fmt.Errorf("dedup_by must be email, phone, email_phone or none")
+	}
+	if opts.OnDuplicate == "" {
+		opts.OnDuplicate = models.ImportOnDuplicateSkip
+	}
+	switch opts.OnDuplicate {
+	case models.ImportOnDuplicateSkip, models.ImportOnDuplicateUpdate, models.ImportOnDuplicateMerge:
+	default:
+		return fmt.Errorf("on_duplicate must be skip, update or merge")
+	}
+	return nil
+}
+
+// ========== ЧТЕНИЕ ФАЙЛА ==========
+
+// loadImportFile читает файл задания из хранилища, а у старых заданий – с локального диска
+func loadImportFile(ctx context.Context, job *models.ImportJob) ([]string, [][]string, error) {
+	var data []byte
+	var err error
+	if job.FileHash != nil {
+		data, err = fileService.ReadAll(ctx, job.FilePath)
+	} else {
+		data, err = os.ReadFile(job.FilePath)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	return readImportFile(job.FileName, data)
+}
+
+// readImportFile разбирает CSV или XLSX (первый лист); формат определяется по имени файла.
+// Пустые заголовки получают имя «Колонка N», повторяющиеся – суффикс « (2)». Строки
+// выравниваются по числу колонок.
+func readImportFile(fileName string, data []byte) ([]string, [][]string, error) {
+	var records [][]string
+	var err error
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".csv", ".txt":
+		records, err = readImportCSV(data)
+	case ".xlsx":
+		records, err = readImportXLSX(data)
+	default:
+		return nil, nil, errors.New("only .csv and .xlsx files are supported")
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil, errors.New("file is empty")
+	}
+	if len(records)-1 > importMaxRows {
+		return nil, nil, fmt.Errorf("file has more than %d rows", importMaxRows)
+	}
+
+	headers := make([]string, len(records[0]))
+	seen := make(map[string]int)
+	for i, h := range records[0] {
+		h = strings.TrimSpace(h)
+		if h == "" {
+			h = "Колонка " + strconv.Itoa(i+1)
+		}
+		seen[h]++
+		if seen[h] > 1 {
+			h = fmt.Sprintf("%s (%d)", h, seen[h])
+		}
+		headers[i] = h
+	}
+
+	rows := records[1:]
+	for i, row := range rows {
+		if len(row) < len(headers) {
+			rows[i] = append(row, make([]string, len(headers)-len(row))...)
+		}
+	}
+	return headers, rows, nil
+}
+
+func readImportCSV(data []byte) ([][]string, error) {
+	data = []byte(strings.TrimPrefix(string(data), "\uFEFF"))
+	if !utf8.Valid(data) {
+		return nil, errors.New("CSV must be UTF-8 encoded")
+	}
+
+	// Разделитель – тот из ; , и табуляции, которого больше всего в первой строке
+	firstLine := string(data)
+	if i := strings.IndexByte(firstLine, '\n'); i >= 0 {
+		firstLine = firstLine[:i]
+	}
+	delimiter := ','
+	best := strings.Count(firstLine, ",")
+	for _, d := range []rune{';', '\t'} {
+		if n := strings.Count(firstLine, string(d)); n > best {
+			delimiter, best = d, n
+		}
+	}
+
+	r := csv.NewReader(strings.NewReader(string(data)))
+	r.Comma = delimiter
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	var records [][]string
+	for {
+		rec, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		records = append(records, rec)
+		if len(records) > importMaxRows+1 {
+			break
+		}
+	}
+	return records, nil
+}
+
+func readImportXLSX(data []byte) ([][]string, error) {
+	f, err := excelize.OpenReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	sheets := f.GetSheetList()
+	if len(sheets) == 0 {
+		return nil, errors.New("workbook has no sheets")
+	}
+	return f.GetRows(sheets[0])
+}
+
+// ========== РАЗБОР ЗНАЧЕНИЙ ==========
+
+var importDateLayouts = []string{
+	"2006-01-02", "02.01.2006", "02.01.06", "2006-01-02 15:04:05", "02.01.2006 15:04:05",
+	"02.01.2006 15:04", "01/02/2006", time.RFC3339,
+}
+
+func parseImportDate(s string) (time.Time, error) {
+	for _, layout := range importDateLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("unrecognized date, use YYYY-MM-DD or DD.MM.YYYY")
+}
+
+// parseImportNumber понимает «1 500,50 ₽», «1500.5» и т.п.
+func parseImportNumber(s string) (float64, error) {
+	s = strings.NewReplacer(" ", "", " ", "", "₽", "", "руб.", "", "руб", "", "р.", "", "$", "", "€", "").Replace(s)
+	if strings.Count(s, ",") == 1 && !strings.Contains(s, ".") {
+		s = strings.Replace(s, ",", ".", 1)
+	} else {
+		s = strings.ReplaceAll(s, ",", "")
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, errors.New("not a number")
+	}
+	return n, nil
+}
+
+// phoneKey – последние 10 цифр номера: так +7 (999) 123-45-67 и 8 999 1234567 совпадают
+func phoneKey(phone string) string {
+	digits := nonDigits.ReplaceAllString(phone, "")
+	if len(digits) > 10 {
+		digits = digits[len(digits)-10:]
+	}
+	return digits
+}
+
+func splitImportList(s string) []string {
+	parts := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ';' || r == '|' })
+	result := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+// ========== ОБРАБОТКА ==========
+
+// importRowFailure – ошибка в значении строки; строка целиком не импортируется
+type importRowFailure struct {
+	column, value, message string
+}
+
+func (e *importRowFailure) Error() string { return e.message }
+
+// importer хранит состояние одного запуска: схему полей, воронки, кэш тегов
+// и ключи записей, уже встреченных в файле (для dry-run, где в БД ничего не появляется)
+type importer struct {
+	ctx     context.Context
+	job     *models.ImportJob
+	isAdmin bool
+	columns map[string]int // поле CRM -> индекс колонки
+	headers []string
+
+	customFields map[string]*models.CustomField
+	pipelines    []*models.Pipeline
+	tagIDs       map[string]string // нижний регистр имени -> id
+
+	seenEmails map[string]bool
+	seenPhones map[string]bool
+	seenDeals  map[string]bool
+}
+
+// runImportJob выполняет проверку или импорт в фоне и сохраняет итог в задании
+func runImportJob(job *models.ImportJob, isAdmin bool) {
+	ctx := context.Background()
+	defer func() {
+		if r := recover(); r != nil {
+			log.Printf("❌ Импорт %s упал: %v", job.ID, r)
+			job.Status = models.ImportStatusFailed
+			job.Error = fmt.Sprint(r)
+			if err := models.FinishImportJob(ctx, job); err != nil {
+				log.Printf("❌ Не удалось сохранить статус импорта %s: %v", job.ID, err)
+			}
+		}
+	}()
+
+	err := executeImport(ctx, job, isAdmin)
+	switch {
+	case err != nil:
+		job.Status = models.ImportStatusFailed
+		job.Error = err.Error()
+		log.Printf("❌ Импорт %s завершился ошибкой: %v", job.ID, err)
+	case job.DryRun:
+		job.Status = models.ImportStatusValidated
+		log.Printf("🔎 Проверка импорта %s: %d строк, ошибок %d", job.ID, job.TotalRows, job.ErrorCount)
+	default:
+		job.Status = models.ImportStatusCompleted
+		log.Printf("📥 Импорт %s: создано %d, обновлено %d, пропущено %d, ошибок %d",
+			job.ID, job.CreatedCount, job.UpdatedCount, job.SkippedCount, job.ErrorCount)
+	}
+	if err := models.FinishImportJob(ctx, job); err != nil {
+		log.Printf("❌ Не удалось сохранить итог импорта %s: %v", job.ID, err)
+	}
+}
+
+func executeImport(ctx context.Context, job *models.ImportJob, isAdmin bool) error {
+	headers, rows, err := loadImportFile(ctx, job)
+	if err != nil {
+		return err
+	}
+	imp := &importer{
+		ctx:        ctx,
+		job:        job,
+		isAdmin:    isAdmin,
+		headers:    headers,
+		columns:    make(map[string]int),
+		tagIDs:     make(map[string]string),
+		seenEmails: make(map[string]bool),
+		seenPhones: make(map[string]bool),
+		seenDeals:  make(map[string]bool),
+	}
+	for i, h := range headers {
+		if target, ok := job.Options.Mapping[h]; ok {
+			imp.columns[target] = i
+		}
+	}
+	if imp.customFields, err = models.CustomFieldsByKey(ctx, job.EntityType); err != nil {
+		return err
+	}
+	if job.EntityType == models.CustomFieldEntityDeal {
+		if imp.pipelines, err = models.ListPipelines(ctx, job.UserID, isAdmin); err != nil {
+			return err
+		}
+	}
+
+	job.TotalRows = len(rows)
+	for i, row := range rows {
+		rowNum := i + 2 // строка 1 – заголовок
+		if isEmptyImportRow(row) {
+			job.SkippedCount++
+		} else {
+			var outcome string
+			var err error
+			if job.EntityType == models.CustomFieldEntityDeal {
+				outcome, err = imp.importDeal(row)
+			} else {
+				outcome, err = imp.importCustomer(row)
+			}
+			imp.record(rowNum, outcome, err)
+		}
+		job.ProcessedRows++
+		if job.ProcessedRows%importProgressEvery == 0 {
+			if err := models.SaveImportProgress(ctx, job); err != nil {
+				log.Printf("⚠️ Не удалось сохранить прогресс импорта %s: %v", job.ID, err)
+			}
+		}
+	}
+	return nil
+}
+
+func isEmptyImportRow(row []string) bool {
+	for _, v := range row {
+		if strings.TrimSpace(v) != "" {
+			return false
+		}
+	}
+	return true
+}
+
+const (
+	importCreated = "created"
+	importUpdated = "updated"
+	importSkipped = "skipped"
+)
+
+// record учитывает результат строки. Ошибки БД тоже попадают в отчёт, но не останавливают импорт.
+func (imp *importer) record(rowNum int, outcome string, err error) {
+	job := imp.job
+	if err != nil {
+		job.ErrorCount++
+		rowErr := models.ImportRowError{Row: rowNum, Message: err.Error()}
+		var failure *importRowFailure
+		if errors.As(err, &failure) {
+			rowErr.Column, rowErr.Value = failure.column, failure.value
+		} else if !errors.Is(err, models.ErrInvalidCustomField) {
+			log.Printf("❌ Импорт %s, строка %d: %v", job.ID, rowNum, err)
+		}
+		if len(job.Errors) < models.ImportMaxErrors {
+			job.Errors = append(job.Errors, rowErr)
+		}
+		return
+	}
+	switch outcome {
+	case importCreated:
+		job.CreatedCount++
+	case importUpdated:
+		job.UpdatedCount++
+	default:
+		job.SkippedCount++
+	}
+}
+
+// value – значение поля CRM из строки (пустая строка, если колонка не сопоставлена)
+func (imp *importer) value(row []string, field string) string {
+	i, ok := imp.columns[field]
+	if !ok || i >= len(row) {
+		return ""
+	}
+	return strings.TrimSpace(row[i])
+}
+
+func (imp *importer) fail(field, value, format string, args ...interface{}) error {
+	column := field
+	for h, target := range imp.job.Options.Mapping {
+		if target == field {
+			column = h
+			break
+		}
+	}
+	return &importRowFailure{column: column, value: value, message: fmt.Sprintf(format, args...)}
+}
+
+// importValues – разобранные значения строки: колонки таблицы, теги и пользовательские поля
+type importValues struct {
+	columns      map[string]interface{}
+	tags         []string
+	customFields map[string]interface{}
+	stageClosed  *bool // сделка переходит на закрывающий этап (только при смене этапа)
+}
+
+// parseCommon разбирает поля, общие для клиентов и сделок: строки, даты, числа, теги, cf.*
+func (imp *importer) parseCommon(row []string, textFields, dateFields, numberFields []string) (*importValues, error) {
+	v := &importValues{columns: make(map[string]interface{}), customFields: make(map[string]interface{})}
+	for _, f := range textFields {
+		if s := imp.value(row, f); s != "" {
+			v.columns[f] = s
+		}
+	}
+	for _, f := range dateFields {
+		if s := imp.value(row, f); s != "" {
+			d, err := parseImportDate(s)
+			if err != nil {
+				return nil, imp.fail(f, s, "%s: %v", f, err)
+			}
+			v.columns[f] = d
+		}
+	}
+	for _, f := range numberFields {
+		if s := imp.value(row, f); s != "" {
+			n, err := parseImportNumber(s)
+			if err != nil || n < 0 {
+				return nil, imp.fail(f, s, "%s: expected a non-negative number", f)
+			}
+			v.columns[f] = n
+		}
+	}
+
+	if s := imp.value(row, "tags"); s != "" {
+		for _, name := range splitImportList(s) {
+			id, err := imp.tagID(name)
+			if err != nil {
+				return nil, err
+			}
+			if id != "" {
+				v.tags = append(v.tags, id)
+			}
+		}
+	}
+
+	for key, f := range imp.customFields {
+		s := imp.value(row, customFieldFilterPrefix+key)
+		if s == "" {
+			continue
+		}
+		var raw interface{} = s
+		if f.FieldType == models.CustomFieldMultiSelect {
+			items := []interface{}{}
+			for _, item := range splitImportList(s) {
+				items = append(items, item)
+			}
+			raw = items
+		} else if f.FieldType == models.CustomFieldDate {
+			d, err := parseImportDate(s)
+			if err != nil {
+				return nil, imp.fail(customFieldFilterPrefix+key, s, "%s: %v", f.Label, err)
+			}
+			raw = d.Format("2006-01-02")
+		}
+		normalized, err := f.Normalize(imp.ctx, raw)
+		if err != nil {
+			return nil, imp.fail(customFieldFilterPrefix+key, s, "%v", err)
+		}
+		v.customFields[key] = normalized
+	}
+	return v, nil
+}
+
+// tagID находит тег по имени без учёта регистра и создаёт недостающий (в dry-run не создаёт)
+func (imp *importer) tagID(name string) (string, error) {
+	key := strings.ToLower(name)
+	if id, ok := imp.tagIDs[key]; ok {
+		return id, nil
+	}
+	var id string
+	err := database.Pool.QueryRow(imp.ctx, `SELECT id FROM tags WHERE LOWER(name) = $1 AND deleted_at IS NULL LIMIT 1`, key).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if imp.job.DryRun {
+			return "", nil
+		}
+		err = database.Pool.QueryRow(imp.ctx,
+			`INSERT INTO tags (name, color) VALUES ($1, '#6c757d') RETURNING id`, name).Scan(&id)
+	}
+	if err != nil {
+		return "", err
+	}
+	imp.tagIDs[key] = id
+	return id, nil
+}
+
+// ownerFilter – ограничение выборки записями пользователя (кроме администратора), без записей из корзины
+func (imp *importer) ownerFilter(args []interface{}) (string, []interface{}) {
+	if imp.isAdmin {
+		return " AND deleted_at IS NULL", args
+	}
+	return " AND deleted_at IS NULL AND user_id = $" + strconv.Itoa(len(args)+1), append(args, imp.job.UserID)
+}
+
+// findCustomer ищет клиента по email и/или телефону (по правилу dedup_by)
+func (imp *importer) findCustomer(email, phone, dedupBy string) (string, error) {
+	var id string
+	if email != "" && (dedupBy == models.ImportDedupEmail || dedupBy == models.ImportDedupEmailPhone) {
+		filter, args := imp.ownerFilter([]interface{}{email})
+		err := database.Pool.QueryRow(imp.ctx,
+			`SELECT id FROM crm_customers WHERE LOWER(email) = $1`+filter+` LIMIT 1`, args...).Scan(&id)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			return id, err
+		}
+	}
+	if key := phoneKey(phone); len(key) >= 7 && (dedupBy == models.ImportDedupPhone || dedupBy == models.ImportDedupEmailPhone) {
+		filter, args := imp.ownerFilter([]interface{}{key})
+		err := database.Pool.QueryRow(imp.ctx, `
+			SELECT id FROM crm_customers
+			WHERE RIGHT(regexp_replace(COALESCE(phone, ''), '\D', '', 'g'), 10) = $1`+filter+`
+			ORDER BY created_at LIMIT 1`, args...).Scan(&id)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			return id, err
+		}
+	}
+	return "", nil
+}
+
+// seenInFile – в dry-run клиент с тем же email/телефоном уже «создан» строкой выше.
+// При настоящем импорте такие записи уже есть в БД, и их находит findCustomer.
+func (imp *importer) seenInFile(email, phone, dedupBy string) bool {
+	if !imp.job.DryRun {
+		return false
+	}
+	key := phoneKey(phone)
+	if email != "" && imp.seenEmails[email] && (dedupBy == models.ImportDedupEmail || dedupBy == models.ImportDedupEmailPhone) {
+		return true
+	}
+	return len(key) >= 7 && imp.seenPhones[key] && (dedupBy == models.ImportDedupPhone || dedupBy == models.ImportDedupEmailPhone)
+}
+
+// rememberCustomer запоминает ключи клиента, «созданного» в dry-run
+func (imp *importer) rememberCustomer(email, phone string) {
+	if email != "" {
+		imp.seenEmails[email] = true
+	}
+	if key := phoneKey(phone); len(key) >= 7 {
+		imp.seenPhones[key] = true
+	}
+}
+
+func (imp *importer) importCustomer(row []string) (string, error) {
+	v, err := imp.parseCommon(row,
+		[]string{"name", "phone", "company", "status", "responsible", "source", "comment", "city", "notes"},
+		[]string{"birthday"}, nil)
+	if err != nil {
+		return "", err
+	}
+	email := strings.ToLower(imp.value(row, "email"))
+	if email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return "", imp.fail("email", email, "invalid email")
+		}
+		email = strings.ToLower(addr.Address)
+		v.columns["email"] = email
+	}
+	phone, _ := v.columns["phone"].(string)
+	if phone != "" && len(phoneKey(phone)) < 7 {
+		return "", imp.fail("phone", phone, "phone must contain at least 7 digits")
+	}
+
+	opts := imp.job.Options
+	if opts.DedupBy != models.ImportDedupNone {
+		existingID, err := imp.findCustomer(email, phone, opts.DedupBy)
+		if err != nil {
+			return "", err
+		}
+		inFile := imp.seenInFile(email, phone, opts.DedupBy)
+		if existingID != "" || inFile {
+			if opts.OnDuplicate == models.ImportOnDuplicateSkip {
+				return importSkipped, nil
+			}
+			if imp.job.DryRun {
+				return importUpdated, nil
+			}
+			return importUpdated, imp.updateRecord("customer", existingID, v, opts.OnDuplicate == models.ImportOnDuplicateMerge)
+		}
+	}
+
+	// Новая запись: email в crm_customers обязателен и уникален
+	if _, ok := v.columns["name"]; !ok {
+		return "", imp.fail("name", "", "name is required for a new customer")
+	}
+	if email == "" {
+		return "", imp.fail("email", "", "email is required for a new customer")
+	}
+	var taken, inTrash bool
+	err = database.Pool.QueryRow(imp.ctx,
+		`SELECT COUNT(*) > 0, COALESCE(BOOL_AND(deleted_at IS NOT NULL), false) FROM crm_customers WHERE LOWER(email) = $1`, email).Scan(&taken, &inTrash)
+	if err != nil {
+		return "", err
+	}
+	if taken && inTrash {
+		return "", imp.fail("email", email, "customer with this email is in the trash")
+	}
+	if taken || (imp.job.DryRun && imp.seenEmails[email]) {
+		return "", imp.fail("email", email, "customer with this email already exists")
+	}
+	if _, err := models.ApplyCustomFieldValues(imp.ctx, models.CustomFieldEntityCustomer, nil, v.customFields); err != nil {
+		return "", err
+	}
+	if imp.job.DryRun {
+		imp.rememberCustomer(email, phone)
+		return importCreated, nil
+	}
+	if _, ok := v.columns["status"]; !ok {
+		v.columns["status"] = "lead"
+	}
+	return importCreated, imp.insertRecord("customer", v)
+}
+
+// findPipelineStage – воронка по имени или ID (пусто – по умолчанию) и этап по коду или названию
+func (imp *importer) findPipelineStage(pipelineRef, stageRef string) (*models.Pipeline, *models.PipelineStage, error) {
+	var pipeline *models.Pipeline
+	for _, p := range imp.pipelines {
+		if pipelineRef == "" && p.IsDefault && (p.UserID == nil || *p.UserID == imp.job.UserID) {
+			// своя воронка по умолчанию важнее общей
+			if pipeline == nil || p.UserID != nil {
+				pipeline = p
+			}
+		} else if pipelineRef != "" && (p.ID == pipelineRef || strings.EqualFold(p.Name, pipelineRef)) {
+			pipeline = p
+			break
+		}
+	}
+	if pipeline == nil {
+		return nil, nil, imp.fail("pipeline", pipelineRef, "pipeline not found")
+	}
+
+	var stage *models.PipelineStage
+	var ok bool
+	if stageRef == "" {
+		stage, ok = pipeline.FirstStage()
+	} else if stage, ok = pipeline.Stage(stageRef); !ok {
+		for i := range pipeline.Stages {
+			if strings.EqualFold(pipeline.Stages[i].Name, stageRef) {
+				stage, ok = &pipeline.Stages[i], true
+				break
+			}
+		}
+	}
+	if !ok {
+		return nil, nil, imp.fail("stage", stageRef, "stage not found in pipeline %s", pipeline.Name)
+	}
+	return pipeline, stage, nil
+}
+
+// findDealCustomer – клиент сделки по customer_id, email или телефону среди доступных пользователю
+func (imp *importer) findDealCustomer(row []string) (string, error) {
+	if id := imp.value(row, "customer_id"); id != "" {
+		if _, err := uuid.Parse(id); err != nil {
+			return "", imp.fail("customer_id", id, "invalid customer id")
+		}
+		filter, args := imp.ownerFilter([]interface{}{id})
+		var found string
+		err := database.Pool.QueryRow(imp.ctx, `SELECT id FROM crm_customers WHERE id = $1`+filter, args...).Scan(&found)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return "", imp.fail("customer_id", id, "customer not found")
+		}
+		return found, err
+	}
+	email := strings.ToLower(imp.value(row, "customer_email"))
+	phone := imp.value(row, "customer_phone")
+	id, err := imp.findCustomer(email, phone, models.ImportDedupEmailPhone)
+	if err != nil {
+		return "", err
+	}
+	if id == "" {
+		if email == "" {
+			return "", imp.fail("customer_phone", phone, "customer not found; import customers first")
+		}
+		return "", imp.fail("customer_email", email, "customer not found; import customers first")
+	}
+	return id, nil
+}
+
+func (imp *importer) importDeal(row []string) (string, error) {
+	v, err := imp.parseCommon(row,
+		[]string{"title", "responsible", "source", "comment", "product_category"},
+		[]string{"expected_close", "next_action_date"}, []string{"value", "discount"})
+	if err != nil {
+		return "", err
+	}
+	title, _ := v.columns["title"].(string)
+	if title == "" {
+		return "", imp.fail("title", "", "title is required")
+	}
+	if s := imp.value(row, "probability"); s != "" {
+		p, err := strconv.Atoi(strings.TrimSuffix(s, "%"))
+		if err != nil || p < 0 || p > 100 {
+			return "", imp.fail("probability", s, "probability must be an integer from 0 to 100")
+		}
+		v.columns["probability"] = p
+	}
+
+	customerID, err := imp.findDealCustomer(row)
+	if err != nil {
+		return "", err
+	}
+	v.columns["customer_id"] = customerID
+
+	_, pipelineMapped := imp.columns["pipeline"]
+	_, stageMapped := imp.columns["stage"]
+	pipeline, stage, err := imp.findPipelineStage(imp.value(row, "pipeline"), imp.value(row, "stage"))
+	if err != nil {
+		return "", err
+	}
+
+	// Дубликат сделки – та же сделка (по названию) у того же клиента
+	opts := imp.job.Options
+	if opts.DedupBy != models.ImportDedupNone {
+		inFile := imp.job.DryRun && imp.seenDeals[customerID+"|"+strings.ToLower(title)]
+
+		var existingID string
+		filter, args := imp.ownerFilter([]interface{}{customerID, strings.ToLower(title)})
+		err := database.Pool.QueryRow(imp.ctx, `
+			SELECT id FROM crm_deals WHERE customer_id = $1 AND LOWER(title) = $2`+filter+`
+			ORDER BY created_at LIMIT 1`, args...).Scan(&existingID)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return "", err
+		}
+		if existingID != "" || inFile {
+			if opts.OnDuplicate == models.ImportOnDuplicateSkip {
+				return importSkipped, nil
+			}
+			if imp.job.DryRun {
+				return importUpdated, nil
+			}
+			merge := opts.OnDuplicate == models.ImportOnDuplicateMerge
+			// при обновлении этап меняется, только если он есть в файле; слияние этап не трогает
+			if !merge && (pipelineMapped || stageMapped) {
+				v.columns["pipeline_id"] = pipeline.ID
+				v.columns["stage"] = stage.Code
+				closed := stage.IsClosed()
+				v.stageClosed = &closed
+			}
+			if err := imp.updateRecord("deal", existingID, v, merge); err != nil {
+				return "", err
+			}
+			return importUpdated, updateLeadScore(imp.ctx, customerID)
+		}
+	}
+
+	if _, err := models.ApplyCustomFieldValues(imp.ctx, models.CustomFieldEntityDeal, nil, v.customFields); err != nil {
+		return "", err
+	}
+	if imp.job.DryRun {
+		imp.seenDeals[customerID+"|"+strings.ToLower(title)] = true
+		return importCreated, nil
+	}
+	v.columns["pipeline_id"] = pipeline.ID
+	v.columns["stage"] = stage.Code
+	if _, ok := v.columns["probability"]; !ok {
+		v.columns["probability"] = stage.Probability
+	}
+	if _, ok := v.columns["value"]; !ok {
+		v.columns["value"] = 0.0
+	}
+	if stage.IsClosed() {
+		v.columns["closed_at"] = time.Now()
+	}
+	if err := imp.insertRecord("deal", v); err != nil {
+		return "", err
+	}
+	return importCreated, updateLeadScore(imp.ctx, customerID)
+}
+
+// importTextDefaults – строковые колонки, которые API всегда заполняет (NULL ломает выборки)
+var importTextDefaults = map[string][]string{
+	"customer": {"phone", "company", "responsible", "source", "comment", "city", "notes"},
+	"deal":     {"responsible", "source", "comment", "product_category"},
+}
+
+// insertRecord создаёт клиента или сделку из разобранной строки
+func (imp *importer) insertRecord(entityType string, v *importValues) error {
+	table := models.CRMEntityTable(entityType)
+	for _, col := range importTextDefaults[entityType] {
+		if _, ok := v.columns[col]; !ok {
+			v.columns[col] = ""
+		}
+	}
+	customFields, err := models.ApplyCustomFieldValues(imp.ctx, entityType, nil, v.customFields)
+	if err != nil {
+		return err
+	}
+	v.columns["custom_fields"] = customFields
+	v.columns["user_id"] = imp.job.UserID
+
+	cols := sortedImportColumns(v.columns)
+	args := make([]interface{}, 0, len(cols))
+	placeholders := make([]string, 0, len(cols))
+	for _, col := range cols {
+		args = append(args, v.columns[col])
+		placeholders = append(placeholders, "$"+strconv.Itoa(len(args)))
+	}
+	extra := ""
+	if entityType == "deal" {
+		extra = ", stage_changed_at"
+		placeholders = append(placeholders, "NOW()")
+	}
+
+	var id string
+	err = database.Pool.QueryRow(imp.ctx, fmt.Sprintf(
+		`INSERT INTO %s (%s%s) VALUES (%s) RETURNING id`,
+		table, strings.Join(cols, ", "), extra, strings.Join(placeholders, ", ")), args...).Scan(&id)
+	if err != nil {
+		return err
+	}
+	if len(v.tags) > 0 {
+		if err := updateEntityTags(imp.ctx, entityType, id, v.tags); err != nil {
+			return err
+		}
+	}
+	userID := imp.job.UserID
+	return addHistory(imp.ctx, entityType, id, "create", &userID, map[string]string{"import_job": imp.job.ID})
+}
+
+// importNumericColumns – для слияния «пусто» у чисел означает NULL или 0
+var importNumericColumns = map[string]bool{"value": true, "discount": true, "probability": true}
+
+// updateRecord обновляет найденный дубликат: update перезаписывает колонками из файла,
+// merge заполняет только пустые колонки и добавляет недостающие теги и пользовательские поля
+func (imp *importer) updateRecord(entityType, id string, v *importValues, merge bool) error {
+	table := models.CRMEntityTable(entityType)
+	var rawCustomFields []byte
+	err := database.Pool.QueryRow(imp.ctx,
+		fmt.Sprintf(`SELECT custom_fields FROM %s WHERE id = $1`, table), id).Scan(&rawCustomFields)
+	if err != nil {
+		return err
+	}
+	current := decodeCustomFields(rawCustomFields)
+	patch := v.customFields
+	if merge {
+		patch = make(map[string]interface{})
+		for k, val := range v.customFields {
+			if _, ok := current[k]; !ok {
+				patch[k] = val
+			}
+		}
+	}
+	customFields, err := models.ApplyCustomFieldValues(imp.ctx, entityType, current, patch)
+	if err != nil {
+		return err
+	}
+
+	delete(v.columns, "customer_id")
+	cols := sortedImportColumns(v.columns)
+	args := []interface{}{id, customFields}
+	sets := []string{"custom_fields = $2"}
+	for _, col := range cols {
+		args = append(args, v.columns[col])
+		p := "$" + strconv.Itoa(len(args))
+		switch {
+		case !merge:
+			sets = append(sets, fmt.Sprintf("%s = %s", col, p))
+		case importNumericColumns[col]:
+			sets = append(sets, fmt.Sprintf("%[1]s = CASE WHEN COALESCE(%[1]s, 0) = 0 THEN %[2]s ELSE %[1]s END", col, p))
+		case col == "birthday" || col == "expected_close" || col == "next_action_date":
+			sets = append(sets, fmt.Sprintf("%[1]s = COALESCE(%[1]s, %[2]s)", col, p))
+		default:
+			sets = append(sets, fmt.Sprintf("%[1]s = CASE WHEN COALESCE(%[1]s, '') = '' THEN %[2]s ELSE %[1]s END", col, p))
+		}
+	}
+	if entityType == "deal" {
+		sets = append(sets, "updated_at = NOW()")
+		if stage, ok := v.columns["stage"]; ok {
+			args = append(args, stage)
+			sets = append(sets, fmt.Sprintf(
+				"stage_changed_at = CASE WHEN stage IS DISTINCT FROM $%d THEN NOW() ELSE stage_changed_at END",
+				len(args)))
+		}
+		if v.stageClosed != nil {
+			args = append(args, *v.stageClosed)
+			sets = append(sets, fmt.Sprintf("closed_at = CASE WHEN $%d THEN COALESCE(closed_at, NOW()) END", len(args)))
+		}
+	} else {
+		sets = append(sets, "last_seen = NOW()")
+	}
+
+	// stage_changed_at вычисляется по старому значению stage: в PostgreSQL SET видит строку до обновления
+	_, err = database.Pool.Exec(imp.ctx, fmt.Sprintf(`UPDATE %s SET %s WHERE id = $1`,
+		table, strings.Join(sets, ", ")), args...)
+	if err != nil {
+		return err
+	}
+
+	if len(v.tags) > 0 {
+		tags := v.tags
+		if merge {
+			existing, err := getTagsForEntity(imp.ctx, entityType, id)
+			if err != nil {
+				return err
+			}
+			tags = unionStrings(existing, v.tags)
+		}
+		if err := updateEntityTags(imp.ctx, entityType, id, tags); err != nil {
+			return err
+		}
+	}
+	userID := imp.job.UserID
+	return addHistory(imp.ctx, entityType, id, "update", &userID, map[string]string{"import_job": imp.job.ID})
+}
+
+func sortedImportColumns(columns map[string]interface{}) []string {
+	cols := make([]string, 0, len(columns))
+	for col := range columns {
+		cols = append(cols, col)
+	}
+	sort.Strings(cols)
+	return cols
+}
+
+func unionStrings(a, b []string) []string {
+	seen := make(map[string]bool, len(a)+len(b))
+	result := make([]string, 0, len(a)+len(b))
+	for _, s := range append(append([]string{}, a...), b...) {
+		if !seen[s] {
+			seen[s] = true
+			result = append(result, s)
+		}
+	}
+	return result
+}
@@ -0,0 +1,345 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/config"
+	"subscription-system/database"
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Настройка модели лид-скоринга, пересчёт и разбор оценки клиента. Своя модель есть у каждого
+// пользователя; общую (?shared=true) ведёт администратор, она действует для тех, у кого своей нет.
+
+// scoringSuggestSample – на скольких клиентах считается статистика для подбора весов
+const scoringSuggestSample = 1000
+
+var (
+	scoringAI *services.YandexAIService
+
+	// scoringRuns – идущие фоновые пересчёты по рабочим пространствам ("" – все клиенты)
+	scoringRuns   = map[string]bool{}
+	scoringRunsMu sync.Mutex
+)
+
+// InitLeadScoring включает подсказки весов от YandexGPT, если он настроен
+func InitLeadScoring(cfg *config.Config) {
+	if cfg.YandexFolderID != "" && cfg.YandexAPIKey != "" {
+		scoringAI = services.NewYandexAIService(cfg)
+	}
+}
+
+// respondScoringError переводит ошибки скоринга в HTTP-ответ
+func respondScoringError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidScoringModel):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrScoringModelNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Scoring model not found"})
+	case errors.Is(err, models.ErrLeadScoreNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
+	default:
+		log.Printf("❌ Ошибка лид-скоринга: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// scoringOwner – чью модель затрагивает запрос: ?shared=true – общую (изменять может только администратор)
+func scoringOwner(c *gin.Context, edit bool) (*string, bool) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return nil, false
+	}
+	if c.Query("shared") != "true" {
+		return &userID, true
+	}
+	if edit && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can edit the shared scoring model"})
+		return nil, false
+	}
+	return nil, true
+}
+
+// scoringModelFor – модель рабочего пространства; для общей без сохранённой модели – встроенная
+func scoringModelFor(ctx context.Context, ownerID *string) (*models.ScoringModel, error) {
+	if ownerID != nil {
+		return models.EffectiveScoringModel(ctx, ownerID)
+	}
+	m, err := models.GetScoringModel(ctx, nil)
+	if errors.Is(err, models.ErrScoringModelNotFound) {
+		return models.DefaultScoringModel(), nil
+	}
+	return m, err
+}
+
+// startScoringRecalculation пересчитывает оценки в фоне; false – такой пересчёт уже идёт.
+// ownerID == nil – все клиенты (после изменения общей модели или по запросу администратора).
+func startScoringRecalculation(ownerID *string) bool {
+	key := ""
+	if ownerID != nil {
+		key = *ownerID
+	}
+	scoringRunsMu.Lock()
+	if scoringRuns[key] {
+		scoringRunsMu.Unlock()
+		return false
+	}
+	scoringRuns[key] = true
+	scoringRunsMu.Unlock()
+
+	go func() {
+		defer func() {
+			scoringRunsMu.Lock()
+			delete(scoringRuns, key)
+			scoringRunsMu.Unlock()
+		}()
+		started := time.Now()
+		n, err := models.RecalculateLeadScores(context.Background(), ownerID)
+		if err != nil {
+			log.Printf("❌ Пересчёт лид-скоринга прерван после %d клиентов: %v", n, err)
+			return
+		}
+		log.Printf("🎯 Лид-скоринг пересчитан: %d клиентов за %s", n, time.Since(started).Round(time.Millisecond))
+	}()
+	return true
+}
+
+// GetScoringCriteria описывает доступные критерии, операторы и поля для конструктора правил
+func GetScoringCriteria(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"criteria":               models.ScoringCriteria,
+		"operators":              []string{models.ScoringOpNotEmpty, models.ScoringOpEquals, models.ScoringOpContains},
+		"fields":                 models.ScoringFields,
+		"custom_field_prefix":    models.LeadCustomTargetPrefix,
+		"deal_stage_groups":      []string{models.ScoringStageOpen, models.ScoringStageWon, models.ScoringStageLost},
+		"email_activity_types":   models.ScoringEmailActivityTypes,
+		"default_model":          models.DefaultScoringModel(),
+		"max_score":              models.ScoreMax,
+		"default_half_life_days": models.DefaultScoringHalfLife,
+	})
+}
+
+// GetScoringModel возвращает действующую модель скоринга (built_in – сохранённой модели нет)
+func GetScoringModel(c *gin.Context) {
+	ownerID, ok := scoringOwner(c, false)
+	if !ok {
+		return
+	}
+	m, err := scoringModelFor(c.Request.Context(), ownerID)
+	if err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, m)
+}
+
+// SaveScoringModel сохраняет модель целиком и запускает пересчёт оценок затронутых клиентов
+func SaveScoringModel(c *gin.Context) {
+	ownerID, ok := scoringOwner(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Rules             []models.ScoringRule `json:"rules" binding:"required"`
+		DecayHalfLifeDays *int                 `json:"decay_half_life_days"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	m := &models.ScoringModel{UserID: ownerID, Rules: req.Rules, DecayHalfLifeDays: models.DefaultScoringHalfLife}
+	if req.DecayHalfLifeDays != nil {
+		m.DecayHalfLifeDays = *req.DecayHalfLifeDays
+	}
+	if err := m.Normalize(); err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	userID := getUserIDFromContext(c)
+	if err := models.SaveScoringModel(c.Request.Context(), m, userID); err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	log.Printf("🎯 Модель лид-скоринга обновлена пользователем %s (правил: %d, общая: %t)", userID, len(m.Rules), ownerID == nil)
+	startScoringRecalculation(ownerID)
+	c.JSON(http.StatusOK, m)
+}
+
+// DeleteScoringModel сбрасывает модель: снова действует общая или встроенная
+func DeleteScoringModel(c *gin.Context) {
+	ownerID, ok := scoringOwner(c, true)
+	if !ok {
+		return
+	}
+	if err := models.DeleteScoringModel(c.Request.Context(), ownerID); err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	startScoringRecalculation(ownerID)
+	c.JSON(http.StatusOK, gin.H{"message": "Scoring model reset"})
+}
+
+// RecalculateLeadScores запускает фоновый пересчёт оценок своих клиентов; администратор с ?all=true –
+// всех клиентов
+func RecalculateLeadScores(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	ownerID := &userID
+	if c.Query("all") == "true" {
+		if !isAdmin(c) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+			return
+		}
+		ownerID = nil
+	}
+	if !startScoringRecalculation(ownerID) {
+		c.JSON(http.StatusAccepted, gin.H{"message": "Recalculation is already running"})
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"message": "Recalculation started"})
+}
+
+// GetCustomerLeadScore объясняет оценку клиента: вклад каждого правила и затухание.
+// ?refresh=true (или если оценки ещё нет) – пересчитать перед ответом.
+func GetCustomerLeadScore(c *gin.Context) {
+	id := c.Param("id")
+	var ownerID *string
+	err := database.Pool.QueryRow(c.Request.Context(), `SELECT user_id::text FROM crm_customers WHERE id::text = $1 AND deleted_at IS NULL`, id).Scan(&ownerID)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && !isAdmin(c) && (ownerID == nil || *ownerID != getUserIDFromContext(c))) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Customer not found"})
+		return
+	}
+	if err != nil {
+		respondScoringError(c, err)
+		return
+	}
+
+	var score *models.LeadScore
+	if c.Query("refresh") != "true" {
+		score, err = models.GetLeadScore(c.Request.Context(), id)
+	}
+	if score == nil && (err == nil || errors.Is(err, models.ErrLeadScoreNotFound)) {
+		score, err = models.RecalculateLeadScore(c.Request.Context(), id)
+	}
+	if err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	model, err := models.EffectiveScoringModel(c.Request.Context(), ownerID)
+	if err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"score":       score,
+		"model":       gin.H{"id": model.ID, "built_in": model.BuiltIn, "decay_half_life_days": model.DecayHalfLifeDays, "updated_at": model.UpdatedAt},
+		"model_stale": model.UpdatedAt != nil && model.UpdatedAt.After(score.ComputedAt),
+	})
+}
+
+// scoringAISuggestion – вес правила, предложенный YandexGPT
+type scoringAISuggestion struct {
+	RuleID string  `json:"rule_id"`
+	Points float64 `json:"points"`
+	Reason string  `json:"reason"`
+}
+
+// SuggestScoringWeights подбирает веса правил по истории: у кого из клиентов есть выигранные сделки.
+// С ?ai=true статистика дополнительно отдаётся YandexGPT за рекомендациями с пояснениями.
+// Модель не меняется – предложенные веса применяются через PUT модели.
+func SuggestScoringWeights(c *gin.Context) {
+	ownerID, ok := scoringOwner(c, false)
+	if !ok {
+		return
+	}
+	model, err := scoringModelFor(c.Request.Context(), ownerID)
+	if err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	// Статистика по общей модели считается на всех клиентах только для администратора
+	sampleOwner := ownerID
+	if sampleOwner == nil && !isAdmin(c) {
+		userID := getUserIDFromContext(c)
+		sampleOwner = &userID
+	}
+	stats, err := models.SuggestScoringWeights(c.Request.Context(), model, sampleOwner, scoringSuggestSample)
+	if err != nil {
+		respondScoringError(c, err)
+		return
+	}
+	resp := gin.H{"model": model, "stats": stats}
+
+	if c.Query("ai") == "true" {
+		switch {
+		case scoringAI == nil:
+			resp["ai_error"] = "YandexGPT is not configured"
+		case stats.Customers == 0:
+			resp["ai_error"] = "Not enough customers to analyse"
+		default:
+			suggestions, err := askScoringWeights(c.Request.Context(), stats)
+			if err != nil {
+				log.Printf("⚠️ YandexGPT не предложил веса скоринга: %v", err)
+				resp["ai_error"] = "AI suggestion failed"
+			} else {
+				resp["ai_suggestions"] = suggestions
+			}
+		}
+	}
+	c.JSON(http.StatusOK, resp)
+}
+
+// askScoringWeights просит YandexGPT предложить веса по статистике правил
+func askScoringWeights(ctx context.Context, stats *models.ScoringSuggestion) ([]scoringAISuggestion, error) {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Ты аналитик отдела продаж. Модель лид-скоринга начисляет баллы (итог 0..100) по правилам. "+
+		"Выборка: %d клиентов, у %d есть выигранная сделка (доля %.1f%%).\n", stats.Customers, stats.Won, stats.BaseWinRate*100)
+	b.WriteString("Правила (id; название; текущие баллы; у скольких срабатывает; доля выигравших среди них; доля среди остальных):\n")
+	for _, r := range stats.Rules {
+		fmt.Fprintf(&b, "- %s; %s; %.0f; %d; %.1f%%; %.1f%%\n", r.RuleID, r.Name, r.Points, r.Matched, r.WinRateMatched*100, r.WinRateOthers*100)
+	}
+	b.WriteString("Предложи новые баллы для каждого правила (от -50 до 50) так, чтобы оценка лучше отделяла будущих покупателей. " +
+		"Правила, которые сами смотрят на выигранные сделки, оценивай по смыслу, а не по статистике. " +
+		`Ответь только JSON-массивом вида [{"rule_id": "...", "points": 10, "reason": "кратко по-русски"}].`)
+
+	answer, err := scoringAI.Ask(ctx, b.String())
+	if err != nil {
+		return nil, err
+	}
+	// Модель иногда оборачивает JSON в текст или markdown – берём сам массив
+	start, end := strings.Index(answer, "["), strings.LastIndex(answer, "]")
+	if start < 0 || end < start {
+		return nil, fmt.Errorf("no JSON array in answer: %.200s", answer)
+	}
+	var suggestions []scoringAISuggestion
+	if err := json.Unmarshal([]byte(answer[start:end+1]), &suggestions); err != nil {
+		return nil, err
+	}
+	known := make(map[string]bool, len(stats.Rules))
+	for _, r := range stats.Rules {
+		known[r.RuleID] = true
+	}
+	valid := suggestions[:0]
+	for _, s := range suggestions {
+		if known[s.RuleID] && s.Points >= -models.ScoreMax && s.Points <= models.ScoreMax {
+			valid = append(valid, s)
+		}
+	}
+	return valid, nil
+}
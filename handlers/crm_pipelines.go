@@ -0,0 +1,419 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/database"
+	"subscription-system/models"
+)
+
+// errInvalidStage – этап сделки не принадлежит её воронке
+var errInvalidStage = errors.New("stage does not belong to the pipeline")
+
+// findPipeline возвращает воронку по ID (пустой ID – воронка пользователя по умолчанию),
+// если пользователь имеет к ней доступ
+func findPipeline(ctx context.Context, userID string, isAdmin bool, pipelineID string) (*models.Pipeline, error) {
+	var pipeline *models.Pipeline
+	var err error
+	if pipelineID == "" {
+		pipeline, err = models.GetDefaultPipeline(ctx, userID)
+	} else {
+		pipeline, err = models.GetPipeline(ctx, pipelineID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !pipeline.CanView(userID, isAdmin) {
+		return nil, models.ErrPipelineNotFound
+	}
+	return pipeline, nil
+}
+
+// resolveDealStage находит воронку сделки и проверяет, что этап ей принадлежит.
+// Пустой этап означает первый открытый этап воронки.
+func resolveDealStage(ctx context.Context, userID string, isAdmin bool, pipelineID, stageCode string) (*models.Pipeline, *models.PipelineStage, error) {
+	pipeline, err := findPipeline(ctx, userID, isAdmin, pipelineID)
+	if err != nil {
+		return nil, nil, err
+	}
+	var stage *models.PipelineStage
+	var ok bool
+	if stageCode == "" {
+		stage, ok = pipeline.FirstStage()
+	} else {
+		stage, ok = pipeline.Stage(stageCode)
+	}
+	if !ok {
+		return nil, nil, errInvalidStage
+	}
+	return pipeline, stage, nil
+}
+
+// respondPipelineError переводит ошибки воронок в HTTP-ответ
+func respondPipelineError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidPipeline):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrPipelineNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Pipeline not found"})
+	case errors.Is(err, models.ErrStageNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Stage not found"})
+	case errors.Is(err, models.ErrPipelineInUse):
+		c.JSON(http.StatusConflict, gin.H{"error": "Pipeline or stage still has deals; move them first"})
+	case errors.Is(err, errInvalidStage):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Stage does not belong to the deal pipeline"})
+	default:
+		log.Printf("❌ Ошибка работы с воронкой: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// loadPipelineParam загружает воронку из :id и проверяет права (edit – на изменение)
+func loadPipelineParam(c *gin.Context, edit bool) (*models.Pipeline, bool) {
+	userID := getUserIDFromContext(c)
+	pipeline, err := findPipeline(c.Request.Context(), userID, isAdmin(c), c.Param("id"))
+	if err != nil {
+		respondPipelineError(c, err)
+		return nil, false
+	}
+	if edit && !pipeline.CanEdit(userID, isAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return pipeline, true
+}
+
+// pipelineFromQuery – воронка из ?pipeline_id, по умолчанию – воронка пользователя
+func pipelineFromQuery(c *gin.Context) (*models.Pipeline, bool) {
+	pipeline, err := findPipeline(c.Request.Context(), getUserIDFromContext(c), isAdmin(c), c.Query("pipeline_id"))
+	if err != nil {
+		respondPipelineError(c, err)
+		return nil, false
+	}
+	return pipeline, true
+}
+
+// GetPipelines возвращает доступные воронки с этапами
+func GetPipelines(c *gin.Context) {
+	pipelines, err := models.ListPipelines(c.Request.Context(), getUserIDFromContext(c), isAdmin(c))
+	if err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, pipelines)
+}
+
+// GetPipeline возвращает воронку с этапами
+func GetPipeline(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, pipeline)
+}
+
+// CreatePipeline создаёт воронку. Общую (shared) воронку может создать только администратор.
+// Без этапов воронка получает стандартный набор.
+func CreatePipeline(c *gin.Context) {
+	var req struct {
+		Name      string                 `json:"name" binding:"required"`
+		IsDefault bool                   `json:"is_default"`
+		SortOrder int                    `json:"sort_order"`
+		Shared    bool                   `json:"shared"`
+		Stages    []models.PipelineStage `json:"stages"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	if req.Shared && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only administrators can create shared pipelines"})
+		return
+	}
+
+	pipeline := &models.Pipeline{
+		Name:      req.Name,
+		IsDefault: req.IsDefault,
+		SortOrder: req.SortOrder,
+		Stages:    req.Stages,
+	}
+	if !req.Shared {
+		pipeline.UserID = &userID
+	}
+	if len(pipeline.Stages) == 0 {
+		pipeline.Stages = models.DefaultPipelineStages()
+	}
+
+	if err := models.CreatePipeline(c.Request.Context(), pipeline); err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, pipeline)
+}
+
+// UpdatePipeline меняет название, порядок и признак воронки по умолчанию
+func UpdatePipeline(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		Name      *string `json:"name"`
+		IsDefault *bool   `json:"is_default"`
+		SortOrder *int    `json:"sort_order"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Name != nil {
+		pipeline.Name = *req.Name
+	}
+	if req.IsDefault != nil {
+		// общая воронка по умолчанию – запасная для всех, у кого нет своей
+		if pipeline.UserID == nil && pipeline.IsDefault && !*req.IsDefault {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Make another shared pipeline default instead"})
+			return
+		}
+		pipeline.IsDefault = *req.IsDefault
+	}
+	if req.SortOrder != nil {
+		pipeline.SortOrder = *req.SortOrder
+	}
+
+	if err := models.UpdatePipeline(c.Request.Context(), pipeline); err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, pipeline)
+}
+
+// DeletePipeline удаляет воронку без сделок
+func DeletePipeline(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, true)
+	if !ok {
+		return
+	}
+	if pipeline.IsDefault && pipeline.UserID == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The shared default pipeline cannot be deleted"})
+		return
+	}
+	if err := models.DeletePipeline(c.Request.Context(), pipeline.ID); err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// AddPipelineStage добавляет этап в воронку
+func AddPipelineStage(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, true)
+	if !ok {
+		return
+	}
+	var stage models.PipelineStage
+	if err := c.ShouldBindJSON(&stage); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.AddStage(c.Request.Context(), pipeline, &stage); err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, stage)
+}
+
+// UpdatePipelineStage меняет этап (код, название, вероятность, флаги, порог «протухания»)
+func UpdatePipelineStage(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, true)
+	if !ok {
+		return
+	}
+	var stage models.PipelineStage
+	if err := c.ShouldBindJSON(&stage); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	stage.ID = c.Param("stage_id")
+	if err := models.UpdateStage(c.Request.Context(), pipeline, &stage); err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, stage)
+}
+
+// DeletePipelineStage удаляет этап; сделки этапа переносятся на ?move_to=<код этапа>
+func DeletePipelineStage(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, true)
+	if !ok {
+		return
+	}
+	err := models.DeleteStage(c.Request.Context(), pipeline, c.Param("stage_id"), c.Query("move_to"))
+	if err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ReorderPipelineStages задаёт порядок этапов
+func ReorderPipelineStages(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, true)
+	if !ok {
+		return
+	}
+	var req struct {
+		StageIDs []string `json:"stage_ids" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.ReorderStages(c.Request.Context(), pipeline, req.StageIDs); err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
+
+// ========== КАНБАН ==========
+
+// boardDeal – карточка сделки на канбан-доске
+type boardDeal struct {
+	ID             string     `json:"id"`
+	CustomerID     string     `json:"customer_id"`
+	Title          string     `json:"title"`
+	Value          float64    `json:"value"`
+	Probability    int        `json:"probability"`
+	Responsible    string     `json:"responsible"`
+	ExpectedClose  *time.Time `json:"expected_close,omitempty"`
+	StageChangedAt time.Time  `json:"stage_changed_at"`
+	DaysInStage    int        `json:"days_in_stage"`
+	Rotting        bool       `json:"rotting"`
+}
+
+// boardColumn – колонка доски (этап) с итогами по всем сделкам этапа
+type boardColumn struct {
+	Stage         models.PipelineStage `json:"stage"`
+	Count         int                  `json:"count"`
+	TotalValue    float64              `json:"total_value"`
+	WeightedValue float64              `json:"weighted_value"`
+	RottingCount  int                  `json:"rotting_count"`
+	Deals         []boardDeal          `json:"deals"`
+}
+
+// GetPipelineBoard возвращает канбан-доску воронки: этапы по порядку, итоги и карточки.
+// В каждой колонке не больше ?limit (по умолчанию 50) последних сдвинутых сделок.
+func GetPipelineBoard(c *gin.Context) {
+	pipeline, ok := loadPipelineParam(c, false)
+	if !ok {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if err != nil || limit < 1 || limit > 500 {
+		limit = 50
+	}
+	ctx := c.Request.Context()
+
+	columns := make([]*boardColumn, len(pipeline.Stages))
+	byCode := make(map[string]*boardColumn, len(pipeline.Stages))
+	for i, stage := range pipeline.Stages {
+		columns[i] = &boardColumn{Stage: stage, Deals: []boardDeal{}}
+		byCode[stage.Code] = columns[i]
+	}
+
+	args := []interface{}{pipeline.ID}
+	userFilter := " AND d.deleted_at IS NULL"
+	if userID := getUserIDFromContext(c); !isAdmin(c) && userID != "" {
+		userFilter += " AND d.user_id = $2"
+		args = append(args, userID)
+	}
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT d.stage, COUNT(*), COALESCE(SUM(d.value), 0)::float8,
+		       COALESCE(SUM(d.value * d.probability / 100.0), 0)::float8,
+		       COUNT(*) FILTER (WHERE ps.rotting_days IS NOT NULL AND NOT ps.is_won AND NOT ps.is_lost
+		                          AND d.stage_changed_at < NOW() - ps.rotting_days * INTERVAL '1 day')
+		FROM crm_deals d
+		JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+		WHERE d.pipeline_id = $1`+userFilter+`
+		GROUP BY d.stage
+	`, args...)
+	if err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	for rows.Next() {
+		var code string
+		var col boardColumn
+		if err := rows.Scan(&code, &col.Count, &col.TotalValue, &col.WeightedValue, &col.RottingCount); err != nil {
+			rows.Close()
+			respondPipelineError(c, err)
+			return
+		}
+		if target, ok := byCode[code]; ok {
+			target.Count, target.TotalValue, target.WeightedValue, target.RottingCount =
+				col.Count, col.TotalValue, col.WeightedValue, col.RottingCount
+		}
+	}
+	rows.Close()
+
+	rows, err = database.Pool.Query(ctx, `
+		SELECT stage, id, customer_id, title, value, probability, responsible, expected_close, changed_at
+		FROM (
+			SELECT d.*, COALESCE(d.stage_changed_at, d.created_at, NOW()) AS changed_at,
+			       ROW_NUMBER() OVER (PARTITION BY d.stage ORDER BY d.stage_changed_at DESC NULLS LAST) AS rn
+			FROM crm_deals d
+			WHERE d.pipeline_id = $1`+userFilter+`
+		) t
+		WHERE rn <= `+strconv.Itoa(limit)+`
+		ORDER BY changed_at DESC
+	`, args...)
+	if err != nil {
+		respondPipelineError(c, err)
+		return
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	for rows.Next() {
+		var code string
+		var d boardDeal
+		var responsible *string
+		if err := rows.Scan(&code, &d.ID, &d.CustomerID, &d.Title, &d.Value, &d.Probability,
+			&responsible, &d.ExpectedClose, &d.StageChangedAt); err != nil {
+			respondPipelineError(c, err)
+			return
+		}
+		col, ok := byCode[code]
+		if !ok {
+			continue
+		}
+		if responsible != nil {
+			d.Responsible = *responsible
+		}
+		d.DaysInStage = int(now.Sub(d.StageChangedAt).Hours() / 24)
+		if days := col.Stage.RottingDays; days != nil && !col.Stage.IsClosed() {
+			d.Rotting = now.Sub(d.StageChangedAt) > time.Duration(*days)*24*time.Hour
+		}
+		col.Deals = append(col.Deals, d)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"pipeline": pipeline,
+		"columns":  columns,
+	})
+}
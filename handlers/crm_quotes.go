@@ -0,0 +1,282 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/config"
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Коммерческие предложения по сделке (PDF с номером и версиями) и заказы из выигранных
+// сделок. Доступ – как к самой сделке.
+
+var quoteSeller = services.QuoteSeller{Name: "SaaSPro"}
+
+// InitQuotes задаёт продавца для шапки коммерческих предложений
+func InitQuotes(cfg *config.Config) {
+	quoteSeller = services.QuoteSeller{Name: cfg.QuoteSellerName, Details: cfg.QuoteSellerDetails}
+}
+
+// loadQuote загружает версию КП из :id и проверяет доступ к её сделке
+func loadQuote(c *gin.Context) (*models.Quote, bool) {
+	quote, err := models.GetQuote(c.Request.Context(), c.Param("id"))
+	if err == nil {
+		if _, err = checkDealAccess(c.Request.Context(), quote.DealID, getUserIDFromContext(c), isAdmin(c)); errors.Is(err, errDealNotFound) {
+			err = models.ErrQuoteNotFound
+		}
+	}
+	if err != nil {
+		respondCatalogError(c, err)
+		return nil, false
+	}
+	return quote, true
+}
+
+// GetDealQuotes возвращает все версии КП сделки, новые сверху
+func GetDealQuotes(c *gin.Context) {
+	if _, ok := loadDealParam(c); !ok {
+		return
+	}
+	quotes, err := models.ListDealQuotes(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": quotes})
+}
+
+// CreateDealQuote выпускает КП по текущим позициям сделки. С revise_of (ID версии) –
+// новая версия того же предложения, иначе предложение с новым номером.
+// valid_until – дата «2006-01-02», по умолчанию через 14 дней.
+func CreateDealQuote(c *gin.Context) {
+	ownerID, ok := loadDealParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		ReviseOf   string `json:"revise_of"`
+		ValidUntil string `json:"valid_until"`
+		Notes      string `json:"notes"`
+	}
+	// Тело необязательно: без него выпускается новое КП со сроком по умолчанию
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	userID := getUserIDFromContext(c)
+	quote := &models.Quote{DealID: c.Param("id"), UserID: &userID, Notes: req.Notes}
+	if req.ValidUntil != "" {
+		validUntil, err := time.Parse("2006-01-02", req.ValidUntil)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "valid_until must be a date like 2006-01-02"})
+			return
+		}
+		quote.ValidUntil = &validUntil
+	}
+	if err := models.CreateQuote(c.Request.Context(), quote, req.ReviseOf); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+
+	go addHistory(context.Background(), "deal", quote.DealID, "quote", &userID, map[string]interface{}{
+		"quote_id": quote.ID, "number": quote.Number, "version": quote.Version, "total": quote.Totals.Total,
+	})
+	publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventQuoteCreated, EntityType: "deal", EntityID: quote.DealID, OwnerID: ownerID,
+		Payload: gin.H{"quote_id": quote.ID, "number": quote.Number, "version": quote.Version, "total": quote.Totals.Total, "currency": quote.Totals.Currency}})
+	log.Printf("📄 КП %s (версия %d) по сделке %s на %.2f %s", quote.Number, quote.Version, quote.DealID, quote.Totals.Total, quote.Totals.Currency)
+
+	c.JSON(http.StatusCreated, quote)
+}
+
+// GetQuote возвращает версию КП
+func GetQuote(c *gin.Context) {
+	quote, ok := loadQuote(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, quote)
+}
+
+// GetQuotePDF отдаёт PDF версии КП; ?download=1 – вложением, иначе для просмотра в браузере
+func GetQuotePDF(c *gin.Context) {
+	quote, ok := loadQuote(c)
+	if !ok {
+		return
+	}
+	data, err := services.RenderQuotePDF(quote, quoteSeller)
+	if err != nil {
+		log.Printf("❌ Ошибка формирования PDF для КП %s: %v", quote.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render PDF"})
+		return
+	}
+	disposition := "inline"
+	if c.Query("download") != "" {
+		disposition = "attachment"
+	}
+	c.Header("Content-Disposition", disposition+`; filename="quote.pdf"; filename*=UTF-8''`+url.PathEscape(quote.FileName()))
+	c.Data(http.StatusOK, "application/pdf", data)
+}
+
+// UpdateQuoteStatus отмечает КП отправленным, принятым или отклонённым.
+// Принятое КП определяет состав заказа при оформлении сделки.
+func UpdateQuoteStatus(c *gin.Context) {
+	quote, ok := loadQuote(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Status string `json:"status" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := models.SetQuoteStatus(c.Request.Context(), quote.ID, req.Status); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	userID := getUserIDFromContext(c)
+	go addHistory(context.Background(), "deal", quote.DealID, "quote_status", &userID, map[string]interface{}{
+		"number": quote.Number, "version": quote.Version, "status": map[string]string{"old": quote.Status, "new": req.Status},
+	})
+	quote.Status = req.Status
+	c.JSON(http.StatusOK, quote)
+}
+
+// CreateDealOrder превращает выигранную сделку в заказ CRM (crm_orders). Тело – доставка:
+// delivery_type (pickup|courier|post), delivery_address, estimated_delivery (RFC 3339).
+// Повторный вызов возвращает уже созданный заказ со статусом 409.
+func CreateDealOrder(c *gin.Context) {
+	ownerID, ok := loadDealParam(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		DeliveryType      string              `json:"delivery_type"`
+		DeliveryAddress   models.OrderAddress `json:"delivery_address"`
+		EstimatedDelivery *time.Time          `json:"estimated_delivery"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil && !errors.Is(err, io.EOF) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	dealID := c.Param("id")
+	order := &models.Order{
+		DeliveryType:      req.DeliveryType,
+		DeliveryAddress:   req.DeliveryAddress,
+		EstimatedDelivery: req.EstimatedDelivery,
+	}
+	err := models.CreateOrderFromDeal(c.Request.Context(), dealID, order)
+	if errors.Is(err, models.ErrOrderExists) {
+		existing, getErr := models.GetDealOrder(c.Request.Context(), dealID)
+		if getErr != nil {
+			respondCatalogError(c, getErr)
+			return
+		}
+		c.JSON(http.StatusConflict, gin.H{"error": "Deal already has an order", "order": existing})
+		return
+	}
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+
+	userID := getUserIDFromContext(c)
+	go addHistory(context.Background(), "deal", dealID, "order", &userID, map[string]interface{}{
+		"order_id": order.ID, "total_amount": order.TotalAmount,
+	})
+	publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventOrderCreated, EntityType: "deal", EntityID: dealID, OwnerID: ownerID,
+		Payload: gin.H{"order_id": order.ID, "total_amount": order.TotalAmount, "currency": order.Currency, "delivery_type": order.DeliveryType}})
+	log.Printf("📦 Сделка %s оформлена в заказ %s на %.2f %s", dealID, order.ID, order.TotalAmount, order.Currency)
+
+	c.JSON(http.StatusCreated, order)
+}
+
+// loadOrder загружает заказ из :id и проверяет доступ
+func loadOrder(c *gin.Context) (*models.Order, bool) {
+	order, err := models.GetOrder(c.Request.Context(), c.Param("id"))
+	if err == nil && !order.CanAccess(getUserIDFromContext(c), isAdmin(c)) {
+		err = models.ErrOrderNotFound
+	}
+	if err != nil {
+		respondCatalogError(c, err)
+		return nil, false
+	}
+	return order, true
+}
+
+// GetOrders возвращает заказы из сделок: ?status=, постранично
+func GetOrders(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	status := c.Query("status")
+	if status != "" && !models.ValidOrderStatus(status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown order status"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	orders, total, err := models.ListOrders(c.Request.Context(), models.OrderFilter{
+		UserID:  userID,
+		IsAdmin: isAdmin(c),
+		Status:  status,
+		Limit:   pageSize,
+		Offset:  (page - 1) * pageSize,
+	})
+	if err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        orders,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetOrder возвращает заказ
+func GetOrder(c *gin.Context) {
+	order, ok := loadOrder(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
+
+// UpdateOrderStatus меняет статус заказа и трек-номер
+func UpdateOrderStatus(c *gin.Context) {
+	order, ok := loadOrder(c)
+	if !ok {
+		return
+	}
+	var req struct {
+		Status         string  `json:"status" binding:"required"`
+		TrackingNumber *string `json:"tracking_number"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	order.Status = req.Status
+	if req.TrackingNumber != nil {
+		order.TrackingNumber = *req.TrackingNumber
+	}
+	if err := models.UpdateOrderStatus(c.Request.Context(), order); err != nil {
+		respondCatalogError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, order)
+}
@@ -0,0 +1,319 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/gorilla/websocket"
+
+	"subscription-system/config"
+	"subscription-system/database"
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Живые обновления CRM: канбан, списки и дашборды получают события журнала crm_events
+// через SSE (/api/crm/events) или WebSocket (/api/crm/events/ws). Клиент видит только
+// события своих сущностей (администратор – все) и после обрыва продолжает с Last-Event-ID.
+
+const (
+	realtimeHeartbeat   = 25 * time.Second
+	realtimeReplayLimit = 1000
+	realtimeWriteWait   = 10 * time.Second
+)
+
+var (
+	realtimeHub     *services.RealtimeHub
+	realtimeOrigins []string
+)
+
+var realtimeUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+	CheckOrigin:     checkRealtimeOrigin,
+}
+
+// InitRealtime подключает обработчики к хабу событий этого экземпляра
+func InitRealtime(cfg *config.Config, hub *services.RealtimeHub) {
+	realtimeHub = hub
+	realtimeOrigins = cfg.AllowedOrigins
+}
+
+// checkRealtimeOrigin пускает WebSocket со своего хоста и из разрешённых для CORS источников
+func checkRealtimeOrigin(r *http.Request) bool {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return true
+	}
+	u, err := url.Parse(origin)
+	if err == nil && u.Host == r.Host {
+		return true
+	}
+	for _, allowed := range realtimeOrigins {
+		if allowed == "*" || allowed == origin {
+			return true
+		}
+	}
+	return false
+}
+
+// publishCRMEvent записывает событие в журнал после успешного изменения.
+// Ошибка публикации не отменяет изменение, поэтому только логируется.
+func publishCRMEvent(c *gin.Context, e *models.CRMEvent) {
+	if userID := getUserIDFromContext(c); userID != "" && e.ActorID == nil {
+		e.ActorID = &userID
+	}
+	if err := models.PublishCRMEvent(c.Request.Context(), e); err != nil {
+		log.Printf("⚠️ Не удалось опубликовать событие %s %s: %v", e.Type, e.EntityID, err)
+		return
+	}
+	// Те же события уходят во внешние системы через вебхуки; владелец уже определён журналом
+	data := map[string]interface{}{"entity_type": e.EntityType, "entity_id": e.EntityID, "actor_id": e.ActorID}
+	for k, v := range e.Payload {
+		data[k] = v
+	}
+	enqueueWebhook(c, e.OwnerID, e.Type, data)
+	// и в журнал событий продукта – как действие пользователя, который его совершил
+	if e.ActorID != nil {
+		services.TrackProductEvent(*e.ActorID, e.Type, map[string]interface{}{"entity_type": e.EntityType})
+	}
+}
+
+// changedFields – отсортированные имена изменённых полей из карты изменений для истории
+func changedFields(changes map[string]interface{}) []string {
+	fields := make([]string, 0, len(changes))
+	for field := range changes {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// crmEntityOwners возвращает владельцев сущностей до удаления – после него событие не найдёт владельца само
+func crmEntityOwners(ctx context.Context, table string, ids []string) map[string]*string {
+	owners := make(map[string]*string, len(ids))
+	rows, err := database.Pool.Query(ctx, "SELECT id::text, user_id::text FROM "+table+" WHERE id = ANY($1)", ids)
+	if err != nil {
+		log.Printf("⚠️ Не удалось получить владельцев %s: %v", table, err)
+		return owners
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var owner *string
+		if err := rows.Scan(&id, &owner); err == nil {
+			owners[id] = owner
+		}
+	}
+	return owners
+}
+
+// crmEventSink – транспорт живых обновлений (SSE или WebSocket)
+type crmEventSink interface {
+	event(e *models.CRMEvent) error
+	// control – служебное сообщение: ready (с id, от которого продолжать) или resync (перечитать данные)
+	control(name string, id int64, data gin.H) error
+	ping() error
+}
+
+// streamCRMEvents подписывает клиента, досылает пропущенное после lastID и пересылает новые события,
+// пока клиент не отключится. Подписка оформляется до чтения журнала, поэтому на стыке ничего не теряется,
+// а повторы отсекаются по id. Опоздавшие события (меньший id, закоммичены позже) тоже пересылаются,
+// поэтому lastID – наибольший отправленный id, а не признак «всё меньшее уже было».
+func streamCRMEvents(ctx context.Context, c *gin.Context, sink crmEventSink, lastID int64) {
+	userID := getUserIDFromContext(c)
+	admin := isAdmin(c)
+	sub := realtimeHub.Subscribe(userID, admin)
+	defer realtimeHub.Unsubscribe(sub)
+
+	sent := models.NewCRMEventDedup()
+	resync := false
+	if lastID > 0 {
+		events, complete, err := models.CRMEventsForUser(ctx, lastID, userID, admin, realtimeReplayLimit)
+		if err != nil {
+			log.Printf("❌ Ошибка повтора событий CRM для %s: %v", userID, err)
+			return
+		}
+		if !complete {
+			// пропущено больше, чем хранится или стоит повторять, – клиент перечитывает данные целиком
+			lastID, resync = 0, true
+		}
+		for _, e := range events {
+			sent.Add(e.ID)
+			if err := sink.event(e); err != nil {
+				return
+			}
+			lastID = max(lastID, e.ID)
+		}
+	}
+	if lastID == 0 {
+		latest, err := models.LatestCRMEventID(ctx)
+		if err != nil {
+			log.Printf("❌ Ошибка чтения журнала событий CRM: %v", err)
+			return
+		}
+		lastID = latest
+	}
+	if resync {
+		if err := sink.control("resync", lastID, gin.H{}); err != nil {
+			return
+		}
+	}
+	// user_id нужен странице, чтобы не показывать уведомления о собственных действиях
+	if err := sink.control("ready", lastID, gin.H{"user_id": userID, "is_admin": admin}); err != nil {
+		return
+	}
+
+	heartbeat := time.NewTicker(realtimeHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case e := <-sub.Events:
+			// уже отправленное при повторе из журнала
+			if !sent.Add(e.ID) {
+				continue
+			}
+			if err := sink.event(e); err != nil {
+				return
+			}
+			lastID = max(lastID, e.ID)
+		case <-heartbeat.C:
+			if err := sink.ping(); err != nil {
+				return
+			}
+		case <-sub.Done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// parseLastEventID – Last-Event-ID из заголовка (так переподключается EventSource) или параметра
+func parseLastEventID(c *gin.Context) int64 {
+	raw := c.GetHeader("Last-Event-ID")
+	if raw == "" {
+		raw = c.Query("last_event_id")
+	}
+	id, err := strconv.ParseInt(raw, 10, 64)
+	if err != nil || id < 0 {
+		return 0
+	}
+	return id
+}
+
+// sseSink пишет события в формате text/event-stream; id события становится Last-Event-ID браузера
+type sseSink struct {
+	c *gin.Context
+}
+
+func (s sseSink) write(format string, args ...interface{}) error {
+	if _, err := fmt.Fprintf(s.c.Writer, format, args...); err != nil {
+		return err
+	}
+	s.c.Writer.Flush()
+	return nil
+}
+
+func (s sseSink) event(e *models.CRMEvent) error {
+	data, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	return s.write("id: %d\ndata: %s\n\n", e.ID, data)
+}
+
+func (s sseSink) control(name string, id int64, data gin.H) error {
+	data["id"] = id
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+	return s.write("id: %d\nevent: %s\ndata: %s\n\n", id, name, payload)
+}
+
+func (s sseSink) ping() error {
+	return s.write(": ping\n\n")
+}
+
+// StreamCRMEvents – живые обновления CRM через Server-Sent Events
+func StreamCRMEvents(c *gin.Context) {
+	if realtimeHub == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Realtime updates are disabled"})
+		return
+	}
+	h := c.Writer.Header()
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("Connection", "keep-alive")
+	h.Set("X-Accel-Buffering", "no")
+	c.Status(http.StatusOK)
+
+	sink := sseSink{c: c}
+	if err := sink.write("retry: 3000\n\n"); err != nil {
+		return
+	}
+	streamCRMEvents(c.Request.Context(), c, sink, parseLastEventID(c))
+}
+
+// wsSink пишет события JSON-сообщениями; служебные сообщения – {"type":"ready"|"resync","id":N,...}
+type wsSink struct {
+	conn *websocket.Conn
+}
+
+func (s wsSink) event(e *models.CRMEvent) error {
+	s.conn.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+	return s.conn.WriteJSON(e)
+}
+
+func (s wsSink) control(name string, id int64, data gin.H) error {
+	data["type"], data["id"] = name, id
+	s.conn.SetWriteDeadline(time.Now().Add(realtimeWriteWait))
+	return s.conn.WriteJSON(data)
+}
+
+func (s wsSink) ping() error {
+	return s.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(realtimeWriteWait))
+}
+
+// StreamCRMEventsWS – живые обновления CRM через WebSocket (?last_event_id=N для повтора пропущенного)
+func StreamCRMEventsWS(c *gin.Context) {
+	if realtimeHub == nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Realtime updates are disabled"})
+		return
+	}
+	lastID := parseLastEventID(c)
+	conn, err := realtimeUpgrader.Upgrade(c.Writer, c.Request, nil)
+	if err != nil {
+		// Upgrade сам ответил клиенту ошибкой
+		return
+	}
+	defer conn.Close()
+
+	// Клиент ничего не присылает; чтение нужно, чтобы обрабатывать pong/close и заметить обрыв
+	ctx, cancel := context.WithCancel(c.Request.Context())
+	defer cancel()
+	conn.SetReadLimit(512)
+	conn.SetReadDeadline(time.Now().Add(2 * realtimeHeartbeat))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * realtimeHeartbeat))
+	})
+	go func() {
+		defer cancel()
+		for {
+			if _, _, err := conn.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+
+	streamCRMEvents(ctx, c, wsSink{conn: conn}, lastID)
+}
@@ -0,0 +1,359 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+	"subscription-system/models"
+)
+
+// Задачи CRM. Доступ: автор, исполнитель и администратор. Задачи по сделке
+// двигают её next_action_date на срок ближайшей открытой задачи.
+
+// respondTaskError переводит ошибки задач в HTTP-ответ
+func respondTaskError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidTask):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrTaskNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Task not found"})
+	default:
+		log.Printf("❌ Ошибка работы с задачами CRM: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// parseTaskTime принимает RFC 3339 или локальное время «2006-01-02T15:04» (часовой пояс сервера)
+func parseTaskTime(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	for _, layout := range []string{"2006-01-02T15:04", "2006-01-02 15:04", "2006-01-02T15:04:05"} {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.New("invalid time " + s + ", expected RFC 3339")
+}
+
+// taskRequest – тело создания и изменения задачи; отсутствующие поля при изменении не трогаются
+type taskRequest struct {
+	Title           *string `json:"title"`
+	Description     *string `json:"description"`
+	DueAt           *string `json:"due_at"`
+	DurationMinutes *int    `json:"duration_minutes"`
+	Priority        *string `json:"priority"`
+	AssigneeID      *string `json:"assignee_id"`
+	CustomerID      *string `json:"customer_id"`
+	DealID          *string `json:"deal_id"`
+	Recurrence      *string `json:"recurrence"`
+	RecurrenceUntil *string `json:"recurrence_until"`
+	ReminderOffsets *[]int  `json:"reminder_offsets"`
+}
+
+// apply переносит поля запроса в задачу
+func (r *taskRequest) apply(t *models.Task) error {
+	if r.Title != nil {
+		t.Title = *r.Title
+	}
+	if r.Description != nil {
+		t.Description = *r.Description
+	}
+	if r.DueAt != nil {
+		due, err := parseTaskTime(*r.DueAt)
+		if err != nil {
+			return err
+		}
+		t.DueAt = due
+	}
+	if r.DurationMinutes != nil {
+		t.DurationMinutes = *r.DurationMinutes
+	}
+	if r.Priority != nil {
+		t.Priority = *r.Priority
+	}
+	if r.AssigneeID != nil {
+		t.AssigneeID = r.AssigneeID
+	}
+	if r.CustomerID != nil {
+		t.CustomerID = r.CustomerID
+	}
+	if r.DealID != nil {
+		t.DealID = r.DealID
+	}
+	if r.Recurrence != nil {
+		t.Recurrence = *r.Recurrence
+	}
+	if r.RecurrenceUntil != nil {
+		if *r.RecurrenceUntil == "" {
+			t.RecurrenceUntil = nil
+		} else {
+			until, err := time.Parse("2006-01-02", *r.RecurrenceUntil)
+			if err != nil {
+				return errors.New("recurrence_until must be YYYY-MM-DD")
+			}
+			t.RecurrenceUntil = &until
+		}
+	}
+	if r.ReminderOffsets != nil {
+		t.ReminderOffsets = *r.ReminderOffsets
+	}
+	return nil
+}
+
+// checkTaskLinks проверяет исполнителя, клиента и сделку задачи. Клиент сделки подставляется,
+// если он не указан; чужие клиенты и сделки недоступны (кроме администратора).
+func checkTaskLinks(ctx context.Context, t *models.Task, userID string, admin bool) error {
+	if t.AssigneeID != nil && *t.AssigneeID != "" {
+		var exists bool
+		if err := database.Pool.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM users WHERE id::text = $1)`, *t.AssigneeID).Scan(&exists); err != nil {
+			return err
+		}
+		if !exists {
+			return fmt.Errorf("%w: assignee not found", models.ErrInvalidTask)
+		}
+	}
+	if t.DealID != nil && *t.DealID != "" {
+		var customerID string
+		var ownerID *string
+		err := database.Pool.QueryRow(ctx, `SELECT customer_id, user_id FROM crm_deals WHERE id::text = $1 AND deleted_at IS NULL`, *t.DealID).Scan(&customerID, &ownerID)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && !admin && (ownerID == nil || *ownerID != userID)) {
+			return fmt.Errorf("%w: deal not found", models.ErrInvalidTask)
+		}
+		if err != nil {
+			return err
+		}
+		if t.CustomerID == nil || *t.CustomerID == "" {
+			t.CustomerID = &customerID
+		} else if *t.CustomerID != customerID {
+			return fmt.Errorf("%w: deal belongs to another customer", models.ErrInvalidTask)
+		}
+	}
+	if t.CustomerID != nil && *t.CustomerID != "" {
+		var ownerID *string
+		err := database.Pool.QueryRow(ctx, `SELECT user_id FROM crm_customers WHERE id::text = $1 AND deleted_at IS NULL`, *t.CustomerID).Scan(&ownerID)
+		if errors.Is(err, pgx.ErrNoRows) || (err == nil && !admin && (ownerID == nil || *ownerID != userID)) {
+			return fmt.Errorf("%w: customer not found", models.ErrInvalidTask)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// syncTaskDeal обновляет next_action_date сделок, к которым относилась задача
+func syncTaskDeal(ctx context.Context, dealIDs ...*string) {
+	seen := make(map[string]bool)
+	for _, id := range dealIDs {
+		if id == nil || *id == "" || seen[*id] {
+			continue
+		}
+		seen[*id] = true
+		if err := models.SyncDealNextAction(ctx, *id); err != nil {
+			log.Printf("⚠️ Не удалось обновить next_action_date сделки %s: %v", *id, err)
+		}
+	}
+}
+
+// loadTask загружает задачу из :id и проверяет доступ
+func loadTask(c *gin.Context) (*models.Task, bool) {
+	task, err := models.GetTask(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondTaskError(c, err)
+		return nil, false
+	}
+	if !task.CanAccess(getUserIDFromContext(c), isAdmin(c)) {
+		respondTaskError(c, models.ErrTaskNotFound)
+		return nil, false
+	}
+	return task, true
+}
+
+// GetTasks возвращает задачи: ?status=open|completed|all, ?assignee=<id>|me, ?customer_id=, ?deal_id=,
+// ?from= и ?to= (RFC 3339) по сроку, постранично
+func GetTasks(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	f := models.TaskFilter{
+		UserID:     userID,
+		IsAdmin:    isAdmin(c),
+		AssigneeID: c.Query("assignee"),
+		CustomerID: c.Query("customer_id"),
+		DealID:     c.Query("deal_id"),
+		Status:     c.Query("status"),
+		Limit:      pageSize,
+		Offset:     (page - 1) * pageSize,
+	}
+	if f.AssigneeID == "me" {
+		f.AssigneeID = userID
+	}
+	for param, dst := range map[string]**time.Time{"from": &f.From, "to": &f.To} {
+		if v := c.Query(param); v != "" {
+			t, err := parseTaskTime(v)
+			if err != nil {
+				c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+				return
+			}
+			*dst = &t
+		}
+	}
+
+	tasks, total, err := models.ListTasks(c.Request.Context(), f)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        tasks,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetTask возвращает задачу
+func GetTask(c *gin.Context) {
+	task, ok := loadTask(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, task)
+}
+
+// CreateTask создаёт задачу. Без reminder_offsets берутся смещения из настроек уведомлений исполнителя.
+func CreateTask(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req taskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	task := &models.Task{UserID: &userID}
+	if err := req.apply(task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := task.Normalize(); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	if err := checkTaskLinks(c.Request.Context(), task, userID, isAdmin(c)); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	if req.ReminderOffsets == nil {
+		task.ReminderOffsets = models.UserReminderOffsets(c.Request.Context(), task.Recipient())
+	}
+
+	if err := models.CreateTask(c.Request.Context(), task); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	syncTaskDeal(c.Request.Context(), task.DealID)
+	if task.DealID != nil {
+		go addHistory(context.Background(), "deal", *task.DealID, "task", &userID, map[string]interface{}{
+			"task_id": task.ID, "title": task.Title, "due_at": task.DueAt,
+		})
+	}
+	c.JSON(http.StatusCreated, task)
+}
+
+// UpdateTask меняет поля задачи (частичное обновление)
+func UpdateTask(c *gin.Context) {
+	task, ok := loadTask(c)
+	if !ok {
+		return
+	}
+	var req taskRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	oldDealID := task.DealID
+	if err := req.apply(task); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// при смене сделки клиент берётся из неё, если не указан явно
+	if req.DealID != nil && req.CustomerID == nil {
+		task.CustomerID = nil
+	}
+	if err := task.Normalize(); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	if err := checkTaskLinks(c.Request.Context(), task, getUserIDFromContext(c), isAdmin(c)); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	if err := models.UpdateTask(c.Request.Context(), task); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	syncTaskDeal(c.Request.Context(), oldDealID, task.DealID)
+	c.JSON(http.StatusOK, task)
+}
+
+// CompleteTask отмечает задачу выполненной (?undo=true – снимает отметку).
+// Для повторяющейся задачи в ответе next – следующий экземпляр.
+func CompleteTask(c *gin.Context) {
+	task, ok := loadTask(c)
+	if !ok {
+		return
+	}
+	userID := getUserIDFromContext(c)
+	if c.Query("undo") == "true" {
+		if err := models.ReopenTask(c.Request.Context(), task.ID); err != nil {
+			respondTaskError(c, err)
+			return
+		}
+		syncTaskDeal(c.Request.Context(), task.DealID)
+		c.JSON(http.StatusOK, gin.H{"success": true})
+		return
+	}
+
+	next, err := models.CompleteTask(c.Request.Context(), task, userID)
+	if err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	syncTaskDeal(c.Request.Context(), task.DealID)
+	if task.DealID != nil {
+		go addHistory(context.Background(), "deal", *task.DealID, "task_done", &userID, map[string]interface{}{
+			"task_id": task.ID, "title": task.Title,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "next": next})
+}
+
+// DeleteTask удаляет задачу
+func DeleteTask(c *gin.Context) {
+	task, ok := loadTask(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteTask(c.Request.Context(), task.ID); err != nil {
+		respondTaskError(c, err)
+		return
+	}
+	syncTaskDeal(c.Request.Context(), task.DealID)
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
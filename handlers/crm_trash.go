@@ -0,0 +1,196 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/config"
+	"subscription-system/database"
+	"subscription-system/models"
+)
+
+// Корзина CRM: просмотр удалённого, восстановление (вместе с удалёнными каскадом дочерними строками)
+// и окончательное удаление до истечения срока хранения.
+
+const trashBatchMax = 500
+
+var trashRetention time.Duration
+
+// InitTrash запоминает срок хранения корзины (вызывается из main)
+func InitTrash(cfg *config.Config) {
+	trashRetention = time.Duration(cfg.CRMTrashRetentionDays) * 24 * time.Hour
+}
+
+// respondTrashError переводит ошибки корзины в HTTP-ответ
+func respondTrashError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrTrashItemNotFound), errors.Is(err, models.ErrNotInTrash):
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrTrashRestoreBlocked):
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+	default:
+		log.Printf("❌ Ошибка корзины CRM: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// loadManageableTrashItem загружает запись корзины и проверяет права; при ошибке ответ уже отправлен
+func loadManageableTrashItem(c *gin.Context, id string) (*models.TrashItem, bool) {
+	item, err := models.GetTrashItem(c.Request.Context(), id)
+	if err != nil {
+		respondTrashError(c, err)
+		return nil, false
+	}
+	if !item.CanManage(getUserIDFromContext(c), isAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return item, true
+}
+
+// GetTrash возвращает корзину: администратор видит всё, остальные – своё (?entity_type=customer|deal|...)
+func GetTrash(c *gin.Context) {
+	entityType := c.Query("entity_type")
+	if entityType != "" && !models.IsTrashEntity(entityType) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid entity type"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	filter := models.TrashFilter{EntityType: entityType, Limit: pageSize, Offset: (page - 1) * pageSize}
+	if !isAdmin(c) {
+		filter.OwnerID = getUserIDFromContext(c)
+		if filter.OwnerID == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+			return
+		}
+	}
+	items, total, err := models.ListTrash(c.Request.Context(), filter)
+	if err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	for _, item := range items {
+		item.WithRetention(trashRetention)
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":           items,
+		"total":          total,
+		"page":           page,
+		"page_size":      pageSize,
+		"total_pages":    (total + pageSize - 1) / pageSize,
+		"retention_days": int(trashRetention / (24 * time.Hour)),
+	})
+}
+
+// GetTrashItem возвращает запись корзины с числом удалённых вместе с ней строк
+func GetTrashItem(c *gin.Context) {
+	item, ok := loadManageableTrashItem(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, item.WithRetention(trashRetention))
+}
+
+// RestoreTrashItem восстанавливает запись корзины
+func RestoreTrashItem(c *gin.Context) {
+	item, ok := loadManageableTrashItem(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if err := restoreTrashItem(c, item); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true, "restored": item})
+}
+
+// BatchRestoreTrash восстанавливает несколько записей: {"ids": [...]}. Записи, которые нельзя вернуть,
+// перечисляются в errors, остальные восстанавливаются.
+func BatchRestoreTrash(c *gin.Context) {
+	var req struct {
+		IDs []string `json:"ids"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil || len(req.IDs) == 0 || len(req.IDs) > trashBatchMax {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ids required (up to 500)"})
+		return
+	}
+	userID := getUserIDFromContext(c)
+	admin := isAdmin(c)
+	// Клиенты раньше сделок, сделки раньше вложений и активностей – иначе дети упрутся в родителя в корзине
+	items := make([]*models.TrashItem, 0, len(req.IDs))
+	failed := gin.H{}
+	for _, id := range req.IDs {
+		item, err := models.GetTrashItem(c.Request.Context(), id)
+		if err != nil {
+			failed[id] = err.Error()
+			continue
+		}
+		if !item.CanManage(userID, admin) {
+			failed[id] = "access denied"
+			continue
+		}
+		items = append(items, item)
+	}
+	restored := 0
+	for _, entityType := range []string{models.TrashEntityCustomer, models.TrashEntityDeal, models.TrashEntityTag,
+		models.TrashEntityAttachment, models.TrashEntityActivity} {
+		for _, item := range items {
+			if item.EntityType != entityType {
+				continue
+			}
+			if err := restoreTrashItem(c, item); err != nil {
+				if !errors.Is(err, models.ErrTrashRestoreBlocked) && !errors.Is(err, models.ErrTrashItemNotFound) {
+					log.Printf("❌ Ошибка восстановления записи корзины %s: %v", item.ID, err)
+				}
+				failed[item.ID] = err.Error()
+				continue
+			}
+			restored++
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"success": len(failed) == 0, "restored": restored, "errors": failed})
+}
+
+// restoreTrashItem восстанавливает запись и оповещает об этом как о событии сущности
+func restoreTrashItem(c *gin.Context, item *models.TrashItem) error {
+	if _, err := models.RestoreTrashItem(c.Request.Context(), item.ID); err != nil {
+		return err
+	}
+	userID := getUserIDFromContext(c)
+	ctx := c.Request.Context()
+	switch item.EntityType {
+	case models.TrashEntityCustomer:
+		go addHistory(context.Background(), "customer", item.EntityID, "restore", &userID, nil)
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerRestored, EntityType: "customer", EntityID: item.EntityID,
+			Payload: gin.H{"name": item.Title, "children": item.Children}})
+	case models.TrashEntityDeal:
+		go addHistory(context.Background(), "deal", item.EntityID, "restore", &userID, nil)
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealRestored, EntityType: "deal", EntityID: item.EntityID,
+			Payload: gin.H{"title": item.Title, "children": item.Children}})
+		var customerID string
+		if err := database.Pool.QueryRow(ctx, "SELECT customer_id FROM crm_deals WHERE id = $1", item.EntityID).Scan(&customerID); err == nil {
+			if err := updateLeadScore(ctx, customerID); err != nil {
+				log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", customerID, err)
+			}
+		}
+	}
+	return nil
+}
+
+// PurgeTrashItem удаляет запись корзины окончательно, не дожидаясь срока хранения
+func PurgeTrashItem(c *gin.Context) {
+	item, ok := loadManageableTrashItem(c, c.Param("id"))
+	if !ok {
+		return
+	}
+	if err := models.PurgeTrashItem(c.Request.Context(), item.ID); err != nil {
+		respondTrashError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"success": true})
+}
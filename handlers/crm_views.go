@@ -0,0 +1,392 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+)
+
+// Фильтры и сохранённые представления списков клиентов и сделок. Список принимает
+// ?filter=<JSON-фильтр>, ?view=<ID представления> и прежние параметры (status, search, cf.* и т.д.) –
+// всё объединяется через AND. Те же параметры понимают экспорт, а массовые операции –
+// поля filter и view_id в теле вместо списка ids.
+
+// crmBatchLimit – сколько записей массовая операция может затронуть по фильтру
+const crmBatchLimit = 5000
+
+// respondViewError переводит ошибки фильтров и представлений в HTTP-ответ
+func respondViewError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidFilter), errors.Is(err, models.ErrInvalidSavedView),
+		errors.Is(err, models.ErrInvalidCustomField):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrSavedViewNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Saved view not found"})
+	default:
+		log.Printf("❌ Ошибка фильтрации списка CRM: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// crmLegacyParams – прежние параметры списков и их условия на языке фильтров
+var crmLegacyParams = map[string][]struct{ param, field, op string }{
+	models.FilterEntityCustomer: {
+		{"status", "status", models.FilterOpEq},
+		{"city", "city", models.FilterOpEq},
+		{"created_from", "created_at", models.FilterOpGte},
+		{"created_to", "created_at", models.FilterOpLte},
+		{"tag_id", models.FilterTagField, models.FilterOpEq},
+	},
+	models.FilterEntityDeal: {
+		{"stage", "stage", models.FilterOpEq},
+		{"pipeline_id", "pipeline_id", models.FilterOpEq},
+		{"search", "title", models.FilterOpContains},
+		{"category", "product_category", models.FilterOpEq},
+		{"value_min", "value", models.FilterOpGte},
+		{"value_max", "value", models.FilterOpLte},
+		{"close_from", "expected_close", models.FilterOpGte},
+		{"close_to", "expected_close", models.FilterOpLte},
+		{"tag_id", models.FilterTagField, models.FilterOpEq},
+	},
+}
+
+// legacyCRMFilter переводит прежние параметры запроса (включая cf.*) в фильтр
+func legacyCRMFilter(c *gin.Context, entity string) (*models.CRMFilter, error) {
+	var conds []*models.CRMFilter
+	for _, p := range crmLegacyParams[entity] {
+		if v := c.Query(p.param); v != "" {
+			conds = append(conds, models.FilterCond(p.field, p.op, v))
+		}
+	}
+	if search := c.Query("search"); search != "" && entity == models.FilterEntityCustomer {
+		conds = append(conds, &models.CRMFilter{Or: []*models.CRMFilter{
+			models.FilterCond("name", models.FilterOpContains, search),
+			models.FilterCond("email", models.FilterOpContains, search),
+			models.FilterCond("city", models.FilterOpContains, search),
+		}})
+	}
+	if entity == models.FilterEntityDeal && c.Query("has_next_action") == "true" {
+		conds = append(conds, models.FilterCond("next_action_date", models.FilterOpNotEmpty, nil))
+	}
+
+	// ?cf.<key>=v (для текста – подстрока, для множественного выбора – содержит вариант), ?cf.<key>.min=, .max=
+	var schema map[string]*models.CustomField
+	for name, values := range c.Request.URL.Query() {
+		if !strings.HasPrefix(name, customFieldFilterPrefix) || len(values) == 0 || values[0] == "" {
+			continue
+		}
+		if schema == nil {
+			var err error
+			if schema, err = models.CustomFieldsByKey(c.Request.Context(), entity); err != nil {
+				return nil, err
+			}
+		}
+		key, op := strings.TrimPrefix(name, customFieldFilterPrefix), ""
+		if i := strings.LastIndex(key, "."); i >= 0 {
+			key, op = key[:i], key[i+1:]
+		}
+		field, ok := schema[key]
+		if !ok {
+			return nil, errors.New("unknown custom field filter: " + name)
+		}
+		filterOp := models.FilterOpEq
+		switch {
+		case op == "min":
+			filterOp = models.FilterOpGte
+		case op == "max":
+			filterOp = models.FilterOpLte
+		case op != "":
+			return nil, errors.New("unknown custom field filter: " + name)
+		case field.FieldType == models.CustomFieldText, field.FieldType == models.CustomFieldURL,
+			field.FieldType == models.CustomFieldMultiSelect:
+			filterOp = models.FilterOpContains
+		}
+		conds = append(conds, models.FilterCond(customFieldFilterPrefix+key, filterOp, values[0]))
+	}
+	return models.FilterAnd(conds...), nil
+}
+
+// loadVisibleView загружает представление, доступное пользователю, для сущности entity
+func loadVisibleView(c *gin.Context, id, entity string) (*models.SavedView, error) {
+	view, err := models.GetSavedView(c.Request.Context(), id)
+	if err != nil {
+		return nil, err
+	}
+	if !view.CanView(getUserIDFromContext(c), isAdmin(c)) {
+		return nil, models.ErrSavedViewNotFound
+	}
+	if view.EntityType != entity {
+		return nil, fmt.Errorf("%w: saved view belongs to another entity", models.ErrInvalidFilter)
+	}
+	return view, nil
+}
+
+// crmListQuery собирает отбор списка из запроса: права, прежние параметры, ?filter, ?view, ?sort
+func crmListQuery(c *gin.Context, entity string) (*models.CRMListQuery, error) {
+	q := &models.CRMListQuery{Entity: entity}
+	if !isAdmin(c) {
+		q.OwnerID = getUserIDFromContext(c)
+	}
+	legacy, err := legacyCRMFilter(c, entity)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", models.ErrInvalidFilter, err)
+	}
+	filter, err := models.ParseCRMFilter([]byte(c.Query("filter")))
+	if err != nil {
+		return nil, err
+	}
+	var viewFilter *models.CRMFilter
+	if viewID := c.Query("view"); viewID != "" {
+		view, err := loadVisibleView(c, viewID, entity)
+		if err != nil {
+			return nil, err
+		}
+		viewFilter, q.Sort = view.Filter, view.Sort
+	}
+	q.Filter = models.FilterAnd(viewFilter, filter, legacy)
+	if sortField := c.Query("sort"); sortField != "" {
+		q.Sort = []models.CRMSort{{Field: sortField, Order: c.DefaultQuery("order", "asc")}}
+	}
+	return q, nil
+}
+
+// crmBatchSelection – записи массовой операции: явный список ids или фильтр и/или представление
+type crmBatchSelection struct {
+	IDs    []string          `json:"ids"`
+	Filter *models.CRMFilter `json:"filter"`
+	ViewID string            `json:"view_id"`
+}
+
+// resolve возвращает ID записей; по фильтру – только записи, доступные пользователю
+func (s *crmBatchSelection) resolve(c *gin.Context, entity string) ([]string, error) {
+	if len(s.IDs) > 0 {
+		return s.IDs, nil
+	}
+	// Пустой фильтр без представления означал бы «все записи» – такое нужно запросить явно
+	if s.Filter.IsEmpty() && s.ViewID == "" {
+		return nil, fmt.Errorf("%w: ids, filter or view_id is required", models.ErrInvalidFilter)
+	}
+	q := &models.CRMListQuery{Entity: entity, Filter: s.Filter}
+	if !isAdmin(c) {
+		q.OwnerID = getUserIDFromContext(c)
+	}
+	if s.ViewID != "" {
+		view, err := loadVisibleView(c, s.ViewID, entity)
+		if err != nil {
+			return nil, err
+		}
+		q.Filter = models.FilterAnd(view.Filter, s.Filter)
+	}
+	ids, err := q.MatchingIDs(c.Request.Context(), crmBatchLimit+1)
+	if err != nil {
+		return nil, err
+	}
+	if len(ids) > crmBatchLimit {
+		return nil, fmt.Errorf("%w: filter matches more than %d records", models.ErrInvalidFilter, crmBatchLimit)
+	}
+	return ids, nil
+}
+
+// bindBatchIDs читает тело массового удаления: массив ID (как раньше) или объект crmBatchSelection.
+// Ошибку отвечает сам; пустой список – фильтр ничего не нашёл.
+func bindBatchIDs(c *gin.Context, entity string) ([]string, bool) {
+	var raw json.RawMessage
+	if err := c.ShouldBindJSON(&raw); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return nil, false
+	}
+	var sel crmBatchSelection
+	if err := json.Unmarshal(raw, &sel.IDs); err != nil {
+		sel.IDs = nil
+		if err := json.Unmarshal(raw, &sel); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+			return nil, false
+		}
+	} else if len(sel.IDs) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request"})
+		return nil, false
+	}
+	ids, err := sel.resolve(c, entity)
+	if err != nil {
+		respondViewError(c, err)
+		return nil, false
+	}
+	return ids, true
+}
+
+// GetFilterFields описывает поля и операторы фильтров сущности (?entity=customer|deal)
+func GetFilterFields(c *gin.Context) {
+	entity := c.DefaultQuery("entity", models.FilterEntityCustomer)
+	if !models.IsFilterEntity(entity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entity must be customer or deal"})
+		return
+	}
+	schema, err := models.LoadFilterSchema(c.Request.Context())
+	if err != nil {
+		respondViewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entity": entity, "fields": models.FilterFields(entity, schema)})
+}
+
+// loadSavedView загружает представление из :id и проверяет права (edit – на изменение)
+func loadSavedView(c *gin.Context, edit bool) (*models.SavedView, bool) {
+	userID := getUserIDFromContext(c)
+	view, err := models.GetSavedView(c.Request.Context(), c.Param("id"))
+	if err == nil && !view.CanView(userID, isAdmin(c)) {
+		err = models.ErrSavedViewNotFound
+	}
+	if err != nil {
+		respondViewError(c, err)
+		return nil, false
+	}
+	if edit && !view.CanEdit(userID, isAdmin(c)) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Access denied"})
+		return nil, false
+	}
+	return view, true
+}
+
+// savedViewRequest – тело создания и изменения представления; при изменении отсутствующие поля не трогаются
+type savedViewRequest struct {
+	EntityType string            `json:"entity_type"`
+	Name       *string           `json:"name"`
+	Filter     json.RawMessage   `json:"filter"`
+	Sort       *[]models.CRMSort `json:"sort"`
+	Columns    *[]string         `json:"columns"`
+	SortOrder  *int              `json:"sort_order"`
+	Shared     bool              `json:"shared"`
+}
+
+func (r *savedViewRequest) apply(v *models.SavedView) error {
+	if r.Name != nil {
+		v.Name = *r.Name
+	}
+	if len(r.Filter) > 0 {
+		filter, err := models.ParseCRMFilter(r.Filter)
+		if err != nil {
+			return err
+		}
+		v.Filter = filter
+	}
+	if r.Sort != nil {
+		v.Sort = *r.Sort
+	}
+	if r.Columns != nil {
+		v.Columns = *r.Columns
+	}
+	if r.SortOrder != nil {
+		v.SortOrder = *r.SortOrder
+	}
+	return nil
+}
+
+// GetSavedViews возвращает общие и свои представления сущности (?entity=customer|deal)
+func GetSavedViews(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	entity := c.DefaultQuery("entity", models.FilterEntityCustomer)
+	if !models.IsFilterEntity(entity) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "entity must be customer or deal"})
+		return
+	}
+	views, err := models.ListSavedViews(c.Request.Context(), entity, userID)
+	if err != nil {
+		respondViewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": views})
+}
+
+// GetSavedView возвращает представление
+func GetSavedView(c *gin.Context) {
+	view, ok := loadSavedView(c, false)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// CreateSavedView сохраняет представление. Общее (shared) может создать только администратор.
+func CreateSavedView(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req savedViewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Shared && !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only admins can create shared views"})
+		return
+	}
+	view := &models.SavedView{EntityType: req.EntityType, CreatedBy: &userID}
+	if !req.Shared {
+		view.UserID = &userID
+	}
+	if err := req.apply(view); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	if err := view.Normalize(c.Request.Context()); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	if err := models.CreateSavedView(c.Request.Context(), view); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, view)
+}
+
+// UpdateSavedView меняет представление (частичное обновление); filter: null снимает фильтр
+func UpdateSavedView(c *gin.Context) {
+	view, ok := loadSavedView(c, true)
+	if !ok {
+		return
+	}
+	var req savedViewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := req.apply(view); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	if err := view.Normalize(c.Request.Context()); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	if err := models.UpdateSavedView(c.Request.Context(), view); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, view)
+}
+
+// DeleteSavedView удаляет представление
+func DeleteSavedView(c *gin.Context) {
+	view, ok := loadSavedView(c, true)
+	if !ok {
+		return
+	}
+	if err := models.DeleteSavedView(c.Request.Context(), view.ID); err != nil {
+		respondViewError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Saved view deleted"})
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/config"
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Загрузка и выдача файлов через общее хранилище (services.FileService): вложения сделок,
+// аудио для транскрибации, документы базы знаний.
+
+const (
+	uploadFormOverhead = 1 << 20  // заголовки multipart и текстовые поля сверх лимита файла
+	uploadFieldMaxLen  = 64 << 10 // текстовое поле формы
+	fileURLDefaultTTL  = 15 * time.Minute
+	fileURLMaxTTL      = 24 * time.Hour
+)
+
+var errNoUploadFile = errors.New("no file uploaded")
+
+var (
+	fileService        *services.FileService
+	defaultUploadLimit int64
+)
+
+// InitFiles подключает файловое хранилище (вызывается из main)
+func InitFiles(cfg *config.Config, fs *services.FileService) {
+	fileService = fs
+	defaultUploadLimit = int64(cfg.UploadMaxMB) << 20
+}
+
+// uploadLimit – лимит размера файла по тарифу пользователя (или по умолчанию)
+func uploadLimit(c *gin.Context) int64 {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		return defaultUploadLimit
+	}
+	mb, err := models.GetUserUploadLimitMB(c.Request.Context(), userID)
+	if err != nil {
+		log.Printf("⚠️ Не удалось получить лимит загрузки пользователя %s: %v", userID, err)
+		return defaultUploadLimit
+	}
+	if mb <= 0 {
+		return defaultUploadLimit
+	}
+	return int64(mb) << 20
+}
+
+// receiveUpload читает multipart-форму потоком: файл из поля field сразу уходит в хранилище
+// (без буферизации всей формы), остальные поля возвращаются картой
+func receiveUpload(c *gin.Context, field string, policy *services.UploadPolicy) (*models.FileBlob, string, map[string]string, error) {
+	limit := uploadLimit(c)
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, limit+uploadFormOverhead)
+	mr, err := c.Request.MultipartReader()
+	if err != nil {
+		return nil, "", nil, errNoUploadFile
+	}
+
+	var blob *models.FileBlob
+	var fileName string
+	fields := map[string]string{}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				return nil, "", nil, services.ErrFileTooLarge
+			}
+			return nil, "", nil, err
+		}
+		switch {
+		case part.FileName() == "":
+			var value []byte
+			value, err = io.ReadAll(io.LimitReader(part, uploadFieldMaxLen))
+			fields[part.FormName()] = string(value)
+		case part.FormName() == field && blob == nil: // лишние файлы пропускаем
+			fileName = filepath.Base(strings.ReplaceAll(part.FileName(), "\\", "/"))
+			blob, err = fileService.Ingest(c.Request.Context(), part, fileName, limit, policy)
+		}
+		part.Close()
+		if err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if blob == nil {
+		return nil, "", nil, errNoUploadFile
+	}
+	return blob, fileName, fields, nil
+}
+
+// respondUploadError переводит ошибки загрузки в HTTP-ответ
+func respondUploadError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, services.ErrFileTooLarge):
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrFileTypeNotAllowed):
+		c.JSON(http.StatusUnsupportedMediaType, gin.H{"error": err.Error()})
+	case errors.Is(err, errNoUploadFile), errors.Is(err, services.ErrFileEmpty):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	default:
+		log.Printf("❌ Ошибка загрузки файла: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save file"})
+	}
+}
+
+// serveStoredFile отдаёт объект хранилища; size < 0 – размер неизвестен
+func serveStoredFile(c *gin.Context, key string, size int64, opts services.DownloadOptions) {
+	rc, err := fileService.Open(c.Request.Context(), key)
+	if errors.Is(err, services.ErrStoredFileNotFound) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "File not found"})
+		return
+	}
+	if err != nil {
+		log.Printf("❌ Ошибка чтения файла %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read file"})
+		return
+	}
+	defer rc.Close()
+	contentType := opts.ContentType
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	c.DataFromReader(http.StatusOK, size, contentType, rc, map[string]string{
+		"Content-Disposition":    opts.ContentDisposition(),
+		"X-Content-Type-Options": "nosniff",
+		"Cache-Control":          "private, max-age=300",
+	})
+}
+
+// signedFileURL выдаёт временную ссылку на объект; срок – ?ttl= в секундах (до суток)
+func signedFileURL(c *gin.Context, key string, opts services.DownloadOptions) {
+	ttl := fileURLDefaultTTL
+	if v := c.Query("ttl"); v != "" {
+		sec, err := strconv.Atoi(v)
+		if err != nil || sec <= 0 || time.Duration(sec)*time.Second > fileURLMaxTTL {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "ttl must be between 1 and 86400 seconds"})
+			return
+		}
+		ttl = time.Duration(sec) * time.Second
+	}
+	u, expiresAt, err := fileService.SignedURL(c.Request.Context(), publicBaseURL(c), key, opts, ttl)
+	if err != nil {
+		log.Printf("❌ Ошибка подписи ссылки на файл %s: %v", key, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign url"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"url": u, "expires_at": expiresAt})
+}
+
+// DownloadSignedFile отдаёт файл по временной ссылке (без авторизации – доступ даёт подпись)
+func DownloadSignedFile(c *gin.Context) {
+	t, err := fileService.ParseFileToken(c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+		return
+	}
+	serveStoredFile(c, t.Key, -1, t.Options())
+}
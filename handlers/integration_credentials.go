@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/models"
+)
+
+// AdminListIntegrationCredentialsHandler – список интеграций с сохранёнными учётными данными.
+// Значения не возвращаются, только имена заполненных полей.
+func AdminListIntegrationCredentialsHandler(c *gin.Context) {
+	infos, err := models.ListIntegrationCredentials(c.Request.Context())
+	if err != nil {
+		log.Printf("❌ Ошибка загрузки учётных данных интеграций: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось загрузить интеграции"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"integrations": infos,
+		"providers":    models.IntegrationProviders,
+	})
+}
+
+// AdminSaveIntegrationCredentialsHandler – сохранение учётных данных интеграции.
+// Переданные поля заменяют сохранённые, остальные остаются без изменений.
+func AdminSaveIntegrationCredentialsHandler(c *gin.Context) {
+	provider := c.Param("provider")
+	var req struct {
+		Credentials map[string]string `json:"credentials" binding:"required"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	creds, err := models.GetIntegrationCredentials(c.Request.Context(), provider)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		log.Printf("❌ Ошибка чтения учётных данных %s: %v", provider, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось прочитать учётные данные"})
+		return
+	}
+	if creds == nil {
+		creds = make(map[string]string)
+	}
+	for field, value := range req.Credentials {
+		creds[field] = value
+	}
+
+	if err := models.SaveIntegrationCredentials(c.Request.Context(), provider, creds, getUserIDFromContext(c)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("🔐 Учётные данные интеграции %s обновлены", provider)
+	c.JSON(http.StatusOK, gin.H{"message": "Учётные данные сохранены и будут применены при следующем запуске сервера"})
+}
+
+// AdminDeleteIntegrationCredentialsHandler – удаление учётных данных интеграции
+func AdminDeleteIntegrationCredentialsHandler(c *gin.Context) {
+	provider := c.Param("provider")
+	if err := models.DeleteIntegrationCredentials(c.Request.Context(), provider); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Не удалось удалить учётные данные"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Учётные данные удалены; интеграция вернётся к настройкам окружения при следующем запуске сервера"})
+}
@@ -2,45 +2,38 @@ package handlers
 
 import (
     "context"
-    "io"
     "log"
     "net/http"
-    "strings"
     "subscription-system/database"
+    "subscription-system/services"
     "github.com/gin-gonic/gin"
 )
 
-// UploadKnowledgeHandler загружает документ
+// UploadKnowledgeHandler загружает документ: файл – в общее хранилище, текст – в knowledge_docs для поиска
 func UploadKnowledgeHandler(c *gin.Context) {
-    userID := c.PostForm("user_id")
-    if userID == "" {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "user_id required"})
-        return
-    }
-
-    file, header, err := c.Request.FormFile("file")
+    blob, filename, fields, err := receiveUpload(c, "file", services.UploadPolicyKnowledge)
     if err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "file required"})
+        respondUploadError(c, err)
         return
     }
-    defer file.Close()
 
-    filename := header.Filename
-    if !strings.HasSuffix(strings.ToLower(filename), ".txt") && !strings.HasSuffix(strings.ToLower(filename), ".pdf") {
-        c.JSON(http.StatusBadRequest, gin.H{"error": "only .txt and .pdf files are allowed"})
+    userID := fields["user_id"]
+    if userID == "" {
+        c.JSON(http.StatusBadRequest, gin.H{"error": "user_id required"})
         return
     }
 
-    contentBytes, err := io.ReadAll(file)
+    contentBytes, err := fileService.ReadAll(c.Request.Context(), blob.StorageKey)
     if err != nil {
+        log.Printf("❌ Ошибка чтения документа из хранилища: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to read file"})
         return
     }
     content := string(contentBytes)
 
     _, err = database.Pool.Exec(c.Request.Context(),
-        `INSERT INTO knowledge_docs (user_id, filename, content) VALUES ($1, $2, $3)`,
-        userID, filename, content)
+        `INSERT INTO knowledge_docs (user_id, filename, content, file_hash) VALUES ($1, $2, $3, $4)`,
+        userID, filename, content, blob.SHA256)
     if err != nil {
         log.Printf("Ошибка вставки документа: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
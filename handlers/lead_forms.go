@@ -0,0 +1,599 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+)
+
+// Формы захвата лидов: настройка в /api/crm/lead-forms, публичная часть – /api/public/lead-forms/:key
+// (схема формы, скрипт встраивания и приём заявок с чужих сайтов). Заявки на услуги и AI-консультанта
+// проходят через тот же captureLead.
+
+const (
+	leadRateWindow     = time.Hour
+	leadLegacyBatch    = 500
+	leadDefaultMessage = "Спасибо! Мы свяжемся с вами в ближайшее время."
+)
+
+// respondLeadError переводит ошибки форм и заявок в HTTP-ответ
+func respondLeadError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidLeadForm), errors.Is(err, models.ErrInvalidLead),
+		errors.Is(err, models.ErrInvalidCustomField):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrLeadFormNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lead form not found"})
+	case errors.Is(err, models.ErrPipelineNotFound), errors.Is(err, errInvalidStage):
+		respondPipelineError(c, err)
+	default:
+		log.Printf("❌ Ошибка работы с формами лидов: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// loadLeadForm загружает форму из :id и проверяет права
+func loadLeadForm(c *gin.Context) (*models.LeadForm, bool) {
+	form, err := models.GetLeadForm(c.Request.Context(), c.Param("id"))
+	if err == nil && !form.CanAccess(getUserIDFromContext(c), isAdmin(c)) {
+		err = models.ErrLeadFormNotFound
+	}
+	if err != nil {
+		respondLeadError(c, err)
+		return nil, false
+	}
+	return form, true
+}
+
+// checkLeadFormSettings проверяет то, что требует БД: назначаемых пользователей и воронку сделок.
+// Пользователь без прав администратора может назначать лиды только себе – чужие клиенты ему не видны.
+func checkLeadFormSettings(c *gin.Context, form *models.LeadForm) error {
+	if err := form.Normalize(); err != nil {
+		return err
+	}
+	assignees := form.Assignment.Assignees()
+	if !isAdmin(c) {
+		for _, id := range assignees {
+			if id != form.UserID {
+				return fmt.Errorf("%w: only administrators can assign leads to other users", models.ErrInvalidLeadForm)
+			}
+		}
+	}
+	if err := models.CheckLeadAssignees(c.Request.Context(), assignees); err != nil {
+		return err
+	}
+	if !form.CreateDeal {
+		return nil
+	}
+	pipelineID := ""
+	if form.PipelineID != nil {
+		pipelineID = *form.PipelineID
+	}
+	pipeline, stage, err := resolveDealStage(c.Request.Context(), form.UserID, isAdmin(c), pipelineID, form.Stage)
+	if err != nil {
+		return err
+	}
+	form.PipelineID, form.Stage = &pipeline.ID, stage.Code
+	return nil
+}
+
+// leadFormEmbedCode – HTML для вставки формы на сайт
+func leadFormEmbedCode(c *gin.Context, form *models.LeadForm) string {
+	return fmt.Sprintf(`<div id="lead-form-%[2]s"></div>
+<script src="%[1]s/api/public/lead-forms/%[2]s/embed.js" async></script>`, publicBaseURL(c), form.PublicKey)
+}
+
+// GetLeadForms возвращает формы пользователя (администратору – все)
+func GetLeadForms(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	forms, err := models.ListLeadForms(c.Request.Context(), userID, isAdmin(c))
+	if err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": forms})
+}
+
+// GetLeadForm возвращает форму с кодом для вставки на сайт
+func GetLeadForm(c *gin.Context) {
+	form, ok := loadLeadForm(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"form": form, "embed_code": leadFormEmbedCode(c, form)})
+}
+
+// CreateLeadForm создаёт форму. Владелец формы – рабочее пространство, в которое попадают лиды.
+func CreateLeadForm(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	form := &models.LeadForm{Active: true, RateLimitPerHour: models.LeadDefaultRateLimit}
+	if err := c.ShouldBindJSON(form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	form.UserID = userID
+	if err := checkLeadFormSettings(c, form); err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	if err := models.CreateLeadForm(c.Request.Context(), form); err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	log.Printf("📝 Пользователь %s создал форму лидов «%s»", userID, form.Name)
+	c.JSON(http.StatusCreated, gin.H{"form": form, "embed_code": leadFormEmbedCode(c, form)})
+}
+
+// UpdateLeadForm меняет настройки формы (частичное обновление: не переданные поля не меняются)
+func UpdateLeadForm(c *gin.Context) {
+	form, ok := loadLeadForm(c)
+	if !ok {
+		return
+	}
+	id, owner, key := form.ID, form.UserID, form.PublicKey
+	if err := c.ShouldBindJSON(form); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	form.ID, form.UserID, form.PublicKey = id, owner, key
+	if err := checkLeadFormSettings(c, form); err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	if err := models.UpdateLeadForm(c.Request.Context(), form); err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"form": form, "embed_code": leadFormEmbedCode(c, form)})
+}
+
+// DeleteLeadForm удаляет форму; заявки и созданные клиенты остаются
+func DeleteLeadForm(c *gin.Context) {
+	form, ok := loadLeadForm(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteLeadForm(c.Request.Context(), form.ID); err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Lead form deleted"})
+}
+
+// RotateLeadFormKey выдаёт форме новый публичный ключ (если код формы начали использовать без спроса)
+func RotateLeadFormKey(c *gin.Context) {
+	form, ok := loadLeadForm(c)
+	if !ok {
+		return
+	}
+	key, err := models.RotateLeadFormKey(c.Request.Context(), form.ID)
+	if err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	form.PublicKey = key
+	c.JSON(http.StatusOK, gin.H{"form": form, "embed_code": leadFormEmbedCode(c, form)})
+}
+
+// GetLeadSubmissions – журнал заявок: ?form_id=, ?channel=, ?status=created|matched|spam, постранично
+func GetLeadSubmissions(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	submissions, total, err := models.ListLeadSubmissions(c.Request.Context(), models.LeadSubmissionFilter{
+		FormID:  c.Query("form_id"),
+		Channel: c.Query("channel"),
+		Status:  c.Query("status"),
+		UserID:  userID,
+		IsAdmin: isAdmin(c),
+		Limit:   pageSize,
+		Offset:  (page - 1) * pageSize,
+	})
+	if err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        submissions,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// captureLead проводит заявку через общий поток и публикует события CRM о клиенте и сделке.
+// form == nil – канал без формы: клиент попадает в общий список без ответственного.
+func captureLead(c *gin.Context, form *models.LeadForm, in models.LeadInput) (*models.LeadResult, error) {
+	ctx := c.Request.Context()
+	var pipeline *models.Pipeline
+	var stage *models.PipelineStage
+	if form != nil && form.CreateDeal {
+		pipelineID := ""
+		if form.PipelineID != nil {
+			pipelineID = *form.PipelineID
+		}
+		// Воронку проверили при сохранении формы; этап могли удалить позже – тогда первый открытый
+		var err error
+		pipeline, stage, err = resolveDealStage(ctx, form.UserID, true, pipelineID, form.Stage)
+		if errors.Is(err, errInvalidStage) {
+			pipeline, stage, err = resolveDealStage(ctx, form.UserID, true, pipelineID, "")
+		}
+		if err != nil {
+			log.Printf("⚠️ Форма %s: воронка для сделки недоступна (%v), лид будет без сделки", form.ID, err)
+		}
+	}
+
+	res, err := models.CaptureLead(ctx, form, in, pipeline, stage)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := updateLeadScore(ctx, res.CustomerID); err != nil {
+		log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", res.CustomerID, err)
+	}
+	history := map[string]interface{}{"channel": in.Channel, "submission_id": res.SubmissionID, "source": res.Source}
+	if form != nil {
+		history["form_id"], history["form"] = form.ID, form.Name
+	}
+	go addHistory(context.Background(), "customer", res.CustomerID, "lead", nil, history)
+
+	if res.CustomerCreated {
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerCreated, EntityType: "customer", EntityID: res.CustomerID,
+			Payload: gin.H{"name": res.CustomerName, "status": "lead", "responsible": res.Responsible, "source": res.Source, "channel": in.Channel}})
+		if notifier != nil {
+			notifier.NotifyCustomerCreated(ctx, res.CustomerName, res.Email, res.Phone, res.Company, res.Responsible)
+		}
+	} else {
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventCustomerUpdated, EntityType: "customer", EntityID: res.CustomerID,
+			Payload: gin.H{"name": res.CustomerName, "lead": true, "channel": in.Channel}})
+	}
+	if res.DealID != "" {
+		go addHistory(context.Background(), "deal", res.DealID, "create", nil, history)
+		publishCRMEvent(c, &models.CRMEvent{Type: models.CRMEventDealCreated, EntityType: "deal", EntityID: res.DealID,
+			Payload: gin.H{"title": res.DealTitle, "value": res.DealValue, "pipeline_id": res.PipelineID, "stage": res.Stage, "customer_id": res.CustomerID}})
+		if notifier != nil {
+			notifier.NotifyDealCreated(ctx, res.DealTitle, res.DealValue, res.Stage, res.Responsible, res.CustomerID)
+		}
+	}
+	log.Printf("🧲 Лид (%s) → клиент %s [%s], ответственный: %s", in.Channel, res.CustomerID, res.Status, res.Responsible)
+	return res, nil
+}
+
+// captureChannelLead – заявка внутреннего канала: попадает в форму, подписанную на канал, если такая есть
+func captureChannelLead(c *gin.Context, in models.LeadInput) (*models.LeadResult, error) {
+	form, err := models.LeadFormForChannel(c.Request.Context(), in.Channel)
+	if err != nil {
+		return nil, err
+	}
+	return captureLead(c, form, in)
+}
+
+// CaptureServiceOrder проводит заявку на услуги с сайта (/api/service-order) через общий поток лидов
+func CaptureServiceOrder(c *gin.Context, name, contact, description string) error {
+	in := models.ServiceRequestLead(name, contact, description, "", nil)
+	in.IP, in.UserAgent, in.Referrer = c.ClientIP(), c.Request.UserAgent(), c.Request.Referer()
+	_, err := captureChannelLead(c, in)
+	return err
+}
+
+// ConvertLegacyLeads переносит в общий поток заявки, накопленные в service_requests и individual_consultations
+func ConvertLegacyLeads(c *gin.Context) {
+	inputs, err := models.PendingLegacyLeads(c.Request.Context(), leadLegacyBatch)
+	if err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	converted, failed := 0, []gin.H{}
+	for _, in := range inputs {
+		if _, err := captureChannelLead(c, in); err != nil {
+			if !errors.Is(err, models.ErrInvalidLead) {
+				respondLeadError(c, err)
+				return
+			}
+			// Заявку без контакта не превратить в клиента; отмечаем её в журнале, чтобы
+			// она не возвращалась в каждой следующей пачке
+			if err := models.RecordInvalidLead(c.Request.Context(), in, err); err != nil {
+				respondLeadError(c, err)
+				return
+			}
+			failed = append(failed, gin.H{"channel": in.Channel, "ref": in.ExternalRef, "error": err.Error()})
+			continue
+		}
+		converted++
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"converted": converted,
+		"failed":    failed,
+		// Пачка заполнена – возможно, остались ещё заявки
+		"more": len(inputs) == leadLegacyBatch,
+	})
+}
+
+// ---------- Публичная часть ----------
+
+// leadFormCORS разрешает запрос со страницы, где стоит форма. Глобальный CORS эти маршруты пропускает:
+// список сайтов у каждой формы свой (allowed_origins).
+func leadFormCORS(c *gin.Context, form *models.LeadForm) bool {
+	origin := c.GetHeader("Origin")
+	if origin == "" {
+		return true
+	}
+	if !form.AllowsOrigin(origin) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Origin is not allowed for this form"})
+		return false
+	}
+	h := c.Writer.Header()
+	h.Set("Access-Control-Allow-Origin", origin)
+	h.Add("Vary", "Origin")
+	h.Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
+	h.Set("Access-Control-Allow-Headers", "Content-Type")
+	h.Set("Access-Control-Max-Age", "86400")
+	return true
+}
+
+// loadPublicLeadForm – активная форма по публичному ключу из :key
+func loadPublicLeadForm(c *gin.Context) (*models.LeadForm, bool) {
+	form, err := models.GetLeadFormByKey(c.Request.Context(), c.Param("key"))
+	if err != nil {
+		respondLeadError(c, err)
+		return nil, false
+	}
+	return form, true
+}
+
+// LeadFormPreflight отвечает на CORS-preflight перед отправкой формы
+func LeadFormPreflight(c *gin.Context) {
+	form, ok := loadPublicLeadForm(c)
+	if !ok || !leadFormCORS(c, form) {
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// GetPublicLeadForm – схема формы для отрисовки на сайте (без настроек назначения и воронки)
+func GetPublicLeadForm(c *gin.Context) {
+	form, ok := loadPublicLeadForm(c)
+	if !ok || !leadFormCORS(c, form) {
+		return
+	}
+	message := form.SuccessMessage
+	if message == "" {
+		message = leadDefaultMessage
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"name":            form.Name,
+		"fields":          form.Fields,
+		"honeypot":        models.LeadHoneypotField,
+		"success_message": message,
+		"redirect_url":    form.RedirectURL,
+	})
+}
+
+// readLeadValues читает заявку из JSON или обычной HTML-формы
+func readLeadValues(c *gin.Context) (map[string]string, error) {
+	values := map[string]string{}
+	if strings.HasPrefix(c.ContentType(), "application/json") {
+		var raw map[string]interface{}
+		if err := c.ShouldBindJSON(&raw); err != nil {
+			return nil, err
+		}
+		for k, v := range raw {
+			switch v := v.(type) {
+			case string:
+				values[k] = v
+			case nil:
+			case bool:
+				if v {
+					values[k] = "да"
+				}
+			default:
+				values[k] = fmt.Sprint(v)
+			}
+		}
+		return values, nil
+	}
+	if err := c.Request.ParseForm(); err != nil {
+		return nil, err
+	}
+	for k, v := range c.Request.PostForm {
+		if len(v) > 0 {
+			values[k] = strings.Join(v, ", ")
+		}
+	}
+	return values, nil
+}
+
+// SubmitLeadForm принимает заявку с сайта: проверяет источник, лимит с IP и honeypot,
+// отделяет UTM-метки и проводит заявку через общий поток
+func SubmitLeadForm(c *gin.Context) {
+	form, ok := loadPublicLeadForm(c)
+	if !ok || !leadFormCORS(c, form) {
+		return
+	}
+	values, err := readLeadValues(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid form data"})
+		return
+	}
+
+	ip := c.ClientIP()
+	if form.RateLimitPerHour > 0 {
+		n, err := models.RecentLeadSubmissions(c.Request.Context(), form.ID, ip, leadRateWindow)
+		if err != nil {
+			respondLeadError(c, err)
+			return
+		}
+		if n >= form.RateLimitPerHour {
+			log.Printf("⛔ Форма %s: лимит заявок с %s исчерпан (%d в час)", form.ID, ip, form.RateLimitPerHour)
+			c.Header("Retry-After", fmt.Sprint(int(leadRateWindow.Seconds())))
+			c.JSON(http.StatusTooManyRequests, gin.H{"error": "Слишком много заявок. Попробуйте позже."})
+			return
+		}
+	}
+
+	in := models.LeadInput{
+		Channel:   models.LeadChannelForm,
+		Values:    map[string]string{},
+		UTM:       map[string]string{},
+		IP:        ip,
+		UserAgent: c.Request.UserAgent(),
+		Referrer:  values["_page"],
+	}
+	if in.Referrer == "" {
+		in.Referrer = c.Request.Referer()
+	}
+	for k, v := range values {
+		switch {
+		case containsStringFold(models.LeadUTMParams, k):
+			in.UTM[strings.ToLower(k)] = v
+		case strings.HasPrefix(k, "_"):
+			// служебные поля скрипта встраивания
+		default:
+			in.Values[k] = v
+		}
+	}
+	// Метки из адреса страницы, если сайт не передал их полями
+	for _, p := range models.LeadUTMParams {
+		if in.UTM[p] == "" {
+			if v := c.Query(p); v != "" {
+				in.UTM[p] = v
+			}
+		}
+	}
+
+	message := form.SuccessMessage
+	if message == "" {
+		message = leadDefaultMessage
+	}
+	if values[models.LeadHoneypotField] != "" {
+		// Боту отвечаем как обычно, чтобы он не подбирал обход
+		if err := models.RecordSpamLead(c.Request.Context(), form, in); err != nil {
+			log.Printf("⚠️ Не удалось записать спам-заявку формы %s: %v", form.ID, err)
+		}
+		log.Printf("🚫 Форма %s: заявка с %s отсеяна honeypot", form.ID, ip)
+		respondLeadSubmitted(c, form, message)
+		return
+	}
+
+	if _, err := captureLead(c, form, in); err != nil {
+		respondLeadError(c, err)
+		return
+	}
+	respondLeadSubmitted(c, form, message)
+}
+
+// respondLeadSubmitted – ответ на принятую заявку: JSON для скрипта, редирект для обычной HTML-формы
+func respondLeadSubmitted(c *gin.Context, form *models.LeadForm, message string) {
+	if form.RedirectURL != "" && !strings.HasPrefix(c.ContentType(), "application/json") {
+		c.Redirect(http.StatusSeeOther, form.RedirectURL)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ok", "message": message, "redirect_url": form.RedirectURL})
+}
+
+func containsStringFold(list []string, value string) bool {
+	for _, item := range list {
+		if strings.EqualFold(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// LeadFormEmbedScript отдаёт скрипт, который рисует форму в <div id="lead-form-KEY"> (или перед собой)
+// и отправляет заявку вместе с UTM-метками страницы
+func LeadFormEmbedScript(c *gin.Context) {
+	form, ok := loadPublicLeadForm(c)
+	if !ok {
+		return
+	}
+	endpoint, _ := json.Marshal(publicBaseURL(c) + "/api/public/lead-forms/" + form.PublicKey)
+	key, _ := json.Marshal(form.PublicKey)
+	c.Header("Cache-Control", "public, max-age=300")
+	c.Data(http.StatusOK, "application/javascript; charset=utf-8",
+		[]byte(strings.NewReplacer("__ENDPOINT__", string(endpoint), "__KEY__", string(key)).Replace(leadFormEmbedJS)))
+}
+
+const leadFormEmbedJS = `(function () {
+  var endpoint = __ENDPOINT__, key = __KEY__;
+  var script = document.currentScript;
+  function el(tag, attrs, text) {
+    var e = document.createElement(tag);
+    for (var k in attrs || {}) e.setAttribute(k, attrs[k]);
+    if (text) e.textContent = text;
+    return e;
+  }
+  fetch(endpoint).then(function (r) { return r.json(); }).then(function (schema) {
+    var host = document.getElementById('lead-form-' + key);
+    if (!host) { host = el('div'); script.parentNode.insertBefore(host, script); }
+    var form = el('form', {'class': 'lead-form'});
+    schema.fields.forEach(function (f) {
+      var row = el('div', {'class': 'lead-form-field'}), input;
+      if (f.type !== 'hidden' && f.type !== 'checkbox') row.appendChild(el('label', {'for': 'lf-' + f.name}, f.label + (f.required ? ' *' : '')));
+      if (f.type === 'textarea') {
+        input = el('textarea');
+      } else if (f.type === 'select') {
+        input = el('select');
+        input.appendChild(el('option', {value: ''}, '—'));
+        (f.options || []).forEach(function (o) { input.appendChild(el('option', {value: o}, o)); });
+      } else {
+        input = el('input', {type: f.type});
+        if (f.type === 'checkbox') input.value = 'да';
+      }
+      input.id = 'lf-' + f.name; input.name = f.name;
+      if (f.required) input.required = true;
+      row.appendChild(input);
+      if (f.type === 'checkbox') row.appendChild(el('label', {'for': 'lf-' + f.name}, f.label));
+      form.appendChild(row);
+    });
+    // honeypot: поле вне экрана, люди его не заполняют
+    var hp = el('input', {type: 'text', name: schema.honeypot, tabindex: '-1', autocomplete: 'off', 'aria-hidden': 'true'});
+    hp.style.cssText = 'position:absolute;left:-9999px;width:1px;height:1px;';
+    form.appendChild(hp);
+    var button = el('button', {type: 'submit'}, 'Отправить');
+    var status = el('div', {'class': 'lead-form-status', role: 'status'});
+    form.appendChild(button);
+    form.appendChild(status);
+    form.addEventListener('submit', function (e) {
+      e.preventDefault();
+      var data = {_page: location.href};
+      new FormData(form).forEach(function (v, k) { data[k] = v; });
+      new URLSearchParams(location.search).forEach(function (v, k) { if (/^utm_/.test(k)) data[k] = v; });
+      button.disabled = true;
+      fetch(endpoint + '/submit', {method: 'POST', headers: {'Content-Type': 'application/json'}, body: JSON.stringify(data)})
+        .then(function (r) { return r.json().then(function (body) { return {ok: r.ok, body: body}; }); })
+        .then(function (res) {
+          if (!res.ok) throw new Error(res.body.error || 'Ошибка отправки');
+          if (res.body.redirect_url) { location.href = res.body.redirect_url; return; }
+          form.reset();
+          status.textContent = res.body.message;
+        })
+        .catch(function (err) { status.textContent = err.message; })
+        .then(function () { button.disabled = false; });
+    });
+    host.appendChild(el('h3', {}, schema.name));
+    host.appendChild(form);
+  });
+})();
+`
@@ -19,22 +19,24 @@ func GetNotificationSettings(c *gin.Context) {
 
     var settings models.NotificationSettings
     var events []string
+    var offsets []int32
     err := database.Pool.QueryRow(c.Request.Context(), `
-        SELECT user_id, telegram_enabled, email_enabled, events, created_at, updated_at
+        SELECT user_id, telegram_enabled, email_enabled, events, task_reminder_offsets, created_at, updated_at
         FROM user_notification_settings
         WHERE user_id = $1
     `, userID).Scan(
         &settings.UserID, &settings.TelegramEnabled, &settings.EmailEnabled,
-        &events, &settings.CreatedAt, &settings.UpdatedAt,
+        &events, &offsets, &settings.CreatedAt, &settings.UpdatedAt,
     )
     if err != nil {
         if err == pgx.ErrNoRows {
             // Настроек нет – возвращаем значения по умолчанию
             settings = models.NotificationSettings{
-                UserID:          userID,
-                TelegramEnabled: false,
-                EmailEnabled:    true,
-                Events:          []string{},
+                UserID:              userID,
+                TelegramEnabled:     false,
+                EmailEnabled:        true,
+                Events:              []string{},
+                TaskReminderOffsets: models.DefaultTaskReminderOffsets,
             }
         } else {
             c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
@@ -42,6 +44,10 @@ func GetNotificationSettings(c *gin.Context) {
         }
     } else {
         settings.Events = events
+        settings.TaskReminderOffsets = make([]int, len(offsets))
+        for i, m := range offsets {
+            settings.TaskReminderOffsets[i] = int(m)
+        }
     }
 
     c.JSON(http.StatusOK, settings)
@@ -61,16 +67,24 @@ func UpdateNotificationSettings(c *gin.Context) {
         return
     }
 
-    // Вставляем или обновляем запись
+    for _, m := range req.TaskReminderOffsets {
+        if m < 0 || m > 30*24*60 {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "task_reminder_offsets must be between 0 and 43200 minutes"})
+            return
+        }
+    }
+
+    // Вставляем или обновляем запись; без task_reminder_offsets смещения не меняются
     _, err := database.Pool.Exec(c.Request.Context(), `
-        INSERT INTO user_notification_settings (user_id, telegram_enabled, email_enabled, events, updated_at)
-        VALUES ($1, $2, $3, $4, NOW())
+        INSERT INTO user_notification_settings (user_id, telegram_enabled, email_enabled, events, task_reminder_offsets, updated_at)
+        VALUES ($1, $2, $3, $4, COALESCE($5::int[], '{15}'), NOW())
         ON CONFLICT (user_id) DO UPDATE
         SET telegram_enabled = EXCLUDED.telegram_enabled,
             email_enabled = EXCLUDED.email_enabled,
             events = EXCLUDED.events,
+            task_reminder_offsets = COALESCE($5::int[], user_notification_settings.task_reminder_offsets),
             updated_at = NOW()
-    `, userID, req.TelegramEnabled, req.EmailEnabled, req.Events)
+    `, userID, req.TelegramEnabled, req.EmailEnabled, req.Events, req.TaskReminderOffsets)
 
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "database error"})
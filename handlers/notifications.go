@@ -13,13 +13,15 @@ import (
 
     "subscription-system/config"
     "subscription-system/database"
+    "subscription-system/tracing"
     "subscription-system/utils"
     "github.com/gin-gonic/gin"
 )
 
 var (
-    cfg          = config.Load()
-    emailService = utils.NewEmailService(cfg)
+    cfg            = config.Load()
+    emailService   = utils.NewEmailService(cfg)
+    telegramClient = tracing.NewHTTPClient("telegram", 10*time.Second)
 )
 
 // Notification types
@@ -73,9 +75,9 @@ func GetLocationByIP(ip string) string {
 }
 
 // SendTelegramNotification отправляет уведомление пользователю в Telegram
-func SendTelegramNotification(userID string, message string) error {
+func SendTelegramNotification(ctx context.Context, userID string, message string) error {
     var telegramID int64
-    err := database.Pool.QueryRow(context.Background(),
+    err := database.Pool.QueryRow(ctx,
         "SELECT telegram_id FROM users WHERE id = $1", userID).Scan(&telegramID)
     if err != nil || telegramID == 0 {
         return fmt.Errorf("telegram ID not found for user %s", userID)
@@ -96,7 +98,12 @@ func SendTelegramNotification(userID string, message string) error {
     
     jsonData, _ := json.Marshal(payload)
     
-    resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := telegramClient.Do(req)
     if err != nil {
         return err
     }
@@ -161,8 +168,8 @@ func LogAndNotify(c *gin.Context, userID string, notifType string, details map[s
     // Формируем текст для Telegram
     message := formatNotificationMessage(notifType, details)
     
-    // Отправляем в Telegram
-    go SendTelegramNotification(userID, message)
+    // Отправляем в Telegram: контекст запроса без отмены – ответ может уйти раньше отправки
+    go SendTelegramNotification(context.WithoutCancel(c.Request.Context()), userID, message)
     
     // Отправляем на email
     go SendEmailNotification(userID, notifType, details)
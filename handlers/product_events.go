@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+)
+
+// События продукта: приём от веб-страниц (static/js/track.js) и мини-приложения, а также
+// воронки, пути и сегментация для администратора. Серверные события пишет services.TrackProductEvent.
+
+// productEventsBodyLimit – предел тела пакета событий
+const productEventsBodyLimit = 1 << 20
+
+// respondProductEventError переводит ошибки событий продукта в HTTP-ответ
+func respondProductEventError(c *gin.Context, err error) {
+	if errors.Is(err, models.ErrInvalidProductEvent) || errors.Is(err, models.ErrInvalidProductEventQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("❌ Ошибка событий продукта: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+}
+
+// productEventRequest – событие от клиента; пользователь берётся из токена, а не из тела
+type productEventRequest struct {
+	InsertID   string                 `json:"insert_id"`
+	Event      string                 `json:"event"`
+	SessionID  string                 `json:"session_id"`
+	Source     string                 `json:"source"`
+	Properties map[string]interface{} `json:"properties"`
+	OccurredAt *time.Time             `json:"occurred_at"`
+}
+
+// toEvent проверяет событие клиента; источник server клиенту недоступен
+func (r *productEventRequest) toEvent(c *gin.Context, now time.Time) (*models.ProductEvent, error) {
+	e := &models.ProductEvent{
+		InsertID:   r.InsertID,
+		Event:      r.Event,
+		UserID:     getUserIDFromContext(c),
+		AccountID:  GetAccountID(c),
+		SessionID:  r.SessionID,
+		Source:     r.Source,
+		Properties: r.Properties,
+	}
+	if e.Source == "" {
+		e.Source = models.ProductEventSourceWeb
+	}
+	if e.Source == models.ProductEventSourceServer {
+		return nil, errors.New("source must be web or miniapp")
+	}
+	if r.OccurredAt != nil {
+		e.OccurredAt = *r.OccurredAt
+	}
+	return e, e.Normalize(now)
+}
+
+// TrackProductEvent принимает одно событие
+func TrackProductEvent(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, productEventsBodyLimit)
+	var req productEventRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	e, err := req.toEvent(c, time.Now())
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	accepted, err := models.InsertProductEvents(c.Request.Context(), []*models.ProductEvent{e})
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{"accepted": accepted})
+}
+
+// TrackProductEventsBatch принимает пакет событий ({"events": [...]}). Неверные события
+// отклоняются по одному, остальные записываются; повтор с тем же insert_id не дублируется.
+func TrackProductEventsBatch(c *gin.Context) {
+	c.Request.Body = http.MaxBytesReader(c.Writer, c.Request.Body, productEventsBodyLimit)
+	var req struct {
+		Events []productEventRequest `json:"events"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if len(req.Events) == 0 || len(req.Events) > models.ProductEventMaxBatch {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "batch must contain 1 to " + strconv.Itoa(models.ProductEventMaxBatch) + " events"})
+		return
+	}
+	now := time.Now()
+	events := make([]*models.ProductEvent, 0, len(req.Events))
+	rejected := []gin.H{}
+	for i := range req.Events {
+		e, err := req.Events[i].toEvent(c, now)
+		if err != nil {
+			rejected = append(rejected, gin.H{"index": i, "error": err.Error()})
+			continue
+		}
+		events = append(events, e)
+	}
+	accepted, err := models.InsertProductEvents(c.Request.Context(), events)
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"accepted":   accepted,
+		"duplicates": len(events) - accepted,
+		"rejected":   rejected,
+	})
+}
+
+// productEventRange – период запроса из ?from=&to=; при ошибке ответ уже отправлен
+func productEventRange(c *gin.Context) (time.Time, time.Time, bool) {
+	from, to, err := models.ParseProductEventRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		respondProductEventError(c, err)
+		return time.Time{}, time.Time{}, false
+	}
+	return from, to, true
+}
+
+// GetProductEventNames – события за период с числом срабатываний и пользователей
+func GetProductEventNames(c *gin.Context) {
+	from, to, ok := productEventRange(c)
+	if !ok {
+		return
+	}
+	names, err := models.ListProductEventNames(c.Request.Context(), from, to)
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": names})
+}
+
+// GetProductFunnel – воронка (?steps=signed_up,deal.created&window=7d&from=&to=&plan=)
+func GetProductFunnel(c *gin.Context) {
+	from, to, ok := productEventRange(c)
+	if !ok {
+		return
+	}
+	window, err := models.ParseProductWindow(c.Query("window"), 7*24*time.Hour)
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	var steps []string
+	for _, step := range strings.Split(c.Query("steps"), ",") {
+		if step = strings.TrimSpace(step); step != "" {
+			steps = append(steps, step)
+		}
+	}
+	result, err := models.ProductFunnel(c.Request.Context(), models.FunnelQuery{
+		Steps: steps, Window: window, From: from, To: to, Plan: c.Query("plan"),
+	})
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"steps": result, "window_seconds": int(window.Seconds())})
+}
+
+// GetProductPaths – пути после события (?start=logged_in&depth=5&window=1h&from=&to=)
+func GetProductPaths(c *gin.Context) {
+	from, to, ok := productEventRange(c)
+	if !ok {
+		return
+	}
+	window, err := models.ParseProductWindow(c.Query("window"), time.Hour)
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	depth, err := strconv.Atoi(c.DefaultQuery("depth", "5"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid depth"})
+		return
+	}
+	result, err := models.ProductPaths(c.Request.Context(), models.PathQuery{
+		Start: c.Query("start"), Depth: depth, Window: window, From: from, To: to,
+	})
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// GetProductSegmentation – ряды события (?event=&granularity=day&breakdown=plan|source|property:<ключ>&from=&to=)
+func GetProductSegmentation(c *gin.Context) {
+	from, to, ok := productEventRange(c)
+	if !ok {
+		return
+	}
+	series, err := models.ProductSegmentation(c.Request.Context(), models.SegmentationQuery{
+		Event:       c.Query("event"),
+		From:        from,
+		To:          to,
+		Granularity: c.DefaultQuery("granularity", models.RevenueGranularityDay),
+		Breakdown:   c.Query("breakdown"),
+	})
+	if err != nil {
+		respondProductEventError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": series})
+}
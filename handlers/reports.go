@@ -0,0 +1,412 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"html"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Отчёты по расписанию: подписки на отчёты (воронка, прогноз, MRR, ИИ, агенты), их получатели,
+// отправка вне расписания, предпросмотр и история доставки. Рассылку ведёт ReportService;
+// отписка по ссылке из письма или сообщения не требует входа.
+
+var reportService *services.ReportService
+
+// InitReports подключает сервис рассылки отчётов (вызывается из main)
+func InitReports(s *services.ReportService) {
+	reportService = s
+}
+
+// respondReportError переводит ошибки отчётов в HTTP-ответ
+func respondReportError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidReportSubscription):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrPipelineNotFound):
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Pipeline from filters not found"})
+	case errors.Is(err, models.ErrReportForbidden):
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	case errors.Is(err, services.ErrReportNoRecipients):
+		c.JSON(http.StatusConflict, gin.H{"error": "All recipients have unsubscribed"})
+	case errors.Is(err, models.ErrReportSubscriptionNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report subscription not found"})
+	case errors.Is(err, models.ErrReportRecipientNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Report recipient not found"})
+	default:
+		log.Printf("❌ Ошибка отчётов по расписанию: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// reportSubscriptionRequest – тело создания и изменения подписки; пустые поля не меняются.
+// Получатели задаются только при создании, потом – отдельными запросами.
+type reportSubscriptionRequest struct {
+	Name       *string                  `json:"name"`
+	Report     *string                  `json:"report"`
+	Filters    *models.ReportFilters    `json:"filters"`
+	Cadence    *string                  `json:"cadence"`
+	SendHour   *int                     `json:"send_hour"`
+	SendMinute *int                     `json:"send_minute"`
+	Weekday    *int                     `json:"weekday"`
+	MonthDay   *int                     `json:"month_day"`
+	Timezone   *string                  `json:"timezone"`
+	Formats    *[]string                `json:"formats"`
+	Enabled    *bool                    `json:"enabled"`
+	Recipients []reportRecipientRequest `json:"recipients"`
+}
+
+// reportRecipientRequest – получатель: почта или id чата Telegram (пустой – свой чат с ботом)
+type reportRecipientRequest struct {
+	Channel string `json:"channel"`
+	Address string `json:"address"`
+}
+
+func (r *reportSubscriptionRequest) apply(s *models.ReportSubscription) {
+	if r.Name != nil {
+		s.Name = *r.Name
+	}
+	if r.Report != nil {
+		s.Report = *r.Report
+	}
+	if r.Filters != nil {
+		s.Filters = *r.Filters
+	}
+	if r.Cadence != nil {
+		s.Cadence = *r.Cadence
+	}
+	if r.SendHour != nil {
+		s.SendHour = *r.SendHour
+	}
+	if r.SendMinute != nil {
+		s.SendMinute = *r.SendMinute
+	}
+	if r.Weekday != nil {
+		s.Weekday = *r.Weekday
+	}
+	if r.MonthDay != nil {
+		s.MonthDay = *r.MonthDay
+	}
+	if r.Timezone != nil {
+		s.Timezone = *r.Timezone
+	}
+	if r.Formats != nil {
+		s.Formats = *r.Formats
+	}
+	if r.Enabled != nil {
+		s.Enabled = *r.Enabled
+	}
+}
+
+// validateReportSubscription проверяет подписку с правами её владельца (а не того, кто её меняет)
+func validateReportSubscription(ctx context.Context, s *models.ReportSubscription, ownerIsAdmin bool) error {
+	if err := s.Normalize(ownerIsAdmin); err != nil {
+		return err
+	}
+	if s.Filters.PipelineID != "" {
+		if _, err := findPipeline(ctx, s.UserID, ownerIsAdmin, s.Filters.PipelineID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// loadReportSubscription загружает доступную пользователю подписку; при ошибке ответ уже отправлен
+func loadReportSubscription(c *gin.Context) (*models.ReportSubscription, bool) {
+	s, err := models.GetReportSubscription(c.Request.Context(), c.Param("id"))
+	if err == nil && !s.CanView(getUserIDFromContext(c), isAdmin(c)) {
+		err = models.ErrReportSubscriptionNotFound
+	}
+	if err != nil {
+		respondReportError(c, err)
+		return nil, false
+	}
+	return s, true
+}
+
+// reportOwnerIsAdmin – роль владельца подписки
+func reportOwnerIsAdmin(c *gin.Context, s *models.ReportSubscription) (bool, error) {
+	if s.UserID == getUserIDFromContext(c) {
+		return isAdmin(c), nil
+	}
+	owner, err := models.GetUserByID(s.UserID)
+	if err != nil {
+		return false, err
+	}
+	return owner.Role == "admin", nil
+}
+
+// GetReportTypes – отчёты, на которые можно подписаться, с доступными фильтрами
+func GetReportTypes(c *gin.Context) {
+	types := []models.ReportType{}
+	for _, t := range models.ReportTypes {
+		if !t.AdminOnly || isAdmin(c) {
+			types = append(types, t)
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":     types,
+		"cadences": []string{models.ReportCadenceDaily, models.ReportCadenceWeekly, models.ReportCadenceMonthly},
+		"formats":  []string{models.ReportFormatXLSX, models.ReportFormatPDF},
+		"channels": []string{models.ReportChannelEmail, models.ReportChannelTelegram},
+	})
+}
+
+// GetReportSubscriptions – свои подписки; администратору – все
+func GetReportSubscriptions(c *gin.Context) {
+	page, pageSize := getPaginationParams(c)
+	subs, total, err := models.ListReportSubscriptions(c.Request.Context(), getUserIDFromContext(c), isAdmin(c), pageSize, (page-1)*pageSize)
+	if err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        subs,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetReportSubscription – подписка с получателями
+func GetReportSubscription(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// CreateReportSubscription создаёт подписку (по умолчанию – еженедельно в понедельник в 9:00 UTC);
+// без получателей отчёт приходит на почту владельца
+func CreateReportSubscription(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req reportSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ctx := c.Request.Context()
+	s := &models.ReportSubscription{UserID: userID, Enabled: true, SendHour: 9}
+	req.apply(s)
+	if err := validateReportSubscription(ctx, s, isAdmin(c)); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	if len(req.Recipients) == 0 {
+		owner, err := models.GetUserByID(userID)
+		if err != nil {
+			respondReportError(c, err)
+			return
+		}
+		req.Recipients = []reportRecipientRequest{{Channel: models.ReportChannelEmail, Address: owner.Email}}
+	}
+	recipients := make([]models.ReportRecipient, 0, len(req.Recipients))
+	for _, rr := range req.Recipients {
+		r := models.ReportRecipient{Channel: rr.Channel, Address: rr.Address}
+		if err := r.Normalize(ctx, userID); err != nil {
+			respondReportError(c, err)
+			return
+		}
+		recipients = append(recipients, r)
+	}
+	if err := models.CreateReportSubscription(ctx, s, recipients); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, s)
+}
+
+// UpdateReportSubscription меняет отчёт, фильтры или расписание; следующая отправка пересчитывается
+func UpdateReportSubscription(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	var req reportSubscriptionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ownerIsAdmin, err := reportOwnerIsAdmin(c, s)
+	if err != nil {
+		respondReportError(c, err)
+		return
+	}
+	req.apply(s)
+	if err := validateReportSubscription(c.Request.Context(), s, ownerIsAdmin); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	if err := models.UpdateReportSubscription(c.Request.Context(), s); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, s)
+}
+
+// DeleteReportSubscription удаляет подписку вместе с получателями и историей
+func DeleteReportSubscription(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteReportSubscription(c.Request.Context(), s.ID); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Report subscription deleted"})
+}
+
+// AddReportRecipient добавляет получателя. Отписавшегося получателя этим не вернуть:
+// его нужно удалить и добавить заново.
+func AddReportRecipient(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	var req reportRecipientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	r := &models.ReportRecipient{Channel: req.Channel, Address: req.Address}
+	if err := r.Normalize(c.Request.Context(), s.UserID); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	if err := models.AddReportRecipient(c.Request.Context(), s, r); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusCreated, r)
+}
+
+// DeleteReportRecipient удаляет получателя; история его доставок сохраняется
+func DeleteReportRecipient(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteReportRecipient(c.Request.Context(), s.ID, c.Param("recipient_id")); err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Report recipient deleted"})
+}
+
+// SendReportNow отправляет отчёт за последний закончившийся период вне расписания
+func SendReportNow(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	from, to := s.Period(time.Now())
+	deliveries, err := reportService.Deliver(c.Request.Context(), s, from, to)
+	if err != nil && deliveries == nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": deliveries})
+}
+
+// PreviewReport показывает отчёт за последний закончившийся период (?format=json|html|xlsx|pdf)
+func PreviewReport(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "html" && format != models.ReportFormatXLSX && format != models.ReportFormatPDF {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, html, xlsx or pdf"})
+		return
+	}
+	data, err := reportService.Preview(c.Request.Context(), s)
+	if err != nil {
+		respondReportError(c, err)
+		return
+	}
+	switch format {
+	case "json":
+		c.JSON(http.StatusOK, data)
+	case "html":
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(services.RenderReportHTML(data)))
+	default:
+		name, contentType, body, err := services.RenderReportFile(data, s.Report, format)
+		if err != nil {
+			log.Printf("❌ Ошибка формирования отчёта %s (%s): %v", s.ID, format, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to render report"})
+			return
+		}
+		c.Header("Content-Disposition", "attachment; filename="+name)
+		c.Data(http.StatusOK, contentType, body)
+	}
+}
+
+// GetReportDeliveries – история доставки подписки, новые сначала
+func GetReportDeliveries(c *gin.Context) {
+	s, ok := loadReportSubscription(c)
+	if !ok {
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	list, total, err := models.ListReportDeliveries(c.Request.Context(), s.ID, pageSize, (page-1)*pageSize)
+	if err != nil {
+		respondReportError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        list,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// UnsubscribeReport отписывает получателя по ссылке из письма или сообщения Telegram.
+// GET только показывает форму подтверждения: ссылку открывают и почтовые сканеры, и
+// предпросмотр в мессенджерах. Отписывает POST – из формы или в один клик из почтового клиента.
+func UnsubscribeReport(c *gin.Context) {
+	var r *models.ReportRecipient
+	var name string
+	var err error
+	if c.Request.Method == http.MethodPost {
+		r, name, err = models.UnsubscribeReportRecipient(c.Request.Context(), c.Param("token"))
+	} else {
+		r, name, err = models.GetReportRecipientByToken(c.Request.Context(), c.Param("token"))
+	}
+	status, message, confirm := http.StatusOK, "", false
+	switch {
+	case errors.Is(err, models.ErrReportRecipientNotFound):
+		status, message = http.StatusNotFound, "Ссылка отписки недействительна: возможно, получатель уже удалён из рассылки."
+	case err != nil:
+		log.Printf("❌ Ошибка отписки от отчёта: %v", err)
+		status, message = http.StatusInternalServerError, "Не удалось отписаться, попробуйте позже."
+	case c.Request.Method == http.MethodPost || r.UnsubscribedAt != nil:
+		message = "Адрес " + r.Address + " больше не будет получать отчёт «" + name + "»."
+	default:
+		message = "Отписать адрес " + r.Address + " от отчёта «" + name + "»?"
+		confirm = true
+	}
+	page := `<!DOCTYPE html><html lang="ru"><head><meta charset="utf-8"><title>Отписка от отчёта</title></head>` +
+		`<body style="font-family:Arial,sans-serif;max-width:560px;margin:60px auto;color:#222">` +
+		`<h2>Отписка от отчёта</h2><p>` + html.EscapeString(message) + `</p>`
+	if confirm {
+		page += `<form method="post"><button type="submit" style="padding:8px 16px">Отписаться</button></form>`
+	}
+	page += `</body></html>`
+	c.Data(status, "text/html; charset=utf-8", []byte(page))
+}
@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+// Метрики выручки подписок для страницы revenue-dashboard: MRR/ARR, движения MRR,
+// отток, когорты LTV. Данные считает RevenueMetricsService по завершившимся дням.
+
+var revenueMetrics *services.RevenueMetricsService
+
+// InitRevenueMetrics подключает сервис метрик выручки (вызывается из main)
+func InitRevenueMetrics(s *services.RevenueMetricsService) {
+	revenueMetrics = s
+}
+
+// respondRevenueError переводит ошибки метрик выручки в HTTP-ответ
+func respondRevenueError(c *gin.Context, err error) {
+	if errors.Is(err, models.ErrInvalidRevenueQuery) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	log.Printf("❌ Ошибка метрик выручки: %v", err)
+	c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+}
+
+// GetRevenueSummary – MRR, ARR, ARPU на последний посчитанный день и итоги 30 дней
+func GetRevenueSummary(c *gin.Context) {
+	summary, err := models.GetRevenueSummary(c.Request.Context())
+	if err != nil {
+		respondRevenueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, summary)
+}
+
+// GetRevenueSeries – ряд метрик (?from=&to=YYYY-MM-DD&granularity=day|week|month)
+func GetRevenueSeries(c *gin.Context) {
+	from, to, err := models.ParseRevenueRange(c.Query("from"), c.Query("to"))
+	if err != nil {
+		respondRevenueError(c, err)
+		return
+	}
+	granularity := c.DefaultQuery("granularity", models.RevenueGranularityMonth)
+	series, err := models.RevenueSeries(c.Request.Context(), from, to, granularity)
+	if err != nil {
+		respondRevenueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"from":        from.Format("2006-01-02"),
+		"to":          to.Format("2006-01-02"),
+		"granularity": granularity,
+		"data":        series,
+	})
+}
+
+// GetRevenueMovements – движения MRR (?from=&to=&kind=&user_id=)
+func GetRevenueMovements(c *gin.Context) {
+	filter := models.MRRMovementFilter{Kind: c.Query("kind")}
+	if c.Query("from") != "" || c.Query("to") != "" {
+		from, to, err := models.ParseRevenueRange(c.Query("from"), c.Query("to"))
+		if err != nil {
+			respondRevenueError(c, err)
+			return
+		}
+		filter.From, filter.To = &from, &to
+	}
+	if v := c.Query("user_id"); v != "" {
+		id, err := uuid.Parse(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid user ID"})
+			return
+		}
+		filter.UserID = &id
+	}
+	page, pageSize := getPaginationParams(c)
+	movements, total, err := models.ListMRRMovements(c.Request.Context(), filter, pageSize, (page-1)*pageSize)
+	if err != nil {
+		respondRevenueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        movements,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// GetRevenueCohorts – когорты LTV по месяцу первой оплаты (?months=12)
+func GetRevenueCohorts(c *gin.Context) {
+	months, err := strconv.Atoi(c.DefaultQuery("months", "12"))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid months"})
+		return
+	}
+	cohorts, err := models.GetRevenueCohorts(c.Request.Context(), months)
+	if err != nil {
+		respondRevenueError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": cohorts, "months": months})
+}
+
+// RebuildRevenueMetrics пересчитывает историю метрик выручки по текущему состоянию подписок
+func RebuildRevenueMetrics(c *gin.Context) {
+	days, err := revenueMetrics.Rebuild(c.Request.Context())
+	if err != nil {
+		respondRevenueError(c, err)
+		return
+	}
+	log.Printf("💰 Метрики выручки пересчитаны администратором %s: дней – %d", getUserIDFromContext(c), days)
+	c.JSON(http.StatusOK, gin.H{"days_processed": days})
+}
@@ -2,7 +2,6 @@ package handlers
 
 import (
 	"context"
-	"io"
         "log" 
 	"net/http"
 	"time"
@@ -23,38 +22,23 @@ func UploadAudio(c *gin.Context) {
 		return
 	}
 
-	// Получаем файл из запроса
-	file, err := c.FormFile("audio")
+	// Файл уходит в общее хранилище, обработка читает его оттуда (на любом инстансе)
+	blob, fileName, fields, err := receiveUpload(c, "audio", services.UploadPolicyAudio)
 	if err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "файл не найден"})
+		respondUploadError(c, err)
 		return
 	}
 
 	// Получаем дополнительные параметры
-	customerID := c.PostForm("customer_id")
-	dealID := c.PostForm("deal_id")
-
-	// Открываем файл
-	src, err := file.Open()
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка открытия файла"})
-		return
-	}
-	defer src.Close()
-
-	// Читаем файл в память
-	audioData, err := io.ReadAll(src)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "ошибка чтения файла"})
-		return
-	}
+	customerID := fields["customer_id"]
+	dealID := fields["deal_id"]
 
 	// Создаем запись в БД
 	transcriptionID := uuid.New().String()
 	_, err = database.Pool.Exec(c.Request.Context(), `
-		INSERT INTO audio_transcriptions (id, account_id, customer_id, deal_id, filename, file_size, status, created_at, updated_at)
-		VALUES ($1, $2, $3, $4, $5, $6, 'uploaded', NOW(), NOW())
-	`, transcriptionID, accountID, customerID, dealID, file.Filename, file.Size)
+		INSERT INTO audio_transcriptions (id, account_id, customer_id, deal_id, filename, file_size, file_hash, status, created_at, updated_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, 'uploaded', NOW(), NOW())
+	`, transcriptionID, accountID, customerID, dealID, fileName, blob.Size, blob.SHA256)
 
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
@@ -62,7 +46,7 @@ func UploadAudio(c *gin.Context) {
 	}
 
 	// Запускаем обработку в фоне
-	go processAudio(transcriptionID, audioData, file.Filename)
+	go processAudio(transcriptionID, blob.StorageKey, fileName)
 
 	c.JSON(http.StatusOK, gin.H{
 		"message":          "файл загружен, обработка начата",
@@ -71,9 +55,16 @@ func UploadAudio(c *gin.Context) {
 }
 
 // processAudio - фоновая обработка аудио
-func processAudio(transcriptionID string, audioData []byte, filename string) {
+func processAudio(transcriptionID, storageKey, filename string) {
 	ctx := context.Background()
 
+	audioData, err := fileService.ReadAll(ctx, storageKey)
+	if err != nil {
+		log.Printf("❌ Не удалось прочитать аудио %s из хранилища: %v", transcriptionID, err)
+		database.Pool.Exec(ctx, "UPDATE audio_transcriptions SET status = 'failed' WHERE id = $1", transcriptionID)
+		return
+	}
+
 	// Получаем SpeechKit сервис
 	speechKit := &services.SpeechKitService{
 		// TODO: добавить инициализацию с cfg
@@ -2,6 +2,7 @@ package handlers
 
 import (
     "encoding/base64"
+    "fmt"
     "net/http"
     "time"
 
@@ -10,6 +11,7 @@ import (
     "github.com/skip2/go-qrcode"
 
     "subscription-system/database"
+    "subscription-system/models"
 )
 
 // GenerateTwoFASecret создаёт новый секрет для 2FA
@@ -41,12 +43,7 @@ func GenerateTwoFASecret(c *gin.Context) {
     }
 
     // Сохраняем секрет в БД
-    _, err = database.Pool.Exec(c.Request.Context(), `
-        INSERT INTO twofa (user_id, secret, enabled) 
-        VALUES ($1, $2, false)
-        ON CONFLICT (user_id) 
-        DO UPDATE SET secret = $2, enabled = false, updated_at = NOW()
-    `, userID, key.Secret())
+    err = models.SaveTwoFASecret(c.Request.Context(), fmt.Sprint(userID), key.Secret())
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save secret"})
         return
@@ -81,9 +78,7 @@ func VerifyTwoFACode(c *gin.Context) {
     }
 
     // Получаем секрет из БД
-    var secret string
-    err := database.Pool.QueryRow(c.Request.Context(),
-        "SELECT secret FROM twofa WHERE user_id = $1", req.UserID).Scan(&secret)
+    secret, err := models.GetTwoFASecret(c.Request.Context(), req.UserID, false)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "2FA not set up"})
         return
@@ -128,9 +123,7 @@ func DisableTwoFA(c *gin.Context) {
     }
 
     // Получаем секрет из БД
-    var secret string
-    err := database.Pool.QueryRow(c.Request.Context(),
-        "SELECT secret FROM twofa WHERE user_id = $1", req.UserID).Scan(&secret)
+    secret, err := models.GetTwoFASecret(c.Request.Context(), req.UserID, false)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "2FA not set up"})
         return
@@ -11,6 +11,7 @@ import (
     "github.com/pquerna/otp/totp"
 
     "subscription-system/database"
+    "subscription-system/models"
 )
 
 // Get2FASettings возвращает расширенные настройки 2FA
@@ -113,11 +114,8 @@ func GenerateBackupCodes(c *gin.Context) {
         codes[i] = generateRandomCode(12)
     }
 
-    // Сохраняем в БД
-    _, err := database.Pool.Exec(c.Request.Context(),
-        `UPDATE twofa SET backup_codes = $2 WHERE user_id = $1::uuid`,
-        req.UserID, codes)
-    if err != nil {
+    // В БД сохраняются только хеши: коды показываются пользователю один раз
+    if err := models.SaveTwoFABackupCodes(c.Request.Context(), req.UserID, codes); err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save backup codes"})
         return
     }
@@ -150,39 +148,25 @@ func VerifyWithBackupCode(c *gin.Context) {
         return
     }
 
-    var backupCodes []string
+    var exists bool
     err := database.Pool.QueryRow(c.Request.Context(),
-        `SELECT backup_codes FROM twofa WHERE user_id = $1::uuid`,
-        req.UserID).Scan(&backupCodes)
-    if err != nil {
+        `SELECT EXISTS (SELECT 1 FROM twofa WHERE user_id = $1::uuid)`,
+        req.UserID).Scan(&exists)
+    if err != nil || !exists {
         c.JSON(http.StatusNotFound, gin.H{"error": "2FA not set up"})
         return
     }
 
-    // Ищем код
-    found := -1
-    for i, code := range backupCodes {
-        if code == req.Code {
-            found = i
-            break
-        }
-    }
-
-    if found == -1 {
-        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid backup code"})
-        return
-    }
-
-    // Удаляем использованный код
-    backupCodes = append(backupCodes[:found], backupCodes[found+1:]...)
-    
-    _, err = database.Pool.Exec(c.Request.Context(),
-        `UPDATE twofa SET backup_codes = $2 WHERE user_id = $1::uuid`,
-        req.UserID, backupCodes)
+    // Код проверяется и удаляется одним запросом
+    used, err := models.UseTwoFABackupCode(c.Request.Context(), req.UserID, req.Code)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update backup codes"})
         return
     }
+    if !used {
+        c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid backup code"})
+        return
+    }
 
     c.JSON(http.StatusOK, gin.H{
         "success": true,
@@ -214,10 +198,7 @@ func TrustDevice(c *gin.Context) {
     }
 
     // Проверяем код 2FA
-    var secret string
-    err := database.Pool.QueryRow(c.Request.Context(),
-        "SELECT secret FROM twofa WHERE user_id = $1::uuid AND enabled = true",
-        req.UserID).Scan(&secret)
+    secret, err := models.GetTwoFASecret(c.Request.Context(), req.UserID, true)
     if err != nil {
         c.JSON(http.StatusNotFound, gin.H{"error": "2FA not enabled"})
         return
@@ -176,7 +176,7 @@ func SendVerificationTelegram(c *gin.Context) {
 
     // Отправляем в Telegram
     message := fmt.Sprintf("🔐 Ваш код подтверждения: <b>%s</b>\n\nКод действителен 15 минут.", code)
-    err = SendTelegramNotification(req.UserID, message)
+    err = SendTelegramNotification(c.Request.Context(), req.UserID, message)
     if err != nil {
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to send telegram"})
         return
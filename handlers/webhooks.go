@@ -0,0 +1,292 @@
+package handlers
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"subscription-system/models"
+	"subscription-system/services"
+)
+
+var webhookDispatcher *services.WebhookDispatcher
+
+// InitWebhooks подключает диспетчер для проверочных и повторных отправок
+func InitWebhooks(dispatcher *services.WebhookDispatcher) {
+	webhookDispatcher = dispatcher
+}
+
+// respondWebhookError переводит ошибки вебхуков в HTTP-ответ
+func respondWebhookError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, models.ErrInvalidWebhook):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.Is(err, models.ErrWebhookNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Webhook not found"})
+	case errors.Is(err, models.ErrWebhookDeliveryNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Delivery not found"})
+	default:
+		log.Printf("❌ Ошибка работы с вебхуками: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// enqueueWebhook ставит событие в очередь вебхуков; ошибка не отменяет уже сделанное изменение
+func enqueueWebhook(c *gin.Context, ownerID *string, eventType string, data map[string]interface{}) {
+	if _, err := models.EnqueueWebhookEvent(c.Request.Context(), ownerID, eventType, data); err != nil {
+		log.Printf("⚠️ Не удалось поставить вебхук %s в очередь: %v", eventType, err)
+	}
+}
+
+// loadWebhook загружает адрес из :id и проверяет права
+func loadWebhook(c *gin.Context) (*models.WebhookEndpoint, bool) {
+	endpoint, err := models.GetWebhookEndpoint(c.Request.Context(), c.Param("id"))
+	if err == nil && !endpoint.CanAccess(getUserIDFromContext(c), isAdmin(c)) {
+		err = models.ErrWebhookNotFound
+	}
+	if err != nil {
+		respondWebhookError(c, err)
+		return nil, false
+	}
+	return endpoint, true
+}
+
+// webhookRequest – тело создания и изменения адреса; в изменении пустые поля не трогаются
+type webhookRequest struct {
+	URL         *string  `json:"url"`
+	Description *string  `json:"description"`
+	EventTypes  []string `json:"event_types"`
+	Active      *bool    `json:"active"`
+}
+
+func (r *webhookRequest) apply(e *models.WebhookEndpoint) {
+	if r.URL != nil {
+		e.URL = *r.URL
+	}
+	if r.Description != nil {
+		e.Description = *r.Description
+	}
+	if r.EventTypes != nil {
+		e.EventTypes = r.EventTypes
+	}
+	if r.Active != nil {
+		e.Active = *r.Active
+	}
+}
+
+// GetWebhookEventTypes возвращает события, на которые можно подписаться
+func GetWebhookEventTypes(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"event_types":  models.WebhookEventTypes,
+		"all":          models.WebhookAllEvents,
+		"max_attempts": models.WebhookMaxAttempts,
+	})
+}
+
+// GetWebhooks возвращает адреса пользователя (администратору – все) со сводкой доставок
+func GetWebhooks(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	endpoints, err := models.ListWebhookEndpoints(c.Request.Context(), userID, isAdmin(c))
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"data": endpoints})
+}
+
+// CreateWebhook подписывает адрес на события. Секрет подписи возвращается только в этом ответе.
+func CreateWebhook(c *gin.Context) {
+	userID := getUserIDFromContext(c)
+	if userID == "" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Unauthorized"})
+		return
+	}
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	endpoint := &models.WebhookEndpoint{UserID: userID, Active: true}
+	req.apply(endpoint)
+	if err := endpoint.Normalize(); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	if err := models.CreateWebhookEndpoint(c.Request.Context(), endpoint); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	log.Printf("🪝 Пользователь %s подписал %s на события %v", userID, endpoint.URL, endpoint.EventTypes)
+	c.JSON(http.StatusCreated, endpoint)
+}
+
+// GetWebhook возвращает адрес по ID
+func GetWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, endpoint)
+}
+
+// UpdateWebhook меняет адрес, описание, события или активность (частичное обновление)
+func UpdateWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	var req webhookRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.apply(endpoint)
+	if err := endpoint.Normalize(); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	if err := models.UpdateWebhookEndpoint(c.Request.Context(), endpoint); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, endpoint)
+}
+
+// DeleteWebhook удаляет адрес вместе с журналом доставок
+func DeleteWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	if err := models.DeleteWebhookEndpoint(c.Request.Context(), endpoint.ID); err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"message": "Webhook deleted"})
+}
+
+// RotateWebhookSecret выпускает новый секрет подписи; старый перестаёт действовать сразу
+func RotateWebhookSecret(c *gin.Context) {
+	endpoint, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	secret, err := models.RotateWebhookSecret(c.Request.Context(), endpoint.ID)
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"id": endpoint.ID, "secret": secret})
+}
+
+// PingWebhook отправляет на адрес проверочное событие и возвращает результат попытки.
+// Неудачная проверка повторяется по общему расписанию, как обычная доставка.
+func PingWebhook(c *gin.Context) {
+	endpoint, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	deliveryID, err := models.CreateWebhookPing(c.Request.Context(), endpoint)
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	deliverWebhookNow(c, deliveryID)
+}
+
+// deliverWebhookNow отправляет доставку сразу, не дожидаясь диспетчера, и отвечает её состоянием
+func deliverWebhookNow(c *gin.Context, deliveryID string) {
+	var delivery *models.WebhookDelivery
+	var err error
+	if webhookDispatcher != nil {
+		delivery, err = webhookDispatcher.DeliverNow(c.Request.Context(), deliveryID)
+	} else {
+		delivery, err = models.GetWebhookDelivery(c.Request.Context(), deliveryID)
+	}
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// GetWebhookDeliveries – журнал доставок адреса: ?status=pending|succeeded|failed, ?event_type=, постранично
+func GetWebhookDeliveries(c *gin.Context) {
+	endpoint, ok := loadWebhook(c)
+	if !ok {
+		return
+	}
+	status := c.Query("status")
+	switch status {
+	case "", models.WebhookDeliveryPending, models.WebhookDeliverySucceeded, models.WebhookDeliveryFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be pending, succeeded or failed"})
+		return
+	}
+	page, pageSize := getPaginationParams(c)
+	deliveries, total, err := models.ListWebhookDeliveries(c.Request.Context(), models.WebhookDeliveryFilter{
+		EndpointID: endpoint.ID,
+		Status:     status,
+		EventType:  c.Query("event_type"),
+		Limit:      pageSize,
+		Offset:     (page - 1) * pageSize,
+	})
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"data":        deliveries,
+		"total":       total,
+		"page":        page,
+		"page_size":   pageSize,
+		"total_pages": (total + pageSize - 1) / pageSize,
+	})
+}
+
+// loadWebhookDelivery загружает доставку из :id и проверяет права на её адрес
+func loadWebhookDelivery(c *gin.Context) (*models.WebhookDelivery, bool) {
+	delivery, err := models.GetWebhookDelivery(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		respondWebhookError(c, err)
+		return nil, false
+	}
+	endpoint, err := models.GetWebhookEndpoint(c.Request.Context(), delivery.EndpointID)
+	if err == nil && !endpoint.CanAccess(getUserIDFromContext(c), isAdmin(c)) {
+		err = models.ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		respondWebhookError(c, err)
+		return nil, false
+	}
+	return delivery, true
+}
+
+// GetWebhookDelivery возвращает доставку с телом события и журналом попыток
+func GetWebhookDelivery(c *gin.Context) {
+	delivery, ok := loadWebhookDelivery(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, delivery)
+}
+
+// RedeliverWebhook отправляет событие повторно новой доставкой (тот же event_id – подписчик может отсечь дубль)
+func RedeliverWebhook(c *gin.Context) {
+	delivery, ok := loadWebhookDelivery(c)
+	if !ok {
+		return
+	}
+	newID, err := models.RedeliverWebhook(c.Request.Context(), delivery.ID)
+	if err != nil {
+		respondWebhookError(c, err)
+		return
+	}
+	deliverWebhookNow(c, newID)
+}
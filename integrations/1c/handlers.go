@@ -3,6 +3,7 @@ package onecintegration
 import (
 	"github.com/gin-gonic/gin"
 	"net/http"
+	"time"
 )
 
 // Обработчики для API
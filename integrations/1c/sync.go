@@ -3,6 +3,8 @@ package onecintegration
 import (
 	"log"
 	"time"
+
+	"subscription-system/monitoring"
 )
 
 // Структура для синхронизации
@@ -54,19 +56,32 @@ func (sm *SyncManager) Stop() {
 func (sm *SyncManager) SyncAll() {
 	log.Println("[1C] Starting sync cycle...")
 
+	failed := false
+
 	// 1. Синхронизация пользователей
 	if err := sm.SyncUsers(); err != nil {
 		log.Printf("[1C] Error syncing users: %v", err)
+		monitoring.OneCSyncErrorsTotal.WithLabelValues("users").Inc()
+		failed = true
 	}
 
 	// 2. Синхронизация платежей
 	if err := sm.SyncPayments(); err != nil {
 		log.Printf("[1C] Error syncing payments: %v", err)
+		monitoring.OneCSyncErrorsTotal.WithLabelValues("payments").Inc()
+		failed = true
 	}
 
 	// 3. Синхронизация подписок
 	if err := sm.SyncSubscriptions(); err != nil {
 		log.Printf("[1C] Error syncing subscriptions: %v", err)
+		monitoring.OneCSyncErrorsTotal.WithLabelValues("subscriptions").Inc()
+		failed = true
+	}
+
+	// Лаг синхронизации считаем от последнего цикла без ошибок
+	if !failed {
+		monitoring.MarkOneCSynced()
 	}
 
 	log.Println("[1C] Sync cycle completed")
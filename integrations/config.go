@@ -1,8 +1,15 @@
 package integrations
 
 import (
+	"context"
+	"errors"
+	"log"
 	"os"
 	"strconv"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/models"
 )
 
 // Config для всех интеграций
@@ -26,7 +33,10 @@ type IntegrationConfig struct {
 // Загружаем конфиг из .env или переменных окружения
 func LoadConfig() *IntegrationConfig {
 	onecEnabled, _ := strconv.ParseBool(getEnv("ONEC_ENABLED", "false"))
-	syncInterval, _ := strconv.Atoi(getEnv("ONEC_SYNC_INTERVAL", "60"))
+	syncInterval, err := strconv.Atoi(getEnv("ONEC_SYNC_INTERVAL", "60"))
+	if err != nil || syncInterval <= 0 {
+		syncInterval = 60
+	}
 	bitrixEnabled, _ := strconv.ParseBool(getEnv("BITRIX_ENABLED", "false"))
 
 	return &IntegrationConfig{
@@ -47,6 +57,45 @@ func LoadConfig() *IntegrationConfig {
 	}
 }
 
+// LoadConfigWithStored загружает конфиг из окружения и поверх него –
+// учётные данные, сохранённые в БД (хранятся зашифрованными). Читается при запуске сервера.
+func LoadConfigWithStored(ctx context.Context) *IntegrationConfig {
+	cfg := LoadConfig()
+	for provider := range models.IntegrationProviders {
+		creds, err := models.GetIntegrationCredentials(ctx, provider)
+		if err != nil {
+			if !errors.Is(err, pgx.ErrNoRows) {
+				log.Printf("⚠️ Не удалось загрузить учётные данные интеграции %s: %v", provider, err)
+			}
+			continue
+		}
+		cfg.ApplyCredentials(provider, creds)
+		log.Printf("🔐 Учётные данные интеграции %s загружены из БД", provider)
+	}
+	return cfg
+}
+
+// ApplyCredentials подставляет непустые учётные данные интеграции
+func (c *IntegrationConfig) ApplyCredentials(provider string, creds map[string]string) {
+	set := func(dst *string, field string) {
+		if value := creds[field]; value != "" {
+			*dst = value
+		}
+	}
+	switch provider {
+	case "onec":
+		set(&c.OneCBaseURL, "base_url")
+		set(&c.OneCLogin, "login")
+		set(&c.OneCPassword, "password")
+		set(&c.OneCDatabase, "database")
+	case "bitrix24":
+		set(&c.BitrixWebhookURL, "webhook_url")
+		set(&c.BitrixClientID, "client_id")
+		set(&c.BitrixClientSecret, "client_secret")
+		set(&c.BitrixPortal, "portal")
+	}
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
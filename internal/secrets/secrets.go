@@ -0,0 +1,424 @@
+// Package secrets реализует envelope-шифрование секретов, хранящихся в БД.
+//
+// Мастер-ключи (KEK) задаются в конфигурации и никогда не попадают в БД.
+// Ими шифруются версионированные ключи данных (DEK) из таблицы secret_data_keys,
+// а уже ключами данных — сами значения (AES-256-GCM).
+//
+// Зашифрованное значение имеет вид enc:v1:<версия DEK>:<base64(nonce|ciphertext)>.
+// Значения без префикса считаются старыми незашифрованными данными и
+// возвращаются Decrypt как есть, пока их не перешифрует команда rotate-secrets.
+package secrets
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"subscription-system/database"
+)
+
+const (
+	valuePrefix = "enc:v1:"
+	keySize     = 32
+	// reloadTimeout – сколько ждать БД при загрузке неизвестного ключа данных
+	reloadTimeout = 5 * time.Second
+)
+
+var (
+	// ErrDisabled – мастер-ключ не задан, шифрование выключено
+	ErrDisabled = errors.New("secrets: master key is not configured")
+	// ErrUnknownKey – значение зашифровано ключом данных, которого нет в keyring
+	ErrUnknownKey = errors.New("secrets: unknown data key version")
+)
+
+// Keyring хранит расшифрованные ключи данных в памяти процесса
+type Keyring struct {
+	mu            sync.RWMutex
+	masters       map[int][]byte
+	activeMaster  int
+	dataKeys      map[int][]byte
+	activeDataKey int
+}
+
+var defaultKeyring *Keyring
+
+// ParseMasterKeys разбирает строку вида "1:<base64>,2:<base64>".
+// Возвращает ключи по версиям и максимальную версию.
+func ParseMasterKeys(spec string) (map[int][]byte, int, error) {
+	keys := make(map[int][]byte)
+	latest := 0
+	for _, part := range strings.Split(spec, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		versionStr, encoded, ok := strings.Cut(part, ":")
+		if !ok {
+			return nil, 0, fmt.Errorf("secrets: master key must be in form <version>:<base64>")
+		}
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version <= 0 {
+			return nil, 0, fmt.Errorf("secrets: invalid master key version %q", versionStr)
+		}
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			return nil, 0, fmt.Errorf("secrets: master key v%d is not valid base64", version)
+		}
+		if len(key) != keySize {
+			return nil, 0, fmt.Errorf("secrets: master key v%d must be %d bytes, got %d", version, keySize, len(key))
+		}
+		keys[version] = key
+		if version > latest {
+			latest = version
+		}
+	}
+	return keys, latest, nil
+}
+
+// Init загружает ключи данных из БД и делает keyring доступным пакету.
+// activeMaster = 0 означает «последняя версия мастер-ключа».
+// Пустой spec выключает шифрование: новые значения пишутся открытым текстом.
+func Init(ctx context.Context, spec string, activeMaster int) error {
+	if strings.TrimSpace(spec) == "" {
+		log.Println("⚠️ SECRETS_MASTER_KEYS не задан: секреты в БД хранятся без шифрования")
+		defaultKeyring = nil
+		return nil
+	}
+
+	masters, latest, err := ParseMasterKeys(spec)
+	if err != nil {
+		return err
+	}
+	if activeMaster == 0 {
+		activeMaster = latest
+	}
+	if _, ok := masters[activeMaster]; !ok {
+		return fmt.Errorf("secrets: active master key v%d is not configured", activeMaster)
+	}
+
+	kr := &Keyring{
+		masters:      masters,
+		activeMaster: activeMaster,
+		dataKeys:     make(map[int][]byte),
+	}
+	if err := kr.load(ctx); err != nil {
+		return err
+	}
+	if kr.activeDataKey == 0 {
+		if _, err := kr.rotate(ctx); err != nil {
+			return err
+		}
+	}
+
+	defaultKeyring = kr
+	log.Printf("🔐 Шифрование секретов включено: мастер-ключ v%d, ключ данных v%d", kr.activeMaster, kr.activeDataKey)
+	return nil
+}
+
+// Enabled сообщает, настроено ли шифрование
+func Enabled() bool {
+	return defaultKeyring != nil
+}
+
+// ActiveDataKeyVersion возвращает версию ключа данных для новых значений
+func ActiveDataKeyVersion() int {
+	if defaultKeyring == nil {
+		return 0
+	}
+	defaultKeyring.mu.RLock()
+	defer defaultKeyring.mu.RUnlock()
+	return defaultKeyring.activeDataKey
+}
+
+// load читает и расшифровывает все ключи данных; после Init вызывается только под kr.mu
+func (kr *Keyring) load(ctx context.Context) error {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT version, master_version, wrapped_key, active
+		FROM secret_data_keys ORDER BY version
+	`)
+	if err != nil {
+		return fmt.Errorf("secrets: load data keys: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var version, masterVersion int
+		var wrapped string
+		var active bool
+		if err := rows.Scan(&version, &masterVersion, &wrapped, &active); err != nil {
+			return err
+		}
+		master, ok := kr.masters[masterVersion]
+		if !ok {
+			return fmt.Errorf("secrets: data key v%d is wrapped with master key v%d which is not configured", version, masterVersion)
+		}
+		dek, err := open(master, wrapped)
+		if err != nil {
+			return fmt.Errorf("secrets: unwrap data key v%d: %w", version, err)
+		}
+		kr.dataKeys[version] = dek
+		if active {
+			kr.activeDataKey = version
+		}
+	}
+	return rows.Err()
+}
+
+// rotate создаёт новый ключ данных и делает его активным
+func (kr *Keyring) rotate(ctx context.Context) (int, error) {
+	dek := make([]byte, keySize)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return 0, err
+	}
+	wrapped, err := seal(kr.masters[kr.activeMaster], dek)
+	if err != nil {
+		return 0, err
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `UPDATE secret_data_keys SET active = false WHERE active`); err != nil {
+		return 0, err
+	}
+	var version int
+	err = tx.QueryRow(ctx, `
+		INSERT INTO secret_data_keys (master_version, wrapped_key, active)
+		VALUES ($1, $2, true)
+		RETURNING version
+	`, kr.activeMaster, wrapped).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, err
+	}
+
+	kr.mu.Lock()
+	kr.dataKeys[version] = dek
+	kr.activeDataKey = version
+	kr.mu.Unlock()
+	return version, nil
+}
+
+// RotateDataKey выпускает новый ключ данных; старые остаются для расшифровки
+func RotateDataKey(ctx context.Context) (int, error) {
+	if defaultKeyring == nil {
+		return 0, ErrDisabled
+	}
+	return defaultKeyring.rotate(ctx)
+}
+
+// RewrapDataKeys перешифровывает все ключи данных активным мастер-ключом.
+// После этого старый мастер-ключ можно убрать из конфигурации.
+func RewrapDataKeys(ctx context.Context) (int, error) {
+	kr := defaultKeyring
+	if kr == nil {
+		return 0, ErrDisabled
+	}
+	kr.mu.RLock()
+	master := kr.masters[kr.activeMaster]
+	keys := make(map[int][]byte, len(kr.dataKeys))
+	for version, dek := range kr.dataKeys {
+		keys[version] = dek
+	}
+	kr.mu.RUnlock()
+
+	rewrapped := 0
+	for version, dek := range keys {
+		wrapped, err := seal(master, dek)
+		if err != nil {
+			return rewrapped, err
+		}
+		tag, err := database.Pool.Exec(ctx, `
+			UPDATE secret_data_keys SET master_version = $1, wrapped_key = $2
+			WHERE version = $3 AND master_version <> $1
+		`, kr.activeMaster, wrapped, version)
+		if err != nil {
+			return rewrapped, err
+		}
+		rewrapped += int(tag.RowsAffected())
+	}
+	return rewrapped, nil
+}
+
+// IsEncrypted проверяет, что значение уже зашифровано
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, valuePrefix)
+}
+
+// NeedsReencrypt сообщает, что значение хранится открытым текстом
+// или зашифровано неактивным ключом данных
+func NeedsReencrypt(value string) bool {
+	if defaultKeyring == nil || value == "" {
+		return false
+	}
+	if !IsEncrypted(value) {
+		return true
+	}
+	version, _, err := splitValue(value)
+	return err != nil || version != ActiveDataKeyVersion()
+}
+
+// Encrypt шифрует значение активным ключом данных.
+// При выключенном шифровании возвращает значение без изменений.
+func Encrypt(plaintext []byte) (string, error) {
+	kr := defaultKeyring
+	if kr == nil {
+		return string(plaintext), nil
+	}
+	kr.mu.RLock()
+	version := kr.activeDataKey
+	dek := kr.dataKeys[version]
+	kr.mu.RUnlock()
+
+	sealed, err := seal(dek, plaintext)
+	if err != nil {
+		return "", err
+	}
+	return valuePrefix + strconv.Itoa(version) + ":" + sealed, nil
+}
+
+// Decrypt расшифровывает значение; незашифрованные значения возвращаются как есть
+func Decrypt(value string) ([]byte, error) {
+	if !IsEncrypted(value) {
+		return []byte(value), nil
+	}
+	kr := defaultKeyring
+	if kr == nil {
+		return nil, ErrDisabled
+	}
+	version, sealed, err := splitValue(value)
+	if err != nil {
+		return nil, err
+	}
+	kr.mu.RLock()
+	dek, ok := kr.dataKeys[version]
+	kr.mu.RUnlock()
+	if !ok {
+		if dek, err = kr.reload(version); err != nil {
+			return nil, err
+		}
+	}
+	return open(dek, sealed)
+}
+
+// reload перечитывает ключи данных из БД, когда значение зашифровано неизвестной версией:
+// её мог выпустить другой процесс (rotate-secrets -new-data-key), пока этот работал
+func (kr *Keyring) reload(version int) ([]byte, error) {
+	kr.mu.Lock()
+	defer kr.mu.Unlock()
+	// Пока ждали блокировку, ключ мог загрузить параллельный вызов
+	if dek, ok := kr.dataKeys[version]; ok {
+		return dek, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), reloadTimeout)
+	defer cancel()
+	if err := kr.load(ctx); err != nil {
+		return nil, err
+	}
+	dek, ok := kr.dataKeys[version]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	log.Printf("🔐 Ключи данных перечитаны из БД: загружен ключ v%d, активный – v%d", version, kr.activeDataKey)
+	return dek, nil
+}
+
+// EncryptString – Encrypt для строковых секретов
+func EncryptString(plaintext string) (string, error) {
+	return Encrypt([]byte(plaintext))
+}
+
+// DecryptString – Decrypt для строковых секретов
+func DecryptString(value string) (string, error) {
+	plaintext, err := Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// Reencrypt расшифровывает значение и шифрует его активным ключом данных
+func Reencrypt(value string) (string, error) {
+	plaintext, err := Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return Encrypt(plaintext)
+}
+
+func splitValue(value string) (int, string, error) {
+	versionStr, sealed, ok := strings.Cut(strings.TrimPrefix(value, valuePrefix), ":")
+	if !ok {
+		return 0, "", errors.New("secrets: malformed encrypted value")
+	}
+	version, err := strconv.Atoi(versionStr)
+	if err != nil {
+		return 0, "", errors.New("secrets: malformed encrypted value")
+	}
+	return version, sealed, nil
+}
+
+// seal шифрует AES-256-GCM и возвращает base64(nonce|ciphertext)
+func seal(key, plaintext []byte) (string, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, plaintext, nil)), nil
+}
+
+func open(key []byte, sealed string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(sealed)
+	if err != nil {
+		return nil, errors.New("secrets: malformed encrypted value")
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("secrets: malformed encrypted value")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, ciphertext, nil)
+	if err != nil {
+		return nil, errors.New("secrets: decryption failed")
+	}
+	return plaintext, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Redacted – расшифрованный секрет в памяти. При выводе через fmt/log
+// печатается как [REDACTED], чтобы открытый текст не попал в логи.
+type Redacted []byte
+
+// Format скрывает содержимое для всех глаголов fmt (%v, %+v, %s, %x, ...)
+func (Redacted) Format(f fmt.State, _ rune) {
+	io.WriteString(f, "[REDACTED]")
+}
@@ -1,28 +1,68 @@
 package logging
 
 import (
+	"context"
+
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
 )
 
-var Logger *zap.Logger
+var Logger = zap.NewNop()
 
-func InitLogger(production bool) error {
-	var config zap.Config
+type ctxKey struct{}
 
-	if production {
-		config = zap.NewProductionConfig()
-	} else {
+// InitLogger настраивает zap: уровень из LOG_LEVEL, формат json (по умолчанию) или console.
+// Стандартный log перенаправляется в zap (уровень warn), поэтому старые log.Printf тоже пишутся структурно.
+func InitLogger(level, format string) error {
+	config := zap.NewProductionConfig()
+	if format == "console" {
 		config = zap.NewDevelopmentConfig()
 		config.EncoderConfig.EncodeLevel = zapcore.CapitalColorLevelEncoder
 	}
+	config.EncoderConfig.TimeKey = "time"
+	config.EncoderConfig.EncodeTime = zapcore.ISO8601TimeEncoder
+
+	parsed, err := zapcore.ParseLevel(level)
+	if err != nil {
+		parsed = zapcore.InfoLevel
+	}
+	config.Level = zap.NewAtomicLevelAt(parsed)
 
-	var err error
 	Logger, err = config.Build()
 	if err != nil {
 		return err
 	}
-
-	defer Logger.Sync()
+	zap.ReplaceGlobals(Logger)
+	// У стандартного log нет уровней, а через него идут и ошибки: пишем его на уровне warn,
+	// чтобы LOG_LEVEL=warn их не скрывал. Код запросов пишет через FromContext с нужным уровнем.
+	if _, err := zap.RedirectStdLogAt(Logger, zapcore.WarnLevel); err != nil {
+		return err
+	}
 	return nil
 }
+
+// Sync сбрасывает буферы логгера (вызывать при завершении)
+func Sync() {
+	_ = Logger.Sync()
+}
+
+// WithLogger кладёт логгер запроса в контекст
+func WithLogger(ctx context.Context, logger *zap.Logger) context.Context {
+	return context.WithValue(ctx, ctxKey{}, logger)
+}
+
+// FromContext возвращает логгер запроса (с request_id и trace_id) или общий логгер
+func FromContext(ctx context.Context) *zap.Logger {
+	logger, ok := ctx.Value(ctxKey{}).(*zap.Logger)
+	if !ok {
+		logger = Logger
+	}
+	if spanCtx := trace.SpanContextFromContext(ctx); spanCtx.IsValid() && !ok {
+		logger = logger.With(
+			zap.String("trace_id", spanCtx.TraceID().String()),
+			zap.String("span_id", spanCtx.SpanID().String()),
+		)
+	}
+	return logger
+}
@@ -1,8 +1,10 @@
 package main
 
 import (
+    "context"
     "embed"
     "encoding/json"
+    "errors"
     "fmt"
     "html/template"
     "io/fs"
@@ -15,12 +17,21 @@ import (
     "github.com/joho/godotenv"
     swaggerFiles "github.com/swaggo/files"
     ginSwagger "github.com/swaggo/gin-swagger"
+    "github.com/prometheus/client_golang/prometheus/promhttp"
+    "go.opentelemetry.io/contrib/instrumentation/github.com/gin-gonic/gin/otelgin"
 
     "subscription-system/config"
     "subscription-system/database"
     "subscription-system/handlers"
+    "subscription-system/integrations"
+    onecintegration "subscription-system/integrations/1c"
     "subscription-system/middleware"
+    "subscription-system/models"
+    "subscription-system/internal/secrets"
+    "subscription-system/logging"
+    "subscription-system/monitoring"
     "subscription-system/services"
+    "subscription-system/tracing"
     _ "subscription-system/docs"
 )
 
@@ -45,11 +56,12 @@ func serviceOrderHandler(c *gin.Context) {
         return
     }
 
-    _, err := database.Pool.Exec(c.Request.Context(), `
-        INSERT INTO service_requests (name, contact, description, created_at)
-        VALUES ($1, $2, $3, NOW())
-    `, order.Name, order.Contact, order.Description)
-    if err != nil {
+    // Заявка попадает в CRM как лид (клиент, ответственный, сделка – по форме, принимающей этот канал)
+    if err := handlers.CaptureServiceOrder(c, order.Name, order.Contact, order.Description); err != nil {
+        if errors.Is(err, models.ErrInvalidLead) {
+            c.JSON(http.StatusBadRequest, gin.H{"error": "Неверные данные"})
+            return
+        }
         log.Printf("Ошибка сохранения заявки: %v", err)
         c.JSON(http.StatusInternalServerError, gin.H{"error": "Ошибка базы данных"})
         return
@@ -67,13 +79,52 @@ func main() {
     }
     cfg := config.Load()
 
+    if err := logging.InitLogger(cfg.LogLevel, cfg.LogFormat); err != nil {
+        log.Fatalf("❌ Ошибка инициализации логгера: %v", err)
+    }
+    defer logging.Sync()
+
+    shutdownTracing, err := tracing.Init(context.Background(), cfg.OTelServiceName, cfg.OTLPEndpoint)
+    if err != nil {
+        log.Fatalf("❌ Ошибка инициализации OpenTelemetry: %v", err)
+    }
+    defer shutdownTracing(context.Background())
+
     if err := database.InitDB(cfg); err != nil {
         log.Fatalf("❌ Ошибка подключения к БД: %v", err)
     }
     defer database.CloseDB()
+    monitoring.RegisterDBCollectors(database.Pool)
+    if n, err := models.FailInterruptedImports(context.Background()); err != nil {
+        log.Printf("⚠️ Не удалось закрыть прерванные импорты: %v", err)
+    } else if n > 0 {
+        log.Printf("⚠️ %d импортов CRM прервано перезапуском", n)
+    }
+
+    if cfg.Env == "release" && cfg.SecretsMasterKeys == "" {
+        log.Fatal("❌ SECRETS_MASTER_KEYS обязателен в режиме release")
+    }
+    if err := secrets.Init(context.Background(), cfg.SecretsMasterKeys, cfg.SecretsMasterKeyVersion); err != nil {
+        log.Fatalf("❌ Ошибка инициализации шифрования секретов: %v", err)
+    }
+    // Ключ ссылок на файлы отдельный: утечка ссылки не должна помогать подделывать JWT, и наоборот
+    if cfg.FileURLSecret == "" || cfg.FileURLSecret == config.DefaultJWTSecret || cfg.FileURLSecret == cfg.JWTSecret {
+        log.Fatal("❌ FILE_URL_SECRET обязателен и не должен совпадать с JWT_ACCESS_SECRET")
+    }
 
     handlers.InitAuthHandler(cfg)
     handlers.InitNotifier(cfg)
+    handlers.InitCalendar(cfg)
+    handlers.InitQuotes(cfg)
+    handlers.InitLeadScoring(cfg)
+
+    fileStore, err := services.NewFileStore(cfg)
+    if err != nil {
+        log.Fatalf("❌ Ошибка инициализации файлового хранилища: %v", err)
+    }
+    fileService := services.NewFileService(cfg, fileStore)
+    fileService.Start()
+    handlers.InitFiles(cfg, fileService)
 
     // ========== ОБЪЯВЛЯЕМ ПЕРЕМЕННЫЕ ==========
     var yandexService *services.YandexAdapter
@@ -86,6 +137,44 @@ func main() {
     aiAgentService.StartAgentScheduler()
     log.Println("🤖 Сервис ИИ-агентов запущен с YandexGPT")
 
+    services.NewTaskReminderService(cfg).Start()
+    services.NewAPIKeyUsageService().Start()
+    services.NewLeadScoringService().Start()
+    services.NewTrashPurgeService(cfg).Start()
+    handlers.InitTrash(cfg)
+    emailChannel := services.NewEmailChannelService(cfg)
+    emailChannel.Start()
+    handlers.InitEmailChannel(emailChannel)
+    revenueMetrics := services.NewRevenueMetricsService(cfg)
+    revenueMetrics.Start()
+    handlers.InitRevenueMetrics(revenueMetrics)
+    services.NewCohortService().Start()
+    churn := services.NewChurnService(cfg)
+    churn.Start()
+    handlers.InitChurn(churn)
+    services.NewProductEventService(cfg).Start()
+    reports := services.NewReportService(cfg)
+    reports.Start()
+    handlers.InitReports(reports)
+    alerts := services.NewAlertService(cfg)
+    alerts.Start()
+    handlers.InitAlerts(alerts)
+
+    realtimeHub := services.NewRealtimeHub()
+    realtimeHub.Start()
+    handlers.InitRealtime(cfg, realtimeHub)
+
+    webhookDispatcher := services.NewWebhookDispatcher(cfg)
+    webhookDispatcher.Start()
+    handlers.InitWebhooks(webhookDispatcher)
+
+    // Учётные данные интеграций из админки (integration_credentials) перекрывают переменные окружения
+    integrationsCfg := integrations.LoadConfigWithStored(context.Background())
+    if integrationsCfg.OneCEnabled {
+        onecClient := onecintegration.NewClient(integrationsCfg.OneCBaseURL, integrationsCfg.OneCLogin, integrationsCfg.OneCPassword)
+        onecintegration.NewSyncManager(onecClient, integrationsCfg.OneCSyncInterval).Start()
+    }
+
     speechKitService = services.NewSpeechKitService(cfg)
     _ = speechKitService
     log.Println("🎙️ Сервис транскрибации SpeechKit инициализирован")
@@ -95,15 +184,24 @@ func main() {
     }
 
     r := gin.New()
-    r.Use(gin.Logger())
     r.Use(gin.Recovery())
+    r.Use(otelgin.Middleware(cfg.OTelServiceName))
+    r.Use(middleware.RequestID())
     r.Use(middleware.Logger())
+    r.Use(middleware.Metrics())
     r.SetTrustedProxies(cfg.TrustedProxies)
     r.Use(middleware.SetupCORS(cfg))
 
-    rateLimiter := middleware.NewRateLimiter(30, time.Minute)
     r.Use(middleware.SecurityMonitor())
-    authLimiter := middleware.NewRateLimiter(3, time.Minute)
+    switch cfg.RateLimitBackend {
+    case "postgres":
+        middleware.SetRateLimitStore(middleware.NewPostgresRateLimitStore())
+        log.Println("🚦 Rate limit: общее хранилище в PostgreSQL")
+    case "memory":
+        log.Println("🚦 Rate limit: в памяти процесса")
+    default:
+        log.Fatalf("❌ Неизвестный RATE_LIMIT_BACKEND: %s", cfg.RateLimitBackend)
+    }
 
     subFS, err := fs.Sub(templateFS, "templates")
     if err != nil {
@@ -201,17 +299,12 @@ func main() {
     }
 
     authAPI := r.Group("/api/auth")
-    authAPI.Use(func(c *gin.Context) {
-        ip := c.ClientIP()
-        if authLimiter.Limit(ip) {
-            c.JSON(http.StatusTooManyRequests, gin.H{
-                "error": "Слишком много попыток входа. Попробуйте через минуту.",
-            })
-            c.Abort()
-            return
-        }
-        c.Next()
-    })
+    authAPI.Use(middleware.RateLimit(middleware.RateLimitPolicy{
+        Group:   "auth",
+        Limit:   cfg.RateLimitAuthPerMinute,
+        Window:  time.Minute,
+        Message: "Слишком много попыток входа. Попробуйте через минуту.",
+    }))
     {
         authAPI.POST("/register", handlers.RegisterHandler)
         authAPI.POST("/login", handlers.LoginHandler)
@@ -304,18 +397,14 @@ func main() {
     }
 
     api := r.Group("/api")
-    api.Use(func(c *gin.Context) {
-        ip := c.ClientIP()
-        if rateLimiter.Limit(ip) {
-            c.JSON(http.StatusTooManyRequests, gin.H{
-                "error": "Слишком много запросов. Попробуйте позже.",
-            })
-            c.Abort()
-            return
-        }
-        c.Next()
-    })
     api.Use(middleware.AuthMiddleware(cfg))
+    api.Use(middleware.RateLimit(middleware.RateLimitPolicy{
+        Group:      "api",
+        Limit:      cfg.RateLimitPerMinute,
+        Window:     time.Minute,
+        PlanLimits: true,
+        Message:    "Слишком много запросов. Попробуйте позже.",
+    }))
     {
         api.GET("/health", handlers.HealthHandler)
         api.GET("/crm/health", handlers.CRMHealthHandler)
@@ -341,6 +430,10 @@ func main() {
         api.GET("/user/keys", handlers.GetUserAPIKeysHandler)
         api.POST("/keys/revoke", handlers.RevokeAPIKeyHandler)
         api.POST("/keys/validate", handlers.ValidateAPIKeyHandler)
+        api.GET("/keys/scopes", handlers.GetAPIKeyScopesHandler)
+        api.PUT("/keys/:id/policy", handlers.UpdateAPIKeyPolicyHandler)
+        api.POST("/keys/:id/rotate", handlers.RotateAPIKeyHandler)
+        api.GET("/keys/:id/usage", handlers.GetAPIKeyUsageHandler)
         api.GET("/referral/stats", handlers.GetReferralStatsHandler)
         api.GET("/referral/friends", handlers.GetReferralFriendsHandler)
         api.GET("/2fa/status", handlers.GetTwoFAStatus)
@@ -361,10 +454,44 @@ func main() {
         api.PUT("/crm/deals/:id", handlers.UpdateDeal)
         api.DELETE("/crm/deals/:id", handlers.DeleteDeal)
         api.PUT("/crm/deals/:id/stage", handlers.UpdateDealStage)
+        api.GET("/crm/pipelines", handlers.GetPipelines)
+        api.POST("/crm/pipelines", handlers.CreatePipeline)
+        api.GET("/crm/pipelines/:id", handlers.GetPipeline)
+        api.PUT("/crm/pipelines/:id", handlers.UpdatePipeline)
+        api.DELETE("/crm/pipelines/:id", handlers.DeletePipeline)
+        api.GET("/crm/pipelines/:id/board", handlers.GetPipelineBoard)
+        api.POST("/crm/pipelines/:id/stages", handlers.AddPipelineStage)
+        api.PUT("/crm/pipelines/:id/stages/:stage_id", handlers.UpdatePipelineStage)
+        api.DELETE("/crm/pipelines/:id/stages/:stage_id", handlers.DeletePipelineStage)
+        api.PUT("/crm/pipelines/:id/stage-order", handlers.ReorderPipelineStages)
+        // Пользовательские поля клиентов и сделок (изменение схемы – только администратор)
+        api.GET("/crm/custom-fields", handlers.GetCustomFields)
+        api.POST("/crm/custom-fields", handlers.CreateCustomField)
+        api.PUT("/crm/custom-fields/:id", handlers.UpdateCustomField)
+        api.DELETE("/crm/custom-fields/:id", handlers.DeleteCustomField)
+        // Фильтры и сохранённые представления списков
+        api.GET("/crm/filter-fields", handlers.GetFilterFields)
+        api.GET("/crm/views", handlers.GetSavedViews)
+        api.POST("/crm/views", handlers.CreateSavedView)
+        api.GET("/crm/views/:id", handlers.GetSavedView)
+        api.PUT("/crm/views/:id", handlers.UpdateSavedView)
+        api.DELETE("/crm/views/:id", handlers.DeleteSavedView)
+        // Импорт клиентов и сделок из CSV/XLSX
+        api.POST("/crm/imports", handlers.UploadImportFile)
+        api.GET("/crm/imports", handlers.GetImports)
+        api.GET("/crm/imports/:id", handlers.GetImport)
+        api.POST("/crm/imports/:id/run", handlers.RunImport)
+        api.GET("/crm/imports/:id/errors", handlers.DownloadImportErrors)
+        api.DELETE("/crm/imports/:id", handlers.DeleteImport)
+        api.GET("/crm/import-templates", handlers.GetImportTemplates)
+        api.POST("/crm/import-templates", handlers.SaveImportTemplate)
+        api.DELETE("/crm/import-templates/:id", handlers.DeleteImportTemplate)
         api.GET("/crm/stats", handlers.GetCRMStats)
         api.POST("/crm/deals/:id/attachments", handlers.UploadDealAttachment)
         api.GET("/crm/deals/:id/attachments", handlers.GetDealAttachments)
         api.GET("/crm/attachments/:attachment_id/download", handlers.DownloadDealAttachment)
+        api.GET("/crm/attachments/:attachment_id/thumbnail", handlers.DownloadDealAttachmentThumbnail)
+        api.GET("/crm/attachments/:attachment_id/url", handlers.GetDealAttachmentURL)
         api.DELETE("/crm/attachments/:attachment_id", handlers.DeleteDealAttachment)
         api.GET("/crm/advanced-stats", handlers.GetCRMAdvancedStats)
         api.POST("/crm/customers/batch/delete", handlers.BatchDeleteCustomers)
@@ -374,6 +501,68 @@ func main() {
         api.PUT("/crm/deals/batch/responsible", handlers.BatchUpdateDealsResponsible)
         api.GET("/crm/customers/export/csv", handlers.ExportCustomersCSV)
         api.GET("/crm/customers/export/excel", handlers.ExportCustomersExcel)
+        // Дубли клиентов: поиск, слияние и отмена слияния
+        api.GET("/crm/customers/duplicates", handlers.GetCustomerDuplicates)
+        api.POST("/crm/customers/merge", handlers.MergeCustomers)
+        api.POST("/crm/customers/merges/:id/revert", handlers.RevertCustomerMerge)
+        // Прайс-лист, позиции сделок, коммерческие предложения и заказы
+        api.GET("/crm/products", handlers.GetProducts)
+        api.POST("/crm/products", handlers.CreateProduct)
+        api.GET("/crm/products/:id", handlers.GetProduct)
+        api.PUT("/crm/products/:id", handlers.UpdateProduct)
+        api.DELETE("/crm/products/:id", handlers.DeleteProduct)
+        api.GET("/crm/deals/:id/items", handlers.GetDealItems)
+        api.PUT("/crm/deals/:id/items", handlers.ReplaceDealItems)
+        api.GET("/crm/deals/:id/quotes", handlers.GetDealQuotes)
+        api.POST("/crm/deals/:id/quotes", handlers.CreateDealQuote)
+        api.GET("/crm/quotes/:id", handlers.GetQuote)
+        api.GET("/crm/quotes/:id/pdf", handlers.GetQuotePDF)
+        api.PUT("/crm/quotes/:id/status", handlers.UpdateQuoteStatus)
+        api.POST("/crm/deals/:id/order", handlers.CreateDealOrder)
+        api.GET("/crm/orders", handlers.GetOrders)
+        api.GET("/crm/orders/:id", handlers.GetOrder)
+        api.PUT("/crm/orders/:id/status", handlers.UpdateOrderStatus)
+        // Лид-скоринг: модель, пересчёт, разбор оценки
+        api.GET("/crm/lead-scoring/criteria", handlers.GetScoringCriteria)
+        api.GET("/crm/lead-scoring/model", handlers.GetScoringModel)
+        api.PUT("/crm/lead-scoring/model", handlers.SaveScoringModel)
+        api.DELETE("/crm/lead-scoring/model", handlers.DeleteScoringModel)
+        api.POST("/crm/lead-scoring/recalculate", handlers.RecalculateLeadScores)
+        api.POST("/crm/lead-scoring/suggest", handlers.SuggestScoringWeights)
+        api.GET("/crm/customers/:id/lead-score", handlers.GetCustomerLeadScore)
+        // Формы захвата лидов и журнал заявок
+        api.GET("/crm/lead-forms", handlers.GetLeadForms)
+        api.POST("/crm/lead-forms", handlers.CreateLeadForm)
+        api.GET("/crm/lead-forms/:id", handlers.GetLeadForm)
+        api.PUT("/crm/lead-forms/:id", handlers.UpdateLeadForm)
+        api.DELETE("/crm/lead-forms/:id", handlers.DeleteLeadForm)
+        api.POST("/crm/lead-forms/:id/rotate-key", handlers.RotateLeadFormKey)
+        api.GET("/crm/leads", handlers.GetLeadSubmissions)
+        // Задачи и календарь
+        api.GET("/crm/tasks", handlers.GetTasks)
+        api.POST("/crm/tasks", handlers.CreateTask)
+        api.GET("/crm/tasks/:id", handlers.GetTask)
+        api.PUT("/crm/tasks/:id", handlers.UpdateTask)
+        api.POST("/crm/tasks/:id/complete", handlers.CompleteTask)
+        api.DELETE("/crm/tasks/:id", handlers.DeleteTask)
+        api.GET("/crm/calendar/events", handlers.GetCalendarEvents)
+        api.GET("/crm/calendar/feed", handlers.GetCalendarFeed)
+        api.POST("/crm/calendar/feed/reset", handlers.ResetCalendarFeed)
+        // Живые обновления CRM (SSE и WebSocket)
+        api.GET("/crm/events", handlers.StreamCRMEvents)
+        api.GET("/crm/events/ws", handlers.StreamCRMEventsWS)
+        // Исходящие вебхуки
+        api.GET("/webhooks/event-types", handlers.GetWebhookEventTypes)
+        api.GET("/webhooks", handlers.GetWebhooks)
+        api.POST("/webhooks", handlers.CreateWebhook)
+        api.GET("/webhooks/:id", handlers.GetWebhook)
+        api.PUT("/webhooks/:id", handlers.UpdateWebhook)
+        api.DELETE("/webhooks/:id", handlers.DeleteWebhook)
+        api.POST("/webhooks/:id/rotate-secret", handlers.RotateWebhookSecret)
+        api.POST("/webhooks/:id/ping", handlers.PingWebhook)
+        api.GET("/webhooks/:id/deliveries", handlers.GetWebhookDeliveries)
+        api.GET("/webhook-deliveries/:id", handlers.GetWebhookDelivery)
+        api.POST("/webhook-deliveries/:id/redeliver", handlers.RedeliverWebhook)
         api.GET("/crm/deals/export/csv", handlers.ExportDealsCSV)
         api.GET("/crm/deals/export/excel", handlers.ExportDealsExcel)
         api.GET("/crm/history/:type/:id", handlers.GetEntityHistory)
@@ -393,6 +582,32 @@ func main() {
         api.GET("/crm/forecast", handlers.GetSalesForecast)
         api.GET("/crm/conversion", handlers.GetStageConversion)
         api.DELETE("/crm/activities/:id", handlers.DeleteActivity)
+
+        // Корзина CRM
+        api.GET("/crm/trash", handlers.GetTrash)
+        api.POST("/crm/trash/restore", handlers.BatchRestoreTrash)
+        api.POST("/crm/trash/:id/restore", handlers.RestoreTrashItem)
+        api.GET("/crm/trash/:id", handlers.GetTrashItem)
+        api.DELETE("/crm/trash/:id", handlers.PurgeTrashItem)
+
+        // Почтовый канал: ящики пользователей, шаблоны, переписка с клиентами
+        api.GET("/crm/mailboxes", handlers.GetMailboxes)
+        api.POST("/crm/mailboxes", handlers.CreateMailbox)
+        api.PUT("/crm/mailboxes/:id", handlers.UpdateMailbox)
+        api.DELETE("/crm/mailboxes/:id", handlers.DeleteMailbox)
+        api.POST("/crm/mailboxes/:id/test", handlers.TestMailbox)
+        api.POST("/crm/mailboxes/:id/sync", handlers.SyncMailbox)
+        api.GET("/crm/email/templates", handlers.GetEmailTemplates)
+        api.POST("/crm/email/templates", handlers.CreateEmailTemplate)
+        api.GET("/crm/email/templates/:id", handlers.GetEmailTemplate)
+        api.PUT("/crm/email/templates/:id", handlers.UpdateEmailTemplate)
+        api.DELETE("/crm/email/templates/:id", handlers.DeleteEmailTemplate)
+        api.POST("/crm/email/preview", handlers.PreviewEmail)
+        api.POST("/crm/email/send", handlers.SendEmail)
+        api.GET("/crm/email/threads", handlers.GetEmailThreads)
+        api.GET("/crm/email/threads/:id", handlers.GetEmailThread)
+        api.GET("/crm/customers/:id/emails", handlers.GetCustomerEmails)
+
         api.PUT("/crm/tags/:id", handlers.UpdateTag)
         api.POST("/ai/consultant", handlers.AIConsultantHandler)
 
@@ -408,7 +623,28 @@ func main() {
         api.GET("/analytics/ltv/:id", handlers.GetCustomerLTV)
         api.GET("/analytics/insights", handlers.GetInsights)
         api.GET("/analytics/segments", handlers.GetSegmentSummary)
+        api.POST("/events", handlers.TrackProductEvent)
+        api.POST("/events/batch", handlers.TrackProductEventsBatch)
         api.GET("/analytics/cohorts/run", handlers.RunCohortAnalysis)
+        api.GET("/analytics/cohorts/events", handlers.GetCohortEvents)
+        api.GET("/analytics/cohorts/definitions", handlers.GetCohortDefinitions)
+        api.POST("/analytics/cohorts/definitions", handlers.CreateCohortDefinition)
+        api.PUT("/analytics/cohorts/definitions/:id", handlers.UpdateCohortDefinition)
+        api.DELETE("/analytics/cohorts/definitions/:id", handlers.DeleteCohortDefinition)
+        api.GET("/analytics/cohorts/definitions/:id/export", handlers.ExportCohorts)
+
+        // Отчёты по расписанию: подписки, получатели, предпросмотр и история доставки
+        api.GET("/reports/types", handlers.GetReportTypes)
+        api.GET("/reports/subscriptions", handlers.GetReportSubscriptions)
+        api.POST("/reports/subscriptions", handlers.CreateReportSubscription)
+        api.GET("/reports/subscriptions/:id", handlers.GetReportSubscription)
+        api.PUT("/reports/subscriptions/:id", handlers.UpdateReportSubscription)
+        api.DELETE("/reports/subscriptions/:id", handlers.DeleteReportSubscription)
+        api.POST("/reports/subscriptions/:id/recipients", handlers.AddReportRecipient)
+        api.DELETE("/reports/subscriptions/:id/recipients/:recipient_id", handlers.DeleteReportRecipient)
+        api.POST("/reports/subscriptions/:id/send", handlers.SendReportNow)
+        api.GET("/reports/subscriptions/:id/preview", handlers.PreviewReport)
+        api.GET("/reports/subscriptions/:id/deliveries", handlers.GetReportDeliveries)
         api.GET("/payments", handlers.GetPayments)
     }
 
@@ -429,8 +665,31 @@ func main() {
 
     v1 := r.Group("/api/v1")
     v1.Use(middleware.APIKeyAuthMiddleware())
+    v1.Use(middleware.RateLimit(middleware.RateLimitPolicy{
+        Group:      "v1",
+        Limit:      cfg.RateLimitPerMinute,
+        Window:     time.Minute,
+        PlanLimits: true,
+        Message:    "Слишком много запросов. Попробуйте позже.",
+    }))
     {
-        // Зарезервировано
+        v1.GET("/crm/customers", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetCustomers)
+        v1.POST("/crm/customers", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.CreateCustomer)
+        v1.PUT("/crm/customers/:id", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.UpdateCustomer)
+        v1.GET("/crm/deals", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetDeals)
+        v1.POST("/crm/deals", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.CreateDeal)
+        v1.PUT("/crm/deals/:id", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.UpdateDeal)
+        v1.PUT("/crm/deals/:id/stage", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.UpdateDealStage)
+        v1.GET("/crm/pipelines", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetPipelines)
+        v1.GET("/crm/pipelines/:id/board", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetPipelineBoard)
+        v1.GET("/crm/custom-fields", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetCustomFields)
+        v1.GET("/crm/filter-fields", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetFilterFields)
+        v1.GET("/crm/views", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetSavedViews)
+        v1.GET("/crm/tasks", middleware.RequireAPIKeyScope(models.ScopeCRMRead), handlers.GetTasks)
+        v1.POST("/crm/tasks", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.CreateTask)
+        v1.POST("/crm/tasks/:id/complete", middleware.RequireAPIKeyScope(models.ScopeCRMWrite), handlers.CompleteTask)
+        v1.POST("/ai/ask", middleware.RequireAPIKeyScope(models.ScopeAIChat), handlers.AIAskHandler)
+        v1.GET("/user/subscriptions", middleware.RequireAPIKeyScope(models.ScopeBillingRead), handlers.GetUserSubscriptionsHandler)
     }
 
     adminAPI := r.Group("/api/admin")
@@ -438,17 +697,50 @@ func main() {
     {
         adminAPI.PUT("/subscriptions/:id/cancel", handlers.AdminCancelSubscriptionHandler)
         adminAPI.PUT("/subscriptions/:id/reactivate", handlers.AdminReactivateSubscriptionHandler)
+        adminAPI.POST("/payments/:id/complete", handlers.AdminCompletePaymentHandler)
+        adminAPI.POST("/leads/convert-legacy", handlers.ConvertLegacyLeads)
         adminAPI.GET("/plans", handlers.AdminGetPlansHandler)
         adminAPI.POST("/plans", handlers.AdminCreatePlanHandler)
         adminAPI.PUT("/plans/:id", handlers.AdminUpdatePlanHandler)
         adminAPI.DELETE("/plans/:id", handlers.AdminDeletePlanHandler)
         adminAPI.PUT("/api-keys/:id", handlers.AdminUpdateAPIKeyHandler)
         adminAPI.DELETE("/api-keys/:id", handlers.AdminDeleteAPIKeyHandler)
+        adminAPI.GET("/integrations/credentials", handlers.AdminListIntegrationCredentialsHandler)
+        adminAPI.PUT("/integrations/:provider/credentials", handlers.AdminSaveIntegrationCredentialsHandler)
+        adminAPI.DELETE("/integrations/:provider/credentials", handlers.AdminDeleteIntegrationCredentialsHandler)
         adminAPI.GET("/stats", handlers.AdminStatsHandler)
         adminAPI.GET("/users", handlers.AdminUsersHandler)
         adminAPI.PUT("/users/:id/block", handlers.AdminToggleUserBlockHandler)
         adminAPI.GET("/payments", handlers.AdminPaymentsHandler)
         adminAPI.GET("/payment-stats", handlers.AdminPaymentStats)
+        adminAPI.GET("/revenue/summary", handlers.GetRevenueSummary)
+        adminAPI.GET("/revenue/series", handlers.GetRevenueSeries)
+        adminAPI.GET("/revenue/movements", handlers.GetRevenueMovements)
+        adminAPI.GET("/revenue/cohorts", handlers.GetRevenueCohorts)
+        adminAPI.POST("/revenue/rebuild", handlers.RebuildRevenueMetrics)
+        adminAPI.GET("/churn/models", handlers.GetChurnModels)
+        adminAPI.POST("/churn/models/train", handlers.TrainChurnModel)
+        adminAPI.POST("/churn/models/:id/activate", handlers.ActivateChurnModel)
+        adminAPI.GET("/churn/predictions", handlers.GetChurnPredictions)
+        adminAPI.GET("/churn/predictions/:user_id", handlers.GetUserChurnPrediction)
+        adminAPI.POST("/churn/score", handlers.ScoreChurn)
+
+        adminAPI.GET("/alerts/options", handlers.GetAlertOptions)
+        adminAPI.GET("/alerts/rules", handlers.GetAlertRules)
+        adminAPI.POST("/alerts/rules", handlers.CreateAlertRule)
+        adminAPI.POST("/alerts/rules/test", handlers.TestAlertRule)
+        adminAPI.GET("/alerts/rules/:id", handlers.GetAlertRule)
+        adminAPI.PUT("/alerts/rules/:id", handlers.UpdateAlertRule)
+        adminAPI.DELETE("/alerts/rules/:id", handlers.DeleteAlertRule)
+        adminAPI.POST("/alerts/rules/:id/check", handlers.CheckAlertRule)
+        adminAPI.GET("/alerts", handlers.GetAlerts)
+        adminAPI.GET("/alerts/:id", handlers.GetAlert)
+        adminAPI.POST("/alerts/:id/snooze", handlers.SnoozeAlert)
+        adminAPI.POST("/alerts/:id/resolve", handlers.ResolveAlert)
+        adminAPI.GET("/events/names", handlers.GetProductEventNames)
+        adminAPI.GET("/events/funnel", handlers.GetProductFunnel)
+        adminAPI.GET("/events/paths", handlers.GetProductPaths)
+        adminAPI.GET("/events/segmentation", handlers.GetProductSegmentation)
         adminAPI.GET("/security-logs", handlers.AdminSecurityLogs)
         adminAPI.GET("/blocked-ips", handlers.AdminBlockedIPs)
         adminAPI.POST("/users/toggle-block", handlers.AdminToggleUserBlock)
@@ -457,6 +749,31 @@ func main() {
     }
 
     r.GET("/swagger/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
+    if cfg.MetricsToken != "" {
+        r.GET("/metrics", middleware.MetricsAuth(cfg.MetricsToken), gin.WrapH(promhttp.Handler()))
+    } else {
+        log.Println("⚠️ METRICS_TOKEN не задан: /metrics отключён")
+    }
+
+    // ICS-фид календаря: доступ по секретному токену в ссылке, календари не умеют авторизоваться
+    r.GET("/calendar/feed/:token", handlers.CalendarICS)
+
+    // Временные ссылки на файлы: доступ даёт подпись со сроком действия (для локального хранилища; S3 отдаёт файлы сам)
+    r.GET("/api/public/files/:token", handlers.DownloadSignedFile)
+
+    // Публичные формы лидов: встраиваются на сайты, защищены honeypot, лимитом с IP и списком источников формы
+    r.GET("/api/public/lead-forms/:key", handlers.GetPublicLeadForm)
+    r.GET("/api/public/lead-forms/:key/embed.js", handlers.LeadFormEmbedScript)
+    r.POST("/api/public/lead-forms/:key/submit", handlers.SubmitLeadForm)
+    r.OPTIONS("/api/public/lead-forms/:key", handlers.LeadFormPreflight)
+    r.OPTIONS("/api/public/lead-forms/:key/submit", handlers.LeadFormPreflight)
+
+    // Пиксель отслеживания открытий писем из CRM: токен в ссылке, ответ всегда одинаковый
+    r.GET("/api/public/email/open/:token", handlers.TrackEmailOpen)
+
+    // Отписка от отчёта по расписанию: токен получателя в ссылке; POST – отписка в один клик (RFC 8058)
+    r.GET("/api/public/reports/unsubscribe/:token", handlers.UnsubscribeReport)
+    r.POST("/api/public/reports/unsubscribe/:token", handlers.UnsubscribeReport)
 
     r.NoRoute(func(c *gin.Context) {
         c.HTML(http.StatusNotFound, "404.html", gin.H{
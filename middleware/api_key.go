@@ -1,17 +1,20 @@
 package middleware
 
 import (
+        "errors"
         "log"
         "net/http"
         "strings"
+        "time"
 
         "subscription-system/models"
 
         "github.com/gin-gonic/gin"
 )
 
-// APIKeyAuthMiddleware проверяет API-ключ в заголовке Authorization
-func APIKeyAuthMiddleware() gin.HandlerFunc {
+// APIKeyAuthMiddleware проверяет API-ключ в заголовке Authorization.
+// Если переданы scopes, ключ должен иметь каждый из них.
+func APIKeyAuthMiddleware(scopes ...string) gin.HandlerFunc {
         return func(c *gin.Context) {
                 authHeader := c.GetHeader("Authorization")
                 if authHeader == "" {
@@ -30,39 +33,101 @@ func APIKeyAuthMiddleware() gin.HandlerFunc {
                 rawKey := parts[1]
 
                 apiKey, err := models.VerifyAPIKey(rawKey)
-                if err != nil {
+                if errors.Is(err, models.ErrInvalidAPIKey) {
                         log.Printf("❌ VerifyAPIKey failed: %v", err)
                         c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid API key"})
                         return
                 }
+                if err != nil {
+                        log.Printf("❌ Ошибка проверки API-ключа: %v", err)
+                        c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": "API key verification failed"})
+                        return
+                }
 
-                // Подробное логирование состояния ключа
-                log.Printf("🔍 APIKey: id=%s, userID=%s, isActive=%v, quotaLimit=%d, quotaUsed=%d",
-                        apiKey.ID, apiKey.UserID, apiKey.IsActive, apiKey.QuotaLimit, apiKey.QuotaUsed)
+                // Подробное логирование состояния ключа (без значений provider_credentials)
+                log.Printf("🔍 APIKey: id=%s, userID=%s, isActive=%v, quotaLimit=%d, quotaUsed=%d, scopes=%v, providerCreds=%v",
+                        apiKey.ID, apiKey.UserID, apiKey.IsActive, apiKey.QuotaLimit, apiKey.QuotaUsed, apiKey.Scopes, apiKey.HasProviderCredentials)
+
+                ip := c.ClientIP()
+                reject := func(status int, message string) {
+                        models.RecordAPIKeyUsage(apiKey.ID, ip, true)
+                        c.AbortWithStatusJSON(status, gin.H{"error": message})
+                }
+
+                // Просроченный ключ VerifyAPIKey уже выключил, поэтому срок проверяется первым
+                if apiKey.IsExpired() {
+                        log.Printf("⛔ API key %s expired at %s", apiKey.ID, apiKey.ExpiresAt.Format(time.RFC3339))
+                        reject(http.StatusUnauthorized, "API key expired")
+                        return
+                }
 
                 if !apiKey.IsActive {
                         log.Printf("⛔ API key is disabled (isActive=false)")
-                        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key is disabled"})
+                        reject(http.StatusForbidden, "API key is disabled")
+                        return
+                }
+
+                if !apiKey.IPAllowed(ip) {
+                        log.Printf("⛔ API key %s used from disallowed IP %s", apiKey.ID, ip)
+                        reject(http.StatusForbidden, "IP address not allowed for this API key")
+                        return
+                }
+
+                for _, scope := range scopes {
+                        if !apiKey.HasScope(scope) {
+                                log.Printf("⛔ API key %s lacks scope %s", apiKey.ID, scope)
+                                reject(http.StatusForbidden, "API key lacks required scope: "+scope)
+                                return
+                        }
+                }
+
+                // Собственный лимит ключа; лимит тарифа владельца (общий для всех его ключей) проверяет RateLimit,
+                // в заголовках RateLimit-* остаётся более строгий из двух
+                if !checkRateLimit(c, "rl:apikey:"+apiKey.ID, apiKey.RateLimitPerMinute, time.Minute) {
+                        log.Printf("⛔ API key %s rate limit exceeded (%d/min)", apiKey.ID, apiKey.RateLimitPerMinute)
+                        reject(http.StatusTooManyRequests, "API key rate limit exceeded")
                         return
                 }
 
                 // Проверяем лимит, если он не безлимитный
                 if apiKey.QuotaLimit != -1 && apiKey.QuotaUsed >= apiKey.QuotaLimit {
                         log.Printf("⛔ Quota exceeded: limit=%d, used=%d", apiKey.QuotaLimit, apiKey.QuotaUsed)
-                        c.AbortWithStatusJSON(http.StatusPaymentRequired, gin.H{"error": "quota exceeded"})
+                        reject(http.StatusPaymentRequired, "quota exceeded")
                         return
                 }
 
                 // Логируем значения квоты (уже есть выше, но оставим для совместимости)
                 log.Printf("✅ APIKey проверен, пропускаем запрос")
 
+                models.RecordAPIKeyUsage(apiKey.ID, ip, false)
+
                 // Сохраняем информацию о ключе в контекст
                 c.Set("apiKeyID", apiKey.ID)
                 c.Set("apiKeyUserID", apiKey.UserID)
+                c.Set("apiKeyScopes", apiKey.Scopes)
                 c.Set("providerCredentials", []byte(apiKey.ProviderCredentials))
                 c.Set("quotaLimit", apiKey.QuotaLimit)
                 c.Set("quotaUsed", apiKey.QuotaUsed)
 
+                // Обработчики CRM и AI берут владельца из userID; ключ действует с правами обычного пользователя
+                c.Set("userID", apiKey.UserID)
+                c.Set("role", "user")
+                bindIdentityLogger(c)
+
+                c.Next()
+        }
+}
+
+// RequireAPIKeyScope проверяет скоуп для отдельного маршрута внутри группы с APIKeyAuthMiddleware
+func RequireAPIKeyScope(scope string) gin.HandlerFunc {
+        return func(c *gin.Context) {
+                value, _ := c.Get("apiKeyScopes")
+                granted, _ := value.([]string)
+                key := models.APIKey{Scopes: granted}
+                if !key.HasScope(scope) {
+                        c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "API key lacks required scope: " + scope})
+                        return
+                }
                 c.Next()
         }
-}
\ No newline at end of file
+}
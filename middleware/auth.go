@@ -1,10 +1,10 @@
 package middleware
 
 import (
-    "log"
     "net/http"
     "strings"
     "subscription-system/config"
+    "subscription-system/logging"
     "subscription-system/utils"
 
     "github.com/gin-gonic/gin"
@@ -43,7 +43,8 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
             // Используем фиксированный ID тестового администратора
             c.Set("userID", "aa5f14e6-30e1-476c-ac42-8c11ced838a4")
             c.Set("role", "admin")
-            log.Printf("🔓 SkipAuth: установлен userID=aa5f14e6-30e1-476c-ac42-8c11ced838a4, role=admin")
+            bindIdentityLogger(c)
+            logging.FromContext(c.Request.Context()).Debug("🔓 SkipAuth: запрос выполняется от тестового администратора")
             c.Next()
             return
         }
@@ -75,6 +76,7 @@ func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 
         c.Set("userID", claims.UserID)
         c.Set("role", claims.Role)
+        bindIdentityLogger(c)
         c.Next()
     }
 }
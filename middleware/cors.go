@@ -1,6 +1,8 @@
 package middleware
 
 import (
+	"strings"
+
 	"subscription-system/config"
 
 	"github.com/gin-contrib/cors"
@@ -21,5 +23,13 @@ func SetupCORS(cfg *config.Config) gin.HandlerFunc {
 	}
 	corsConfig.AllowCredentials = true
 	corsConfig.MaxAge = 12 * 60 * 60
-	return cors.New(corsConfig)
+	handler := cors.New(corsConfig)
+	return func(c *gin.Context) {
+		// Формы лидов встраиваются на сайты клиентов; их источники проверяет сама форма (allowed_origins)
+		if strings.HasPrefix(c.Request.URL.Path, "/api/public/lead-forms/") {
+			c.Next()
+			return
+		}
+		handler(c)
+	}
 }
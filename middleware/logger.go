@@ -1,28 +1,89 @@
 package middleware
 
 import (
-    "github.com/gin-gonic/gin"
-    "log"
     "time"
+
+    "github.com/gin-gonic/gin"
+    "go.opentelemetry.io/otel/trace"
+    "go.uber.org/zap"
+
+    "subscription-system/logging"
 )
 
+// identityLogKeys – ключи gin-контекста, которые выставляет аутентификация, и поля логов для них
+var identityLogKeys = []struct{ ctx, field string }{
+    {"userID", "user_id"},
+    {"role", "role"},
+    {"accountID", "account_id"},
+    {"apiKeyID", "api_key_id"},
+}
+
+func identityLogFields(c *gin.Context) []zap.Field {
+    var fields []zap.Field
+    for _, key := range identityLogKeys {
+        if value := c.GetString(key.ctx); value != "" {
+            fields = append(fields, zap.String(key.field, value))
+        }
+    }
+    return fields
+}
+
+// bindIdentityLogger добавляет в логгер запроса поля пользователя. Вызывается middleware
+// аутентификации: логгер из Logger создаётся раньше и знает только request_id и trace_id.
+func bindIdentityLogger(c *gin.Context) {
+    if fields := identityLogFields(c); len(fields) > 0 {
+        ctx := c.Request.Context()
+        c.Request = c.Request.WithContext(logging.WithLogger(ctx, logging.FromContext(ctx).With(fields...)))
+    }
+}
+
+// Logger пишет структурированный access-лог через zap и кладёт логгер запроса
+// (request_id, trace_id) в контекст, чтобы обработчики могли брать его через logging.FromContext.
+// Поля пользователя добавляет в этот логгер middleware аутентификации.
+// Должен стоять после RequestID и otelgin.
 func Logger() gin.HandlerFunc {
     return func(c *gin.Context) {
         start := time.Now()
-        path := c.Request.URL.Path
 
         // Сохраняем startTime в контекст для SecurityMonitor
         c.Set("startTime", start)
 
+        fields := []zap.Field{zap.String("request_id", c.GetString("requestID"))}
+        if spanCtx := trace.SpanContextFromContext(c.Request.Context()); spanCtx.IsValid() {
+            fields = append(fields,
+                zap.String("trace_id", spanCtx.TraceID().String()),
+                zap.String("span_id", spanCtx.SpanID().String()),
+            )
+        }
+        reqLogger := logging.Logger.With(fields...)
+        c.Request = c.Request.WithContext(logging.WithLogger(c.Request.Context(), reqLogger))
+
         c.Next()
 
-        latency := time.Since(start)
-        log.Printf("[GIN] %v | %3v | %-7s | %s | %d",
-            start.Format("2006/01/02 - 15:04:05"),
-            latency,
-            c.Request.Method,
-            path,
-            c.Writer.Status(),
-        )
+        status := c.Writer.Status()
+        accessFields := []zap.Field{
+            zap.String("method", c.Request.Method),
+            zap.String("route", c.FullPath()),
+            zap.String("path", c.Request.URL.Path),
+            zap.Int("status", status),
+            zap.Float64("latency_ms", float64(time.Since(start).Microseconds())/1000),
+            zap.String("ip", c.ClientIP()),
+            zap.Int("bytes", c.Writer.Size()),
+            zap.String("user_agent", c.Request.UserAgent()),
+        }
+        // Поля пользователя появляются после middleware аутентификации
+        accessFields = append(accessFields, identityLogFields(c)...)
+        if len(c.Errors) > 0 {
+            accessFields = append(accessFields, zap.String("errors", c.Errors.String()))
+        }
+
+        switch {
+        case status >= 500:
+            reqLogger.Error("request", accessFields...)
+        case status >= 400:
+            reqLogger.Warn("request", accessFields...)
+        default:
+            reqLogger.Info("request", accessFields...)
+        }
     }
-}
\ No newline at end of file
+}
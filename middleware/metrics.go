@@ -0,0 +1,47 @@
+package middleware
+
+import (
+    "crypto/subtle"
+    "net/http"
+    "strconv"
+    "strings"
+    "time"
+
+    "github.com/gin-gonic/gin"
+
+    "subscription-system/monitoring"
+)
+
+// Metrics считает запросы и время ответа. В метку path пишется шаблон маршрута
+// (/api/crm/deals/:id), иначе каждый ID порождал бы новую серию.
+func Metrics() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        start := time.Now()
+        monitoring.HttpRequestsInFlight.Inc()
+        defer monitoring.HttpRequestsInFlight.Dec()
+
+        c.Next()
+
+        path := c.FullPath()
+        if path == "" {
+            path = "unmatched"
+        }
+        method := c.Request.Method
+        monitoring.HttpRequestsTotal.WithLabelValues(method, path, strconv.Itoa(c.Writer.Status())).Inc()
+        monitoring.ResponseTimeHistogram.WithLabelValues(method, path).Observe(time.Since(start).Seconds())
+    }
+}
+
+// MetricsAuth защищает /metrics Bearer-токеном (Authorization: Bearer <token>).
+// Проверки по адресу клиента нет: за обратным прокси на том же хосте все запросы
+// приходят с 127.0.0.1. Без токена маршрут не регистрируется (см. main).
+func MetricsAuth(token string) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        provided := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+        if token == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(token)) != 1 {
+            c.AbortWithStatus(http.StatusUnauthorized)
+            return
+        }
+        c.Next()
+    }
+}
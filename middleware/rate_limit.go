@@ -1,48 +1,128 @@
 package middleware
 
 import (
+    "context"
+    "fmt"
     "log"
+    "math"
+    "net/http"
+    "strconv"
     "sync"
     "time"
 
+    "subscription-system/models"
+
     "github.com/gin-gonic/gin"
 )
 
-type RateLimiter struct {
-    mu       sync.Mutex
-    attempts map[string][]time.Time
-    limit    int
-    window   time.Duration
+// rateLimitStore – общее хранилище лимитов; по умолчанию в памяти процесса
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// SetRateLimitStore подключает хранилище лимитов (например, Postgres для нескольких инстансов)
+func SetRateLimitStore(store RateLimitStore) {
+    rateLimitStore = store
+}
+
+// RateLimitPolicy описывает лимит для группы маршрутов
+type RateLimitPolicy struct {
+    Group      string        // имя группы маршрутов, входит в ключ бакета
+    Limit      int           // запросов за Window для анонимных и пользователей без тарифа
+    Window     time.Duration
+    PlanLimits bool          // брать лимит пользователя / API-ключа из тарифа
+    Message    string        // текст ошибки 429
+}
+
+// planLimitCache кэширует лимиты тарифов, чтобы не ходить в БД на каждый запрос
+var planLimitCache sync.Map // userID -> planLimitEntry
+
+type planLimitEntry struct {
+    perMinute int
+    expires   time.Time
 }
 
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-    return &RateLimiter{
-        attempts: make(map[string][]time.Time),
-        limit:    limit,
-        window:   window,
+const planLimitTTL = time.Minute
+
+// planRateLimit возвращает лимит тарифа пользователя в минуту (0 – нет активной подписки)
+func planRateLimit(ctx context.Context, userID string) int {
+    if v, ok := planLimitCache.Load(userID); ok {
+        entry := v.(planLimitEntry)
+        if time.Now().Before(entry.expires) {
+            return entry.perMinute
+        }
     }
+    perMinute, err := models.GetUserRateLimit(ctx, userID)
+    if err != nil {
+        log.Printf("⚠️ Не удалось получить лимит тарифа для %s: %v", userID, err)
+        perMinute = 0
+    }
+    planLimitCache.Store(userID, planLimitEntry{perMinute: perMinute, expires: time.Now().Add(planLimitTTL)})
+    return perMinute
 }
 
-func (rl *RateLimiter) Limit(key string) bool {
-    rl.mu.Lock()
-    defer rl.mu.Unlock()
+// rateLimitSubject определяет, кого лимитируем: пользователя или IP.
+// Возвращает ключ субъекта и ID пользователя (пустой для анонимных запросов).
+// Запросы по API-ключу считаются в бакете владельца: иначе каждый новый ключ давал бы
+// ещё один полный лимит тарифа. Собственный лимит ключа проверяет APIKeyAuthMiddleware.
+func rateLimitSubject(c *gin.Context) (string, string) {
+    if userID := c.GetString("apiKeyUserID"); userID != "" {
+        return "user:" + userID, userID
+    }
+    if userID := c.GetString("userID"); userID != "" {
+        return "user:" + userID, userID
+    }
+    return "ip:" + c.ClientIP(), ""
+}
+
+// RateLimit ограничивает частоту запросов к группе маршрутов.
+// Должен стоять после middleware аутентификации, чтобы лимитировать по пользователю и ключу.
+func RateLimit(policy RateLimitPolicy) gin.HandlerFunc {
+    return func(c *gin.Context) {
+        subject, userID := rateLimitSubject(c)
+        limit := policy.Limit
+        if policy.PlanLimits && userID != "" {
+            if perMinute := planRateLimit(c.Request.Context(), userID); perMinute > 0 {
+                limit = int(float64(perMinute) * policy.Window.Minutes())
+            }
+        }
 
-    now := time.Now()
-    // Очищаем старые попытки
-    var valid []time.Time
-    for _, t := range rl.attempts[key] {
-        if now.Sub(t) < rl.window {
-            valid = append(valid, t)
+        if !checkRateLimit(c, "rl:"+policy.Group+":"+subject, limit, policy.Window) {
+            log.Printf("⛔ Лимит запросов %s превышен: %s (%d за %s)", policy.Group, subject, limit, policy.Window)
+            c.AbortWithStatusJSON(http.StatusTooManyRequests, gin.H{"error": policy.Message})
+            return
         }
+        c.Next()
     }
+}
 
-    if len(valid) >= rl.limit {
-        rl.attempts[key] = valid
-        return true // превышен лимит
+// checkRateLimit списывает токен и выставляет заголовки RateLimit-* (и Retry-After при отказе).
+// Возвращает false, если лимит исчерпан. При ошибке хранилища запрос пропускается.
+// Запрос по API-ключу проходит два лимита – ключа и группы маршрутов; заголовки описывают
+// тот, у которого осталось меньше запросов, а не последний проверенный.
+func checkRateLimit(c *gin.Context, key string, limit int, window time.Duration) bool {
+    if limit <= 0 {
+        return true
     }
+    result, err := rateLimitStore.Allow(c.Request.Context(), key, limit, window)
+    if err != nil {
+        log.Printf("⚠️ Ошибка хранилища лимитов: %v", err)
+        return true
+    }
+
+    if prev, err := strconv.Atoi(c.Writer.Header().Get("RateLimit-Remaining")); err == nil && result.Allowed && prev <= result.Remaining {
+        return true
+    }
+    c.Header("RateLimit-Limit", strconv.Itoa(result.Limit))
+    c.Header("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+    c.Header("RateLimit-Reset", strconv.Itoa(ceilSeconds(result.Reset)))
+    c.Header("RateLimit-Policy", fmt.Sprintf("%d;w=%d", limit, ceilSeconds(window)))
+    if !result.Allowed {
+        c.Header("Retry-After", strconv.Itoa(ceilSeconds(result.RetryAfter)))
+    }
+    return result.Allowed
+}
 
-    rl.attempts[key] = append(valid, now)
-    return false
+func ceilSeconds(d time.Duration) int {
+    return int(math.Ceil(d.Seconds()))
 }
 
 // SecurityMonitor middleware для отслеживания подозрительной активности
@@ -0,0 +1,152 @@
+package middleware
+
+import (
+	"context"
+	"log"
+	"math"
+	"sync"
+	"time"
+
+	"subscription-system/database"
+)
+
+// RateLimitResult – решение лимитера и данные для заголовков RateLimit-*
+type RateLimitResult struct {
+	Allowed    bool
+	Limit      int
+	Remaining  int
+	Reset      time.Duration // через сколько бакет наполнится полностью
+	RetryAfter time.Duration // через сколько появится следующий токен (если запрос отклонён)
+}
+
+// RateLimitStore – хранилище бакетов. Ключ уже включает группу маршрутов и субъект
+// (пользователь, API-ключ или IP). Реализации должны быть атомарными по ключу,
+// чтобы несколько инстансов приложения делили один лимит.
+type RateLimitStore interface {
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error)
+}
+
+// takeToken пополняет бакет за прошедшее время и списывает один токен.
+// Бакет вмещает limit токенов и наполняется полностью за window.
+func takeToken(tokens float64, elapsed time.Duration, limit int, window time.Duration) (float64, bool) {
+	rate := float64(limit) / window.Seconds()
+	tokens = math.Min(float64(limit), tokens+elapsed.Seconds()*rate)
+	if tokens >= 1 {
+		return tokens - 1, true
+	}
+	return tokens, false
+}
+
+func newRateLimitResult(tokens float64, allowed bool, limit int, window time.Duration) RateLimitResult {
+	rate := float64(limit) / window.Seconds()
+	result := RateLimitResult{
+		Allowed:   allowed,
+		Limit:     limit,
+		Remaining: int(math.Floor(tokens)),
+		Reset:     time.Duration((float64(limit) - tokens) / rate * float64(time.Second)),
+	}
+	if !allowed {
+		result.RetryAfter = time.Duration((1 - tokens) / rate * float64(time.Second))
+	}
+	return result
+}
+
+// ========== IN-MEMORY ==========
+
+type memoryBucket struct {
+	tokens  float64
+	updated time.Time
+	window  time.Duration
+}
+
+// MemoryRateLimitStore – token bucket в памяти процесса (один инстанс или разработка)
+type MemoryRateLimitStore struct {
+	mu      sync.Mutex
+	buckets map[string]*memoryBucket
+}
+
+// NewMemoryRateLimitStore создаёт хранилище и запускает очистку простаивающих бакетов
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	s := &MemoryRateLimitStore{buckets: make(map[string]*memoryBucket)}
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+		for now := range ticker.C {
+			s.sweep(now)
+		}
+	}()
+	return s
+}
+
+func (s *MemoryRateLimitStore) Allow(_ context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{tokens: float64(limit), updated: now}
+		s.buckets[key] = b
+	}
+	var allowed bool
+	b.tokens, allowed = takeToken(b.tokens, now.Sub(b.updated), limit, window)
+	b.updated = now
+	b.window = window
+	return newRateLimitResult(b.tokens, allowed, limit, window), nil
+}
+
+// sweep удаляет бакеты, которые успели наполниться: они не отличаются от отсутствующих
+func (s *MemoryRateLimitStore) sweep(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, b := range s.buckets {
+		if now.Sub(b.updated) >= b.window {
+			delete(s.buckets, key)
+		}
+	}
+}
+
+// ========== POSTGRES ==========
+
+// PostgresRateLimitStore – общий для всех инстансов token bucket в таблице rate_limit_buckets.
+// Пополнение и списание выполняются одним UPSERT, поэтому гонок между инстансами нет.
+type PostgresRateLimitStore struct{}
+
+// NewPostgresRateLimitStore создаёт хранилище и запускает очистку старых бакетов
+func NewPostgresRateLimitStore() *PostgresRateLimitStore {
+	go func() {
+		ticker := time.NewTicker(10 * time.Minute)
+		defer ticker.Stop()
+		for range ticker.C {
+			_, err := database.Pool.Exec(context.Background(),
+				`DELETE FROM rate_limit_buckets WHERE updated_at < NOW() - INTERVAL '1 hour'`)
+			if err != nil {
+				log.Printf("⚠️ Ошибка очистки rate_limit_buckets: %v", err)
+			}
+		}
+	}()
+	return &PostgresRateLimitStore{}
+}
+
+// pgRefill – количество токенов после пополнения; в ON CONFLICT DO UPDATE
+// b.* ссылается на заблокированную текущую версию строки
+const pgRefill = `LEAST($2::float8, b.tokens + EXTRACT(EPOCH FROM clock_timestamp() - b.updated_at)::float8 * $3::float8)`
+
+func (s *PostgresRateLimitStore) Allow(ctx context.Context, key string, limit int, window time.Duration) (RateLimitResult, error) {
+	rate := float64(limit) / window.Seconds()
+	var tokens float64
+	var allowed bool
+	err := database.Pool.QueryRow(ctx, `
+		INSERT INTO rate_limit_buckets AS b (key, tokens, allowed, updated_at)
+		VALUES ($1, $2::float8 - 1, true, clock_timestamp())
+		ON CONFLICT (key) DO UPDATE SET
+			tokens = CASE WHEN `+pgRefill+` >= 1 THEN `+pgRefill+` - 1 ELSE `+pgRefill+` END,
+			allowed = `+pgRefill+` >= 1,
+			updated_at = clock_timestamp()
+		RETURNING b.tokens, b.allowed
+	`, key, float64(limit), rate).Scan(&tokens, &allowed)
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+	return newRateLimitResult(tokens, allowed, limit, window), nil
+}
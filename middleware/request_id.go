@@ -0,0 +1,39 @@
+package middleware
+
+import (
+    "github.com/gin-gonic/gin"
+    "github.com/google/uuid"
+    "go.opentelemetry.io/otel/attribute"
+    "go.opentelemetry.io/otel/trace"
+)
+
+// RequestIDHeader – заголовок, в котором передаётся и возвращается ID запроса
+const RequestIDHeader = "X-Request-ID"
+
+// RequestID берёт ID запроса из X-Request-ID (или генерирует новый),
+// сохраняет его в контексте и возвращает клиенту
+func RequestID() gin.HandlerFunc {
+    return func(c *gin.Context) {
+        requestID := c.GetHeader(RequestIDHeader)
+        if !validRequestID(requestID) {
+            requestID = uuid.New().String()
+        }
+        c.Set("requestID", requestID)
+        c.Header(RequestIDHeader, requestID)
+        trace.SpanFromContext(c.Request.Context()).SetAttributes(attribute.String("request.id", requestID))
+        c.Next()
+    }
+}
+
+// validRequestID пропускает только короткие печатные ASCII-идентификаторы, чтобы в логи не попал мусор
+func validRequestID(id string) bool {
+    if id == "" || len(id) > 128 {
+        return false
+    }
+    for _, r := range id {
+        if r < 0x21 || r > 0x7e {
+            return false
+        }
+    }
+    return true
+}
@@ -1,6 +1,8 @@
 package models
 
 import (
+	"context"
+	"strings"
 	"time"
 )
 
@@ -24,7 +26,7 @@ type AIAgentAction struct {
 	ID        string                 `json:"id" db:"id"`
 	AgentID   string                 `json:"agent_id" db:"agent_id"`
 	Action    string                 `json:"action" db:"action"`
-	Condition string                 `json:"condition" db:"condition"`
+	Condition string                 `json:"condition" db:"condition"` // view:<id> или JSON-фильтр CRM, пусто – всегда
 	Config    map[string]interface{} `json:"config" db:"config"`
 	IsActive  bool                   `json:"is_active" db:"is_active"`
 	CreatedAt time.Time              `json:"created_at" db:"created_at"`
@@ -40,4 +42,30 @@ type AIAgentLog struct {
 	Result     string    `json:"result" db:"result"`
 	Status     string    `json:"status" db:"status"`
 	CreatedAt  time.Time `json:"created_at" db:"created_at"`
-}
\ No newline at end of file
+}
+// AgentConditionViewPrefix – условие "view:<id>" ссылается на сохранённое представление
+const AgentConditionViewPrefix = "view:"
+
+// MatchesCondition проверяет, подходит ли запись CRM (entity – customer или deal) под условие действия:
+// сохранённое представление той же сущности или фильтр на языке фильтров CRM
+func (a *AIAgentAction) MatchesCondition(ctx context.Context, entity, id string) (bool, error) {
+	condition := strings.TrimSpace(a.Condition)
+	if condition == "" {
+		return true, nil
+	}
+	if viewID, ok := strings.CutPrefix(condition, AgentConditionViewPrefix); ok {
+		view, err := GetSavedView(ctx, strings.TrimSpace(viewID))
+		if err != nil {
+			return false, err
+		}
+		if view.EntityType != entity {
+			return false, nil
+		}
+		return EntityMatchesFilter(ctx, entity, view.Filter, id)
+	}
+	filter, err := ParseCRMFilter([]byte(condition))
+	if err != nil {
+		return false, err
+	}
+	return EntityMatchesFilter(ctx, entity, filter, id)
+}
@@ -0,0 +1,874 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Оповещения по дневным метрикам сервиса. Метрики считаются при проверке прямо по рабочим таблицам
+// (payments, users, user_subscriptions), поэтому отдельного расчёта ждать не нужно.
+// Правило задаёт метрику и способ проверки:
+//   - threshold – значение выше или ниже заданной границы;
+//   - zscore – отклонение от среднего за последние N дней в стандартных отклонениях;
+//   - seasonal – отклонение от медианы того же дня недели за последние N недель (MAD).
+//
+// Проверяется последний закончившийся день; дни без платежей или регистраций считаются нулевыми
+// (метрики – дневные суммы). На правило приходится не больше
+// одного незакрытого оповещения: повторные нарушения обновляют его, а не создают новое.
+// Оповещение можно отложить (snooze) и закрыть вручную; когда значение возвращается в норму,
+// оно закрывается само.
+
+var (
+	ErrAlertRuleNotFound = errors.New("alert rule not found")
+	ErrAlertNotFound     = errors.New("alert not found")
+	ErrInvalidAlertRule  = errors.New("invalid alert rule")
+	ErrAlertResolved     = errors.New("alert is already resolved")
+)
+
+// Метрики
+const (
+	AlertMetricRevenue             = "revenue"
+	AlertMetricNewCustomers        = "new_customers"
+	AlertMetricSignups             = "signups"
+	AlertMetricActiveSubscriptions = "active_subscriptions"
+)
+
+// Способы проверки
+const (
+	AlertKindThreshold = "threshold"
+	AlertKindZScore    = "zscore"
+	AlertKindSeasonal  = "seasonal"
+)
+
+// Направление нарушения
+const (
+	AlertDirectionAbove = "above"
+	AlertDirectionBelow = "below"
+	AlertDirectionBoth  = "both"
+)
+
+// Важность
+const (
+	AlertSeverityInfo     = "info"
+	AlertSeverityWarning  = "warning"
+	AlertSeverityCritical = "critical"
+)
+
+// Статусы оповещения
+const (
+	AlertStatusOpen     = "open"
+	AlertStatusSnoozed  = "snoozed"
+	AlertStatusResolved = "resolved"
+)
+
+// Как закрыто оповещение
+const (
+	AlertResolutionManual = "manual"
+	AlertResolutionAuto   = "auto"
+)
+
+// Каналы уведомления владельца правила
+const (
+	AlertChannelTelegram = "telegram"
+	AlertChannelEmail    = "email"
+)
+
+// Событие жизненного цикла, о котором нужно уведомить
+const (
+	AlertEventFired    = "fired"
+	AlertEventResolved = "resolved"
+)
+
+const (
+	alertNameMaxLen = 255
+	// alertDefaultSigmas – допустимое отклонение по умолчанию для zscore и seasonal
+	alertDefaultSigmas = 3
+	alertMaxSigmas     = 10
+	alertMinPoints     = 3
+	// alertMaxScore – ограничение оценки, когда история почти без разброса
+	alertMaxScore = 1000
+	// alertMADScale приводит MAD к стандартному отклонению нормального распределения
+	alertMADScale = 1.4826
+	// alertMoneyNoise – минимальный разброс денежной метрики относительно ожидаемого
+	alertMoneyNoise = 0.01
+	alertDateLayout = "2006-01-02"
+)
+
+// AlertMetric – метрика, за которой можно следить
+type AlertMetric struct {
+	Code  string `json:"code"`
+	Name  string `json:"name"`
+	Money bool   `json:"money"`
+}
+
+// AlertMetrics – метрики, за которыми можно следить
+var AlertMetrics = []AlertMetric{
+	{AlertMetricRevenue, "Выручка за день", true},
+	{AlertMetricNewCustomers, "Новые плательщики за день", false},
+	{AlertMetricSignups, "Регистрации за день", false},
+	{AlertMetricActiveSubscriptions, "Активные подписки на конец дня", false},
+}
+
+// alertMetricSource – запросы метрики: first – первый день с данными, series – значения
+// по дням в диапазоне $1..$2 (дни без строки считаются нулевыми)
+type alertMetricSource struct {
+	first  string
+	series string
+}
+
+// alertPaidAt – момент оплаты платежа
+const alertPaidAt = `COALESCE(completed_at, created_at)`
+
+var alertMetricSources = map[string]alertMetricSource{
+	AlertMetricRevenue: {
+		first: `SELECT MIN(` + alertPaidAt + `)::date FROM payments WHERE status = 'completed'`,
+		series: `SELECT TO_CHAR(` + alertPaidAt + `::date, 'YYYY-MM-DD'), SUM(amount)::float8 FROM payments
+			WHERE status = 'completed' AND ` + alertPaidAt + ` >= $1::date AND ` + alertPaidAt + ` < $2::date + 1
+			GROUP BY 1`,
+	},
+	// Новый плательщик – пользователь, чей первый успешный платёж пришёлся на этот день
+	AlertMetricNewCustomers: {
+		first: `SELECT MIN(` + alertPaidAt + `)::date FROM payments WHERE status = 'completed'`,
+		series: `SELECT TO_CHAR(first_day, 'YYYY-MM-DD'), COUNT(*)::float8 FROM (
+				SELECT MIN(` + alertPaidAt + `)::date AS first_day FROM payments WHERE status = 'completed' GROUP BY user_id
+			) f WHERE first_day BETWEEN $1::date AND $2::date
+			GROUP BY first_day`,
+	},
+	AlertMetricSignups: {
+		first: `SELECT MIN(created_at)::date FROM users`,
+		series: `SELECT TO_CHAR(created_at::date, 'YYYY-MM-DD'), COUNT(*)::float8 FROM users
+			WHERE created_at >= $1::date AND created_at < $2::date + 1
+			GROUP BY 1`,
+	},
+	// Подписка активна на конец дня, если оформлена раньше и ещё не закончилась: действующая
+	// без отмены – до сих пор, отменённая в конце периода – до конца периода, остальные – до
+	// последнего изменения статуса
+	AlertMetricActiveSubscriptions: {
+		first: `SELECT MIN(created_at)::date FROM user_subscriptions`,
+		series: `SELECT TO_CHAR(d, 'YYYY-MM-DD'), COUNT(s.id)::float8
+			FROM generate_series($1::date, $2::date, interval '1 day') d
+			LEFT JOIN user_subscriptions s ON s.created_at < d::date + 1 AND CASE
+				WHEN s.status IN ('active', 'past_due') AND NOT COALESCE(s.cancel_at_period_end, false) THEN TRUE
+				WHEN s.status IN ('active', 'past_due') THEN s.current_period_end >= d::date + 1
+				ELSE LEAST(s.updated_at, s.current_period_end) >= d::date + 1
+			END
+			GROUP BY d`,
+	},
+}
+
+// FindAlertMetric – метрика по коду; nil, если такой нет
+func FindAlertMetric(code string) *AlertMetric {
+	for i := range AlertMetrics {
+		if AlertMetrics[i].Code == code {
+			return &AlertMetrics[i]
+		}
+	}
+	return nil
+}
+
+// AlertRule – правило оповещения. Threshold – граница значения для threshold и допустимое
+// отклонение (в сигмах) для zscore и seasonal. WindowDays – дней истории для zscore и недель
+// для seasonal. AccountID не используется: метрики считаются по всему сервису.
+type AlertRule struct {
+	ID              string     `json:"id"`
+	UserID          string     `json:"user_id"`
+	AccountID       *string    `json:"account_id"`
+	Name            string     `json:"name"`
+	Metric          string     `json:"metric"`
+	Kind            string     `json:"kind"`
+	Direction       string     `json:"direction"`
+	Threshold       float64    `json:"threshold"`
+	WindowDays      int        `json:"window_days"`
+	MinPoints       int        `json:"min_points"`
+	Severity        string     `json:"severity"`
+	Channels        []string   `json:"channels"`
+	Enabled         bool       `json:"enabled"`
+	LastEvaluatedAt *time.Time `json:"last_evaluated_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// Alert – оповещение по правилу. Expected и Score есть только у статистических правил.
+type Alert struct {
+	ID              string     `json:"id"`
+	RuleID          string     `json:"rule_id"`
+	RuleName        string     `json:"rule_name"`
+	Metric          string     `json:"metric"`
+	Severity        string     `json:"severity"`
+	Status          string     `json:"status"`
+	FirstMetricDate string     `json:"first_metric_date"`
+	LastMetricDate  string     `json:"last_metric_date"`
+	Value           float64    `json:"value"`
+	Expected        *float64   `json:"expected"`
+	Score           *float64   `json:"score"`
+	Occurrences     int        `json:"occurrences"`
+	Message         string     `json:"message"`
+	SnoozedUntil    *time.Time `json:"snoozed_until"`
+	ResolvedAt      *time.Time `json:"resolved_at"`
+	ResolvedBy      *string    `json:"resolved_by"`
+	Resolution      *string    `json:"resolution"`
+	NotifiedAt      *time.Time `json:"notified_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// AlertEvaluation – результат проверки правила за один день. Lower и Upper – границы нормы.
+// InsufficientData – истории меньше MinPoints или по метрике ещё нет данных: правило молчит.
+type AlertEvaluation struct {
+	MetricDate       string   `json:"metric_date"`
+	Value            float64  `json:"value"`
+	Expected         *float64 `json:"expected"`
+	Lower            *float64 `json:"lower"`
+	Upper            *float64 `json:"upper"`
+	Score            *float64 `json:"score"`
+	Points           int      `json:"points"`
+	Breached         bool     `json:"breached"`
+	InsufficientData bool     `json:"insufficient_data"`
+	Message          string   `json:"message"`
+}
+
+// AlertTransition – изменение оповещения после проверки; Event пустой, если уведомлять не о чем
+type AlertTransition struct {
+	Alert *Alert
+	Event string
+}
+
+func invalidAlertf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidAlertRule, fmt.Sprintf(format, args...))
+}
+
+// Normalize проверяет правило и подставляет значения по умолчанию для его способа проверки
+func (r *AlertRule) Normalize() error {
+	metric := FindAlertMetric(r.Metric)
+	if metric == nil {
+		return invalidAlertf("unknown metric %q", r.Metric)
+	}
+	r.Name = strings.TrimSpace(r.Name)
+	if r.Name == "" {
+		r.Name = metric.Name
+	}
+	if len([]rune(r.Name)) > alertNameMaxLen {
+		return invalidAlertf("name is longer than %d characters", alertNameMaxLen)
+	}
+	if r.AccountID != nil {
+		if strings.TrimSpace(*r.AccountID) != "" {
+			return invalidAlertf("account_id is not supported: metrics are computed for the whole service")
+		}
+		r.AccountID = nil
+	}
+	if r.Direction == "" {
+		r.Direction = AlertDirectionBelow
+	}
+	if r.Direction != AlertDirectionAbove && r.Direction != AlertDirectionBelow && r.Direction != AlertDirectionBoth {
+		return invalidAlertf("direction must be above, below or both")
+	}
+	if math.IsNaN(r.Threshold) || math.IsInf(r.Threshold, 0) {
+		return invalidAlertf("threshold must be a finite number")
+	}
+
+	switch r.Kind {
+	case AlertKindThreshold:
+		if r.Direction == AlertDirectionBoth {
+			return invalidAlertf("threshold rule direction must be above or below")
+		}
+		r.WindowDays, r.MinPoints = 0, 0
+	case AlertKindZScore, AlertKindSeasonal:
+		minWindow, maxWindow, defWindow, defPoints := 7, 365, 28, 7
+		if r.Kind == AlertKindSeasonal {
+			minWindow, maxWindow, defWindow, defPoints = alertMinPoints, 52, 8, 4
+		}
+		if r.Threshold == 0 {
+			r.Threshold = alertDefaultSigmas
+		}
+		if r.Threshold < 0 || r.Threshold > alertMaxSigmas {
+			return invalidAlertf("threshold for %s must be between 0 and %d sigmas", r.Kind, alertMaxSigmas)
+		}
+		if r.WindowDays == 0 {
+			r.WindowDays = defWindow
+		}
+		if r.WindowDays < minWindow || r.WindowDays > maxWindow {
+			return invalidAlertf("window_days for %s must be between %d and %d", r.Kind, minWindow, maxWindow)
+		}
+		if r.MinPoints == 0 {
+			r.MinPoints = defPoints
+			if r.MinPoints > r.WindowDays {
+				r.MinPoints = r.WindowDays
+			}
+		}
+		if r.MinPoints < alertMinPoints || r.MinPoints > r.WindowDays {
+			return invalidAlertf("min_points must be between %d and window_days", alertMinPoints)
+		}
+	default:
+		return invalidAlertf("kind must be threshold, zscore or seasonal")
+	}
+
+	switch r.Severity {
+	case AlertSeverityInfo, AlertSeverityWarning, AlertSeverityCritical:
+	case "":
+		r.Severity = AlertSeverityWarning
+	default:
+		return invalidAlertf("severity must be info, warning or critical")
+	}
+	if r.Channels == nil {
+		r.Channels = []string{AlertChannelTelegram, AlertChannelEmail}
+	}
+	channels := []string{}
+	for _, ch := range r.Channels {
+		ch = strings.ToLower(strings.TrimSpace(ch))
+		if ch != AlertChannelTelegram && ch != AlertChannelEmail {
+			return invalidAlertf("channel must be telegram or email")
+		}
+		if !containsString(channels, ch) {
+			channels = append(channels, ch)
+		}
+	}
+	r.Channels = channels
+	return nil
+}
+
+// Evaluate проверяет значение дня по истории. history – предыдущие значения (для seasonal –
+// тот же день недели прошлых недель), уже без дней до появления метрики.
+func (r *AlertRule) Evaluate(day string, value float64, history []float64) AlertEvaluation {
+	ev := AlertEvaluation{MetricDate: day, Value: value, Points: len(history)}
+	if r.Kind == AlertKindThreshold {
+		bound := r.Threshold
+		if r.Direction == AlertDirectionAbove {
+			ev.Upper = &bound
+			ev.Breached = value > bound
+		} else {
+			ev.Lower = &bound
+			ev.Breached = value < bound
+		}
+		ev.Message = r.describe(ev)
+		return ev
+	}
+	if len(history) < r.MinPoints {
+		ev.InsufficientData = true
+		ev.Message = fmt.Sprintf("Недостаточно истории: %d из %d точек", len(history), r.MinPoints)
+		return ev
+	}
+
+	center, spread := mean(history), stdDev(history)
+	if r.Kind == AlertKindSeasonal {
+		center = median(history)
+		deviations := make([]float64, len(history))
+		for i, v := range history {
+			deviations[i] = math.Abs(v - center)
+		}
+		if mad := median(deviations) * alertMADScale; mad > 0 {
+			spread = mad
+		}
+	}
+	// Нижняя граница разброса: у счётчиков – пуассоновский шум √n (не меньше 1), у денег – 1%
+	// ожидаемого. Иначе после ровной истории срабатывал бы любой лишний клиент.
+	if metric := FindAlertMetric(r.Metric); metric != nil && metric.Money {
+		spread = math.Max(spread, math.Abs(center)*alertMoneyNoise)
+	} else {
+		spread = math.Max(spread, math.Max(math.Sqrt(math.Abs(center)), 1))
+	}
+	score := 0.0
+	if spread > 0 {
+		score = (value - center) / spread
+	} else if value != center {
+		// История без разброса: любое отличие – аномалия
+		score = math.Copysign(alertMaxScore, value-center)
+	}
+	score = math.Max(-alertMaxScore, math.Min(alertMaxScore, score))
+	lower, upper := center-r.Threshold*spread, center+r.Threshold*spread
+	ev.Expected, ev.Score = &center, &score
+	if r.Direction != AlertDirectionAbove {
+		ev.Lower = &lower
+	}
+	if r.Direction != AlertDirectionBelow {
+		ev.Upper = &upper
+	}
+	switch r.Direction {
+	case AlertDirectionAbove:
+		ev.Breached = score > r.Threshold
+	case AlertDirectionBelow:
+		ev.Breached = score < -r.Threshold
+	default:
+		ev.Breached = math.Abs(score) > r.Threshold
+	}
+	ev.Message = r.describe(ev)
+	return ev
+}
+
+// describe – текст результата проверки для оповещения
+func (r *AlertRule) describe(ev AlertEvaluation) string {
+	metric := FindAlertMetric(r.Metric)
+	name := r.Metric
+	if metric != nil {
+		name = metric.Name
+	}
+	state := "в норме"
+	if ev.Breached {
+		state = "вне нормы"
+	}
+	text := fmt.Sprintf("%s, %s: %s – %s", name, ev.MetricDate, formatAlertNumber(ev.Value), state)
+	switch {
+	case ev.Lower != nil && ev.Upper != nil:
+		text += fmt.Sprintf(" (норма %s – %s", formatAlertNumber(*ev.Lower), formatAlertNumber(*ev.Upper))
+	case ev.Lower != nil:
+		text += fmt.Sprintf(" (нижняя граница %s", formatAlertNumber(*ev.Lower))
+	case ev.Upper != nil:
+		text += fmt.Sprintf(" (верхняя граница %s", formatAlertNumber(*ev.Upper))
+	}
+	if ev.Expected != nil && ev.Score != nil {
+		text += fmt.Sprintf(", ожидалось %s, отклонение %.1fσ", formatAlertNumber(*ev.Expected), *ev.Score)
+	}
+	if ev.Lower != nil || ev.Upper != nil {
+		text += ")"
+	}
+	return text
+}
+
+func formatAlertNumber(v float64) string {
+	return strconv.FormatFloat(roundMoney(v), 'f', -1, 64)
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sum := 0.0
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// stdDev – выборочное стандартное отклонение
+func stdDev(values []float64) float64 {
+	if len(values) < 2 {
+		return 0
+	}
+	m, sum := mean(values), 0.0
+	for _, v := range values {
+		sum += (v - m) * (v - m)
+	}
+	return math.Sqrt(sum / float64(len(values)-1))
+}
+
+func median(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// EvaluateAlertRule проверяет правило, ничего не меняя. Проверяется вчерашний день: сегодняшний
+// ещё не закончился, и его неполная выручка выглядела бы как падение.
+func EvaluateAlertRule(ctx context.Context, r *AlertRule) (*AlertEvaluation, error) {
+	src, ok := alertMetricSources[r.Metric]
+	if !ok {
+		return nil, invalidAlertf("unknown metric %q", r.Metric)
+	}
+	anchor := time.Now().AddDate(0, 0, -1)
+	anchor = time.Date(anchor.Year(), anchor.Month(), anchor.Day(), 0, 0, 0, 0, time.UTC)
+	day := anchor.Format(alertDateLayout)
+	var firstDate *time.Time
+	if err := database.Pool.QueryRow(ctx, src.first).Scan(&firstDate); err != nil {
+		return nil, err
+	}
+	if firstDate == nil || firstDate.Format(alertDateLayout) > day {
+		// Данных ещё нет – молчим, а не сообщаем о нулях
+		return &AlertEvaluation{MetricDate: day, InsufficientData: true, Message: "По метрике ещё нет данных"}, nil
+	}
+	first := firstDate.Format(alertDateLayout)
+
+	from := anchor
+	switch r.Kind {
+	case AlertKindZScore:
+		from = anchor.AddDate(0, 0, -r.WindowDays)
+	case AlertKindSeasonal:
+		from = anchor.AddDate(0, 0, -7*r.WindowDays)
+	}
+	if first > from.Format(alertDateLayout) {
+		from = time.Date(firstDate.Year(), firstDate.Month(), firstDate.Day(), 0, 0, 0, 0, time.UTC)
+	}
+	rows, err := database.Pool.Query(ctx, src.series, from.Format(alertDateLayout), day)
+	if err != nil {
+		return nil, err
+	}
+	values := map[string]float64{}
+	for rows.Next() {
+		var d string
+		var v float64
+		if err := rows.Scan(&d, &v); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		values[d] = v
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	step := 1
+	if r.Kind == AlertKindSeasonal {
+		step = 7
+	}
+	var history []float64
+	for d := anchor.AddDate(0, 0, -step); !d.Before(from); d = d.AddDate(0, 0, -step) {
+		history = append(history, values[d.Format(alertDateLayout)])
+	}
+	ev := r.Evaluate(day, values[day], history)
+	return &ev, nil
+}
+
+const alertRuleColumns = `id, user_id::text, account_id, name, metric, kind, direction, threshold, window_days,
+	min_points, severity, channels, enabled, last_evaluated_at, created_at, updated_at`
+
+func scanAlertRule(row pgx.Row) (*AlertRule, error) {
+	var r AlertRule
+	err := row.Scan(&r.ID, &r.UserID, &r.AccountID, &r.Name, &r.Metric, &r.Kind, &r.Direction, &r.Threshold, &r.WindowDays,
+		&r.MinPoints, &r.Severity, &r.Channels, &r.Enabled, &r.LastEvaluatedAt, &r.CreatedAt, &r.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if r.Channels == nil {
+		r.Channels = []string{}
+	}
+	return &r, nil
+}
+
+// CreateAlertRule сохраняет проверенное (Normalize) правило
+func CreateAlertRule(ctx context.Context, r *AlertRule) error {
+	saved, err := scanAlertRule(database.Pool.QueryRow(ctx, `
+		INSERT INTO analytics_alert_rules (user_id, account_id, name, metric, kind, direction, threshold,
+			window_days, min_points, severity, channels, enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING `+alertRuleColumns,
+		r.UserID, r.AccountID, r.Name, r.Metric, r.Kind, r.Direction, r.Threshold,
+		r.WindowDays, r.MinPoints, r.Severity, r.Channels, r.Enabled))
+	if err != nil {
+		return err
+	}
+	*r = *saved
+	return nil
+}
+
+func GetAlertRule(ctx context.Context, id string) (*AlertRule, error) {
+	r, err := scanAlertRule(database.Pool.QueryRow(ctx, `
+		SELECT `+alertRuleColumns+` FROM analytics_alert_rules WHERE id::text = $1
+	`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAlertRuleNotFound
+	}
+	return r, err
+}
+
+// ListAlertRules – правила, новые сначала
+func ListAlertRules(ctx context.Context, limit, offset int) ([]*AlertRule, int, error) {
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM analytics_alert_rules`).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+alertRuleColumns+` FROM analytics_alert_rules
+		ORDER BY created_at DESC
+		LIMIT $1 OFFSET $2
+	`, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	list, err := collectAlertRules(rows)
+	return list, total, err
+}
+
+// EnabledAlertRules – включённые правила для планировщика
+func EnabledAlertRules(ctx context.Context) ([]*AlertRule, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+alertRuleColumns+` FROM analytics_alert_rules WHERE enabled ORDER BY created_at
+	`)
+	if err != nil {
+		return nil, err
+	}
+	return collectAlertRules(rows)
+}
+
+func collectAlertRules(rows pgx.Rows) ([]*AlertRule, error) {
+	defer rows.Close()
+	list := []*AlertRule{}
+	for rows.Next() {
+		r, err := scanAlertRule(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, r)
+	}
+	return list, rows.Err()
+}
+
+// UpdateAlertRule сохраняет проверенное (Normalize) правило. Незакрытое оповещение остаётся:
+// следующая проверка по новым условиям закроет его или обновит.
+func UpdateAlertRule(ctx context.Context, r *AlertRule) error {
+	saved, err := scanAlertRule(database.Pool.QueryRow(ctx, `
+		UPDATE analytics_alert_rules SET account_id = $2, name = $3, metric = $4, kind = $5, direction = $6,
+			threshold = $7, window_days = $8, min_points = $9, severity = $10, channels = $11, enabled = $12,
+			updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+alertRuleColumns,
+		r.ID, r.AccountID, r.Name, r.Metric, r.Kind, r.Direction,
+		r.Threshold, r.WindowDays, r.MinPoints, r.Severity, r.Channels, r.Enabled))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrAlertRuleNotFound
+	}
+	if err != nil {
+		return err
+	}
+	*r = *saved
+	return nil
+}
+
+// DeleteAlertRule удаляет правило вместе с его оповещениями
+func DeleteAlertRule(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM analytics_alert_rules WHERE id::text = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrAlertRuleNotFound
+	}
+	return nil
+}
+
+// AlertOwnerContacts – почта и чат Telegram владельца правила
+func AlertOwnerContacts(ctx context.Context, userID string) (string, *int64, error) {
+	var email string
+	var telegramID *int64
+	err := database.Pool.QueryRow(ctx, `SELECT email, telegram_id FROM users WHERE id::text = $1`, userID).Scan(&email, &telegramID)
+	return email, telegramID, err
+}
+
+const alertColumns = `a.id, a.rule_id, r.name, r.metric, r.severity, a.status,
+	TO_CHAR(a.first_metric_date, 'YYYY-MM-DD'), TO_CHAR(a.last_metric_date, 'YYYY-MM-DD'), a.value, a.expected, a.score,
+	a.occurrences, a.message, a.snoozed_until, a.resolved_at, a.resolved_by::text, a.resolution, a.notified_at,
+	a.created_at, a.updated_at`
+
+func scanAlert(row pgx.Row) (*Alert, error) {
+	var a Alert
+	err := row.Scan(&a.ID, &a.RuleID, &a.RuleName, &a.Metric, &a.Severity, &a.Status,
+		&a.FirstMetricDate, &a.LastMetricDate, &a.Value, &a.Expected, &a.Score,
+		&a.Occurrences, &a.Message, &a.SnoozedUntil, &a.ResolvedAt, &a.ResolvedBy, &a.Resolution, &a.NotifiedAt,
+		&a.CreatedAt, &a.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &a, nil
+}
+
+func getAlert(ctx context.Context, q pgx.Tx, id string) (*Alert, error) {
+	a, err := scanAlert(q.QueryRow(ctx, `
+		SELECT `+alertColumns+` FROM analytics_alerts a JOIN analytics_alert_rules r ON r.id = a.rule_id
+		WHERE a.id = $1
+	`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAlertNotFound
+	}
+	return a, err
+}
+
+func GetAlert(ctx context.Context, id string) (*Alert, error) {
+	a, err := scanAlert(database.Pool.QueryRow(ctx, `
+		SELECT `+alertColumns+` FROM analytics_alerts a JOIN analytics_alert_rules r ON r.id = a.rule_id
+		WHERE a.id::text = $1
+	`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrAlertNotFound
+	}
+	return a, err
+}
+
+// ListAlerts – оповещения, новые сначала; status и ruleID необязательны.
+// Отложенные, у которых срок прошёл, показываются как есть до следующей проверки.
+func ListAlerts(ctx context.Context, status, ruleID string, limit, offset int) ([]*Alert, int, error) {
+	where := `($1 = '' OR a.status = $1) AND ($2 = '' OR a.rule_id::text = $2)`
+	var total int
+	if err := database.Pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM analytics_alerts a WHERE `+where, status, ruleID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+alertColumns+` FROM analytics_alerts a JOIN analytics_alert_rules r ON r.id = a.rule_id
+		WHERE `+where+`
+		ORDER BY a.created_at DESC
+		LIMIT $3 OFFSET $4
+	`, status, ruleID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []*Alert{}
+	for rows.Next() {
+		a, err := scanAlert(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, a)
+	}
+	return list, total, rows.Err()
+}
+
+// SnoozeAlert откладывает незакрытое оповещение до until: нарушения до этого времени
+// не уведомляют, а если к сроку метрика не вернулась в норму – оповещение откроется снова
+func SnoozeAlert(ctx context.Context, id string, until time.Time) (*Alert, error) {
+	return updateActiveAlert(ctx, id, `status = 'snoozed', snoozed_until = $2`, until)
+}
+
+// ResolveAlert закрывает оповещение вручную. Пока не появятся данные за следующий день,
+// правило по нему не сработает снова.
+func ResolveAlert(ctx context.Context, id, userID string) (*Alert, error) {
+	return updateActiveAlert(ctx, id, `status = 'resolved', snoozed_until = NULL, resolved_at = NOW(),
+		resolved_by = $2::uuid, resolution = 'manual'`, userID)
+}
+
+func updateActiveAlert(ctx context.Context, id, set string, arg interface{}) (*Alert, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	var alertID string
+	err = tx.QueryRow(ctx, `
+		UPDATE analytics_alerts SET `+set+`, updated_at = NOW()
+		WHERE id::text = $1 AND status <> 'resolved'
+		RETURNING id
+	`, id, arg).Scan(&alertID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		if _, err := GetAlert(ctx, id); err != nil {
+			return nil, err
+		}
+		return nil, ErrAlertResolved
+	}
+	if err != nil {
+		return nil, err
+	}
+	a, err := getAlert(ctx, tx, alertID)
+	if err != nil {
+		return nil, err
+	}
+	return a, tx.Commit(ctx)
+}
+
+// ApplyAlertEvaluation переводит оповещение правила по результату проверки:
+//   - нарушение без незакрытого оповещения – новое оповещение (кроме дня, закрытого вручную);
+//   - нарушение при открытом или ещё отложенном – обновление без повторного уведомления;
+//   - нарушение после срока откладывания – оповещение открывается и уведомляет снова;
+//   - значение в норме – незакрытое оповещение закрывается автоматически.
+//
+// Правило блокируется на время перехода, поэтому параллельные проверки не дублируют оповещения.
+func ApplyAlertEvaluation(ctx context.Context, rule *AlertRule, ev *AlertEvaluation, now time.Time) (*AlertTransition, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	tag, err := tx.Exec(ctx, `
+		UPDATE analytics_alert_rules SET last_evaluated_at = $2 WHERE id = $1
+	`, rule.ID, now)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil, ErrAlertRuleNotFound
+	}
+	rule.LastEvaluatedAt = &now
+	if ev.InsufficientData {
+		return &AlertTransition{}, tx.Commit(ctx)
+	}
+
+	var activeID, status, lastDate string
+	var snoozedUntil *time.Time
+	err = tx.QueryRow(ctx, `
+		SELECT id, status, TO_CHAR(last_metric_date, 'YYYY-MM-DD'), snoozed_until
+		FROM analytics_alerts WHERE rule_id = $1 AND status <> 'resolved'
+		FOR UPDATE
+	`, rule.ID).Scan(&activeID, &status, &lastDate, &snoozedUntil)
+	hasActive := err == nil
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+
+	t := &AlertTransition{}
+	switch {
+	case ev.Breached && hasActive:
+		if ev.MetricDate < lastDate {
+			break
+		}
+		reopen := status == AlertStatusSnoozed && snoozedUntil != nil && !snoozedUntil.After(now)
+		if _, err := tx.Exec(ctx, `
+			UPDATE analytics_alerts SET last_metric_date = $2::date, value = $3, expected = $4, score = $5, message = $6,
+				occurrences = occurrences + CASE WHEN last_metric_date < $2::date THEN 1 ELSE 0 END,
+				status = CASE WHEN $7 THEN 'open' ELSE status END,
+				snoozed_until = CASE WHEN $7 THEN NULL ELSE snoozed_until END,
+				notified_at = CASE WHEN $7 THEN $8 ELSE notified_at END,
+				updated_at = NOW()
+			WHERE id = $1
+		`, activeID, ev.MetricDate, ev.Value, ev.Expected, ev.Score, ev.Message, reopen, now); err != nil {
+			return nil, err
+		}
+		if reopen {
+			t.Event = AlertEventFired
+		}
+		if t.Alert, err = getAlert(ctx, tx, activeID); err != nil {
+			return nil, err
+		}
+	case ev.Breached:
+		var suppressed bool
+		if err := tx.QueryRow(ctx, `
+			SELECT EXISTS (
+				SELECT 1 FROM analytics_alerts
+				WHERE rule_id = $1 AND resolution = 'manual' AND last_metric_date >= $2::date
+			)
+		`, rule.ID, ev.MetricDate).Scan(&suppressed); err != nil {
+			return nil, err
+		}
+		if suppressed {
+			break
+		}
+		var id string
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO analytics_alerts (rule_id, first_metric_date, last_metric_date, value, expected, score, message, notified_at)
+			VALUES ($1, $2::date, $2::date, $3, $4, $5, $6, $7)
+			RETURNING id
+		`, rule.ID, ev.MetricDate, ev.Value, ev.Expected, ev.Score, ev.Message, now).Scan(&id); err != nil {
+			return nil, err
+		}
+		t.Event = AlertEventFired
+		if t.Alert, err = getAlert(ctx, tx, id); err != nil {
+			return nil, err
+		}
+	case hasActive && ev.MetricDate >= lastDate:
+		if _, err := tx.Exec(ctx, `
+			UPDATE analytics_alerts SET status = 'resolved', snoozed_until = NULL, resolved_at = $2,
+				resolution = 'auto', message = $3, updated_at = NOW()
+			WHERE id = $1
+		`, activeID, now, ev.Message); err != nil {
+			return nil, err
+		}
+		t.Event = AlertEventResolved
+		if t.Alert, err = getAlert(ctx, tx, activeID); err != nil {
+			return nil, err
+		}
+	}
+	return t, tx.Commit(ctx)
+}
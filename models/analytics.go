@@ -26,18 +26,6 @@ type AnalyticsCohort struct {
 	Revenue       float64   `json:"revenue" db:"revenue"`
 }
 
-// ChurnPrediction - прогноз оттока
-type ChurnPrediction struct {
-	ID               string                 `json:"id" db:"id"`
-	AccountID        string                 `json:"account_id" db:"account_id"`
-	CustomerID       string                 `json:"customer_id" db:"customer_id"`
-	ChurnProbability float64                `json:"churn_probability" db:"churn_probability"`
-	RiskLevel        string                 `json:"risk_level" db:"risk_level"`
-	Factors          map[string]interface{} `json:"factors" db:"factors"`
-	PredictedDate    time.Time              `json:"predicted_date" db:"predicted_date"`
-	CreatedAt        time.Time              `json:"created_at" db:"created_at"`
-}
-
 // RFMAnalysis - RFM-анализ (Recency, Frequency, Monetary)
 type RFMAnalysis struct {
 	CustomerID    string  `json:"customer_id"`
@@ -3,49 +3,268 @@ package models
 import (
 "context"
 "encoding/json"
+"errors"
 "fmt"
+"net"
+"strings"
 "subscription-system/database"
+"subscription-system/internal/secrets"
+"sync"
 "time"
 
 "github.com/google/uuid"
+"github.com/jackc/pgx/v5"
 "golang.org/x/crypto/bcrypt"
 )
 
+// Скоупы API-ключей. ScopeAll даёт полный доступ (так работают старые ключи).
+const (
+ScopeAll         = "*"
+ScopeCRMRead     = "crm:read"
+ScopeCRMWrite    = "crm:write"
+ScopeAIChat      = "ai:chat"
+ScopeBillingRead = "billing:read"
+)
+
+// APIKeyScopes – список скоупов, которые можно выдать ключу
+var APIKeyScopes = []string{ScopeCRMRead, ScopeCRMWrite, ScopeAIChat, ScopeBillingRead}
+
+// ErrInvalidAPIKey – ключ не найден среди активных; прочие ошибки VerifyAPIKey – сбой сервера
+var ErrInvalidAPIKey = errors.New("invalid API key")
+
+// apiKeyRawPrefix – начало всех ключей; apiKeyPrefixLen – длина открытого префикса,
+// по которому ищется ключ (apiKeyRawPrefix и 8 символов случайной части)
+const (
+apiKeyRawPrefix = "sk-saaspro-"
+apiKeyPrefixLen = len(apiKeyRawPrefix) + 8
+)
+
+// apiKeyPrefix возвращает открытый префикс ключа
+func apiKeyPrefix(rawKey string) string {
+if len(rawKey) < apiKeyPrefixLen {
+return rawKey
+}
+return rawKey[:apiKeyPrefixLen]
+}
+
+// MaxRotationOverlap – максимальное окно, в течение которого старый ключ работает после ротации
+const MaxRotationOverlap = 30 * 24 * time.Hour
+
 type APIKey struct {
-ID                  string          `json:"id" db:"id"`
-UserID              string          `json:"user_id" db:"user_id"`
-Name                string          `json:"name" db:"name"`
-KeyHash             string          `json:"-" db:"key_hash"`
-ProviderCredentials json.RawMessage `json:"provider_credentials" db:"provider_credentials"`
-QuotaLimit          int64           `json:"quota_limit" db:"quota_limit"`
-QuotaUsed           int64           `json:"quota_used" db:"quota_used"`
-IsActive            bool            `json:"is_active" db:"is_active"`
-CreatedAt           time.Time       `json:"created_at" db:"created_at"`
-UpdatedAt           time.Time       `json:"updated_at" db:"updated_at"`
-}
-
-// GenerateAPIKey создаёт новый ключ и возвращает его в открытом виде
+ID                     string           `json:"id" db:"id"`
+UserID                 string           `json:"user_id" db:"user_id"`
+Name                   string           `json:"name" db:"name"`
+KeyHash                string           `json:"-" db:"key_hash"`
+ProviderCredentials    secrets.Redacted `json:"-" db:"provider_credentials_enc"` // расшифрованный JSON
+HasProviderCredentials bool             `json:"has_provider_credentials"`
+QuotaLimit             int64            `json:"quota_limit" db:"quota_limit"`
+QuotaUsed              int64            `json:"quota_used" db:"quota_used"`
+IsActive               bool             `json:"is_active" db:"is_active"`
+Scopes                 []string         `json:"scopes" db:"scopes"`
+ExpiresAt              *time.Time       `json:"expires_at,omitempty" db:"expires_at"`
+RateLimitPerMinute     int              `json:"rate_limit_per_minute" db:"rate_limit_per_minute"`
+AllowedCIDRs           []string         `json:"allowed_cidrs" db:"allowed_cidrs"`
+RotatedFrom            *string          `json:"rotated_from,omitempty" db:"rotated_from"`
+LastUsedAt             *time.Time       `json:"last_used_at,omitempty" db:"last_used_at"`
+LastUsedIP             *string          `json:"last_used_ip,omitempty" db:"last_used_ip"`
+CreatedAt              time.Time        `json:"created_at" db:"created_at"`
+UpdatedAt              time.Time        `json:"updated_at" db:"updated_at"`
+}
+
+// APIKeyOptions – ограничения, задаваемые при создании ключа
+type APIKeyOptions struct {
+Scopes             []string
+ExpiresAt          *time.Time
+RateLimitPerMinute int
+AllowedCIDRs       []string
+}
+
+// APIKeyUsageDay – использование ключа за день
+type APIKeyUsageDay struct {
+Day      time.Time `json:"day"`
+Requests int64     `json:"requests"`
+Rejected int64     `json:"rejected"`
+}
+
+const apiKeyColumns = `id, user_id, name, key_hash, provider_credentials, provider_credentials_enc, quota_limit, quota_used, is_active,
+scopes, expires_at, rate_limit_per_minute, allowed_cidrs, rotated_from, last_used_at, last_used_ip,
+created_at, updated_at`
+
+type apiKeyScanner interface {
+Scan(dest ...interface{}) error
+}
+
+func scanAPIKey(row apiKeyScanner, key *APIKey) error {
+var legacyCreds []byte
+var encCreds string
+err := row.Scan(&key.ID, &key.UserID, &key.Name, &key.KeyHash, &legacyCreds, &encCreds,
+&key.QuotaLimit, &key.QuotaUsed, &key.IsActive,
+&key.Scopes, &key.ExpiresAt, &key.RateLimitPerMinute, &key.AllowedCIDRs, &key.RotatedFrom,
+&key.LastUsedAt, &key.LastUsedIP, &key.CreatedAt, &key.UpdatedAt)
+if err != nil {
+return err
+}
+creds, err := decryptProviderCredentials(legacyCreds, encCreds)
+if err != nil {
+return fmt.Errorf("api key %s: %w", key.ID, err)
+}
+key.ProviderCredentials = creds
+key.HasProviderCredentials = !isEmptyCredentials(creds)
+return nil
+}
+
+// encryptProviderCredentials шифрует JSON с ключами провайдеров; пустой объект не шифруется
+func encryptProviderCredentials(credsJSON []byte) (string, error) {
+if isEmptyCredentials(credsJSON) {
+return "", nil
+}
+return secrets.Encrypt(credsJSON)
+}
+
+// decryptProviderCredentials читает зашифрованную колонку, а для старых
+// строк, ещё не перешифрованных командой rotate-secrets, – JSONB
+func decryptProviderCredentials(legacyCreds []byte, encCreds string) (secrets.Redacted, error) {
+if encCreds == "" {
+if len(legacyCreds) == 0 {
+return secrets.Redacted("{}"), nil
+}
+return secrets.Redacted(legacyCreds), nil
+}
+plaintext, err := secrets.Decrypt(encCreds)
+if err != nil {
+return nil, err
+}
+return secrets.Redacted(plaintext), nil
+}
+
+func isEmptyCredentials(credsJSON []byte) bool {
+trimmed := strings.TrimSpace(string(credsJSON))
+return trimmed == "" || trimmed == "{}" || trimmed == "null"
+}
+
+// HasScope проверяет, разрешён ли ключу скоуп (поддерживаются '*' и 'crm:*')
+func (k *APIKey) HasScope(scope string) bool {
+resource := strings.SplitN(scope, ":", 2)[0]
+for _, s := range k.Scopes {
+if s == ScopeAll || s == scope || s == resource+":*" {
+return true
+}
+}
+return false
+}
+
+// IsExpired проверяет срок действия ключа
+func (k *APIKey) IsExpired() bool {
+return k.ExpiresAt != nil && time.Now().After(*k.ExpiresAt)
+}
+
+// IPAllowed проверяет IP по allowlist; пустой список разрешает любой адрес
+func (k *APIKey) IPAllowed(ip string) bool {
+if len(k.AllowedCIDRs) == 0 {
+return true
+}
+parsed := net.ParseIP(ip)
+if parsed == nil {
+return false
+}
+for _, cidr := range k.AllowedCIDRs {
+if !strings.Contains(cidr, "/") {
+if allowed := net.ParseIP(cidr); allowed != nil && allowed.Equal(parsed) {
+return true
+}
+continue
+}
+_, network, err := net.ParseCIDR(cidr)
+if err == nil && network.Contains(parsed) {
+return true
+}
+}
+return false
+}
+
+// ValidateAPIKeyOptions нормализует и проверяет скоупы и CIDR
+func ValidateAPIKeyOptions(opts *APIKeyOptions) error {
+if len(opts.Scopes) == 0 {
+return fmt.Errorf("at least one scope is required")
+}
+for i, scope := range opts.Scopes {
+scope = strings.TrimSpace(scope)
+opts.Scopes[i] = scope
+if !isKnownScope(scope) {
+return fmt.Errorf("unknown scope: %s", scope)
+}
+}
+for i, cidr := range opts.AllowedCIDRs {
+cidr = strings.TrimSpace(cidr)
+opts.AllowedCIDRs[i] = cidr
+if strings.Contains(cidr, "/") {
+if _, _, err := net.ParseCIDR(cidr); err != nil {
+return fmt.Errorf("invalid CIDR: %s", cidr)
+}
+} else if net.ParseIP(cidr) == nil {
+return fmt.Errorf("invalid IP: %s", cidr)
+}
+}
+if opts.RateLimitPerMinute < 0 {
+return fmt.Errorf("rate_limit_per_minute must be >= 0")
+}
+if opts.ExpiresAt != nil && opts.ExpiresAt.Before(time.Now()) {
+return fmt.Errorf("expires_at must be in the future")
+}
+return nil
+}
+
+func isKnownScope(scope string) bool {
+if scope == ScopeAll {
+return true
+}
+for _, s := range APIKeyScopes {
+if s == scope || strings.SplitN(s, ":", 2)[0]+":*" == scope {
+return true
+}
+}
+return false
+}
+
+// GenerateAPIKey создаёт новый ключ с полным доступом и возвращает его в открытом виде
 func GenerateAPIKey(userID, name string, providerCredentials map[string]interface{}, quotaLimit int64) (string, *APIKey, error) {
+return GenerateScopedAPIKey(userID, name, providerCredentials, quotaLimit, APIKeyOptions{Scopes: []string{ScopeAll}})
+}
+
+// GenerateScopedAPIKey создаёт ключ с заданными скоупами, сроком действия и ограничениями
+func GenerateScopedAPIKey(userID, name string, providerCredentials map[string]interface{}, quotaLimit int64, opts APIKeyOptions) (string, *APIKey, error) {
+credsJSON, _ := json.Marshal(providerCredentials)
+return insertAPIKey(userID, name, credsJSON, quotaLimit, opts, nil)
+}
+
+func insertAPIKey(userID, name string, credsJSON []byte, quotaLimit int64, opts APIKeyOptions, rotatedFrom *string) (string, *APIKey, error) {
 // Генерируем случайный ключ формата sk-saaspro-xxxxxxxx
-rawKey := "sk-saaspro-" + uuid.New().String()
+rawKey := apiKeyRawPrefix + uuid.New().String()
 hashBytes, err := bcrypt.GenerateFromPassword([]byte(rawKey), bcrypt.DefaultCost)
 if err != nil {
 return "", nil, err
 }
 keyHash := string(hashBytes)
 
-credsJSON, _ := json.Marshal(providerCredentials)
+if opts.AllowedCIDRs == nil {
+opts.AllowedCIDRs = []string{}
+}
+encCreds, err := encryptProviderCredentials(credsJSON)
+if err != nil {
+return "", nil, err
+}
 
 var key APIKey
 query := `
-INSERT INTO api_keys (id, user_id, name, key_hash, provider_credentials, quota_limit, quota_used, is_active)
-VALUES ($1, $2, $3, $4, $5, $6, 0, true)
-RETURNING id, user_id, name, key_hash, provider_credentials, quota_limit, quota_used, is_active, created_at, updated_at
-`
+INSERT INTO api_keys (id, user_id, name, key_hash, provider_credentials, provider_credentials_enc, quota_limit, quota_used, is_active,
+scopes, expires_at, rate_limit_per_minute, allowed_cidrs, rotated_from, key_prefix)
+VALUES ($1, $2, $3, $4, '{}', $5, $6, 0, true, $7, $8, $9, $10, $11, $12)
+RETURNING ` + apiKeyColumns
 id := uuid.New().String()
-err = database.Pool.QueryRow(context.Background(), query,
-id, userID, name, keyHash, credsJSON, quotaLimit,
-).Scan(&key.ID, &key.UserID, &key.Name, &key.KeyHash, &key.ProviderCredentials, &key.QuotaLimit, &key.QuotaUsed, &key.IsActive, &key.CreatedAt, &key.UpdatedAt)
+err = scanAPIKey(database.Pool.QueryRow(context.Background(), query,
+id, userID, name, keyHash, encCreds, quotaLimit,
+opts.Scopes, opts.ExpiresAt, opts.RateLimitPerMinute, opts.AllowedCIDRs, rotatedFrom, apiKeyPrefix(rawKey),
+), &key)
 if err != nil {
 return "", nil, err
 }
@@ -55,12 +274,19 @@ return rawKey, &key, nil
 // FindAPIKeyByHash ищет ключ по хешу (используется в middleware)
 func FindAPIKeyByHash(keyHash string) (*APIKey, error) {
 var key APIKey
-query := `SELECT id, user_id, name, key_hash, provider_credentials, quota_limit, quota_used, is_active, created_at, updated_at
-          FROM api_keys WHERE key_hash = $1`
-err := database.Pool.QueryRow(context.Background(), query, keyHash).Scan(
-&key.ID, &key.UserID, &key.Name, &key.KeyHash, &key.ProviderCredentials,
-&key.QuotaLimit, &key.QuotaUsed, &key.IsActive, &key.CreatedAt, &key.UpdatedAt,
-)
+query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE key_hash = $1`
+err := scanAPIKey(database.Pool.QueryRow(context.Background(), query, keyHash), &key)
+if err != nil {
+return nil, err
+}
+return &key, nil
+}
+
+// GetAPIKeyByID возвращает ключ по ID
+func GetAPIKeyByID(id string) (*APIKey, error) {
+var key APIKey
+query := `SELECT ` + apiKeyColumns + ` FROM api_keys WHERE id = $1`
+err := scanAPIKey(database.Pool.QueryRow(context.Background(), query, id), &key)
 if err != nil {
 return nil, err
 }
@@ -70,7 +296,7 @@ return &key, nil
 // GetAPIKeysByUser возвращает все ключи пользователя (для админки)
 func GetAPIKeysByUser(userID string) ([]APIKey, error) {
 rows, err := database.Pool.Query(context.Background(), `
-SELECT id, user_id, name, key_hash, provider_credentials, quota_limit, quota_used, is_active, created_at, updated_at
+SELECT `+apiKeyColumns+`
 FROM api_keys WHERE user_id = $1 ORDER BY created_at DESC
 `, userID)
 if err != nil {
@@ -80,8 +306,7 @@ defer rows.Close()
 var keys []APIKey
 for rows.Next() {
 var k APIKey
-err := rows.Scan(&k.ID, &k.UserID, &k.Name, &k.KeyHash, &k.ProviderCredentials, &k.QuotaLimit, &k.QuotaUsed, &k.IsActive, &k.CreatedAt, &k.UpdatedAt)
-if err != nil {
+if err := scanAPIKey(rows, &k); err != nil {
 return nil, err
 }
 keys = append(keys, k)
@@ -107,8 +332,12 @@ argPos++
 }
 if providerCredentials != nil {
 credsJSON, _ := json.Marshal(providerCredentials)
-query += `, provider_credentials = $` + fmt.Sprint(argPos)
-args = append(args, credsJSON)
+encCreds, err := encryptProviderCredentials(credsJSON)
+if err != nil {
+return err
+}
+query += `, provider_credentials = '{}', provider_credentials_enc = $` + fmt.Sprint(argPos)
+args = append(args, encCreds)
 argPos++
 }
 query += ` WHERE id = $` + fmt.Sprint(argPos)
@@ -118,6 +347,59 @@ _, err := database.Pool.Exec(context.Background(), query, args...)
 return err
 }
 
+// UpdateAPIKeyPolicy заменяет скоупы, срок действия, лимит RPM и allowlist ключа
+func UpdateAPIKeyPolicy(id string, opts APIKeyOptions) error {
+if opts.AllowedCIDRs == nil {
+opts.AllowedCIDRs = []string{}
+}
+_, err := database.Pool.Exec(context.Background(), `
+UPDATE api_keys
+SET scopes = $1, expires_at = $2, rate_limit_per_minute = $3, allowed_cidrs = $4, updated_at = NOW()
+WHERE id = $5
+`, opts.Scopes, opts.ExpiresAt, opts.RateLimitPerMinute, opts.AllowedCIDRs, id)
+return err
+}
+
+// RotateAPIKey выпускает новый ключ с теми же настройками, а старый
+// продолжает работать ещё overlap, чтобы интеграции успели переключиться.
+// Возвращает и фактический срок старого ключа: он не продлевается, если истекал раньше.
+func RotateAPIKey(id string, overlap time.Duration) (string, *APIKey, time.Time, error) {
+if overlap < 0 || overlap > MaxRotationOverlap {
+return "", nil, time.Time{}, fmt.Errorf("overlap must be between 0 and %s", MaxRotationOverlap)
+}
+old, err := GetAPIKeyByID(id)
+if err != nil {
+return "", nil, time.Time{}, err
+}
+if !old.IsActive || old.IsExpired() {
+return "", nil, time.Time{}, fmt.Errorf("cannot rotate inactive or expired key")
+}
+
+opts := APIKeyOptions{
+Scopes:             old.Scopes,
+ExpiresAt:          old.ExpiresAt,
+RateLimitPerMinute: old.RateLimitPerMinute,
+AllowedCIDRs:       old.AllowedCIDRs,
+}
+rawKey, key, err := insertAPIKey(old.UserID, old.Name, old.ProviderCredentials, old.QuotaLimit, opts, &old.ID)
+if err != nil {
+return "", nil, time.Time{}, err
+}
+
+var oldExpiresAt time.Time
+err = database.Pool.QueryRow(context.Background(), `
+UPDATE api_keys
+SET expires_at = CASE WHEN expires_at IS NULL OR expires_at > $1 THEN $1 ELSE expires_at END,
+    updated_at = NOW()
+WHERE id = $2
+RETURNING expires_at
+`, time.Now().Add(overlap), old.ID).Scan(&oldExpiresAt)
+if err != nil {
+return "", nil, time.Time{}, err
+}
+return rawKey, key, oldExpiresAt, nil
+}
+
 // DeleteAPIKey удаляет ключ
 func DeleteAPIKey(id string) error {
 _, err := database.Pool.Exec(context.Background(), `DELETE FROM api_keys WHERE id = $1`, id)
@@ -132,36 +414,199 @@ UPDATE api_keys SET quota_used = quota_used + $1, updated_at = NOW() WHERE id =
 return err
 }
 
-// VerifyAPIKey проверяет сырой ключ и возвращает объект APIKey
-func VerifyAPIKey(rawKey string) (*APIKey, error) {
-// Из-за особенностей bcrypt мы не можем просто захешировать и сравнить,
-// потому что соль случайная. В реальности мы бы хранили префикс и искали кандидатов.
-// Для MVP мы будем использовать упрощение: ключ имеет формат sk-saaspro-{uuid},
-// мы можем вычислить хеш для полученного ключа и искать по нему.
-// Это будет работать, потому что bcrypt детерминирован при одинаковой соли,
-// но при генерации соль всегда разная, поэтому хеш будет разным.
-// Поэтому такой подход не сработает. Нужно перебирать все хеши и проверять bcrypt.CompareHashAndPassword.
-
-// Получаем все активные ключи и проверяем bcrypt.CompareHashAndPassword
+// RecordAPIKeyUsage учитывает запрос по ключу в памяти (rejected – запрос отклонён политикой ключа);
+// в БД счётчики попадают пачкой при FlushAPIKeyUsage
+func RecordAPIKeyUsage(keyID, ip string, rejected bool) {
+now := time.Now()
+k := apiKeyUsageKey{keyID: keyID, day: now.Format("2006-01-02")}
+apiKeyUsage.mu.Lock()
+defer apiKeyUsage.mu.Unlock()
+p := apiKeyUsage.pending[k]
+if p == nil {
+p = &apiKeyUsagePending{}
+apiKeyUsage.pending[k] = p
+}
+p.requests++
+if rejected {
+p.rejected++
+}
+p.lastUsedAt, p.lastUsedIP = now, ip
+}
+
+type apiKeyUsageKey struct {
+keyID string
+day   string
+}
+
+type apiKeyUsagePending struct {
+requests   int64
+rejected   int64
+lastUsedAt time.Time
+lastUsedIP string
+}
+
+// apiKeyUsage – использование ключей, ещё не записанное в БД
+var apiKeyUsage = struct {
+mu      sync.Mutex
+pending map[apiKeyUsageKey]*apiKeyUsagePending
+}{pending: map[apiKeyUsageKey]*apiKeyUsagePending{}}
+
+// FlushAPIKeyUsage записывает накопленное использование ключей одной пачкой запросов.
+// Если запись не удалась, счётчики возвращаются в очередь до следующего сброса.
+func FlushAPIKeyUsage(ctx context.Context) error {
+apiKeyUsage.mu.Lock()
+pending := apiKeyUsage.pending
+apiKeyUsage.pending = map[apiKeyUsageKey]*apiKeyUsagePending{}
+apiKeyUsage.mu.Unlock()
+if len(pending) == 0 {
+return nil
+}
+
+batch := &pgx.Batch{}
+for k, p := range pending {
+batch.Queue(`
+INSERT INTO api_key_usage (key_id, day, requests, rejected)
+SELECT id, $2::date, $3, $4 FROM api_keys WHERE id = $1 -- ключ могли удалить до сброса
+ON CONFLICT (key_id, day)
+DO UPDATE SET requests = api_key_usage.requests + EXCLUDED.requests, rejected = api_key_usage.rejected + EXCLUDED.rejected
+`, k.keyID, k.day, p.requests, p.rejected)
+batch.Queue(`
+UPDATE api_keys SET last_used_at = $1, last_used_ip = $2
+WHERE id = $3 AND (last_used_at IS NULL OR last_used_at < $1)
+`, p.lastUsedAt, p.lastUsedIP, k.keyID)
+}
+// В транзакции пачка записывается целиком или не записывается вовсе, поэтому повтор не задвоит счётчики
+tx, err := database.Pool.Begin(ctx)
+if err == nil {
+err = tx.SendBatch(ctx, batch).Close()
+if err == nil {
+err = tx.Commit(ctx)
+}
+tx.Rollback(ctx)
+}
+if err != nil {
+requeueAPIKeyUsage(pending)
+return err
+}
+return nil
+}
+
+func requeueAPIKeyUsage(pending map[apiKeyUsageKey]*apiKeyUsagePending) {
+apiKeyUsage.mu.Lock()
+defer apiKeyUsage.mu.Unlock()
+for k, p := range pending {
+cur := apiKeyUsage.pending[k]
+if cur == nil {
+apiKeyUsage.pending[k] = p
+continue
+}
+cur.requests += p.requests
+cur.rejected += p.rejected
+if p.lastUsedAt.After(cur.lastUsedAt) {
+cur.lastUsedAt, cur.lastUsedIP = p.lastUsedAt, p.lastUsedIP
+}
+}
+}
+
+// GetAPIKeyUsage возвращает использование ключа за последние days дней
+func GetAPIKeyUsage(keyID string, days int) ([]APIKeyUsageDay, error) {
 rows, err := database.Pool.Query(context.Background(), `
-SELECT id, user_id, name, key_hash, provider_credentials, quota_limit, quota_used, is_active, created_at, updated_at
-FROM api_keys WHERE is_active = true
-`)
+SELECT day, requests, rejected
+FROM api_key_usage
+WHERE key_id = $1 AND day > CURRENT_DATE - $2::int
+ORDER BY day
+`, keyID, days)
 if err != nil {
 return nil, err
 }
 defer rows.Close()
-
+usage := []APIKeyUsageDay{}
 for rows.Next() {
-var key APIKey
-err := rows.Scan(&key.ID, &key.UserID, &key.Name, &key.KeyHash, &key.ProviderCredentials, &key.QuotaLimit, &key.QuotaUsed, &key.IsActive, &key.CreatedAt, &key.UpdatedAt)
+var u APIKeyUsageDay
+if err := rows.Scan(&u.Day, &u.Requests, &u.Rejected); err != nil {
+return nil, err
+}
+usage = append(usage, u)
+}
+return usage, nil
+}
+
+// VerifyAPIKey проверяет сырой ключ и возвращает объект APIKey.
+// bcrypt с солью не позволяет искать по хешу, поэтому кандидаты выбираются по открытому
+// префиксу ключа, а расшифровывается только совпавшая строка. Старые ключи без префикса
+// проверяются перебором активных, и при совпадении префикс сохраняется.
+// Отключённые и просроченные ключи тоже возвращаются, чтобы middleware дало понятную ошибку;
+// просроченный ключ при этом выключается.
+func VerifyAPIKey(rawKey string) (*APIKey, error) {
+ctx := context.Background()
+prefix := apiKeyPrefix(rawKey)
+rows, err := database.Pool.Query(ctx, `
+SELECT id::text, key_hash, key_prefix IS NULL
+FROM api_keys WHERE key_prefix = $1 OR (key_prefix IS NULL AND is_active = true)
+ORDER BY key_prefix NULLS LAST
+`, prefix)
 if err != nil {
+return nil, err
+}
+type candidate struct {
+id, hash string
+legacy   bool
+}
+var candidates []candidate
+for rows.Next() {
+var c candidate
+if err := rows.Scan(&c.id, &c.hash, &c.legacy); err != nil {
+rows.Close()
+return nil, err
+}
+candidates = append(candidates, c)
+}
+rows.Close()
+if err := rows.Err(); err != nil {
+return nil, err
+}
+
+for _, c := range candidates {
+if bcrypt.CompareHashAndPassword([]byte(c.hash), []byte(rawKey)) != nil {
 continue
 }
-err = bcrypt.CompareHashAndPassword([]byte(key.KeyHash), []byte(rawKey))
-if err == nil {
-return &key, nil
+if c.legacy {
+if _, err := database.Pool.Exec(ctx, `UPDATE api_keys SET key_prefix = $1 WHERE id = $2`, prefix, c.id); err != nil {
+return nil, err
+}
 }
+// Ошибка чтения (в том числе расшифровки provider_credentials) – не «ключ не найден»:
+// иначе сбой ротации ключей шифрования выглядел бы как неверный ключ
+key, err := GetAPIKeyByID(c.id)
+if err != nil {
+return nil, fmt.Errorf("read api key: %w", err)
+}
+if key.IsActive && key.IsExpired() {
+if err := deactivateAPIKey(ctx, key.ID); err != nil {
+return nil, err
+}
+key.IsActive = false
+}
+return key, nil
+}
+return nil, ErrInvalidAPIKey
+}
+
+// deactivateAPIKey выключает ключ, срок действия которого истёк
+func deactivateAPIKey(ctx context.Context, id string) error {
+_, err := database.Pool.Exec(ctx, `UPDATE api_keys SET is_active = false, updated_at = NOW() WHERE id = $1`, id)
+return err
+}
+
+// DeactivateExpiredAPIKeys выключает все ключи с истёкшим сроком, в том числе старые ключи
+// после окончания окна ротации, которыми больше не пользуются
+func DeactivateExpiredAPIKeys(ctx context.Context) (int64, error) {
+tag, err := database.Pool.Exec(ctx, `
+UPDATE api_keys SET is_active = false, updated_at = NOW()
+WHERE is_active = true AND expires_at <= NOW()
+`)
+if err != nil {
+return 0, err
 }
-return nil, fmt.Errorf("invalid API key")
+return tag.RowsAffected(), nil
 }
@@ -2,7 +2,6 @@ package models
 
 import (
 "context"
-"encoding/json"
 "fmt"
 "subscription-system/database"
 "time"
@@ -10,17 +9,17 @@ import (
 
 // AdminAPIKey – ключ с данными пользователя для админ-панели
 type AdminAPIKey struct {
-ID                  string          `json:"id"`
-UserID              string          `json:"user_id"`
-UserEmail           string          `json:"user_email"`
-UserName            string          `json:"user_name"`
-Name                string          `json:"name"`
-ProviderCredentials json.RawMessage `json:"provider_credentials"`
-QuotaLimit          int64           `json:"quota_limit"`
-QuotaUsed           int64           `json:"quota_used"`
-IsActive            bool            `json:"is_active"`
-CreatedAt           time.Time       `json:"created_at"`
-UpdatedAt           time.Time       `json:"updated_at"`
+ID                     string    `json:"id"`
+UserID                 string    `json:"user_id"`
+UserEmail              string    `json:"user_email"`
+UserName               string    `json:"user_name"`
+Name                   string    `json:"name"`
+HasProviderCredentials bool      `json:"has_provider_credentials"` // сами ключи провайдеров не отдаём
+QuotaLimit             int64     `json:"quota_limit"`
+QuotaUsed              int64     `json:"quota_used"`
+IsActive               bool      `json:"is_active"`
+CreatedAt              time.Time `json:"created_at"`
+UpdatedAt              time.Time `json:"updated_at"`
 }
 
 // GetAllAPIKeys возвращает все ключи с пагинацией и поиском
@@ -46,7 +45,7 @@ return nil, 0, err
 query := `
 SELECT 
 k.id, k.user_id, u.email, u.name,
-k.name, k.provider_credentials, k.quota_limit, k.quota_used,
+k.name, (k.provider_credentials_enc <> '' OR COALESCE(k.provider_credentials, '{}'::jsonb) <> '{}'::jsonb), k.quota_limit, k.quota_used,
 k.is_active, k.created_at, k.updated_at
 FROM api_keys k
 JOIN users u ON k.user_id = u.id
@@ -73,7 +72,7 @@ for rows.Next() {
 var k AdminAPIKey
 err := rows.Scan(
 &k.ID, &k.UserID, &k.UserEmail, &k.UserName,
-&k.Name, &k.ProviderCredentials, &k.QuotaLimit, &k.QuotaUsed,
+&k.Name, &k.HasProviderCredentials, &k.QuotaLimit, &k.QuotaUsed,
 &k.IsActive, &k.CreatedAt, &k.UpdatedAt,
 )
 if err != nil {
@@ -0,0 +1,727 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Прогноз оттока платящих подписчиков. Метки берутся из движений MRR (revenue_mrr_movements):
+// подписчик, платящий на дату среза, «ушёл», если в следующие horizon дней у него было движение churn.
+// Обучающая выборка – еженедельные срезы за последний год; признаки считаются строго по данным
+// до даты среза. Последняя четверть срезов откладывается для проверки (AUC, калибровка), между
+// обучением и проверкой выдерживается разрыв в горизонт, чтобы метки не пересекались.
+//
+// Каждое обучение сохраняет новую версию модели; версия становится активной, только если на
+// отложенной выборке не хуже действующей. Вклад признака в прогноз – вес × стандартизованное
+// значение, т.е. сдвиг логита относительно «среднего» подписчика.
+
+var (
+	ErrChurnModelNotFound    = errors.New("churn model not found")
+	ErrNoActiveChurnModel    = errors.New("no active churn model")
+	ErrNotEnoughChurnData    = errors.New("not enough churn history to train a model")
+	ErrChurnPredictionAbsent = errors.New("churn prediction not found")
+	ErrInvalidChurnHorizon   = errors.New("churn horizon must be between 7 and 180 days")
+)
+
+// Уровни риска оттока
+const (
+	ChurnRiskLow    = "low"
+	ChurnRiskMedium = "medium"
+	ChurnRiskHigh   = "high"
+)
+
+const (
+	churnAlgorithm = "logistic_regression"
+	// churnTrainingDays, churnSnapshotStep – глубина истории и шаг срезов обучающей выборки
+	churnTrainingDays = 365
+	churnSnapshotStep = 7
+	// churnValidationShare – доля последних срезов, отложенных для проверки
+	churnValidationShare = 0.25
+	churnMinSamples      = 50
+	churnMinPositives    = 5
+	// churnMinAUC, churnAUCTolerance – порог качества и допустимая просадка AUC относительно активной версии
+	churnMinAUC       = 0.6
+	churnAUCTolerance = 0.02
+	churnTopFactors   = 5
+)
+
+// churnFeatureDef – признак подписчика на момент $1 (timestamp, начало дня после среза); u.id – пользователь.
+// Признаки из необязательных таблиц равны 0, если таблицы нет в базе.
+type churnFeatureDef struct {
+	Name  string
+	Label string
+	table string
+	log   bool // в модель идёт ln(1 + x): счётчики с длинным хвостом
+	sql   string
+}
+
+var churnFeatureDefs = []churnFeatureDef{
+	{Name: "days_since_activity", Label: "Дней без активности в CRM", table: "activities",
+		sql: `LEAST(COALESCE(EXTRACT(EPOCH FROM $1::timestamp -
+			(SELECT MAX(created_at) FROM activities WHERE user_id = u.id AND created_at < $1::timestamp)) / 86400, 365), 365)`},
+	{Name: "activities_30d", Label: "Активностей в CRM за 30 дней", table: "activities", log: true,
+		sql: `(SELECT COUNT(*) FROM activities WHERE user_id = u.id
+			AND created_at >= $1::timestamp - INTERVAL '30 days' AND created_at < $1::timestamp)`},
+	{Name: "ai_requests_30d", Label: "Запросов к ИИ за 30 дней", table: "ai_usage_logs", log: true,
+		sql: `(SELECT COUNT(*) FROM ai_usage_logs WHERE user_id = u.id
+			AND created_at >= $1::timestamp - INTERVAL '30 days' AND created_at < $1::timestamp)`},
+	{Name: "support_messages_90d", Label: "Обращений в поддержку за 90 дней", table: "chat_history", log: true,
+		sql: `(SELECT COUNT(*) FROM chat_history WHERE user_id = u.id AND role = 'user'
+			AND created_at >= $1::timestamp - INTERVAL '90 days' AND created_at < $1::timestamp)`},
+	{Name: "deals_won_90d", Label: "Выигранных сделок за 90 дней", log: true,
+		sql: `(SELECT COUNT(*) FROM crm_deals d
+			JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage AND ps.is_won
+			WHERE d.user_id = u.id AND d.closed_at >= $1::timestamp - INTERVAL '90 days' AND d.closed_at < $1::timestamp)`},
+	{Name: "deals_lost_90d", Label: "Проигранных сделок за 90 дней", log: true,
+		sql: `(SELECT COUNT(*) FROM crm_deals d
+			JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage AND ps.is_lost
+			WHERE d.user_id = u.id AND d.closed_at >= $1::timestamp - INTERVAL '90 days' AND d.closed_at < $1::timestamp)`},
+	{Name: "payments_180d", Label: "Оплат за 180 дней",
+		sql: `(SELECT COUNT(*) FROM payments WHERE user_id = u.id AND status = 'completed'
+			AND COALESCE(completed_at, created_at) >= $1::timestamp - INTERVAL '180 days'
+			AND COALESCE(completed_at, created_at) < $1::timestamp)`},
+	{Name: "days_since_payment", Label: "Дней с последней оплаты",
+		sql: `LEAST(COALESCE(EXTRACT(EPOCH FROM $1::timestamp - (SELECT MAX(COALESCE(completed_at, created_at))
+			FROM payments WHERE user_id = u.id AND status = 'completed' AND COALESCE(completed_at, created_at) < $1::timestamp)) / 86400, 365), 365)`},
+	{Name: "pending_payments_90d", Label: "Неоплаченных счетов за 90 дней",
+		sql: `(SELECT COUNT(*) FROM payments WHERE user_id = u.id AND status = 'pending'
+			AND created_at >= $1::timestamp - INTERVAL '90 days' AND created_at < $1::timestamp)`},
+	{Name: "mrr", Label: "MRR подписки", log: true,
+		sql: `COALESCE((SELECT mrr_to FROM revenue_mrr_movements WHERE user_id = u.id AND day < $1::timestamp::date
+			ORDER BY day DESC, id DESC LIMIT 1), 0)`},
+	{Name: "tenure_months", Label: "Месяцев с первой оплаты",
+		sql: `COALESCE(($1::timestamp::date - (SELECT MIN(day) FROM revenue_mrr_movements
+			WHERE user_id = u.id AND kind = 'new' AND day < $1::timestamp::date)) / 30.0, 0)`},
+	{Name: "recent_contraction", Label: "Понижение тарифа за 90 дней",
+		sql: `CASE WHEN EXISTS (SELECT 1 FROM revenue_mrr_movements WHERE user_id = u.id AND kind = 'contraction'
+			AND day >= $1::timestamp::date - 90 AND day < $1::timestamp::date) THEN 1 ELSE 0 END`},
+}
+
+func churnFeatureDefByName(name string) *churnFeatureDef {
+	for i := range churnFeatureDefs {
+		if churnFeatureDefs[i].Name == name {
+			return &churnFeatureDefs[i]
+		}
+	}
+	return nil
+}
+
+// ChurnModel – обученная версия модели
+type ChurnModel struct {
+	ID          int                  `json:"version"`
+	Algorithm   string               `json:"algorithm"`
+	HorizonDays int                  `json:"horizon_days"`
+	Features    []ChurnFeatureWeight `json:"features"`
+	Intercept   float64              `json:"intercept"`
+	Metrics     ChurnMetrics         `json:"metrics"`
+	TrainedFrom string               `json:"trained_from"`
+	TrainedTo   string               `json:"trained_to"`
+	IsActive    bool                 `json:"is_active"`
+	CreatedBy   *string              `json:"created_by,omitempty"`
+	TrainedAt   time.Time            `json:"trained_at"`
+}
+
+// ChurnFactor – вклад признака в прогноз подписчика
+type ChurnFactor struct {
+	Feature      string  `json:"feature"`
+	Label        string  `json:"label"`
+	Value        float64 `json:"value"`
+	Contribution float64 `json:"contribution"`
+}
+
+// ChurnPrediction – текущий прогноз оттока подписчика
+type ChurnPrediction struct {
+	UserID           string        `json:"user_id"`
+	Email            string        `json:"email"`
+	Name             string        `json:"name"`
+	ModelVersion     int           `json:"model_version"`
+	ChurnProbability float64       `json:"churn_probability"`
+	RiskLevel        string        `json:"risk_level"`
+	Factors          []ChurnFactor `json:"factors"`
+	PredictedDate    string        `json:"predicted_date"`
+	HighRiskSince    *time.Time    `json:"high_risk_since,omitempty"`
+	TaskID           *string       `json:"task_id,omitempty"`
+	UpdatedAt        time.Time     `json:"updated_at"`
+}
+
+// ChurnRiskThresholds – пороги вероятности для уровней риска
+type ChurnRiskThresholds struct {
+	High   float64
+	Medium float64
+}
+
+func (t ChurnRiskThresholds) level(p float64) string {
+	switch {
+	case p >= t.High:
+		return ChurnRiskHigh
+	case p >= t.Medium:
+		return ChurnRiskMedium
+	}
+	return ChurnRiskLow
+}
+
+// churnFeatureQuery – запрос признаков для пользователей $2 на момент $1 по списку признаков
+func churnFeatureQuery(ctx context.Context, q pgxQuerier, names []string) (string, error) {
+	tables := map[string]bool{}
+	for _, def := range churnFeatureDefs {
+		if def.table != "" {
+			tables[def.table] = false
+		}
+	}
+	for table := range tables {
+		var exists bool
+		if err := q.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+			return "", err
+		}
+		tables[table] = exists
+	}
+	cols := make([]string, 0, len(names))
+	for _, name := range names {
+		def := churnFeatureDefByName(name)
+		if def == nil || (def.table != "" && !tables[def.table]) {
+			cols = append(cols, "0::float8")
+			continue
+		}
+		cols = append(cols, "("+def.sql+")::float8")
+	}
+	return `SELECT u.id, ` + strings.Join(cols, ", ") + ` FROM unnest($2::uuid[]) AS u(id)`, nil
+}
+
+// pgxQuerier – общее у пула и транзакции для чтения
+type pgxQuerier interface {
+	Query(ctx context.Context, sql string, args ...interface{}) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}
+
+// churnFeatureRows – сырые признаки пользователей на конец дня day
+func churnFeatureRows(ctx context.Context, q pgxQuerier, query string, day time.Time, ids []uuid.UUID, n int) (map[uuid.UUID][]float64, error) {
+	rows, err := q.Query(ctx, query, day.AddDate(0, 0, 1), ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make(map[uuid.UUID][]float64, len(ids))
+	for rows.Next() {
+		var id uuid.UUID
+		values := make([]float64, n)
+		dest := make([]interface{}, n+1)
+		dest[0] = &id
+		for j := range values {
+			dest[j+1] = &values[j]
+		}
+		if err := rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		result[id] = values
+	}
+	return result, rows.Err()
+}
+
+// churnTransform – значения признаков в том виде, в котором их видит модель
+func churnTransform(names []string, raw []float64) []float64 {
+	x := make([]float64, len(raw))
+	for j, name := range names {
+		x[j] = raw[j]
+		if def := churnFeatureDefByName(name); def != nil && def.log {
+			x[j] = math.Log1p(math.Max(raw[j], 0))
+		}
+	}
+	return x
+}
+
+// payingUsersOn – пользователи с MRR > 0 на конец дня day по движениям MRR
+func payingUsersOn(ctx context.Context, q pgxQuerier, day time.Time) ([]uuid.UUID, error) {
+	rows, err := q.Query(ctx, `
+		SELECT user_id FROM (
+			SELECT DISTINCT ON (user_id) user_id, mrr_to FROM revenue_mrr_movements
+			WHERE day <= $1 ORDER BY user_id, day DESC, id DESC
+		) s WHERE mrr_to > 0
+	`, day)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []uuid.UUID{}
+	for rows.Next() {
+		var id uuid.UUID
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+type churnSample struct {
+	day   time.Time
+	x     []float64
+	label float64
+}
+
+// TrainChurnModel обучает новую версию модели на истории движений MRR и сохраняет её.
+// Версия активируется, если AUC на отложенной выборке не ниже порога и не хуже активной.
+func TrainChurnModel(ctx context.Context, horizonDays int, createdBy *string) (*ChurnModel, error) {
+	if horizonDays < 7 || horizonDays > 180 {
+		return nil, ErrInvalidChurnHorizon
+	}
+	last, err := LastRevenueDay(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if last == nil {
+		return nil, fmt.Errorf("%w: revenue metrics are not computed yet", ErrNotEnoughChurnData)
+	}
+	var first *time.Time
+	if err := database.Pool.QueryRow(ctx, `SELECT MIN(day) FROM revenue_daily`).Scan(&first); err != nil {
+		return nil, err
+	}
+	latest := last.Day.AddDate(0, 0, -horizonDays)
+	earliest := latest.AddDate(0, 0, -churnTrainingDays)
+	if first != nil && revenueDay(*first).After(earliest) {
+		earliest = revenueDay(*first)
+	}
+
+	names := make([]string, len(churnFeatureDefs))
+	for j, def := range churnFeatureDefs {
+		names[j] = def.Name
+	}
+	query, err := churnFeatureQuery(ctx, database.Pool, names)
+	if err != nil {
+		return nil, err
+	}
+
+	var samples []churnSample
+	var snapshots []time.Time
+	for day := latest; !day.Before(earliest); day = day.AddDate(0, 0, -churnSnapshotStep) {
+		ids, err := payingUsersOn(ctx, database.Pool, day)
+		if err != nil {
+			return nil, err
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		churned := map[uuid.UUID]bool{}
+		rows, err := database.Pool.Query(ctx, `
+			SELECT DISTINCT user_id FROM revenue_mrr_movements
+			WHERE kind = 'churn' AND day > $1 AND day <= $1::date + $2::int
+		`, day, horizonDays)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var id uuid.UUID
+			if err := rows.Scan(&id); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			churned[id] = true
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		features, err := churnFeatureRows(ctx, database.Pool, query, day, ids, len(names))
+		if err != nil {
+			return nil, err
+		}
+		for id, raw := range features {
+			s := churnSample{day: day, x: churnTransform(names, raw)}
+			if churned[id] {
+				s.label = 1
+			}
+			samples = append(samples, s)
+		}
+		snapshots = append(snapshots, day)
+	}
+	if len(snapshots) < 2 {
+		return nil, fmt.Errorf("%w: need at least %d days of revenue history", ErrNotEnoughChurnData, horizonDays+2*churnSnapshotStep)
+	}
+
+	// Последние по времени срезы – отложенная выборка; обучающие срезы заканчиваются за горизонт до неё
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Before(snapshots[j]) })
+	validationCount := int(math.Ceil(float64(len(snapshots)) * churnValidationShare))
+	validationFrom := snapshots[len(snapshots)-validationCount]
+	trainTo := validationFrom.AddDate(0, 0, -horizonDays)
+	var trainX, validX [][]float64
+	var trainY, validY []float64
+	for _, s := range samples {
+		switch {
+		case !s.day.Before(validationFrom):
+			validX, validY = append(validX, s.x), append(validY, s.label)
+		case !s.day.After(trainTo):
+			trainX, trainY = append(trainX, s.x), append(trainY, s.label)
+		}
+	}
+	if err := checkChurnSet("training", trainY); err != nil {
+		return nil, err
+	}
+	if err := checkChurnSet("validation", validY); err != nil {
+		return nil, err
+	}
+
+	features := standardize(names, trainX)
+	intercept, err := trainLogistic(features, trainX, trainY)
+	if err != nil {
+		return nil, err
+	}
+	probs := make([]float64, len(validX))
+	for i, x := range validX {
+		probs[i] = sigmoid(churnLogit(features, intercept, x))
+	}
+	metrics := evaluateChurn(probs, validY)
+	metrics.TrainSamples, metrics.ValidationSamples = len(trainY), len(validY)
+	for _, y := range trainY {
+		metrics.TrainPositives += int(y)
+	}
+	for _, y := range validY {
+		metrics.ValidationPositive += int(y)
+	}
+
+	m := &ChurnModel{
+		Algorithm:   churnAlgorithm,
+		HorizonDays: horizonDays,
+		Features:    features,
+		Intercept:   intercept,
+		Metrics:     metrics,
+		TrainedFrom: snapshots[0].Format(revenueDateLayout),
+		TrainedTo:   snapshots[len(snapshots)-1].Format(revenueDateLayout),
+		CreatedBy:   createdBy,
+	}
+	return m, saveChurnModel(ctx, m)
+}
+
+// checkChurnSet – в выборке достаточно примеров обоих классов
+func checkChurnSet(name string, labels []float64) error {
+	positives := 0
+	for _, y := range labels {
+		positives += int(y)
+	}
+	negatives := len(labels) - positives
+	if len(labels) < churnMinSamples || positives < churnMinPositives || negatives < churnMinPositives {
+		return fmt.Errorf("%w: %s set has %d samples, %d churned (need %d samples and %d of each class)",
+			ErrNotEnoughChurnData, name, len(labels), positives, churnMinSamples, churnMinPositives)
+	}
+	return nil
+}
+
+// saveChurnModel сохраняет версию и решает, становится ли она активной
+func saveChurnModel(ctx context.Context, m *ChurnModel) error {
+	features, err := json.Marshal(m.Features)
+	if err != nil {
+		return err
+	}
+	metrics, err := json.Marshal(m.Metrics)
+	if err != nil {
+		return err
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('churn_model'))`); err != nil {
+		return err
+	}
+	var activeAUC *float64
+	err = tx.QueryRow(ctx, `SELECT (metrics->>'auc')::float8 FROM analytics_churn_models WHERE is_active`).Scan(&activeAUC)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+	m.IsActive = m.Metrics.AUC >= churnMinAUC && (activeAUC == nil || m.Metrics.AUC >= *activeAUC-churnAUCTolerance)
+	if m.IsActive {
+		if _, err := tx.Exec(ctx, `UPDATE analytics_churn_models SET is_active = false WHERE is_active`); err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO analytics_churn_models (algorithm, horizon_days, features, intercept, metrics,
+			trained_from, trained_to, is_active, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, trained_at
+	`, m.Algorithm, m.HorizonDays, features, m.Intercept, metrics, m.TrainedFrom, m.TrainedTo, m.IsActive, m.CreatedBy).
+		Scan(&m.ID, &m.TrainedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+const churnModelColumns = `id, algorithm, horizon_days, features, intercept, metrics,
+	trained_from, trained_to, is_active, created_by::text, trained_at`
+
+func scanChurnModel(row pgx.Row) (*ChurnModel, error) {
+	var m ChurnModel
+	var features, metrics []byte
+	var from, to time.Time
+	err := row.Scan(&m.ID, &m.Algorithm, &m.HorizonDays, &features, &m.Intercept, &metrics,
+		&from, &to, &m.IsActive, &m.CreatedBy, &m.TrainedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(features, &m.Features); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(metrics, &m.Metrics); err != nil {
+		return nil, err
+	}
+	m.TrainedFrom, m.TrainedTo = from.Format(revenueDateLayout), to.Format(revenueDateLayout)
+	return &m, nil
+}
+
+// ListChurnModels – версии модели, новые первыми
+func ListChurnModels(ctx context.Context) ([]*ChurnModel, error) {
+	rows, err := database.Pool.Query(ctx, `SELECT `+churnModelColumns+` FROM analytics_churn_models ORDER BY id DESC`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*ChurnModel{}
+	for rows.Next() {
+		m, err := scanChurnModel(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// ActiveChurnModel – действующая версия или ErrNoActiveChurnModel
+func ActiveChurnModel(ctx context.Context) (*ChurnModel, error) {
+	m, err := scanChurnModel(database.Pool.QueryRow(ctx,
+		`SELECT `+churnModelColumns+` FROM analytics_churn_models WHERE is_active`))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNoActiveChurnModel
+	}
+	return m, err
+}
+
+// ActivateChurnModel делает версию активной вручную (например, откат к прежней)
+func ActivateChurnModel(ctx context.Context, id int) (*ChurnModel, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('churn_model'))`); err != nil {
+		return nil, err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE analytics_churn_models SET is_active = false WHERE is_active AND id <> $1`, id); err != nil {
+		return nil, err
+	}
+	m, err := scanChurnModel(tx.QueryRow(ctx, `
+		UPDATE analytics_churn_models SET is_active = true WHERE id = $1 RETURNING `+churnModelColumns, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrChurnModelNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, tx.Commit(ctx)
+}
+
+// ChurnRiskEntered – подписчик, впервые (с последнего выхода из зоны) попавший в высокий риск
+type ChurnRiskEntered struct {
+	UserID      string
+	Email       string
+	Probability float64
+	Factors     []ChurnFactor
+}
+
+// ScoreChurn пересчитывает прогнозы платящих подписчиков активной моделью на последний посчитанный
+// день выручки; прогнозы тех, кто больше не платит, удаляются. Возвращает вошедших в высокий риск.
+func ScoreChurn(ctx context.Context, thresholds ChurnRiskThresholds) (int, []ChurnRiskEntered, error) {
+	model, err := ActiveChurnModel(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	last, err := LastRevenueDay(ctx)
+	if err != nil || last == nil {
+		return 0, nil, err
+	}
+	ids, err := payingUsersOn(ctx, database.Pool, last.Day)
+	if err != nil {
+		return 0, nil, err
+	}
+	names := make([]string, len(model.Features))
+	for j, f := range model.Features {
+		names[j] = f.Name
+	}
+	query, err := churnFeatureQuery(ctx, database.Pool, names)
+	if err != nil {
+		return 0, nil, err
+	}
+	features, err := churnFeatureRows(ctx, database.Pool, query, last.Day, ids, len(names))
+	if err != nil {
+		return 0, nil, err
+	}
+	predictedDate := revenueDay(time.Now()).AddDate(0, 0, model.HorizonDays)
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `DELETE FROM analytics_churn_predictions WHERE NOT (user_id = ANY($1))`, ids); err != nil {
+		return 0, nil, err
+	}
+	var entered []ChurnRiskEntered
+	for id, raw := range features {
+		x := churnTransform(names, raw)
+		p := round4(sigmoid(churnLogit(model.Features, model.Intercept, x)))
+		factors := make([]ChurnFactor, len(names))
+		for j, f := range model.Features {
+			label := f.Name
+			if def := churnFeatureDefByName(f.Name); def != nil {
+				label = def.Label
+			}
+			factors[j] = ChurnFactor{Feature: f.Name, Label: label, Value: round4(raw[j]),
+				Contribution: round4(f.Weight * (x[j] - f.Mean) / f.Std)}
+		}
+		sort.Slice(factors, func(a, b int) bool {
+			return math.Abs(factors[a].Contribution) > math.Abs(factors[b].Contribution)
+		})
+		payload, err := json.Marshal(factors)
+		if err != nil {
+			return 0, nil, err
+		}
+		risk := thresholds.level(p)
+		var wasHigh bool
+		var email string
+		err = tx.QueryRow(ctx, `
+			WITH prev AS (SELECT risk_level FROM analytics_churn_predictions WHERE user_id = $1)
+			INSERT INTO analytics_churn_predictions (user_id, model_id, churn_probability, risk_level, factors,
+				predicted_date, high_risk_since, updated_at)
+			VALUES ($1, $2, $3, $4, $5, $6, CASE WHEN $4 = 'high' THEN NOW() END, NOW())
+			ON CONFLICT (user_id) DO UPDATE SET
+				model_id = EXCLUDED.model_id,
+				churn_probability = EXCLUDED.churn_probability,
+				risk_level = EXCLUDED.risk_level,
+				factors = EXCLUDED.factors,
+				predicted_date = EXCLUDED.predicted_date,
+				high_risk_since = CASE WHEN EXCLUDED.risk_level <> 'high' THEN NULL
+					ELSE COALESCE(analytics_churn_predictions.high_risk_since, NOW()) END,
+				updated_at = NOW()
+			RETURNING COALESCE((SELECT risk_level = 'high' FROM prev), false),
+				(SELECT email FROM users WHERE id = $1)
+		`, id, model.ID, p, risk, payload, predictedDate).Scan(&wasHigh, &email)
+		if err != nil {
+			return 0, nil, err
+		}
+		if risk == ChurnRiskHigh && !wasHigh {
+			top := factors
+			if len(top) > churnTopFactors {
+				top = top[:churnTopFactors]
+			}
+			entered = append(entered, ChurnRiskEntered{UserID: id.String(), Email: email, Probability: p, Factors: top})
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return 0, nil, err
+	}
+	return len(features), entered, nil
+}
+
+// SetChurnPredictionTask запоминает задачу, созданную по высокому риску подписчика
+func SetChurnPredictionTask(ctx context.Context, userID, taskID string) error {
+	_, err := database.Pool.Exec(ctx, `UPDATE analytics_churn_predictions SET task_id = $2 WHERE user_id = $1`, userID, taskID)
+	return err
+}
+
+const churnPredictionColumns = `p.user_id::text, COALESCE(u.email, ''), COALESCE(u.name, ''), p.model_id,
+	p.churn_probability, p.risk_level, p.factors, p.predicted_date, p.high_risk_since, p.task_id::text, p.updated_at`
+
+func scanChurnPrediction(row pgx.Row) (*ChurnPrediction, error) {
+	var p ChurnPrediction
+	var factors []byte
+	var predicted time.Time
+	err := row.Scan(&p.UserID, &p.Email, &p.Name, &p.ModelVersion, &p.ChurnProbability, &p.RiskLevel,
+		&factors, &predicted, &p.HighRiskSince, &p.TaskID, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(factors, &p.Factors); err != nil {
+		return nil, err
+	}
+	p.PredictedDate = predicted.Format(revenueDateLayout)
+	return &p, nil
+}
+
+// ListChurnPredictions – прогнозы по убыванию вероятности; risk – отбор по уровню риска
+func ListChurnPredictions(ctx context.Context, risk string, limit, offset int) ([]*ChurnPrediction, int, error) {
+	var total int
+	if err := database.Pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM analytics_churn_predictions WHERE $1 = '' OR risk_level = $1
+	`, risk).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+churnPredictionColumns+`
+		FROM analytics_churn_predictions p
+		LEFT JOIN users u ON u.id = p.user_id
+		WHERE $1 = '' OR p.risk_level = $1
+		ORDER BY p.churn_probability DESC
+		LIMIT $2 OFFSET $3
+	`, risk, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []*ChurnPrediction{}
+	for rows.Next() {
+		p, err := scanChurnPrediction(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		list = append(list, p)
+	}
+	return list, total, rows.Err()
+}
+
+// GetChurnPrediction – прогноз подписчика
+func GetChurnPrediction(ctx context.Context, userID string) (*ChurnPrediction, error) {
+	if _, err := uuid.Parse(userID); err != nil {
+		return nil, ErrChurnPredictionAbsent
+	}
+	p, err := scanChurnPrediction(database.Pool.QueryRow(ctx, `
+		SELECT `+churnPredictionColumns+`
+		FROM analytics_churn_predictions p
+		LEFT JOIN users u ON u.id = p.user_id
+		WHERE p.user_id = $1
+	`, userID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrChurnPredictionAbsent
+	}
+	return p, err
+}
+
+// ChurnCustomerFor – клиент CRM владельца ownerID с email подписчика, если он заведён
+func ChurnCustomerFor(ctx context.Context, ownerID, email string) (*string, error) {
+	if email == "" {
+		return nil, nil
+	}
+	var id string
+	err := database.Pool.QueryRow(ctx, `
+		SELECT id::text FROM crm_customers
+		WHERE user_id = $1 AND LOWER(email) = LOWER($2) AND deleted_at IS NULL
+		ORDER BY created_at LIMIT 1
+	`, ownerID, email).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &id, nil
+}
@@ -0,0 +1,259 @@
+package models
+
+import (
+	"errors"
+	"math"
+	"sort"
+)
+
+// Логистическая регрессия для прогноза оттока: обучение методом Ньютона с L2-регуляризацией
+// на стандартизованных признаках и метрики качества на отложенной выборке.
+
+const (
+	churnL2           = 1.0
+	churnMaxNewton    = 50
+	churnNewtonEps    = 1e-6
+	churnCalibBuckets = 10
+)
+
+var errChurnSingular = errors.New("churn model: singular hessian")
+
+// ChurnFeatureWeight – признак модели: вес в стандартизованном пространстве и параметры стандартизации
+type ChurnFeatureWeight struct {
+	Name   string  `json:"name"`
+	Weight float64 `json:"weight"`
+	Mean   float64 `json:"mean"`
+	Std    float64 `json:"std"`
+}
+
+// ChurnCalibrationBucket – корзина калибровки: средняя предсказанная и фактическая доля оттока
+type ChurnCalibrationBucket struct {
+	From      float64 `json:"from"`
+	To        float64 `json:"to"`
+	Count     int     `json:"count"`
+	Predicted float64 `json:"predicted"`
+	Observed  float64 `json:"observed"`
+}
+
+// ChurnMetrics – качество модели на отложенной (более поздней по времени) выборке
+type ChurnMetrics struct {
+	AUC                float64                  `json:"auc"`
+	LogLoss            float64                  `json:"log_loss"`
+	Brier              float64                  `json:"brier"`
+	CalibrationError   float64                  `json:"calibration_error"` // ECE – взвешенное расхождение по корзинам
+	BaseRate           float64                  `json:"base_rate"`
+	TrainSamples       int                      `json:"train_samples"`
+	TrainPositives     int                      `json:"train_positives"`
+	ValidationSamples  int                      `json:"validation_samples"`
+	ValidationPositive int                      `json:"validation_positives"`
+	Calibration        []ChurnCalibrationBucket `json:"calibration"`
+}
+
+func sigmoid(z float64) float64 {
+	if z >= 0 {
+		return 1 / (1 + math.Exp(-z))
+	}
+	e := math.Exp(z)
+	return e / (1 + e)
+}
+
+// standardize считает среднее и разброс каждого признака; постоянный признак получает разброс 1
+func standardize(names []string, x [][]float64) []ChurnFeatureWeight {
+	features := make([]ChurnFeatureWeight, len(names))
+	n := float64(len(x))
+	for j, name := range names {
+		var sum, sq float64
+		for _, row := range x {
+			sum += row[j]
+		}
+		mean := sum / n
+		for _, row := range x {
+			sq += (row[j] - mean) * (row[j] - mean)
+		}
+		std := math.Sqrt(sq / n)
+		if std < 1e-9 {
+			std = 1
+		}
+		features[j] = ChurnFeatureWeight{Name: name, Mean: mean, Std: std}
+	}
+	return features
+}
+
+// logit – линейная часть модели для сырых признаков
+func churnLogit(features []ChurnFeatureWeight, intercept float64, x []float64) float64 {
+	z := intercept
+	for j, f := range features {
+		z += f.Weight * (x[j] - f.Mean) / f.Std
+	}
+	return z
+}
+
+// trainLogistic обучает модель; features уже содержат параметры стандартизации, веса заполняются
+func trainLogistic(features []ChurnFeatureWeight, x [][]float64, y []float64) (float64, error) {
+	p := len(features) + 1 // нулевой коэффициент – свободный член
+	beta := make([]float64, p)
+	z := make([][]float64, len(x))
+	for i, row := range x {
+		z[i] = make([]float64, p)
+		z[i][0] = 1
+		for j, f := range features {
+			z[i][j+1] = (row[j] - f.Mean) / f.Std
+		}
+	}
+	for iter := 0; iter < churnMaxNewton; iter++ {
+		grad := make([]float64, p)
+		hess := make([][]float64, p)
+		for k := range hess {
+			hess[k] = make([]float64, p)
+		}
+		for i, zi := range z {
+			var lin float64
+			for k := range zi {
+				lin += beta[k] * zi[k]
+			}
+			pi := sigmoid(lin)
+			w := pi * (1 - pi)
+			for k := range zi {
+				grad[k] += (pi - y[i]) * zi[k]
+				for l := k; l < p; l++ {
+					hess[k][l] += w * zi[k] * zi[l]
+				}
+			}
+		}
+		for k := 0; k < p; k++ {
+			for l := 0; l < k; l++ {
+				hess[k][l] = hess[l][k]
+			}
+			if k > 0 {
+				grad[k] += churnL2 * beta[k]
+				hess[k][k] += churnL2
+			}
+		}
+		step, err := solveLinear(hess, grad)
+		if err != nil {
+			return 0, err
+		}
+		maxStep := 0.0
+		for k := range beta {
+			beta[k] -= step[k]
+			maxStep = math.Max(maxStep, math.Abs(step[k]))
+		}
+		if maxStep < churnNewtonEps {
+			break
+		}
+	}
+	for j := range features {
+		features[j].Weight = beta[j+1]
+	}
+	return beta[0], nil
+}
+
+// solveLinear решает a·x = b методом Гаусса с выбором главного элемента (a и b портятся)
+func solveLinear(a [][]float64, b []float64) ([]float64, error) {
+	n := len(b)
+	for col := 0; col < n; col++ {
+		pivot := col
+		for r := col + 1; r < n; r++ {
+			if math.Abs(a[r][col]) > math.Abs(a[pivot][col]) {
+				pivot = r
+			}
+		}
+		if math.Abs(a[pivot][col]) < 1e-12 {
+			return nil, errChurnSingular
+		}
+		a[col], a[pivot] = a[pivot], a[col]
+		b[col], b[pivot] = b[pivot], b[col]
+		for r := col + 1; r < n; r++ {
+			f := a[r][col] / a[col][col]
+			for c := col; c < n; c++ {
+				a[r][c] -= f * a[col][c]
+			}
+			b[r] -= f * b[col]
+		}
+	}
+	x := make([]float64, n)
+	for r := n - 1; r >= 0; r-- {
+		s := b[r]
+		for c := r + 1; c < n; c++ {
+			s -= a[r][c] * x[c]
+		}
+		x[r] = s / a[r][r]
+	}
+	return x, nil
+}
+
+// rocAUC – площадь под ROC-кривой через ранги (совпадающие оценки получают средний ранг)
+func rocAUC(scores, labels []float64) float64 {
+	idx := make([]int, len(scores))
+	for i := range idx {
+		idx[i] = i
+	}
+	sort.Slice(idx, func(a, b int) bool { return scores[idx[a]] < scores[idx[b]] })
+	var rankSum, positives float64
+	for i := 0; i < len(idx); {
+		j := i
+		for j < len(idx) && scores[idx[j]] == scores[idx[i]] {
+			j++
+		}
+		rank := float64(i+j+1) / 2 // ранги i+1..j
+		for k := i; k < j; k++ {
+			if labels[idx[k]] == 1 {
+				rankSum += rank
+				positives++
+			}
+		}
+		i = j
+	}
+	negatives := float64(len(scores)) - positives
+	if positives == 0 || negatives == 0 {
+		return 0.5
+	}
+	return (rankSum - positives*(positives+1)/2) / (positives * negatives)
+}
+
+// evaluateChurn считает метрики прогнозов probs против фактических меток
+func evaluateChurn(probs, labels []float64) ChurnMetrics {
+	m := ChurnMetrics{AUC: round4(rocAUC(probs, labels))}
+	buckets := make([]ChurnCalibrationBucket, churnCalibBuckets)
+	for b := range buckets {
+		buckets[b].From = float64(b) / churnCalibBuckets
+		buckets[b].To = float64(b+1) / churnCalibBuckets
+	}
+	var logLoss, brier, positives float64
+	for i, p := range probs {
+		y := labels[i]
+		pc := math.Min(math.Max(p, 1e-15), 1-1e-15)
+		logLoss -= y*math.Log(pc) + (1-y)*math.Log(1-pc)
+		brier += (p - y) * (p - y)
+		positives += y
+		b := int(p * churnCalibBuckets)
+		if b >= churnCalibBuckets {
+			b = churnCalibBuckets - 1
+		}
+		buckets[b].Count++
+		buckets[b].Predicted += p
+		buckets[b].Observed += y
+	}
+	n := float64(len(probs))
+	m.LogLoss = round4(logLoss / n)
+	m.Brier = round4(brier / n)
+	m.BaseRate = round4(positives / n)
+	var ece float64
+	m.Calibration = []ChurnCalibrationBucket{}
+	for _, b := range buckets {
+		if b.Count == 0 {
+			continue
+		}
+		b.Predicted /= float64(b.Count)
+		b.Observed /= float64(b.Count)
+		ece += float64(b.Count) / n * math.Abs(b.Predicted-b.Observed)
+		b.Predicted, b.Observed = round4(b.Predicted), round4(b.Observed)
+		m.Calibration = append(m.Calibration, b)
+	}
+	m.CalibrationError = round4(ece)
+	return m
+}
+
+func round4(v float64) float64 {
+	return math.Round(v*10000) / 10000
+}
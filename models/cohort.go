@@ -0,0 +1,502 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Когортный анализ удержания. Определение задаёт событие входа в когорту (первое такое событие
+// субъекта), событие удержания и шаг (день, неделя, месяц). Субъект – пользователь сервиса или
+// клиент CRM, в зависимости от событий; оба события должны относиться к одному виду субъектов.
+//
+// Расчёт инкрементальный: каждый проход берёт события после computed_through, добавляет новых
+// участников и отмечает периоды, в которых участник совершил событие удержания. Уже учтённые
+// строки не пересчитываются; смена событий или шага сбрасывает расчёт.
+//
+// Определения с user_id = NULL считаются по всему сервису и доступны только администратору;
+// личные определения видят только клиентов CRM своего владельца.
+
+var (
+	ErrCohortDefinitionNotFound = errors.New("cohort definition not found")
+	ErrInvalidCohortDefinition  = errors.New("invalid cohort definition")
+)
+
+// Виды субъектов когорт
+const (
+	CohortSubjectUser     = "user"
+	CohortSubjectCustomer = "customer"
+)
+
+const (
+	cohortNameMaxLen     = 255
+	cohortDefaultPeriods = 12
+)
+
+// cohortMaxPeriods – сколько периодов (и когорт) показывает матрица при каждом шаге
+var cohortMaxPeriods = map[string]int{
+	RevenueGranularityDay:   90,
+	RevenueGranularityWeek:  52,
+	RevenueGranularityMonth: 36,
+}
+
+// CohortEvent – событие входа в когорту или удержания.
+// sql возвращает (subject_id, owner_id, at); owner_id – владелец клиента CRM для личных определений.
+type CohortEvent struct {
+	Code    string `json:"code"`
+	Name    string `json:"name"`
+	Subject string `json:"subject"`
+	sql     string
+}
+
+// wonDealsSQL – выигранные сделки с владельцем клиента
+const wonDealsSQL = `SELECT d.customer_id, c.user_id, d.closed_at
+	FROM crm_deals d
+	JOIN crm_customers c ON c.id = d.customer_id
+	JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage AND ps.is_won
+	WHERE d.closed_at IS NOT NULL AND d.deleted_at IS NULL`
+
+// CohortEntryEvents – события входа в когорту
+var CohortEntryEvents = []CohortEvent{
+	{Code: "signup", Name: "Регистрация", Subject: CohortSubjectUser,
+		sql: `SELECT id, id, created_at FROM users`},
+	{Code: "first_payment", Name: "Первая оплата", Subject: CohortSubjectUser,
+		sql: `SELECT user_id, user_id, COALESCE(completed_at, created_at) FROM payments WHERE status = 'completed'`},
+	{Code: "customer_created", Name: "Клиент добавлен в CRM", Subject: CohortSubjectCustomer,
+		sql: `SELECT id, user_id, created_at FROM crm_customers WHERE deleted_at IS NULL`},
+	{Code: "first_deal_won", Name: "Первая выигранная сделка", Subject: CohortSubjectCustomer,
+		sql: wonDealsSQL},
+}
+
+// CohortRetentionEvents – события удержания
+var CohortRetentionEvents = []CohortEvent{
+	{Code: "payment", Name: "Оплата", Subject: CohortSubjectUser,
+		sql: `SELECT user_id, user_id, COALESCE(completed_at, created_at) FROM payments WHERE status = 'completed'`},
+	{Code: "crm_activity", Name: "Работа в CRM (активность)", Subject: CohortSubjectUser,
+		sql: `SELECT user_id, user_id, created_at FROM activities WHERE user_id IS NOT NULL AND deleted_at IS NULL`},
+	{Code: "activity", Name: "Активность по клиенту или его сделке", Subject: CohortSubjectCustomer,
+		sql: `SELECT COALESCE(d.customer_id, a.entity_id), NULL::uuid, a.created_at
+			FROM activities a
+			LEFT JOIN crm_deals d ON a.entity_type = 'deal' AND d.id = a.entity_id
+			WHERE a.deleted_at IS NULL AND (a.entity_type = 'customer' OR d.id IS NOT NULL)`},
+	{Code: "deal_won", Name: "Выигранная сделка", Subject: CohortSubjectCustomer,
+		sql: wonDealsSQL},
+	{Code: "email_received", Name: "Входящее письмо", Subject: CohortSubjectCustomer,
+		sql: `SELECT customer_id, NULL::uuid, sent_at FROM crm_email_messages WHERE direction = 'in' AND customer_id IS NOT NULL`},
+}
+
+func findCohortEvent(events []CohortEvent, code string) *CohortEvent {
+	for i := range events {
+		if events[i].Code == code {
+			return &events[i]
+		}
+	}
+	return nil
+}
+
+// CohortDefinition – сохранённое определение когорт
+type CohortDefinition struct {
+	ID              string     `json:"id"`
+	UserID          *string    `json:"user_id,omitempty"`
+	Name            string     `json:"name"`
+	CohortEvent     string     `json:"cohort_event"`
+	RetentionEvent  string     `json:"retention_event"`
+	Granularity     string     `json:"granularity"`
+	Periods         int        `json:"periods"`
+	Subject         string     `json:"subject"`
+	Global          bool       `json:"global"`
+	ComputedThrough *time.Time `json:"computed_through"`
+	CreatedBy       *string    `json:"created_by,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+}
+
+// CanView – определения по всему сервису доступны только администратору, личные – владельцу
+func (d *CohortDefinition) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || (d.UserID != nil && *d.UserID == userID)
+}
+
+// Normalize проверяет определение и подставляет значения по умолчанию
+func (d *CohortDefinition) Normalize() error {
+	d.Name = strings.TrimSpace(d.Name)
+	if d.Name == "" || len([]rune(d.Name)) > cohortNameMaxLen {
+		return fmt.Errorf("%w: name is required (up to %d characters)", ErrInvalidCohortDefinition, cohortNameMaxLen)
+	}
+	entry := findCohortEvent(CohortEntryEvents, d.CohortEvent)
+	if entry == nil {
+		return fmt.Errorf("%w: unknown cohort_event %q", ErrInvalidCohortDefinition, d.CohortEvent)
+	}
+	retention := findCohortEvent(CohortRetentionEvents, d.RetentionEvent)
+	if retention == nil {
+		return fmt.Errorf("%w: unknown retention_event %q", ErrInvalidCohortDefinition, d.RetentionEvent)
+	}
+	if entry.Subject != retention.Subject {
+		return fmt.Errorf("%w: %s and %s describe different subjects", ErrInvalidCohortDefinition, d.CohortEvent, d.RetentionEvent)
+	}
+	if entry.Subject == CohortSubjectUser && d.UserID != nil {
+		return fmt.Errorf("%w: user cohorts are available only for service-wide definitions", ErrInvalidCohortDefinition)
+	}
+	if d.Granularity == "" {
+		d.Granularity = RevenueGranularityMonth
+	}
+	maxPeriods, ok := cohortMaxPeriods[d.Granularity]
+	if !ok {
+		return fmt.Errorf("%w: granularity must be day, week or month", ErrInvalidCohortDefinition)
+	}
+	if d.Periods == 0 {
+		d.Periods = cohortDefaultPeriods
+	}
+	if d.Periods < 1 || d.Periods > maxPeriods {
+		return fmt.Errorf("%w: periods must be between 1 and %d for %s", ErrInvalidCohortDefinition, maxPeriods, d.Granularity)
+	}
+	d.Subject = entry.Subject
+	d.Global = d.UserID == nil
+	return nil
+}
+
+const cohortDefinitionColumns = `id, user_id::text, name, cohort_event, retention_event, granularity, periods,
+	computed_through, created_by::text, created_at, updated_at`
+
+func scanCohortDefinition(row pgx.Row) (*CohortDefinition, error) {
+	var d CohortDefinition
+	err := row.Scan(&d.ID, &d.UserID, &d.Name, &d.CohortEvent, &d.RetentionEvent, &d.Granularity, &d.Periods,
+		&d.ComputedThrough, &d.CreatedBy, &d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	d.Global = d.UserID == nil
+	if e := findCohortEvent(CohortEntryEvents, d.CohortEvent); e != nil {
+		d.Subject = e.Subject
+	}
+	return &d, nil
+}
+
+// ListCohortDefinitions – определения пользователя; администратору – ещё и по всему сервису
+func ListCohortDefinitions(ctx context.Context, userID string, isAdmin bool) ([]*CohortDefinition, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+cohortDefinitionColumns+` FROM analytics_cohort_definitions
+		WHERE user_id::text = $1 OR ($2 AND user_id IS NULL)
+		ORDER BY user_id NULLS FIRST, name
+	`, userID, isAdmin)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	defs := []*CohortDefinition{}
+	for rows.Next() {
+		d, err := scanCohortDefinition(rows)
+		if err != nil {
+			return nil, err
+		}
+		defs = append(defs, d)
+	}
+	return defs, rows.Err()
+}
+
+// CohortDefinitionIDs – все определения, для фонового досчёта
+func CohortDefinitionIDs(ctx context.Context) ([]string, error) {
+	rows, err := database.Pool.Query(ctx, `SELECT id::text FROM analytics_cohort_definitions ORDER BY created_at`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// GetCohortDefinition возвращает определение по ID
+func GetCohortDefinition(ctx context.Context, id string) (*CohortDefinition, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrCohortDefinitionNotFound
+	}
+	d, err := scanCohortDefinition(database.Pool.QueryRow(ctx,
+		`SELECT `+cohortDefinitionColumns+` FROM analytics_cohort_definitions WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrCohortDefinitionNotFound
+	}
+	return d, err
+}
+
+// CreateCohortDefinition сохраняет новое определение (после Normalize)
+func CreateCohortDefinition(ctx context.Context, d *CohortDefinition) error {
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO analytics_cohort_definitions (user_id, name, cohort_event, retention_event, granularity, periods, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, updated_at
+	`, d.UserID, d.Name, d.CohortEvent, d.RetentionEvent, d.Granularity, d.Periods, d.CreatedBy).Scan(&d.ID, &d.CreatedAt, &d.UpdatedAt)
+}
+
+// UpdateCohortDefinition сохраняет изменения (после Normalize). Смена событий или шага
+// удаляет посчитанных участников – следующий расчёт пройдёт всю историю заново.
+func UpdateCohortDefinition(ctx context.Context, d *CohortDefinition) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	var reset bool
+	err = tx.QueryRow(ctx, `
+		SELECT cohort_event <> $2 OR retention_event <> $3 OR granularity <> $4
+		FROM analytics_cohort_definitions WHERE id = $1 FOR UPDATE
+	`, d.ID, d.CohortEvent, d.RetentionEvent, d.Granularity).Scan(&reset)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrCohortDefinitionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if reset {
+		if _, err := tx.Exec(ctx, `DELETE FROM analytics_cohort_members WHERE definition_id = $1`, d.ID); err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(ctx, `
+		UPDATE analytics_cohort_definitions
+		SET name = $2, cohort_event = $3, retention_event = $4, granularity = $5, periods = $6,
+		    computed_through = CASE WHEN $7 THEN NULL ELSE computed_through END, updated_at = NOW()
+		WHERE id = $1
+		RETURNING computed_through, updated_at
+	`, d.ID, d.Name, d.CohortEvent, d.RetentionEvent, d.Granularity, d.Periods, reset).Scan(&d.ComputedThrough, &d.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteCohortDefinition удаляет определение вместе с посчитанными данными
+func DeleteCohortDefinition(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM analytics_cohort_definitions WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrCohortDefinitionNotFound
+	}
+	return nil
+}
+
+// cohortPeriodSQL – номер периода события bucket относительно начала когорты start при шаге $4
+const cohortPeriodSQL = `CASE $4
+	WHEN 'day' THEN %[1]s - %[2]s
+	WHEN 'week' THEN (%[1]s - %[2]s) / 7
+	ELSE ((EXTRACT(YEAR FROM %[1]s) - EXTRACT(YEAR FROM %[2]s)) * 12
+		+ EXTRACT(MONTH FROM %[1]s) - EXTRACT(MONTH FROM %[2]s))::int
+END`
+
+// ComputeCohorts досчитывает определение по событиям после computed_through.
+// Возвращает число новых участников и новых отметок удержания.
+func ComputeCohorts(ctx context.Context, id string) (members, retained int64, err error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer tx.Rollback(ctx)
+
+	d, err := scanCohortDefinition(tx.QueryRow(ctx,
+		`SELECT `+cohortDefinitionColumns+` FROM analytics_cohort_definitions WHERE id = $1 FOR UPDATE`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, 0, ErrCohortDefinitionNotFound
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	entry := findCohortEvent(CohortEntryEvents, d.CohortEvent)
+	retention := findCohortEvent(CohortRetentionEvents, d.RetentionEvent)
+	if entry == nil || retention == nil {
+		return 0, 0, fmt.Errorf("%w: unknown events %s/%s", ErrInvalidCohortDefinition, d.CohortEvent, d.RetentionEvent)
+	}
+	until := time.Now()
+
+	// Новые участники: первое событие входа в окне; уже вошедшие в когорту не меняются.
+	// Окна идут по порядку, поэтому первое событие окна – первое событие вообще.
+	tag, err := tx.Exec(ctx, `
+		INSERT INTO analytics_cohort_members (definition_id, subject_id, joined_at, cohort_start)
+		SELECT $3, e.subject_id, MIN(e.at), date_trunc($4, MIN(e.at))::date
+		FROM (`+entry.sql+`) e(subject_id, owner_id, at)
+		WHERE ($1::timestamp IS NULL OR e.at > $1) AND e.at <= $2
+		  AND ($5::uuid IS NULL OR e.owner_id = $5)
+		GROUP BY e.subject_id
+		ON CONFLICT DO NOTHING
+	`, d.ComputedThrough, until, d.ID, d.Granularity, d.UserID)
+	if err != nil {
+		return 0, 0, err
+	}
+	members = tag.RowsAffected()
+
+	// Отметки удержания: событие не раньше входа в когорту, в периоде от её начала
+	period := fmt.Sprintf(cohortPeriodSQL, "date_trunc($4, e.at)::date", "m.cohort_start")
+	tag, err = tx.Exec(ctx, `
+		INSERT INTO analytics_cohort_retention (definition_id, subject_id, period)
+		SELECT DISTINCT $3::uuid, m.subject_id, `+period+`
+		FROM (`+retention.sql+`) e(subject_id, owner_id, at)
+		JOIN analytics_cohort_members m ON m.definition_id = $3 AND m.subject_id = e.subject_id
+		WHERE ($1::timestamp IS NULL OR e.at > $1) AND e.at <= $2 AND e.at >= m.joined_at
+		ON CONFLICT DO NOTHING
+	`, d.ComputedThrough, until, d.ID, d.Granularity)
+	if err != nil {
+		return 0, 0, err
+	}
+	retained = tag.RowsAffected()
+
+	if _, err := tx.Exec(ctx, `UPDATE analytics_cohort_definitions SET computed_through = $2 WHERE id = $1`, d.ID, until); err != nil {
+		return 0, 0, err
+	}
+	return members, retained, tx.Commit(ctx)
+}
+
+// CohortRow – строка матрицы: когорта и удержание по периодам от её начала.
+// Последний период строки может быть незавершённым (Complete меньше длины Retained).
+type CohortRow struct {
+	Cohort   string    `json:"cohort"`
+	Size     int       `json:"size"`
+	Retained []int     `json:"retained"`
+	Rates    []float64 `json:"rates"`
+	Complete int       `json:"complete_periods"`
+}
+
+// CohortMatrix – треугольная матрица удержания
+type CohortMatrix struct {
+	Definition *CohortDefinition `json:"definition"`
+	Periods    int               `json:"periods"`
+	Rows       []CohortRow       `json:"rows"`
+	// Average – взвешенное удержание по завершённым периодам всех когорт; nil – данных нет
+	Average []*float64 `json:"average"`
+}
+
+// cohortBucket – начало периода, в который попадает момент t
+func cohortBucket(t time.Time, granularity string) time.Time {
+	return revenueBucketStart(revenueDay(t), granularity)
+}
+
+// cohortPeriodIndex – номер периода bucket относительно начала когорты start (как cohortPeriodSQL)
+func cohortPeriodIndex(start, bucket time.Time, granularity string) int {
+	switch granularity {
+	case RevenueGranularityDay:
+		return int(math.Round(bucket.Sub(start).Hours() / 24))
+	case RevenueGranularityWeek:
+		return int(math.Round(bucket.Sub(start).Hours()/24)) / 7
+	}
+	return monthsBetween(start, bucket)
+}
+
+// cohortShift – начало периода, отстоящего от start на n шагов
+func cohortShift(start time.Time, granularity string, n int) time.Time {
+	switch granularity {
+	case RevenueGranularityDay:
+		return start.AddDate(0, 0, n)
+	case RevenueGranularityWeek:
+		return start.AddDate(0, 0, 7*n)
+	}
+	return start.AddDate(0, n, 0)
+}
+
+// GetCohortMatrix собирает матрицу для последних Periods когорт по посчитанным данным
+func GetCohortMatrix(ctx context.Context, d *CohortDefinition) (*CohortMatrix, error) {
+	current := cohortBucket(time.Now(), d.Granularity)
+	since := cohortShift(current, d.Granularity, -(d.Periods - 1))
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT cohort_start, COUNT(*) FROM analytics_cohort_members
+		WHERE definition_id = $1 AND cohort_start >= $2
+		GROUP BY cohort_start ORDER BY cohort_start
+	`, d.ID, since)
+	if err != nil {
+		return nil, err
+	}
+	matrix := &CohortMatrix{Definition: d, Periods: d.Periods, Rows: []CohortRow{}}
+	index := map[string]int{}
+	for rows.Next() {
+		var start time.Time
+		var size int
+		if err := rows.Scan(&start, &size); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		start = revenueDay(start)
+		elapsed := cohortPeriodIndex(start, current, d.Granularity)
+		if elapsed < 0 {
+			elapsed = 0
+		}
+		length := elapsed + 1
+		if length > d.Periods {
+			length = d.Periods
+		}
+		complete := elapsed
+		if complete > length {
+			complete = length
+		}
+		row := CohortRow{
+			Cohort:   start.Format(revenueDateLayout),
+			Size:     size,
+			Retained: make([]int, length),
+			Rates:    make([]float64, length),
+			Complete: complete,
+		}
+		index[row.Cohort] = len(matrix.Rows)
+		matrix.Rows = append(matrix.Rows, row)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.Pool.Query(ctx, `
+		SELECT m.cohort_start, r.period, COUNT(*)
+		FROM analytics_cohort_retention r
+		JOIN analytics_cohort_members m ON m.definition_id = r.definition_id AND m.subject_id = r.subject_id
+		WHERE r.definition_id = $1 AND m.cohort_start >= $2 AND r.period >= 0 AND r.period < $3
+		GROUP BY 1, 2
+	`, d.ID, since, d.Periods)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var start time.Time
+		var period, count int
+		if err := rows.Scan(&start, &period, &count); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		i, ok := index[revenueDay(start).Format(revenueDateLayout)]
+		if !ok || period >= len(matrix.Rows[i].Retained) {
+			continue
+		}
+		matrix.Rows[i].Retained[period] = count
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	matrix.Average = make([]*float64, d.Periods)
+	for p := 0; p < d.Periods; p++ {
+		var retained, size int
+		for i := range matrix.Rows {
+			row := &matrix.Rows[i]
+			if p < len(row.Retained) {
+				row.Rates[p] = math.Round(float64(row.Retained[p])/float64(row.Size)*10000) / 10000
+			}
+			if p < row.Complete {
+				retained += row.Retained[p]
+				size += row.Size
+			}
+		}
+		matrix.Average[p] = revenueRatio(float64(retained), float64(size))
+	}
+	return matrix, nil
+}
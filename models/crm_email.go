@@ -0,0 +1,434 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Переписка с клиентами: входящие письма из IMAP и отправленные из CRM собираются в цепочки
+// по заголовкам Message-ID / In-Reply-To / References и привязываются к клиенту по адресу.
+// Каждое письмо и первое открытие отправленного письма пишутся в активности.
+
+var ErrEmailThreadNotFound = errors.New("email thread not found")
+
+// Направление письма
+const (
+	EmailDirectionIn  = "in"
+	EmailDirectionOut = "out"
+)
+
+// Типы активностей почтового канала (email_opened и email_replied учитывает скоринг лидов)
+const (
+	ActivityEmailSent     = "email_sent"
+	ActivityEmailReceived = "email_received"
+	ActivityEmailReplied  = "email_replied"
+	ActivityEmailOpened   = "email_opened"
+)
+
+// emailActivitySnippetLen – сколько символов текста письма попадает в активность
+const emailActivitySnippetLen = 300
+
+// EmailMessage – письмо переписки
+type EmailMessage struct {
+	ID            string     `json:"id"`
+	MailboxID     string     `json:"mailbox_id"`
+	ThreadID      string     `json:"thread_id"`
+	CustomerID    *string    `json:"customer_id,omitempty"`
+	DealID        *string    `json:"deal_id,omitempty"`
+	Direction     string     `json:"direction"`
+	MessageID     string     `json:"message_id"`
+	InReplyTo     string     `json:"in_reply_to,omitempty"`
+	References    []string   `json:"references,omitempty"`
+	FromAddr      string     `json:"from"`
+	FromName      string     `json:"from_name,omitempty"`
+	To            []string   `json:"to"`
+	Cc            []string   `json:"cc,omitempty"`
+	Subject       string     `json:"subject"`
+	BodyText      string     `json:"body_text"`
+	BodyHTML      string     `json:"body_html,omitempty"`
+	IMAPUID       *int64     `json:"-"`
+	TemplateID    *string    `json:"template_id,omitempty"`
+	SentBy        *string    `json:"sent_by,omitempty"`
+	TrackingToken *string    `json:"-"`
+	OpenCount     int        `json:"open_count"`
+	OpenedAt      *time.Time `json:"opened_at,omitempty"`
+	SentAt        time.Time  `json:"sent_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+
+	// ActivityType – какой активностью письмо записано клиенту (заполняет SaveEmailMessage)
+	ActivityType string `json:"-"`
+}
+
+// EmailThread – цепочка писем одного ящика
+type EmailThread struct {
+	ID            string          `json:"id"`
+	MailboxID     string          `json:"mailbox_id"`
+	MailboxEmail  string          `json:"mailbox_email"`
+	UserID        string          `json:"user_id"` // владелец ящика
+	CustomerID    *string         `json:"customer_id,omitempty"`
+	CustomerName  *string         `json:"customer_name,omitempty"`
+	Subject       string          `json:"subject"`
+	MessageCount  int             `json:"message_count"`
+	LastMessageAt time.Time       `json:"last_message_at"`
+	CreatedAt     time.Time       `json:"created_at"`
+	Messages      []*EmailMessage `json:"messages,omitempty"`
+}
+
+// CanView – переписку видит владелец ящика и администратор; доступ через клиента проверяет обработчик
+func (t *EmailThread) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || (userID != "" && t.UserID == userID)
+}
+
+// NewEmailTrackingToken – случайный токен пикселя отслеживания открытий
+func NewEmailTrackingToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// NewEmailMessageID – значение заголовка Message-ID (без угловых скобок) для домена ящика
+func NewEmailMessageID(fromAddr string) string {
+	domain := "localhost"
+	if i := strings.LastIndex(fromAddr, "@"); i >= 0 && i < len(fromAddr)-1 {
+		domain = fromAddr[i+1:]
+	}
+	return uuid.NewString() + "@" + domain
+}
+
+const emailMessageColumns = `id, mailbox_id, thread_id, customer_id::text, deal_id::text, direction, message_id, in_reply_to, refs,
+	from_addr, from_name, to_addrs, cc_addrs, subject, body_text, body_html, imap_uid, template_id::text, sent_by::text,
+	tracking_token, open_count, opened_at, sent_at, created_at`
+
+func scanEmailMessage(row pgx.Row) (*EmailMessage, error) {
+	var m EmailMessage
+	err := row.Scan(&m.ID, &m.MailboxID, &m.ThreadID, &m.CustomerID, &m.DealID, &m.Direction, &m.MessageID, &m.InReplyTo, &m.References,
+		&m.FromAddr, &m.FromName, &m.To, &m.Cc, &m.Subject, &m.BodyText, &m.BodyHTML, &m.IMAPUID, &m.TemplateID, &m.SentBy,
+		&m.TrackingToken, &m.OpenCount, &m.OpenedAt, &m.SentAt, &m.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// emailCounterparts – адреса собеседников: отправитель входящего или получатели исходящего, кроме самого ящика
+func emailCounterparts(mb *Mailbox, m *EmailMessage) []string {
+	var addrs []string
+	if m.Direction == EmailDirectionIn {
+		addrs = []string{m.FromAddr}
+	} else {
+		addrs = append(append(addrs, m.To...), m.Cc...)
+	}
+	result := make([]string, 0, len(addrs))
+	for _, a := range addrs {
+		a = strings.ToLower(strings.TrimSpace(a))
+		if a != "" && a != mb.Email && !containsString(result, a) {
+			result = append(result, a)
+		}
+	}
+	return result
+}
+
+// SaveEmailMessage сохраняет письмо ящика: находит цепочку, клиента и пишет активность.
+// Повторно то же письмо (тот же Message-ID в ящике) не сохраняется – возвращается false.
+// onlyKnown – сохранять только письма клиентов CRM и ответы в уже известных цепочках:
+// так синхронизация не тянет в базу личную переписку владельца ящика.
+func SaveEmailMessage(ctx context.Context, mb *Mailbox, m *EmailMessage, onlyKnown bool) (bool, error) {
+	m.MessageID = strings.Trim(strings.TrimSpace(m.MessageID), "<>")
+	if m.MessageID == "" {
+		return false, fmt.Errorf("message without Message-ID")
+	}
+	if m.References == nil {
+		m.References = []string{}
+	}
+	if m.To == nil {
+		m.To = []string{}
+	}
+	if m.Cc == nil {
+		m.Cc = []string{}
+	}
+	m.MailboxID = mb.ID
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM crm_email_messages WHERE mailbox_id = $1 AND message_id = $2)`,
+		mb.ID, m.MessageID).Scan(&exists); err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	// Цепочка: явно заданная (ответ из CRM) или та, где лежит любое из упомянутых писем
+	var threadCustomerID *string
+	if m.ThreadID == "" {
+		parents := append([]string{}, m.References...)
+		if m.InReplyTo != "" {
+			parents = append(parents, m.InReplyTo)
+		}
+		if len(parents) > 0 {
+			err := tx.QueryRow(ctx, `
+				SELECT t.id, t.customer_id::text FROM crm_email_messages em
+				JOIN crm_email_threads t ON t.id = em.thread_id
+				WHERE em.mailbox_id = $1 AND em.message_id = ANY($2)
+				ORDER BY em.sent_at DESC LIMIT 1
+			`, mb.ID, parents).Scan(&m.ThreadID, &threadCustomerID)
+			if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+				return false, err
+			}
+		}
+	} else {
+		err := tx.QueryRow(ctx, `SELECT customer_id::text FROM crm_email_threads WHERE id = $1 AND mailbox_id = $2`,
+			m.ThreadID, mb.ID).Scan(&threadCustomerID)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return false, ErrEmailThreadNotFound
+		}
+		if err != nil {
+			return false, err
+		}
+	}
+
+	// Клиент: заданный явно, найденный по адресу собеседника или клиент цепочки
+	if m.CustomerID == nil {
+		if addrs := emailCounterparts(mb, m); len(addrs) > 0 {
+			var customerID string
+			err := tx.QueryRow(ctx, `
+				SELECT id::text FROM crm_customers
+				WHERE lower(email) = ANY($1) AND deleted_at IS NULL
+				ORDER BY array_position($1, lower(email)::text) LIMIT 1
+			`, addrs).Scan(&customerID)
+			if err == nil {
+				m.CustomerID = &customerID
+			} else if !errors.Is(err, pgx.ErrNoRows) {
+				return false, err
+			}
+		}
+		if m.CustomerID == nil {
+			m.CustomerID = threadCustomerID
+		}
+	}
+	if onlyKnown && m.CustomerID == nil && m.ThreadID == "" {
+		return false, nil
+	}
+
+	// Ответ клиента – входящее письмо в цепочке, где мы уже писали
+	m.ActivityType = ActivityEmailSent
+	if m.Direction == EmailDirectionIn {
+		m.ActivityType = ActivityEmailReceived
+		if m.ThreadID != "" {
+			var replied bool
+			if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM crm_email_messages WHERE thread_id = $1 AND direction = $2)`,
+				m.ThreadID, EmailDirectionOut).Scan(&replied); err != nil {
+				return false, err
+			}
+			if replied {
+				m.ActivityType = ActivityEmailReplied
+			}
+		}
+	}
+
+	if m.ThreadID == "" {
+		if err := tx.QueryRow(ctx, `
+			INSERT INTO crm_email_threads (mailbox_id, customer_id, subject, last_message_at)
+			VALUES ($1, $2, $3, $4) RETURNING id
+		`, mb.ID, m.CustomerID, m.Subject, m.SentAt).Scan(&m.ThreadID); err != nil {
+			return false, err
+		}
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO crm_email_messages (mailbox_id, thread_id, customer_id, deal_id, direction, message_id, in_reply_to, refs,
+			from_addr, from_name, to_addrs, cc_addrs, subject, body_text, body_html, imap_uid, template_id, sent_by, tracking_token, sent_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18, $19, $20)
+		RETURNING id, created_at
+	`, mb.ID, m.ThreadID, m.CustomerID, m.DealID, m.Direction, m.MessageID, m.InReplyTo, m.References,
+		m.FromAddr, m.FromName, m.To, m.Cc, m.Subject, m.BodyText, m.BodyHTML, m.IMAPUID, m.TemplateID, m.SentBy, m.TrackingToken, m.SentAt,
+	).Scan(&m.ID, &m.CreatedAt)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `
+		UPDATE crm_email_threads SET message_count = message_count + 1,
+			last_message_at = GREATEST(last_message_at, $2), customer_id = COALESCE(customer_id, $3)
+		WHERE id = $1
+	`, m.ThreadID, m.SentAt, m.CustomerID); err != nil {
+		return false, err
+	}
+
+	if m.CustomerID != nil {
+		verb := "Входящее письмо"
+		if m.Direction == EmailDirectionOut {
+			verb = "Отправлено письмо"
+		}
+		content := verb + ": " + m.Subject
+		if snippet := strings.Join(strings.Fields(m.BodyText), " "); snippet != "" {
+			content += "\n" + truncateString(snippet, emailActivitySnippetLen)
+		}
+		if err := insertEmailActivity(ctx, tx, m, m.ActivityType, content, m.SentBy); err != nil {
+			return false, err
+		}
+	}
+	return true, tx.Commit(ctx)
+}
+
+// insertEmailActivity пишет активность письма: по сделке, если письмо к ней привязано, иначе по клиенту
+func insertEmailActivity(ctx context.Context, tx pgx.Tx, m *EmailMessage, activityType, content string, userID *string) error {
+	entityType, entityID := "customer", m.CustomerID
+	if m.DealID != nil {
+		entityType, entityID = "deal", m.DealID
+	}
+	_, err := tx.Exec(ctx, `
+		INSERT INTO activities (entity_type, entity_id, activity_type, content, user_id)
+		VALUES ($1, $2, $3, $4, $5)
+	`, entityType, entityID, activityType, content, userID)
+	return err
+}
+
+// EmailThreadFilter – отбор цепочек: по клиенту или по ящикам пользователя
+type EmailThreadFilter struct {
+	CustomerID string
+	UserID     string // владелец ящиков; пусто – все ящики
+	Limit      int
+	Offset     int
+}
+
+const emailThreadColumns = `t.id, t.mailbox_id, mb.email, mb.user_id::text, t.customer_id::text, c.name, t.subject,
+	t.message_count, t.last_message_at, t.created_at`
+
+func scanEmailThread(row pgx.Row) (*EmailThread, error) {
+	var t EmailThread
+	err := row.Scan(&t.ID, &t.MailboxID, &t.MailboxEmail, &t.UserID, &t.CustomerID, &t.CustomerName, &t.Subject,
+		&t.MessageCount, &t.LastMessageAt, &t.CreatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrEmailThreadNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+const emailThreadFrom = `crm_email_threads t
+	JOIN crm_mailboxes mb ON mb.id = t.mailbox_id
+	LEFT JOIN crm_customers c ON c.id = t.customer_id AND c.deleted_at IS NULL`
+
+// ListEmailThreads возвращает цепочки, новые сверху, и общее число
+func ListEmailThreads(ctx context.Context, f EmailThreadFilter) ([]*EmailThread, int, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	if f.CustomerID != "" {
+		args = append(args, f.CustomerID)
+		where = append(where, fmt.Sprintf("t.customer_id::text = $%d", len(args)))
+	}
+	if f.UserID != "" {
+		args = append(args, f.UserID)
+		where = append(where, fmt.Sprintf("mb.user_id::text = $%d", len(args)))
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM `+emailThreadFrom+` WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+		SELECT `+emailThreadColumns+` FROM `+emailThreadFrom+` WHERE `+cond+`
+		ORDER BY t.last_message_at DESC LIMIT $%d OFFSET $%d
+	`, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	threads := []*EmailThread{}
+	for rows.Next() {
+		t, err := scanEmailThread(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		threads = append(threads, t)
+	}
+	return threads, total, rows.Err()
+}
+
+// GetEmailThread возвращает цепочку с письмами по порядку
+func GetEmailThread(ctx context.Context, id string) (*EmailThread, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrEmailThreadNotFound
+	}
+	t, err := scanEmailThread(database.Pool.QueryRow(ctx, `SELECT `+emailThreadColumns+` FROM `+emailThreadFrom+` WHERE t.id = $1`, id))
+	if err != nil {
+		return nil, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+emailMessageColumns+` FROM crm_email_messages WHERE thread_id = $1 ORDER BY sent_at, created_at
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	t.Messages = []*EmailMessage{}
+	for rows.Next() {
+		m, err := scanEmailMessage(rows)
+		if err != nil {
+			return nil, err
+		}
+		t.Messages = append(t.Messages, m)
+	}
+	return t, rows.Err()
+}
+
+// LastEmailMessage – последнее письмо цепочки (на него отвечает письмо из CRM)
+func LastEmailMessage(ctx context.Context, threadID string) (*EmailMessage, error) {
+	m, err := scanEmailMessage(database.Pool.QueryRow(ctx, `
+		SELECT `+emailMessageColumns+` FROM crm_email_messages WHERE thread_id = $1 ORDER BY sent_at DESC, created_at DESC LIMIT 1
+	`, threadID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrEmailThreadNotFound
+	}
+	return m, err
+}
+
+// RecordEmailOpen учитывает открытие письма по токену пикселя. Первое открытие пишется
+// в активности клиента; неизвестный токен не считается ошибкой (возвращается nil).
+func RecordEmailOpen(ctx context.Context, token string) (*EmailMessage, error) {
+	if token == "" || len(token) > 64 {
+		return nil, nil
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	m, err := scanEmailMessage(tx.QueryRow(ctx, `
+		UPDATE crm_email_messages SET open_count = open_count + 1, opened_at = COALESCE(opened_at, NOW())
+		WHERE tracking_token = $1
+		RETURNING `+emailMessageColumns, token))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.OpenCount == 1 && m.CustomerID != nil {
+		if err := insertEmailActivity(ctx, tx, m, ActivityEmailOpened, "Письмо открыто: "+m.Subject, nil); err != nil {
+			return nil, err
+		}
+	}
+	return m, tx.Commit(ctx)
+}
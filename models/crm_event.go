@@ -0,0 +1,234 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Журнал событий CRM для живых обновлений канбана и дашбордов.
+// Каждое изменение записывается в crm_events и анонсируется через NOTIFY crm_events (в payload – только id),
+// экземпляры приложения дочитывают новые строки из таблицы. Так события не теряются при переполнении
+// очереди NOTIFY, а переподключившийся клиент дополучает пропущенное по Last-Event-ID. Порядок id
+// почти всегда совпадает с порядком коммитов; опоздавшие события досылаются (CRMEventLateWindow).
+
+// CRMEventsChannel – канал LISTEN/NOTIFY для новых событий
+const CRMEventsChannel = "crm_events"
+
+// CRMEventRetention – сколько хранятся события; клиент, отставший сильнее, получает resync
+const CRMEventRetention = 24 * time.Hour
+
+// CRMEventLateWindow – сколько перечитываются события позади курсора. id выдаётся при вставке,
+// а строка видна после коммита, поэтому событие с меньшим id может появиться позже большего;
+// курсор «id > последнего» такие события пропустил бы.
+const CRMEventLateWindow = 10 * time.Second
+
+// Типы событий CRM
+const (
+	CRMEventDealCreated        = "deal.created"
+	CRMEventDealUpdated        = "deal.updated"
+	CRMEventDealStageChanged   = "deal.stage_changed"
+	CRMEventDealDeleted        = "deal.deleted"
+	CRMEventDealRestored       = "deal.restored"
+	CRMEventCustomerCreated    = "customer.created"
+	CRMEventCustomerUpdated    = "customer.updated"
+	CRMEventCustomerDeleted    = "customer.deleted"
+	CRMEventCustomerRestored   = "customer.restored"
+	CRMEventCustomersMerged    = "customer.merged"
+	CRMEventActivityAdded      = "activity.added"
+	CRMEventAttachmentUploaded = "attachment.uploaded"
+	CRMEventAttachmentDeleted  = "attachment.deleted"
+	CRMEventQuoteCreated       = "quote.created"
+	CRMEventOrderCreated       = "order.created"
+	CRMEventEmailSent          = "email.sent"
+	CRMEventEmailReceived      = "email.received"
+	CRMEventEmailOpened        = "email.opened"
+	CRMEventChurnHighRisk      = "churn.high_risk"
+)
+
+// crmEventOwnerTables – откуда брать владельца события, если обработчик его не передал
+var crmEventOwnerTables = map[string]string{
+	"deal":     "crm_deals",
+	"customer": "crm_customers",
+}
+
+// CRMEvent – событие журнала. OwnerID – владелец сущности: событие видят он и администраторы.
+type CRMEvent struct {
+	ID         int64                  `json:"id"`
+	Type       string                 `json:"type"`
+	EntityType string                 `json:"entity_type"`
+	EntityID   string                 `json:"entity_id,omitempty"`
+	OwnerID    *string                `json:"-"`
+	ActorID    *string                `json:"actor_id,omitempty"`
+	Payload    map[string]interface{} `json:"data"`
+	CreatedAt  time.Time              `json:"created_at"`
+}
+
+// VisibleTo – то же правило, что у списков CRM: администратор видит всё, остальные – только своё
+func (e *CRMEvent) VisibleTo(userID string, isAdmin bool) bool {
+	if isAdmin {
+		return true
+	}
+	return userID != "" && e.OwnerID != nil && *e.OwnerID == userID
+}
+
+// PublishCRMEvent сохраняет событие и оповещает все экземпляры приложения.
+// Пустой OwnerID заполняется владельцем сущности; для удалённых сущностей его нужно передать явно.
+func PublishCRMEvent(ctx context.Context, e *CRMEvent) error {
+	if e.Payload == nil {
+		e.Payload = map[string]interface{}{}
+	}
+	payload, err := json.Marshal(e.Payload)
+	if err != nil {
+		return err
+	}
+	var entityID interface{}
+	if e.EntityID != "" {
+		entityID = e.EntityID
+	}
+	owner := "$4::uuid"
+	if table, ok := crmEventOwnerTables[e.EntityType]; ok {
+		owner = "COALESCE($4::uuid, (SELECT user_id FROM " + table + " WHERE id = $3::uuid))"
+	}
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_events (type, entity_type, entity_id, owner_id, actor_id, payload)
+		VALUES ($1, $2, $3, `+owner+`, $5, $6)
+		RETURNING id, owner_id, created_at
+	`, e.Type, e.EntityType, entityID, e.OwnerID, e.ActorID, payload).Scan(&e.ID, &e.OwnerID, &e.CreatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = database.Pool.Exec(ctx, `SELECT pg_notify($1, $2)`, CRMEventsChannel, strconv.FormatInt(e.ID, 10))
+	return err
+}
+
+func scanCRMEvents(rows pgx.Rows) ([]*CRMEvent, error) {
+	defer rows.Close()
+	var events []*CRMEvent
+	for rows.Next() {
+		var e CRMEvent
+		var entityID *string
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.Type, &e.EntityType, &entityID, &e.OwnerID, &e.ActorID, &payload, &e.CreatedAt); err != nil {
+			return nil, err
+		}
+		if entityID != nil {
+			e.EntityID = *entityID
+		}
+		if err := json.Unmarshal(payload, &e.Payload); err != nil {
+			return nil, err
+		}
+		events = append(events, &e)
+	}
+	return events, rows.Err()
+}
+
+const crmEventColumns = `id, type, entity_type, entity_id::text, owner_id::text, actor_id::text, payload, created_at`
+
+// CRMEventsAfter возвращает события с id больше afterID по возрастанию – для рассылки по экземпляру
+func CRMEventsAfter(ctx context.Context, afterID int64, limit int) ([]*CRMEvent, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+crmEventColumns+` FROM crm_events WHERE id > $1 ORDER BY id LIMIT $2
+	`, afterID, limit)
+	if err != nil {
+		return nil, err
+	}
+	return scanCRMEvents(rows)
+}
+
+// LateCRMEvents возвращает недавние события с id не больше beforeID – кандидатов на опоздавшие.
+// Уже разосланные отсекаются по id (CRMEventDedup).
+func LateCRMEvents(ctx context.Context, beforeID int64) ([]*CRMEvent, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+crmEventColumns+` FROM crm_events
+		WHERE id <= $1 AND created_at > NOW() - make_interval(secs => $2)
+		ORDER BY id
+	`, beforeID, CRMEventLateWindow.Seconds())
+	if err != nil {
+		return nil, err
+	}
+	return scanCRMEvents(rows)
+}
+
+// CRMEventDedup помнит id событий, отправленных за последние CRMEventLateWindow (с запасом),
+// чтобы повторное чтение окна не отправляло их снова. Не потокобезопасен.
+type CRMEventDedup struct {
+	seen      map[int64]time.Time
+	lastPrune time.Time
+}
+
+func NewCRMEventDedup() *CRMEventDedup {
+	return &CRMEventDedup{seen: make(map[int64]time.Time), lastPrune: time.Now()}
+}
+
+// Add отмечает событие; false – оно уже было
+func (d *CRMEventDedup) Add(id int64) bool {
+	now := time.Now()
+	if now.Sub(d.lastPrune) > CRMEventLateWindow {
+		for seenID, at := range d.seen {
+			if now.Sub(at) > 3*CRMEventLateWindow {
+				delete(d.seen, seenID)
+			}
+		}
+		d.lastPrune = now
+	}
+	if _, ok := d.seen[id]; ok {
+		return false
+	}
+	d.seen[id] = now
+	return true
+}
+
+// CRMEventsForUser возвращает пропущенные пользователем события для повтора после переподключения:
+// после afterID и опоздавшие из последних CRMEventLateWindow (клиент отбрасывает повторы по id).
+// complete=false означает, что часть событий уже удалена из журнала и клиенту нужно перечитать данные целиком.
+func CRMEventsForUser(ctx context.Context, afterID int64, userID string, isAdmin bool, limit int) (events []*CRMEvent, complete bool, err error) {
+	var oldest int64
+	if err := database.Pool.QueryRow(ctx, `SELECT COALESCE(MIN(id), 0) FROM crm_events`).Scan(&oldest); err != nil {
+		return nil, false, err
+	}
+	if oldest > afterID+1 {
+		return nil, false, nil
+	}
+	query := `SELECT ` + crmEventColumns + ` FROM crm_events
+		WHERE (id > $1 OR created_at > NOW() - make_interval(secs => $3))`
+	args := []interface{}{afterID, limit + 1, CRMEventLateWindow.Seconds()}
+	if !isAdmin {
+		query += ` AND owner_id = $4`
+		args = append(args, userID)
+	}
+	rows, err := database.Pool.Query(ctx, query+` ORDER BY id LIMIT $2`, args...)
+	if err != nil {
+		return nil, false, err
+	}
+	events, err = scanCRMEvents(rows)
+	if err != nil {
+		return nil, false, err
+	}
+	if len(events) > limit {
+		return nil, false, nil
+	}
+	return events, true, nil
+}
+
+// LatestCRMEventID – id последнего события; с него экземпляр начинает рассылку после запуска
+func LatestCRMEventID(ctx context.Context) (int64, error) {
+	var id int64
+	err := database.Pool.QueryRow(ctx, `SELECT COALESCE(MAX(id), 0) FROM crm_events`).Scan(&id)
+	return id, err
+}
+
+// PruneCRMEvents удаляет события старше срока хранения
+func PruneCRMEvents(ctx context.Context) (int64, error) {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_events WHERE created_at < NOW() - make_interval(hours => $1)`,
+		int(CRMEventRetention.Hours()))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
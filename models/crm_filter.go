@@ -0,0 +1,808 @@
+package models
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"subscription-system/database"
+)
+
+// Язык фильтров для списков клиентов и сделок. Фильтр – дерево из групп and/or/not и условий
+// {field, op, value}; компилируется в параметризованный SQL: имена полей берутся только из реестра
+// (и схемы пользовательских полей), значения всегда уходят аргументами.
+//
+//	{"and": [
+//	  {"field": "status", "op": "in", "value": ["lead", "active"]},
+//	  {"or": [{"field": "tag", "op": "eq", "value": "VIP"}, {"field": "deal.value", "op": "gte", "value": 100000}]},
+//	  {"field": "cf.industry", "op": "eq", "value": "retail"}
+//	]}
+//
+// Поля: обычные колонки, cf.<ключ> – пользовательские поля, tag – теги, deal.<поле> (у клиентов) –
+// есть сделка с таким полем, customer.<поле> (у сделок) – поле клиента сделки.
+
+var ErrInvalidFilter = errors.New("invalid filter")
+
+// invalidFilterf – ошибка разбора фильтра, распознаётся через errors.Is(err, ErrInvalidFilter)
+func invalidFilterf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidFilter}, args...)...)
+}
+
+// Сущности, к которым применяются фильтры
+const (
+	FilterEntityCustomer = "customer"
+	FilterEntityDeal     = "deal"
+)
+
+// Операторы условий
+const (
+	FilterOpEq            = "eq"
+	FilterOpNeq           = "neq"
+	FilterOpIn            = "in"
+	FilterOpNotIn         = "not_in"
+	FilterOpContains      = "contains"
+	FilterOpNotContains   = "not_contains"
+	FilterOpStartsWith    = "starts_with"
+	FilterOpGt            = "gt"
+	FilterOpGte           = "gte"
+	FilterOpLt            = "lt"
+	FilterOpLte           = "lte"
+	FilterOpBetween       = "between"         // value – [от, до] включительно
+	FilterOpWithinDays    = "within_days"     // дата не старше value дней
+	FilterOpOlderThanDays = "older_than_days" // дата старше value дней
+	FilterOpIsEmpty       = "is_empty"
+	FilterOpNotEmpty      = "not_empty"
+)
+
+// Типы полей фильтра
+const (
+	FilterTypeText     = "text"
+	FilterTypeID       = "id"
+	FilterTypeNumber   = "number"
+	FilterTypeDate     = "date"
+	FilterTypeDateTime = "datetime"
+	FilterTypeBool     = "bool"
+	FilterTypeTags     = "tags"
+	FilterTypeMulti    = "multi_select"
+)
+
+// FilterOperators – операторы, допустимые для типа поля
+var FilterOperators = map[string][]string{
+	FilterTypeText:     {FilterOpEq, FilterOpNeq, FilterOpIn, FilterOpNotIn, FilterOpContains, FilterOpNotContains, FilterOpStartsWith, FilterOpIsEmpty, FilterOpNotEmpty},
+	FilterTypeID:       {FilterOpEq, FilterOpNeq, FilterOpIn, FilterOpNotIn, FilterOpIsEmpty, FilterOpNotEmpty},
+	FilterTypeNumber:   {FilterOpEq, FilterOpNeq, FilterOpIn, FilterOpNotIn, FilterOpGt, FilterOpGte, FilterOpLt, FilterOpLte, FilterOpBetween, FilterOpIsEmpty, FilterOpNotEmpty},
+	FilterTypeDate:     {FilterOpEq, FilterOpGt, FilterOpGte, FilterOpLt, FilterOpLte, FilterOpBetween, FilterOpWithinDays, FilterOpOlderThanDays, FilterOpIsEmpty, FilterOpNotEmpty},
+	FilterTypeDateTime: {FilterOpEq, FilterOpGt, FilterOpGte, FilterOpLt, FilterOpLte, FilterOpBetween, FilterOpWithinDays, FilterOpOlderThanDays, FilterOpIsEmpty, FilterOpNotEmpty},
+	FilterTypeBool:     {FilterOpEq},
+	FilterTypeTags:     {FilterOpEq, FilterOpNeq, FilterOpIn, FilterOpNotIn, FilterOpIsEmpty, FilterOpNotEmpty},
+	FilterTypeMulti:    {FilterOpEq, FilterOpContains, FilterOpIn, FilterOpNotIn, FilterOpIsEmpty, FilterOpNotEmpty},
+}
+
+const (
+	filterMaxDepth      = 6
+	filterMaxConditions = 50
+	filterMaxValues     = 500
+
+	FilterCustomPrefix   = "cf."
+	FilterDealPrefix     = "deal."
+	FilterCustomerPrefix = "customer."
+	FilterTagField       = "tag"
+)
+
+// filterField – поле реестра. expr – SQL-выражение, %[1]s в нём заменяется псевдонимом таблицы
+type filterField struct {
+	expr     string
+	typ      string
+	sortable bool
+}
+
+// filterStageOutcome – выражение «этап сделки выигрышный/проигрышный» по настройкам воронки
+const filterStageOutcome = `EXISTS (SELECT 1 FROM crm_pipeline_stages ps WHERE ps.pipeline_id = %[1]s.pipeline_id AND ps.code = %[1]s.stage AND ps.%[2]s)`
+
+var filterFields = map[string]map[string]filterField{
+	FilterEntityCustomer: {
+		"id":          {"%[1]s.id::text", FilterTypeID, false},
+		"user_id":     {"%[1]s.user_id::text", FilterTypeID, false},
+		"name":        {"%[1]s.name", FilterTypeText, true},
+		"email":       {"%[1]s.email", FilterTypeText, true},
+		"phone":       {"%[1]s.phone", FilterTypeText, true},
+		"company":     {"%[1]s.company", FilterTypeText, true},
+		"status":      {"%[1]s.status", FilterTypeText, true},
+		"responsible": {"%[1]s.responsible", FilterTypeText, true},
+		"source":      {"%[1]s.source", FilterTypeText, true},
+		"comment":     {"%[1]s.comment", FilterTypeText, false},
+		"city":        {"%[1]s.city", FilterTypeText, true},
+		"notes":       {"%[1]s.notes", FilterTypeText, false},
+		"lead_score":  {"%[1]s.lead_score", FilterTypeNumber, true},
+		"birthday":    {"%[1]s.birthday", FilterTypeDate, true},
+		"created_at":  {"%[1]s.created_at", FilterTypeDateTime, true},
+		"last_seen":   {"%[1]s.last_seen", FilterTypeDateTime, true},
+	},
+	FilterEntityDeal: {
+		"id":               {"%[1]s.id::text", FilterTypeID, false},
+		"user_id":          {"%[1]s.user_id::text", FilterTypeID, false},
+		"customer_id":      {"%[1]s.customer_id::text", FilterTypeID, false},
+		"pipeline_id":      {"%[1]s.pipeline_id::text", FilterTypeID, false},
+		"title":            {"%[1]s.title", FilterTypeText, true},
+		"stage":            {"%[1]s.stage", FilterTypeText, true},
+		"responsible":      {"%[1]s.responsible", FilterTypeText, true},
+		"source":           {"%[1]s.source", FilterTypeText, true},
+		"comment":          {"%[1]s.comment", FilterTypeText, false},
+		"product_category": {"%[1]s.product_category", FilterTypeText, true},
+		"value":            {"%[1]s.value", FilterTypeNumber, true},
+		"probability":      {"%[1]s.probability", FilterTypeNumber, true},
+		"discount":         {"%[1]s.discount", FilterTypeNumber, true},
+		"expected_close":   {"%[1]s.expected_close", FilterTypeDate, true},
+		"created_at":       {"%[1]s.created_at", FilterTypeDateTime, true},
+		"closed_at":        {"%[1]s.closed_at", FilterTypeDateTime, true},
+		"next_action_date": {"%[1]s.next_action_date", FilterTypeDateTime, true},
+		"stage_changed_at": {"%[1]s.stage_changed_at", FilterTypeDateTime, true},
+		"is_won":           {fmt.Sprintf(filterStageOutcome, "%[1]s", "is_won"), FilterTypeBool, false},
+		"is_lost":          {fmt.Sprintf(filterStageOutcome, "%[1]s", "is_lost"), FilterTypeBool, false},
+	},
+}
+
+// filterTables – таблицы сущностей и связи между ними
+var filterTables = map[string]struct{ table, tags, tagKey string }{
+	FilterEntityCustomer: {"crm_customers", "customer_tags", "customer_id"},
+	FilterEntityDeal:     {"crm_deals", "deal_tags", "deal_id"},
+}
+
+// IsFilterEntity – поддерживает ли сущность фильтры и представления
+func IsFilterEntity(entity string) bool {
+	_, ok := filterTables[entity]
+	return ok
+}
+
+// CRMFilter – узел фильтра: группа (and, or, not) или условие (field, op, value)
+type CRMFilter struct {
+	And   []*CRMFilter    `json:"and,omitempty"`
+	Or    []*CRMFilter    `json:"or,omitempty"`
+	Not   *CRMFilter      `json:"not,omitempty"`
+	Field string          `json:"field,omitempty"`
+	Op    string          `json:"op,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// FilterCond – условие фильтра; value сериализуется в JSON
+func FilterCond(field, op string, value interface{}) *CRMFilter {
+	f := &CRMFilter{Field: field, Op: op}
+	if value != nil {
+		f.Value, _ = json.Marshal(value)
+	}
+	return f
+}
+
+// FilterAnd объединяет фильтры через AND, пропуская пустые
+func FilterAnd(filters ...*CRMFilter) *CRMFilter {
+	var parts []*CRMFilter
+	for _, f := range filters {
+		if !f.IsEmpty() {
+			parts = append(parts, f)
+		}
+	}
+	switch len(parts) {
+	case 0:
+		return nil
+	case 1:
+		return parts[0]
+	}
+	return &CRMFilter{And: parts}
+}
+
+// IsEmpty – фильтр ничего не ограничивает
+func (f *CRMFilter) IsEmpty() bool {
+	return f == nil || (len(f.And) == 0 && len(f.Or) == 0 && f.Not == nil && f.Field == "")
+}
+
+// ParseCRMFilter разбирает фильтр из JSON
+func ParseCRMFilter(raw []byte) (*CRMFilter, error) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return nil, nil
+	}
+	var f CRMFilter
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		return nil, invalidFilterf("%v", err)
+	}
+	return &f, nil
+}
+
+// CRMSort – поле сортировки; order – asc или desc
+type CRMSort struct {
+	Field string `json:"field"`
+	Order string `json:"order,omitempty"`
+}
+
+// FilterSchema – пользовательские поля обеих сущностей (по ключу)
+type FilterSchema map[string]map[string]*CustomField
+
+// LoadFilterSchema загружает схемы пользовательских полей для компиляции фильтров
+func LoadFilterSchema(ctx context.Context) (FilterSchema, error) {
+	schema := FilterSchema{}
+	for _, entity := range []string{CustomFieldEntityCustomer, CustomFieldEntityDeal} {
+		fields, err := CustomFieldsByKey(ctx, entity)
+		if err != nil {
+			return nil, err
+		}
+		schema[entity] = fields
+	}
+	return schema, nil
+}
+
+// FilterFieldInfo – описание поля для конструктора фильтров
+type FilterFieldInfo struct {
+	Field     string   `json:"field"`
+	Type      string   `json:"type"`
+	Label     string   `json:"label,omitempty"`
+	Sortable  bool     `json:"sortable"`
+	Operators []string `json:"operators"`
+	Options   []string `json:"options,omitempty"`
+}
+
+// FilterFields – поля, доступные в фильтрах сущности, включая пользовательские и связанные
+func FilterFields(entity string, schema FilterSchema) []FilterFieldInfo {
+	var res []FilterFieldInfo
+	add := func(prefix, ent string, sortable bool) {
+		for _, name := range sortedKeys(filterFields[ent]) {
+			fd := filterFields[ent][name]
+			res = append(res, FilterFieldInfo{Field: prefix + name, Type: fd.typ, Sortable: sortable && fd.sortable, Operators: FilterOperators[fd.typ]})
+		}
+		res = append(res, FilterFieldInfo{Field: prefix + FilterTagField, Type: FilterTypeTags, Operators: FilterOperators[FilterTypeTags]})
+		for _, key := range sortedKeys(schema[ent]) {
+			cf := schema[ent][key]
+			typ := customFilterType(cf)
+			res = append(res, FilterFieldInfo{Field: prefix + FilterCustomPrefix + key, Type: typ, Label: cf.Label,
+				Sortable: sortable && typ != FilterTypeMulti, Operators: FilterOperators[typ], Options: cf.Options})
+		}
+	}
+	add("", entity, true)
+	switch entity {
+	case FilterEntityCustomer:
+		add(FilterDealPrefix, FilterEntityDeal, false)
+	case FilterEntityDeal:
+		add(FilterCustomerPrefix, FilterEntityCustomer, false)
+	}
+	return res
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// customFilterType – тип фильтра для пользовательского поля
+func customFilterType(cf *CustomField) string {
+	switch cf.FieldType {
+	case CustomFieldNumber:
+		return FilterTypeNumber
+	case CustomFieldDate:
+		return FilterTypeDate
+	case CustomFieldMultiSelect:
+		return FilterTypeMulti
+	}
+	return FilterTypeText
+}
+
+// filterCompiler собирает SQL и аргументы; args продолжает нумерацию уже набранных параметров
+type filterCompiler struct {
+	schema     FilterSchema
+	args       []interface{}
+	conditions int
+}
+
+func (fc *filterCompiler) arg(v interface{}) string {
+	fc.args = append(fc.args, v)
+	return "$" + strconv.Itoa(len(fc.args))
+}
+
+// CompileCRMFilter превращает фильтр в условие WHERE для таблицы сущности под псевдонимом alias.
+// Пустой фильтр – пустая строка. Возвращает дополненный список аргументов.
+func CompileCRMFilter(entity string, f *CRMFilter, schema FilterSchema, alias string, args []interface{}) (string, []interface{}, error) {
+	if !IsFilterEntity(entity) {
+		return "", args, invalidFilterf("unknown entity %q", entity)
+	}
+	if f.IsEmpty() {
+		return "", args, nil
+	}
+	fc := &filterCompiler{schema: schema, args: args}
+	sql, err := fc.node(entity, alias, f, 1, false)
+	if err != nil {
+		return "", args, err
+	}
+	return sql, fc.args, nil
+}
+
+func (fc *filterCompiler) node(entity, alias string, f *CRMFilter, depth int, related bool) (string, error) {
+	if depth > filterMaxDepth {
+		return "", invalidFilterf("filter is nested deeper than %d levels", filterMaxDepth)
+	}
+	kinds := 0
+	for _, set := range []bool{len(f.And) > 0, len(f.Or) > 0, f.Not != nil, f.Field != ""} {
+		if set {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return "", invalidFilterf("each filter node must be exactly one of and, or, not or a condition")
+	}
+	switch {
+	case f.Not != nil:
+		inner, err := fc.node(entity, alias, f.Not, depth+1, related)
+		if err != nil {
+			return "", err
+		}
+		return "NOT COALESCE(" + inner + ", false)", nil
+	case f.Field != "":
+		fc.conditions++
+		if fc.conditions > filterMaxConditions {
+			return "", invalidFilterf("filter has more than %d conditions", filterMaxConditions)
+		}
+		return fc.condition(entity, alias, f, related)
+	}
+	children, joiner := f.And, " AND "
+	if len(f.Or) > 0 {
+		children, joiner = f.Or, " OR "
+	}
+	parts := make([]string, 0, len(children))
+	for _, child := range children {
+		if child == nil {
+			return "", invalidFilterf("empty filter node")
+		}
+		part, err := fc.node(entity, alias, child, depth+1, related)
+		if err != nil {
+			return "", err
+		}
+		parts = append(parts, part)
+	}
+	return "(" + strings.Join(parts, joiner) + ")", nil
+}
+
+// condition компилирует условие, разворачивая связанные поля в EXISTS по связанной таблице
+func (fc *filterCompiler) condition(entity, alias string, f *CRMFilter, related bool) (string, error) {
+	field := f.Field
+	if !related {
+		switch {
+		case entity == FilterEntityCustomer && strings.HasPrefix(field, FilterDealPrefix):
+			inner, err := fc.condition(FilterEntityDeal, "fd", &CRMFilter{Field: strings.TrimPrefix(field, FilterDealPrefix), Op: f.Op, Value: f.Value}, true)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("EXISTS (SELECT 1 FROM crm_deals fd WHERE fd.customer_id = %s.id AND fd.deleted_at IS NULL AND %s)", alias, inner), nil
+		case entity == FilterEntityDeal && strings.HasPrefix(field, FilterCustomerPrefix):
+			inner, err := fc.condition(FilterEntityCustomer, "fc", &CRMFilter{Field: strings.TrimPrefix(field, FilterCustomerPrefix), Op: f.Op, Value: f.Value}, true)
+			if err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("EXISTS (SELECT 1 FROM crm_customers fc WHERE fc.id = %s.customer_id AND fc.deleted_at IS NULL AND %s)", alias, inner), nil
+		}
+	}
+
+	if field == FilterTagField {
+		return fc.tagCondition(entity, alias, f)
+	}
+	if strings.HasPrefix(field, FilterCustomPrefix) {
+		cf, ok := fc.schema[entity][strings.TrimPrefix(field, FilterCustomPrefix)]
+		if !ok {
+			return "", invalidFilterf("unknown field %q", f.Field)
+		}
+		column := alias + ".custom_fields"
+		if cf.FieldType == CustomFieldMultiSelect {
+			return fc.multiCondition(column, cf.Key, f)
+		}
+		return fc.valueCondition(cf.valueSQL(column), customFilterType(cf), f)
+	}
+	fd, ok := filterFields[entity][field]
+	if !ok {
+		return "", invalidFilterf("unknown field %q", f.Field)
+	}
+	return fc.valueCondition(fmt.Sprintf(fd.expr, alias), fd.typ, f)
+}
+
+func checkFilterOp(typ string, f *CRMFilter) error {
+	if !containsString(FilterOperators[typ], f.Op) {
+		return invalidFilterf("operator %q is not supported for %s field %q", f.Op, typ, f.Field)
+	}
+	return nil
+}
+
+// valueCondition – условие над скалярным выражением expr типа typ
+func (fc *filterCompiler) valueCondition(expr, typ string, f *CRMFilter) (string, error) {
+	if err := checkFilterOp(typ, f); err != nil {
+		return "", err
+	}
+	switch f.Op {
+	case FilterOpIsEmpty:
+		if typ == FilterTypeText {
+			return fmt.Sprintf("COALESCE(%s, '') = ''", expr), nil
+		}
+		return expr + " IS NULL", nil
+	case FilterOpNotEmpty:
+		if typ == FilterTypeText {
+			return fmt.Sprintf("COALESCE(%s, '') <> ''", expr), nil
+		}
+		return expr + " IS NOT NULL", nil
+	}
+
+	switch typ {
+	case FilterTypeBool:
+		var v bool
+		if err := json.Unmarshal(f.Value, &v); err != nil {
+			return "", invalidFilterf("field %q: value must be true or false", f.Field)
+		}
+		if v {
+			return expr, nil
+		}
+		return "NOT " + expr, nil
+	case FilterTypeDate, FilterTypeDateTime:
+		return fc.dateCondition(expr, typ, f)
+	}
+
+	switch f.Op {
+	case FilterOpIn, FilterOpNotIn:
+		values, err := filterValues(typ, f)
+		if err != nil {
+			return "", err
+		}
+		if f.Op == FilterOpIn {
+			return fmt.Sprintf("%s = ANY(%s)", expr, fc.arg(values)), nil
+		}
+		return fmt.Sprintf("(%s IS NULL OR %s <> ALL(%s))", expr, expr, fc.arg(values)), nil
+	case FilterOpBetween:
+		bounds, err := filterValues(typ, f)
+		if err != nil {
+			return "", err
+		}
+		if len(bounds.([]float64)) != 2 {
+			return "", invalidFilterf("field %q: between expects [from, to]", f.Field)
+		}
+		b := bounds.([]float64)
+		return fmt.Sprintf("%s BETWEEN %s AND %s", expr, fc.arg(b[0]), fc.arg(b[1])), nil
+	}
+
+	value, err := filterValue(typ, f, f.Value)
+	if err != nil {
+		return "", err
+	}
+	switch f.Op {
+	case FilterOpEq:
+		return fmt.Sprintf("%s = %s", expr, fc.arg(value)), nil
+	case FilterOpNeq:
+		return fmt.Sprintf("%s IS DISTINCT FROM %s", expr, fc.arg(value)), nil
+	case FilterOpGt, FilterOpGte, FilterOpLt, FilterOpLte:
+		return fmt.Sprintf("%s %s %s", expr, filterComparisons[f.Op], fc.arg(value)), nil
+	case FilterOpContains:
+		return fmt.Sprintf("%s ILIKE '%%' || %s || '%%'", expr, fc.arg(escapeLike(value.(string)))), nil
+	case FilterOpNotContains:
+		return fmt.Sprintf("COALESCE(%s, '') NOT ILIKE '%%' || %s || '%%'", expr, fc.arg(escapeLike(value.(string)))), nil
+	case FilterOpStartsWith:
+		return fmt.Sprintf("%s ILIKE %s || '%%'", expr, fc.arg(escapeLike(value.(string)))), nil
+	}
+	return "", invalidFilterf("operator %q is not supported for field %q", f.Op, f.Field)
+}
+
+var filterComparisons = map[string]string{FilterOpGt: ">", FilterOpGte: ">=", FilterOpLt: "<", FilterOpLte: "<="}
+
+// dateCondition – условия над датами. Значение – YYYY-MM-DD или RFC 3339; дата без времени
+// у datetime-поля означает весь день: lte 2024-05-31 включает 31 мая целиком.
+func (fc *filterCompiler) dateCondition(expr, typ string, f *CRMFilter) (string, error) {
+	switch f.Op {
+	case FilterOpWithinDays, FilterOpOlderThanDays:
+		var days int
+		if err := json.Unmarshal(f.Value, &days); err != nil || days < 0 {
+			return "", invalidFilterf("field %q: value must be a number of days", f.Field)
+		}
+		cmp := ">="
+		if f.Op == FilterOpOlderThanDays {
+			cmp = "<"
+		}
+		return fmt.Sprintf("%s %s NOW() - make_interval(days => %s)", expr, cmp, fc.arg(days)), nil
+	case FilterOpBetween:
+		var bounds []json.RawMessage
+		if err := json.Unmarshal(f.Value, &bounds); err != nil || len(bounds) != 2 {
+			return "", invalidFilterf("field %q: between expects [from, to]", f.Field)
+		}
+		from, err := fc.dateBound(expr, typ, FilterOpGte, f, bounds[0])
+		if err != nil {
+			return "", err
+		}
+		to, err := fc.dateBound(expr, typ, FilterOpLte, f, bounds[1])
+		if err != nil {
+			return "", err
+		}
+		return "(" + from + " AND " + to + ")", nil
+	case FilterOpEq:
+		from, err := fc.dateBound(expr, typ, FilterOpGte, f, f.Value)
+		if err != nil {
+			return "", err
+		}
+		to, err := fc.dateBound(expr, typ, FilterOpLte, f, f.Value)
+		if err != nil {
+			return "", err
+		}
+		return "(" + from + " AND " + to + ")", nil
+	}
+	return fc.dateBound(expr, typ, f.Op, f, f.Value)
+}
+
+func (fc *filterCompiler) dateBound(expr, typ, op string, f *CRMFilter, raw json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return "", invalidFilterf("field %q: date must be a string", f.Field)
+	}
+	if _, err := time.Parse("2006-01-02", s); err == nil {
+		if typ == FilterTypeDate {
+			return fmt.Sprintf("%s %s %s::date", expr, filterComparisons[op], fc.arg(s)), nil
+		}
+		// Граница по дню: gt и lte отсчитываются от начала следующего дня
+		switch op {
+		case FilterOpGte:
+			return fmt.Sprintf("%s >= %s::date", expr, fc.arg(s)), nil
+		case FilterOpGt:
+			return fmt.Sprintf("%s >= %s::date + 1", expr, fc.arg(s)), nil
+		case FilterOpLt:
+			return fmt.Sprintf("%s < %s::date", expr, fc.arg(s)), nil
+		default:
+			return fmt.Sprintf("%s < %s::date + 1", expr, fc.arg(s)), nil
+		}
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return "", invalidFilterf("field %q: %q is not a date (YYYY-MM-DD or RFC 3339)", f.Field, s)
+	}
+	if typ == FilterTypeDate {
+		return fmt.Sprintf("%s %s %s::date", expr, filterComparisons[op], fc.arg(t.Format("2006-01-02"))), nil
+	}
+	return fmt.Sprintf("%s %s %s::timestamptz", expr, filterComparisons[op], fc.arg(t)), nil
+}
+
+// tagCondition – условия по тегам: значения – ID или названия тегов (без учёта регистра)
+func (fc *filterCompiler) tagCondition(entity, alias string, f *CRMFilter) (string, error) {
+	if err := checkFilterOp(FilterTypeTags, f); err != nil {
+		return "", err
+	}
+	t := filterTables[entity]
+	exists := fmt.Sprintf("EXISTS (SELECT 1 FROM %s ft JOIN tags t ON t.id = ft.tag_id WHERE t.deleted_at IS NULL AND ft.%s = %s.id", t.tags, t.tagKey, alias)
+	switch f.Op {
+	case FilterOpIsEmpty:
+		return "NOT " + exists + ")", nil
+	case FilterOpNotEmpty:
+		return exists + ")", nil
+	}
+	var values []string
+	if f.Op == FilterOpEq || f.Op == FilterOpNeq {
+		v, err := filterValue(FilterTypeText, f, f.Value)
+		if err != nil {
+			return "", err
+		}
+		values = []string{v.(string)}
+	} else {
+		v, err := filterValues(FilterTypeText, f)
+		if err != nil {
+			return "", err
+		}
+		values = v.([]string)
+	}
+	lower := make([]string, len(values))
+	for i, v := range values {
+		lower[i] = strings.ToLower(v)
+	}
+	cond := fmt.Sprintf("%s AND (t.id::text = ANY(%s) OR lower(t.name) = ANY(%s)))", exists, fc.arg(values), fc.arg(lower))
+	if f.Op == FilterOpNeq || f.Op == FilterOpNotIn {
+		return "NOT " + cond, nil
+	}
+	return cond, nil
+}
+
+// multiCondition – условия по полю с множественным выбором (массив в JSONB)
+func (fc *filterCompiler) multiCondition(column, key string, f *CRMFilter) (string, error) {
+	if err := checkFilterOp(FilterTypeMulti, f); err != nil {
+		return "", err
+	}
+	value := fmt.Sprintf("(%s->'%s')", column, key)
+	switch f.Op {
+	case FilterOpIsEmpty:
+		return fmt.Sprintf("COALESCE(jsonb_array_length(%s), 0) = 0", value), nil
+	case FilterOpNotEmpty:
+		return fmt.Sprintf("COALESCE(jsonb_array_length(%s), 0) > 0", value), nil
+	case FilterOpEq, FilterOpContains:
+		v, err := filterValue(FilterTypeText, f, f.Value)
+		if err != nil {
+			return "", err
+		}
+		// @> по всей колонке использует GIN-индекс
+		return fmt.Sprintf("%s @> jsonb_build_object('%s', jsonb_build_array(%s::text))", column, key, fc.arg(v)), nil
+	}
+	values, err := filterValues(FilterTypeText, f)
+	if err != nil {
+		return "", err
+	}
+	cond := fmt.Sprintf("COALESCE(%s ?| %s::text[], false)", value, fc.arg(values))
+	if f.Op == FilterOpNotIn {
+		return "NOT " + cond, nil
+	}
+	return cond, nil
+}
+
+// filterValue разбирает одно значение условия для типа typ
+func filterValue(typ string, f *CRMFilter, raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 {
+		return nil, invalidFilterf("field %q: value is required for operator %q", f.Field, f.Op)
+	}
+	if typ == FilterTypeNumber {
+		var n float64
+		if err := json.Unmarshal(raw, &n); err == nil {
+			return n, nil
+		}
+		var s string
+		if err := json.Unmarshal(raw, &s); err == nil {
+			if n, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+				return n, nil
+			}
+		}
+		return nil, invalidFilterf("field %q: value must be a number", f.Field)
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		var n json.Number
+		if err := json.Unmarshal(raw, &n); err != nil {
+			return nil, invalidFilterf("field %q: value must be a string", f.Field)
+		}
+		s = n.String()
+	}
+	return s, nil
+}
+
+// filterValues разбирает список значений ([]string или []float64 в зависимости от типа)
+func filterValues(typ string, f *CRMFilter) (interface{}, error) {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(f.Value, &raw); err != nil {
+		return nil, invalidFilterf("field %q: operator %q expects a list of values", f.Field, f.Op)
+	}
+	if len(raw) == 0 || len(raw) > filterMaxValues {
+		return nil, invalidFilterf("field %q: list must have 1 to %d values", f.Field, filterMaxValues)
+	}
+	if typ == FilterTypeNumber {
+		res := make([]float64, len(raw))
+		for i, r := range raw {
+			v, err := filterValue(typ, f, r)
+			if err != nil {
+				return nil, err
+			}
+			res[i] = v.(float64)
+		}
+		return res, nil
+	}
+	res := make([]string, len(raw))
+	for i, r := range raw {
+		v, err := filterValue(typ, f, r)
+		if err != nil {
+			return nil, err
+		}
+		res[i] = v.(string)
+	}
+	return res, nil
+}
+
+// escapeLike экранирует спецсимволы LIKE, чтобы значение искалось как есть
+func escapeLike(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(s)
+}
+
+// CompileCRMSort – ORDER BY по списку полей (обычные сортируемые поля и cf.<ключ>), последним –
+// created_at DESC для стабильного порядка. Пустой список – сортировка по умолчанию.
+func CompileCRMSort(entity string, sorts []CRMSort, schema FilterSchema, alias string) (string, error) {
+	parts := make([]string, 0, len(sorts)+1)
+	for _, s := range sorts {
+		direction := " ASC"
+		switch strings.ToLower(s.Order) {
+		case "", "asc":
+		case "desc":
+			direction = " DESC"
+		default:
+			return "", invalidFilterf("order must be asc or desc")
+		}
+		var expr string
+		if strings.HasPrefix(s.Field, FilterCustomPrefix) {
+			cf, ok := schema[entity][strings.TrimPrefix(s.Field, FilterCustomPrefix)]
+			if !ok || cf.FieldType == CustomFieldMultiSelect {
+				return "", invalidFilterf("unknown sort field: %s", s.Field)
+			}
+			expr = cf.SortSQL(alias + ".custom_fields")
+		} else {
+			fd, ok := filterFields[entity][s.Field]
+			if !ok || !fd.sortable {
+				return "", invalidFilterf("unknown sort field: %s", s.Field)
+			}
+			expr = fmt.Sprintf(fd.expr, alias)
+		}
+		parts = append(parts, expr+direction+" NULLS LAST")
+	}
+	return strings.Join(append(parts, alias+".created_at DESC"), ", "), nil
+}
+
+// CRMListQuery – отбор записей списка: фильтр, сортировка и ограничение владельцем
+type CRMListQuery struct {
+	Entity  string
+	Filter  *CRMFilter
+	Sort    []CRMSort
+	OwnerID string // не пусто – только записи этого пользователя
+}
+
+// SQL возвращает таблицу сущности, условие WHERE (без ключевого слова, всегда непустое),
+// ORDER BY и аргументы. Таблица в выражениях не переименовывается.
+func (q *CRMListQuery) SQL(ctx context.Context, args []interface{}) (table, where, orderBy string, outArgs []interface{}, err error) {
+	if !IsFilterEntity(q.Entity) {
+		return "", "", "", args, invalidFilterf("unknown entity %q", q.Entity)
+	}
+	schema, err := LoadFilterSchema(ctx)
+	if err != nil {
+		return "", "", "", args, err
+	}
+	table = filterTables[q.Entity].table
+	conds := []string{NotDeletedSQL(table)}
+	if q.OwnerID != "" {
+		args = append(args, q.OwnerID)
+		conds = append(conds, fmt.Sprintf("%s.user_id::text = $%d", table, len(args)))
+	}
+	cond, args, err := CompileCRMFilter(q.Entity, q.Filter, schema, table, args)
+	if err != nil {
+		return "", "", "", args, err
+	}
+	if cond != "" {
+		conds = append(conds, cond)
+	}
+	orderBy, err = CompileCRMSort(q.Entity, q.Sort, schema, table)
+	if err != nil {
+		return "", "", "", args, err
+	}
+	return table, strings.Join(conds, " AND "), orderBy, args, nil
+}
+
+// MatchingIDs – ID записей, подходящих под отбор (не больше limit, в порядке сортировки)
+func (q *CRMListQuery) MatchingIDs(ctx context.Context, limit int) ([]string, error) {
+	table, where, orderBy, args, err := q.SQL(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, limit)
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`SELECT %s.id::text FROM %s WHERE %s ORDER BY %s LIMIT $%d`,
+		table, table, where, orderBy, len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	ids := []string{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// EntityMatchesFilter проверяет, подходит ли запись под фильтр (для условий автоматизаций и агентов)
+func EntityMatchesFilter(ctx context.Context, entity string, f *CRMFilter, id string) (bool, error) {
+	q := &CRMListQuery{Entity: entity, Filter: FilterAnd(FilterCond("id", FilterOpEq, id), f)}
+	table, where, _, args, err := q.SQL(ctx, nil)
+	if err != nil {
+		return false, err
+	}
+	var ok bool
+	err = database.Pool.QueryRow(ctx, fmt.Sprintf(`SELECT EXISTS (SELECT 1 FROM %s WHERE %s)`, table, where), args...).Scan(&ok)
+	return ok, err
+}
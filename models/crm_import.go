@@ -0,0 +1,350 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Импорт клиентов и сделок из CSV/XLSX. Задание проходит путь
+// uploaded -> running -> (validated | completed | failed): сначала файл загружается и
+// разбирается заголовок, затем по сопоставлению колонок запускается проверка (dry-run)
+// или сам импорт. Ошибки по строкам сохраняются в задании для отчёта.
+
+var (
+	ErrImportNotFound   = errors.New("import job not found")
+	ErrImportRunning    = errors.New("import job is already running")
+	ErrTemplateNotFound = errors.New("import template not found")
+)
+
+const (
+	ImportStatusUploaded  = "uploaded"
+	ImportStatusRunning   = "running"
+	ImportStatusValidated = "validated" // dry-run завершён, данные не менялись
+	ImportStatusCompleted = "completed"
+	ImportStatusFailed    = "failed"
+)
+
+// Поиск дубликатов
+const (
+	ImportDedupEmail      = "email"
+	ImportDedupPhone      = "phone"
+	ImportDedupEmailPhone = "email_phone" // сначала email, потом телефон
+	ImportDedupNone       = "none"
+)
+
+// Что делать с найденным дубликатом
+const (
+	ImportOnDuplicateSkip   = "skip"   // строку пропустить
+	ImportOnDuplicateUpdate = "update" // непустые значения из файла перезаписывают запись
+	ImportOnDuplicateMerge  = "merge"  // заполнить только пустые поля записи, теги объединить
+)
+
+// ImportMaxErrors – сколько ошибок по строкам хранится в задании
+const ImportMaxErrors = 5000
+
+// ImportRowError – ошибка строки файла; Row – номер строки в файле (заголовок – 1)
+type ImportRowError struct {
+	Row     int    `json:"row"`
+	Column  string `json:"column,omitempty"`
+	Value   string `json:"value,omitempty"`
+	Message string `json:"message"`
+}
+
+// ImportOptions – сопоставление колонок и правила дедупликации
+type ImportOptions struct {
+	Mapping     map[string]string `json:"mapping"` // заголовок колонки -> поле CRM
+	DedupBy     string            `json:"dedup_by"`
+	OnDuplicate string            `json:"on_duplicate"`
+}
+
+// ImportJob – задание импорта. FilePath – ключ файла в хранилище; у заданий, созданных до
+// перехода на хранилище, FileHash пуст, а FilePath – путь на локальном диске.
+type ImportJob struct {
+	ID            string           `json:"id"`
+	UserID        string           `json:"user_id"`
+	EntityType    string           `json:"entity_type"`
+	FileName      string           `json:"file_name"`
+	FilePath      string           `json:"-"`
+	FileHash      *string          `json:"-"`
+	Headers       []string         `json:"headers"`
+	Options       ImportOptions    `json:"options"`
+	DryRun        bool             `json:"dry_run"`
+	Status        string           `json:"status"`
+	TotalRows     int              `json:"total_rows"`
+	ProcessedRows int              `json:"processed_rows"`
+	CreatedCount  int              `json:"created_count"`
+	UpdatedCount  int              `json:"updated_count"`
+	SkippedCount  int              `json:"skipped_count"`
+	ErrorCount    int              `json:"error_count"`
+	Errors        []ImportRowError `json:"errors,omitempty"`
+	Error         string           `json:"error,omitempty"`
+	CreatedAt     time.Time        `json:"created_at"`
+	StartedAt     *time.Time       `json:"started_at,omitempty"`
+	FinishedAt    *time.Time       `json:"finished_at,omitempty"`
+}
+
+// Progress – доля обработанных строк, 0..100
+func (j *ImportJob) Progress() int {
+	if j.TotalRows == 0 {
+		if j.Status == ImportStatusCompleted || j.Status == ImportStatusValidated {
+			return 100
+		}
+		return 0
+	}
+	return j.ProcessedRows * 100 / j.TotalRows
+}
+
+// CanAccess – задание видит его автор и администратор
+func (j *ImportJob) CanAccess(userID string, isAdmin bool) bool {
+	return isAdmin || j.UserID == userID
+}
+
+const importJobColumns = `id, user_id, entity_type, file_name, file_path, file_hash, headers, options, dry_run, status,
+	total_rows, processed_rows, created_count, updated_count, skipped_count, error_count,
+	COALESCE(error, ''), created_at, started_at, finished_at`
+
+func scanImportJob(row pgx.Row) (*ImportJob, error) {
+	var j ImportJob
+	var headers, options []byte
+	err := row.Scan(&j.ID, &j.UserID, &j.EntityType, &j.FileName, &j.FilePath, &j.FileHash, &headers, &options,
+		&j.DryRun, &j.Status, &j.TotalRows, &j.ProcessedRows, &j.CreatedCount, &j.UpdatedCount,
+		&j.SkippedCount, &j.ErrorCount, &j.Error, &j.CreatedAt, &j.StartedAt, &j.FinishedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(headers, &j.Headers); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(options, &j.Options); err != nil {
+		return nil, err
+	}
+	return &j, nil
+}
+
+// CreateImportJob сохраняет загруженный файл как новое задание
+func CreateImportJob(ctx context.Context, j *ImportJob) error {
+	headers, _ := json.Marshal(j.Headers)
+	options, _ := json.Marshal(j.Options)
+	j.Status = ImportStatusUploaded
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_import_jobs (user_id, entity_type, file_name, file_path, file_hash, headers, options, status, total_rows)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at
+	`, j.UserID, j.EntityType, j.FileName, j.FilePath, j.FileHash, headers, options, j.Status, j.TotalRows).
+		Scan(&j.ID, &j.CreatedAt)
+}
+
+// GetImportJob возвращает задание вместе с ошибками по строкам
+func GetImportJob(ctx context.Context, id string) (*ImportJob, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrImportNotFound
+	}
+	j, err := scanImportJob(database.Pool.QueryRow(ctx,
+		`SELECT `+importJobColumns+` FROM crm_import_jobs WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrImportNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var rowErrors []byte
+	err = database.Pool.QueryRow(ctx, `SELECT row_errors FROM crm_import_jobs WHERE id = $1`, id).Scan(&rowErrors)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(rowErrors, &j.Errors); err != nil {
+		return nil, err
+	}
+	return j, nil
+}
+
+// ListImportJobs – последние задания пользователя (администратору – всех), без ошибок по строкам
+func ListImportJobs(ctx context.Context, userID string, isAdmin bool, limit int) ([]*ImportJob, error) {
+	query := `SELECT ` + importJobColumns + ` FROM crm_import_jobs`
+	args := []interface{}{}
+	if !isAdmin {
+		query += ` WHERE user_id = $1`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY created_at DESC LIMIT $` + strconv.Itoa(len(args)+1)
+	args = append(args, limit)
+
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []*ImportJob{}
+	for rows.Next() {
+		j, err := scanImportJob(rows)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, j)
+	}
+	return jobs, rows.Err()
+}
+
+// StartImportJob переводит задание в running с новыми параметрами и обнуляет счётчики.
+// Возвращает ErrImportRunning, если задание уже выполняется.
+func StartImportJob(ctx context.Context, j *ImportJob, opts ImportOptions, dryRun bool) error {
+	options, _ := json.Marshal(opts)
+	err := database.Pool.QueryRow(ctx, `
+		UPDATE crm_import_jobs
+		SET options = $2, dry_run = $3, status = 'running', processed_rows = 0,
+			created_count = 0, updated_count = 0, skipped_count = 0, error_count = 0,
+			row_errors = '[]', error = NULL, started_at = NOW(), finished_at = NULL
+		WHERE id = $1 AND status <> 'running'
+		RETURNING started_at
+	`, j.ID, options, dryRun).Scan(&j.StartedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrImportRunning
+	}
+	if err != nil {
+		return err
+	}
+	j.Options = opts
+	j.DryRun = dryRun
+	j.Status = ImportStatusRunning
+	j.ProcessedRows, j.CreatedCount, j.UpdatedCount, j.SkippedCount, j.ErrorCount = 0, 0, 0, 0, 0
+	j.Errors = nil
+	j.Error = ""
+	j.FinishedAt = nil
+	return nil
+}
+
+// SaveImportProgress сохраняет счётчики выполняющегося задания
+func SaveImportProgress(ctx context.Context, j *ImportJob) error {
+	_, err := database.Pool.Exec(ctx, `
+		UPDATE crm_import_jobs
+		SET total_rows = $2, processed_rows = $3, created_count = $4, updated_count = $5,
+			skipped_count = $6, error_count = $7
+		WHERE id = $1
+	`, j.ID, j.TotalRows, j.ProcessedRows, j.CreatedCount, j.UpdatedCount, j.SkippedCount, j.ErrorCount)
+	return err
+}
+
+// FinishImportJob сохраняет итог задания: статус, счётчики и ошибки по строкам
+func FinishImportJob(ctx context.Context, j *ImportJob) error {
+	rowErrors := j.Errors
+	if len(rowErrors) > ImportMaxErrors {
+		rowErrors = rowErrors[:ImportMaxErrors]
+	}
+	if rowErrors == nil {
+		rowErrors = []ImportRowError{}
+	}
+	errorsJSON, _ := json.Marshal(rowErrors)
+	var jobError *string
+	if j.Error != "" {
+		jobError = &j.Error
+	}
+	return database.Pool.QueryRow(ctx, `
+		UPDATE crm_import_jobs
+		SET status = $2, total_rows = $3, processed_rows = $4, created_count = $5, updated_count = $6,
+			skipped_count = $7, error_count = $8, row_errors = $9, error = $10, finished_at = NOW()
+		WHERE id = $1
+		RETURNING finished_at
+	`, j.ID, j.Status, j.TotalRows, j.ProcessedRows, j.CreatedCount, j.UpdatedCount,
+		j.SkippedCount, j.ErrorCount, errorsJSON, jobError).Scan(&j.FinishedAt)
+}
+
+// DeleteImportJob удаляет задание; файл удаляет вызывающий код
+func DeleteImportJob(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_import_jobs WHERE id = $1 AND status <> 'running'`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrImportRunning
+	}
+	return nil
+}
+
+// FailInterruptedImports помечает упавшими задания, которые выполнялись во время остановки сервера
+func FailInterruptedImports(ctx context.Context) (int64, error) {
+	tag, err := database.Pool.Exec(ctx, `
+		UPDATE crm_import_jobs
+		SET status = 'failed', error = 'interrupted by server restart', finished_at = NOW()
+		WHERE status = 'running'
+	`)
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
+
+// ========== ШАБЛОНЫ СОПОСТАВЛЕНИЯ ==========
+
+// ImportTemplate – сохранённое сопоставление колонок (например, «Выгрузка amoCRM»)
+type ImportTemplate struct {
+	ID         string            `json:"id"`
+	UserID     string            `json:"user_id"`
+	Name       string            `json:"name"`
+	EntityType string            `json:"entity_type"`
+	Mapping    map[string]string `json:"mapping"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// ListImportTemplates – шаблоны пользователя для сущности
+func ListImportTemplates(ctx context.Context, userID, entityType string) ([]ImportTemplate, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT id, user_id, name, entity_type, mapping, created_at
+		FROM crm_import_templates
+		WHERE user_id = $1 AND ($2 = '' OR entity_type = $2)
+		ORDER BY name
+	`, userID, entityType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	templates := []ImportTemplate{}
+	for rows.Next() {
+		var t ImportTemplate
+		var mapping []byte
+		if err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.EntityType, &mapping, &t.CreatedAt); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal(mapping, &t.Mapping); err != nil {
+			return nil, err
+		}
+		templates = append(templates, t)
+	}
+	return templates, rows.Err()
+}
+
+// SaveImportTemplate создаёт шаблон или перезаписывает шаблон с тем же именем
+func SaveImportTemplate(ctx context.Context, t *ImportTemplate) error {
+	mapping, _ := json.Marshal(t.Mapping)
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_import_templates (user_id, name, entity_type, mapping)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (user_id, entity_type, name) DO UPDATE SET mapping = EXCLUDED.mapping
+		RETURNING id, created_at
+	`, t.UserID, t.Name, t.EntityType, mapping).Scan(&t.ID, &t.CreatedAt)
+}
+
+// DeleteImportTemplate удаляет шаблон пользователя
+func DeleteImportTemplate(ctx context.Context, userID, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrTemplateNotFound
+	}
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_import_templates WHERE id = $1 AND user_id = $2`, id, userID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTemplateNotFound
+	}
+	return nil
+}
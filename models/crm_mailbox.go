@@ -0,0 +1,307 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+	"subscription-system/internal/secrets"
+)
+
+// Почтовые ящики пользователей для канала email в CRM: IMAP – входящие (синхронизация
+// в переписку с клиентами), SMTP – отправка из CRM. Пароли хранятся зашифрованными (internal/secrets).
+
+var (
+	ErrMailboxNotFound = errors.New("mailbox not found")
+	ErrInvalidMailbox  = errors.New("invalid mailbox")
+)
+
+// Защита соединения с почтовым сервером
+const (
+	MailSecurityTLS      = "tls"      // TLS с первого байта (IMAPS 993, SMTPS 465)
+	MailSecurityStartTLS = "starttls" // открытое соединение с переходом на TLS (IMAP 143, SMTP 587)
+	MailSecurityNone     = "none"     // без шифрования – только для локальных тестовых серверов
+)
+
+// IsMailSecurity проверяет режим защиты соединения
+func IsMailSecurity(s string) bool {
+	return s == MailSecurityTLS || s == MailSecurityStartTLS || s == MailSecurityNone
+}
+
+// Mailbox – подключённый почтовый ящик пользователя
+type Mailbox struct {
+	ID           string     `json:"id"`
+	UserID       string     `json:"user_id"`
+	Email        string     `json:"email"`
+	DisplayName  string     `json:"display_name"`
+	IMAPHost     string     `json:"imap_host"`
+	IMAPPort     int        `json:"imap_port"`
+	IMAPSecurity string     `json:"imap_security"`
+	IMAPUsername string     `json:"imap_username"`
+	IMAPFolder   string     `json:"imap_folder"`
+	SMTPHost     string     `json:"smtp_host"`
+	SMTPPort     int        `json:"smtp_port"`
+	SMTPSecurity string     `json:"smtp_security"`
+	SMTPUsername string     `json:"smtp_username"`
+	SyncEnabled  bool       `json:"sync_enabled"`
+	UIDValidity  int64      `json:"-"`
+	LastUID      int64      `json:"-"`
+	LastSyncAt   *time.Time `json:"last_sync_at,omitempty"`
+	LastError    *string    `json:"last_error,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+
+	IMAPPassword secrets.Redacted `json:"-"`
+	SMTPPassword secrets.Redacted `json:"-"`
+}
+
+// CanIMAP – настроен ли приём почты
+func (m *Mailbox) CanIMAP() bool {
+	return m.IMAPHost != ""
+}
+
+// CanSMTP – настроена ли отправка
+func (m *Mailbox) CanSMTP() bool {
+	return m.SMTPHost != ""
+}
+
+// MailboxInput – параметры ящика при создании и изменении. Пустой пароль при изменении
+// оставляет прежний; логины по умолчанию – адрес ящика.
+type MailboxInput struct {
+	Email        string  `json:"email"`
+	DisplayName  string  `json:"display_name"`
+	IMAPHost     string  `json:"imap_host"`
+	IMAPPort     int     `json:"imap_port"`
+	IMAPSecurity string  `json:"imap_security"`
+	IMAPUsername string  `json:"imap_username"`
+	IMAPPassword *string `json:"imap_password"`
+	IMAPFolder   string  `json:"imap_folder"`
+	SMTPHost     string  `json:"smtp_host"`
+	SMTPPort     int     `json:"smtp_port"`
+	SMTPSecurity string  `json:"smtp_security"`
+	SMTPUsername string  `json:"smtp_username"`
+	SMTPPassword *string `json:"smtp_password"`
+	SyncEnabled  *bool   `json:"sync_enabled"`
+}
+
+// Normalize проверяет параметры и подставляет значения по умолчанию
+func (in *MailboxInput) Normalize() error {
+	addr, err := mail.ParseAddress(strings.TrimSpace(in.Email))
+	if err != nil {
+		return fmt.Errorf("%w: invalid email", ErrInvalidMailbox)
+	}
+	in.Email = strings.ToLower(addr.Address)
+	in.DisplayName = strings.TrimSpace(in.DisplayName)
+	if in.DisplayName == "" {
+		in.DisplayName = addr.Name
+	}
+	in.IMAPHost = strings.TrimSpace(in.IMAPHost)
+	in.SMTPHost = strings.TrimSpace(in.SMTPHost)
+	if in.IMAPHost == "" && in.SMTPHost == "" {
+		return fmt.Errorf("%w: imap_host or smtp_host is required", ErrInvalidMailbox)
+	}
+	if in.IMAPSecurity == "" {
+		in.IMAPSecurity = MailSecurityTLS
+	}
+	if in.SMTPSecurity == "" {
+		in.SMTPSecurity = MailSecurityTLS
+	}
+	if !IsMailSecurity(in.IMAPSecurity) || !IsMailSecurity(in.SMTPSecurity) {
+		return fmt.Errorf("%w: security must be tls, starttls or none", ErrInvalidMailbox)
+	}
+	if in.IMAPPort == 0 {
+		in.IMAPPort = map[string]int{MailSecurityTLS: 993, MailSecurityStartTLS: 143, MailSecurityNone: 143}[in.IMAPSecurity]
+	}
+	if in.SMTPPort == 0 {
+		in.SMTPPort = map[string]int{MailSecurityTLS: 465, MailSecurityStartTLS: 587, MailSecurityNone: 25}[in.SMTPSecurity]
+	}
+	if in.IMAPPort < 1 || in.IMAPPort > 65535 || in.SMTPPort < 1 || in.SMTPPort > 65535 {
+		return fmt.Errorf("%w: invalid port", ErrInvalidMailbox)
+	}
+	if strings.TrimSpace(in.IMAPUsername) == "" {
+		in.IMAPUsername = in.Email
+	}
+	if strings.TrimSpace(in.SMTPUsername) == "" {
+		in.SMTPUsername = in.Email
+	}
+	in.IMAPFolder = strings.TrimSpace(in.IMAPFolder)
+	if in.IMAPFolder == "" {
+		in.IMAPFolder = "INBOX"
+	}
+	if strings.ContainsAny(in.IMAPFolder+in.IMAPUsername+in.SMTPUsername, "\r\n") {
+		return fmt.Errorf("%w: line breaks are not allowed", ErrInvalidMailbox)
+	}
+	return nil
+}
+
+const mailboxColumns = `id, user_id::text, email, display_name, imap_host, imap_port, imap_security, imap_username,
+	imap_password_enc, imap_folder, smtp_host, smtp_port, smtp_security, smtp_username, smtp_password_enc,
+	sync_enabled, uid_validity, last_uid, last_sync_at, last_error, created_at, updated_at`
+
+func scanMailbox(row pgx.Row) (*Mailbox, error) {
+	var m Mailbox
+	var imapPassword, smtpPassword string
+	err := row.Scan(&m.ID, &m.UserID, &m.Email, &m.DisplayName, &m.IMAPHost, &m.IMAPPort, &m.IMAPSecurity, &m.IMAPUsername,
+		&imapPassword, &m.IMAPFolder, &m.SMTPHost, &m.SMTPPort, &m.SMTPSecurity, &m.SMTPUsername, &smtpPassword,
+		&m.SyncEnabled, &m.UIDValidity, &m.LastUID, &m.LastSyncAt, &m.LastError, &m.CreatedAt, &m.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrMailboxNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m.IMAPPassword, err = secrets.Decrypt(imapPassword); err != nil {
+		return nil, fmt.Errorf("mailbox %s imap password: %w", m.ID, err)
+	}
+	if m.SMTPPassword, err = secrets.Decrypt(smtpPassword); err != nil {
+		return nil, fmt.Errorf("mailbox %s smtp password: %w", m.ID, err)
+	}
+	return &m, nil
+}
+
+func collectMailboxes(rows pgx.Rows, err error) ([]*Mailbox, error) {
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*Mailbox{}
+	for rows.Next() {
+		m, err := scanMailbox(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// ListMailboxes возвращает ящики пользователя
+func ListMailboxes(ctx context.Context, userID string) ([]*Mailbox, error) {
+	return collectMailboxes(database.Pool.Query(ctx,
+		`SELECT `+mailboxColumns+` FROM crm_mailboxes WHERE user_id = $1 ORDER BY created_at`, userID))
+}
+
+// SyncableMailboxes – ящики с включённой синхронизацией входящих
+func SyncableMailboxes(ctx context.Context) ([]*Mailbox, error) {
+	return collectMailboxes(database.Pool.Query(ctx,
+		`SELECT `+mailboxColumns+` FROM crm_mailboxes WHERE sync_enabled AND imap_host <> '' ORDER BY last_sync_at NULLS FIRST`))
+}
+
+// GetMailbox возвращает ящик по ID
+func GetMailbox(ctx context.Context, id string) (*Mailbox, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrMailboxNotFound
+	}
+	return scanMailbox(database.Pool.QueryRow(ctx, `SELECT `+mailboxColumns+` FROM crm_mailboxes WHERE id = $1`, id))
+}
+
+// encryptMailboxPassword шифрует пароль; nil – пароль не менялся
+func encryptMailboxPassword(password *string) (*string, error) {
+	if password == nil {
+		return nil, nil
+	}
+	enc, err := secrets.EncryptString(*password)
+	if err != nil {
+		return nil, err
+	}
+	return &enc, nil
+}
+
+// CreateMailbox подключает ящик пользователю
+func CreateMailbox(ctx context.Context, userID string, in *MailboxInput) (*Mailbox, error) {
+	if err := in.Normalize(); err != nil {
+		return nil, err
+	}
+	imapPassword, err := encryptMailboxPassword(in.IMAPPassword)
+	if err != nil {
+		return nil, err
+	}
+	smtpPassword, err := encryptMailboxPassword(in.SMTPPassword)
+	if err != nil {
+		return nil, err
+	}
+	syncEnabled := in.SyncEnabled == nil || *in.SyncEnabled
+	m, err := scanMailbox(database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_mailboxes (user_id, email, display_name, imap_host, imap_port, imap_security, imap_username,
+			imap_password_enc, imap_folder, smtp_host, smtp_port, smtp_security, smtp_username, smtp_password_enc, sync_enabled)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, COALESCE($8, ''), $9, $10, $11, $12, $13, COALESCE($14, ''), $15)
+		ON CONFLICT (user_id, email) DO NOTHING
+		RETURNING `+mailboxColumns,
+		userID, in.Email, in.DisplayName, in.IMAPHost, in.IMAPPort, in.IMAPSecurity, in.IMAPUsername,
+		imapPassword, in.IMAPFolder, in.SMTPHost, in.SMTPPort, in.SMTPSecurity, in.SMTPUsername, smtpPassword, syncEnabled))
+	if errors.Is(err, ErrMailboxNotFound) {
+		return nil, fmt.Errorf("%w: mailbox %s is already connected", ErrInvalidMailbox, in.Email)
+	}
+	return m, err
+}
+
+// UpdateMailbox меняет параметры ящика. Смена сервера, папки или логина IMAP сбрасывает
+// позицию синхронизации: письма будут перечитаны (дубли отсекаются по Message-ID).
+func UpdateMailbox(ctx context.Context, id string, in *MailboxInput) (*Mailbox, error) {
+	if err := in.Normalize(); err != nil {
+		return nil, err
+	}
+	imapPassword, err := encryptMailboxPassword(in.IMAPPassword)
+	if err != nil {
+		return nil, err
+	}
+	smtpPassword, err := encryptMailboxPassword(in.SMTPPassword)
+	if err != nil {
+		return nil, err
+	}
+	m, err := scanMailbox(database.Pool.QueryRow(ctx, `
+		UPDATE crm_mailboxes SET
+			email = $2, display_name = $3,
+			uid_validity = CASE WHEN (imap_host, imap_port, imap_username, imap_folder) IS DISTINCT FROM ($4, $5, $7, $9)
+				THEN 0 ELSE uid_validity END,
+			last_uid = CASE WHEN (imap_host, imap_port, imap_username, imap_folder) IS DISTINCT FROM ($4, $5, $7, $9)
+				THEN 0 ELSE last_uid END,
+			imap_host = $4, imap_port = $5, imap_security = $6, imap_username = $7,
+			imap_password_enc = COALESCE($8, imap_password_enc), imap_folder = $9,
+			smtp_host = $10, smtp_port = $11, smtp_security = $12, smtp_username = $13,
+			smtp_password_enc = COALESCE($14, smtp_password_enc),
+			sync_enabled = COALESCE($15, sync_enabled), last_error = NULL, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+mailboxColumns,
+		id, in.Email, in.DisplayName, in.IMAPHost, in.IMAPPort, in.IMAPSecurity, in.IMAPUsername,
+		imapPassword, in.IMAPFolder, in.SMTPHost, in.SMTPPort, in.SMTPSecurity, in.SMTPUsername, smtpPassword, in.SyncEnabled))
+	var pgErr interface{ SQLState() string }
+	if errors.As(err, &pgErr) && pgErr.SQLState() == "23505" {
+		return nil, fmt.Errorf("%w: mailbox %s is already connected", ErrInvalidMailbox, in.Email)
+	}
+	return m, err
+}
+
+// DeleteMailbox отключает ящик; переписка, синхронизированная из него, удаляется вместе с ним,
+// записи в активностях клиентов остаются
+func DeleteMailbox(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_mailboxes WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrMailboxNotFound
+	}
+	return nil
+}
+
+// SetMailboxSyncState сохраняет позицию синхронизации и результат последнего прохода
+func SetMailboxSyncState(ctx context.Context, id string, uidValidity, lastUID int64, syncErr error) error {
+	var lastError *string
+	if syncErr != nil {
+		msg := truncateString(syncErr.Error(), 1000)
+		lastError = &msg
+	}
+	_, err := database.Pool.Exec(ctx, `
+		UPDATE crm_mailboxes SET uid_validity = $2, last_uid = $3, last_error = $4, last_sync_at = NOW()
+		WHERE id = $1
+	`, id, uidValidity, lastUID, lastError)
+	return err
+}
@@ -0,0 +1,926 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Поиск и слияние дублей клиентов CRM. UNIQUE на email не ловит одну и ту же компанию,
+// пришедшую с разными адресами или в разном формате телефона, поэтому кандидаты ищутся
+// по нормализованному телефону (E.164), домену почты + названию компании и похожести имени.
+// Слияние переносит всё на «выжившего» клиента и пишет снимок в crm_history (action = 'merge'),
+// по которому слияние можно отменить.
+
+var (
+	ErrCustomerNotFound = errors.New("customer not found")
+	ErrMergeNotFound    = errors.New("merge not found")
+	ErrMergeReverted    = errors.New("merge already reverted")
+	ErrInvalidMerge     = errors.New("invalid merge")
+)
+
+// Причины, по которым два клиента считаются дублями
+const (
+	DuplicateReasonEmail         = "email"
+	DuplicateReasonPhone         = "phone"
+	DuplicateReasonDomainCompany = "domain_company"
+	DuplicateReasonName          = "name"
+)
+
+// Вес причины в итоговой оценке пары; оценки объединяются как 1 - Π(1 - w)
+var duplicateReasonWeight = map[string]float64{
+	DuplicateReasonEmail:         1,
+	DuplicateReasonPhone:         0.9,
+	DuplicateReasonDomainCompany: 0.8,
+}
+
+const (
+	// NameSimilarityThreshold – минимальная триграммная похожесть имён, чтобы считать её причиной
+	NameSimilarityThreshold = 0.6
+	// duplicateScanLimit – сколько клиентов просматривается за один поиск
+	duplicateScanLimit = 20000
+	// duplicateBlockLimit – слишком частые слова имени (например, «ооо») не сравниваются попарно
+	duplicateBlockLimit = 500
+)
+
+// MergeableCustomerFields – поля, значение которых при слиянии можно взять у любого из клиентов
+var MergeableCustomerFields = []string{"name", "email", "phone", "company", "status", "responsible", "source", "comment"}
+
+// freeEmailDomains – публичные почтовые сервисы: совпадение такого домена ничего не говорит о компании
+var freeEmailDomains = map[string]bool{
+	"gmail.com": true, "googlemail.com": true, "yahoo.com": true, "outlook.com": true, "hotmail.com": true,
+	"live.com": true, "icloud.com": true, "me.com": true, "aol.com": true, "proton.me": true, "protonmail.com": true,
+	"mail.ru": true, "inbox.ru": true, "list.ru": true, "bk.ru": true, "internet.ru": true,
+	"yandex.ru": true, "ya.ru": true, "yandex.com": true, "rambler.ru": true,
+}
+
+// companyLegalForms – организационно-правовые формы, которые не участвуют в сравнении названий
+var companyLegalForms = map[string]bool{
+	"ооо": true, "оао": true, "зао": true, "пао": true, "ао": true, "ип": true, "нко": true,
+	"llc": true, "inc": true, "ltd": true, "gmbh": true, "corp": true, "co": true, "plc": true,
+}
+
+// NormalizePhone приводит телефон к E.164. Номера без кода страны считаются российскими
+// (8XXXXXXXXXX и 10 цифр -> +7...). Для строк, не похожих на телефон, возвращает "".
+func NormalizePhone(raw string) string {
+	raw = strings.TrimSpace(raw)
+	var digits strings.Builder
+	for _, r := range raw {
+		if r >= '0' && r <= '9' {
+			digits.WriteRune(r)
+		}
+	}
+	d := digits.String()
+	switch {
+	case len(d) < 10 || len(d) > 15:
+		return ""
+	case strings.HasPrefix(raw, "+"):
+		return "+" + d
+	case len(d) == 10:
+		return "+7" + d
+	case len(d) == 11 && d[0] == '8':
+		return "+7" + d[1:]
+	default:
+		return "+" + d
+	}
+}
+
+// companyEmailDomain – домен почты, если это не публичный почтовый сервис
+func companyEmailDomain(email string) string {
+	i := strings.LastIndex(email, "@")
+	if i < 0 {
+		return ""
+	}
+	domain := strings.ToLower(strings.TrimSpace(email[i+1:]))
+	if domain == "" || freeEmailDomains[domain] {
+		return ""
+	}
+	return domain
+}
+
+// nameTokens – слова строки в нижнем регистре без пунктуации, ё -> е
+func nameTokens(s string) []string {
+	s = strings.ReplaceAll(strings.ToLower(s), "ё", "е")
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return !unicode.IsLetter(r) && !unicode.IsDigit(r)
+	})
+}
+
+// NormalizeCompany – название компании без кавычек, пунктуации и ООО/LLC
+func NormalizeCompany(company string) string {
+	tokens := make([]string, 0)
+	for _, t := range nameTokens(company) {
+		if !companyLegalForms[t] {
+			tokens = append(tokens, t)
+		}
+	}
+	return strings.Join(tokens, " ")
+}
+
+// trigrams – множество триграмм слов, как в pg_trgm: слово дополняется двумя пробелами слева и одним справа
+func trigrams(tokens []string) map[string]bool {
+	set := make(map[string]bool)
+	for _, t := range tokens {
+		r := []rune("  " + t + " ")
+		for i := 0; i+3 <= len(r); i++ {
+			set[string(r[i:i+3])] = true
+		}
+	}
+	return set
+}
+
+// NameSimilarity – триграммная похожесть имён от 0 до 1. Порядок слов не важен,
+// поэтому «Иванов Иван» и «Иван Иванов» совпадают полностью.
+func NameSimilarity(a, b string) float64 {
+	ta, tb := trigrams(nameTokens(a)), trigrams(nameTokens(b))
+	if len(ta) == 0 || len(tb) == 0 {
+		return 0
+	}
+	common := 0
+	for t := range ta {
+		if tb[t] {
+			common++
+		}
+	}
+	return float64(common) / float64(len(ta)+len(tb)-common)
+}
+
+// DuplicateCandidate – клиент в группе возможных дублей
+type DuplicateCandidate struct {
+	ID         string    `json:"id"`
+	Name       string    `json:"name"`
+	Email      string    `json:"email"`
+	Phone      string    `json:"phone"`
+	Company    string    `json:"company"`
+	Status     string    `json:"status"`
+	DealsCount int       `json:"deals_count"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+// DuplicateGroup – клиенты, связанные попарными совпадениями. Score – лучшая оценка пары в группе.
+type DuplicateGroup struct {
+	Customers []DuplicateCandidate `json:"customers"`
+	Reasons   []string             `json:"reasons"`
+	Score     float64              `json:"score"`
+}
+
+// duplicateScore оценивает пару клиентов и возвращает причины совпадения
+func duplicateScore(a, b *DuplicateCandidate) (float64, []string) {
+	reasons := make([]string, 0, 2)
+	if strings.EqualFold(strings.TrimSpace(a.Email), strings.TrimSpace(b.Email)) && a.Email != "" {
+		reasons = append(reasons, DuplicateReasonEmail)
+	}
+	if p := NormalizePhone(a.Phone); p != "" && p == NormalizePhone(b.Phone) {
+		reasons = append(reasons, DuplicateReasonPhone)
+	}
+	if d := companyEmailDomain(a.Email); d != "" && d == companyEmailDomain(b.Email) {
+		if c := NormalizeCompany(a.Company); c != "" && c == NormalizeCompany(b.Company) {
+			reasons = append(reasons, DuplicateReasonDomainCompany)
+		}
+	}
+
+	miss := 1.0
+	for _, r := range reasons {
+		miss *= 1 - duplicateReasonWeight[r]
+	}
+	if sim := NameSimilarity(a.Name, b.Name); sim >= NameSimilarityThreshold {
+		reasons = append(reasons, DuplicateReasonName)
+		miss *= 1 - 0.7*sim
+	}
+	return 1 - miss, reasons
+}
+
+// FindDuplicates ищет группы возможных дублей среди клиентов пользователя (администратор – среди всех).
+// Попарно сравниваются только клиенты с общим ключом: телефоном, email, доменом + компанией
+// или словом имени, поэтому поиск не квадратичен по всей базе.
+func FindDuplicates(ctx context.Context, userID string, isAdmin bool, minScore float64, limit int) ([]DuplicateGroup, error) {
+	query := `
+		SELECT id, name, email, COALESCE(phone, ''), COALESCE(company, ''), COALESCE(status, ''), COALESCE(created_at, NOW())
+		FROM crm_customers WHERE deleted_at IS NULL`
+	args := []interface{}{}
+	if !isAdmin {
+		query += ` AND user_id = $1`
+		args = append(args, userID)
+	}
+	query += fmt.Sprintf(` ORDER BY created_at LIMIT %d`, duplicateScanLimit)
+
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	customers := make([]DuplicateCandidate, 0)
+	for rows.Next() {
+		var c DuplicateCandidate
+		if err := rows.Scan(&c.ID, &c.Name, &c.Email, &c.Phone, &c.Company, &c.Status, &c.CreatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		customers = append(customers, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// блоки: ключ -> индексы клиентов
+	blocks := make(map[string][]int)
+	for i := range customers {
+		c := &customers[i]
+		keys := make([]string, 0, 4)
+		if c.Email != "" {
+			keys = append(keys, "e:"+strings.ToLower(strings.TrimSpace(c.Email)))
+		}
+		if p := NormalizePhone(c.Phone); p != "" {
+			keys = append(keys, "p:"+p)
+		}
+		if d := companyEmailDomain(c.Email); d != "" {
+			keys = append(keys, "d:"+d)
+		}
+		for _, t := range nameTokens(c.Name) {
+			if len([]rune(t)) >= 3 {
+				keys = append(keys, "n:"+t)
+			}
+		}
+		for _, k := range keys {
+			blocks[k] = append(blocks[k], i)
+		}
+	}
+
+	// система непересекающихся множеств для объединения пар в группы
+	parent := make([]int, len(customers))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	type pairInfo struct {
+		score   float64
+		reasons []string
+	}
+	checked := make(map[[2]int]bool)
+	pairs := make(map[[2]int]pairInfo)
+	for _, idx := range blocks {
+		if len(idx) < 2 || len(idx) > duplicateBlockLimit {
+			continue
+		}
+		for x := 0; x < len(idx); x++ {
+			for y := x + 1; y < len(idx); y++ {
+				key := [2]int{idx[x], idx[y]}
+				if checked[key] {
+					continue
+				}
+				checked[key] = true
+				score, reasons := duplicateScore(&customers[idx[x]], &customers[idx[y]])
+				if len(reasons) == 0 || score < minScore {
+					continue
+				}
+				pairs[key] = pairInfo{score: score, reasons: reasons}
+				parent[find(idx[x])] = find(idx[y])
+			}
+		}
+	}
+
+	byRoot := make(map[int]*DuplicateGroup)
+	reasonSets := make(map[int]map[string]bool)
+	for key, p := range pairs {
+		root := find(key[0])
+		g, ok := byRoot[root]
+		if !ok {
+			g = &DuplicateGroup{}
+			byRoot[root] = g
+			reasonSets[root] = make(map[string]bool)
+		}
+		if p.score > g.Score {
+			g.Score = p.score
+		}
+		for _, r := range p.reasons {
+			reasonSets[root][r] = true
+		}
+	}
+	for i := range customers {
+		if g, ok := byRoot[find(i)]; ok {
+			g.Customers = append(g.Customers, customers[i])
+		}
+	}
+
+	groups := make([]DuplicateGroup, 0, len(byRoot))
+	ids := make([]string, 0)
+	for root, g := range byRoot {
+		for r := range reasonSets[root] {
+			g.Reasons = append(g.Reasons, r)
+		}
+		sort.Strings(g.Reasons)
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].Score != groups[j].Score {
+			return groups[i].Score > groups[j].Score
+		}
+		return groups[i].Customers[0].CreatedAt.Before(groups[j].Customers[0].CreatedAt)
+	})
+	if limit > 0 && len(groups) > limit {
+		groups = groups[:limit]
+	}
+	for _, g := range groups {
+		for _, c := range g.Customers {
+			ids = append(ids, c.ID)
+		}
+	}
+	if len(ids) == 0 {
+		return groups, nil
+	}
+
+	// число сделок помогает выбрать, кого оставить
+	counts := make(map[string]int)
+	rows, err = database.Pool.Query(ctx, `
+		SELECT customer_id, COUNT(*) FROM crm_deals WHERE customer_id = ANY($1) AND deleted_at IS NULL GROUP BY customer_id
+	`, ids)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id string
+		var n int
+		if err := rows.Scan(&id, &n); err != nil {
+			return nil, err
+		}
+		counts[id] = n
+	}
+	for _, g := range groups {
+		for i := range g.Customers {
+			g.Customers[i].DealsCount = counts[g.Customers[i].ID]
+		}
+	}
+	return groups, rows.Err()
+}
+
+// mergeCustomerRow – клиент целиком, как он хранится в снимке слияния
+type mergeCustomerRow struct {
+	ID           string                 `json:"id"`
+	Name         string                 `json:"name"`
+	Email        string                 `json:"email"`
+	Phone        *string                `json:"phone"`
+	Company      *string                `json:"company"`
+	Status       *string                `json:"status"`
+	Responsible  *string                `json:"responsible"`
+	Source       *string                `json:"source"`
+	Comment      *string                `json:"comment"`
+	UserID       *string                `json:"user_id"`
+	LeadScore    float64                `json:"lead_score"`
+	CustomFields map[string]interface{} `json:"custom_fields"`
+	CreatedAt    time.Time              `json:"created_at"`
+	LastSeen     time.Time              `json:"last_seen"`
+}
+
+const mergeCustomerColumns = `id, name, email, phone, company, status, responsible, source, comment,
+	user_id, COALESCE(lead_score, 0), custom_fields, created_at, last_seen`
+
+func scanMergeCustomer(row pgx.Row) (*mergeCustomerRow, error) {
+	var c mergeCustomerRow
+	var customFields []byte
+	var createdAt, lastSeen *time.Time
+	if err := row.Scan(&c.ID, &c.Name, &c.Email, &c.Phone, &c.Company, &c.Status, &c.Responsible, &c.Source, &c.Comment,
+		&c.UserID, &c.LeadScore, &customFields, &createdAt, &lastSeen); err != nil {
+		return nil, err
+	}
+	c.CustomFields = map[string]interface{}{}
+	if len(customFields) > 0 {
+		if err := json.Unmarshal(customFields, &c.CustomFields); err != nil {
+			return nil, err
+		}
+	}
+	if createdAt != nil {
+		c.CreatedAt = *createdAt
+	}
+	if lastSeen != nil {
+		c.LastSeen = *lastSeen
+	}
+	return &c, nil
+}
+
+// field возвращает значение поля из MergeableCustomerFields
+func (c *mergeCustomerRow) field(name string) *string {
+	switch name {
+	case "name":
+		return &c.Name
+	case "email":
+		return &c.Email
+	case "phone":
+		return c.Phone
+	case "company":
+		return c.Company
+	case "status":
+		return c.Status
+	case "responsible":
+		return c.Responsible
+	case "source":
+		return c.Source
+	case "comment":
+		return c.Comment
+	}
+	return nil
+}
+
+// setField меняет значение поля из MergeableCustomerFields
+func (c *mergeCustomerRow) setField(name string, v *string) {
+	switch name {
+	case "name":
+		c.Name = *v
+	case "email":
+		c.Email = *v
+	case "phone":
+		c.Phone = v
+	case "company":
+		c.Company = v
+	case "status":
+		c.Status = v
+	case "responsible":
+		c.Responsible = v
+	case "source":
+		c.Source = v
+	case "comment":
+		c.Comment = v
+	}
+}
+
+func isEmptyField(v *string) bool {
+	return v == nil || strings.TrimSpace(*v) == ""
+}
+
+// MergeRequest – что с чем сливать. Fields задаёт, у какого клиента взять значение поля
+// (ключи – MergeableCustomerFields и cf.<key> для пользовательских полей). Для остальных полей
+// остаётся значение выжившего, а если оно пустое – первое непустое у сливаемых.
+type MergeRequest struct {
+	SurvivorID string            `json:"survivor_id"`
+	MergeIDs   []string          `json:"merge_ids"`
+	Fields     map[string]string `json:"fields"`
+}
+
+// customerMergeSnapshot – всё, что нужно для отмены слияния; хранится в crm_history.changes
+type customerMergeSnapshot struct {
+	Before         *mergeCustomerRow   `json:"before"`
+	After          *mergeCustomerRow   `json:"after"`
+	Merged         []*mergeCustomerRow `json:"merged"`
+	Fields         map[string]string   `json:"fields,omitempty"`
+	Deals          map[string][]string `json:"deals"`
+	Activities     map[string][]string `json:"activities"`
+	Transcriptions map[string][]string `json:"transcriptions"`
+	Tags           map[string][]string `json:"tags"`
+	AddedTags      []string            `json:"added_tags"`
+	RevertedAt     *time.Time          `json:"reverted_at,omitempty"`
+}
+
+// MergeResult – итог слияния. MergeID – запись crm_history, по ней слияние отменяется.
+type MergeResult struct {
+	MergeID             string   `json:"merge_id"`
+	SurvivorID          string   `json:"survivor_id"`
+	MergedIDs           []string `json:"merged_ids"`
+	MovedDeals          int      `json:"moved_deals"`
+	MovedActivities     int      `json:"moved_activities"`
+	MovedTranscriptions int      `json:"moved_transcriptions"`
+	AddedTags           int      `json:"added_tags"`
+}
+
+// moveRows выполняет UPDATE ... RETURNING id, <старый владелец> и группирует id по старому владельцу
+func moveRows(ctx context.Context, tx pgx.Tx, query string, args ...interface{}) (map[string][]string, int, error) {
+	rows, err := tx.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	moved := make(map[string][]string)
+	n := 0
+	for rows.Next() {
+		var id, owner string
+		if err := rows.Scan(&id, &owner); err != nil {
+			return nil, 0, err
+		}
+		moved[owner] = append(moved[owner], id)
+		n++
+	}
+	return moved, n, rows.Err()
+}
+
+// transcriptionsEnabled – таблица транскрибаций создаётся модулем распознавания речи и может отсутствовать
+func transcriptionsEnabled(ctx context.Context, tx pgx.Tx) (bool, error) {
+	var exists bool
+	err := tx.QueryRow(ctx, `SELECT to_regclass('audio_transcriptions') IS NOT NULL`).Scan(&exists)
+	return exists, err
+}
+
+// MergeCustomers сливает клиентов MergeIDs в SurvivorID: выбирает значения полей, переносит сделки
+// (вместе с их вложениями), активности, теги и транскрибации, удаляет слитых клиентов и пишет
+// снимок в crm_history. Клиенты должны принадлежать userID, если он не администратор.
+func MergeCustomers(ctx context.Context, req MergeRequest, userID string, isAdmin bool) (*MergeResult, error) {
+	if req.SurvivorID == "" || len(req.MergeIDs) == 0 {
+		return nil, fmt.Errorf("%w: survivor_id and merge_ids are required", ErrInvalidMerge)
+	}
+	ids := []string{req.SurvivorID}
+	seen := map[string]bool{req.SurvivorID: true}
+	for _, id := range req.MergeIDs {
+		if seen[id] {
+			return nil, fmt.Errorf("%w: customer %s is listed twice", ErrInvalidMerge, id)
+		}
+		seen[id] = true
+		ids = append(ids, id)
+	}
+	for field, source := range req.Fields {
+		if !seen[source] {
+			return nil, fmt.Errorf("%w: field %s refers to customer %s outside the merge", ErrInvalidMerge, field, source)
+		}
+		if !strings.HasPrefix(field, "cf.") && !containsString(MergeableCustomerFields, field) {
+			return nil, fmt.Errorf("%w: field %s cannot be merged", ErrInvalidMerge, field)
+		}
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	rows, err := tx.Query(ctx, `SELECT `+mergeCustomerColumns+` FROM crm_customers WHERE id = ANY($1) AND deleted_at IS NULL FOR UPDATE`, ids)
+	if err != nil {
+		return nil, err
+	}
+	byID := make(map[string]*mergeCustomerRow)
+	for rows.Next() {
+		c, err := scanMergeCustomer(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		byID[c.ID] = c
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for _, id := range ids {
+		c, ok := byID[id]
+		if !ok || (!isAdmin && (c.UserID == nil || *c.UserID != userID)) {
+			return nil, fmt.Errorf("%w: %s", ErrCustomerNotFound, id)
+		}
+	}
+
+	before := byID[req.SurvivorID]
+	merged := make([]*mergeCustomerRow, 0, len(req.MergeIDs))
+	for _, id := range req.MergeIDs {
+		merged = append(merged, byID[id])
+	}
+
+	// значения выжившего
+	afterCopy := *before
+	after := &afterCopy
+	after.CustomFields = make(map[string]interface{}, len(before.CustomFields))
+	for k, v := range before.CustomFields {
+		after.CustomFields[k] = v
+	}
+	for _, field := range MergeableCustomerFields {
+		if source, ok := req.Fields[field]; ok {
+			after.setField(field, byID[source].field(field))
+			continue
+		}
+		if !isEmptyField(after.field(field)) {
+			continue
+		}
+		for _, m := range merged {
+			if !isEmptyField(m.field(field)) {
+				after.setField(field, m.field(field))
+				break
+			}
+		}
+	}
+	if strings.TrimSpace(after.Name) == "" || strings.TrimSpace(after.Email) == "" {
+		return nil, fmt.Errorf("%w: name and email of the survivor cannot be empty", ErrInvalidMerge)
+	}
+	for _, m := range merged {
+		for k, v := range m.CustomFields {
+			if _, ok := after.CustomFields[k]; !ok && v != nil {
+				after.CustomFields[k] = v
+			}
+		}
+	}
+	for field, source := range req.Fields {
+		if key := strings.TrimPrefix(field, "cf."); key != field {
+			if v, ok := byID[source].CustomFields[key]; ok && v != nil {
+				after.CustomFields[key] = v
+			} else {
+				delete(after.CustomFields, key)
+			}
+		}
+	}
+
+	snapshot := customerMergeSnapshot{
+		Before: before,
+		After:  after,
+		Merged: merged,
+		Fields: req.Fields,
+		Tags:   make(map[string][]string),
+	}
+	result := &MergeResult{SurvivorID: req.SurvivorID, MergedIDs: req.MergeIDs}
+
+	snapshot.Deals, result.MovedDeals, err = moveRows(ctx, tx, `
+		UPDATE crm_deals d SET customer_id = $1, updated_at = NOW()
+		FROM (SELECT id, customer_id FROM crm_deals WHERE customer_id = ANY($2)) old
+		WHERE d.id = old.id
+		RETURNING d.id, old.customer_id
+	`, req.SurvivorID, req.MergeIDs)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Activities, result.MovedActivities, err = moveRows(ctx, tx, `
+		UPDATE activities a SET entity_id = $1
+		FROM (SELECT id, entity_id FROM activities WHERE entity_type = 'customer' AND entity_id = ANY($2)) old
+		WHERE a.id = old.id
+		RETURNING a.id::text, old.entity_id::text
+	`, req.SurvivorID, req.MergeIDs)
+	if err != nil {
+		return nil, err
+	}
+	snapshot.Transcriptions = map[string][]string{}
+	if ok, err := transcriptionsEnabled(ctx, tx); err != nil {
+		return nil, err
+	} else if ok {
+		snapshot.Transcriptions, result.MovedTranscriptions, err = moveRows(ctx, tx, `
+			UPDATE audio_transcriptions t SET customer_id = $1, updated_at = NOW()
+			FROM (SELECT id, customer_id FROM audio_transcriptions WHERE customer_id::text = ANY($2)) old
+			WHERE t.id = old.id
+			RETURNING t.id::text, old.customer_id::text
+		`, req.SurvivorID, req.MergeIDs)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// теги: выживший получает объединение тегов
+	rows, err = tx.Query(ctx, `SELECT customer_id::text, tag_id::text FROM customer_tags WHERE customer_id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var customerID, tagID string
+		if err := rows.Scan(&customerID, &tagID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		snapshot.Tags[customerID] = append(snapshot.Tags[customerID], tagID)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	snapshot.AddedTags = []string{}
+	for _, id := range req.MergeIDs {
+		for _, tagID := range snapshot.Tags[id] {
+			if !containsString(snapshot.Tags[req.SurvivorID], tagID) && !containsString(snapshot.AddedTags, tagID) {
+				snapshot.AddedTags = append(snapshot.AddedTags, tagID)
+			}
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM customer_tags WHERE customer_id = ANY($1)`, req.MergeIDs); err != nil {
+		return nil, err
+	}
+	for _, tagID := range snapshot.AddedTags {
+		if _, err := tx.Exec(ctx, `INSERT INTO customer_tags (customer_id, tag_id) VALUES ($1, $2)`, req.SurvivorID, tagID); err != nil {
+			return nil, err
+		}
+	}
+	result.AddedTags = len(snapshot.AddedTags)
+
+	// слитые удаляются до обновления выжившего: он может забрать email одного из них
+	if _, err := tx.Exec(ctx, `DELETE FROM crm_customers WHERE id = ANY($1)`, req.MergeIDs); err != nil {
+		return nil, err
+	}
+	if err := writeMergeCustomer(ctx, tx, after); err != nil {
+		return nil, err
+	}
+
+	changes, err := json.Marshal(snapshot)
+	if err != nil {
+		return nil, err
+	}
+	var actor *string
+	if userID != "" {
+		actor = &userID
+	}
+	if err := tx.QueryRow(ctx, `
+		INSERT INTO crm_history (entity_type, entity_id, action, user_id, changes)
+		VALUES ('customer', $1, 'merge', $2, $3)
+		RETURNING id
+	`, req.SurvivorID, actor, changes).Scan(&result.MergeID); err != nil {
+		return nil, err
+	}
+	for _, id := range req.MergeIDs {
+		note, _ := json.Marshal(map[string]string{"merged_into": req.SurvivorID, "merge_id": result.MergeID})
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO crm_history (entity_type, entity_id, action, user_id, changes)
+			VALUES ('customer', $1, 'merged', $2, $3)
+		`, id, actor, note); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// writeMergeCustomer сохраняет поля выжившего клиента
+func writeMergeCustomer(ctx context.Context, tx pgx.Tx, c *mergeCustomerRow) error {
+	customFields, err := json.Marshal(c.CustomFields)
+	if err != nil {
+		return err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE crm_customers
+		SET name = $2, email = $3, phone = $4, company = $5, status = $6, responsible = $7,
+		    source = $8, comment = $9, custom_fields = $10, last_seen = GREATEST(last_seen, $11)
+		WHERE id = $1
+	`, c.ID, c.Name, c.Email, c.Phone, c.Company, c.Status, c.Responsible, c.Source, c.Comment, customFields, c.LastSeen)
+	return err
+}
+
+// RevertMerge отменяет слияние по записи crm_history: восстанавливает слитых клиентов с прежними id
+// и возвращает им сделки, активности, транскрибации и теги. Поля выжившего откатываются,
+// только если после слияния их не меняли вручную. Возвращает id выжившего и восстановленных клиентов.
+func RevertMerge(ctx context.Context, mergeID, userID string, isAdmin bool) (string, []string, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return "", nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var survivorID string
+	var raw []byte
+	err = tx.QueryRow(ctx, `
+		SELECT entity_id::text, changes FROM crm_history
+		WHERE id = $1 AND entity_type = 'customer' AND action = 'merge'
+		FOR UPDATE
+	`, mergeID).Scan(&survivorID, &raw)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil, ErrMergeNotFound
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var snapshot customerMergeSnapshot
+	if err := json.Unmarshal(raw, &snapshot); err != nil {
+		return "", nil, err
+	}
+	if snapshot.RevertedAt != nil {
+		return "", nil, ErrMergeReverted
+	}
+	if snapshot.Before == nil || snapshot.After == nil {
+		return "", nil, fmt.Errorf("%w: merge record has no snapshot", ErrInvalidMerge)
+	}
+
+	current, err := scanMergeCustomer(tx.QueryRow(ctx,
+		`SELECT `+mergeCustomerColumns+` FROM crm_customers WHERE id = $1 FOR UPDATE`, survivorID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", nil, fmt.Errorf("%w: survivor %s was deleted", ErrCustomerNotFound, survivorID)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	if !isAdmin && (current.UserID == nil || *current.UserID != userID) {
+		return "", nil, ErrMergeNotFound
+	}
+
+	// поля, не тронутые после слияния, возвращаются к прежним значениям
+	for _, field := range MergeableCustomerFields {
+		if equalFieldValues(current.field(field), snapshot.After.field(field)) {
+			current.setField(field, snapshot.Before.field(field))
+		}
+	}
+	keys := make(map[string]bool)
+	for k := range snapshot.Before.CustomFields {
+		keys[k] = true
+	}
+	for k := range snapshot.After.CustomFields {
+		keys[k] = true
+	}
+	for k := range keys {
+		if !equalJSONValues(current.CustomFields[k], snapshot.After.CustomFields[k]) {
+			continue
+		}
+		if v, ok := snapshot.Before.CustomFields[k]; ok {
+			current.CustomFields[k] = v
+		} else {
+			delete(current.CustomFields, k)
+		}
+	}
+	if err := writeMergeCustomer(ctx, tx, current); err != nil {
+		return "", nil, err
+	}
+
+	restored := make([]string, 0, len(snapshot.Merged))
+	for _, m := range snapshot.Merged {
+		var taken bool
+		if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM crm_customers WHERE email = $1 OR id = $2)`, m.Email, m.ID).Scan(&taken); err != nil {
+			return "", nil, err
+		}
+		if taken {
+			return "", nil, fmt.Errorf("%w: email %s or id %s is already used by another customer", ErrInvalidMerge, m.Email, m.ID)
+		}
+		customFields, err := json.Marshal(m.CustomFields)
+		if err != nil {
+			return "", nil, err
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO crm_customers (id, name, email, phone, company, status, responsible, source, comment,
+			                           user_id, lead_score, custom_fields, created_at, last_seen)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		`, m.ID, m.Name, m.Email, m.Phone, m.Company, m.Status, m.Responsible, m.Source, m.Comment,
+			m.UserID, m.LeadScore, customFields, m.CreatedAt, m.LastSeen); err != nil {
+			return "", nil, err
+		}
+		restored = append(restored, m.ID)
+
+		// возвращается только то, что до сих пор у выжившего
+		if ids := snapshot.Deals[m.ID]; len(ids) > 0 {
+			if _, err := tx.Exec(ctx, `UPDATE crm_deals SET customer_id = $1, updated_at = NOW() WHERE id = ANY($2) AND customer_id = $3`,
+				m.ID, ids, survivorID); err != nil {
+				return "", nil, err
+			}
+		}
+		if ids := snapshot.Activities[m.ID]; len(ids) > 0 {
+			if _, err := tx.Exec(ctx, `UPDATE activities SET entity_id = $1 WHERE id::text = ANY($2) AND entity_type = 'customer' AND entity_id::text = $3`,
+				m.ID, ids, survivorID); err != nil {
+				return "", nil, err
+			}
+		}
+		if ids := snapshot.Transcriptions[m.ID]; len(ids) > 0 {
+			if _, err := tx.Exec(ctx, `UPDATE audio_transcriptions SET customer_id = $1, updated_at = NOW() WHERE id::text = ANY($2) AND customer_id::text = $3`,
+				m.ID, ids, survivorID); err != nil {
+				return "", nil, err
+			}
+		}
+		if tagIDs := snapshot.Tags[m.ID]; len(tagIDs) > 0 {
+			// теги, удалённые после слияния, не восстанавливаются
+			if _, err := tx.Exec(ctx, `INSERT INTO customer_tags (customer_id, tag_id) SELECT $1, id FROM tags WHERE id::text = ANY($2)`,
+				m.ID, tagIDs); err != nil {
+				return "", nil, err
+			}
+		}
+	}
+	if len(snapshot.AddedTags) > 0 {
+		if _, err := tx.Exec(ctx, `DELETE FROM customer_tags WHERE customer_id = $1 AND tag_id::text = ANY($2)`,
+			survivorID, snapshot.AddedTags); err != nil {
+			return "", nil, err
+		}
+	}
+
+	if _, err := tx.Exec(ctx, `
+		UPDATE crm_history SET changes = jsonb_set(changes, '{reverted_at}', to_jsonb(NOW()))
+		WHERE id = $1
+	`, mergeID); err != nil {
+		return "", nil, err
+	}
+	var actor *string
+	if userID != "" {
+		actor = &userID
+	}
+	note, _ := json.Marshal(map[string]interface{}{"merge_id": mergeID, "restored": restored})
+	if _, err := tx.Exec(ctx, `
+		INSERT INTO crm_history (entity_type, entity_id, action, user_id, changes)
+		VALUES ('customer', $1, 'unmerge', $2, $3)
+	`, survivorID, actor, note); err != nil {
+		return "", nil, err
+	}
+
+	if err := tx.Commit(ctx); err != nil {
+		return "", nil, err
+	}
+	return survivorID, restored, nil
+}
+
+func equalFieldValues(a, b *string) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return *a == *b
+}
+
+func equalJSONValues(a, b interface{}) bool {
+	ja, _ := json.Marshal(a)
+	jb, _ := json.Marshal(b)
+	return string(ja) == string(jb)
+}
@@ -0,0 +1,433 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Корзина CRM. Удаление клиента, сделки, активности, тега или вложения только помечает строку
+// (deleted_at, deleted_by, deletion_id) и создаёт запись в crm_trash. Дочерние строки – сделки клиента,
+// их вложения, активности клиента и сделок – помечаются тем же deletion_id, поэтому восстановление
+// записи корзины возвращает их вместе с родителем, а ранее удалённые по отдельности остаются в корзине.
+// По истечении срока хранения записи корзины удаляются окончательно (дальше работают ON DELETE CASCADE).
+
+// Типы сущностей корзины
+const (
+	TrashEntityCustomer   = "customer"
+	TrashEntityDeal       = "deal"
+	TrashEntityActivity   = "activity"
+	TrashEntityTag        = "tag"
+	TrashEntityAttachment = "attachment"
+)
+
+var (
+	ErrTrashItemNotFound   = errors.New("trash item not found")
+	ErrTrashRestoreBlocked = errors.New("cannot restore")
+	ErrNotInTrash          = errors.New("entity not found or already deleted")
+)
+
+// trashTables – таблица каждой сущности корзины
+var trashTables = map[string]string{
+	TrashEntityCustomer:   "crm_customers",
+	TrashEntityDeal:       "crm_deals",
+	TrashEntityActivity:   "activities",
+	TrashEntityTag:        "tags",
+	TrashEntityAttachment: "deal_attachments",
+}
+
+// trashRestoreOrder – порядок снятия пометок: родители раньше детей
+var trashRestoreOrder = []string{"crm_customers", "crm_deals", "deal_attachments", "activities", "tags"}
+
+// IsTrashEntity проверяет тип сущности корзины
+func IsTrashEntity(entityType string) bool {
+	_, ok := trashTables[entityType]
+	return ok
+}
+
+// NotDeletedSQL – условие «строка не в корзине» для таблицы с алиасом alias (пустой – без алиаса)
+func NotDeletedSQL(alias string) string {
+	if alias == "" {
+		return "deleted_at IS NULL"
+	}
+	return alias + ".deleted_at IS NULL"
+}
+
+// TrashItem – запись корзины: удалённая сущность и число удалённых вместе с ней дочерних строк
+type TrashItem struct {
+	ID         string         `json:"id"`
+	EntityType string         `json:"entity_type"`
+	EntityID   string         `json:"entity_id"`
+	Title      string         `json:"title"`
+	OwnerID    *string        `json:"owner_id,omitempty"`
+	DeletedBy  *string        `json:"deleted_by,omitempty"`
+	DeletedAt  time.Time      `json:"deleted_at"`
+	Children   map[string]int `json:"children"`
+	PurgeAt    *time.Time     `json:"purge_at,omitempty"`
+}
+
+// CanManage – восстановить или удалить навсегда может администратор, владелец сущности
+// и тот, кто её удалил; записи без владельца (теги) – любой пользователь, как и сами теги
+func (t *TrashItem) CanManage(userID string, isAdmin bool) bool {
+	return isAdmin || t.OwnerID == nil || *t.OwnerID == userID || (t.DeletedBy != nil && *t.DeletedBy == userID)
+}
+
+// WithRetention заполняет срок окончательного удаления
+func (t *TrashItem) WithRetention(retention time.Duration) *TrashItem {
+	if retention > 0 {
+		at := t.DeletedAt.Add(retention)
+		t.PurgeAt = &at
+	}
+	return t
+}
+
+const trashColumns = `id, entity_type, entity_id::text, title, owner_id::text, deleted_by::text, deleted_at, children`
+
+func scanTrashItem(row pgx.Row) (*TrashItem, error) {
+	var t TrashItem
+	var children []byte
+	err := row.Scan(&t.ID, &t.EntityType, &t.EntityID, &t.Title, &t.OwnerID, &t.DeletedBy, &t.DeletedAt, &children)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTrashItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(children, &t.Children); err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// MoveToTrash удаляет сущности в корзину в отдельной транзакции
+func MoveToTrash(ctx context.Context, entityType string, ids []string, deletedBy *string) ([]*TrashItem, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	items, err := MoveToTrashTx(ctx, tx, entityType, ids, deletedBy)
+	if err != nil {
+		return nil, err
+	}
+	return items, tx.Commit(ctx)
+}
+
+// MoveToTrashTx удаляет сущности в корзину: по записи корзины на сущность. Уже удалённые
+// и несуществующие ID пропускаются; если не удалось ни одного – ErrNotInTrash.
+func MoveToTrashTx(ctx context.Context, tx pgx.Tx, entityType string, ids []string, deletedBy *string) ([]*TrashItem, error) {
+	if !IsTrashEntity(entityType) {
+		return nil, fmt.Errorf("unknown trash entity %q", entityType)
+	}
+	items := make([]*TrashItem, 0, len(ids))
+	for _, id := range ids {
+		item, err := trashEntity(ctx, tx, entityType, id, deletedBy)
+		if errors.Is(err, ErrNotInTrash) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	if len(items) == 0 {
+		return nil, ErrNotInTrash
+	}
+	return items, nil
+}
+
+// trashEntity помечает сущность и её дочерние строки и создаёт запись корзины
+func trashEntity(ctx context.Context, tx pgx.Tx, entityType, id string, deletedBy *string) (*TrashItem, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotInTrash
+	}
+	item := &TrashItem{ID: uuid.NewString(), EntityType: entityType, EntityID: id, DeletedBy: deletedBy, Children: map[string]int{}}
+	const mark = `deleted_at = NOW(), deleted_by = $2, deletion_id = $3`
+
+	var titleSQL, ownerSQL string
+	switch entityType {
+	case TrashEntityCustomer:
+		titleSQL, ownerSQL = "name", "user_id::text"
+	case TrashEntityDeal:
+		titleSQL, ownerSQL = "title", "user_id::text"
+	case TrashEntityTag:
+		titleSQL, ownerSQL = "name", "NULL::text"
+	case TrashEntityAttachment:
+		titleSQL = "file_name"
+		ownerSQL = "(SELECT d.user_id::text FROM crm_deals d WHERE d.id = deal_id)"
+	case TrashEntityActivity:
+		titleSQL = "activity_type || ': ' || LEFT(COALESCE(content, ''), 100)"
+		ownerSQL = `CASE entity_type
+			WHEN 'deal' THEN (SELECT d.user_id::text FROM crm_deals d WHERE d.id::text = entity_id::text)
+			WHEN 'customer' THEN (SELECT c.user_id::text FROM crm_customers c WHERE c.id::text = entity_id::text)
+			END`
+	}
+	err := tx.QueryRow(ctx, `
+		UPDATE `+trashTables[entityType]+` SET `+mark+`
+		WHERE id = $1 AND deleted_at IS NULL
+		RETURNING `+titleSQL+`, `+ownerSQL, id, deletedBy, item.ID).Scan(&item.Title, &item.OwnerID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotInTrash
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Каскад: сделки клиента, вложения сделок, активности клиента и сделок
+	var dealIDs []string
+	switch entityType {
+	case TrashEntityCustomer:
+		rows, err := tx.Query(ctx, `
+			UPDATE crm_deals SET `+mark+`
+			WHERE customer_id = $1 AND deleted_at IS NULL
+			RETURNING id::text
+		`, id, deletedBy, item.ID)
+		if err != nil {
+			return nil, err
+		}
+		dealIDs, err = pgx.CollectRows(rows, pgx.RowTo[string])
+		if err != nil {
+			return nil, err
+		}
+		item.Children["deals"] = len(dealIDs)
+	case TrashEntityDeal:
+		dealIDs = []string{id}
+	}
+	if len(dealIDs) > 0 {
+		tag, err := tx.Exec(ctx, `
+			UPDATE deal_attachments SET `+mark+`
+			WHERE deal_id::text = ANY($1) AND deleted_at IS NULL
+		`, dealIDs, deletedBy, item.ID)
+		if err != nil {
+			return nil, err
+		}
+		item.Children["attachments"] = int(tag.RowsAffected())
+	}
+	if entityType == TrashEntityCustomer || entityType == TrashEntityDeal {
+		tag, err := tx.Exec(ctx, `
+			UPDATE activities SET `+mark+`
+			WHERE deleted_at IS NULL
+			  AND ((entity_type = 'customer' AND entity_id::text = $1) OR (entity_type = 'deal' AND entity_id::text = ANY($4)))
+		`, id, deletedBy, item.ID, dealIDs)
+		if err != nil {
+			return nil, err
+		}
+		item.Children["activities"] = int(tag.RowsAffected())
+	}
+
+	children, err := json.Marshal(item.Children)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO crm_trash (id, entity_type, entity_id, title, owner_id, deleted_by, children)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING deleted_at
+	`, item.ID, entityType, id, item.Title, item.OwnerID, deletedBy, children).Scan(&item.DeletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// TrashFilter – отбор записей корзины
+type TrashFilter struct {
+	EntityType string
+	OwnerID    string // пусто – все (администратор); иначе свои, удалённые пользователем и общие
+	Limit      int
+	Offset     int
+}
+
+// ListTrash возвращает записи корзины, новые сначала, и их общее число
+func ListTrash(ctx context.Context, f TrashFilter) ([]*TrashItem, int, error) {
+	where := "TRUE"
+	args := []interface{}{}
+	if f.EntityType != "" {
+		args = append(args, f.EntityType)
+		where += fmt.Sprintf(" AND entity_type = $%d", len(args))
+	}
+	if f.OwnerID != "" {
+		args = append(args, f.OwnerID)
+		where += fmt.Sprintf(" AND (owner_id IS NULL OR owner_id::text = $%d OR deleted_by::text = $%d)", len(args), len(args))
+	}
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_trash WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+		SELECT `+trashColumns+` FROM crm_trash WHERE %s
+		ORDER BY deleted_at DESC, id
+		LIMIT $%d OFFSET $%d
+	`, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	items := []*TrashItem{}
+	for rows.Next() {
+		t, err := scanTrashItem(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		items = append(items, t)
+	}
+	return items, total, rows.Err()
+}
+
+// GetTrashItem возвращает запись корзины
+func GetTrashItem(ctx context.Context, id string) (*TrashItem, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrTrashItemNotFound
+	}
+	return scanTrashItem(database.Pool.QueryRow(ctx, `SELECT `+trashColumns+` FROM crm_trash WHERE id = $1`, id))
+}
+
+// RestoreTrashItem возвращает сущность и удалённые вместе с ней строки. Сделку нельзя вернуть,
+// пока в корзине её клиент; вложение и активность – пока в корзине их сделка или клиент.
+func RestoreTrashItem(ctx context.Context, id string) (*TrashItem, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	item, err := restoreTrashItemTx(ctx, tx, id)
+	if err != nil {
+		return nil, err
+	}
+	return item, tx.Commit(ctx)
+}
+
+// RestoreTrashedCustomerTx возвращает клиента из корзины внутри транзакции tx
+// (например, когда по его email пришла новая заявка)
+func RestoreTrashedCustomerTx(ctx context.Context, tx pgx.Tx, customerID string) (*TrashItem, error) {
+	var id string
+	err := tx.QueryRow(ctx, `
+		SELECT id::text FROM crm_trash WHERE entity_type = $1 AND entity_id::text = $2
+	`, TrashEntityCustomer, customerID).Scan(&id)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTrashItemNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return restoreTrashItemTx(ctx, tx, id)
+}
+
+func restoreTrashItemTx(ctx context.Context, tx pgx.Tx, id string) (*TrashItem, error) {
+	item, err := scanTrashItem(tx.QueryRow(ctx, `SELECT `+trashColumns+` FROM crm_trash WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return nil, err
+	}
+	if err := checkTrashParent(ctx, tx, item); err != nil {
+		return nil, err
+	}
+	for _, table := range trashRestoreOrder {
+		if _, err := tx.Exec(ctx, `
+			UPDATE `+table+` SET deleted_at = NULL, deleted_by = NULL, deletion_id = NULL
+			WHERE deletion_id = $1
+		`, id); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM crm_trash WHERE id = $1`, id); err != nil {
+		return nil, err
+	}
+	return item, nil
+}
+
+// checkTrashParent – родитель восстанавливаемой сущности должен существовать и быть вне корзины
+func checkTrashParent(ctx context.Context, tx pgx.Tx, item *TrashItem) error {
+	var query, parent string
+	switch item.EntityType {
+	case TrashEntityDeal:
+		query, parent = `SELECT c.deleted_at IS NULL FROM crm_deals d JOIN crm_customers c ON c.id = d.customer_id WHERE d.id = $1`, "customer"
+	case TrashEntityAttachment:
+		query, parent = `SELECT d.deleted_at IS NULL FROM deal_attachments a JOIN crm_deals d ON d.id = a.deal_id WHERE a.id = $1`, "deal"
+	case TrashEntityActivity:
+		query = `
+			SELECT COALESCE((
+				SELECT d.deleted_at IS NULL FROM crm_deals d WHERE a.entity_type = 'deal' AND d.id::text = a.entity_id::text
+				UNION ALL
+				SELECT c.deleted_at IS NULL FROM crm_customers c WHERE a.entity_type = 'customer' AND c.id::text = a.entity_id::text
+			), FALSE)
+			FROM activities a WHERE a.id::text = $1`
+		parent = "deal or customer"
+	default:
+		return nil
+	}
+	var ok bool
+	err := tx.QueryRow(ctx, query, item.EntityID).Scan(&ok)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrTrashItemNotFound
+	}
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("%w: restore the %s first", ErrTrashRestoreBlocked, parent)
+	}
+	return nil
+}
+
+// PurgeTrashItem удаляет сущность корзины и её дочерние строки окончательно
+func PurgeTrashItem(ctx context.Context, id string) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	item, err := scanTrashItem(tx.QueryRow(ctx, `SELECT `+trashColumns+` FROM crm_trash WHERE id = $1 FOR UPDATE`, id))
+	if err != nil {
+		return err
+	}
+	// У активностей нет внешних ключей: удаляем и помеченные, и все активности удаляемых клиентов и сделок
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM activities a
+		WHERE a.deletion_id = $1
+		   OR (a.entity_type = 'deal' AND a.entity_id::text IN (SELECT id::text FROM crm_deals WHERE deletion_id = $1))
+		   OR (a.entity_type = 'deal' AND a.entity_id::text IN (
+		           SELECT d.id::text FROM crm_deals d JOIN crm_customers c ON c.id = d.customer_id WHERE c.deletion_id = $1))
+		   OR (a.entity_type = 'customer' AND a.entity_id::text IN (SELECT id::text FROM crm_customers WHERE deletion_id = $1))
+	`, id); err != nil {
+		return err
+	}
+	for _, table := range []string{"deal_attachments", "crm_deals", "crm_customers", "tags"} {
+		if _, err := tx.Exec(ctx, `DELETE FROM `+table+` WHERE deletion_id = $1`, id); err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM crm_trash WHERE id = $1`, item.ID); err != nil {
+		return err
+	}
+	// Записи корзины, чьи сущности ушли каскадом вместе с этой (сделки клиента, удалённые раньше него)
+	if _, err := tx.Exec(ctx, `
+		DELETE FROM crm_trash t WHERE
+		   (t.entity_type = 'deal' AND NOT EXISTS (SELECT 1 FROM crm_deals d WHERE d.id = t.entity_id))
+		OR (t.entity_type = 'attachment' AND NOT EXISTS (SELECT 1 FROM deal_attachments a WHERE a.id = t.entity_id))
+		OR (t.entity_type = 'activity' AND NOT EXISTS (SELECT 1 FROM activities a WHERE a.id::text = t.entity_id::text))
+	`); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ExpiredTrashItems возвращает ID записей корзины, удалённых раньше before
+func ExpiredTrashItems(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT id::text FROM crm_trash WHERE deleted_at < $1 ORDER BY deleted_at LIMIT $2
+	`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
@@ -0,0 +1,517 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Пользовательские поля клиентов и сделок. Схема (тип, варианты, обязательность)
+// хранится в crm_custom_fields, значения – в JSONB-колонке custom_fields сущности
+// в нормализованном виде: number – число, date – строка YYYY-MM-DD,
+// multi_select – массив строк, остальные типы – строка.
+
+var (
+	ErrCustomFieldNotFound = errors.New("custom field not found")
+	ErrInvalidCustomField  = errors.New("invalid custom field")
+)
+
+// invalidFieldf – ошибка валидации схемы или значения, распознаётся через errors.Is(err, ErrInvalidCustomField)
+func invalidFieldf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidCustomField}, args...)...)
+}
+
+const (
+	CustomFieldEntityCustomer = "customer"
+	CustomFieldEntityDeal     = "deal"
+)
+
+const (
+	CustomFieldText        = "text"
+	CustomFieldNumber      = "number"
+	CustomFieldDate        = "date"
+	CustomFieldSelect      = "select"
+	CustomFieldMultiSelect = "multi_select"
+	CustomFieldUser        = "user"
+	CustomFieldURL         = "url"
+)
+
+var customFieldTypes = map[string]bool{
+	CustomFieldText: true, CustomFieldNumber: true, CustomFieldDate: true, CustomFieldSelect: true,
+	CustomFieldMultiSelect: true, CustomFieldUser: true, CustomFieldURL: true,
+}
+
+// Ключ подставляется в SQL как литерал (фильтры, сортировка), поэтому набор символов жёстко ограничен
+var customFieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+
+const customFieldTextMaxLen = 2000
+
+// CustomField – описание пользовательского поля
+type CustomField struct {
+	ID         string    `json:"id"`
+	EntityType string    `json:"entity_type"`
+	Key        string    `json:"key"`
+	Label      string    `json:"label"`
+	FieldType  string    `json:"field_type"`
+	Options    []string  `json:"options"`
+	Required   bool      `json:"required"`
+	SortOrder  int       `json:"sort_order"`
+	CreatedAt  time.Time `json:"created_at"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+// IsCustomFieldEntity – поддерживает ли сущность пользовательские поля
+func IsCustomFieldEntity(entityType string) bool {
+	return entityType == CustomFieldEntityCustomer || entityType == CustomFieldEntityDeal
+}
+
+// Validate проверяет описание поля перед сохранением
+func (f *CustomField) Validate() error {
+	if !IsCustomFieldEntity(f.EntityType) {
+		return invalidFieldf("entity_type must be customer or deal")
+	}
+	if !customFieldKeyPattern.MatchString(f.Key) {
+		return invalidFieldf("key %q must match %s", f.Key, customFieldKeyPattern)
+	}
+	if strings.TrimSpace(f.Label) == "" {
+		return invalidFieldf("field %s: label is required", f.Key)
+	}
+	if !customFieldTypes[f.FieldType] {
+		return invalidFieldf("field %s: unknown type %q", f.Key, f.FieldType)
+	}
+	if f.FieldType == CustomFieldSelect || f.FieldType == CustomFieldMultiSelect {
+		if len(f.Options) == 0 {
+			return invalidFieldf("field %s: options are required for %s", f.Key, f.FieldType)
+		}
+		seen := make(map[string]bool, len(f.Options))
+		for _, o := range f.Options {
+			if strings.TrimSpace(o) == "" || seen[o] {
+				return invalidFieldf("field %s: options must be unique and non-empty", f.Key)
+			}
+			seen[o] = true
+		}
+	} else if len(f.Options) > 0 {
+		return invalidFieldf("field %s: options are only allowed for select and multi_select", f.Key)
+	}
+	return nil
+}
+
+func (f *CustomField) hasOption(v string) bool {
+	for _, o := range f.Options {
+		if o == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Normalize приводит значение из JSON к типу поля. Пустое значение (nil, "", [])
+// возвращается как nil – такое поле просто не хранится
+func (f *CustomField) Normalize(ctx context.Context, raw interface{}) (interface{}, error) {
+	if raw == nil {
+		return nil, nil
+	}
+	if s, ok := raw.(string); ok {
+		raw = strings.TrimSpace(s)
+		if raw == "" {
+			return nil, nil
+		}
+	}
+
+	switch f.FieldType {
+	case CustomFieldText:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalidFieldf("%s: expected a string", f.Key)
+		}
+		if len([]rune(s)) > customFieldTextMaxLen {
+			return nil, invalidFieldf("%s: text is longer than %d characters", f.Key, customFieldTextMaxLen)
+		}
+		return s, nil
+
+	case CustomFieldNumber:
+		switch v := raw.(type) {
+		case float64:
+			return v, nil
+		case json.Number:
+			n, err := v.Float64()
+			if err != nil {
+				return nil, invalidFieldf("%s: %q is not a number", f.Key, v)
+			}
+			return n, nil
+		case string:
+			n, err := strconv.ParseFloat(strings.Replace(v, ",", ".", 1), 64)
+			if err != nil {
+				return nil, invalidFieldf("%s: %q is not a number", f.Key, v)
+			}
+			return n, nil
+		}
+		return nil, invalidFieldf("%s: expected a number", f.Key)
+
+	case CustomFieldDate:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalidFieldf("%s: expected a date string", f.Key)
+		}
+		d, err := ParseCustomFieldDate(s)
+		if err != nil {
+			return nil, invalidFieldf("%s: %q is not a date (YYYY-MM-DD)", f.Key, s)
+		}
+		return d.Format("2006-01-02"), nil
+
+	case CustomFieldSelect:
+		s, ok := raw.(string)
+		if !ok || !f.hasOption(s) {
+			return nil, invalidFieldf("%s: value must be one of %s", f.Key, strings.Join(f.Options, ", "))
+		}
+		return s, nil
+
+	case CustomFieldMultiSelect:
+		var items []interface{}
+		switch v := raw.(type) {
+		case []interface{}:
+			items = v
+		case []string:
+			for _, s := range v {
+				items = append(items, s)
+			}
+		case string:
+			items = []interface{}{v}
+		default:
+			return nil, invalidFieldf("%s: expected an array of strings", f.Key)
+		}
+		values := []string{}
+		seen := make(map[string]bool)
+		for _, item := range items {
+			s, ok := item.(string)
+			if !ok || !f.hasOption(s) {
+				return nil, invalidFieldf("%s: values must be from %s", f.Key, strings.Join(f.Options, ", "))
+			}
+			if !seen[s] {
+				seen[s] = true
+				values = append(values, s)
+			}
+		}
+		if len(values) == 0 {
+			return nil, nil
+		}
+		return values, nil
+
+	case CustomFieldUser:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalidFieldf("%s: expected a user id", f.Key)
+		}
+		if _, err := uuid.Parse(s); err != nil {
+			return nil, invalidFieldf("%s: %q is not a user id", f.Key, s)
+		}
+		var exists bool
+		err := database.Pool.QueryRow(ctx, `SELECT EXISTS(SELECT 1 FROM users WHERE id = $1)`, s).Scan(&exists)
+		if err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, invalidFieldf("%s: user %s not found", f.Key, s)
+		}
+		return s, nil
+
+	case CustomFieldURL:
+		s, ok := raw.(string)
+		if !ok {
+			return nil, invalidFieldf("%s: expected a URL", f.Key)
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return nil, invalidFieldf("%s: %q is not an http(s) URL", f.Key, s)
+		}
+		return s, nil
+	}
+	return nil, invalidFieldf("%s: unknown type %q", f.Key, f.FieldType)
+}
+
+// Format – значение поля для CSV/Excel
+func (f *CustomField) Format(v interface{}) string {
+	switch val := v.(type) {
+	case nil:
+		return ""
+	case float64:
+		return strconv.FormatFloat(val, 'f', -1, 64)
+	case []interface{}:
+		parts := make([]string, 0, len(val))
+		for _, item := range val {
+			parts = append(parts, fmt.Sprint(item))
+		}
+		return strings.Join(parts, ", ")
+	case []string:
+		return strings.Join(val, ", ")
+	}
+	return fmt.Sprint(v)
+}
+
+// ParseCustomFieldDate принимает YYYY-MM-DD или RFC3339 (берётся только дата)
+func ParseCustomFieldDate(s string) (time.Time, error) {
+	if d, err := time.Parse("2006-01-02", s); err == nil {
+		return d, nil
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC), nil
+}
+
+// ========== SQL: ФИЛЬТРЫ И СОРТИРОВКА ==========
+
+// valueSQL – выражение значения поля в колонке column (crm_customers.custom_fields и т.п.)
+// с приведением к типу, по которому имеет смысл сравнивать
+func (f *CustomField) valueSQL(column string) string {
+	switch f.FieldType {
+	case CustomFieldNumber:
+		return fmt.Sprintf("(%s->>'%s')::numeric", column, f.Key)
+	case CustomFieldDate:
+		return fmt.Sprintf("(%s->>'%s')::date", column, f.Key)
+	}
+	return fmt.Sprintf("(%s->>'%s')", column, f.Key)
+}
+
+// SortSQL – выражение для ORDER BY
+func (f *CustomField) SortSQL(column string) string {
+	return f.valueSQL(column)
+}
+
+// ========== CRUD ==========
+
+const customFieldColumns = `id, entity_type, key, label, field_type, options, required, sort_order, created_at, updated_at`
+
+func scanCustomField(row pgx.Row) (*CustomField, error) {
+	var f CustomField
+	var options []byte
+	err := row.Scan(&f.ID, &f.EntityType, &f.Key, &f.Label, &f.FieldType, &options,
+		&f.Required, &f.SortOrder, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	f.Options = []string{}
+	if len(options) > 0 {
+		if err := json.Unmarshal(options, &f.Options); err != nil {
+			return nil, err
+		}
+	}
+	return &f, nil
+}
+
+// ListCustomFields возвращает поля сущности в порядке отображения
+func ListCustomFields(ctx context.Context, entityType string) ([]*CustomField, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+customFieldColumns+`
+		FROM crm_custom_fields
+		WHERE entity_type = $1
+		ORDER BY sort_order, label
+	`, entityType)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	fields := []*CustomField{}
+	for rows.Next() {
+		f, err := scanCustomField(rows)
+		if err != nil {
+			return nil, err
+		}
+		fields = append(fields, f)
+	}
+	return fields, rows.Err()
+}
+
+// CustomFieldsByKey – схема сущности в виде map для валидации и фильтров
+func CustomFieldsByKey(ctx context.Context, entityType string) (map[string]*CustomField, error) {
+	fields, err := ListCustomFields(ctx, entityType)
+	if err != nil {
+		return nil, err
+	}
+	byKey := make(map[string]*CustomField, len(fields))
+	for _, f := range fields {
+		byKey[f.Key] = f
+	}
+	return byKey, nil
+}
+
+// GetCustomField возвращает поле по ID
+func GetCustomField(ctx context.Context, id string) (*CustomField, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrCustomFieldNotFound
+	}
+	f, err := scanCustomField(database.Pool.QueryRow(ctx,
+		`SELECT `+customFieldColumns+` FROM crm_custom_fields WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrCustomFieldNotFound
+	}
+	return f, err
+}
+
+// CreateCustomField создаёт поле; ключ уникален в пределах сущности
+func CreateCustomField(ctx context.Context, f *CustomField) error {
+	if f.Options == nil {
+		f.Options = []string{}
+	}
+	if err := f.Validate(); err != nil {
+		return err
+	}
+	var exists bool
+	err := database.Pool.QueryRow(ctx,
+		`SELECT EXISTS(SELECT 1 FROM crm_custom_fields WHERE entity_type = $1 AND key = $2)`,
+		f.EntityType, f.Key).Scan(&exists)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return invalidFieldf("field %s already exists for %s", f.Key, f.EntityType)
+	}
+
+	options, _ := json.Marshal(f.Options)
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_custom_fields (entity_type, key, label, field_type, options, required, sort_order)
+		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		RETURNING id, created_at, updated_at
+	`, f.EntityType, f.Key, f.Label, f.FieldType, options, f.Required, f.SortOrder).
+		Scan(&f.ID, &f.CreatedAt, &f.UpdatedAt)
+}
+
+// UpdateCustomField меняет подпись, варианты, обязательность и порядок.
+// Сущность, ключ и тип не меняются – иначе сохранённые значения перестали бы им соответствовать.
+// Удалённые варианты select / multi_select вычищаются из значений.
+func UpdateCustomField(ctx context.Context, f *CustomField) error {
+	if f.Options == nil {
+		f.Options = []string{}
+	}
+	if err := f.Validate(); err != nil {
+		return err
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	options, _ := json.Marshal(f.Options)
+	err = tx.QueryRow(ctx, `
+		UPDATE crm_custom_fields
+		SET label = $2, options = $3, required = $4, sort_order = $5, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, f.ID, f.Label, options, f.Required, f.SortOrder).Scan(&f.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrCustomFieldNotFound
+	}
+	if err != nil {
+		return err
+	}
+
+	table := CRMEntityTable(f.EntityType)
+	switch f.FieldType {
+	case CustomFieldSelect:
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+			UPDATE %[1]s SET custom_fields = custom_fields - '%[2]s'
+			WHERE custom_fields ? '%[2]s' AND NOT ($1::jsonb ? (custom_fields->>'%[2]s'))
+		`, table, f.Key), options)
+	case CustomFieldMultiSelect:
+		_, err = tx.Exec(ctx, fmt.Sprintf(`
+			UPDATE %[1]s SET custom_fields = jsonb_set(custom_fields, '{%[2]s}', COALESCE((
+				SELECT jsonb_agg(v) FROM jsonb_array_elements_text(custom_fields->'%[2]s') v
+				WHERE $1::jsonb ? v
+			), '[]'::jsonb))
+			WHERE jsonb_typeof(custom_fields->'%[2]s') = 'array'
+				AND NOT ($1::jsonb @> (custom_fields->'%[2]s'))
+		`, table, f.Key), options)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// DeleteCustomField удаляет поле вместе со значениями у всех записей
+func DeleteCustomField(ctx context.Context, f *CustomField) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	tag, err := tx.Exec(ctx, `DELETE FROM crm_custom_fields WHERE id = $1`, f.ID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrCustomFieldNotFound
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf(
+		`UPDATE %s SET custom_fields = custom_fields - $1::text WHERE custom_fields ? $1::text`,
+		CRMEntityTable(f.EntityType)), f.Key)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// CRMEntityTable – таблица сущности CRM (customer -> crm_customers, deal -> crm_deals)
+func CRMEntityTable(entityType string) string {
+	if entityType == CustomFieldEntityDeal {
+		return "crm_deals"
+	}
+	return "crm_customers"
+}
+
+// ========== ЗНАЧЕНИЯ ==========
+
+// ApplyCustomFieldValues накладывает patch на текущие значения записи (current – nil для новой):
+// ключи из patch проверяются по схеме и нормализуются, null или пустое значение удаляет ключ.
+// После слияния проверяются обязательные поля. Возвращает итоговые значения для сохранения.
+func ApplyCustomFieldValues(ctx context.Context, entityType string, current, patch map[string]interface{}) (map[string]interface{}, error) {
+	schema, err := CustomFieldsByKey(ctx, entityType)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]interface{}, len(current)+len(patch))
+	for k, v := range current {
+		// значения удалённых из схемы полей не переносим
+		if _, ok := schema[k]; ok {
+			result[k] = v
+		}
+	}
+	for k, raw := range patch {
+		f, ok := schema[k]
+		if !ok {
+			return nil, invalidFieldf("unknown field %q", k)
+		}
+		v, err := f.Normalize(ctx, raw)
+		if err != nil {
+			return nil, err
+		}
+		if v == nil {
+			delete(result, k)
+		} else {
+			result[k] = v
+		}
+	}
+	for k, f := range schema {
+		if _, ok := result[k]; f.Required && !ok {
+			return nil, invalidFieldf("field %s (%s) is required", k, f.Label)
+		}
+	}
+	return result, nil
+}
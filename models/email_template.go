@@ -0,0 +1,233 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Шаблоны писем CRM с полями подстановки {customer.name}, {deal.title}, ...
+// Общие шаблоны (user_id NULL) создаёт администратор, свои – любой пользователь.
+
+var (
+	ErrEmailTemplateNotFound = errors.New("email template not found")
+	ErrInvalidEmailTemplate  = errors.New("invalid email template")
+)
+
+const (
+	emailTemplateNameMaxLen    = 255
+	emailTemplateSubjectMaxLen = 500
+	emailTemplateBodyMaxLen    = 200000
+)
+
+// EmailMergeFields – поля подстановки, доступные в теме и тексте шаблона
+var EmailMergeFields = []string{
+	"customer.name", "customer.email", "customer.company", "customer.phone",
+	"deal.title", "deal.value", "deal.stage",
+	"user.name", "user.email",
+}
+
+var emailMergeFieldRe = regexp.MustCompile(`\{([a-z]+\.[a-z_]+)\}`)
+
+// EmailTemplate – шаблон письма
+type EmailTemplate struct {
+	ID        string    `json:"id"`
+	UserID    *string   `json:"user_id,omitempty"`
+	Shared    bool      `json:"shared"`
+	Name      string    `json:"name"`
+	Subject   string    `json:"subject"`
+	Body      string    `json:"body"` // HTML
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// CanView – общие шаблоны видят все, свои – владелец и администратор
+func (t *EmailTemplate) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || t.UserID == nil || *t.UserID == userID
+}
+
+// CanEdit – общие шаблоны меняет только администратор
+func (t *EmailTemplate) CanEdit(userID string, isAdmin bool) bool {
+	return isAdmin || (t.UserID != nil && *t.UserID == userID)
+}
+
+// Normalize проверяет шаблон; неизвестные поля подстановки считаются ошибкой
+func (t *EmailTemplate) Normalize() error {
+	t.Name = strings.TrimSpace(t.Name)
+	if t.Name == "" || len([]rune(t.Name)) > emailTemplateNameMaxLen {
+		return fmt.Errorf("%w: name is required (up to %d characters)", ErrInvalidEmailTemplate, emailTemplateNameMaxLen)
+	}
+	t.Subject = strings.TrimSpace(t.Subject)
+	if t.Subject == "" || len([]rune(t.Subject)) > emailTemplateSubjectMaxLen || strings.ContainsAny(t.Subject, "\r\n") {
+		return fmt.Errorf("%w: subject is required (one line, up to %d characters)", ErrInvalidEmailTemplate, emailTemplateSubjectMaxLen)
+	}
+	if strings.TrimSpace(t.Body) == "" || len(t.Body) > emailTemplateBodyMaxLen {
+		return fmt.Errorf("%w: body is required (up to %d bytes)", ErrInvalidEmailTemplate, emailTemplateBodyMaxLen)
+	}
+	for _, m := range emailMergeFieldRe.FindAllStringSubmatch(t.Subject+t.Body, -1) {
+		if !containsString(EmailMergeFields, m[1]) {
+			return fmt.Errorf("%w: unknown merge field {%s}", ErrInvalidEmailTemplate, m[1])
+		}
+	}
+	return nil
+}
+
+const emailTemplateColumns = `id, user_id::text, name, subject, body, created_at, updated_at`
+
+func scanEmailTemplate(row pgx.Row) (*EmailTemplate, error) {
+	var t EmailTemplate
+	err := row.Scan(&t.ID, &t.UserID, &t.Name, &t.Subject, &t.Body, &t.CreatedAt, &t.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrEmailTemplateNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	t.Shared = t.UserID == nil
+	return &t, nil
+}
+
+// ListEmailTemplates возвращает общие и свои шаблоны: сначала общие
+func ListEmailTemplates(ctx context.Context, userID string) ([]*EmailTemplate, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+emailTemplateColumns+` FROM crm_email_templates
+		WHERE user_id IS NULL OR user_id::text = $1
+		ORDER BY user_id NULLS FIRST, name
+	`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []*EmailTemplate{}
+	for rows.Next() {
+		t, err := scanEmailTemplate(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, t)
+	}
+	return list, rows.Err()
+}
+
+// GetEmailTemplate возвращает шаблон по ID
+func GetEmailTemplate(ctx context.Context, id string) (*EmailTemplate, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrEmailTemplateNotFound
+	}
+	return scanEmailTemplate(database.Pool.QueryRow(ctx, `SELECT `+emailTemplateColumns+` FROM crm_email_templates WHERE id = $1`, id))
+}
+
+// CreateEmailTemplate сохраняет новый шаблон (после Normalize)
+func CreateEmailTemplate(ctx context.Context, t *EmailTemplate) error {
+	t.Shared = t.UserID == nil
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_email_templates (user_id, name, subject, body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at
+	`, t.UserID, t.Name, t.Subject, t.Body).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+}
+
+// UpdateEmailTemplate сохраняет изменения шаблона (после Normalize); владелец не меняется
+func UpdateEmailTemplate(ctx context.Context, t *EmailTemplate) error {
+	err := database.Pool.QueryRow(ctx, `
+		UPDATE crm_email_templates SET name = $2, subject = $3, body = $4, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, t.ID, t.Name, t.Subject, t.Body).Scan(&t.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrEmailTemplateNotFound
+	}
+	return err
+}
+
+// DeleteEmailTemplate удаляет шаблон; отправленные по нему письма остаются
+func DeleteEmailTemplate(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_email_templates WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrEmailTemplateNotFound
+	}
+	return nil
+}
+
+// EmailMergeData – значения полей подстановки для конкретного письма
+type EmailMergeData map[string]string
+
+// LoadEmailMergeData собирает значения полей: клиент, сделка (если указана) и отправитель.
+// Удалённые в корзину клиент и сделка не подставляются.
+func LoadEmailMergeData(ctx context.Context, customerID, dealID, userID string) (EmailMergeData, error) {
+	data := EmailMergeData{}
+	for _, f := range EmailMergeFields {
+		data[f] = ""
+	}
+	if customerID != "" {
+		var name, email, company, phone *string
+		err := database.Pool.QueryRow(ctx, `
+			SELECT name, email, company, phone FROM crm_customers WHERE id::text = $1 AND deleted_at IS NULL
+		`, customerID).Scan(&name, &email, &company, &phone)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		data["customer.name"], data["customer.email"] = derefString(name), derefString(email)
+		data["customer.company"], data["customer.phone"] = derefString(company), derefString(phone)
+	}
+	if dealID != "" {
+		var title, stage *string
+		var value *float64
+		err := database.Pool.QueryRow(ctx, `
+			SELECT title, value::float8, stage FROM crm_deals WHERE id::text = $1 AND deleted_at IS NULL
+		`, dealID).Scan(&title, &value, &stage)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		data["deal.title"], data["deal.stage"] = derefString(title), derefString(stage)
+		if value != nil {
+			data["deal.value"] = strconv.FormatFloat(*value, 'f', 2, 64)
+		}
+	}
+	if userID != "" {
+		var name, email *string
+		err := database.Pool.QueryRow(ctx, `SELECT name, email FROM users WHERE id::text = $1`, userID).Scan(&name, &email)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+		data["user.name"], data["user.email"] = derefString(name), derefString(email)
+	}
+	return data, nil
+}
+
+// RenderEmail подставляет значения полей: в тему – как есть, в HTML-текст – с экранированием
+func RenderEmail(subject, body string, data EmailMergeData) (string, string) {
+	subject = emailMergeFieldRe.ReplaceAllStringFunc(subject, func(m string) string {
+		if v, ok := data[m[1:len(m)-1]]; ok {
+			return strings.NewReplacer("\r", " ", "\n", " ").Replace(v)
+		}
+		return m
+	})
+	body = emailMergeFieldRe.ReplaceAllStringFunc(body, func(m string) string {
+		if v, ok := data[m[1:len(m)-1]]; ok {
+			return html.EscapeString(v)
+		}
+		return m
+	})
+	return subject, body
+}
+
+func derefString(s *string) string {
+	if s == nil {
+		return ""
+	}
+	return *s
+}
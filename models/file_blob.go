@@ -0,0 +1,154 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Реестр содержимого файлового хранилища. Одинаковые файлы хранятся один раз: запись адресуется
+// по SHA-256, а вложения, аудио, документы и файлы импорта ссылаются на неё колонкой file_hash. Счётчика ссылок нет –
+// содержимое без ссылок удаляет фоновая очистка, поэтому каскадные удаления сделок ничего не «теряют».
+
+var ErrFileBlobNotFound = errors.New("file blob not found")
+
+// fileBlobRefs – таблицы, ссылающиеся на содержимое по file_hash
+var fileBlobRefs = []string{"deal_attachments", "audio_transcriptions", "knowledge_docs", "crm_import_jobs"}
+
+// FileBlob – содержимое в хранилище
+type FileBlob struct {
+	SHA256       string    `json:"sha256"`
+	StorageKey   string    `json:"-"`
+	Size         int64     `json:"size"`
+	MimeType     string    `json:"mime_type"`
+	ThumbnailKey *string   `json:"-"`
+	CreatedAt    time.Time `json:"created_at"`
+	LastUsedAt   time.Time `json:"last_used_at"`
+}
+
+const fileBlobColumns = `sha256, storage_key, size, mime_type, thumbnail_key, created_at, last_used_at`
+
+func scanFileBlob(row pgx.Row) (*FileBlob, error) {
+	var b FileBlob
+	err := row.Scan(&b.SHA256, &b.StorageKey, &b.Size, &b.MimeType, &b.ThumbnailKey, &b.CreatedAt, &b.LastUsedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrFileBlobNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &b, nil
+}
+
+// GetFileBlob возвращает содержимое по хешу
+func GetFileBlob(ctx context.Context, sha256 string) (*FileBlob, error) {
+	return scanFileBlob(database.Pool.QueryRow(ctx, `SELECT `+fileBlobColumns+` FROM file_blobs WHERE sha256 = $1`, sha256))
+}
+
+// TouchFileBlob отмечает повторное использование содержимого, чтобы очистка его не забрала.
+// ErrFileBlobNotFound – содержимого ещё нет (или его только что удалила очистка), его нужно записать.
+func TouchFileBlob(ctx context.Context, sha256 string) (*FileBlob, error) {
+	return scanFileBlob(database.Pool.QueryRow(ctx, `
+		UPDATE file_blobs SET last_used_at = NOW() WHERE sha256 = $1
+		RETURNING `+fileBlobColumns, sha256))
+}
+
+// SaveFileBlob регистрирует записанное в хранилище содержимое
+func SaveFileBlob(ctx context.Context, b *FileBlob) error {
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO file_blobs (sha256, storage_key, size, mime_type)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (sha256) DO UPDATE SET last_used_at = NOW()
+		RETURNING thumbnail_key, created_at, last_used_at
+	`, b.SHA256, b.StorageKey, b.Size, b.MimeType).Scan(&b.ThumbnailKey, &b.CreatedAt, &b.LastUsedAt)
+}
+
+// SetFileBlobThumbnail запоминает ключ миниатюры изображения
+func SetFileBlobThumbnail(ctx context.Context, sha256, key string) error {
+	_, err := database.Pool.Exec(ctx, `UPDATE file_blobs SET thumbnail_key = $2 WHERE sha256 = $1`, sha256, key)
+	return err
+}
+
+// orphanFileBlobCond – условие «на содержимое b никто не ссылается» по существующим таблицам
+// (audio_transcriptions и knowledge_docs создаются вне миграций и могут отсутствовать)
+func orphanFileBlobCond(ctx context.Context, q interface {
+	QueryRow(context.Context, string, ...any) pgx.Row
+}) (string, error) {
+	cond := "TRUE"
+	for _, table := range fileBlobRefs {
+		var exists bool
+		if err := q.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, table).Scan(&exists); err != nil {
+			return "", err
+		}
+		if exists {
+			cond += ` AND NOT EXISTS (SELECT 1 FROM ` + table + ` r WHERE r.file_hash = b.sha256)`
+		}
+	}
+	return cond, nil
+}
+
+// OrphanFileBlobs возвращает хеши содержимого без ссылок, не использовавшегося с before
+func OrphanFileBlobs(ctx context.Context, before time.Time, limit int) ([]string, error) {
+	cond, err := orphanFileBlobCond(ctx, database.Pool)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT b.sha256 FROM file_blobs b
+		WHERE b.last_used_at < $1 AND `+cond+`
+		ORDER BY b.last_used_at
+		LIMIT $2
+	`, before, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	hashes := []string{}
+	for rows.Next() {
+		var h string
+		if err := rows.Scan(&h); err != nil {
+			return nil, err
+		}
+		hashes = append(hashes, h)
+	}
+	return hashes, rows.Err()
+}
+
+// DeleteOrphanFileBlob удаляет содержимое, если на него по-прежнему никто не ссылается и его не
+// использовали с before. remove (удаление объектов из хранилища) вызывается под блокировкой строки:
+// параллельная загрузка того же файла ждёт в TouchFileBlob и затем записывает содержимое заново.
+// false – содержимое снова в деле, ничего не удалено.
+func DeleteOrphanFileBlob(ctx context.Context, sha256 string, before time.Time, remove func(*FileBlob) error) (bool, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback(ctx)
+
+	cond, err := orphanFileBlobCond(ctx, tx)
+	if err != nil {
+		return false, err
+	}
+	b, err := scanFileBlob(tx.QueryRow(ctx, `
+		SELECT `+fileBlobColumns+` FROM file_blobs b
+		WHERE b.sha256 = $1 AND b.last_used_at < $2 AND `+cond+`
+		FOR UPDATE
+	`, sha256, before))
+	if errors.Is(err, ErrFileBlobNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if err := remove(b); err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM file_blobs WHERE sha256 = $1`, sha256); err != nil {
+		return false, err
+	}
+	return true, tx.Commit(ctx)
+}
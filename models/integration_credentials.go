@@ -0,0 +1,130 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+
+	"subscription-system/database"
+	"subscription-system/internal/secrets"
+)
+
+// IntegrationProviders – интеграции, учётные данные которых можно хранить в БД
+var IntegrationProviders = map[string][]string{
+	"onec":     {"base_url", "login", "password", "database"},
+	"bitrix24": {"webhook_url", "client_id", "client_secret", "portal"},
+}
+
+// IntegrationCredentialInfo – сведения об учётных данных без самих значений
+type IntegrationCredentialInfo struct {
+	Provider  string    `json:"provider"`
+	Fields    []string  `json:"fields"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// SaveIntegrationCredentials шифрует и сохраняет учётные данные интеграции
+func SaveIntegrationCredentials(ctx context.Context, provider string, creds map[string]string, updatedBy string) error {
+	allowed, ok := IntegrationProviders[provider]
+	if !ok {
+		return fmt.Errorf("unknown integration provider: %s", provider)
+	}
+	for field := range creds {
+		if !containsString(allowed, field) {
+			return fmt.Errorf("unknown field %s for provider %s", field, provider)
+		}
+	}
+
+	plaintext, err := json.Marshal(creds)
+	if err != nil {
+		return err
+	}
+	encCreds, err := secrets.Encrypt(plaintext)
+	if err != nil {
+		return err
+	}
+
+	var updater interface{}
+	if updatedBy != "" {
+		updater = updatedBy
+	}
+	_, err = database.Pool.Exec(ctx, `
+		INSERT INTO integration_credentials (provider, credentials_enc, updated_by, updated_at)
+		VALUES ($1, $2, $3, NOW())
+		ON CONFLICT (provider)
+		DO UPDATE SET credentials_enc = $2, updated_by = $3, updated_at = NOW()
+	`, provider, encCreds, updater)
+	return err
+}
+
+// GetIntegrationCredentials возвращает расшифрованные учётные данные интеграции
+func GetIntegrationCredentials(ctx context.Context, provider string) (map[string]string, error) {
+	var encCreds string
+	err := database.Pool.QueryRow(ctx,
+		`SELECT credentials_enc FROM integration_credentials WHERE provider = $1`, provider).Scan(&encCreds)
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := secrets.Decrypt(encCreds)
+	if err != nil {
+		return nil, err
+	}
+	creds := make(map[string]string)
+	if err := json.Unmarshal(plaintext, &creds); err != nil {
+		return nil, err
+	}
+	return creds, nil
+}
+
+// ListIntegrationCredentials возвращает список сохранённых интеграций и заполненных полей
+func ListIntegrationCredentials(ctx context.Context) ([]IntegrationCredentialInfo, error) {
+	rows, err := database.Pool.Query(ctx,
+		`SELECT provider, updated_at FROM integration_credentials ORDER BY provider`)
+	if err != nil {
+		return nil, err
+	}
+	var infos []IntegrationCredentialInfo
+	for rows.Next() {
+		var info IntegrationCredentialInfo
+		if err := rows.Scan(&info.Provider, &info.UpdatedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		infos = append(infos, info)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	for i := range infos {
+		creds, err := GetIntegrationCredentials(ctx, infos[i].Provider)
+		if err != nil {
+			return nil, err
+		}
+		infos[i].Fields = make([]string, 0, len(creds))
+		for field, value := range creds {
+			if value != "" {
+				infos[i].Fields = append(infos[i].Fields, field)
+			}
+		}
+		sort.Strings(infos[i].Fields)
+	}
+	return infos, nil
+}
+
+// DeleteIntegrationCredentials удаляет учётные данные интеграции
+func DeleteIntegrationCredentials(ctx context.Context, provider string) error {
+	_, err := database.Pool.Exec(ctx, `DELETE FROM integration_credentials WHERE provider = $1`, provider)
+	return err
+}
+
+func containsString(list []string, value string) bool {
+	for _, item := range list {
+		if item == value {
+			return true
+		}
+	}
+	return false
+}
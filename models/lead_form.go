@@ -0,0 +1,1120 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Захват лидов: формы на сайтах владельца рабочего пространства (user_id формы), заявка на услуги
+// и AI-консультант сводятся в один поток – заявка в lead_submissions, клиент в crm_customers
+// (новый или найденный по email/телефону), ответственный и, если настроено, сделка в воронке.
+
+var (
+	ErrLeadFormNotFound = errors.New("lead form not found")
+	ErrInvalidLeadForm  = errors.New("invalid lead form")
+	ErrInvalidLead      = errors.New("invalid lead")
+)
+
+func invalidLeadFormf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidLeadForm}, args...)...)
+}
+
+func invalidLeadf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidLead}, args...)...)
+}
+
+// Каналы заявок
+const (
+	LeadChannelForm           = "form"
+	LeadChannelServiceRequest = "service_request"
+	LeadChannelConsultant     = "consultant"
+)
+
+// LeadInternalChannels – каналы без своей формы; форма может принимать их заявки (channels)
+var LeadInternalChannels = []string{LeadChannelServiceRequest, LeadChannelConsultant}
+
+// Статусы заявки
+const (
+	LeadStatusCreated = "created" // создан новый клиент
+	LeadStatusMatched = "matched" // заявка привязана к существующему клиенту
+	LeadStatusSpam    = "spam"
+	LeadStatusInvalid = "invalid" // перенесённую заявку не удалось принять (нет контакта), причина в error
+)
+
+// Способы назначения ответственного
+const (
+	LeadAssignOwner      = "owner"       // владелец формы
+	LeadAssignRoundRobin = "round_robin" // по очереди из user_ids
+	LeadAssignRules      = "rules"       // первое сработавшее правило, иначе по очереди из user_ids
+)
+
+const (
+	// LeadHoneypotField – скрытое поле формы: человек его не видит, бот заполняет
+	LeadHoneypotField = "_hp"
+	// LeadPlaceholderEmailDomain – email в crm_customers обязателен; лиду без почты
+	// выдаётся адрес в зарезервированной зоне .invalid, на который ничего не отправить
+	LeadPlaceholderEmailDomain = "no-email.invalid"
+	// LeadCustomTargetPrefix – target поля формы "custom.<key>" пишет в пользовательское поле клиента
+	LeadCustomTargetPrefix = "custom."
+	// LeadDefaultRateLimit – заявок в час с одного IP на форму по умолчанию
+	LeadDefaultRateLimit = 10
+	leadValueMaxLen      = 2000
+)
+
+// IsPlaceholderLeadEmail – адрес выдан лиду без почты и не годится для документов и рассылок
+func IsPlaceholderLeadEmail(email string) bool {
+	return strings.HasSuffix(email, "@"+LeadPlaceholderEmailDomain)
+}
+
+// LeadCustomerTargets – поля клиента, в которые можно направить поле формы
+var LeadCustomerTargets = []string{"name", "email", "phone", "company", "city", "comment", "notes", "telegram"}
+
+// LeadUTMParams – метки, которые сохраняются с заявкой и попадают в источник клиента
+var LeadUTMParams = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+var (
+	leadFieldNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,49}$`)
+	leadFieldTypes       = []string{"text", "email", "tel", "textarea", "select", "checkbox", "hidden"}
+)
+
+// LeadFormField – поле формы. Target – куда значение пишется у клиента; пусто – в комментарий
+type LeadFormField struct {
+	Name     string   `json:"name"`
+	Label    string   `json:"label"`
+	Type     string   `json:"type"`
+	Required bool     `json:"required"`
+	Options  []string `json:"options,omitempty"`
+	Target   string   `json:"target,omitempty"`
+}
+
+// LeadAssignmentRule – правило назначения: значение поля формы (или UTM-метки) равно/содержит Value
+type LeadAssignmentRule struct {
+	Field  string `json:"field"`
+	Op     string `json:"op"` // equals, contains
+	Value  string `json:"value"`
+	UserID string `json:"user_id"`
+}
+
+func (r LeadAssignmentRule) matches(values map[string]string) bool {
+	v := strings.ToLower(strings.TrimSpace(values[r.Field]))
+	want := strings.ToLower(r.Value)
+	if r.Op == "contains" {
+		return v != "" && strings.Contains(v, want)
+	}
+	return v == want
+}
+
+// LeadAssignment – настройка автоназначения ответственного
+type LeadAssignment struct {
+	Mode    string               `json:"mode"`
+	UserIDs []string             `json:"user_ids,omitempty"`
+	Rules   []LeadAssignmentRule `json:"rules,omitempty"`
+}
+
+// Assignees – все пользователи, которых форма может назначить
+func (a LeadAssignment) Assignees() []string {
+	ids := append([]string{}, a.UserIDs...)
+	for _, r := range a.Rules {
+		if !containsString(ids, r.UserID) {
+			ids = append(ids, r.UserID)
+		}
+	}
+	return ids
+}
+
+// LeadForm – форма захвата лидов рабочего пространства
+type LeadForm struct {
+	ID               string          `json:"id"`
+	UserID           string          `json:"user_id"`
+	Name             string          `json:"name"`
+	PublicKey        string          `json:"public_key"`
+	Fields           []LeadFormField `json:"fields"`
+	Source           string          `json:"source"`
+	Assignment       LeadAssignment  `json:"assignment"`
+	CreateDeal       bool            `json:"create_deal"`
+	PipelineID       *string         `json:"pipeline_id,omitempty"`
+	Stage            string          `json:"stage,omitempty"`
+	DealTitle        string          `json:"deal_title,omitempty"`
+	DealValue        float64         `json:"deal_value"`
+	Channels         []string        `json:"channels"`
+	AllowedOrigins   []string        `json:"allowed_origins"`
+	RateLimitPerHour int             `json:"rate_limit_per_hour"`
+	SuccessMessage   string          `json:"success_message,omitempty"`
+	RedirectURL      string          `json:"redirect_url,omitempty"`
+	Active           bool            `json:"active"`
+	CreatedAt        time.Time       `json:"created_at"`
+	UpdatedAt        time.Time       `json:"updated_at"`
+	// Заявок за последние 30 дней (без спама)
+	Submissions int `json:"submissions"`
+}
+
+// Normalize проверяет настройки формы. Пользователи и воронка проверяются отдельно – нужна БД.
+func (f *LeadForm) Normalize() error {
+	f.Name = strings.TrimSpace(f.Name)
+	if f.Name == "" || len(f.Name) > 255 {
+		return invalidLeadFormf("name is required and must be at most 255 characters")
+	}
+	if len(f.Fields) == 0 {
+		return invalidLeadFormf("fields are required")
+	}
+	seen := make(map[string]bool, len(f.Fields))
+	contact := false
+	for i := range f.Fields {
+		field := &f.Fields[i]
+		field.Name = strings.TrimSpace(field.Name)
+		field.Label = strings.TrimSpace(field.Label)
+		if !leadFieldNamePattern.MatchString(field.Name) || containsString(LeadUTMParams, field.Name) {
+			return invalidLeadFormf("field name %q must match %s and not be a UTM parameter", field.Name, leadFieldNamePattern)
+		}
+		if seen[field.Name] {
+			return invalidLeadFormf("duplicate field %q", field.Name)
+		}
+		seen[field.Name] = true
+		if field.Label == "" {
+			field.Label = field.Name
+		}
+		if field.Type == "" {
+			field.Type = "text"
+		}
+		if !containsString(leadFieldTypes, field.Type) {
+			return invalidLeadFormf("field %s: unknown type %q", field.Name, field.Type)
+		}
+		if field.Type == "select" && len(field.Options) == 0 {
+			return invalidLeadFormf("field %s: select needs options", field.Name)
+		}
+		if field.Target != "" && !containsString(LeadCustomerTargets, field.Target) &&
+			!(strings.HasPrefix(field.Target, LeadCustomTargetPrefix) && len(field.Target) > len(LeadCustomTargetPrefix)) {
+			return invalidLeadFormf("field %s: unknown target %q", field.Name, field.Target)
+		}
+		if field.Target == "email" || field.Target == "phone" || field.Target == "telegram" {
+			contact = true
+		}
+	}
+	if !contact {
+		return invalidLeadFormf("at least one field must target email, phone or telegram")
+	}
+
+	switch f.Assignment.Mode {
+	case "":
+		f.Assignment.Mode = LeadAssignOwner
+	case LeadAssignOwner:
+	case LeadAssignRoundRobin:
+		if len(f.Assignment.UserIDs) == 0 {
+			return invalidLeadFormf("round_robin assignment needs user_ids")
+		}
+	case LeadAssignRules:
+		if len(f.Assignment.Rules) == 0 {
+			return invalidLeadFormf("rules assignment needs rules")
+		}
+	default:
+		return invalidLeadFormf("assignment mode must be owner, round_robin or rules")
+	}
+	for i := range f.Assignment.Rules {
+		r := &f.Assignment.Rules[i]
+		if !seen[r.Field] && !containsString(LeadUTMParams, r.Field) {
+			return invalidLeadFormf("assignment rule: unknown field %q", r.Field)
+		}
+		if r.Op == "" {
+			r.Op = "equals"
+		}
+		if r.Op != "equals" && r.Op != "contains" {
+			return invalidLeadFormf("assignment rule: op must be equals or contains")
+		}
+	}
+	for _, id := range f.Assignment.Assignees() {
+		if _, err := uuid.Parse(id); err != nil {
+			return invalidLeadFormf("assignment: invalid user id %q", id)
+		}
+	}
+
+	if f.PipelineID != nil && *f.PipelineID == "" {
+		f.PipelineID = nil
+	}
+	f.DealTitle = strings.TrimSpace(f.DealTitle)
+	if f.DealValue < 0 {
+		return invalidLeadFormf("deal_value must not be negative")
+	}
+	for _, ch := range f.Channels {
+		if !containsString(LeadInternalChannels, ch) {
+			return invalidLeadFormf("unknown channel %q", ch)
+		}
+	}
+	if f.Channels == nil {
+		f.Channels = []string{}
+	}
+	for i, origin := range f.AllowedOrigins {
+		origin = strings.TrimRight(strings.TrimSpace(origin), "/")
+		if u, err := url.Parse(origin); origin != "*" && (err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "") {
+			return invalidLeadFormf("allowed origin %q must look like https://example.com", origin)
+		}
+		f.AllowedOrigins[i] = origin
+	}
+	if f.AllowedOrigins == nil {
+		f.AllowedOrigins = []string{}
+	}
+	if f.RateLimitPerHour < 0 || f.RateLimitPerHour > 10000 {
+		return invalidLeadFormf("rate_limit_per_hour must be between 0 and 10000")
+	}
+	if f.RedirectURL != "" {
+		if u, err := url.Parse(f.RedirectURL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return invalidLeadFormf("redirect_url must be an absolute http(s) URL")
+		}
+	}
+	return nil
+}
+
+// CanAccess – формой управляет владелец или администратор
+func (f *LeadForm) CanAccess(userID string, isAdmin bool) bool {
+	return isAdmin || f.UserID == userID
+}
+
+// AllowsOrigin – можно ли отправлять форму со страницы этого источника (пустой список – с любого)
+func (f *LeadForm) AllowsOrigin(origin string) bool {
+	if len(f.AllowedOrigins) == 0 {
+		return true
+	}
+	for _, allowed := range f.AllowedOrigins {
+		if allowed == "*" || strings.EqualFold(allowed, origin) {
+			return true
+		}
+	}
+	return false
+}
+
+// Field возвращает поле формы по имени
+func (f *LeadForm) Field(name string) (*LeadFormField, bool) {
+	for i := range f.Fields {
+		if f.Fields[i].Name == name {
+			return &f.Fields[i], true
+		}
+	}
+	return nil, false
+}
+
+func newLeadFormKey() (string, error) {
+	buf := make([]byte, 12)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "lf_" + hex.EncodeToString(buf), nil
+}
+
+const leadFormColumns = `f.id, f.user_id, f.name, f.public_key, f.fields, f.source, f.assignment, f.create_deal,
+	f.pipeline_id::text, f.stage, f.deal_title, f.deal_value, f.channels, f.allowed_origins, f.rate_limit_per_hour,
+	f.success_message, f.redirect_url, f.active, f.created_at, f.updated_at,
+	(SELECT COUNT(*) FROM lead_submissions s
+	 WHERE s.form_id = f.id AND s.status <> 'spam' AND s.created_at > NOW() - INTERVAL '30 days')`
+
+func scanLeadForm(row pgx.Row) (*LeadForm, error) {
+	var f LeadForm
+	var fields, assignment []byte
+	err := row.Scan(&f.ID, &f.UserID, &f.Name, &f.PublicKey, &fields, &f.Source, &assignment, &f.CreateDeal,
+		&f.PipelineID, &f.Stage, &f.DealTitle, &f.DealValue, &f.Channels, &f.AllowedOrigins, &f.RateLimitPerHour,
+		&f.SuccessMessage, &f.RedirectURL, &f.Active, &f.CreatedAt, &f.UpdatedAt, &f.Submissions)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrLeadFormNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(fields, &f.Fields); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(assignment, &f.Assignment); err != nil {
+		return nil, err
+	}
+	if f.Assignment.Mode == "" {
+		f.Assignment.Mode = LeadAssignOwner
+	}
+	return &f, nil
+}
+
+func queryLeadForms(ctx context.Context, where string, args ...interface{}) ([]*LeadForm, error) {
+	rows, err := database.Pool.Query(ctx, `SELECT `+leadFormColumns+` FROM lead_forms f `+where, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	forms := []*LeadForm{}
+	for rows.Next() {
+		f, err := scanLeadForm(rows)
+		if err != nil {
+			return nil, err
+		}
+		forms = append(forms, f)
+	}
+	return forms, rows.Err()
+}
+
+// ListLeadForms возвращает формы пользователя (администратору – все)
+func ListLeadForms(ctx context.Context, userID string, isAdmin bool) ([]*LeadForm, error) {
+	if isAdmin {
+		return queryLeadForms(ctx, `ORDER BY f.created_at`)
+	}
+	return queryLeadForms(ctx, `WHERE f.user_id = $1 ORDER BY f.created_at`, userID)
+}
+
+// GetLeadForm возвращает форму по ID
+func GetLeadForm(ctx context.Context, id string) (*LeadForm, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrLeadFormNotFound
+	}
+	return scanLeadForm(database.Pool.QueryRow(ctx, `SELECT `+leadFormColumns+` FROM lead_forms f WHERE f.id = $1`, id))
+}
+
+// GetLeadFormByKey возвращает активную форму по публичному ключу из кода встраивания
+func GetLeadFormByKey(ctx context.Context, key string) (*LeadForm, error) {
+	return scanLeadForm(database.Pool.QueryRow(ctx,
+		`SELECT `+leadFormColumns+` FROM lead_forms f WHERE f.public_key = $1 AND f.active`, key))
+}
+
+// LeadFormForChannel – активная форма, принимающая заявки внутреннего канала (самая старая), или nil
+func LeadFormForChannel(ctx context.Context, channel string) (*LeadForm, error) {
+	forms, err := queryLeadForms(ctx, `WHERE f.active AND $1 = ANY(f.channels) ORDER BY f.created_at LIMIT 1`, channel)
+	if err != nil || len(forms) == 0 {
+		return nil, err
+	}
+	return forms[0], nil
+}
+
+// CheckLeadAssignees проверяет, что назначаемые формой пользователи существуют
+func CheckLeadAssignees(ctx context.Context, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var found int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM users WHERE id = ANY($1::uuid[])`, ids).Scan(&found); err != nil {
+		return err
+	}
+	if found != len(ids) {
+		return invalidLeadFormf("assignment: unknown user")
+	}
+	return nil
+}
+
+// CreateLeadForm сохраняет форму и выдаёт ей публичный ключ
+func CreateLeadForm(ctx context.Context, f *LeadForm) error {
+	if err := f.Normalize(); err != nil {
+		return err
+	}
+	key, err := newLeadFormKey()
+	if err != nil {
+		return err
+	}
+	fields, _ := json.Marshal(f.Fields)
+	assignment, _ := json.Marshal(f.Assignment)
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO lead_forms (user_id, name, public_key, fields, source, assignment, create_deal, pipeline_id, stage,
+			deal_title, deal_value, channels, allowed_origins, rate_limit_per_hour, success_message, redirect_url, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17)
+		RETURNING id, created_at, updated_at
+	`, f.UserID, f.Name, key, fields, f.Source, assignment, f.CreateDeal, f.PipelineID, f.Stage,
+		f.DealTitle, f.DealValue, f.Channels, f.AllowedOrigins, f.RateLimitPerHour, f.SuccessMessage, f.RedirectURL,
+		f.Active).Scan(&f.ID, &f.CreatedAt, &f.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	f.PublicKey = key
+	return nil
+}
+
+// UpdateLeadForm сохраняет настройки формы; публичный ключ и очередь назначения не меняются
+func UpdateLeadForm(ctx context.Context, f *LeadForm) error {
+	if err := f.Normalize(); err != nil {
+		return err
+	}
+	fields, _ := json.Marshal(f.Fields)
+	assignment, _ := json.Marshal(f.Assignment)
+	err := database.Pool.QueryRow(ctx, `
+		UPDATE lead_forms
+		SET name = $2, fields = $3, source = $4, assignment = $5, create_deal = $6, pipeline_id = $7, stage = $8,
+			deal_title = $9, deal_value = $10, channels = $11, allowed_origins = $12, rate_limit_per_hour = $13,
+			success_message = $14, redirect_url = $15, active = $16, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, f.ID, f.Name, fields, f.Source, assignment, f.CreateDeal, f.PipelineID, f.Stage,
+		f.DealTitle, f.DealValue, f.Channels, f.AllowedOrigins, f.RateLimitPerHour, f.SuccessMessage, f.RedirectURL,
+		f.Active).Scan(&f.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrLeadFormNotFound
+	}
+	return err
+}
+
+// RotateLeadFormKey выдаёт форме новый публичный ключ; старый код встраивания перестаёт работать
+func RotateLeadFormKey(ctx context.Context, id string) (string, error) {
+	key, err := newLeadFormKey()
+	if err != nil {
+		return "", err
+	}
+	tag, err := database.Pool.Exec(ctx, `UPDATE lead_forms SET public_key = $2, updated_at = NOW() WHERE id = $1`, id, key)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrLeadFormNotFound
+	}
+	return key, nil
+}
+
+// DeleteLeadForm удаляет форму; журнал заявок остаётся без ссылки на неё
+func DeleteLeadForm(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM lead_forms WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrLeadFormNotFound
+	}
+	return nil
+}
+
+// LeadInput – заявка из любого канала. Для формы Values – значения её полей по имени,
+// для каналов без формы ключи Values – сразу поля клиента (LeadCustomerTargets).
+type LeadInput struct {
+	Channel     string
+	ExternalRef string
+	Values      map[string]string
+	UTM         map[string]string
+	IP          string
+	UserAgent   string
+	Referrer    string
+	// CreatedAt – время исходной заявки при переносе старых записей; пусто – сейчас
+	CreatedAt *time.Time
+}
+
+// LeadResult – итог обработки заявки
+type LeadResult struct {
+	SubmissionID    string  `json:"submission_id"`
+	Status          string  `json:"status"`
+	CustomerID      string  `json:"customer_id,omitempty"`
+	CustomerName    string  `json:"-"`
+	Email           string  `json:"-"`
+	Phone           string  `json:"-"`
+	Company         string  `json:"-"`
+	CustomerCreated bool    `json:"customer_created"`
+	DealID          string  `json:"deal_id,omitempty"`
+	DealTitle       string  `json:"-"`
+	DealValue       float64 `json:"-"`
+	PipelineID      string  `json:"-"`
+	Stage           string  `json:"-"`
+	AssignedTo      *string `json:"assigned_to,omitempty"`
+	Responsible     string  `json:"responsible,omitempty"`
+	Source          string  `json:"-"`
+}
+
+// leadCustomer – поля клиента, собранные из заявки
+type leadCustomer struct {
+	columns map[string]string
+	custom  map[string]interface{}
+	comment []string
+}
+
+// SplitLeadContact раскладывает свободную строку контакта (заявка на услуги, консультант)
+// на email, телефон или Telegram
+func SplitLeadContact(contact string) map[string]string {
+	contact = strings.TrimSpace(contact)
+	values := map[string]string{}
+	switch {
+	case contact == "":
+	case strings.Contains(contact, "@") && !strings.HasPrefix(contact, "@"):
+		if addr, err := mail.ParseAddress(contact); err == nil {
+			values["email"] = addr.Address
+		} else {
+			values["comment"] = "Контакт: " + contact
+		}
+	case NormalizePhone(contact) != "":
+		values["phone"] = NormalizePhone(contact)
+	case strings.HasPrefix(contact, "@") || strings.Contains(contact, "t.me/"):
+		values["telegram"] = contact
+	default:
+		values["comment"] = "Контакт: " + contact
+	}
+	return values
+}
+
+// collectLeadCustomer проверяет значения по полям формы и раскладывает их по полям клиента.
+// Заявки внутренних каналов (form == nil) приходят уже разложенными по полям клиента и принимаются
+// без контакта: он мог остаться в комментарии в свободной форме.
+func collectLeadCustomer(form *LeadForm, values map[string]string) (*leadCustomer, error) {
+	lc := &leadCustomer{columns: map[string]string{}, custom: map[string]interface{}{}}
+	put := func(target, label, v string) {
+		switch {
+		case strings.HasPrefix(target, LeadCustomTargetPrefix):
+			lc.custom[strings.TrimPrefix(target, LeadCustomTargetPrefix)] = v
+		case target == "" || target == "comment":
+			if target == "" {
+				v = label + ": " + v
+			}
+			lc.comment = append(lc.comment, v)
+		default:
+			lc.columns[target] = v
+		}
+	}
+	if form == nil {
+		for target, v := range values {
+			if v = strings.TrimSpace(v); v != "" && containsString(LeadCustomerTargets, target) {
+				put(target, target, v)
+			}
+		}
+	} else {
+		for _, field := range form.Fields {
+			v := strings.TrimSpace(values[field.Name])
+			if len(v) > leadValueMaxLen {
+				return nil, invalidLeadf("%s is too long", field.Label)
+			}
+			if v == "" {
+				if field.Required {
+					return nil, invalidLeadf("%s is required", field.Label)
+				}
+				continue
+			}
+			if field.Type == "select" && !containsString(field.Options, v) {
+				return nil, invalidLeadf("%s: unknown option", field.Label)
+			}
+			put(field.Target, field.Label, v)
+		}
+	}
+
+	if email := lc.columns["email"]; email != "" {
+		addr, err := mail.ParseAddress(email)
+		if err != nil {
+			return nil, invalidLeadf("invalid email")
+		}
+		lc.columns["email"] = strings.ToLower(addr.Address)
+	}
+	if phone := lc.columns["phone"]; phone != "" {
+		normalized := NormalizePhone(phone)
+		if normalized == "" {
+			return nil, invalidLeadf("invalid phone")
+		}
+		lc.columns["phone"] = normalized
+	}
+	if form != nil && lc.columns["email"] == "" && lc.columns["phone"] == "" && lc.columns["telegram"] == "" {
+		return nil, invalidLeadf("email, phone or telegram is required")
+	}
+	if lc.columns["name"] == "" {
+		lc.columns["name"] = firstNonEmpty(lc.columns["company"], lc.columns["email"], lc.columns["phone"], lc.columns["telegram"])
+	}
+	if lc.columns["name"] == "" {
+		if len(lc.comment) == 0 {
+			return nil, invalidLeadf("lead is empty")
+		}
+		lc.columns["name"] = "Лид без имени"
+	}
+	return lc, nil
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, v := range values {
+		if v != "" {
+			return v
+		}
+	}
+	return ""
+}
+
+// LeadSource – значение crm_customers.source: UTM-метки, если они есть, иначе источник формы или канал
+func LeadSource(form *LeadForm, channel string, utm map[string]string) string {
+	var parts []string
+	for _, p := range []string{"utm_source", "utm_medium", "utm_campaign"} {
+		if v := strings.TrimSpace(utm[p]); v != "" {
+			parts = append(parts, v)
+		}
+	}
+	if len(parts) > 0 {
+		return truncateString(strings.Join(parts, " / "), 255)
+	}
+	if form != nil && form.Source != "" {
+		return form.Source
+	}
+	if form != nil && channel == LeadChannelForm {
+		return truncateString("Форма: "+form.Name, 255)
+	}
+	switch channel {
+	case LeadChannelServiceRequest:
+		return "Заявка на услуги"
+	case LeadChannelConsultant:
+		return "AI-консультант"
+	}
+	return channel
+}
+
+func truncateString(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n])
+	}
+	return s
+}
+
+// pickLeadAssignee выбирает ответственного: правило, очередь или владелец формы (nil – без формы)
+func pickLeadAssignee(ctx context.Context, tx pgx.Tx, form *LeadForm, values map[string]string) (*string, error) {
+	if form == nil {
+		return nil, nil
+	}
+	a := form.Assignment
+	if a.Mode == LeadAssignRules {
+		for _, r := range a.Rules {
+			if r.matches(values) {
+				return &r.UserID, nil
+			}
+		}
+	}
+	if (a.Mode == LeadAssignRoundRobin || a.Mode == LeadAssignRules) && len(a.UserIDs) > 0 {
+		// Счётчик двигается под блокировкой строки, поэтому очередь честная и при параллельных заявках
+		var cursor int64
+		err := tx.QueryRow(ctx, `
+			UPDATE lead_forms SET assignment_cursor = assignment_cursor + 1 WHERE id = $1 RETURNING assignment_cursor
+		`, form.ID).Scan(&cursor)
+		if err != nil {
+			return nil, err
+		}
+		id := a.UserIDs[(cursor-1)%int64(len(a.UserIDs))]
+		return &id, nil
+	}
+	owner := form.UserID
+	return &owner, nil
+}
+
+// findLeadCustomer ищет клиента заявки по email, затем по телефону среди клиентов ответственного
+// и владельца формы (без формы – среди всех). emailTaken – email уже занят клиентом вне этого
+// круга: email уникален во всей базе, поэтому нового клиента придётся создать без него.
+func findLeadCustomer(ctx context.Context, tx pgx.Tx, lc *leadCustomer, scope []string) (id string, emailTaken bool, err error) {
+	if email := lc.columns["email"]; email != "" {
+		// Email уникален и среди клиентов в корзине: новая заявка возвращает такого клиента из корзины,
+		// но только своего – чужого клиента не трогаем
+		var trashed, inScope bool
+		err := tx.QueryRow(ctx, `
+			SELECT id, deleted_at IS NOT NULL, COALESCE($2 OR user_id = ANY($3::uuid[]), FALSE) AS in_scope
+			FROM crm_customers WHERE LOWER(email) = $1
+			ORDER BY in_scope DESC, deleted_at NULLS FIRST LIMIT 1
+		`, email, len(scope) == 0, scope).Scan(&id, &trashed, &inScope)
+		switch {
+		case err == nil && !inScope:
+			id, emailTaken = "", true
+		case err == nil && trashed:
+			if _, err := RestoreTrashedCustomerTx(ctx, tx, id); err != nil {
+				return "", false, err
+			}
+			return id, false, nil
+		case err == nil || !errors.Is(err, pgx.ErrNoRows):
+			return id, false, err
+		}
+	}
+	if phone := lc.columns["phone"]; phone != "" {
+		digits := strings.TrimPrefix(phone, "+")
+		if len(digits) > 10 {
+			digits = digits[len(digits)-10:]
+		}
+		query := `SELECT id FROM crm_customers WHERE deleted_at IS NULL AND RIGHT(regexp_replace(COALESCE(phone, ''), '\D', '', 'g'), 10) = $1`
+		args := []interface{}{digits}
+		if len(scope) > 0 {
+			query += ` AND user_id = ANY($2::uuid[])`
+			args = append(args, scope)
+		}
+		err := tx.QueryRow(ctx, query+` ORDER BY created_at LIMIT 1`, args...).Scan(&id)
+		if err == nil || !errors.Is(err, pgx.ErrNoRows) {
+			return id, emailTaken, err
+		}
+	}
+	return "", emailTaken, nil
+}
+
+// leadDealTitle подставляет в шаблон названия сделки {name}, {company} и {form}
+func leadDealTitle(form *LeadForm, lc *leadCustomer) string {
+	title := form.DealTitle
+	if title == "" {
+		title = "Заявка: {name}"
+	}
+	title = strings.NewReplacer("{name}", lc.columns["name"], "{company}", lc.columns["company"], "{form}", form.Name).Replace(title)
+	return truncateString(strings.TrimSpace(title), 255)
+}
+
+// CaptureLead обрабатывает заявку: находит или создаёт клиента, назначает ответственного,
+// создаёт сделку (если форма так настроена) и пишет заявку в журнал – всё в одной транзакции.
+// pipeline и stage – воронка и этап новой сделки, их доступность проверяет вызывающий.
+func CaptureLead(ctx context.Context, form *LeadForm, in LeadInput, pipeline *Pipeline, stage *PipelineStage) (*LeadResult, error) {
+	// Форма, принимающая внутренний канал, задаёт назначение и воронку, но не схему полей
+	schema := form
+	if in.Channel != LeadChannelForm {
+		schema = nil
+	}
+	lc, err := collectLeadCustomer(schema, in.Values)
+	if err != nil {
+		return nil, err
+	}
+	var customFields map[string]interface{}
+	if len(lc.custom) > 0 {
+		if customFields, err = ApplyCustomFieldValues(ctx, CustomFieldEntityCustomer, nil, lc.custom); err != nil {
+			return nil, err
+		}
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	res := &LeadResult{
+		Source:       LeadSource(form, in.Channel, in.UTM),
+		CustomerName: lc.columns["name"],
+		Email:        lc.columns["email"],
+		Phone:        lc.columns["phone"],
+		Company:      lc.columns["company"],
+	}
+	values := map[string]string{}
+	for k, v := range in.UTM {
+		values[k] = v
+	}
+	for k, v := range in.Values {
+		values[k] = v
+	}
+	if res.AssignedTo, err = pickLeadAssignee(ctx, tx, form, values); err != nil {
+		return nil, err
+	}
+	if res.AssignedTo != nil {
+		if err := tx.QueryRow(ctx, `SELECT COALESCE(NULLIF(name, ''), email) FROM users WHERE id = $1`,
+			*res.AssignedTo).Scan(&res.Responsible); err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			return nil, err
+		}
+	}
+
+	var scope []string
+	if form != nil {
+		scope = append([]string{form.UserID}, form.Assignment.Assignees()...)
+	}
+	var emailTaken bool
+	if res.CustomerID, emailTaken, err = findLeadCustomer(ctx, tx, lc, scope); err != nil {
+		return nil, err
+	}
+	if emailTaken && res.CustomerID == "" {
+		lc.comment = append(lc.comment, "Email: "+lc.columns["email"])
+	}
+	comment := strings.Join(lc.comment, "\n")
+	var socialMedia interface{}
+	if tg := lc.columns["telegram"]; tg != "" {
+		socialMedia, _ = json.Marshal(map[string]string{"telegram": tg})
+	}
+	if res.CustomerID != "" {
+		// Существующего клиента не перезаписываем: только дополняем пустые поля и отмечаем активность
+		res.Status = LeadStatusMatched
+		err = tx.QueryRow(ctx, `
+			UPDATE crm_customers SET
+				phone = COALESCE(NULLIF(phone, ''), NULLIF($2, '')),
+				company = COALESCE(NULLIF(company, ''), NULLIF($3, '')),
+				city = COALESCE(NULLIF(city, ''), NULLIF($4, '')),
+				source = COALESCE(NULLIF(source, ''), $5),
+				last_seen = NOW()
+			WHERE id = $1
+			RETURNING name
+		`, res.CustomerID, lc.columns["phone"], lc.columns["company"], lc.columns["city"], res.Source).Scan(&res.CustomerName)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		res.Status, res.CustomerCreated = LeadStatusCreated, true
+		email := lc.columns["email"]
+		if email == "" || emailTaken {
+			email = "lead-" + uuid.NewString() + "@" + LeadPlaceholderEmailDomain
+		}
+		if customFields == nil {
+			customFields = map[string]interface{}{}
+		}
+		err = tx.QueryRow(ctx, `
+			INSERT INTO crm_customers (name, email, phone, company, status, responsible, source, comment, user_id,
+				created_at, last_seen, city, social_media, notes, custom_fields)
+			VALUES ($1, $2, $3, $4, 'lead', $5, $6, $7, $8, COALESCE($9, NOW()), NOW(), $10, $11, $12, $13)
+			RETURNING id
+		`, truncateString(lc.columns["name"], 255), email, lc.columns["phone"], truncateString(lc.columns["company"], 255),
+			res.Responsible, res.Source, comment, res.AssignedTo, in.CreatedAt, lc.columns["city"], socialMedia,
+			lc.columns["notes"], customFields).Scan(&res.CustomerID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if form != nil && form.CreateDeal && pipeline != nil && stage != nil {
+		res.DealTitle, res.DealValue = leadDealTitle(form, lc), form.DealValue
+		res.PipelineID, res.Stage = pipeline.ID, stage.Code
+		err = tx.QueryRow(ctx, `
+			INSERT INTO crm_deals (customer_id, title, value, pipeline_id, stage, probability, responsible, source, comment,
+				user_id, created_at, stage_changed_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, NOW(), NOW())
+			RETURNING id
+		`, res.CustomerID, res.DealTitle, res.DealValue, pipeline.ID, stage.Code, stage.Probability,
+			res.Responsible, res.Source, comment, res.AssignedTo).Scan(&res.DealID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if res.SubmissionID, err = insertLeadSubmission(ctx, tx, form, in, res); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return res, nil
+}
+
+func insertLeadSubmission(ctx context.Context, q interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
+}, form *LeadForm, in LeadInput, res *LeadResult) (string, error) {
+	var formID interface{}
+	if form != nil {
+		formID = form.ID
+	}
+	payload, _ := json.Marshal(in.Values)
+	utm, _ := json.Marshal(in.UTM)
+	if in.UTM == nil {
+		utm = []byte("{}")
+	}
+	var externalRef, customerID, dealID interface{}
+	if in.ExternalRef != "" {
+		externalRef = in.ExternalRef
+	}
+	if res.CustomerID != "" {
+		customerID = res.CustomerID
+	}
+	if res.DealID != "" {
+		dealID = res.DealID
+	}
+	var id string
+	err := q.QueryRow(ctx, `
+		INSERT INTO lead_submissions (form_id, channel, external_ref, payload, utm, ip, user_agent, referrer, status,
+			customer_id, deal_id, assigned_to, created_at)
+		VALUES ($1, $2, $3, $4, $5, NULLIF($6, ''), NULLIF($7, ''), NULLIF($8, ''), $9, $10, $11, $12, COALESCE($13, NOW()))
+		RETURNING id
+	`, formID, in.Channel, externalRef, payload, utm, in.IP, truncateString(in.UserAgent, 500), truncateString(in.Referrer, 1000),
+		res.Status, customerID, dealID, res.AssignedTo, in.CreatedAt).Scan(&id)
+	return id, err
+}
+
+// RecordSpamLead пишет в журнал заявку, отсеянную honeypot: клиент не создаётся,
+// но заявка учитывается в лимите с этого IP
+func RecordSpamLead(ctx context.Context, form *LeadForm, in LeadInput) error {
+	_, err := insertLeadSubmission(ctx, database.Pool, form, in, &LeadResult{Status: LeadStatusSpam})
+	return err
+}
+
+// RecordInvalidLead пишет в журнал перенесённую заявку, которую не удалось принять: клиент не
+// создаётся, а external_ref исключает заявку из следующих пачек PendingLegacyLeads
+func RecordInvalidLead(ctx context.Context, in LeadInput, reason error) error {
+	payload, _ := json.Marshal(in.Values)
+	_, err := database.Pool.Exec(ctx, `
+		INSERT INTO lead_submissions (channel, external_ref, payload, status, error, created_at)
+		VALUES ($1, $2, $3, $4, $5, COALESCE($6, NOW()))
+		ON CONFLICT (channel, external_ref) WHERE external_ref IS NOT NULL DO NOTHING
+	`, in.Channel, in.ExternalRef, payload, LeadStatusInvalid, reason.Error(), in.CreatedAt)
+	return err
+}
+
+// RecentLeadSubmissions – сколько заявок (включая спам) пришло на форму с IP за период
+func RecentLeadSubmissions(ctx context.Context, formID, ip string, window time.Duration) (int, error) {
+	var n int
+	err := database.Pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM lead_submissions
+		WHERE form_id = $1 AND ip = $2 AND created_at > NOW() - $3::int * INTERVAL '1 second'
+	`, formID, ip, int(window.Seconds())).Scan(&n)
+	return n, err
+}
+
+// LeadSubmission – запись журнала заявок
+type LeadSubmission struct {
+	ID         string            `json:"id"`
+	FormID     *string           `json:"form_id,omitempty"`
+	Channel    string            `json:"channel"`
+	Payload    map[string]string `json:"payload"`
+	UTM        map[string]string `json:"utm"`
+	IP         *string           `json:"ip,omitempty"`
+	Referrer   *string           `json:"referrer,omitempty"`
+	Status     string            `json:"status"`
+	CustomerID *string           `json:"customer_id,omitempty"`
+	DealID     *string           `json:"deal_id,omitempty"`
+	AssignedTo *string           `json:"assigned_to,omitempty"`
+	CreatedAt  time.Time         `json:"created_at"`
+}
+
+// LeadSubmissionFilter – фильтр журнала заявок
+type LeadSubmissionFilter struct {
+	FormID  string
+	Channel string
+	Status  string
+	// UserID/IsAdmin – пользователь видит заявки своих форм и назначенные ему
+	UserID  string
+	IsAdmin bool
+	Limit   int
+	Offset  int
+}
+
+// ListLeadSubmissions возвращает заявки, новые сначала, и общее число
+func ListLeadSubmissions(ctx context.Context, f LeadSubmissionFilter) ([]*LeadSubmission, int, error) {
+	if _, err := uuid.Parse(f.FormID); f.FormID != "" && err != nil {
+		return []*LeadSubmission{}, 0, nil
+	}
+	where := ` WHERE true`
+	var args []interface{}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		where += fmt.Sprintf(" AND "+cond, len(args))
+	}
+	if f.FormID != "" {
+		add("s.form_id = $%d", f.FormID)
+	}
+	if f.Channel != "" {
+		add("s.channel = $%d", f.Channel)
+	}
+	if f.Status != "" {
+		add("s.status = $%d", f.Status)
+	}
+	if !f.IsAdmin {
+		args = append(args, f.UserID)
+		where += fmt.Sprintf(" AND (s.assigned_to = $%[1]d OR EXISTS (SELECT 1 FROM lead_forms lf WHERE lf.id = s.form_id AND lf.user_id = $%[1]d))", len(args))
+	}
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM lead_submissions s`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := database.Pool.Query(ctx, `
+		SELECT s.id, s.form_id::text, s.channel, s.payload, s.utm, s.ip, s.referrer, s.status,
+			s.customer_id::text, s.deal_id::text, s.assigned_to::text, s.created_at
+		FROM lead_submissions s`+where+
+		fmt.Sprintf(" ORDER BY s.created_at DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	submissions := []*LeadSubmission{}
+	for rows.Next() {
+		var s LeadSubmission
+		var payload, utm []byte
+		if err := rows.Scan(&s.ID, &s.FormID, &s.Channel, &payload, &utm, &s.IP, &s.Referrer, &s.Status,
+			&s.CustomerID, &s.DealID, &s.AssignedTo, &s.CreatedAt); err != nil {
+			return nil, 0, err
+		}
+		// payload старых заявок может содержать не только строки – показываем то, что читается
+		_ = json.Unmarshal(payload, &s.Payload)
+		_ = json.Unmarshal(utm, &s.UTM)
+		submissions = append(submissions, &s)
+	}
+	return submissions, total, rows.Err()
+}
+
+// PendingLegacyLeads возвращает ещё не перенесённые заявки из service_requests и individual_consultations,
+// которые раньше сохранялись и больше никуда не попадали. Отсутствующие таблицы пропускаются.
+func PendingLegacyLeads(ctx context.Context, limit int) ([]LeadInput, error) {
+	var exists struct{ requests, consultations bool }
+	err := database.Pool.QueryRow(ctx, `
+		SELECT to_regclass('public.service_requests') IS NOT NULL, to_regclass('public.individual_consultations') IS NOT NULL
+	`).Scan(&exists.requests, &exists.consultations)
+	if err != nil {
+		return nil, err
+	}
+	var inputs []LeadInput
+	if exists.requests {
+		// У старых заявок нет надёжного ключа, поэтому ссылкой служит хеш содержимого
+		rows, err := database.Pool.Query(ctx, `
+			SELECT r.ref, r.name, r.contact, r.description, r.created_at
+			FROM (
+				SELECT md5(concat_ws('|', name, contact, description, created_at::text)) AS ref,
+					COALESCE(name, '') AS name, COALESCE(contact, '') AS contact,
+					COALESCE(description, '') AS description, created_at
+				FROM service_requests
+			) r
+			WHERE NOT EXISTS (SELECT 1 FROM lead_submissions s WHERE s.channel = $1 AND s.external_ref = r.ref)
+			ORDER BY r.created_at
+			LIMIT $2
+		`, LeadChannelServiceRequest, limit)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var ref, name, contact, description string
+			var createdAt *time.Time
+			if err := rows.Scan(&ref, &name, &contact, &description, &createdAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			inputs = append(inputs, ServiceRequestLead(name, contact, description, ref, createdAt))
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	if exists.consultations && len(inputs) < limit {
+		rows, err := database.Pool.Query(ctx, `
+			SELECT c.ref, COALESCE(c.name, ''), COALESCE(c.contact, ''), COALESCE(c.service_type, ''),
+				COALESCE(c.description, ''), COALESCE(c.budget, ''), COALESCE(c.deadline, ''), c.created_at
+			FROM (
+				SELECT md5(concat_ws('|', session_id, created_at::text)) AS ref, * FROM individual_consultations
+			) c
+			WHERE NOT EXISTS (SELECT 1 FROM lead_submissions s WHERE s.channel = $1 AND s.external_ref = c.ref)
+			ORDER BY c.created_at
+			LIMIT $2
+		`, LeadChannelConsultant, limit-len(inputs))
+		if err != nil {
+			return nil, err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var ref, name, contact string
+			data := map[string]string{}
+			var serviceType, description, budget, deadline string
+			var createdAt *time.Time
+			if err := rows.Scan(&ref, &name, &contact, &serviceType, &description, &budget, &deadline, &createdAt); err != nil {
+				return nil, err
+			}
+			data["name"], data["contact"] = name, contact
+			data["service_type"], data["description"], data["budget"], data["deadline"] = serviceType, description, budget, deadline
+			inputs = append(inputs, ConsultantLead(ref, data, createdAt))
+		}
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return inputs, nil
+}
+
+// ServiceRequestLead – заявка на услуги в общем формате
+func ServiceRequestLead(name, contact, description, ref string, createdAt *time.Time) LeadInput {
+	values := SplitLeadContact(contact)
+	values["name"] = strings.TrimSpace(name)
+	values["comment"] = strings.TrimSpace(strings.Join([]string{values["comment"], description}, "\n"))
+	return LeadInput{Channel: LeadChannelServiceRequest, ExternalRef: ref, Values: values, CreatedAt: createdAt}
+}
+
+// ConsultantLead – заявка, собранная AI-консультантом, в общем формате
+func ConsultantLead(ref string, data map[string]string, createdAt *time.Time) LeadInput {
+	values := SplitLeadContact(data["contact"])
+	values["name"] = strings.TrimSpace(data["name"])
+	var comment []string
+	if values["comment"] != "" {
+		comment = append(comment, values["comment"])
+	}
+	for _, item := range []struct{ label, key string }{
+		{"Услуга", "service_type"}, {"Описание", "description"}, {"Бюджет", "budget"}, {"Срок", "deadline"},
+	} {
+		if v := strings.TrimSpace(data[item.key]); v != "" {
+			comment = append(comment, item.label+": "+v)
+		}
+	}
+	values["comment"] = strings.Join(comment, "\n")
+	return LeadInput{Channel: LeadChannelConsultant, ExternalRef: ref, Values: values, CreatedAt: createdAt}
+}
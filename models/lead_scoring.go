@@ -0,0 +1,843 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Лид-скоринг. Модель – набор правил с весами в баллах: поля клиента, теги, давность и число
+// активностей, этапы и сумма сделок, источник, реакция на письма. Итог – сумма баллов в пределах 0..100;
+// в crm_customers.lead_score он пишется долей единицы, как раньше. Баллы правил с decays затухают
+// вдвое за каждые decay_half_life_days с момента последнего подтверждения (активности, смены этапа),
+// поэтому оценка «остывает» сама, а фоновый пересчёт это фиксирует.
+//
+// Модели устроены как воронки: у клиента действует модель его владельца, без неё – общая
+// (user_id = NULL), без общей – встроенная DefaultScoringModel.
+
+var (
+	ErrInvalidScoringModel  = errors.New("invalid scoring model")
+	ErrScoringModelNotFound = errors.New("scoring model not found")
+	ErrLeadScoreNotFound    = errors.New("lead score not found")
+)
+
+// invalidScoringf – ошибка валидации модели, распознаётся через errors.Is(err, ErrInvalidScoringModel)
+func invalidScoringf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidScoringModel}, args...)...)
+}
+
+// Критерии правил скоринга
+const (
+	ScoringCriterionField           = "field"            // поле клиента или custom.<ключ>
+	ScoringCriterionSource          = "source"           // источник клиента
+	ScoringCriterionTag             = "tag"              // есть один из тегов
+	ScoringCriterionActivityRecency = "activity_recency" // последняя активность не старше within_days
+	ScoringCriterionActivityCount   = "activity_count"   // число активностей за within_days
+	ScoringCriterionDealStage       = "deal_stage"       // есть сделка на одном из этапов (won, lost, open – любые выигранные, проигранные, открытые)
+	ScoringCriterionDealValue       = "deal_value"       // сумма непроигранных сделок не меньше min
+	ScoringCriterionEmailEngagement = "email_engagement" // открытия, переходы и ответы на письма за within_days
+)
+
+// ScoringCriteria – известные критерии
+var ScoringCriteria = []string{
+	ScoringCriterionField, ScoringCriterionSource, ScoringCriterionTag,
+	ScoringCriterionActivityRecency, ScoringCriterionActivityCount,
+	ScoringCriterionDealStage, ScoringCriterionDealValue, ScoringCriterionEmailEngagement,
+}
+
+// Операторы сравнения для field и source
+const (
+	ScoringOpNotEmpty = "not_empty"
+	ScoringOpEquals   = "equals"   // равно одному из values без учёта регистра
+	ScoringOpContains = "contains" // содержит одно из values
+)
+
+// Особые значения этапа в правиле deal_stage
+const (
+	ScoringStageWon  = "won"
+	ScoringStageLost = "lost"
+	ScoringStageOpen = "open"
+)
+
+// ScoringFields – поля клиента для правил field (плюс custom.<ключ> пользовательских полей)
+var ScoringFields = []string{"name", "email", "phone", "company", "status", "source", "city", "responsible", "comment", "notes"}
+
+// ScoringEmailActivityTypes – типы активностей, которые считаются реакцией на письма
+var ScoringEmailActivityTypes = []string{"email_opened", "email_clicked", "email_replied"}
+
+const (
+	ScoreMax                  = 100
+	DefaultScoringHalfLife    = 30
+	scoringMaxRules           = 50
+	scoringDefaultCountWindow = 90
+	scoringDefaultEmailWindow = 30
+	// scoringActivityLimit – сколько последних активностей клиента учитывается
+	scoringActivityLimit = 500
+)
+
+// ScoringRule – правило модели. Points – баллы за срабатывание (или за каждую единицу при per_item),
+// отрицательные баллы понижают оценку
+type ScoringRule struct {
+	ID         string   `json:"id"`
+	Name       string   `json:"name"`
+	Criterion  string   `json:"criterion"`
+	Field      string   `json:"field,omitempty"`
+	Operator   string   `json:"operator,omitempty"`
+	Values     []string `json:"values,omitempty"`
+	WithinDays int      `json:"within_days,omitempty"`
+	Min        float64  `json:"min,omitempty"`
+	Points     float64  `json:"points"`
+	PerItem    bool     `json:"per_item,omitempty"`
+	MaxPoints  float64  `json:"max_points,omitempty"`
+	Decays     bool     `json:"decays,omitempty"`
+	Disabled   bool     `json:"disabled,omitempty"`
+}
+
+// ScoringModel – модель скоринга рабочего пространства; пустой ID – встроенная модель
+type ScoringModel struct {
+	ID                string        `json:"id,omitempty"`
+	UserID            *string       `json:"user_id,omitempty"`
+	Rules             []ScoringRule `json:"rules"`
+	DecayHalfLifeDays int           `json:"decay_half_life_days"`
+	BuiltIn           bool          `json:"built_in"`
+	UpdatedAt         *time.Time    `json:"updated_at,omitempty"`
+}
+
+// DefaultScoringModel – правила по умолчанию: контакты, вовлечённость, сделки
+func DefaultScoringModel() *ScoringModel {
+	return &ScoringModel{
+		BuiltIn:           true,
+		DecayHalfLifeDays: DefaultScoringHalfLife,
+		Rules: []ScoringRule{
+			{ID: "has_email", Name: "Указан email", Criterion: ScoringCriterionField, Field: "email", Operator: ScoringOpNotEmpty, Points: 5},
+			{ID: "has_phone", Name: "Указан телефон", Criterion: ScoringCriterionField, Field: "phone", Operator: ScoringOpNotEmpty, Points: 5},
+			{ID: "has_company", Name: "Указана компания", Criterion: ScoringCriterionField, Field: "company", Operator: ScoringOpNotEmpty, Points: 5},
+			{ID: "active_week", Name: "Активность за неделю", Criterion: ScoringCriterionActivityRecency, WithinDays: 7, Points: 15},
+			{ID: "active_month", Name: "Активность за месяц", Criterion: ScoringCriterionActivityRecency, WithinDays: 30, Points: 5},
+			{ID: "activities", Name: "Активности за 90 дней", Criterion: ScoringCriterionActivityCount, WithinDays: 90, PerItem: true, Points: 2, MaxPoints: 20, Decays: true},
+			{ID: "email_engagement", Name: "Реакция на письма", Criterion: ScoringCriterionEmailEngagement, WithinDays: 30, PerItem: true, Points: 3, MaxPoints: 15, Decays: true},
+			{ID: "open_deal", Name: "Есть открытая сделка", Criterion: ScoringCriterionDealStage, Values: []string{ScoringStageOpen}, Points: 10, Decays: true},
+			{ID: "late_stage", Name: "Сделка на этапе предложения или переговоров", Criterion: ScoringCriterionDealStage, Values: []string{"proposal", "negotiation"}, Points: 10, Decays: true},
+			{ID: "won_deal", Name: "Есть выигранная сделка", Criterion: ScoringCriterionDealStage, Values: []string{ScoringStageWon}, Points: 15},
+			{ID: "big_deals", Name: "Сделки от 100 000", Criterion: ScoringCriterionDealValue, Min: 100000, Points: 10},
+		},
+	}
+}
+
+// Normalize проверяет правила и подставляет значения по умолчанию
+func (m *ScoringModel) Normalize() error {
+	if m.DecayHalfLifeDays < 0 || m.DecayHalfLifeDays > 365 {
+		return invalidScoringf("decay_half_life_days must be between 0 (no decay) and 365")
+	}
+	if len(m.Rules) > scoringMaxRules {
+		return invalidScoringf("a model can have at most %d rules", scoringMaxRules)
+	}
+	seen := make(map[string]bool, len(m.Rules))
+	for n := range m.Rules {
+		r := &m.Rules[n]
+		r.ID = strings.TrimSpace(r.ID)
+		if r.ID == "" {
+			r.ID = fmt.Sprintf("rule_%d", n+1)
+		}
+		if seen[r.ID] {
+			return invalidScoringf("duplicate rule id %q", r.ID)
+		}
+		seen[r.ID] = true
+		if err := r.normalize(); err != nil {
+			return invalidScoringf("rule %q: %v", r.ID, err)
+		}
+	}
+	return nil
+}
+
+func (r *ScoringRule) normalize() error {
+	r.Name = strings.TrimSpace(r.Name)
+	r.Field = strings.TrimSpace(r.Field)
+	if r.Name == "" {
+		r.Name = r.ID
+	}
+	if r.Points < -ScoreMax || r.Points > ScoreMax {
+		return fmt.Errorf("points must be between -%d and %d", ScoreMax, ScoreMax)
+	}
+	if r.MaxPoints < 0 || r.WithinDays < 0 || r.Min < 0 {
+		return errors.New("max_points, within_days and min must not be negative")
+	}
+	switch r.Criterion {
+	case ScoringCriterionField:
+		if !containsString(ScoringFields, r.Field) && !strings.HasPrefix(r.Field, LeadCustomTargetPrefix) {
+			return fmt.Errorf("unknown field %q", r.Field)
+		}
+		return r.normalizeOperator(ScoringOpNotEmpty)
+	case ScoringCriterionSource:
+		return r.normalizeOperator(ScoringOpEquals)
+	case ScoringCriterionTag, ScoringCriterionDealStage:
+		if len(r.Values) == 0 {
+			return errors.New("values are required")
+		}
+	case ScoringCriterionActivityRecency:
+		if r.WithinDays == 0 {
+			return errors.New("within_days is required")
+		}
+	case ScoringCriterionActivityCount, ScoringCriterionEmailEngagement:
+		if r.WithinDays == 0 {
+			r.WithinDays = scoringDefaultCountWindow
+			if r.Criterion == ScoringCriterionEmailEngagement {
+				r.WithinDays = scoringDefaultEmailWindow
+			}
+		}
+		if !r.PerItem && r.Min == 0 {
+			r.Min = 1
+		}
+	case ScoringCriterionDealValue:
+		if r.Min == 0 {
+			return errors.New("min is required")
+		}
+	default:
+		return fmt.Errorf("unknown criterion %q", r.Criterion)
+	}
+	return nil
+}
+
+func (r *ScoringRule) normalizeOperator(def string) error {
+	if r.Operator == "" {
+		r.Operator = def
+	}
+	switch r.Operator {
+	case ScoringOpNotEmpty:
+		return nil
+	case ScoringOpEquals, ScoringOpContains:
+		if len(r.Values) == 0 {
+			return errors.New("values are required")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown operator %q", r.Operator)
+}
+
+// ScoringActivity – активность клиента или его сделки
+type ScoringActivity struct {
+	Type string
+	At   time.Time
+}
+
+// ScoringDeal – сделка клиента
+type ScoringDeal struct {
+	Stage     string
+	Value     float64
+	Won       bool
+	Lost      bool
+	ChangedAt time.Time
+}
+
+// ScoringFacts – всё, что правила знают о клиенте
+type ScoringFacts struct {
+	OwnerID    *string
+	Fields     map[string]string
+	Tags       []string
+	Activities []ScoringActivity // новые сверху
+	Deals      []ScoringDeal
+}
+
+// LoadScoringFacts собирает данные клиента для расчёта оценки
+func LoadScoringFacts(ctx context.Context, customerID string) (*ScoringFacts, error) {
+	f := &ScoringFacts{Fields: map[string]string{}}
+	var name, email, phone, company, status, source, city, responsible, comment, notes string
+	var customFields []byte
+	err := database.Pool.QueryRow(ctx, `
+		SELECT user_id::text, name, email, COALESCE(phone, ''), COALESCE(company, ''), COALESCE(status, ''),
+			COALESCE(source, ''), COALESCE(city, ''), COALESCE(responsible, ''), COALESCE(comment, ''),
+			COALESCE(notes, ''), custom_fields
+		FROM crm_customers WHERE id::text = $1 AND deleted_at IS NULL
+	`, customerID).Scan(&f.OwnerID, &name, &email, &phone, &company, &status, &source, &city, &responsible, &comment, &notes, &customFields)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrLeadScoreNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if IsPlaceholderLeadEmail(email) {
+		email = ""
+	}
+	for k, v := range map[string]string{
+		"name": name, "email": email, "phone": phone, "company": company, "status": status, "source": source,
+		"city": city, "responsible": responsible, "comment": comment, "notes": notes,
+	} {
+		f.Fields[k] = strings.TrimSpace(v)
+	}
+	var custom map[string]interface{}
+	if len(customFields) > 0 && json.Unmarshal(customFields, &custom) == nil {
+		for k, v := range custom {
+			if v != nil {
+				f.Fields[LeadCustomTargetPrefix+k] = strings.TrimSpace(fmt.Sprint(v))
+			}
+		}
+	}
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT t.name FROM customer_tags ct JOIN tags t ON t.id = ct.tag_id WHERE ct.customer_id::text = $1 AND t.deleted_at IS NULL
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var tag string
+		if err := rows.Scan(&tag); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		f.Tags = append(f.Tags, tag)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.Pool.Query(ctx, `
+		SELECT d.stage, d.value, COALESCE(ps.is_won, false), COALESCE(ps.is_lost, false),
+			COALESCE(d.stage_changed_at, d.created_at, NOW())
+		FROM crm_deals d
+		LEFT JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+		WHERE d.customer_id::text = $1 AND d.deleted_at IS NULL
+	`, customerID)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var d ScoringDeal
+		if err := rows.Scan(&d.Stage, &d.Value, &d.Won, &d.Lost, &d.ChangedAt); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		f.Deals = append(f.Deals, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Активности по самому клиенту и по его сделкам
+	rows, err = database.Pool.Query(ctx, `
+		SELECT activity_type, created_at FROM activities
+		WHERE deleted_at IS NULL
+		  AND ((entity_type = 'customer' AND entity_id::text = $1)
+		   OR (entity_type = 'deal' AND entity_id::text IN (SELECT id::text FROM crm_deals WHERE customer_id::text = $1 AND deleted_at IS NULL)))
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, customerID, scoringActivityLimit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var a ScoringActivity
+		if err := rows.Scan(&a.Type, &a.At); err != nil {
+			return nil, err
+		}
+		f.Activities = append(f.Activities, a)
+	}
+	return f, rows.Err()
+}
+
+// ScoreContribution – вклад сработавшего правила в оценку
+type ScoreContribution struct {
+	RuleID    string     `json:"rule_id"`
+	Name      string     `json:"name"`
+	Criterion string     `json:"criterion"`
+	Points    float64    `json:"points"`                // с учётом затухания
+	RawPoints float64    `json:"raw_points"`            // до затухания
+	Decay     float64    `json:"decay,omitempty"`       // множитель затухания, если применялся
+	Detail    string     `json:"detail,omitempty"`      // почему правило сработало
+	Evidence  *time.Time `json:"evidence_at,omitempty"` // от этого момента считается затухание
+}
+
+// LeadScore – рассчитанная оценка клиента с разбором по правилам
+type LeadScore struct {
+	CustomerID    string              `json:"customer_id"`
+	ModelID       *string             `json:"model_id,omitempty"`
+	Score         float64             `json:"score"`  // 0..100
+	Points        float64             `json:"points"` // сумма вкладов до ограничения 0..100
+	Contributions []ScoreContribution `json:"contributions"`
+	ComputedAt    time.Time           `json:"computed_at"`
+}
+
+// Evaluate считает оценку клиента по модели на момент now
+func (m *ScoringModel) Evaluate(f *ScoringFacts, now time.Time) *LeadScore {
+	s := &LeadScore{Contributions: []ScoreContribution{}, ComputedAt: now}
+	if m.ID != "" {
+		id := m.ID
+		s.ModelID = &id
+	}
+	for _, r := range m.Rules {
+		if r.Disabled {
+			continue
+		}
+		points, detail, evidence, ok := r.evaluate(f, now)
+		if !ok || points == 0 {
+			continue
+		}
+		c := ScoreContribution{RuleID: r.ID, Name: r.Name, Criterion: r.Criterion, RawPoints: points, Points: points, Detail: detail}
+		if !evidence.IsZero() {
+			at := evidence
+			c.Evidence = &at
+			if r.Decays && m.DecayHalfLifeDays > 0 {
+				days := now.Sub(evidence).Hours() / 24
+				if days > 0 {
+					c.Decay = math.Round(math.Pow(0.5, days/float64(m.DecayHalfLifeDays))*1000) / 1000
+					c.Points = points * c.Decay
+				}
+			}
+		}
+		c.Points = math.Round(c.Points*100) / 100
+		s.Points += c.Points
+		s.Contributions = append(s.Contributions, c)
+	}
+	s.Points = math.Round(s.Points*100) / 100
+	s.Score = math.Max(0, math.Min(ScoreMax, s.Points))
+	return s
+}
+
+// evaluate проверяет правило: баллы до затухания, пояснение и момент последнего подтверждения
+func (r *ScoringRule) evaluate(f *ScoringFacts, now time.Time) (points float64, detail string, evidence time.Time, ok bool) {
+	switch r.Criterion {
+	case ScoringCriterionField:
+		value := f.Fields[r.Field]
+		if matchScoringValue(r.Operator, value, r.Values) {
+			return r.Points, fmt.Sprintf("%s = %q", r.Field, value), time.Time{}, true
+		}
+	case ScoringCriterionSource:
+		value := f.Fields["source"]
+		if matchScoringValue(r.Operator, value, r.Values) {
+			return r.Points, fmt.Sprintf("source = %q", value), time.Time{}, true
+		}
+	case ScoringCriterionTag:
+		for _, tag := range f.Tags {
+			if containsFold(r.Values, tag) {
+				return r.Points, "tag " + tag, time.Time{}, true
+			}
+		}
+	case ScoringCriterionActivityRecency:
+		for _, a := range f.Activities {
+			if len(r.Values) > 0 && !containsFold(r.Values, a.Type) {
+				continue
+			}
+			if now.Sub(a.At) <= time.Duration(r.WithinDays)*24*time.Hour {
+				return r.Points, fmt.Sprintf("last %s at %s", a.Type, a.At.Format(time.RFC3339)), a.At, true
+			}
+			break
+		}
+	case ScoringCriterionActivityCount, ScoringCriterionEmailEngagement:
+		types := r.Values
+		if len(types) == 0 && r.Criterion == ScoringCriterionEmailEngagement {
+			types = ScoringEmailActivityTypes
+		}
+		count := 0
+		for _, a := range f.Activities {
+			if now.Sub(a.At) > time.Duration(r.WithinDays)*24*time.Hour {
+				break
+			}
+			if len(types) > 0 && !containsFold(types, a.Type) {
+				continue
+			}
+			if count == 0 {
+				evidence = a.At
+			}
+			count++
+		}
+		return r.itemPoints(count, fmt.Sprintf("%d in %d days", count, r.WithinDays), evidence)
+	case ScoringCriterionDealStage:
+		count := 0
+		for _, d := range f.Deals {
+			if !dealMatchesStage(d, r.Values) {
+				continue
+			}
+			count++
+			if d.ChangedAt.After(evidence) {
+				evidence = d.ChangedAt
+			}
+		}
+		return r.itemPoints(count, fmt.Sprintf("%d deal(s) at %s", count, strings.Join(r.Values, ", ")), evidence)
+	case ScoringCriterionDealValue:
+		var total float64
+		for _, d := range f.Deals {
+			if !d.Lost {
+				total += d.Value
+			}
+		}
+		if total >= r.Min {
+			return r.Points, fmt.Sprintf("deals total %.2f", total), time.Time{}, true
+		}
+	}
+	return 0, "", time.Time{}, false
+}
+
+// itemPoints – баллы для счётных правил: за каждую единицу (с потолком) или за достижение порога
+func (r *ScoringRule) itemPoints(count int, detail string, evidence time.Time) (float64, string, time.Time, bool) {
+	if count == 0 {
+		return 0, "", time.Time{}, false
+	}
+	if r.PerItem {
+		points := r.Points * float64(count)
+		if r.MaxPoints > 0 && math.Abs(points) > r.MaxPoints {
+			points = math.Copysign(r.MaxPoints, points)
+		}
+		return points, detail, evidence, true
+	}
+	if float64(count) < math.Max(r.Min, 1) {
+		return 0, "", time.Time{}, false
+	}
+	return r.Points, detail, evidence, true
+}
+
+func dealMatchesStage(d ScoringDeal, stages []string) bool {
+	for _, s := range stages {
+		switch strings.ToLower(s) {
+		case ScoringStageWon:
+			if d.Won {
+				return true
+			}
+		case ScoringStageLost:
+			if d.Lost {
+				return true
+			}
+		case ScoringStageOpen:
+			if !d.Won && !d.Lost {
+				return true
+			}
+		default:
+			if strings.EqualFold(s, d.Stage) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func matchScoringValue(op, value string, values []string) bool {
+	switch op {
+	case ScoringOpNotEmpty:
+		return value != ""
+	case ScoringOpEquals:
+		return containsFold(values, value)
+	case ScoringOpContains:
+		lower := strings.ToLower(value)
+		for _, v := range values {
+			if v != "" && strings.Contains(lower, strings.ToLower(v)) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+const scoringModelColumns = `id, user_id::text, rules, decay_half_life_days, updated_at`
+
+func scanScoringModel(row pgx.Row) (*ScoringModel, error) {
+	var m ScoringModel
+	var rules []byte
+	var updatedAt time.Time
+	if err := row.Scan(&m.ID, &m.UserID, &rules, &m.DecayHalfLifeDays, &updatedAt); err != nil {
+		return nil, err
+	}
+	m.UpdatedAt = &updatedAt
+	if err := json.Unmarshal(rules, &m.Rules); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// GetScoringModel возвращает модель рабочего пространства (nil – общую) без подстановки запасных
+func GetScoringModel(ctx context.Context, ownerID *string) (*ScoringModel, error) {
+	m, err := scanScoringModel(database.Pool.QueryRow(ctx, `
+		SELECT `+scoringModelColumns+` FROM crm_scoring_models WHERE user_id IS NOT DISTINCT FROM $1::uuid
+	`, ownerID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrScoringModelNotFound
+	}
+	return m, err
+}
+
+// EffectiveScoringModel – модель, по которой оцениваются клиенты владельца:
+// своя, иначе общая, иначе встроенная
+func EffectiveScoringModel(ctx context.Context, ownerID *string) (*ScoringModel, error) {
+	m, err := scanScoringModel(database.Pool.QueryRow(ctx, `
+		SELECT `+scoringModelColumns+` FROM crm_scoring_models
+		WHERE user_id IS NULL OR user_id = $1::uuid
+		ORDER BY user_id NULLS LAST
+		LIMIT 1
+	`, ownerID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return DefaultScoringModel(), nil
+	}
+	return m, err
+}
+
+// SaveScoringModel сохраняет модель рабочего пространства (создаёт или заменяет)
+func SaveScoringModel(ctx context.Context, m *ScoringModel, updatedBy string) error {
+	rules, err := json.Marshal(m.Rules)
+	if err != nil {
+		return err
+	}
+	var updatedAt time.Time
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_scoring_models (user_id, rules, decay_half_life_days, updated_by)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (COALESCE(user_id::text, '')) DO UPDATE
+		SET rules = EXCLUDED.rules, decay_half_life_days = EXCLUDED.decay_half_life_days,
+			updated_by = EXCLUDED.updated_by, updated_at = NOW()
+		RETURNING id, updated_at
+	`, m.UserID, rules, m.DecayHalfLifeDays, updatedBy).Scan(&m.ID, &updatedAt)
+	if err != nil {
+		return err
+	}
+	m.BuiltIn = false
+	m.UpdatedAt = &updatedAt
+	return nil
+}
+
+// DeleteScoringModel удаляет модель рабочего пространства – снова действует общая или встроенная
+func DeleteScoringModel(ctx context.Context, ownerID *string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_scoring_models WHERE user_id IS NOT DISTINCT FROM $1::uuid`, ownerID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrScoringModelNotFound
+	}
+	return nil
+}
+
+// RecalculateLeadScore пересчитывает и сохраняет оценку клиента
+func RecalculateLeadScore(ctx context.Context, customerID string) (*LeadScore, error) {
+	facts, err := LoadScoringFacts(ctx, customerID)
+	if err != nil {
+		return nil, err
+	}
+	model, err := EffectiveScoringModel(ctx, facts.OwnerID)
+	if err != nil {
+		return nil, err
+	}
+	score := model.Evaluate(facts, time.Now())
+	score.CustomerID = customerID
+	return score, saveLeadScore(ctx, score)
+}
+
+func saveLeadScore(ctx context.Context, s *LeadScore) error {
+	contributions, err := json.Marshal(s.Contributions)
+	if err != nil {
+		return err
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO crm_lead_scores (customer_id, model_id, score, contributions, computed_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (customer_id) DO UPDATE
+		SET model_id = EXCLUDED.model_id, score = EXCLUDED.score,
+			contributions = EXCLUDED.contributions, computed_at = EXCLUDED.computed_at
+	`, s.CustomerID, s.ModelID, s.Score, contributions, s.ComputedAt)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `UPDATE crm_customers SET lead_score = $2 WHERE id = $1`, s.CustomerID, s.Score/ScoreMax); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// GetLeadScore возвращает сохранённую оценку клиента с разбором
+func GetLeadScore(ctx context.Context, customerID string) (*LeadScore, error) {
+	s := LeadScore{CustomerID: customerID}
+	var contributions []byte
+	err := database.Pool.QueryRow(ctx, `
+		SELECT model_id::text, score, contributions, computed_at FROM crm_lead_scores WHERE customer_id::text = $1
+	`, customerID).Scan(&s.ModelID, &s.Score, &contributions, &s.ComputedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrLeadScoreNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(contributions, &s.Contributions); err != nil {
+		return nil, err
+	}
+	for _, c := range s.Contributions {
+		s.Points += c.Points
+	}
+	s.Points = math.Round(s.Points*100) / 100
+	return &s, nil
+}
+
+// StaleLeadScoreCustomers – клиенты без оценки или с оценкой старше olderThan, сначала самые давние
+func StaleLeadScoreCustomers(ctx context.Context, olderThan time.Duration, limit int) ([]string, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT c.id::text FROM crm_customers c
+		LEFT JOIN crm_lead_scores s ON s.customer_id = c.id
+		WHERE c.deleted_at IS NULL AND (s.computed_at IS NULL OR s.computed_at < NOW() - $1::interval)
+		ORDER BY s.computed_at NULLS FIRST
+		LIMIT $2
+	`, fmt.Sprintf("%d seconds", int(olderThan.Seconds())), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ScoringCustomerIDs – клиенты рабочего пространства (nil – все) постранично по ID, начиная после afterID
+func ScoringCustomerIDs(ctx context.Context, ownerID *string, afterID string, limit int) ([]string, error) {
+	query := `SELECT id::text FROM crm_customers WHERE id::text > $1 AND deleted_at IS NULL`
+	args := []interface{}{afterID, limit}
+	if ownerID != nil {
+		query += ` AND user_id = $3::uuid`
+		args = append(args, *ownerID)
+	}
+	rows, err := database.Pool.Query(ctx, query+` ORDER BY id::text LIMIT $2`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+// ScoringRuleStats – как часто правило срабатывает у клиентов с выигранной сделкой и без неё
+type ScoringRuleStats struct {
+	RuleID          string  `json:"rule_id"`
+	Name            string  `json:"name"`
+	Points          float64 `json:"points"`
+	Matched         int     `json:"matched"`
+	MatchedWon      int     `json:"matched_won"`
+	WinRateMatched  float64 `json:"win_rate_matched"`
+	WinRateOthers   float64 `json:"win_rate_others"`
+	SuggestedPoints float64 `json:"suggested_points"`
+}
+
+// ScoringSuggestion – статистика правил на выборке клиентов и предложенные по ней веса
+type ScoringSuggestion struct {
+	Customers   int                 `json:"customers"`
+	Won         int                 `json:"won"`
+	BaseWinRate float64             `json:"base_win_rate"`
+	Rules       []*ScoringRuleStats `json:"rules"`
+}
+
+// SuggestScoringWeights оценивает правила модели на клиентах рабочего пространства (до sample штук):
+// исход – есть ли у клиента выигранная сделка. Предложенный вес – разница долей выигранных
+// среди тех, у кого правило срабатывает, и остальных, в процентных пунктах (от -50 до 50).
+// Правила, которые сами смотрят на выигранные сделки, предсказывают исход тривиально – их вес
+// стоит оценивать по смыслу.
+func SuggestScoringWeights(ctx context.Context, m *ScoringModel, ownerID *string, sample int) (*ScoringSuggestion, error) {
+	ids, err := ScoringCustomerIDs(ctx, ownerID, "", sample)
+	if err != nil {
+		return nil, err
+	}
+	res := &ScoringSuggestion{Rules: make([]*ScoringRuleStats, len(m.Rules))}
+	for i, r := range m.Rules {
+		res.Rules[i] = &ScoringRuleStats{RuleID: r.ID, Name: r.Name, Points: r.Points}
+	}
+	othersWon := make([]int, len(m.Rules))
+	now := time.Now()
+	for _, id := range ids {
+		facts, err := LoadScoringFacts(ctx, id)
+		if errors.Is(err, ErrLeadScoreNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		won := false
+		for _, d := range facts.Deals {
+			won = won || d.Won
+		}
+		res.Customers++
+		if won {
+			res.Won++
+		}
+		for i, r := range m.Rules {
+			if _, _, _, ok := r.evaluate(facts, now); ok {
+				res.Rules[i].Matched++
+				if won {
+					res.Rules[i].MatchedWon++
+				}
+			} else if won {
+				othersWon[i]++
+			}
+		}
+	}
+	if res.Customers == 0 {
+		return res, nil
+	}
+	res.BaseWinRate = math.Round(float64(res.Won)/float64(res.Customers)*1000) / 1000
+	for i, st := range res.Rules {
+		if st.Matched > 0 {
+			st.WinRateMatched = math.Round(float64(st.MatchedWon)/float64(st.Matched)*1000) / 1000
+		}
+		if others := res.Customers - st.Matched; others > 0 {
+			st.WinRateOthers = math.Round(float64(othersWon[i])/float64(others)*1000) / 1000
+		}
+		if st.Matched == 0 || st.Matched == res.Customers {
+			// Правило срабатывает у всех или ни у кого – по выборке о нём ничего не сказать
+			st.SuggestedPoints = st.Points
+			continue
+		}
+		st.SuggestedPoints = math.Round(math.Max(-50, math.Min(50, (st.WinRateMatched-st.WinRateOthers)*100)))
+	}
+	return res, nil
+}
+
+// RecalculateLeadScores пересчитывает оценки всех клиентов рабочего пространства (nil – всех клиентов)
+// и возвращает число пересчитанных
+func RecalculateLeadScores(ctx context.Context, ownerID *string) (int, error) {
+	const batch = 500
+	done, after := 0, ""
+	for {
+		ids, err := ScoringCustomerIDs(ctx, ownerID, after, batch)
+		if err != nil {
+			return done, err
+		}
+		for _, id := range ids {
+			if _, err := RecalculateLeadScore(ctx, id); err != nil && !errors.Is(err, ErrLeadScoreNotFound) {
+				return done, err
+			}
+			done++
+		}
+		if len(ids) < batch {
+			return done, nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
@@ -12,6 +12,9 @@ type NotificationSettings struct {
     Events          []string  `json:"events"`
     CreatedAt       time.Time `json:"created_at"`
     UpdatedAt       time.Time `json:"updated_at"`
+
+    // За сколько минут до срока напоминать о задачах CRM (по умолчанию для новых задач)
+    TaskReminderOffsets []int `json:"task_reminder_offsets"`
 }
 
 // NotificationLog запись в логе уведомлений
@@ -0,0 +1,321 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Заказы из выигранных сделок. Хранятся в crm_orders и ведутся через API CRM: модуль logistics
+// держит заказы только в памяти и эту таблицу не читает. JSON-поля совпадают с Order/OrderProduct
+// модуля logistics, чтобы заказ можно было передать туда без преобразования, когда у логистики
+// появится своё хранилище. Одна сделка превращается не более чем в один заказ.
+
+var (
+	ErrOrderNotFound = errors.New("order not found")
+	ErrInvalidOrder  = errors.New("invalid order")
+	ErrDealNotWon    = errors.New("deal is not won")
+	ErrOrderExists   = errors.New("deal already has an order")
+)
+
+// Статусы заказа – те же, что у заказов модуля logistics
+const (
+	OrderStatusNew        = "new"
+	OrderStatusProcessing = "processing"
+	OrderStatusShipped    = "shipped"
+	OrderStatusDelivered  = "delivered"
+	OrderStatusCanceled   = "canceled"
+)
+
+var orderStatuses = map[string]bool{
+	OrderStatusNew: true, OrderStatusProcessing: true, OrderStatusShipped: true,
+	OrderStatusDelivered: true, OrderStatusCanceled: true,
+}
+
+var orderDeliveryTypes = map[string]bool{"pickup": true, "courier": true, "post": true}
+
+// ValidOrderStatus – известный статус заказа
+func ValidOrderStatus(status string) bool {
+	return orderStatuses[status]
+}
+
+// OrderProduct – товар в заказе
+type OrderProduct struct {
+	ProductID string  `json:"product_id"`
+	Name      string  `json:"name"`
+	SKU       string  `json:"sku"`
+	Quantity  float64 `json:"quantity"`
+	Price     float64 `json:"price"` // за единицу со скидкой и НДС
+	Total     float64 `json:"total"`
+}
+
+// OrderAddress – адрес доставки
+type OrderAddress struct {
+	City       string `json:"city"`
+	Street     string `json:"street"`
+	Building   string `json:"building"`
+	Apartment  string `json:"apartment"`
+	PostalCode string `json:"postal_code"`
+	Region     string `json:"region"`
+	Country    string `json:"country"`
+	Notes      string `json:"notes"`
+}
+
+// Order – заказ клиента
+type Order struct {
+	ID            string  `json:"id"`
+	UserID        *string `json:"user_id,omitempty"`
+	DealID        *string `json:"deal_id,omitempty"`
+	QuoteID       *string `json:"quote_id,omitempty"`
+	CustomerID    *string `json:"customer_id,omitempty"`
+	CustomerName  string  `json:"customer_name"`
+	CustomerPhone string  `json:"customer_phone"`
+	CustomerEmail string  `json:"customer_email"`
+
+	Products    []OrderProduct `json:"products"`
+	TotalAmount float64        `json:"total_amount"`
+	Currency    string         `json:"currency"`
+
+	DeliveryType    string       `json:"delivery_type"` // pickup, courier, post
+	DeliveryAddress OrderAddress `json:"delivery_address"`
+
+	Status         string `json:"status"`
+	TrackingNumber string `json:"tracking_number"`
+
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+	EstimatedDelivery *time.Time `json:"estimated_delivery,omitempty"`
+}
+
+// CanAccess – заказ видят владелец и администратор
+func (o *Order) CanAccess(userID string, isAdmin bool) bool {
+	return isAdmin || (o.UserID != nil && *o.UserID == userID)
+}
+
+const orderColumns = `id, user_id::text, deal_id::text, quote_id::text, customer_id::text, customer_name, customer_phone, customer_email,
+	products, total_amount, currency, delivery_type, delivery_address, status, tracking_number, created_at, updated_at, estimated_delivery`
+
+func scanOrder(row pgx.Row) (*Order, error) {
+	var o Order
+	var products, address []byte
+	err := row.Scan(&o.ID, &o.UserID, &o.DealID, &o.QuoteID, &o.CustomerID, &o.CustomerName, &o.CustomerPhone, &o.CustomerEmail,
+		&products, &o.TotalAmount, &o.Currency, &o.DeliveryType, &address, &o.Status, &o.TrackingNumber,
+		&o.CreatedAt, &o.UpdatedAt, &o.EstimatedDelivery)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(products, &o.Products); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(address, &o.DeliveryAddress); err != nil {
+		return nil, err
+	}
+	return &o, nil
+}
+
+// GetOrder возвращает заказ по ID
+func GetOrder(ctx context.Context, id string) (*Order, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrOrderNotFound
+	}
+	o, err := scanOrder(database.Pool.QueryRow(ctx, `SELECT `+orderColumns+` FROM crm_orders WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	return o, err
+}
+
+// GetDealOrder возвращает заказ сделки
+func GetDealOrder(ctx context.Context, dealID string) (*Order, error) {
+	o, err := scanOrder(database.Pool.QueryRow(ctx, `SELECT `+orderColumns+` FROM crm_orders WHERE deal_id = $1`, dealID))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrOrderNotFound
+	}
+	return o, err
+}
+
+// OrderFilter – отбор заказов
+type OrderFilter struct {
+	UserID  string
+	IsAdmin bool
+	Status  string
+	Limit   int
+	Offset  int
+}
+
+// ListOrders возвращает заказы (администратору – все) и их общее число
+func ListOrders(ctx context.Context, f OrderFilter) ([]*Order, int, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	if !f.IsAdmin {
+		args = append(args, f.UserID)
+		where = append(where, fmt.Sprintf("user_id::text = $%d", len(args)))
+	}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		where = append(where, fmt.Sprintf("status = $%d", len(args)))
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_orders WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+		SELECT %s FROM crm_orders WHERE %s
+		ORDER BY created_at DESC LIMIT $%d OFFSET $%d
+	`, orderColumns, cond, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	orders := []*Order{}
+	for rows.Next() {
+		o, err := scanOrder(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, total, rows.Err()
+}
+
+// CreateOrderFromDeal оформляет заказ по выигранной сделке. Товары берутся из принятого КП,
+// если оно есть, иначе из позиций сделки; сделка без позиций становится одной строкой на её сумму.
+// o задаёт доставку; клиент, товары и сумма заполняются здесь.
+func CreateOrderFromDeal(ctx context.Context, dealID string, o *Order) error {
+	o.DeliveryType = strings.TrimSpace(o.DeliveryType)
+	if o.DeliveryType == "" {
+		o.DeliveryType = "pickup"
+	}
+	if !orderDeliveryTypes[o.DeliveryType] {
+		return fmt.Errorf("%w: delivery_type must be pickup, courier or post", ErrInvalidOrder)
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Блокировка сделки: два одновременных оформления не создадут два заказа
+	var title string
+	var value float64
+	var won bool
+	var customerID string
+	err = tx.QueryRow(ctx, `
+		SELECT d.title, d.value, d.customer_id::text, d.user_id::text,
+			EXISTS (SELECT 1 FROM crm_pipeline_stages ps WHERE ps.pipeline_id = d.pipeline_id AND ps.code = d.stage AND ps.is_won)
+		FROM crm_deals d WHERE d.id = $1 AND d.deleted_at IS NULL
+		FOR UPDATE
+	`, dealID).Scan(&title, &value, &customerID, &o.UserID, &won)
+	if err != nil {
+		return err
+	}
+	if !won {
+		return ErrDealNotWon
+	}
+	var exists bool
+	if err := tx.QueryRow(ctx, `SELECT EXISTS (SELECT 1 FROM crm_orders WHERE deal_id = $1)`, dealID).Scan(&exists); err != nil {
+		return err
+	}
+	if exists {
+		return ErrOrderExists
+	}
+
+	err = tx.QueryRow(ctx, `SELECT name, COALESCE(phone, ''), email FROM crm_customers WHERE id = $1`, customerID).
+		Scan(&o.CustomerName, &o.CustomerPhone, &o.CustomerEmail)
+	if err != nil {
+		return err
+	}
+	if IsPlaceholderLeadEmail(o.CustomerEmail) {
+		o.CustomerEmail = ""
+	}
+	o.CustomerID = &customerID
+	o.DealID = &dealID
+
+	var items []*DealItem
+	var quoteID string
+	var quoteItems []byte
+	err = tx.QueryRow(ctx, `
+		SELECT id::text, items FROM crm_quotes
+		WHERE deal_id = $1 AND status = $2
+		ORDER BY created_at DESC LIMIT 1
+	`, dealID, QuoteStatusAccepted).Scan(&quoteID, &quoteItems)
+	switch {
+	case err == nil:
+		if err := json.Unmarshal(quoteItems, &items); err != nil {
+			return err
+		}
+		o.QuoteID = &quoteID
+	case errors.Is(err, pgx.ErrNoRows):
+		if items, err = GetDealItems(ctx, dealID); err != nil {
+			return err
+		}
+	default:
+		return err
+	}
+
+	o.Currency = DefaultProductCurrency
+	o.Products = []OrderProduct{}
+	if len(items) == 0 {
+		o.Products = append(o.Products, OrderProduct{Name: title, Quantity: 1, Price: value, Total: value})
+		o.TotalAmount = value
+	} else {
+		totals := SumDealItems(items)
+		o.Currency, o.TotalAmount = totals.Currency, totals.Total
+		for _, i := range items {
+			p := OrderProduct{Name: i.Name, SKU: i.SKU, Quantity: i.Quantity, Total: i.Total, Price: roundMoney(i.Total / i.Quantity)}
+			if i.ProductID != nil {
+				p.ProductID = *i.ProductID
+			}
+			o.Products = append(o.Products, p)
+		}
+	}
+	o.Status = OrderStatusNew
+
+	products, err := json.Marshal(o.Products)
+	if err != nil {
+		return err
+	}
+	address, err := json.Marshal(o.DeliveryAddress)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO crm_orders (user_id, deal_id, quote_id, customer_id, customer_name, customer_phone, customer_email,
+			products, total_amount, currency, delivery_type, delivery_address, status, estimated_delivery)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id, created_at, updated_at
+	`, o.UserID, o.DealID, o.QuoteID, o.CustomerID, o.CustomerName, o.CustomerPhone, o.CustomerEmail,
+		products, o.TotalAmount, o.Currency, o.DeliveryType, address, o.Status, o.EstimatedDelivery).Scan(&o.ID, &o.CreatedAt, &o.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// UpdateOrderStatus меняет статус и трек-номер заказа
+func UpdateOrderStatus(ctx context.Context, o *Order) error {
+	if !ValidOrderStatus(o.Status) {
+		return fmt.Errorf("%w: status must be new, processing, shipped, delivered or canceled", ErrInvalidOrder)
+	}
+	err := database.Pool.QueryRow(ctx, `
+		UPDATE crm_orders SET status = $2, tracking_number = $3, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, o.ID, o.Status, o.TrackingNumber).Scan(&o.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrOrderNotFound
+	}
+	return err
+}
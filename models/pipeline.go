@@ -0,0 +1,536 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Воронки продаж. Рабочее пространство CRM – владелец данных (user_id), поэтому
+// у воронки с user_id = NULL общий доступ (её видят все), остальные видит только владелец.
+// crm_deals.stage хранит код этапа, а crm_deals.pipeline_id – воронку, к которой этап относится.
+
+var (
+	ErrPipelineNotFound = errors.New("pipeline not found")
+	ErrStageNotFound    = errors.New("stage not found")
+	ErrPipelineInUse    = errors.New("pipeline or stage still has deals")
+	ErrInvalidPipeline  = errors.New("invalid pipeline")
+)
+
+// invalidf – ошибка валидации воронки, распознаётся через errors.Is(err, ErrInvalidPipeline)
+func invalidf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidPipeline}, args...)...)
+}
+
+var stageCodePattern = regexp.MustCompile(`^[a-z0-9_]{1,50}$`)
+
+// Pipeline – воронка продаж с упорядоченными этапами
+type Pipeline struct {
+	ID        string          `json:"id"`
+	UserID    *string         `json:"user_id,omitempty"`
+	Name      string          `json:"name"`
+	IsDefault bool            `json:"is_default"`
+	SortOrder int             `json:"sort_order"`
+	Stages    []PipelineStage `json:"stages"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+}
+
+// PipelineStage – этап воронки. Probability – вероятность по умолчанию для сделок на этапе,
+// RottingDays – через сколько дней без смены этапа сделка считается «протухшей»
+type PipelineStage struct {
+	ID          string `json:"id"`
+	PipelineID  string `json:"pipeline_id"`
+	Code        string `json:"code"`
+	Name        string `json:"name"`
+	SortOrder   int    `json:"sort_order"`
+	Probability int    `json:"probability"`
+	IsWon       bool   `json:"is_won"`
+	IsLost      bool   `json:"is_lost"`
+	RottingDays *int   `json:"rotting_days,omitempty"`
+}
+
+// IsClosed – этап завершает сделку (выиграна или проиграна)
+func (s PipelineStage) IsClosed() bool {
+	return s.IsWon || s.IsLost
+}
+
+// Validate проверяет поля этапа перед сохранением
+func (s PipelineStage) Validate() error {
+	if !stageCodePattern.MatchString(s.Code) {
+		return invalidf("stage code %q must match %s", s.Code, stageCodePattern)
+	}
+	if s.Name == "" {
+		return invalidf("stage %s: name is required", s.Code)
+	}
+	if s.Probability < 0 || s.Probability > 100 {
+		return invalidf("stage %s: probability must be between 0 and 100", s.Code)
+	}
+	if s.IsWon && s.IsLost {
+		return invalidf("stage %s cannot be both won and lost", s.Code)
+	}
+	if s.RottingDays != nil && *s.RottingDays <= 0 {
+		return invalidf("stage %s: rotting_days must be positive", s.Code)
+	}
+	return nil
+}
+
+// Stage возвращает этап воронки по коду
+func (p *Pipeline) Stage(code string) (*PipelineStage, bool) {
+	for i := range p.Stages {
+		if p.Stages[i].Code == code {
+			return &p.Stages[i], true
+		}
+	}
+	return nil, false
+}
+
+// FirstStage – этап, на который попадают новые сделки без явного этапа
+func (p *Pipeline) FirstStage() (*PipelineStage, bool) {
+	for i := range p.Stages {
+		if !p.Stages[i].IsClosed() {
+			return &p.Stages[i], true
+		}
+	}
+	return nil, false
+}
+
+// CanView – пользователь видит общие воронки и свои; администратор – все
+func (p *Pipeline) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || p.UserID == nil || *p.UserID == userID
+}
+
+// CanEdit – общие воронки меняет только администратор
+func (p *Pipeline) CanEdit(userID string, isAdmin bool) bool {
+	return isAdmin || (p.UserID != nil && *p.UserID == userID)
+}
+
+// DefaultPipelineStages – этапы, которые раньше были зашиты в код; ими засевается общая воронка
+func DefaultPipelineStages() []PipelineStage {
+	days := func(n int) *int { return &n }
+	return []PipelineStage{
+		{Code: "lead", Name: "Лид", SortOrder: 1, Probability: 10, RottingDays: days(14)},
+		{Code: "negotiation", Name: "Переговоры", SortOrder: 2, Probability: 40, RottingDays: days(14)},
+		{Code: "proposal", Name: "Предложение", SortOrder: 3, Probability: 70, RottingDays: days(7)},
+		{Code: "closed_won", Name: "Успешно закрыта", SortOrder: 4, Probability: 100, IsWon: true},
+		{Code: "closed_lost", Name: "Проиграна", SortOrder: 5, Probability: 0, IsLost: true},
+	}
+}
+
+// OpenDealSQL – условие «сделка не закрыта» для запросов по crm_deals с алиасом alias
+func OpenDealSQL(alias string) string {
+	return fmt.Sprintf(`NOT EXISTS (
+		SELECT 1 FROM crm_pipeline_stages ps
+		WHERE ps.pipeline_id = %[1]s.pipeline_id AND ps.code = %[1]s.stage AND (ps.is_won OR ps.is_lost)
+	)`, alias)
+}
+
+const pipelineColumns = `id, user_id::text, name, is_default, sort_order, created_at, updated_at`
+
+func scanPipeline(row pgx.Row) (*Pipeline, error) {
+	var p Pipeline
+	err := row.Scan(&p.ID, &p.UserID, &p.Name, &p.IsDefault, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// loadStages заполняет этапы у переданных воронок
+func loadStages(ctx context.Context, pipelines ...*Pipeline) error {
+	if len(pipelines) == 0 {
+		return nil
+	}
+	byID := make(map[string]*Pipeline, len(pipelines))
+	ids := make([]string, 0, len(pipelines))
+	for _, p := range pipelines {
+		p.Stages = []PipelineStage{}
+		byID[p.ID] = p
+		ids = append(ids, p.ID)
+	}
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT id, pipeline_id, code, name, sort_order, probability, is_won, is_lost, rotting_days
+		FROM crm_pipeline_stages
+		WHERE pipeline_id = ANY($1::uuid[])
+		ORDER BY sort_order, code
+	`, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var s PipelineStage
+		if err := rows.Scan(&s.ID, &s.PipelineID, &s.Code, &s.Name, &s.SortOrder,
+			&s.Probability, &s.IsWon, &s.IsLost, &s.RottingDays); err != nil {
+			return err
+		}
+		if p, ok := byID[s.PipelineID]; ok {
+			p.Stages = append(p.Stages, s)
+		}
+	}
+	return rows.Err()
+}
+
+// ListPipelines возвращает воронки, доступные пользователю, вместе с этапами
+func ListPipelines(ctx context.Context, userID string, isAdmin bool) ([]*Pipeline, error) {
+	query := `SELECT ` + pipelineColumns + ` FROM crm_pipelines`
+	args := []interface{}{}
+	if !isAdmin {
+		query += ` WHERE user_id IS NULL OR user_id = $1`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY user_id NULLS FIRST, sort_order, name`
+
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pipelines := []*Pipeline{}
+	for rows.Next() {
+		p, err := scanPipeline(rows)
+		if err != nil {
+			return nil, err
+		}
+		pipelines = append(pipelines, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if err := loadStages(ctx, pipelines...); err != nil {
+		return nil, err
+	}
+	return pipelines, nil
+}
+
+// GetPipeline возвращает воронку с этапами
+func GetPipeline(ctx context.Context, id string) (*Pipeline, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrPipelineNotFound
+	}
+	p, err := scanPipeline(database.Pool.QueryRow(ctx,
+		`SELECT `+pipelineColumns+` FROM crm_pipelines WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPipelineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := loadStages(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// GetDefaultPipeline возвращает воронку по умолчанию пользователя, а если своей нет – общую
+func GetDefaultPipeline(ctx context.Context, userID string) (*Pipeline, error) {
+	var owner interface{}
+	if userID != "" {
+		owner = userID
+	}
+	p, err := scanPipeline(database.Pool.QueryRow(ctx, `
+		SELECT `+pipelineColumns+` FROM crm_pipelines
+		WHERE is_default AND (user_id IS NULL OR user_id = $1)
+		ORDER BY user_id NULLS LAST
+		LIMIT 1
+	`, owner))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrPipelineNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := loadStages(ctx, p); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+func validateStages(stages []PipelineStage) error {
+	if len(stages) == 0 {
+		return invalidf("pipeline must have at least one stage")
+	}
+	seen := make(map[string]bool, len(stages))
+	open := false
+	for _, s := range stages {
+		if err := s.Validate(); err != nil {
+			return err
+		}
+		if seen[s.Code] {
+			return invalidf("duplicate stage code %s", s.Code)
+		}
+		seen[s.Code] = true
+		open = open || !s.IsClosed()
+	}
+	if !open {
+		return invalidf("pipeline must have at least one open stage")
+	}
+	return nil
+}
+
+// clearDefault снимает флаг is_default со всех воронок владельца; вызывается до установки
+// нового значения, т.к. уникальный индекс допускает одну воронку по умолчанию на владельца
+func clearDefault(ctx context.Context, tx pgx.Tx, userID *string) error {
+	_, err := tx.Exec(ctx, `
+		UPDATE crm_pipelines SET is_default = false
+		WHERE is_default AND user_id IS NOT DISTINCT FROM $1::uuid
+	`, userID)
+	return err
+}
+
+func insertStage(ctx context.Context, tx pgx.Tx, pipelineID string, s *PipelineStage) error {
+	s.PipelineID = pipelineID
+	return tx.QueryRow(ctx, `
+		INSERT INTO crm_pipeline_stages (pipeline_id, code, name, sort_order, probability, is_won, is_lost, rotting_days)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, pipelineID, s.Code, s.Name, s.SortOrder, s.Probability, s.IsWon, s.IsLost, s.RottingDays).Scan(&s.ID)
+}
+
+// CreatePipeline создаёт воронку вместе с этапами. Если SortOrder этапов не задан,
+// используется порядок в списке.
+func CreatePipeline(ctx context.Context, p *Pipeline) error {
+	if p.Name == "" {
+		return invalidf("pipeline name is required")
+	}
+	for i := range p.Stages {
+		if p.Stages[i].SortOrder == 0 {
+			p.Stages[i].SortOrder = i + 1
+		}
+	}
+	if err := validateStages(p.Stages); err != nil {
+		return err
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if p.IsDefault {
+		if err := clearDefault(ctx, tx, p.UserID); err != nil {
+			return err
+		}
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO crm_pipelines (user_id, name, is_default, sort_order)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, created_at, updated_at
+	`, p.UserID, p.Name, p.IsDefault, p.SortOrder).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	for i := range p.Stages {
+		if err := insertStage(ctx, tx, p.ID, &p.Stages[i]); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
+
+// UpdatePipeline меняет название, порядок и признак воронки по умолчанию
+func UpdatePipeline(ctx context.Context, p *Pipeline) error {
+	if p.Name == "" {
+		return invalidf("pipeline name is required")
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if p.IsDefault {
+		if err := clearDefault(ctx, tx, p.UserID); err != nil {
+			return err
+		}
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE crm_pipelines SET name = $1, is_default = $2, sort_order = $3, updated_at = NOW()
+		WHERE id = $4
+	`, p.Name, p.IsDefault, p.SortOrder, p.ID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrPipelineNotFound
+	}
+	return tx.Commit(ctx)
+}
+
+// DeletePipeline удаляет воронку без сделок
+func DeletePipeline(ctx context.Context, id string) error {
+	var deals int
+	if err := database.Pool.QueryRow(ctx,
+		`SELECT COUNT(*) FROM crm_deals WHERE pipeline_id = $1`, id).Scan(&deals); err != nil {
+		return err
+	}
+	if deals > 0 {
+		return ErrPipelineInUse
+	}
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_pipelines WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrPipelineNotFound
+	}
+	return nil
+}
+
+// AddStage добавляет этап в конец воронки (или на позицию SortOrder, если она задана)
+func AddStage(ctx context.Context, p *Pipeline, s *PipelineStage) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	if _, exists := p.Stage(s.Code); exists {
+		return invalidf("duplicate stage code %s", s.Code)
+	}
+	if s.SortOrder == 0 {
+		s.SortOrder = len(p.Stages) + 1
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	if err := insertStage(ctx, tx, p.ID, s); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// UpdateStage меняет этап. Смена кода переносит на новый код и сделки этого этапа.
+func UpdateStage(ctx context.Context, p *Pipeline, s *PipelineStage) error {
+	if err := s.Validate(); err != nil {
+		return err
+	}
+	var current *PipelineStage
+	for i := range p.Stages {
+		if p.Stages[i].ID == s.ID {
+			current = &p.Stages[i]
+		} else if p.Stages[i].Code == s.Code {
+			return invalidf("duplicate stage code %s", s.Code)
+		}
+	}
+	if current == nil {
+		return ErrStageNotFound
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	_, err = tx.Exec(ctx, `
+		UPDATE crm_pipeline_stages
+		SET code = $1, name = $2, sort_order = $3, probability = $4, is_won = $5, is_lost = $6, rotting_days = $7
+		WHERE id = $8
+	`, s.Code, s.Name, s.SortOrder, s.Probability, s.IsWon, s.IsLost, s.RottingDays, s.ID)
+	if err != nil {
+		return err
+	}
+	if current.Code != s.Code {
+		_, err = tx.Exec(ctx, `
+			UPDATE crm_deals SET stage = $1 WHERE pipeline_id = $2 AND stage = $3
+		`, s.Code, p.ID, current.Code)
+		if err != nil {
+			return err
+		}
+	}
+	s.PipelineID = p.ID
+	return tx.Commit(ctx)
+}
+
+// DeleteStage удаляет этап. Сделки этапа переносятся на moveTo; без moveTo этап
+// со сделками удалить нельзя.
+func DeleteStage(ctx context.Context, p *Pipeline, stageID, moveTo string) error {
+	var stage *PipelineStage
+	for i := range p.Stages {
+		if p.Stages[i].ID == stageID {
+			stage = &p.Stages[i]
+		}
+	}
+	if stage == nil {
+		return ErrStageNotFound
+	}
+	remaining := make([]PipelineStage, 0, len(p.Stages)-1)
+	for _, s := range p.Stages {
+		if s.ID != stageID {
+			remaining = append(remaining, s)
+		}
+	}
+	if err := validateStages(remaining); err != nil {
+		return err
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	var deals int
+	if err := tx.QueryRow(ctx, `SELECT COUNT(*) FROM crm_deals WHERE pipeline_id = $1 AND stage = $2`,
+		p.ID, stage.Code).Scan(&deals); err != nil {
+		return err
+	}
+	if deals > 0 {
+		target, ok := p.Stage(moveTo)
+		if moveTo == "" || !ok || target.ID == stageID {
+			return ErrPipelineInUse
+		}
+		_, err = tx.Exec(ctx, `
+			UPDATE crm_deals SET stage = $1, stage_changed_at = NOW(), updated_at = NOW()
+			WHERE pipeline_id = $2 AND stage = $3
+		`, target.Code, p.ID, stage.Code)
+		if err != nil {
+			return err
+		}
+	}
+	if _, err := tx.Exec(ctx, `DELETE FROM crm_pipeline_stages WHERE id = $1`, stageID); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// ReorderStages задаёт порядок этапов по списку их ID
+func ReorderStages(ctx context.Context, p *Pipeline, stageIDs []string) error {
+	if len(stageIDs) != len(p.Stages) {
+		return invalidf("stage_ids must list every stage of the pipeline")
+	}
+	known := make(map[string]bool, len(p.Stages))
+	for _, s := range p.Stages {
+		known[s.ID] = true
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for i, id := range stageIDs {
+		if !known[id] {
+			return ErrStageNotFound
+		}
+		delete(known, id)
+		if _, err := tx.Exec(ctx, `UPDATE crm_pipeline_stages SET sort_order = $1 WHERE id = $2`, i+1, id); err != nil {
+			return err
+		}
+	}
+	return tx.Commit(ctx)
+}
@@ -8,20 +8,21 @@ import (
 )
 
 type Plan struct {
-    ID              int             `json:"id" db:"id"`
-    Name            string          `json:"name" db:"name"`
-    Code            string          `json:"code" db:"code"`
-    Description     string          `json:"description" db:"description"`
-    PriceMonthly    float64         `json:"price_monthly" db:"price_monthly"`
-    PriceYearly     float64         `json:"price_yearly" db:"price_yearly"`
-    Currency        string          `json:"currency" db:"currency"`
-    Features        json.RawMessage `json:"features" db:"features"`
-    AICapabilities  json.RawMessage `json:"ai_capabilities" db:"ai_capabilities"`
-    MaxUsers        int             `json:"max_users" db:"max_users"`
-    IsActive        bool            `json:"is_active" db:"is_active"`
-    SortOrder       int             `json:"sort_order" db:"sort_order"`
-    CreatedAt       time.Time       `json:"created_at" db:"created_at"`
-    UpdatedAt       time.Time       `json:"updated_at" db:"updated_at"`
+    ID                 int             `json:"id" db:"id"`
+    Name               string          `json:"name" db:"name"`
+    Code               string          `json:"code" db:"code"`
+    Description        string          `json:"description" db:"description"`
+    PriceMonthly       float64         `json:"price_monthly" db:"price_monthly"`
+    PriceYearly        float64         `json:"price_yearly" db:"price_yearly"`
+    Currency           string          `json:"currency" db:"currency"`
+    Features           json.RawMessage `json:"features" db:"features"`
+    AICapabilities     json.RawMessage `json:"ai_capabilities" db:"ai_capabilities"`
+    MaxUsers           int             `json:"max_users" db:"max_users"`
+    RateLimitPerMinute int             `json:"rate_limit_per_minute" db:"rate_limit_per_minute"`
+    IsActive           bool            `json:"is_active" db:"is_active"`
+    SortOrder          int             `json:"sort_order" db:"sort_order"`
+    CreatedAt          time.Time       `json:"created_at" db:"created_at"`
+    UpdatedAt          time.Time       `json:"updated_at" db:"updated_at"`
 }
 
 // TableName возвращает имя таблицы
@@ -33,7 +34,7 @@ func (Plan) TableName() string {
 func GetAllPlans() ([]Plan, error) {
     rows, err := database.Pool.Query(context.Background(), `
         SELECT id, name, code, description, price_monthly, price_yearly, 
-               currency, features, ai_capabilities, max_users, is_active, 
+               currency, features, ai_capabilities, max_users, rate_limit_per_minute, is_active, 
                sort_order, created_at, updated_at
         FROM subscription_plans
         WHERE is_active = true
@@ -50,7 +51,7 @@ func GetAllPlans() ([]Plan, error) {
         err := rows.Scan(
             &p.ID, &p.Name, &p.Code, &p.Description, 
             &p.PriceMonthly, &p.PriceYearly, &p.Currency,
-            &p.Features, &p.AICapabilities, &p.MaxUsers,
+            &p.Features, &p.AICapabilities, &p.MaxUsers, &p.RateLimitPerMinute,
             &p.IsActive, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt,
         )
         if err != nil {
@@ -66,14 +67,14 @@ func GetPlanByCode(code string) (*Plan, error) {
     var p Plan
     err := database.Pool.QueryRow(context.Background(), `
         SELECT id, name, code, description, price_monthly, price_yearly, 
-               currency, features, ai_capabilities, max_users, is_active, 
+               currency, features, ai_capabilities, max_users, rate_limit_per_minute, is_active, 
                sort_order, created_at, updated_at
         FROM subscription_plans
         WHERE code = $1 AND is_active = true
     `, code).Scan(
         &p.ID, &p.Name, &p.Code, &p.Description, 
         &p.PriceMonthly, &p.PriceYearly, &p.Currency,
-        &p.Features, &p.AICapabilities, &p.MaxUsers,
+        &p.Features, &p.AICapabilities, &p.MaxUsers, &p.RateLimitPerMinute,
         &p.IsActive, &p.SortOrder, &p.CreatedAt, &p.UpdatedAt,
     )
     if err != nil {
@@ -82,6 +83,32 @@ func GetPlanByCode(code string) (*Plan, error) {
     return &p, nil
 }
 
+// GetUserRateLimit возвращает лимит запросов в минуту по активной подписке пользователя.
+// 0 – активной подписки нет, действует лимит по умолчанию.
+func GetUserRateLimit(ctx context.Context, userID string) (int, error) {
+    var perMinute int
+    err := database.Pool.QueryRow(ctx, `
+        SELECT COALESCE(MAX(p.rate_limit_per_minute), 0)
+        FROM user_subscriptions s
+        JOIN subscription_plans p ON p.id = s.plan_id
+        WHERE s.user_id = $1::uuid AND s.status = 'active' AND s.current_period_end > NOW()
+    `, userID).Scan(&perMinute)
+    return perMinute, err
+}
+
+// GetUserUploadLimitMB возвращает максимальный размер загружаемого файла (МБ) по активной подписке.
+// 0 – подписки нет или тариф лимит не задаёт, действует лимит по умолчанию.
+func GetUserUploadLimitMB(ctx context.Context, userID string) (int, error) {
+    var limit int
+    err := database.Pool.QueryRow(ctx, `
+        SELECT COALESCE(MAX(p.max_upload_mb), 0)
+        FROM user_subscriptions s
+        JOIN subscription_plans p ON p.id = s.plan_id
+        WHERE s.user_id = $1::uuid AND s.status = 'active' AND s.current_period_end > NOW()
+    `, userID).Scan(&limit)
+    return limit, err
+}
+
 // GetAICapabilities возвращает AI-возможности тарифа как map
 func (p *Plan) GetAICapabilities() map[string]interface{} {
     var caps map[string]interface{}
@@ -0,0 +1,417 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+
+	"subscription-system/database"
+)
+
+// Каталог товаров и позиции сделок. Прайс-лист устроен как воронки: товары с user_id = NULL
+// общие (их ведёт администратор), остальные видит только владелец. Цена в каталоге – без НДС.
+// Позиция сделки хранит копию артикула, названия, цены и ставки НДС на момент добавления,
+// поэтому правка прайса не меняет уже согласованные сделки. Сумма сделки (value) – итог позиций.
+
+var (
+	ErrProductNotFound = errors.New("product not found")
+	ErrInvalidProduct  = errors.New("invalid product")
+	ErrInvalidDealItem = errors.New("invalid deal item")
+)
+
+// invalidProductf – ошибка валидации товара, распознаётся через errors.Is(err, ErrInvalidProduct)
+func invalidProductf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidProduct}, args...)...)
+}
+
+// invalidDealItemf – ошибка валидации позиции сделки
+func invalidDealItemf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidDealItem}, args...)...)
+}
+
+const (
+	DefaultProductUnit     = "шт"
+	DefaultProductCurrency = "RUB"
+	DefaultProductVATRate  = 20
+	// maxDealItems – позиций в одной сделке
+	maxDealItems = 200
+)
+
+var currencyPattern = regexp.MustCompile(`^[A-Z]{3}$`)
+
+// roundMoney округляет до копеек; так считаются скидка и НДС каждой позиции
+func roundMoney(v float64) float64 {
+	return math.Round(v*100) / 100
+}
+
+// Product – товар или услуга прайс-листа
+type Product struct {
+	ID          string    `json:"id"`
+	UserID      *string   `json:"user_id,omitempty"`
+	SKU         string    `json:"sku"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Unit        string    `json:"unit"`
+	Price       float64   `json:"price"`
+	Currency    string    `json:"currency"`
+	VATRate     float64   `json:"vat_rate"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+}
+
+// Normalize проверяет товар и подставляет единицу и валюту по умолчанию
+func (p *Product) Normalize() error {
+	p.SKU = strings.TrimSpace(p.SKU)
+	p.Name = strings.TrimSpace(p.Name)
+	p.Unit = strings.TrimSpace(p.Unit)
+	p.Currency = strings.ToUpper(strings.TrimSpace(p.Currency))
+	if p.SKU == "" || len(p.SKU) > 64 {
+		return invalidProductf("sku is required (up to 64 characters)")
+	}
+	if p.Name == "" {
+		return invalidProductf("name is required")
+	}
+	if p.Unit == "" {
+		p.Unit = DefaultProductUnit
+	}
+	if p.Currency == "" {
+		p.Currency = DefaultProductCurrency
+	}
+	if !currencyPattern.MatchString(p.Currency) {
+		return invalidProductf("currency must be a 3-letter ISO code")
+	}
+	if p.Price < 0 {
+		return invalidProductf("price must not be negative")
+	}
+	if p.VATRate < 0 || p.VATRate > 100 {
+		return invalidProductf("vat_rate must be between 0 and 100")
+	}
+	p.Price = roundMoney(p.Price)
+	return nil
+}
+
+// CanView – пользователь видит общий прайс-лист и свои товары; администратор – все
+func (p *Product) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || p.UserID == nil || *p.UserID == userID
+}
+
+// CanEdit – общие товары меняет только администратор
+func (p *Product) CanEdit(userID string, isAdmin bool) bool {
+	return isAdmin || (p.UserID != nil && *p.UserID == userID)
+}
+
+const productColumns = `id, user_id::text, sku, name, description, unit, price, currency, vat_rate, active, created_at, updated_at`
+
+func scanProduct(row pgx.Row) (*Product, error) {
+	var p Product
+	err := row.Scan(&p.ID, &p.UserID, &p.SKU, &p.Name, &p.Description, &p.Unit, &p.Price,
+		&p.Currency, &p.VATRate, &p.Active, &p.CreatedAt, &p.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// ProductFilter – отбор товаров прайс-листа
+type ProductFilter struct {
+	UserID     string
+	IsAdmin    bool
+	Search     string // по артикулу и названию
+	ActiveOnly bool
+	Limit      int
+	Offset     int
+}
+
+// ListProducts возвращает доступные пользователю товары и их общее число
+func ListProducts(ctx context.Context, f ProductFilter) ([]*Product, int, error) {
+	where := []string{"TRUE"}
+	args := []interface{}{}
+	if !f.IsAdmin {
+		args = append(args, f.UserID)
+		where = append(where, fmt.Sprintf("(user_id IS NULL OR user_id::text = $%d)", len(args)))
+	}
+	if f.Search != "" {
+		args = append(args, "%"+f.Search+"%")
+		where = append(where, fmt.Sprintf("(sku ILIKE $%d OR name ILIKE $%d)", len(args), len(args)))
+	}
+	if f.ActiveOnly {
+		where = append(where, "active")
+	}
+	cond := strings.Join(where, " AND ")
+
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_products WHERE `+cond, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(`
+		SELECT %s FROM crm_products WHERE %s
+		ORDER BY name, sku LIMIT $%d OFFSET $%d
+	`, productColumns, cond, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	products := []*Product{}
+	for rows.Next() {
+		p, err := scanProduct(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		products = append(products, p)
+	}
+	return products, total, rows.Err()
+}
+
+// GetProduct возвращает товар по ID
+func GetProduct(ctx context.Context, id string) (*Product, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrProductNotFound
+	}
+	p, err := scanProduct(database.Pool.QueryRow(ctx, `SELECT `+productColumns+` FROM crm_products WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrProductNotFound
+	}
+	return p, err
+}
+
+// productSaveError переводит нарушение уникальности артикула в ошибку валидации
+func productSaveError(err error, sku string) error {
+	var pgErr *pgconn.PgError
+	if errors.As(err, &pgErr) && pgErr.Code == "23505" {
+		return invalidProductf("sku %q already exists in the price list", sku)
+	}
+	return err
+}
+
+// CreateProduct добавляет товар в прайс-лист
+func CreateProduct(ctx context.Context, p *Product) error {
+	err := database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_products (user_id, sku, name, description, unit, price, currency, vat_rate, active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9)
+		RETURNING id, created_at, updated_at
+	`, p.UserID, p.SKU, p.Name, p.Description, p.Unit, p.Price, p.Currency, p.VATRate, p.Active).Scan(&p.ID, &p.CreatedAt, &p.UpdatedAt)
+	return productSaveError(err, p.SKU)
+}
+
+// UpdateProduct сохраняет изменения товара; позиции сделок остаются с прежними ценами
+func UpdateProduct(ctx context.Context, p *Product) error {
+	err := database.Pool.QueryRow(ctx, `
+		UPDATE crm_products
+		SET sku = $2, name = $3, description = $4, unit = $5, price = $6, currency = $7, vat_rate = $8, active = $9, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, p.ID, p.SKU, p.Name, p.Description, p.Unit, p.Price, p.Currency, p.VATRate, p.Active).Scan(&p.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrProductNotFound
+	}
+	return productSaveError(err, p.SKU)
+}
+
+// DeleteProduct удаляет товар из прайс-листа; в позициях сделок остаётся его копия
+func DeleteProduct(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_products WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrProductNotFound
+	}
+	return nil
+}
+
+// DealItem – позиция сделки. Discount – скидка в процентах; суммы считаются через Compute.
+type DealItem struct {
+	ID        string  `json:"id"`
+	ProductID *string `json:"product_id,omitempty"`
+	SKU       string  `json:"sku"`
+	Name      string  `json:"name"`
+	Unit      string  `json:"unit"`
+	Quantity  float64 `json:"quantity"`
+	Price     float64 `json:"price"`
+	Currency  string  `json:"currency"`
+	Discount  float64 `json:"discount"`
+	VATRate   float64 `json:"vat_rate"`
+	SortOrder int     `json:"sort_order"`
+
+	Subtotal       float64 `json:"subtotal"`        // количество × цена
+	DiscountAmount float64 `json:"discount_amount"` // скидка в деньгах
+	TaxAmount      float64 `json:"tax_amount"`      // НДС после скидки
+	Total          float64 `json:"total"`           // итог с НДС
+}
+
+// FillFromProduct подставляет в позицию незаполненные поля из товара прайс-листа
+func (i *DealItem) FillFromProduct(p *Product) {
+	i.ProductID = &p.ID
+	if i.SKU == "" {
+		i.SKU = p.SKU
+	}
+	if i.Name == "" {
+		i.Name = p.Name
+	}
+	if i.Unit == "" {
+		i.Unit = p.Unit
+	}
+	if i.Price == 0 {
+		i.Price = p.Price
+	}
+	if i.Currency == "" {
+		i.Currency = p.Currency
+	}
+	if i.VATRate == 0 {
+		i.VATRate = p.VATRate
+	}
+}
+
+// Normalize проверяет позицию и пересчитывает её суммы
+func (i *DealItem) Normalize() error {
+	i.SKU = strings.TrimSpace(i.SKU)
+	i.Name = strings.TrimSpace(i.Name)
+	i.Unit = strings.TrimSpace(i.Unit)
+	i.Currency = strings.ToUpper(strings.TrimSpace(i.Currency))
+	if i.Name == "" {
+		return invalidDealItemf("name is required")
+	}
+	if i.Unit == "" {
+		i.Unit = DefaultProductUnit
+	}
+	if i.Currency == "" {
+		i.Currency = DefaultProductCurrency
+	}
+	if !currencyPattern.MatchString(i.Currency) {
+		return invalidDealItemf("currency must be a 3-letter ISO code")
+	}
+	if i.Quantity <= 0 {
+		return invalidDealItemf("quantity of %q must be positive", i.Name)
+	}
+	if i.Price < 0 {
+		return invalidDealItemf("price of %q must not be negative", i.Name)
+	}
+	if i.Discount < 0 || i.Discount > 100 {
+		return invalidDealItemf("discount of %q must be between 0 and 100 percent", i.Name)
+	}
+	if i.VATRate < 0 || i.VATRate > 100 {
+		return invalidDealItemf("vat_rate of %q must be between 0 and 100", i.Name)
+	}
+	i.Quantity = math.Round(i.Quantity*1000) / 1000
+	i.Price = roundMoney(i.Price)
+	i.Compute()
+	return nil
+}
+
+// Compute считает суммы позиции: скидка с суммы по цене, НДС начисляется на сумму после скидки
+func (i *DealItem) Compute() {
+	i.Subtotal = roundMoney(i.Quantity * i.Price)
+	i.DiscountAmount = roundMoney(i.Subtotal * i.Discount / 100)
+	net := i.Subtotal - i.DiscountAmount
+	i.TaxAmount = roundMoney(net * i.VATRate / 100)
+	i.Total = roundMoney(net + i.TaxAmount)
+}
+
+// DealTotals – итоги по позициям сделки
+type DealTotals struct {
+	Currency string  `json:"currency"`
+	Subtotal float64 `json:"subtotal"`
+	Discount float64 `json:"discount_total"`
+	Tax      float64 `json:"tax_total"`
+	Total    float64 `json:"total"`
+}
+
+// SumDealItems складывает суммы позиций (позиции должны быть посчитаны)
+func SumDealItems(items []*DealItem) DealTotals {
+	t := DealTotals{Currency: DefaultProductCurrency}
+	for n, i := range items {
+		if n == 0 {
+			t.Currency = i.Currency
+		}
+		t.Subtotal += i.Subtotal
+		t.Discount += i.DiscountAmount
+		t.Tax += i.TaxAmount
+		t.Total += i.Total
+	}
+	t.Subtotal, t.Discount, t.Tax, t.Total = roundMoney(t.Subtotal), roundMoney(t.Discount), roundMoney(t.Tax), roundMoney(t.Total)
+	return t
+}
+
+// GetDealItems возвращает посчитанные позиции сделки по порядку
+func GetDealItems(ctx context.Context, dealID string) ([]*DealItem, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT id, product_id::text, sku, name, unit, quantity, price, currency, discount, vat_rate, sort_order
+		FROM crm_deal_items WHERE deal_id = $1
+		ORDER BY sort_order, id
+	`, dealID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	items := []*DealItem{}
+	for rows.Next() {
+		var i DealItem
+		if err := rows.Scan(&i.ID, &i.ProductID, &i.SKU, &i.Name, &i.Unit, &i.Quantity, &i.Price,
+			&i.Currency, &i.Discount, &i.VATRate, &i.SortOrder); err != nil {
+			return nil, err
+		}
+		i.Compute()
+		items = append(items, &i)
+	}
+	return items, rows.Err()
+}
+
+// DealItemsTotal – итог позиций сделки; ok=false, если позиций нет и сумма сделки задаётся вручную
+func DealItemsTotal(ctx context.Context, dealID string) (total float64, ok bool, err error) {
+	items, err := GetDealItems(ctx, dealID)
+	if err != nil || len(items) == 0 {
+		return 0, false, err
+	}
+	return SumDealItems(items).Total, true, nil
+}
+
+// ReplaceDealItems заменяет позиции сделки (позиции уже нормализованы) и записывает итог в value.
+// Пустой список снимает позиции; сумма сделки тогда остаётся прежней и снова задаётся вручную.
+func ReplaceDealItems(ctx context.Context, dealID string, items []*DealItem) (DealTotals, error) {
+	if len(items) > maxDealItems {
+		return DealTotals{}, invalidDealItemf("a deal can have at most %d items", maxDealItems)
+	}
+	for _, i := range items {
+		if i.Currency != items[0].Currency {
+			return DealTotals{}, invalidDealItemf("all items of a deal must be in one currency")
+		}
+	}
+	totals := SumDealItems(items)
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return DealTotals{}, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `DELETE FROM crm_deal_items WHERE deal_id = $1`, dealID); err != nil {
+		return DealTotals{}, err
+	}
+	for n, i := range items {
+		i.SortOrder = n
+		err := tx.QueryRow(ctx, `
+			INSERT INTO crm_deal_items (deal_id, product_id, sku, name, unit, quantity, price, currency, discount, vat_rate, sort_order)
+			VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+			RETURNING id
+		`, dealID, i.ProductID, i.SKU, i.Name, i.Unit, i.Quantity, i.Price, i.Currency, i.Discount, i.VATRate, i.SortOrder).Scan(&i.ID)
+		if err != nil {
+			return DealTotals{}, err
+		}
+	}
+	if len(items) > 0 {
+		if _, err := tx.Exec(ctx, `UPDATE crm_deals SET value = $2, updated_at = NOW() WHERE id = $1`, dealID, totals.Total); err != nil {
+			return DealTotals{}, err
+		}
+	}
+	return totals, tx.Commit(ctx)
+}
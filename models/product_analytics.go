@@ -0,0 +1,432 @@
+package models
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"subscription-system/database"
+)
+
+// Запросы к событиям продукта: воронки с окном конверсии, пути после события и сегментация
+// события по тарифу, источнику или свойству. Все запросы ограничены периодом, чтобы читать
+// только нужные помесячные партиции.
+
+const (
+	productEventMaxRangeDays = 366
+	productFunnelMaxSteps    = 10
+	productFunnelMaxWindow   = 90 * 24 * time.Hour
+	productPathMaxDepth      = 10
+	productPathTopLimit      = 20
+	productSegmentsLimit     = 10
+	// ProductPathExit – «шаг» после последнего события пути
+	ProductPathExit = "(exit)"
+	// ProductSegmentNone, ProductSegmentOther – события без значения разреза и сегменты вне первой десятки
+	ProductSegmentNone  = "(none)"
+	ProductSegmentOther = "(other)"
+)
+
+var productPropertyKeyRe = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+func invalidProductQueryf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProductEventQuery, fmt.Sprintf(format, args...))
+}
+
+// ParseProductEventRange разбирает период (YYYY-MM-DD, обе границы включительно; по умолчанию –
+// последние 30 дней) и возвращает [from, to) по местному времени
+func ParseProductEventRange(fromStr, toStr string) (time.Time, time.Time, error) {
+	to := revenueDay(time.Now())
+	if toStr != "" {
+		t, err := time.ParseInLocation(revenueDateLayout, toStr, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, invalidProductQueryf("to must be YYYY-MM-DD")
+		}
+		to = t
+	}
+	from := to.AddDate(0, 0, -29)
+	if fromStr != "" {
+		t, err := time.ParseInLocation(revenueDateLayout, fromStr, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, invalidProductQueryf("from must be YYYY-MM-DD")
+		}
+		from = t
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, invalidProductQueryf("from is after to")
+	}
+	if to.Sub(from) > productEventMaxRangeDays*24*time.Hour {
+		return time.Time{}, time.Time{}, invalidProductQueryf("period is longer than %d days", productEventMaxRangeDays)
+	}
+	return from, to.AddDate(0, 0, 1), nil
+}
+
+// ParseProductWindow разбирает окно вида 30m, 12h или 7d; пустая строка – def
+func ParseProductWindow(s string, def time.Duration) (time.Duration, error) {
+	if s == "" {
+		return def, nil
+	}
+	unit := map[byte]time.Duration{'m': time.Minute, 'h': time.Hour, 'd': 24 * time.Hour}[s[len(s)-1]]
+	n, err := strconv.Atoi(s[:len(s)-1])
+	if unit == 0 || err != nil || n <= 0 {
+		return 0, invalidProductQueryf("window must look like 30m, 12h or 7d")
+	}
+	if w := time.Duration(n) * unit; w <= productFunnelMaxWindow {
+		return w, nil
+	}
+	return 0, invalidProductQueryf("window is longer than %d days", int(productFunnelMaxWindow.Hours()/24))
+}
+
+// productInterval – окно как значение для $n::interval
+func productInterval(d time.Duration) string {
+	return fmt.Sprintf("%d seconds", int(d.Seconds()))
+}
+
+func checkProductEventName(name string) error {
+	if !productEventNameRe.MatchString(name) {
+		return invalidProductQueryf("unknown event name %q", name)
+	}
+	return nil
+}
+
+// ProductEventName – событие, встречавшееся за период
+type ProductEventName struct {
+	Event    string    `json:"event"`
+	Events   int       `json:"events"`
+	Users    int       `json:"users"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// ListProductEventNames – события за [from, to) по убыванию частоты
+func ListProductEventNames(ctx context.Context, from, to time.Time) ([]ProductEventName, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT event, COUNT(*), COUNT(DISTINCT user_id), MAX(occurred_at)
+		FROM product_events WHERE occurred_at >= $1 AND occurred_at < $2
+		GROUP BY event ORDER BY COUNT(*) DESC
+	`, from, to)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []ProductEventName{}
+	for rows.Next() {
+		var n ProductEventName
+		if err := rows.Scan(&n.Event, &n.Events, &n.Users, &n.LastSeen); err != nil {
+			return nil, err
+		}
+		list = append(list, n)
+	}
+	return list, rows.Err()
+}
+
+// FunnelQuery – воронка: пользователи, выполнившие первый шаг в [From, To), и кто из них прошёл
+// следующие шаги по порядку не позже Window после первого шага. Plan – отбор по тарифу на первом шаге.
+type FunnelQuery struct {
+	Steps  []string
+	Window time.Duration
+	From   time.Time
+	To     time.Time
+	Plan   string
+}
+
+// FunnelStep – шаг воронки
+type FunnelStep struct {
+	Event                 string   `json:"event"`
+	Users                 int      `json:"users"`
+	ConversionFromStart   *float64 `json:"conversion_from_start"`
+	ConversionFromPrev    *float64 `json:"conversion_from_previous"`
+	MedianSecondsFromPrev *float64 `json:"median_seconds_from_previous"`
+}
+
+// ProductFunnel считает воронку. Каждый шаг – первое подходящее событие после предыдущего шага.
+func ProductFunnel(ctx context.Context, q FunnelQuery) ([]FunnelStep, error) {
+	if len(q.Steps) < 2 || len(q.Steps) > productFunnelMaxSteps {
+		return nil, invalidProductQueryf("funnel needs 2 to %d steps", productFunnelMaxSteps)
+	}
+	for _, step := range q.Steps {
+		if err := checkProductEventName(step); err != nil {
+			return nil, err
+		}
+	}
+	// $1 – начало, $2 – конец периода первого шага, $3 – окно, $4 – тариф, шаги – с $5
+	args := []interface{}{q.From, q.To, productInterval(q.Window), q.Plan}
+	ctes := []string{`s1 AS (
+		SELECT user_id, MIN(occurred_at) AS t0, MIN(occurred_at) AS t, NULL::timestamptz AS prev
+		FROM product_events
+		WHERE event = $5 AND user_id IS NOT NULL AND occurred_at >= $1 AND occurred_at < $2 AND ($4 = '' OR plan = $4)
+		GROUP BY user_id)`}
+	args = append(args, q.Steps[0])
+	selects := []string{`SELECT 1, COUNT(*), NULL::float8 FROM s1`}
+	for i := 1; i < len(q.Steps); i++ {
+		args = append(args, q.Steps[i])
+		after := ">="
+		if q.Steps[i] == q.Steps[i-1] {
+			after = ">"
+		}
+		ctes = append(ctes, fmt.Sprintf(`s%[1]d AS (
+		SELECT s.user_id, s.t0, MIN(e.occurred_at) AS t, s.t AS prev
+		FROM s%[2]d s
+		JOIN product_events e ON e.user_id = s.user_id AND e.event = $%[3]d
+			AND e.occurred_at %[4]s s.t AND e.occurred_at <= s.t0 + $3::interval
+			AND e.occurred_at >= $1 AND e.occurred_at < $2::timestamptz + $3::interval
+		GROUP BY s.user_id, s.t0, s.t)`, i+1, i, len(args), after))
+		selects = append(selects, fmt.Sprintf(`SELECT %[1]d, COUNT(*),
+			percentile_cont(0.5) WITHIN GROUP (ORDER BY EXTRACT(EPOCH FROM t - prev))::float8 FROM s%[1]d`, i+1))
+	}
+	rows, err := database.Pool.Query(ctx, `WITH `+strings.Join(ctes, ",\n")+"\n"+strings.Join(selects, "\nUNION ALL\n"), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	steps := make([]FunnelStep, len(q.Steps))
+	for rows.Next() {
+		var n, users int
+		var median *float64
+		if err := rows.Scan(&n, &users, &median); err != nil {
+			return nil, err
+		}
+		steps[n-1] = FunnelStep{Event: q.Steps[n-1], Users: users, MedianSecondsFromPrev: median}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range steps {
+		steps[i].ConversionFromStart = revenueRatio(float64(steps[i].Users), float64(steps[0].Users))
+		if i > 0 {
+			steps[i].ConversionFromPrev = revenueRatio(float64(steps[i].Users), float64(steps[i-1].Users))
+		}
+	}
+	return steps, nil
+}
+
+// PathQuery – пути после первого за период события Start: следующие Depth событий пользователя
+// в пределах Window (повторы одного события подряд схлопываются)
+type PathQuery struct {
+	Start  string
+	Depth  int
+	Window time.Duration
+	From   time.Time
+	To     time.Time
+}
+
+// PathEdge – переход между соседними шагами пути (Step – номер шага From, Start – шаг 1)
+type PathEdge struct {
+	Step  int    `json:"step"`
+	From  string `json:"from"`
+	To    string `json:"to"`
+	Users int    `json:"users"`
+}
+
+// PathSequence – частая последовательность событий
+type PathSequence struct {
+	Events []string `json:"events"`
+	Users  int      `json:"users"`
+}
+
+// PathResult – переходы по шагам и самые частые пути
+type PathResult struct {
+	Users int            `json:"users"`
+	Edges []PathEdge     `json:"edges"`
+	Paths []PathSequence `json:"paths"`
+}
+
+// ProductPaths считает пути пользователей после события
+func ProductPaths(ctx context.Context, q PathQuery) (*PathResult, error) {
+	if err := checkProductEventName(q.Start); err != nil {
+		return nil, err
+	}
+	if q.Depth < 2 || q.Depth > productPathMaxDepth {
+		return nil, invalidProductQueryf("depth must be between 2 and %d", productPathMaxDepth)
+	}
+	const steps = `
+		WITH starts AS (
+			SELECT user_id, MIN(occurred_at) AS t0 FROM product_events
+			WHERE event = $1 AND user_id IS NOT NULL AND occurred_at >= $2 AND occurred_at < $3
+			GROUP BY user_id
+		), seq AS (
+			SELECT e.user_id, e.event, e.occurred_at, e.id,
+				LAG(e.event) OVER (PARTITION BY e.user_id ORDER BY e.occurred_at, e.id) AS prev
+			FROM starts s
+			JOIN product_events e ON e.user_id = s.user_id AND e.occurred_at >= s.t0 AND e.occurred_at <= s.t0 + $4::interval
+				AND e.occurred_at >= $2 AND e.occurred_at < $3::timestamptz + $4::interval
+		), steps AS (
+			SELECT user_id, event, ROW_NUMBER() OVER (PARTITION BY user_id ORDER BY occurred_at, id) AS step
+			FROM seq WHERE prev IS DISTINCT FROM event
+		)`
+	args := []interface{}{q.Start, q.From, q.To, productInterval(q.Window), q.Depth}
+	result := &PathResult{Edges: []PathEdge{}, Paths: []PathSequence{}}
+
+	rows, err := database.Pool.Query(ctx, steps+`
+		SELECT a.step, a.event, COALESCE(b.event, '`+ProductPathExit+`'), COUNT(*)
+		FROM steps a
+		LEFT JOIN steps b ON b.user_id = a.user_id AND b.step = a.step + 1
+		WHERE a.step < $5
+		GROUP BY 1, 2, 3
+		ORDER BY 1, 4 DESC, 2, 3
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var e PathEdge
+		if err := rows.Scan(&e.Step, &e.From, &e.To, &e.Users); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if e.Step == 1 {
+			result.Users += e.Users
+		}
+		result.Edges = append(result.Edges, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.Pool.Query(ctx, steps+`
+		SELECT path, COUNT(*) FROM (
+			SELECT user_id, array_agg(event ORDER BY step) AS path FROM steps WHERE step <= $5 GROUP BY user_id
+		) p
+		GROUP BY path ORDER BY 2 DESC, 1
+		LIMIT $6
+	`, append(args, productPathTopLimit)...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var p PathSequence
+		if err := rows.Scan(&p.Events, &p.Users); err != nil {
+			return nil, err
+		}
+		result.Paths = append(result.Paths, p)
+	}
+	return result, rows.Err()
+}
+
+// SegmentationQuery – число событий и пользователей по шагам периода в разрезе Breakdown:
+// "" (без разреза, один сегмент all), plan, source или property:<ключ>
+type SegmentationQuery struct {
+	Event       string
+	From        time.Time
+	To          time.Time
+	Granularity string
+	Breakdown   string
+}
+
+// SegmentationPoint – значение за шаг периода
+type SegmentationPoint struct {
+	Bucket string `json:"bucket"`
+	Events int    `json:"events"`
+	Users  int    `json:"users"`
+}
+
+// SegmentationSeries – ряд одного сегмента; Users – уникальные пользователи за весь период
+type SegmentationSeries struct {
+	Segment string              `json:"segment"`
+	Events  int                 `json:"events"`
+	Users   int                 `json:"users"`
+	Points  []SegmentationPoint `json:"points"`
+}
+
+// ProductSegmentation считает ряды события по сегментам; сегменты вне первой десятки объединяются в (other)
+func ProductSegmentation(ctx context.Context, q SegmentationQuery) ([]SegmentationSeries, error) {
+	if err := checkProductEventName(q.Event); err != nil {
+		return nil, err
+	}
+	switch q.Granularity {
+	case RevenueGranularityDay, RevenueGranularityWeek, RevenueGranularityMonth:
+	default:
+		return nil, invalidProductQueryf("granularity must be day, week or month")
+	}
+	segment := `'all'`
+	args := []interface{}{q.Event, q.From, q.To, q.Granularity}
+	switch {
+	case q.Breakdown == "":
+	case q.Breakdown == "plan":
+		segment = "plan"
+	case q.Breakdown == "source":
+		segment = "source"
+	case strings.HasPrefix(q.Breakdown, "property:"):
+		key := strings.TrimPrefix(q.Breakdown, "property:")
+		if !productPropertyKeyRe.MatchString(key) {
+			return nil, invalidProductQueryf("property key must be 1-64 latin letters, digits or _.-")
+		}
+		args = append(args, key)
+		segment = "properties->>$5"
+	default:
+		return nil, invalidProductQueryf("breakdown must be plan, source or property:<key>")
+	}
+	rows, err := database.Pool.Query(ctx, `
+		WITH ev AS (
+			SELECT date_trunc($4, occurred_at)::date AS bucket, COALESCE(`+segment+`, '`+ProductSegmentNone+`') AS segment, user_id
+			FROM product_events WHERE event = $1 AND occurred_at >= $2 AND occurred_at < $3
+		), top AS (
+			SELECT segment FROM ev GROUP BY segment ORDER BY COUNT(*) DESC, segment LIMIT `+strconv.Itoa(productSegmentsLimit)+`
+		), seg AS (
+			SELECT bucket, CASE WHEN segment IN (SELECT segment FROM top) THEN segment ELSE '`+ProductSegmentOther+`' END AS segment, user_id
+			FROM ev
+		)
+		SELECT bucket, segment, COUNT(*), COUNT(DISTINCT user_id) FROM seg GROUP BY GROUPING SETS ((bucket, segment), (segment))
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	bySegment := map[string]*SegmentationSeries{}
+	points := map[string]map[string]SegmentationPoint{}
+	buckets := map[string]bool{}
+	for rows.Next() {
+		var bucket *time.Time
+		var name string
+		var events, users int
+		if err := rows.Scan(&bucket, &name, &events, &users); err != nil {
+			return nil, err
+		}
+		s, ok := bySegment[name]
+		if !ok {
+			s = &SegmentationSeries{Segment: name}
+			bySegment[name] = s
+			points[name] = map[string]SegmentationPoint{}
+		}
+		if bucket == nil {
+			s.Events, s.Users = events, users
+			continue
+		}
+		key := bucket.Format(revenueDateLayout)
+		buckets[key] = true
+		points[name][key] = SegmentationPoint{Bucket: key, Events: events, Users: users}
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Шаги без событий в сегменте заполняются нулями, чтобы ряды были одной длины
+	keys := make([]string, 0, len(buckets))
+	for k := range buckets {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	series := make([]SegmentationSeries, 0, len(bySegment))
+	for name, s := range bySegment {
+		s.Points = make([]SegmentationPoint, len(keys))
+		for i, k := range keys {
+			p, ok := points[name][k]
+			if !ok {
+				p = SegmentationPoint{Bucket: k}
+			}
+			s.Points[i] = p
+		}
+		series = append(series, *s)
+	}
+	sort.Slice(series, func(i, j int) bool {
+		if (series[i].Segment == ProductSegmentOther) != (series[j].Segment == ProductSegmentOther) {
+			return series[j].Segment == ProductSegmentOther
+		}
+		return series[i].Events > series[j].Events
+	})
+	return series, nil
+}
@@ -0,0 +1,231 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+
+	"subscription-system/database"
+)
+
+// События продукта: что пользователь делает в сервисе (вход, создание сделки, открытие мини-приложения…).
+// Пишутся сервером (ProductEventService.Track) и клиентами пакетами через /api/events/batch.
+// Журнал product_events разбит на помесячные партиции по occurred_at: старые месяцы удаляются
+// целиком, а запросы за период читают только нужные партиции.
+
+var (
+	ErrInvalidProductEvent      = errors.New("invalid product event")
+	ErrInvalidProductEventQuery = errors.New("invalid product event query")
+)
+
+// Источники событий
+const (
+	ProductEventSourceServer  = "server"
+	ProductEventSourceWeb     = "web"
+	ProductEventSourceMiniApp = "miniapp"
+)
+
+// Серверные события продукта; действия в CRM пишутся под своими типами (deal.created, …)
+const (
+	ProductEventSignedUp         = "user.signed_up"
+	ProductEventLoggedIn         = "user.logged_in"
+	ProductEventPaymentSucceeded = "payment.succeeded"
+)
+
+const (
+	// ProductEventMaxBatch – событий в одном пакете клиента
+	ProductEventMaxBatch = 100
+	// productEventMaxPropertiesBytes, productEventMaxPropertiesKeys – размер свойств в JSON и число ключей
+	productEventMaxPropertiesBytes = 8 << 10
+	productEventMaxPropertiesKeys  = 50
+	// productEventMaxAge, productEventMaxSkew – насколько время события может отставать и опережать приём
+	productEventMaxAge  = 7 * 24 * time.Hour
+	productEventMaxSkew = time.Hour
+)
+
+var productEventNameRe = regexp.MustCompile(`^[a-z][a-z0-9_.:-]{0,99}$`)
+
+// ProductEvent – событие продукта
+type ProductEvent struct {
+	ID         int64                  `json:"id,omitempty"`
+	InsertID   string                 `json:"insert_id,omitempty"`
+	Event      string                 `json:"event"`
+	UserID     string                 `json:"user_id,omitempty"`
+	AccountID  string                 `json:"account_id,omitempty"`
+	SessionID  string                 `json:"session_id,omitempty"`
+	Source     string                 `json:"source"`
+	Plan       string                 `json:"plan,omitempty"`
+	Properties map[string]interface{} `json:"properties"`
+	OccurredAt time.Time              `json:"occurred_at"`
+}
+
+func invalidProductEventf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidProductEvent, fmt.Sprintf(format, args...))
+}
+
+// Normalize проверяет событие и подставляет значения по умолчанию; now – время приёма
+func (e *ProductEvent) Normalize(now time.Time) error {
+	e.Event = strings.TrimSpace(e.Event)
+	if !productEventNameRe.MatchString(e.Event) {
+		return invalidProductEventf("event name %q must be lowercase latin, digits and _.:- (up to 100 chars)", e.Event)
+	}
+	if e.InsertID != "" {
+		if _, err := uuid.Parse(e.InsertID); err != nil {
+			return invalidProductEventf("insert_id must be a UUID")
+		}
+	}
+	if e.Source == "" {
+		e.Source = ProductEventSourceServer
+	}
+	if e.Source != ProductEventSourceServer && e.Source != ProductEventSourceWeb && e.Source != ProductEventSourceMiniApp {
+		return invalidProductEventf("unknown source %q", e.Source)
+	}
+	if len(e.SessionID) > 100 {
+		return invalidProductEventf("session_id is longer than 100 chars")
+	}
+	if e.Properties == nil {
+		e.Properties = map[string]interface{}{}
+	}
+	if len(e.Properties) > productEventMaxPropertiesKeys {
+		return invalidProductEventf("more than %d properties", productEventMaxPropertiesKeys)
+	}
+	raw, err := json.Marshal(e.Properties)
+	if err != nil {
+		return invalidProductEventf("properties: %v", err)
+	}
+	if len(raw) > productEventMaxPropertiesBytes {
+		return invalidProductEventf("properties are larger than %d bytes", productEventMaxPropertiesBytes)
+	}
+	if e.OccurredAt.IsZero() {
+		e.OccurredAt = now
+	}
+	if e.OccurredAt.Before(now.Add(-productEventMaxAge)) || e.OccurredAt.After(now.Add(productEventMaxSkew)) {
+		return invalidProductEventf("occurred_at must be within the last %d days", int(productEventMaxAge.Hours()/24))
+	}
+	return nil
+}
+
+// InsertProductEvents записывает проверенные (Normalize) события одним запросом и возвращает число новых.
+// Тариф берётся из действующей подписки пользователя; повтор с тем же insert_id пропускается.
+func InsertProductEvents(ctx context.Context, events []*ProductEvent) (int, error) {
+	if len(events) == 0 {
+		return 0, nil
+	}
+	n := len(events)
+	insertIDs, names, userIDs, accountIDs := make([]string, n), make([]string, n), make([]string, n), make([]string, n)
+	sessions, sources, props := make([]string, n), make([]string, n), make([]string, n)
+	occurred := make([]time.Time, n)
+	for i, e := range events {
+		raw, err := json.Marshal(e.Properties)
+		if err != nil {
+			return 0, invalidProductEventf("properties: %v", err)
+		}
+		insertIDs[i], names[i], userIDs[i], accountIDs[i] = e.InsertID, e.Event, e.UserID, e.AccountID
+		sessions[i], sources[i], props[i], occurred[i] = e.SessionID, e.Source, string(raw), e.OccurredAt
+	}
+	tag, err := database.Pool.Exec(ctx, `
+		INSERT INTO product_events (insert_id, event, user_id, account_id, session_id, source, plan, properties, occurred_at)
+		SELECT NULLIF(v.insert_id, '')::uuid, v.event, NULLIF(v.user_id, '')::uuid,
+			COALESCE(NULLIF(v.account_id, ''), NULLIF(v.user_id, ''))::uuid,
+			NULLIF(v.session_id, ''), v.source, p.code, v.properties::jsonb, v.occurred_at
+		FROM unnest($1::text[], $2::text[], $3::text[], $4::text[], $5::text[], $6::text[], $7::text[], $8::timestamptz[])
+			AS v(insert_id, event, user_id, account_id, session_id, source, properties, occurred_at)
+		LEFT JOIN LATERAL (
+			SELECT sp.code FROM user_subscriptions us
+			JOIN subscription_plans sp ON sp.id = us.plan_id
+			WHERE us.user_id = NULLIF(v.user_id, '')::uuid AND us.status IN ('active', 'past_due')
+			ORDER BY us.current_period_end DESC LIMIT 1
+		) p ON true
+		ON CONFLICT (insert_id, occurred_at) DO NOTHING
+	`, insertIDs, names, userIDs, accountIDs, sessions, sources, props, occurred)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// productEventPartition – имя и границы партиции месяца (UTC)
+func productEventPartition(month time.Time) (string, time.Time, time.Time) {
+	from := time.Date(month.UTC().Year(), month.UTC().Month(), 1, 0, 0, 0, 0, time.UTC)
+	return "product_events_" + from.Format("2006_01"), from, from.AddDate(0, 1, 0)
+}
+
+// EnsureProductEventPartitions создаёт партиции с месяца from на months месяцев вперёд;
+// возвращает имена созданных
+func EnsureProductEventPartitions(ctx context.Context, from time.Time, months int) ([]string, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('product_events_partitions'))`); err != nil {
+		return nil, err
+	}
+	_, first, _ := productEventPartition(from)
+	var created []string
+	for i := 0; i < months; i++ {
+		name, start, end := productEventPartition(first.AddDate(0, i, 0))
+		var exists bool
+		if err := tx.QueryRow(ctx, `SELECT to_regclass($1) IS NOT NULL`, name).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if exists {
+			continue
+		}
+		// Имя и границы строятся из даты, а не из ввода пользователя
+		_, err := tx.Exec(ctx, fmt.Sprintf(`CREATE TABLE %s PARTITION OF product_events FOR VALUES FROM ('%s') TO ('%s')`,
+			name, start.Format(time.RFC3339), end.Format(time.RFC3339)))
+		if err != nil {
+			return nil, err
+		}
+		created = append(created, name)
+	}
+	return created, tx.Commit(ctx)
+}
+
+// DropProductEventPartitionsBefore удаляет партиции месяцев, целиком закончившихся до before
+func DropProductEventPartitionsBefore(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT c.relname FROM pg_inherits i
+		JOIN pg_class c ON c.oid = i.inhrelid
+		JOIN pg_class p ON p.oid = i.inhparent
+		WHERE p.relname = 'product_events'
+	`)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	var dropped []string
+	for _, name := range names {
+		month, err := time.Parse("2006_01", strings.TrimPrefix(name, "product_events_"))
+		if err != nil {
+			continue
+		}
+		if _, _, end := productEventPartition(month); end.After(before) {
+			continue
+		}
+		if _, err := database.Pool.Exec(ctx, `DROP TABLE IF EXISTS `+name); err != nil {
+			return dropped, err
+		}
+		dropped = append(dropped, name)
+	}
+	return dropped, nil
+}
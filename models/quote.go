@@ -0,0 +1,231 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Коммерческие предложения (КП) по сделке. Номер выдаётся из последовательности
+// (КП-2026-00042), а каждая переработка того же предложения – новая версия с тем же номером.
+// Версия хранит снимок клиента, позиций и итогов, поэтому PDF любой версии
+// можно выпустить повторно без расхождений с отправленным клиенту документом.
+
+var (
+	ErrQuoteNotFound = errors.New("quote not found")
+	ErrInvalidQuote  = errors.New("invalid quote")
+)
+
+// Статусы коммерческого предложения
+const (
+	QuoteStatusDraft    = "draft"
+	QuoteStatusSent     = "sent"
+	QuoteStatusAccepted = "accepted"
+	QuoteStatusRejected = "rejected"
+)
+
+var quoteStatuses = map[string]bool{
+	QuoteStatusDraft: true, QuoteStatusSent: true, QuoteStatusAccepted: true, QuoteStatusRejected: true,
+}
+
+// ValidQuoteStatus – известный статус КП
+func ValidQuoteStatus(status string) bool {
+	return quoteStatuses[status]
+}
+
+// QuoteDefaultValidity – срок действия КП, если он не указан
+const QuoteDefaultValidity = 14 * 24 * time.Hour
+
+// QuoteCustomer – реквизиты клиента на момент выпуска КП
+type QuoteCustomer struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Company string `json:"company,omitempty"`
+	Email   string `json:"email,omitempty"`
+	Phone   string `json:"phone,omitempty"`
+}
+
+// Quote – версия коммерческого предложения
+type Quote struct {
+	ID         string        `json:"id"`
+	DealID     string        `json:"deal_id"`
+	DealTitle  string        `json:"deal_title"`
+	UserID     *string       `json:"user_id,omitempty"`
+	Number     string        `json:"number"`
+	Version    int           `json:"version"`
+	Status     string        `json:"status"`
+	Customer   QuoteCustomer `json:"customer"`
+	Items      []*DealItem   `json:"items"`
+	Totals     DealTotals    `json:"totals"`
+	ValidUntil *time.Time    `json:"valid_until,omitempty"`
+	Notes      string        `json:"notes"`
+	CreatedAt  time.Time     `json:"created_at"`
+}
+
+// FileName – имя PDF-файла версии
+func (q *Quote) FileName() string {
+	return fmt.Sprintf("%s-v%d.pdf", q.Number, q.Version)
+}
+
+const quoteColumns = `q.id, q.deal_id, d.title, q.user_id::text, q.number, q.version, q.status, q.customer, q.items,
+	q.currency, q.subtotal, q.discount_total, q.tax_total, q.total, q.valid_until, q.notes, q.created_at`
+
+func scanQuote(row pgx.Row) (*Quote, error) {
+	var q Quote
+	var customer, items []byte
+	err := row.Scan(&q.ID, &q.DealID, &q.DealTitle, &q.UserID, &q.Number, &q.Version, &q.Status, &customer, &items,
+		&q.Totals.Currency, &q.Totals.Subtotal, &q.Totals.Discount, &q.Totals.Tax, &q.Totals.Total,
+		&q.ValidUntil, &q.Notes, &q.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(customer, &q.Customer); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(items, &q.Items); err != nil {
+		return nil, err
+	}
+	return &q, nil
+}
+
+// ListDealQuotes возвращает все версии КП сделки, новые сверху
+func ListDealQuotes(ctx context.Context, dealID string) ([]*Quote, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+quoteColumns+` FROM crm_quotes q JOIN crm_deals d ON d.id = q.deal_id
+		WHERE q.deal_id = $1
+		ORDER BY q.created_at DESC
+	`, dealID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	quotes := []*Quote{}
+	for rows.Next() {
+		q, err := scanQuote(rows)
+		if err != nil {
+			return nil, err
+		}
+		quotes = append(quotes, q)
+	}
+	return quotes, rows.Err()
+}
+
+// GetQuote возвращает версию КП по ID
+func GetQuote(ctx context.Context, id string) (*Quote, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrQuoteNotFound
+	}
+	q, err := scanQuote(database.Pool.QueryRow(ctx, `
+		SELECT `+quoteColumns+` FROM crm_quotes q JOIN crm_deals d ON d.id = q.deal_id WHERE q.id = $1
+	`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrQuoteNotFound
+	}
+	return q, err
+}
+
+// CreateQuote выпускает КП по текущим позициям сделки. Пустой reviseOf – новое предложение
+// с новым номером; иначе – следующая версия предложения reviseOf (ID любой его версии).
+func CreateQuote(ctx context.Context, q *Quote, reviseOf string) error {
+	items, err := GetDealItems(ctx, q.DealID)
+	if err != nil {
+		return err
+	}
+	if len(items) == 0 {
+		return fmt.Errorf("%w: deal has no line items", ErrInvalidQuote)
+	}
+	q.Items = items
+	q.Totals = SumDealItems(items)
+	q.Status = QuoteStatusDraft
+	if q.ValidUntil == nil {
+		validUntil := time.Now().Add(QuoteDefaultValidity).Truncate(24 * time.Hour)
+		q.ValidUntil = &validUntil
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	err = tx.QueryRow(ctx, `
+		SELECT c.id::text, c.name, COALESCE(c.company, ''), c.email, COALESCE(c.phone, ''), d.title
+		FROM crm_deals d JOIN crm_customers c ON c.id = d.customer_id
+		WHERE d.id = $1 AND d.deleted_at IS NULL
+	`, q.DealID).Scan(&q.Customer.ID, &q.Customer.Name, &q.Customer.Company, &q.Customer.Email, &q.Customer.Phone, &q.DealTitle)
+	if err != nil {
+		return err
+	}
+	if IsPlaceholderLeadEmail(q.Customer.Email) {
+		q.Customer.Email = ""
+	}
+
+	if reviseOf == "" {
+		var seq int64
+		if err := tx.QueryRow(ctx, `SELECT nextval('crm_quote_number_seq')`).Scan(&seq); err != nil {
+			return err
+		}
+		q.Number = fmt.Sprintf("КП-%d-%05d", time.Now().Year(), seq)
+		q.Version = 1
+	} else {
+		if _, err := uuid.Parse(reviseOf); err != nil {
+			return ErrQuoteNotFound
+		}
+		err := tx.QueryRow(ctx, `SELECT number FROM crm_quotes WHERE id = $1 AND deal_id = $2`, reviseOf, q.DealID).Scan(&q.Number)
+		if errors.Is(err, pgx.ErrNoRows) {
+			return ErrQuoteNotFound
+		}
+		if err != nil {
+			return err
+		}
+		// Две одновременные переработки одного КП не должны получить одну версию
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext('crm_quote:' || $1))`, q.Number); err != nil {
+			return err
+		}
+		if err := tx.QueryRow(ctx, `SELECT MAX(version) + 1 FROM crm_quotes WHERE number = $1`, q.Number).Scan(&q.Version); err != nil {
+			return err
+		}
+	}
+
+	customer, err := json.Marshal(q.Customer)
+	if err != nil {
+		return err
+	}
+	itemsJSON, err := json.Marshal(q.Items)
+	if err != nil {
+		return err
+	}
+	err = tx.QueryRow(ctx, `
+		INSERT INTO crm_quotes (deal_id, user_id, number, version, status, customer, items, currency,
+			subtotal, discount_total, tax_total, total, valid_until, notes)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)
+		RETURNING id, created_at
+	`, q.DealID, q.UserID, q.Number, q.Version, q.Status, customer, itemsJSON, q.Totals.Currency,
+		q.Totals.Subtotal, q.Totals.Discount, q.Totals.Tax, q.Totals.Total, q.ValidUntil, q.Notes).Scan(&q.ID, &q.CreatedAt)
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+// SetQuoteStatus меняет статус версии КП
+func SetQuoteStatus(ctx context.Context, id, status string) error {
+	if !ValidQuoteStatus(status) {
+		return fmt.Errorf("%w: status must be draft, sent, accepted or rejected", ErrInvalidQuote)
+	}
+	tag, err := database.Pool.Exec(ctx, `UPDATE crm_quotes SET status = $2 WHERE id = $1`, id, status)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrQuoteNotFound
+	}
+	return nil
+}
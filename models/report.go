@@ -0,0 +1,714 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/mail"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Отчёты по расписанию. Подписка задаёт отчёт, фильтры и расписание (ежедневно, еженедельно,
+// ежемесячно в часовом поясе подписки); получатели – адреса почты и чаты Telegram, у каждого
+// своя ссылка отписки. Каждая доставка пишется в историю.
+//
+// Отчёт охватывает закончившийся период перед отправкой: вчерашний день, прошлые 7 дней или
+// прошлый месяц. Данные строятся с правами владельца подписки.
+
+var (
+	ErrReportSubscriptionNotFound = errors.New("report subscription not found")
+	ErrReportRecipientNotFound    = errors.New("report recipient not found")
+	ErrInvalidReportSubscription  = errors.New("invalid report subscription")
+	ErrReportForbidden            = errors.New("report is available only to administrators")
+)
+
+// Отчёты
+const (
+	ReportPipelineSummary = "pipeline_summary"
+	ReportSalesForecast   = "sales_forecast"
+	ReportMRR             = "mrr"
+	ReportAIUsage         = "ai_usage"
+	ReportAgentResults    = "agent_results"
+)
+
+// Периодичность
+const (
+	ReportCadenceDaily   = "daily"
+	ReportCadenceWeekly  = "weekly"
+	ReportCadenceMonthly = "monthly"
+)
+
+// Вложения письма
+const (
+	ReportFormatXLSX = "xlsx"
+	ReportFormatPDF  = "pdf"
+)
+
+// Каналы доставки
+const (
+	ReportChannelEmail    = "email"
+	ReportChannelTelegram = "telegram"
+)
+
+// Статусы доставки
+const (
+	ReportDeliverySent   = "sent"
+	ReportDeliveryFailed = "failed"
+)
+
+const (
+	reportNameMaxLen = 255
+	// reportMaxRecipients – получателей в одной подписке
+	reportMaxRecipients = 20
+	// reportMaxMonthDay – дни после 28-го есть не в каждом месяце
+	reportMaxMonthDay = 28
+)
+
+// ReportType – отчёт, на который можно подписаться
+type ReportType struct {
+	Code      string   `json:"code"`
+	Name      string   `json:"name"`
+	AdminOnly bool     `json:"admin_only"`
+	Filters   []string `json:"filters"`
+}
+
+// ReportTypes – доступные отчёты
+var ReportTypes = []ReportType{
+	{Code: ReportPipelineSummary, Name: "Сводка по воронке", Filters: []string{"pipeline_id"}},
+	{Code: ReportSalesForecast, Name: "Прогноз продаж", Filters: []string{"pipeline_id"}},
+	{Code: ReportMRR, Name: "MRR и движение выручки", AdminOnly: true, Filters: []string{}},
+	{Code: ReportAIUsage, Name: "Использование ИИ", Filters: []string{}},
+	{Code: ReportAgentResults, Name: "Результаты ИИ-агентов", Filters: []string{"task_type"}},
+}
+
+// FindReportType – описание отчёта по коду или nil
+func FindReportType(code string) *ReportType {
+	for i := range ReportTypes {
+		if ReportTypes[i].Code == code {
+			return &ReportTypes[i]
+		}
+	}
+	return nil
+}
+
+// ReportFilters – фильтры отчёта; какие из них учитываются, зависит от отчёта
+type ReportFilters struct {
+	PipelineID string `json:"pipeline_id,omitempty"`
+	TaskType   string `json:"task_type,omitempty"`
+}
+
+// ReportSubscription – подписка на отчёт
+type ReportSubscription struct {
+	ID         string            `json:"id"`
+	UserID     string            `json:"user_id"`
+	Name       string            `json:"name"`
+	Report     string            `json:"report"`
+	Filters    ReportFilters     `json:"filters"`
+	Cadence    string            `json:"cadence"`
+	SendHour   int               `json:"send_hour"`
+	SendMinute int               `json:"send_minute"`
+	Weekday    int               `json:"weekday"`
+	MonthDay   int               `json:"month_day"`
+	Timezone   string            `json:"timezone"`
+	Formats    []string          `json:"formats"`
+	Enabled    bool              `json:"enabled"`
+	NextRunAt  time.Time         `json:"next_run_at"`
+	LastRunAt  *time.Time        `json:"last_run_at"`
+	Recipients []ReportRecipient `json:"recipients"`
+	CreatedAt  time.Time         `json:"created_at"`
+	UpdatedAt  time.Time         `json:"updated_at"`
+}
+
+// ReportRecipient – получатель подписки; Address – почта или id чата Telegram
+type ReportRecipient struct {
+	ID               string     `json:"id"`
+	SubscriptionID   string     `json:"subscription_id"`
+	Channel          string     `json:"channel"`
+	Address          string     `json:"address"`
+	UnsubscribeToken string     `json:"-"`
+	UnsubscribedAt   *time.Time `json:"unsubscribed_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+}
+
+// ReportDelivery – запись истории доставки
+type ReportDelivery struct {
+	ID             int64     `json:"id"`
+	SubscriptionID string    `json:"subscription_id"`
+	RecipientID    *string   `json:"recipient_id"`
+	Channel        string    `json:"channel"`
+	Address        string    `json:"address"`
+	Status         string    `json:"status"`
+	Error          *string   `json:"error"`
+	PeriodFrom     string    `json:"period_from"`
+	PeriodTo       string    `json:"period_to"`
+	SentAt         time.Time `json:"sent_at"`
+}
+
+// ReportRun – подписка, взятая в отправку, и время, на которое отправка была назначена
+type ReportRun struct {
+	Subscription *ReportSubscription
+	ScheduledAt  time.Time
+}
+
+func invalidReportf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s", ErrInvalidReportSubscription, fmt.Sprintf(format, args...))
+}
+
+// CanView – подписку видит и меняет владелец и администратор
+func (s *ReportSubscription) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || (userID != "" && s.UserID == userID)
+}
+
+// Active – получатели, не отписавшиеся от рассылки
+func (s *ReportSubscription) Active() []ReportRecipient {
+	active := []ReportRecipient{}
+	for _, r := range s.Recipients {
+		if r.UnsubscribedAt == nil {
+			active = append(active, r)
+		}
+	}
+	return active
+}
+
+// Location – часовой пояс подписки
+func (s *ReportSubscription) Location() *time.Location {
+	loc, err := time.LoadLocation(s.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
+}
+
+// Normalize проверяет подписку и подставляет значения по умолчанию;
+// ownerIsAdmin – владелец вправе получать отчёты только для администраторов
+func (s *ReportSubscription) Normalize(ownerIsAdmin bool) error {
+	s.Name = strings.TrimSpace(s.Name)
+	rt := FindReportType(s.Report)
+	if rt == nil {
+		return invalidReportf("unknown report %q", s.Report)
+	}
+	if rt.AdminOnly && !ownerIsAdmin {
+		return ErrReportForbidden
+	}
+	if s.Name == "" {
+		s.Name = rt.Name
+	}
+	if len([]rune(s.Name)) > reportNameMaxLen {
+		return invalidReportf("name is longer than %d characters", reportNameMaxLen)
+	}
+	s.Filters.PipelineID = strings.TrimSpace(s.Filters.PipelineID)
+	s.Filters.TaskType = strings.TrimSpace(s.Filters.TaskType)
+	if !containsString(rt.Filters, "pipeline_id") {
+		s.Filters.PipelineID = ""
+	}
+	if !containsString(rt.Filters, "task_type") {
+		s.Filters.TaskType = ""
+	}
+	switch s.Cadence {
+	case ReportCadenceDaily, ReportCadenceWeekly, ReportCadenceMonthly:
+	case "":
+		s.Cadence = ReportCadenceWeekly
+	default:
+		return invalidReportf("cadence must be daily, weekly or monthly")
+	}
+	if s.SendHour < 0 || s.SendHour > 23 || s.SendMinute < 0 || s.SendMinute > 59 {
+		return invalidReportf("send time must be between 00:00 and 23:59")
+	}
+	if s.Weekday == 0 {
+		s.Weekday = 1
+	}
+	if s.Weekday < 1 || s.Weekday > 7 {
+		return invalidReportf("weekday must be between 1 (Monday) and 7 (Sunday)")
+	}
+	if s.MonthDay == 0 {
+		s.MonthDay = 1
+	}
+	if s.MonthDay < 1 || s.MonthDay > reportMaxMonthDay {
+		return invalidReportf("month_day must be between 1 and %d", reportMaxMonthDay)
+	}
+	if s.Timezone == "" {
+		s.Timezone = "UTC"
+	}
+	if _, err := time.LoadLocation(s.Timezone); err != nil {
+		return invalidReportf("unknown timezone %q", s.Timezone)
+	}
+	formats := []string{}
+	for _, f := range s.Formats {
+		f = strings.ToLower(strings.TrimSpace(f))
+		if f != ReportFormatXLSX && f != ReportFormatPDF {
+			return invalidReportf("format must be xlsx or pdf")
+		}
+		if !containsString(formats, f) {
+			formats = append(formats, f)
+		}
+	}
+	s.Formats = formats
+	return nil
+}
+
+// NextRun – первое время отправки строго после after
+func (s *ReportSubscription) NextRun(after time.Time) time.Time {
+	loc := s.Location()
+	local := after.In(loc)
+	at := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, s.SendHour, s.SendMinute, 0, 0, loc)
+	}
+	switch s.Cadence {
+	case ReportCadenceMonthly:
+		next := at(local.Year(), local.Month(), s.MonthDay)
+		if !next.After(after) {
+			next = at(local.Year(), local.Month()+1, s.MonthDay)
+		}
+		return next
+	case ReportCadenceWeekly:
+		// time.Weekday: воскресенье – 0, у подписки – 7
+		days := (s.Weekday%7 - int(local.Weekday()) + 7) % 7
+		next := at(local.Year(), local.Month(), local.Day()+days)
+		if !next.After(after) {
+			next = at(local.Year(), local.Month(), local.Day()+days+7)
+		}
+		return next
+	default:
+		next := at(local.Year(), local.Month(), local.Day())
+		if !next.After(after) {
+			next = at(local.Year(), local.Month(), local.Day()+1)
+		}
+		return next
+	}
+}
+
+// Period – закончившийся период отчёта, отправляемого в runAt: [from, to) по датам в поясе подписки
+func (s *ReportSubscription) Period(runAt time.Time) (time.Time, time.Time) {
+	local := runAt.In(s.Location())
+	to := time.Date(local.Year(), local.Month(), local.Day(), 0, 0, 0, 0, local.Location())
+	switch s.Cadence {
+	case ReportCadenceMonthly:
+		return to.AddDate(0, -1, 0), to
+	case ReportCadenceWeekly:
+		return to.AddDate(0, 0, -7), to
+	default:
+		return to.AddDate(0, 0, -1), to
+	}
+}
+
+// Normalize проверяет получателя; пустой чат Telegram – личный чат владельца с ботом
+func (r *ReportRecipient) Normalize(ctx context.Context, ownerID string) error {
+	r.Address = strings.TrimSpace(r.Address)
+	switch r.Channel {
+	case ReportChannelEmail:
+		addr, err := mail.ParseAddress(r.Address)
+		if err != nil || len(addr.Address) > 255 {
+			return invalidReportf("invalid email %q", r.Address)
+		}
+		r.Address = strings.ToLower(addr.Address)
+	case ReportChannelTelegram:
+		if r.Address == "" {
+			var chatID *int64
+			err := database.Pool.QueryRow(ctx, `SELECT telegram_id FROM users WHERE id = $1`, ownerID).Scan(&chatID)
+			if err != nil {
+				return err
+			}
+			if chatID == nil {
+				return invalidReportf("telegram is not linked to the account, specify a chat id")
+			}
+			r.Address = strconv.FormatInt(*chatID, 10)
+		}
+		if _, err := strconv.ParseInt(r.Address, 10, 64); err != nil {
+			return invalidReportf("telegram chat id must be a number")
+		}
+	default:
+		return invalidReportf("recipient channel must be email or telegram")
+	}
+	return nil
+}
+
+// newReportUnsubscribeToken – 24 случайных байта в hex
+func newReportUnsubscribeToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+const reportSubscriptionColumns = `id, user_id::text, name, report, filters, cadence, send_hour, send_minute,
+	weekday, month_day, timezone, formats, enabled, next_run_at, last_run_at, created_at, updated_at`
+
+func scanReportSubscription(row pgx.Row) (*ReportSubscription, error) {
+	var s ReportSubscription
+	var filters []byte
+	err := row.Scan(&s.ID, &s.UserID, &s.Name, &s.Report, &filters, &s.Cadence, &s.SendHour, &s.SendMinute,
+		&s.Weekday, &s.MonthDay, &s.Timezone, &s.Formats, &s.Enabled, &s.NextRunAt, &s.LastRunAt, &s.CreatedAt, &s.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(filters, &s.Filters); err != nil {
+		return nil, err
+	}
+	if s.Formats == nil {
+		s.Formats = []string{}
+	}
+	s.Recipients = []ReportRecipient{}
+	return &s, nil
+}
+
+const reportRecipientColumns = `id, subscription_id, channel, address, unsubscribe_token, unsubscribed_at, created_at`
+
+func scanReportRecipient(row pgx.Row) (*ReportRecipient, error) {
+	var r ReportRecipient
+	if err := row.Scan(&r.ID, &r.SubscriptionID, &r.Channel, &r.Address, &r.UnsubscribeToken, &r.UnsubscribedAt, &r.CreatedAt); err != nil {
+		return nil, err
+	}
+	return &r, nil
+}
+
+// loadReportRecipients заполняет получателей подписок
+func loadReportRecipients(ctx context.Context, subs ...*ReportSubscription) error {
+	if len(subs) == 0 {
+		return nil
+	}
+	byID := make(map[string]*ReportSubscription, len(subs))
+	ids := make([]string, 0, len(subs))
+	for _, s := range subs {
+		byID[s.ID] = s
+		ids = append(ids, s.ID)
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+reportRecipientColumns+` FROM report_recipients
+		WHERE subscription_id = ANY($1::uuid[])
+		ORDER BY created_at
+	`, ids)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		r, err := scanReportRecipient(rows)
+		if err != nil {
+			return err
+		}
+		if s, ok := byID[r.SubscriptionID]; ok {
+			s.Recipients = append(s.Recipients, *r)
+		}
+	}
+	return rows.Err()
+}
+
+// insertReportRecipient добавляет получателя; повтор адреса в подписке не дублируется
+// и не отменяет отписку – для этого получателя нужно удалить и добавить заново
+func insertReportRecipient(ctx context.Context, q interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}, subscriptionID string, r *ReportRecipient) error {
+	token, err := newReportUnsubscribeToken()
+	if err != nil {
+		return err
+	}
+	saved, err := scanReportRecipient(q.QueryRow(ctx, `
+		INSERT INTO report_recipients (subscription_id, channel, address, unsubscribe_token)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (subscription_id, channel, address) DO UPDATE SET channel = EXCLUDED.channel
+		RETURNING `+reportRecipientColumns, subscriptionID, r.Channel, r.Address, token))
+	if err != nil {
+		return err
+	}
+	*r = *saved
+	return nil
+}
+
+// CreateReportSubscription сохраняет проверенную (Normalize) подписку с получателями
+func CreateReportSubscription(ctx context.Context, s *ReportSubscription, recipients []ReportRecipient) error {
+	if len(recipients) == 0 || len(recipients) > reportMaxRecipients {
+		return invalidReportf("subscription needs 1 to %d recipients", reportMaxRecipients)
+	}
+	filters, err := json.Marshal(s.Filters)
+	if err != nil {
+		return err
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	saved, err := scanReportSubscription(tx.QueryRow(ctx, `
+		INSERT INTO report_subscriptions (user_id, name, report, filters, cadence, send_hour, send_minute,
+			weekday, month_day, timezone, formats, enabled, next_run_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING `+reportSubscriptionColumns,
+		s.UserID, s.Name, s.Report, filters, s.Cadence, s.SendHour, s.SendMinute,
+		s.Weekday, s.MonthDay, s.Timezone, s.Formats, s.Enabled, s.NextRun(time.Now())))
+	if err != nil {
+		return err
+	}
+	for i := range recipients {
+		r := recipients[i]
+		if err := insertReportRecipient(ctx, tx, saved.ID, &r); err != nil {
+			return err
+		}
+		if !containsString(recipientIDs(saved.Recipients), r.ID) {
+			saved.Recipients = append(saved.Recipients, r)
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return err
+	}
+	*s = *saved
+	return nil
+}
+
+func recipientIDs(list []ReportRecipient) []string {
+	ids := make([]string, len(list))
+	for i, r := range list {
+		ids[i] = r.ID
+	}
+	return ids
+}
+
+// GetReportSubscription – подписка с получателями
+func GetReportSubscription(ctx context.Context, id string) (*ReportSubscription, error) {
+	s, err := scanReportSubscription(database.Pool.QueryRow(ctx, `
+		SELECT `+reportSubscriptionColumns+` FROM report_subscriptions WHERE id::text = $1
+	`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrReportSubscriptionNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := loadReportRecipients(ctx, s); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// ListReportSubscriptions – подписки пользователя; администратору – все
+func ListReportSubscriptions(ctx context.Context, userID string, isAdmin bool, limit, offset int) ([]*ReportSubscription, int, error) {
+	var total int
+	if err := database.Pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM report_subscriptions WHERE $2 OR user_id::text = $1
+	`, userID, isAdmin).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+reportSubscriptionColumns+` FROM report_subscriptions
+		WHERE $2 OR user_id::text = $1
+		ORDER BY created_at DESC
+		LIMIT $3 OFFSET $4
+	`, userID, isAdmin, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	subs := []*ReportSubscription{}
+	for rows.Next() {
+		s, err := scanReportSubscription(rows)
+		if err != nil {
+			rows.Close()
+			return nil, 0, err
+		}
+		subs = append(subs, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+	return subs, total, loadReportRecipients(ctx, subs...)
+}
+
+// UpdateReportSubscription сохраняет проверенную (Normalize) подписку и пересчитывает время
+// следующей отправки по новому расписанию
+func UpdateReportSubscription(ctx context.Context, s *ReportSubscription) error {
+	filters, err := json.Marshal(s.Filters)
+	if err != nil {
+		return err
+	}
+	recipients := s.Recipients
+	saved, err := scanReportSubscription(database.Pool.QueryRow(ctx, `
+		UPDATE report_subscriptions SET name = $2, report = $3, filters = $4, cadence = $5, send_hour = $6,
+			send_minute = $7, weekday = $8, month_day = $9, timezone = $10, formats = $11, enabled = $12,
+			next_run_at = $13, updated_at = NOW()
+		WHERE id = $1
+		RETURNING `+reportSubscriptionColumns,
+		s.ID, s.Name, s.Report, filters, s.Cadence, s.SendHour, s.SendMinute,
+		s.Weekday, s.MonthDay, s.Timezone, s.Formats, s.Enabled, s.NextRun(time.Now())))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrReportSubscriptionNotFound
+	}
+	if err != nil {
+		return err
+	}
+	*s = *saved
+	s.Recipients = recipients
+	return nil
+}
+
+// DeleteReportSubscription удаляет подписку вместе с получателями и историей
+func DeleteReportSubscription(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM report_subscriptions WHERE id::text = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrReportSubscriptionNotFound
+	}
+	return nil
+}
+
+// AddReportRecipient добавляет проверенного (Normalize) получателя к подписке
+func AddReportRecipient(ctx context.Context, s *ReportSubscription, r *ReportRecipient) error {
+	if len(s.Recipients) >= reportMaxRecipients {
+		return invalidReportf("subscription already has %d recipients", reportMaxRecipients)
+	}
+	return insertReportRecipient(ctx, database.Pool, s.ID, r)
+}
+
+// DeleteReportRecipient удаляет получателя подписки; история его доставок остаётся
+func DeleteReportRecipient(ctx context.Context, subscriptionID, recipientID string) error {
+	tag, err := database.Pool.Exec(ctx, `
+		DELETE FROM report_recipients WHERE subscription_id::text = $1 AND id::text = $2
+	`, subscriptionID, recipientID)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrReportRecipientNotFound
+	}
+	return nil
+}
+
+// GetReportRecipientByToken находит получателя по токену отписки, ничего не меняя;
+// возвращает получателя и название подписки
+func GetReportRecipientByToken(ctx context.Context, token string) (*ReportRecipient, string, error) {
+	var name string
+	var r ReportRecipient
+	err := database.Pool.QueryRow(ctx, `
+		SELECT r.id, r.subscription_id, r.channel, r.address, r.unsubscribe_token, r.unsubscribed_at, r.created_at, s.name
+		FROM report_recipients r JOIN report_subscriptions s ON s.id = r.subscription_id
+		WHERE r.unsubscribe_token = $1
+	`, token).Scan(&r.ID, &r.SubscriptionID, &r.Channel, &r.Address, &r.UnsubscribeToken, &r.UnsubscribedAt, &r.CreatedAt, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", ErrReportRecipientNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &r, name, nil
+}
+
+// UnsubscribeReportRecipient отписывает получателя по токену из письма или сообщения;
+// возвращает получателя и название подписки. Повторная отписка не меняет дату.
+func UnsubscribeReportRecipient(ctx context.Context, token string) (*ReportRecipient, string, error) {
+	var name string
+	var r ReportRecipient
+	err := database.Pool.QueryRow(ctx, `
+		UPDATE report_recipients r SET unsubscribed_at = COALESCE(r.unsubscribed_at, NOW())
+		FROM report_subscriptions s
+		WHERE s.id = r.subscription_id AND r.unsubscribe_token = $1
+		RETURNING r.id, r.subscription_id, r.channel, r.address, r.unsubscribe_token, r.unsubscribed_at, r.created_at, s.name
+	`, token).Scan(&r.ID, &r.SubscriptionID, &r.Channel, &r.Address, &r.UnsubscribeToken, &r.UnsubscribedAt, &r.CreatedAt, &name)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, "", ErrReportRecipientNotFound
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	return &r, name, nil
+}
+
+// ClaimDueReportSubscriptions забирает наступившие отправки и сразу переносит их на следующий
+// срок, поэтому при нескольких экземплярах сервиса отчёт уходит один раз. Пропущенные за время
+// простоя сроки не догоняются: отправляется один отчёт, следующий – по расписанию.
+func ClaimDueReportSubscriptions(ctx context.Context, now time.Time, limit int) ([]ReportRun, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+	rows, err := tx.Query(ctx, `
+		SELECT `+reportSubscriptionColumns+` FROM report_subscriptions
+		WHERE enabled AND next_run_at <= $1
+		ORDER BY next_run_at
+		LIMIT $2
+		FOR UPDATE SKIP LOCKED
+	`, now, limit)
+	if err != nil {
+		return nil, err
+	}
+	var runs []ReportRun
+	for rows.Next() {
+		s, err := scanReportSubscription(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		runs = append(runs, ReportRun{Subscription: s, ScheduledAt: s.NextRunAt})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	subs := make([]*ReportSubscription, 0, len(runs))
+	for _, run := range runs {
+		s := run.Subscription
+		s.NextRunAt = s.NextRun(now)
+		s.LastRunAt = &now
+		if _, err := tx.Exec(ctx, `
+			UPDATE report_subscriptions SET next_run_at = $2, last_run_at = $3 WHERE id = $1
+		`, s.ID, s.NextRunAt, now); err != nil {
+			return nil, err
+		}
+		subs = append(subs, s)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return runs, loadReportRecipients(ctx, subs...)
+}
+
+// LogReportDelivery записывает результат доставки одному получателю
+func LogReportDelivery(ctx context.Context, d *ReportDelivery) error {
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO report_deliveries (subscription_id, recipient_id, channel, address, status, error, period_from, period_to)
+		VALUES ($1, $2, $3, $4, $5, $6, $7::date, $8::date)
+		RETURNING id, sent_at
+	`, d.SubscriptionID, d.RecipientID, d.Channel, d.Address, d.Status, d.Error, d.PeriodFrom, d.PeriodTo).Scan(&d.ID, &d.SentAt)
+}
+
+// ListReportDeliveries – история доставки подписки, новые сначала
+func ListReportDeliveries(ctx context.Context, subscriptionID string, limit, offset int) ([]ReportDelivery, int, error) {
+	var total int
+	if err := database.Pool.QueryRow(ctx, `
+		SELECT COUNT(*) FROM report_deliveries WHERE subscription_id::text = $1
+	`, subscriptionID).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT id, subscription_id, recipient_id::text, channel, address, status, error,
+			TO_CHAR(period_from, 'YYYY-MM-DD'), TO_CHAR(period_to, 'YYYY-MM-DD'), sent_at
+		FROM report_deliveries
+		WHERE subscription_id::text = $1
+		ORDER BY sent_at DESC, id DESC
+		LIMIT $2 OFFSET $3
+	`, subscriptionID, limit, offset)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	list := []ReportDelivery{}
+	for rows.Next() {
+		var d ReportDelivery
+		if err := rows.Scan(&d.ID, &d.SubscriptionID, &d.RecipientID, &d.Channel, &d.Address, &d.Status, &d.Error,
+			&d.PeriodFrom, &d.PeriodTo, &d.SentAt); err != nil {
+			return nil, 0, err
+		}
+		list = append(list, d)
+	}
+	return list, total, rows.Err()
+}
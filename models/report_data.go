@@ -0,0 +1,573 @@
+package models
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"subscription-system/database"
+)
+
+// Данные отчётов по подпискам: показатели и таблицы в виде, не зависящем от формата.
+// Письмо, Telegram, XLSX и PDF собираются из одной ReportData.
+
+// Форматы значений
+const (
+	ReportValueNumber  = "number"
+	ReportValueMoney   = "money"
+	ReportValuePercent = "percent" // значение в процентах: 12.5 – это 12,5%
+	ReportValueText    = "text"
+)
+
+// reportCurrency – валюта сумм в отчётах; суммы складываются без конвертации
+const reportCurrency = "₽"
+
+// reportMaxTableRows – строк в таблицах со списками
+const reportMaxTableRows = 20
+
+// ReportMetric – показатель отчёта
+type ReportMetric struct {
+	Label  string  `json:"label"`
+	Value  float64 `json:"value"`
+	Format string  `json:"format"`
+}
+
+// ReportColumn – колонка таблицы отчёта
+type ReportColumn struct {
+	Title  string `json:"title"`
+	Format string `json:"format"`
+}
+
+// ReportTable – таблица отчёта; ячейки – float64 или string по формату колонки
+type ReportTable struct {
+	Title   string          `json:"title"`
+	Columns []ReportColumn  `json:"columns"`
+	Rows    [][]interface{} `json:"rows"`
+}
+
+// ReportData – собранный отчёт за период [From, To)
+type ReportData struct {
+	Title    string         `json:"title"`
+	Subtitle string         `json:"subtitle,omitempty"`
+	Currency string         `json:"currency"`
+	From     time.Time      `json:"from"`
+	To       time.Time      `json:"to"`
+	Metrics  []ReportMetric `json:"metrics"`
+	Tables   []ReportTable  `json:"tables"`
+}
+
+func (d *ReportData) metric(label string, value float64, format string) {
+	d.Metrics = append(d.Metrics, ReportMetric{Label: label, Value: value, Format: format})
+}
+
+// ratioMetric добавляет долю в процентах; нулевая база (nil) не показывается
+func (d *ReportData) ratioMetric(label string, ratio *float64) {
+	if ratio != nil {
+		d.metric(label, roundMoney(*ratio*100), ReportValuePercent)
+	}
+}
+
+// PeriodLabel – период отчёта для заголовков: «05.03.2024» или «01.03.2024 – 07.03.2024»
+func (d *ReportData) PeriodLabel() string {
+	last := d.To.AddDate(0, 0, -1)
+	if !last.After(d.From) {
+		return d.From.Format("02.01.2006")
+	}
+	return d.From.Format("02.01.2006") + " – " + last.Format("02.01.2006")
+}
+
+// BuildReport собирает отчёт подписки за период [from, to) с правами владельца
+func BuildReport(ctx context.Context, s *ReportSubscription, ownerIsAdmin bool, from, to time.Time) (*ReportData, error) {
+	rt := FindReportType(s.Report)
+	if rt == nil {
+		return nil, invalidReportf("unknown report %q", s.Report)
+	}
+	if rt.AdminOnly && !ownerIsAdmin {
+		return nil, ErrReportForbidden
+	}
+	d := &ReportData{
+		Title:    rt.Name,
+		Currency: reportCurrency,
+		From:     from,
+		To:       to,
+		Metrics:  []ReportMetric{},
+		Tables:   []ReportTable{},
+	}
+	// Администратор видит данные всего сервиса, остальные – свои
+	ownerID := s.UserID
+	if ownerIsAdmin {
+		ownerID = ""
+	}
+	var err error
+	switch s.Report {
+	case ReportPipelineSummary:
+		err = buildPipelineSummary(ctx, d, s.Filters, s.UserID, ownerIsAdmin, ownerID)
+	case ReportSalesForecast:
+		err = buildSalesForecastReport(ctx, d, s.Filters, s.UserID, ownerIsAdmin, ownerID)
+	case ReportMRR:
+		err = buildMRRReport(ctx, d, s.Cadence)
+	case ReportAIUsage:
+		err = buildAIUsageReport(ctx, d, ownerID)
+	case ReportAgentResults:
+		err = buildAgentResultsReport(ctx, d, s.Filters, ownerID, s.Location())
+	}
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// reportPipeline – воронка из фильтра или основная воронка владельца
+func reportPipeline(ctx context.Context, f ReportFilters, userID string, isAdmin bool) (*Pipeline, error) {
+	if f.PipelineID == "" {
+		return GetDefaultPipeline(ctx, userID)
+	}
+	p, err := GetPipeline(ctx, f.PipelineID)
+	if err != nil {
+		return nil, err
+	}
+	if !p.CanView(userID, isAdmin) {
+		return nil, ErrPipelineNotFound
+	}
+	return p, nil
+}
+
+// dealOwnerSQL – условие на владельца сделок d следующим параметром; пустой владелец – без условия
+func dealOwnerSQL(ownerID string, args []interface{}) (string, []interface{}) {
+	if ownerID == "" {
+		return "", args
+	}
+	return " AND d.user_id = $" + strconv.Itoa(len(args)+1), append(args, ownerID)
+}
+
+func buildPipelineSummary(ctx context.Context, d *ReportData, f ReportFilters, userID string, isAdmin bool, ownerID string) error {
+	p, err := reportPipeline(ctx, f, userID, isAdmin)
+	if err != nil {
+		return err
+	}
+	d.Subtitle = "Воронка «" + p.Name + "»"
+	owner, args := dealOwnerSQL(ownerID, []interface{}{p.ID, d.From, d.To})
+	base := `
+		FROM crm_deals d
+		JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+		WHERE d.pipeline_id = $1 AND d.deleted_at IS NULL` + owner
+
+	var openCount, createdCount, wonCount, lostCount int
+	var openValue, weighted, createdValue, wonValue float64
+	err = database.Pool.QueryRow(ctx, `
+		SELECT
+			COUNT(*) FILTER (WHERE NOT ps.is_won AND NOT ps.is_lost),
+			COALESCE(SUM(d.value) FILTER (WHERE NOT ps.is_won AND NOT ps.is_lost), 0),
+			COALESCE(SUM(d.value * d.probability::float / 100) FILTER (WHERE NOT ps.is_won AND NOT ps.is_lost), 0),
+			COUNT(*) FILTER (WHERE d.created_at >= $2 AND d.created_at < $3),
+			COALESCE(SUM(d.value) FILTER (WHERE d.created_at >= $2 AND d.created_at < $3), 0),
+			COUNT(*) FILTER (WHERE ps.is_won AND d.closed_at >= $2 AND d.closed_at < $3),
+			COALESCE(SUM(d.value) FILTER (WHERE ps.is_won AND d.closed_at >= $2 AND d.closed_at < $3), 0),
+			COUNT(*) FILTER (WHERE ps.is_lost AND d.closed_at >= $2 AND d.closed_at < $3)
+		`+base, args...).Scan(&openCount, &openValue, &weighted, &createdCount, &createdValue, &wonCount, &wonValue, &lostCount)
+	if err != nil {
+		return err
+	}
+	d.metric("Открытых сделок", float64(openCount), ReportValueNumber)
+	d.metric("Сумма открытых сделок", openValue, ReportValueMoney)
+	d.metric("Взвешенная сумма", roundMoney(weighted), ReportValueMoney)
+	d.metric("Новых сделок за период", float64(createdCount), ReportValueNumber)
+	d.metric("Сумма новых сделок", createdValue, ReportValueMoney)
+	d.metric("Выиграно за период", float64(wonCount), ReportValueNumber)
+	d.metric("Сумма выигранных", wonValue, ReportValueMoney)
+	d.metric("Проиграно за период", float64(lostCount), ReportValueNumber)
+	d.ratioMetric("Доля выигранных", revenueRatio(float64(wonCount), float64(wonCount+lostCount)))
+
+	// Открытые сделки по этапам в порядке воронки
+	type stageTotals struct {
+		count           int
+		value, weighted float64
+	}
+	totals := map[string]stageTotals{}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT d.stage, COUNT(*), COALESCE(SUM(d.value), 0), COALESCE(SUM(d.value * d.probability::float / 100), 0)
+		`+base+`
+		GROUP BY d.stage
+	`, args...)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var stage string
+		var t stageTotals
+		if err := rows.Scan(&stage, &t.count, &t.value, &t.weighted); err != nil {
+			rows.Close()
+			return err
+		}
+		totals[stage] = t
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	stages := ReportTable{
+		Title: "Открытые сделки по этапам",
+		Columns: []ReportColumn{
+			{"Этап", ReportValueText}, {"Сделок", ReportValueNumber}, {"Сумма", ReportValueMoney}, {"Взвешенная сумма", ReportValueMoney},
+		},
+		Rows: [][]interface{}{},
+	}
+	for _, st := range p.Stages {
+		if st.IsClosed() {
+			continue
+		}
+		t := totals[st.Code]
+		stages.Rows = append(stages.Rows, []interface{}{st.Name, float64(t.count), t.value, roundMoney(t.weighted)})
+	}
+	d.Tables = append(d.Tables, stages)
+
+	// Новые и выигранные сделки периода по ответственным
+	rows, err = database.Pool.Query(ctx, `
+		SELECT COALESCE(NULLIF(d.responsible, ''), 'Не назначен'),
+			COUNT(*) FILTER (WHERE d.created_at >= $2 AND d.created_at < $3),
+			COALESCE(SUM(d.value) FILTER (WHERE d.created_at >= $2 AND d.created_at < $3), 0),
+			COUNT(*) FILTER (WHERE ps.is_won AND d.closed_at >= $2 AND d.closed_at < $3),
+			COALESCE(SUM(d.value) FILTER (WHERE ps.is_won AND d.closed_at >= $2 AND d.closed_at < $3), 0)
+		`+base+`
+		AND ((d.created_at >= $2 AND d.created_at < $3) OR (d.closed_at >= $2 AND d.closed_at < $3))
+		GROUP BY 1
+		ORDER BY 5 DESC, 3 DESC
+		LIMIT `+strconv.Itoa(reportMaxTableRows), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	responsible := ReportTable{
+		Title: "Ответственные за период",
+		Columns: []ReportColumn{
+			{"Ответственный", ReportValueText}, {"Новых", ReportValueNumber}, {"Сумма новых", ReportValueMoney},
+			{"Выиграно", ReportValueNumber}, {"Сумма выигранных", ReportValueMoney},
+		},
+		Rows: [][]interface{}{},
+	}
+	for rows.Next() {
+		var name string
+		var created, won int
+		var createdSum, wonSum float64
+		if err := rows.Scan(&name, &created, &createdSum, &won, &wonSum); err != nil {
+			return err
+		}
+		responsible.Rows = append(responsible.Rows, []interface{}{name, float64(created), createdSum, float64(won), wonSum})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.Tables = append(d.Tables, responsible)
+	return nil
+}
+
+func buildSalesForecastReport(ctx context.Context, d *ReportData, f ReportFilters, userID string, isAdmin bool, ownerID string) error {
+	p, err := reportPipeline(ctx, f, userID, isAdmin)
+	if err != nil {
+		return err
+	}
+	d.Subtitle = "Воронка «" + p.Name + "»"
+	forecast, err := GetSalesForecast(ctx, p.ID, ownerID)
+	if err != nil {
+		return err
+	}
+	d.metric("Среднемесячные продажи (6 мес.)", roundMoney(forecast.AvgMonthlyValue), ReportValueMoney)
+	d.metric("Взвешенная сумма открытых сделок", roundMoney(forecast.WeightedForecast), ReportValueMoney)
+	d.metric("Конверсия закрытых сделок", roundMoney(forecast.Conversion), ReportValuePercent)
+	months := ReportTable{
+		Title:   "Прогноз по месяцам",
+		Columns: []ReportColumn{{"Месяц", ReportValueText}, {"Ожидаемая выручка", ReportValueMoney}},
+		Rows:    [][]interface{}{},
+	}
+	for _, m := range forecast.Months {
+		months.Rows = append(months.Rows, []interface{}{m.Month, roundMoney(m.Value)})
+	}
+	d.Tables = append(d.Tables, months)
+
+	// Крупнейшие открытые сделки по взвешенной сумме
+	owner, args := dealOwnerSQL(ownerID, []interface{}{p.ID})
+	rows, err := database.Pool.Query(ctx, `
+		SELECT d.title, ps.name, d.value, COALESCE(d.probability, 0), d.value * COALESCE(d.probability, 0)::float / 100 AS weighted
+		FROM crm_deals d
+		JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+		WHERE d.pipeline_id = $1 AND d.deleted_at IS NULL AND NOT ps.is_won AND NOT ps.is_lost`+owner+`
+		ORDER BY weighted DESC
+		LIMIT `+strconv.Itoa(reportMaxTableRows), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	deals := ReportTable{
+		Title: "Крупнейшие открытые сделки",
+		Columns: []ReportColumn{
+			{"Сделка", ReportValueText}, {"Этап", ReportValueText}, {"Сумма", ReportValueMoney},
+			{"Вероятность", ReportValuePercent}, {"Взвешенная сумма", ReportValueMoney},
+		},
+		Rows: [][]interface{}{},
+	}
+	for rows.Next() {
+		var title, stage string
+		var value, weighted float64
+		var probability int
+		if err := rows.Scan(&title, &stage, &value, &probability, &weighted); err != nil {
+			return err
+		}
+		deals.Rows = append(deals.Rows, []interface{}{title, stage, value, float64(probability), roundMoney(weighted)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.Tables = append(d.Tables, deals)
+	return nil
+}
+
+// buildMRRReport – MRR на конец периода и движения за период по дням расчёта выручки
+func buildMRRReport(ctx context.Context, d *ReportData, cadence string) error {
+	from := time.Date(d.From.Year(), d.From.Month(), d.From.Day(), 0, 0, 0, 0, time.Local)
+	last := time.Date(d.To.Year(), d.To.Month(), d.To.Day()-1, 0, 0, 0, 0, time.Local)
+	before, days, err := revenueDays(ctx, from, last)
+	if err != nil {
+		return err
+	}
+	p := summarizeRevenue(from, last, before, days)
+	d.metric("MRR", p.MRR, ReportValueMoney)
+	d.metric("ARR", p.ARR, ReportValueMoney)
+	d.metric("Платящих клиентов", float64(p.PayingCustomers), ReportValueNumber)
+	d.metric("ARPU", p.ARPU, ReportValueMoney)
+	d.metric("Чистый прирост MRR", p.NetNewMRR, ReportValueMoney)
+	d.metric("Новых клиентов", float64(p.NewCustomers), ReportValueNumber)
+	d.metric("Ушедших клиентов", float64(p.ChurnedCustomers), ReportValueNumber)
+	d.ratioMetric("Отток клиентов", p.LogoChurnRate)
+	d.ratioMetric("Отток выручки", p.RevenueChurnRate)
+	d.ratioMetric("NRR", p.NetRevenueRetention)
+	d.metric("Поступления", p.PaymentsRevenue, ReportValueMoney)
+
+	d.Tables = append(d.Tables, ReportTable{
+		Title:   "Движение MRR",
+		Columns: []ReportColumn{{"Движение", ReportValueText}, {"Сумма", ReportValueMoney}},
+		Rows: [][]interface{}{
+			{"Новые клиенты", p.NewMRR},
+			{"Расширение", p.ExpansionMRR},
+			{"Возврат", p.ReactivationMRR},
+			{"Сокращение", -p.ContractionMRR},
+			{"Отток", -p.ChurnedMRR},
+		},
+	})
+
+	// Ежемесячный отчёт – по неделям, остальные – по дням
+	granularity := RevenueGranularityDay
+	if cadence == ReportCadenceMonthly {
+		granularity = RevenueGranularityWeek
+	}
+	series, err := RevenueSeries(ctx, from, last, granularity)
+	if err != nil {
+		return err
+	}
+	table := ReportTable{
+		Title: "MRR по периодам",
+		Columns: []ReportColumn{
+			{"Период", ReportValueText}, {"MRR", ReportValueMoney}, {"Чистый прирост", ReportValueMoney},
+			{"Новых", ReportValueNumber}, {"Ушло", ReportValueNumber},
+		},
+		Rows: [][]interface{}{},
+	}
+	for _, s := range series {
+		label := s.From
+		if s.To != s.From {
+			label += " – " + s.To
+		}
+		table.Rows = append(table.Rows, []interface{}{label, s.MRR, s.NetNewMRR, float64(s.NewCustomers), float64(s.ChurnedCustomers)})
+	}
+	d.Tables = append(d.Tables, table)
+	return nil
+}
+
+// buildAIUsageReport – запросы к ИИ-шлюзу за период; ownerID – только запросы владельца
+func buildAIUsageReport(ctx context.Context, d *ReportData, ownerID string) error {
+	where := ` WHERE l.created_at >= $1 AND l.created_at < $2`
+	args := []interface{}{d.From, d.To}
+	if ownerID != "" {
+		where += ` AND l.user_id::text = $3`
+		args = append(args, ownerID)
+	}
+	var requests, tokens, failed int64
+	var avgDuration float64
+	err := database.Pool.QueryRow(ctx, `
+		SELECT COUNT(*), COALESCE(SUM(l.total_tokens), 0), COALESCE(AVG(l.duration_ms), 0),
+			COUNT(*) FILTER (WHERE l.status_code >= 400 OR l.error IS NOT NULL)
+		FROM ai_usage_logs l`+where, args...).Scan(&requests, &tokens, &avgDuration, &failed)
+	if err != nil {
+		return err
+	}
+	d.metric("Запросов", float64(requests), ReportValueNumber)
+	d.metric("Токенов", float64(tokens), ReportValueNumber)
+	d.metric("Среднее время ответа, мс", roundMoney(avgDuration), ReportValueNumber)
+	d.metric("Ошибок", float64(failed), ReportValueNumber)
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT l.model, COUNT(*), COALESCE(SUM(l.total_tokens), 0),
+			COUNT(*) FILTER (WHERE l.status_code >= 400 OR l.error IS NOT NULL)
+		FROM ai_usage_logs l`+where+`
+		GROUP BY l.model
+		ORDER BY 3 DESC
+		LIMIT `+strconv.Itoa(reportMaxTableRows), args...)
+	if err != nil {
+		return err
+	}
+	byModel := ReportTable{
+		Title:   "По моделям",
+		Columns: []ReportColumn{{"Модель", ReportValueText}, {"Запросов", ReportValueNumber}, {"Токенов", ReportValueNumber}, {"Ошибок", ReportValueNumber}},
+		Rows:    [][]interface{}{},
+	}
+	for rows.Next() {
+		var model string
+		var req, tok, errs int64
+		if err := rows.Scan(&model, &req, &tok, &errs); err != nil {
+			rows.Close()
+			return err
+		}
+		byModel.Rows = append(byModel.Rows, []interface{}{model, float64(req), float64(tok), float64(errs)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.Tables = append(d.Tables, byModel)
+	if ownerID != "" {
+		return nil
+	}
+
+	rows, err = database.Pool.Query(ctx, `
+		SELECT u.email, COUNT(*), COALESCE(SUM(l.total_tokens), 0)
+		FROM ai_usage_logs l
+		JOIN users u ON u.id = l.user_id`+where+`
+		GROUP BY u.id, u.email
+		ORDER BY 3 DESC
+		LIMIT `+strconv.Itoa(reportMaxTableRows), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	byUser := ReportTable{
+		Title:   "Пользователи",
+		Columns: []ReportColumn{{"Пользователь", ReportValueText}, {"Запросов", ReportValueNumber}, {"Токенов", ReportValueNumber}},
+		Rows:    [][]interface{}{},
+	}
+	for rows.Next() {
+		var email string
+		var req, tok int64
+		if err := rows.Scan(&email, &req, &tok); err != nil {
+			return err
+		}
+		byUser.Rows = append(byUser.Rows, []interface{}{email, float64(req), float64(tok)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.Tables = append(d.Tables, byUser)
+	return nil
+}
+
+// buildAgentResultsReport – задачи ИИ-агентов за период. Таблица ai_agent_tasks создаётся
+// вместе с агентами; если её нет, отчёт пустой. ownerID – только задачи по клиентам владельца.
+func buildAgentResultsReport(ctx context.Context, d *ReportData, f ReportFilters, ownerID string, loc *time.Location) error {
+	var exists bool
+	if err := database.Pool.QueryRow(ctx, `SELECT to_regclass('ai_agent_tasks') IS NOT NULL`).Scan(&exists); err != nil {
+		return err
+	}
+	if f.TaskType != "" {
+		d.Subtitle = "Тип задач: " + f.TaskType
+	}
+	byType := ReportTable{
+		Title:   "По типам задач",
+		Columns: []ReportColumn{{"Тип", ReportValueText}, {"Выполнено", ReportValueNumber}, {"Ошибок", ReportValueNumber}, {"Ожидает", ReportValueNumber}},
+		Rows:    [][]interface{}{},
+	}
+	results := ReportTable{
+		Title:   "Последние результаты",
+		Columns: []ReportColumn{{"Выполнена", ReportValueText}, {"Тип", ReportValueText}, {"Клиент", ReportValueText}, {"Результат", ReportValueText}},
+		Rows:    [][]interface{}{},
+	}
+	if !exists {
+		d.metric("Выполнено задач", 0, ReportValueNumber)
+		d.metric("Ошибок", 0, ReportValueNumber)
+		d.metric("Ожидает выполнения", 0, ReportValueNumber)
+		d.Tables = append(d.Tables, byType, results)
+		return nil
+	}
+
+	from := `
+		FROM ai_agent_tasks t
+		LEFT JOIN crm_customers c ON c.id::text = t.customer_id::text
+		WHERE COALESCE(t.executed_at, t.scheduled_at) >= $1 AND COALESCE(t.executed_at, t.scheduled_at) < $2`
+	args := []interface{}{d.From, d.To}
+	if f.TaskType != "" {
+		args = append(args, f.TaskType)
+		from += ` AND t.task_type = $` + strconv.Itoa(len(args))
+	}
+	if ownerID != "" {
+		args = append(args, ownerID)
+		from += ` AND c.user_id::text = $` + strconv.Itoa(len(args))
+	}
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT t.task_type,
+			COUNT(*) FILTER (WHERE t.status = 'completed'),
+			COUNT(*) FILTER (WHERE t.status = 'failed'),
+			COUNT(*) FILTER (WHERE t.status = 'pending')
+		`+from+`
+		GROUP BY t.task_type
+		ORDER BY 2 DESC, 1
+	`, args...)
+	if err != nil {
+		return err
+	}
+	var completed, failed, pending float64
+	for rows.Next() {
+		var taskType string
+		var done, errs, waiting int
+		if err := rows.Scan(&taskType, &done, &errs, &waiting); err != nil {
+			rows.Close()
+			return err
+		}
+		completed += float64(done)
+		failed += float64(errs)
+		pending += float64(waiting)
+		byType.Rows = append(byType.Rows, []interface{}{taskType, float64(done), float64(errs), float64(waiting)})
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.metric("Выполнено задач", completed, ReportValueNumber)
+	d.metric("Ошибок", failed, ReportValueNumber)
+	d.metric("Ожидает выполнения", pending, ReportValueNumber)
+	d.Tables = append(d.Tables, byType)
+
+	rows, err = database.Pool.Query(ctx, `
+		SELECT t.executed_at, t.task_type, COALESCE(c.name, ''), COALESCE(t.result, '')
+		`+from+` AND t.status = 'completed'
+		ORDER BY t.executed_at DESC
+		LIMIT `+strconv.Itoa(reportMaxTableRows), args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var executedAt *time.Time
+		var taskType, customer, result string
+		if err := rows.Scan(&executedAt, &taskType, &customer, &result); err != nil {
+			return err
+		}
+		at := ""
+		if executedAt != nil {
+			at = executedAt.In(loc).Format("02.01.2006 15:04")
+		}
+		results.Rows = append(results.Rows, []interface{}{at, taskType, customer, truncateString(result, 300)})
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	d.Tables = append(d.Tables, results)
+	return nil
+}
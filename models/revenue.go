@@ -0,0 +1,810 @@
+package models
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Метрики выручки подписок. MRR клиента на конец дня – сумма месячной стоимости его
+// действующих подписок (годовой тариф – price_yearly/12). Подписка действует с даты создания
+// (после окончания пробного периода) до конца оплаченного периода; продлеваемая подписка
+// без оплаты ещё graceDays дней считается платящей, отменённая сразу – до момента отмены.
+//
+// Расчёт идёт по дням: состояние на конец дня сравнивается с сохранённым в revenue_customer_mrr,
+// разница пишется движениями MRR (new, expansion, contraction, churn, reactivation), итоги дня –
+// в revenue_daily. История смен тарифов в user_subscriptions не хранится, поэтому посчитанный
+// день больше не пересчитывается; полный пересчёт (RebuildRevenueMetrics) восстанавливает
+// прошлое только по текущему состоянию подписок. Суммы складываются без конвертации валют.
+
+var (
+	ErrInvalidRevenueQuery = errors.New("invalid revenue query")
+)
+
+// Виды движений MRR
+const (
+	MRRMovementNew          = "new"
+	MRRMovementExpansion    = "expansion"
+	MRRMovementContraction  = "contraction"
+	MRRMovementChurn        = "churn"
+	MRRMovementReactivation = "reactivation"
+)
+
+// MRRMovementKinds – известные виды движений
+var MRRMovementKinds = []string{
+	MRRMovementNew, MRRMovementExpansion, MRRMovementContraction, MRRMovementChurn, MRRMovementReactivation,
+}
+
+// Шаг ряда метрик
+const (
+	RevenueGranularityDay   = "day"
+	RevenueGranularityWeek  = "week"
+	RevenueGranularityMonth = "month"
+)
+
+const (
+	revenueDateLayout = "2006-01-02"
+	// revenueLockKey – расчёт дней идёт строго по порядку и только в одном процессе
+	revenueLockKey = "revenue_metrics"
+	// revenueChurnWindowDays – окно для среднего месячного оттока в прогнозе LTV
+	revenueChurnWindowDays = 90
+	// revenueMaxSeriesDays – предел длины ряда, чтобы не выгружать годы дневных строк
+	revenueMaxSeriesDays = 3 * 366
+)
+
+// subscriptionMRRExpr – месячная стоимость подписки s по тарифу p
+const subscriptionMRRExpr = `CASE WHEN s.current_period_end - s.current_period_start > INTERVAL '300 days'
+	THEN p.price_yearly / 12 ELSE p.price_monthly END`
+
+// RevenueDay – итоги одного дня
+type RevenueDay struct {
+	Day                  time.Time `json:"-"`
+	Date                 string    `json:"day"`
+	MRR                  float64   `json:"mrr"`
+	PayingCustomers      int       `json:"paying_customers"`
+	NewMRR               float64   `json:"new_mrr"`
+	ExpansionMRR         float64   `json:"expansion_mrr"`
+	ContractionMRR       float64   `json:"contraction_mrr"`
+	ChurnedMRR           float64   `json:"churned_mrr"`
+	ReactivationMRR      float64   `json:"reactivation_mrr"`
+	NewCustomers         int       `json:"new_customers"`
+	ChurnedCustomers     int       `json:"churned_customers"`
+	ReactivatedCustomers int       `json:"reactivated_customers"`
+	PaymentsRevenue      float64   `json:"payments_revenue"`
+}
+
+// MRRMovement – изменение MRR клиента за день
+type MRRMovement struct {
+	ID        int64     `json:"id"`
+	Day       string    `json:"day"`
+	UserID    uuid.UUID `json:"user_id"`
+	UserEmail string    `json:"user_email,omitempty"`
+	Kind      string    `json:"kind"`
+	PlanFrom  *int      `json:"plan_from"`
+	PlanTo    *int      `json:"plan_to"`
+	MRRFrom   float64   `json:"mrr_from"`
+	MRRTo     float64   `json:"mrr_to"`
+	Delta     float64   `json:"delta"`
+}
+
+// RevenuePeriod – метрики за период (точку ряда или окно сводки).
+// Доли – nil, если база для деления нулевая.
+type RevenuePeriod struct {
+	From                 string   `json:"from"`
+	To                   string   `json:"to"`
+	StartMRR             float64  `json:"start_mrr"`
+	MRR                  float64  `json:"mrr"`
+	ARR                  float64  `json:"arr"`
+	StartCustomers       int      `json:"start_customers"`
+	PayingCustomers      int      `json:"paying_customers"`
+	ARPU                 float64  `json:"arpu"`
+	NewMRR               float64  `json:"new_mrr"`
+	ExpansionMRR         float64  `json:"expansion_mrr"`
+	ContractionMRR       float64  `json:"contraction_mrr"`
+	ChurnedMRR           float64  `json:"churned_mrr"`
+	ReactivationMRR      float64  `json:"reactivation_mrr"`
+	NetNewMRR            float64  `json:"net_new_mrr"`
+	NewCustomers         int      `json:"new_customers"`
+	ChurnedCustomers     int      `json:"churned_customers"`
+	ReactivatedCustomers int      `json:"reactivated_customers"`
+	LogoChurnRate        *float64 `json:"logo_churn_rate"`
+	RevenueChurnRate     *float64 `json:"revenue_churn_rate"`
+	NetRevenueRetention  *float64 `json:"net_revenue_retention"`
+	QuickRatio           *float64 `json:"quick_ratio"`
+	PaymentsRevenue      float64  `json:"payments_revenue"`
+}
+
+// RevenueSummary – текущие показатели и итоги последних 30 дней
+type RevenueSummary struct {
+	AsOf                   *string        `json:"as_of"`
+	MRR                    float64        `json:"mrr"`
+	ARR                    float64        `json:"arr"`
+	PayingCustomers        int            `json:"paying_customers"`
+	ARPU                   float64        `json:"arpu"`
+	MRRGrowthRate          *float64       `json:"mrr_growth_rate"`
+	Last30Days             *RevenuePeriod `json:"last_30_days"`
+	MonthlyLogoChurn       *float64       `json:"monthly_logo_churn"`
+	ExpectedLifetimeMonths *float64       `json:"expected_lifetime_months"`
+	PredictedLTV           *float64       `json:"predicted_ltv"`
+}
+
+// RevenueCohort – клиенты, впервые начавшие платить в одном месяце
+type RevenueCohort struct {
+	Month           string    `json:"month"`
+	Customers       int       `json:"customers"`
+	StillPaying     int       `json:"still_paying"`
+	RetentionRate   float64   `json:"retention_rate"`
+	Revenue         float64   `json:"revenue"`
+	RealizedLTV     float64   `json:"realized_ltv"`
+	CumulativeLTV   []float64 `json:"cumulative_ltv"`
+	MRR             float64   `json:"mrr"`
+	ProjectedLTV    *float64  `json:"projected_ltv"`
+	MonthsSinceJoin int       `json:"months_since_join"`
+}
+
+// CustomerRevenue – выручка и LTV одного клиента
+type CustomerRevenue struct {
+	UserID                 uuid.UUID     `json:"user_id"`
+	CurrentMRR             float64       `json:"current_mrr"`
+	PlanID                 *int          `json:"plan_id"`
+	FirstPaidOn            *string       `json:"first_paid_on"`
+	ChurnedOn              *string       `json:"churned_on"`
+	RealizedRevenue        float64       `json:"realized_revenue"`
+	ExpectedLifetimeMonths *float64      `json:"expected_lifetime_months"`
+	PredictedLTV           float64       `json:"predicted_ltv"`
+	Movements              []MRRMovement `json:"movements"`
+}
+
+// revenueDay – дата без времени в локальной зоне сервера, в которой считаются дни
+func revenueDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.Local)
+}
+
+// revenueRatio – a/b или nil при нулевой базе
+func revenueRatio(a, b float64) *float64 {
+	if b == 0 {
+		return nil
+	}
+	v := math.Round(a/b*10000) / 10000
+	return &v
+}
+
+// ProcessNextRevenueDay считает следующий непосчитанный день, если он не позже until.
+// Первый день – дата самой ранней подписки. Возвращает посчитанный день или nil, если считать нечего.
+func ProcessNextRevenueDay(ctx context.Context, until time.Time, graceDays int) (*RevenueDay, error) {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, revenueLockKey); err != nil {
+		return nil, err
+	}
+	var last, first *time.Time
+	if err := tx.QueryRow(ctx, `SELECT MAX(day) FROM revenue_daily`).Scan(&last); err != nil {
+		return nil, err
+	}
+	var day time.Time
+	if last != nil {
+		day = revenueDay(*last).AddDate(0, 0, 1)
+	} else {
+		if err := tx.QueryRow(ctx, `SELECT MIN(created_at) FROM user_subscriptions`).Scan(&first); err != nil {
+			return nil, err
+		}
+		if first == nil {
+			return nil, nil
+		}
+		day = revenueDay(*first)
+	}
+	if day.After(revenueDay(until)) {
+		return nil, nil
+	}
+
+	result, err := processRevenueDay(ctx, tx, day, graceDays)
+	if err != nil {
+		return nil, fmt.Errorf("revenue day %s: %w", day.Format(revenueDateLayout), err)
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+type customerMRR struct {
+	mrr    float64
+	planID *int
+}
+
+// processRevenueDay сравнивает MRR клиентов на конец дня с сохранённым состоянием и пишет движения
+func processRevenueDay(ctx context.Context, tx pgx.Tx, day time.Time, graceDays int) (*RevenueDay, error) {
+	rows, err := tx.Query(ctx, `
+		SELECT s.user_id, SUM(`+subscriptionMRRExpr+`)::float8,
+		       (ARRAY_AGG(s.plan_id ORDER BY `+subscriptionMRRExpr+` DESC))[1]
+		FROM user_subscriptions s
+		JOIN subscription_plans p ON p.id = s.plan_id
+		WHERE s.created_at < $1::date + 1
+		  AND (s.trial_end IS NULL OR s.trial_end < $1::date + 1)
+		  AND CASE
+		        WHEN s.status IN ('active', 'past_due') AND NOT COALESCE(s.cancel_at_period_end, false)
+		          THEN s.current_period_end + make_interval(days => $2)
+		        WHEN s.status IN ('active', 'past_due') THEN s.current_period_end
+		        ELSE LEAST(s.updated_at, s.current_period_end)
+		      END >= $1::date + 1
+		GROUP BY s.user_id`, day, graceDays)
+	if err != nil {
+		return nil, err
+	}
+	current := map[uuid.UUID]customerMRR{}
+	for rows.Next() {
+		var id uuid.UUID
+		var c customerMRR
+		if err := rows.Scan(&id, &c.mrr, &c.planID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		if c.mrr = roundMoney(c.mrr); c.mrr > 0 {
+			current[id] = c
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	ids := make([]uuid.UUID, 0, len(current))
+	for id := range current {
+		ids = append(ids, id)
+	}
+	type storedMRR struct {
+		customerMRR
+		exists bool
+	}
+	stored := map[uuid.UUID]storedMRR{}
+	rows, err = tx.Query(ctx, `
+		SELECT user_id, mrr::float8, plan_id FROM revenue_customer_mrr
+		WHERE mrr > 0 OR user_id = ANY($1)`, ids)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var id uuid.UUID
+		var s storedMRR
+		if err := rows.Scan(&id, &s.mrr, &s.planID); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		s.exists = true
+		stored[id] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	result := &RevenueDay{Day: day, Date: day.Format(revenueDateLayout), PayingCustomers: len(current)}
+	for _, c := range current {
+		result.MRR += c.mrr
+	}
+	changed := map[uuid.UUID]bool{}
+	for id := range current {
+		changed[id] = true
+	}
+	for id := range stored {
+		changed[id] = true
+	}
+	for id := range changed {
+		was, now := stored[id], current[id]
+		kind := ""
+		switch {
+		case was.mrr == now.mrr:
+		case was.mrr == 0 && was.exists:
+			kind = MRRMovementReactivation
+			result.ReactivationMRR += now.mrr
+			result.ReactivatedCustomers++
+		case was.mrr == 0:
+			kind = MRRMovementNew
+			result.NewMRR += now.mrr
+			result.NewCustomers++
+		case now.mrr == 0:
+			kind = MRRMovementChurn
+			result.ChurnedMRR += was.mrr
+			result.ChurnedCustomers++
+		case now.mrr > was.mrr:
+			kind = MRRMovementExpansion
+			result.ExpansionMRR += now.mrr - was.mrr
+		default:
+			kind = MRRMovementContraction
+			result.ContractionMRR += was.mrr - now.mrr
+		}
+		if kind != "" {
+			if _, err := tx.Exec(ctx, `
+				INSERT INTO revenue_mrr_movements (day, user_id, kind, plan_from, plan_to, mrr_from, mrr_to, delta)
+				VALUES ($1, $2, $3, $4, $5, $6, $7, $8)`,
+				day, id, kind, was.planID, now.planID, was.mrr, now.mrr, roundMoney(now.mrr-was.mrr)); err != nil {
+				return nil, err
+			}
+		}
+		samePlan := (was.planID == nil && now.planID == nil) ||
+			(was.planID != nil && now.planID != nil && *was.planID == *now.planID)
+		if kind == "" && (samePlan || now.mrr == 0) {
+			continue
+		}
+		if _, err := tx.Exec(ctx, `
+			INSERT INTO revenue_customer_mrr (user_id, mrr, plan_id, first_paid_on, last_change_on, churned_on)
+			VALUES ($1, $2, $3, $4, $4, NULL)
+			ON CONFLICT (user_id) DO UPDATE SET
+				mrr = EXCLUDED.mrr,
+				plan_id = COALESCE(EXCLUDED.plan_id, revenue_customer_mrr.plan_id),
+				last_change_on = EXCLUDED.last_change_on,
+				churned_on = CASE WHEN EXCLUDED.mrr = 0 THEN EXCLUDED.last_change_on END`,
+			id, now.mrr, now.planID, day); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.QueryRow(ctx, `
+		SELECT COALESCE(SUM(amount), 0)::float8 FROM payments
+		WHERE status = 'completed'
+		  AND COALESCE(completed_at, created_at) >= $1::date
+		  AND COALESCE(completed_at, created_at) < $1::date + 1`, day).Scan(&result.PaymentsRevenue); err != nil {
+		return nil, err
+	}
+
+	result.MRR = roundMoney(result.MRR)
+	result.NewMRR = roundMoney(result.NewMRR)
+	result.ExpansionMRR = roundMoney(result.ExpansionMRR)
+	result.ContractionMRR = roundMoney(result.ContractionMRR)
+	result.ChurnedMRR = roundMoney(result.ChurnedMRR)
+	result.ReactivationMRR = roundMoney(result.ReactivationMRR)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO revenue_daily (day, mrr, paying_customers, new_mrr, expansion_mrr, contraction_mrr,
+			churned_mrr, reactivation_mrr, new_customers, churned_customers, reactivated_customers, payments_revenue)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)`,
+		day, result.MRR, result.PayingCustomers, result.NewMRR, result.ExpansionMRR, result.ContractionMRR,
+		result.ChurnedMRR, result.ReactivationMRR, result.NewCustomers, result.ChurnedCustomers,
+		result.ReactivatedCustomers, result.PaymentsRevenue)
+	if err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// RebuildRevenueMetrics удаляет посчитанные дни и движения; следующий проход считает всё заново с первой подписки
+func RebuildRevenueMetrics(ctx context.Context) error {
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1))`, revenueLockKey); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(ctx, `TRUNCATE revenue_daily, revenue_mrr_movements, revenue_customer_mrr`); err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+const revenueDayColumns = `day, mrr::float8, paying_customers, new_mrr::float8, expansion_mrr::float8,
+	contraction_mrr::float8, churned_mrr::float8, reactivation_mrr::float8, new_customers,
+	churned_customers, reactivated_customers, payments_revenue::float8`
+
+func scanRevenueDay(row pgx.Row) (*RevenueDay, error) {
+	d := &RevenueDay{}
+	err := row.Scan(&d.Day, &d.MRR, &d.PayingCustomers, &d.NewMRR, &d.ExpansionMRR, &d.ContractionMRR,
+		&d.ChurnedMRR, &d.ReactivationMRR, &d.NewCustomers, &d.ChurnedCustomers, &d.ReactivatedCustomers,
+		&d.PaymentsRevenue)
+	if err != nil {
+		return nil, err
+	}
+	d.Day = revenueDay(d.Day)
+	d.Date = d.Day.Format(revenueDateLayout)
+	return d, nil
+}
+
+// LastRevenueDay – последний посчитанный день; nil – расчёта ещё не было
+func LastRevenueDay(ctx context.Context) (*RevenueDay, error) {
+	d, err := scanRevenueDay(database.Pool.QueryRow(ctx,
+		`SELECT `+revenueDayColumns+` FROM revenue_daily ORDER BY day DESC LIMIT 1`))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	return d, err
+}
+
+// revenueDays – посчитанные дни [from, to] и последний посчитанный день до from (база периода)
+func revenueDays(ctx context.Context, from, to time.Time) (*RevenueDay, []RevenueDay, error) {
+	before, err := scanRevenueDay(database.Pool.QueryRow(ctx,
+		`SELECT `+revenueDayColumns+` FROM revenue_daily WHERE day < $1 ORDER BY day DESC LIMIT 1`, from))
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil, err
+	}
+	rows, err := database.Pool.Query(ctx,
+		`SELECT `+revenueDayColumns+` FROM revenue_daily WHERE day >= $1 AND day <= $2 ORDER BY day`, from, to)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+	days := []RevenueDay{}
+	for rows.Next() {
+		d, err := scanRevenueDay(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		days = append(days, *d)
+	}
+	return before, days, rows.Err()
+}
+
+// summarizeRevenue сводит дни периода; start – состояние перед периодом (nil – с нуля)
+func summarizeRevenue(from, to time.Time, start *RevenueDay, days []RevenueDay) *RevenuePeriod {
+	p := &RevenuePeriod{From: from.Format(revenueDateLayout), To: to.Format(revenueDateLayout)}
+	if start != nil {
+		p.StartMRR, p.StartCustomers = start.MRR, start.PayingCustomers
+	}
+	p.MRR, p.PayingCustomers = p.StartMRR, p.StartCustomers
+	for _, d := range days {
+		p.MRR, p.PayingCustomers = d.MRR, d.PayingCustomers
+		p.NewMRR += d.NewMRR
+		p.ExpansionMRR += d.ExpansionMRR
+		p.ContractionMRR += d.ContractionMRR
+		p.ChurnedMRR += d.ChurnedMRR
+		p.ReactivationMRR += d.ReactivationMRR
+		p.NewCustomers += d.NewCustomers
+		p.ChurnedCustomers += d.ChurnedCustomers
+		p.ReactivatedCustomers += d.ReactivatedCustomers
+		p.PaymentsRevenue += d.PaymentsRevenue
+	}
+	p.NewMRR = roundMoney(p.NewMRR)
+	p.ExpansionMRR = roundMoney(p.ExpansionMRR)
+	p.ContractionMRR = roundMoney(p.ContractionMRR)
+	p.ChurnedMRR = roundMoney(p.ChurnedMRR)
+	p.ReactivationMRR = roundMoney(p.ReactivationMRR)
+	p.PaymentsRevenue = roundMoney(p.PaymentsRevenue)
+	p.ARR = roundMoney(p.MRR * 12)
+	if p.PayingCustomers > 0 {
+		p.ARPU = roundMoney(p.MRR / float64(p.PayingCustomers))
+	}
+	p.NetNewMRR = roundMoney(p.NewMRR + p.ExpansionMRR + p.ReactivationMRR - p.ContractionMRR - p.ChurnedMRR)
+	p.LogoChurnRate = revenueRatio(float64(p.ChurnedCustomers), float64(p.StartCustomers))
+	p.RevenueChurnRate = revenueRatio(p.ChurnedMRR+p.ContractionMRR, p.StartMRR)
+	// NRR считается по клиентам начала периода: новые и вернувшиеся в неё не входят
+	p.NetRevenueRetention = revenueRatio(p.StartMRR+p.ExpansionMRR-p.ContractionMRR-p.ChurnedMRR, p.StartMRR)
+	p.QuickRatio = revenueRatio(p.NewMRR+p.ExpansionMRR+p.ReactivationMRR, p.ContractionMRR+p.ChurnedMRR)
+	return p
+}
+
+// ParseRevenueRange разбирает границы периода (YYYY-MM-DD); по умолчанию – последние 12 месяцев
+func ParseRevenueRange(fromStr, toStr string) (time.Time, time.Time, error) {
+	to := revenueDay(time.Now())
+	if toStr != "" {
+		t, err := time.ParseInLocation(revenueDateLayout, toStr, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w: to must be YYYY-MM-DD", ErrInvalidRevenueQuery)
+		}
+		to = t
+	}
+	from := to.AddDate(-1, 0, 1)
+	if fromStr != "" {
+		t, err := time.ParseInLocation(revenueDateLayout, fromStr, time.Local)
+		if err != nil {
+			return time.Time{}, time.Time{}, fmt.Errorf("%w: from must be YYYY-MM-DD", ErrInvalidRevenueQuery)
+		}
+		from = t
+	}
+	if from.After(to) {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: from is after to", ErrInvalidRevenueQuery)
+	}
+	if to.Sub(from) > revenueMaxSeriesDays*24*time.Hour {
+		return time.Time{}, time.Time{}, fmt.Errorf("%w: period is longer than %d days", ErrInvalidRevenueQuery, revenueMaxSeriesDays)
+	}
+	return from, to, nil
+}
+
+// revenueBucketStart – начало шага ряда, в который попадает день (неделя – с понедельника)
+func revenueBucketStart(day time.Time, granularity string) time.Time {
+	switch granularity {
+	case RevenueGranularityWeek:
+		return day.AddDate(0, 0, -((int(day.Weekday()) + 6) % 7))
+	case RevenueGranularityMonth:
+		return time.Date(day.Year(), day.Month(), 1, 0, 0, 0, 0, time.Local)
+	}
+	return day
+}
+
+func revenueBucketEnd(start time.Time, granularity string) time.Time {
+	switch granularity {
+	case RevenueGranularityWeek:
+		return start.AddDate(0, 0, 6)
+	case RevenueGranularityMonth:
+		return start.AddDate(0, 1, -1)
+	}
+	return start
+}
+
+// RevenueSeries – ряд метрик за [from, to] с шагом day, week или month.
+// Крайние шаги обрезаются границами периода; дни без расчёта в ряд не попадают.
+func RevenueSeries(ctx context.Context, from, to time.Time, granularity string) ([]RevenuePeriod, error) {
+	if granularity == "" {
+		granularity = RevenueGranularityMonth
+	}
+	if !containsString([]string{RevenueGranularityDay, RevenueGranularityWeek, RevenueGranularityMonth}, granularity) {
+		return nil, fmt.Errorf("%w: granularity must be day, week or month", ErrInvalidRevenueQuery)
+	}
+	before, days, err := revenueDays(ctx, from, to)
+	if err != nil {
+		return nil, err
+	}
+	series := []RevenuePeriod{}
+	for i := 0; i < len(days); {
+		start := revenueBucketStart(days[i].Day, granularity)
+		end := revenueBucketEnd(start, granularity)
+		j := i
+		for j < len(days) && !days[j].Day.After(end) {
+			j++
+		}
+		if start.Before(from) {
+			start = from
+		}
+		if end.After(to) {
+			end = to
+		}
+		series = append(series, *summarizeRevenue(start, end, before, days[i:j]))
+		before = &days[j-1]
+		i = j
+	}
+	return series, nil
+}
+
+// monthlyLogoChurn – средний месячный логотипный отток за последние revenueChurnWindowDays дней
+func monthlyLogoChurn(ctx context.Context, asOf time.Time) (*float64, error) {
+	var churned, avgCustomers float64
+	err := database.Pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(churned_customers), 0)::float8, COALESCE(AVG(paying_customers), 0)::float8
+		FROM revenue_daily WHERE day > $1::date - $2::int AND day <= $1`,
+		asOf, revenueChurnWindowDays).Scan(&churned, &avgCustomers)
+	if err != nil {
+		return nil, err
+	}
+	return revenueRatio(churned*30/revenueChurnWindowDays, avgCustomers), nil
+}
+
+// GetRevenueSummary – показатели на последний посчитанный день и итоги 30 дней до него
+func GetRevenueSummary(ctx context.Context) (*RevenueSummary, error) {
+	summary := &RevenueSummary{}
+	last, err := LastRevenueDay(ctx)
+	if err != nil || last == nil {
+		return summary, err
+	}
+	summary.AsOf = &last.Date
+	summary.MRR, summary.PayingCustomers = last.MRR, last.PayingCustomers
+	summary.ARR = roundMoney(last.MRR * 12)
+	if last.PayingCustomers > 0 {
+		summary.ARPU = roundMoney(last.MRR / float64(last.PayingCustomers))
+	}
+
+	from := last.Day.AddDate(0, 0, -29)
+	before, days, err := revenueDays(ctx, from, last.Day)
+	if err != nil {
+		return nil, err
+	}
+	summary.Last30Days = summarizeRevenue(from, last.Day, before, days)
+	if before != nil {
+		summary.MRRGrowthRate = revenueRatio(last.MRR-before.MRR, before.MRR)
+	}
+
+	if summary.MonthlyLogoChurn, err = monthlyLogoChurn(ctx, last.Day); err != nil {
+		return nil, err
+	}
+	if churn := summary.MonthlyLogoChurn; churn != nil && *churn > 0 {
+		lifetime := math.Round(1 / *churn * 10) / 10
+		ltv := roundMoney(summary.ARPU / *churn)
+		summary.ExpectedLifetimeMonths, summary.PredictedLTV = &lifetime, &ltv
+	}
+	return summary, nil
+}
+
+// monthsBetween – число полных календарных месяцев от месяца a до месяца b
+func monthsBetween(a, b time.Time) int {
+	return (b.Year()-a.Year())*12 + int(b.Month()) - int(a.Month())
+}
+
+// GetRevenueCohorts – когорты по месяцу первой оплаты за последние months месяцев:
+// накопленная выручка на клиента по месяцам жизни (платежи), доля всё ещё платящих и прогноз LTV
+// (выручка на клиента + текущий MRR когорты на клиента × ожидаемый остаток жизни).
+func GetRevenueCohorts(ctx context.Context, months int) ([]RevenueCohort, error) {
+	if months <= 0 || months > 60 {
+		return nil, fmt.Errorf("%w: months must be between 1 and 60", ErrInvalidRevenueQuery)
+	}
+	now := revenueDay(time.Now())
+	since := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.Local).AddDate(0, -(months - 1), 0)
+
+	rows, err := database.Pool.Query(ctx, `
+		SELECT date_trunc('month', first_paid_on)::date, COUNT(*), COUNT(*) FILTER (WHERE mrr > 0),
+		       COALESCE(SUM(mrr), 0)::float8
+		FROM revenue_customer_mrr WHERE first_paid_on >= $1
+		GROUP BY 1 ORDER BY 1`, since)
+	if err != nil {
+		return nil, err
+	}
+	cohorts := []RevenueCohort{}
+	index := map[string]int{}
+	for rows.Next() {
+		var month time.Time
+		c := RevenueCohort{}
+		if err := rows.Scan(&month, &c.Customers, &c.StillPaying, &c.MRR); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		c.Month = month.Format("2006-01")
+		c.MonthsSinceJoin = monthsBetween(month, now)
+		c.CumulativeLTV = make([]float64, c.MonthsSinceJoin+1)
+		c.RetentionRate = math.Round(float64(c.StillPaying)/float64(c.Customers)*10000) / 10000
+		c.MRR = roundMoney(c.MRR)
+		index[c.Month] = len(cohorts)
+		cohorts = append(cohorts, c)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	rows, err = database.Pool.Query(ctx, `
+		SELECT date_trunc('month', r.first_paid_on)::date,
+		       date_trunc('month', COALESCE(p.completed_at, p.created_at))::date,
+		       SUM(p.amount)::float8
+		FROM revenue_customer_mrr r
+		JOIN payments p ON p.user_id = r.user_id AND p.status = 'completed'
+		WHERE r.first_paid_on >= $1
+		GROUP BY 1, 2`, since)
+	if err != nil {
+		return nil, err
+	}
+	for rows.Next() {
+		var cohortMonth, paidMonth time.Time
+		var amount float64
+		if err := rows.Scan(&cohortMonth, &paidMonth, &amount); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		i, ok := index[cohortMonth.Format("2006-01")]
+		if !ok {
+			continue
+		}
+		c := &cohorts[i]
+		// Платежи до первой засчитанной подписки (пробный период, разовые) относятся к нулевому месяцу
+		offset := monthsBetween(cohortMonth, paidMonth)
+		if offset < 0 {
+			offset = 0
+		}
+		if offset >= len(c.CumulativeLTV) {
+			offset = len(c.CumulativeLTV) - 1
+		}
+		c.CumulativeLTV[offset] += amount
+		c.Revenue += amount
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	churn, err := monthlyLogoChurn(ctx, now)
+	if err != nil {
+		return nil, err
+	}
+	for i := range cohorts {
+		c := &cohorts[i]
+		total := 0.0
+		for m, amount := range c.CumulativeLTV {
+			total += amount
+			c.CumulativeLTV[m] = roundMoney(total / float64(c.Customers))
+		}
+		c.Revenue = roundMoney(c.Revenue)
+		c.RealizedLTV = roundMoney(c.Revenue / float64(c.Customers))
+		if churn != nil && *churn > 0 {
+			projected := roundMoney(c.RealizedLTV + c.MRR/float64(c.Customers) / *churn)
+			c.ProjectedLTV = &projected
+		}
+	}
+	return cohorts, nil
+}
+
+// GetCustomerRevenue – выручка клиента, история его MRR и прогноз LTV: оплаченное плюс
+// текущий MRR на ожидаемый остаток жизни при среднем оттоке
+func GetCustomerRevenue(ctx context.Context, userID uuid.UUID) (*CustomerRevenue, error) {
+	r := &CustomerRevenue{UserID: userID, Movements: []MRRMovement{}}
+	var firstPaid, churned *time.Time
+	err := database.Pool.QueryRow(ctx, `
+		SELECT mrr::float8, plan_id, first_paid_on, churned_on FROM revenue_customer_mrr WHERE user_id = $1`,
+		userID).Scan(&r.CurrentMRR, &r.PlanID, &firstPaid, &churned)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return nil, err
+	}
+	if firstPaid != nil {
+		s := firstPaid.Format(revenueDateLayout)
+		r.FirstPaidOn = &s
+	}
+	if churned != nil {
+		s := churned.Format(revenueDateLayout)
+		r.ChurnedOn = &s
+	}
+	if err := database.Pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(amount), 0)::float8 FROM payments WHERE user_id = $1 AND status = 'completed'`,
+		userID).Scan(&r.RealizedRevenue); err != nil {
+		return nil, err
+	}
+	r.PredictedLTV = roundMoney(r.RealizedRevenue)
+	if r.CurrentMRR > 0 {
+		churn, err := monthlyLogoChurn(ctx, revenueDay(time.Now()))
+		if err != nil {
+			return nil, err
+		}
+		if churn != nil && *churn > 0 {
+			lifetime := math.Round(1 / *churn * 10) / 10
+			r.ExpectedLifetimeMonths = &lifetime
+			r.PredictedLTV = roundMoney(r.RealizedRevenue + r.CurrentMRR / *churn)
+		}
+	}
+	movements, _, err := ListMRRMovements(ctx, MRRMovementFilter{UserID: &userID}, 100, 0)
+	if err != nil {
+		return nil, err
+	}
+	r.Movements = movements
+	return r, nil
+}
+
+// MRRMovementFilter – отбор движений MRR
+type MRRMovementFilter struct {
+	From   *time.Time
+	To     *time.Time
+	Kind   string
+	UserID *uuid.UUID
+}
+
+// ListMRRMovements – движения MRR, новые первыми
+func ListMRRMovements(ctx context.Context, f MRRMovementFilter, limit, offset int) ([]MRRMovement, int, error) {
+	if f.Kind != "" && !containsString(MRRMovementKinds, f.Kind) {
+		return nil, 0, fmt.Errorf("%w: unknown movement kind %q", ErrInvalidRevenueQuery, f.Kind)
+	}
+	where := `WHERE ($1::date IS NULL OR m.day >= $1) AND ($2::date IS NULL OR m.day <= $2)
+		AND ($3 = '' OR m.kind = $3) AND ($4::uuid IS NULL OR m.user_id = $4)`
+	args := []interface{}{f.From, f.To, f.Kind, f.UserID}
+
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM revenue_mrr_movements m `+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	rows, err := database.Pool.Query(ctx, `
+		SELECT m.id, m.day, m.user_id, COALESCE(u.email, ''), m.kind, m.plan_from, m.plan_to,
+		       m.mrr_from::float8, m.mrr_to::float8, m.delta::float8
+		FROM revenue_mrr_movements m
+		LEFT JOIN users u ON u.id = m.user_id
+		`+where+`
+		ORDER BY m.day DESC, m.id DESC
+		LIMIT $5 OFFSET $6`, append(args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	movements := []MRRMovement{}
+	for rows.Next() {
+		var m MRRMovement
+		var day time.Time
+		if err := rows.Scan(&m.ID, &day, &m.UserID, &m.UserEmail, &m.Kind, &m.PlanFrom, &m.PlanTo,
+			&m.MRRFrom, &m.MRRTo, &m.Delta); err != nil {
+			return nil, 0, err
+		}
+		m.Day = day.Format(revenueDateLayout)
+		movements = append(movements, m)
+	}
+	return movements, total, rows.Err()
+}
@@ -0,0 +1,81 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"subscription-system/database"
+)
+
+// SalesForecastMonth – ожидаемая выручка месяца
+type SalesForecastMonth struct {
+	Month string  `json:"month"`
+	Value float64 `json:"value"`
+}
+
+// SalesForecast – прогноз продаж воронки
+type SalesForecast struct {
+	PipelineID       string               `json:"pipeline_id"`
+	AvgMonthlyValue  float64              `json:"avg_monthly_value"`
+	WeightedForecast float64              `json:"weighted_forecast"`
+	Conversion       float64              `json:"conversion"`
+	Months           []SalesForecastMonth `json:"months"`
+}
+
+// salesForecastMonths – на сколько месяцев вперёд строится прогноз
+const salesForecastMonths = 3
+
+// GetSalesForecast строит прогноз продаж воронки на 3 месяца: среднемесячная сумма выигранных
+// сделок за 6 месяцев, взвешенная по вероятности сумма открытых сделок и доля выигранных среди
+// закрытых (в процентах). ownerID ограничивает сделки владельцем; пустой – все сделки.
+func GetSalesForecast(ctx context.Context, pipelineID, ownerID string) (*SalesForecast, error) {
+	args := []interface{}{pipelineID}
+	stageJoin := `
+		FROM crm_deals d
+		JOIN crm_pipeline_stages ps ON ps.pipeline_id = d.pipeline_id AND ps.code = d.stage
+		WHERE d.pipeline_id = $1 AND d.deleted_at IS NULL`
+	if ownerID != "" {
+		stageJoin += ` AND d.user_id = $2`
+		args = append(args, ownerID)
+	}
+
+	f := &SalesForecast{PipelineID: pipelineID}
+	err := database.Pool.QueryRow(ctx, `
+		SELECT COALESCE(AVG(monthly_total), 0)
+		FROM (
+			SELECT DATE_TRUNC('month', COALESCE(d.closed_at, d.created_at)) AS month, SUM(d.value) AS monthly_total
+			`+stageJoin+`
+			AND ps.is_won
+			AND COALESCE(d.closed_at, d.created_at) >= NOW() - INTERVAL '6 months'
+			GROUP BY 1
+		) t
+	`, args...).Scan(&f.AvgMonthlyValue)
+	if err != nil {
+		return nil, err
+	}
+	err = database.Pool.QueryRow(ctx, `
+		SELECT COALESCE(SUM(d.value * d.probability::float / 100), 0)
+		`+stageJoin+`
+		AND NOT ps.is_won AND NOT ps.is_lost
+	`, args...).Scan(&f.WeightedForecast)
+	if err != nil {
+		return nil, err
+	}
+	err = database.Pool.QueryRow(ctx, `
+		SELECT COALESCE(
+			SUM(CASE WHEN ps.is_won THEN 1 ELSE 0 END) * 1.0 /
+			NULLIF(SUM(CASE WHEN ps.is_won OR ps.is_lost THEN 1 ELSE 0 END), 0),
+			0
+		) * 100
+		`+stageJoin, args...).Scan(&f.Conversion)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	f.Months = make([]SalesForecastMonth, salesForecastMonths)
+	for i := range f.Months {
+		f.Months[i] = SalesForecastMonth{Month: now.AddDate(0, i+1, 0).Format("2006-01"), Value: f.AvgMonthlyValue}
+	}
+	return f, nil
+}
@@ -0,0 +1,211 @@
+package models
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Сохранённые представления списков: фильтр, сортировка и колонки под именем. Свои представления
+// есть у каждого пользователя, общие (user_id = NULL) ведёт администратор. Представление применяется
+// к списку, экспорту и массовым операциям через view_id.
+
+var (
+	ErrSavedViewNotFound = errors.New("saved view not found")
+	ErrInvalidSavedView  = errors.New("invalid saved view")
+)
+
+const (
+	savedViewNameMaxLen = 255
+	savedViewMaxSort    = 5
+	savedViewMaxColumns = 100
+)
+
+// SavedView – сохранённое представление списка клиентов или сделок
+type SavedView struct {
+	ID         string     `json:"id"`
+	UserID     *string    `json:"user_id,omitempty"`
+	EntityType string     `json:"entity_type"`
+	Name       string     `json:"name"`
+	Filter     *CRMFilter `json:"filter,omitempty"`
+	Sort       []CRMSort  `json:"sort"`
+	Columns    []string   `json:"columns"`
+	SortOrder  int        `json:"sort_order"`
+	Shared     bool       `json:"shared"`
+	CreatedBy  *string    `json:"created_by,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UpdatedAt  time.Time  `json:"updated_at"`
+}
+
+// CanView – общие представления видят все, свои – владелец и администратор
+func (v *SavedView) CanView(userID string, isAdmin bool) bool {
+	return isAdmin || v.UserID == nil || *v.UserID == userID
+}
+
+// CanEdit – общие представления меняет только администратор
+func (v *SavedView) CanEdit(userID string, isAdmin bool) bool {
+	return isAdmin || (v.UserID != nil && *v.UserID == userID)
+}
+
+// Query – отбор списка по представлению
+func (v *SavedView) Query() *CRMListQuery {
+	return &CRMListQuery{Entity: v.EntityType, Filter: v.Filter, Sort: v.Sort}
+}
+
+// Normalize проверяет представление; фильтр и сортировка компилируются по текущей схеме полей
+func (v *SavedView) Normalize(ctx context.Context) error {
+	v.Name = strings.TrimSpace(v.Name)
+	if v.Name == "" || len([]rune(v.Name)) > savedViewNameMaxLen {
+		return fmt.Errorf("%w: name is required (up to %d characters)", ErrInvalidSavedView, savedViewNameMaxLen)
+	}
+	if !IsFilterEntity(v.EntityType) {
+		return fmt.Errorf("%w: entity_type must be customer or deal", ErrInvalidSavedView)
+	}
+	if len(v.Sort) > savedViewMaxSort {
+		return fmt.Errorf("%w: at most %d sort fields", ErrInvalidSavedView, savedViewMaxSort)
+	}
+	if len(v.Columns) > savedViewMaxColumns {
+		return fmt.Errorf("%w: at most %d columns", ErrInvalidSavedView, savedViewMaxColumns)
+	}
+	if v.Sort == nil {
+		v.Sort = []CRMSort{}
+	}
+	if v.Columns == nil {
+		v.Columns = []string{}
+	}
+	if v.Filter.IsEmpty() {
+		v.Filter = nil
+	}
+	schema, err := LoadFilterSchema(ctx)
+	if err != nil {
+		return err
+	}
+	if _, _, err := CompileCRMFilter(v.EntityType, v.Filter, schema, "t", nil); err != nil {
+		return err
+	}
+	_, err = CompileCRMSort(v.EntityType, v.Sort, schema, "t")
+	return err
+}
+
+const savedViewColumns = `id, user_id::text, entity_type, name, filter, sort, columns, sort_order, created_by::text, created_at, updated_at`
+
+func scanSavedView(row pgx.Row) (*SavedView, error) {
+	var v SavedView
+	var filter, sort, columns []byte
+	err := row.Scan(&v.ID, &v.UserID, &v.EntityType, &v.Name, &filter, &sort, &columns, &v.SortOrder, &v.CreatedBy, &v.CreatedAt, &v.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if len(filter) > 0 {
+		if err := json.Unmarshal(filter, &v.Filter); err != nil {
+			return nil, err
+		}
+	}
+	if err := json.Unmarshal(sort, &v.Sort); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(columns, &v.Columns); err != nil {
+		return nil, err
+	}
+	v.Shared = v.UserID == nil
+	return &v, nil
+}
+
+// ListSavedViews возвращает общие и свои представления сущности: сначала общие
+func ListSavedViews(ctx context.Context, entityType, userID string) ([]*SavedView, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT `+savedViewColumns+` FROM crm_saved_views
+		WHERE entity_type = $1 AND (user_id IS NULL OR user_id::text = $2)
+		ORDER BY user_id NULLS FIRST, sort_order, name
+	`, entityType, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	views := []*SavedView{}
+	for rows.Next() {
+		v, err := scanSavedView(rows)
+		if err != nil {
+			return nil, err
+		}
+		views = append(views, v)
+	}
+	return views, rows.Err()
+}
+
+// GetSavedView возвращает представление по ID
+func GetSavedView(ctx context.Context, id string) (*SavedView, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrSavedViewNotFound
+	}
+	v, err := scanSavedView(database.Pool.QueryRow(ctx, `SELECT `+savedViewColumns+` FROM crm_saved_views WHERE id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrSavedViewNotFound
+	}
+	return v, err
+}
+
+func marshalSavedView(v *SavedView) (filter, sort, columns []byte, err error) {
+	if v.Filter != nil {
+		if filter, err = json.Marshal(v.Filter); err != nil {
+			return
+		}
+	}
+	if sort, err = json.Marshal(v.Sort); err != nil {
+		return
+	}
+	columns, err = json.Marshal(v.Columns)
+	return
+}
+
+// CreateSavedView сохраняет новое представление (после Normalize)
+func CreateSavedView(ctx context.Context, v *SavedView) error {
+	filter, sort, columns, err := marshalSavedView(v)
+	if err != nil {
+		return err
+	}
+	v.Shared = v.UserID == nil
+	return database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_saved_views (user_id, entity_type, name, filter, sort, columns, sort_order, created_by)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, updated_at
+	`, v.UserID, v.EntityType, v.Name, filter, sort, columns, v.SortOrder, v.CreatedBy).Scan(&v.ID, &v.CreatedAt, &v.UpdatedAt)
+}
+
+// UpdateSavedView сохраняет изменения представления (после Normalize); владелец и сущность не меняются
+func UpdateSavedView(ctx context.Context, v *SavedView) error {
+	filter, sort, columns, err := marshalSavedView(v)
+	if err != nil {
+		return err
+	}
+	err = database.Pool.QueryRow(ctx, `
+		UPDATE crm_saved_views
+		SET name = $2, filter = $3, sort = $4, columns = $5, sort_order = $6, updated_at = NOW()
+		WHERE id = $1
+		RETURNING updated_at
+	`, v.ID, v.Name, filter, sort, columns, v.SortOrder).Scan(&v.UpdatedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return ErrSavedViewNotFound
+	}
+	return err
+}
+
+// DeleteSavedView удаляет представление
+func DeleteSavedView(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_saved_views WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrSavedViewNotFound
+	}
+	return nil
+}
@@ -0,0 +1,143 @@
+package models
+
+import (
+	"context"
+	"fmt"
+
+	"subscription-system/database"
+	"subscription-system/internal/secrets"
+)
+
+// ReencryptStats – сколько значений перешифровано в каждой таблице
+type ReencryptStats struct {
+	APIKeys                int `json:"api_keys"`
+	TwoFA                  int `json:"twofa"`
+	TwoFABackupCodes       int `json:"twofa_backup_codes"`
+	IntegrationCredentials int `json:"integration_credentials"`
+	Mailboxes              int `json:"mailboxes"`
+	WebhookEndpoints       int `json:"webhook_endpoints"`
+}
+
+// ReencryptSecrets шифрует открытые значения и перешифровывает значения,
+// зашифрованные неактивным ключом данных. dryRun только подсчитывает их.
+func ReencryptSecrets(ctx context.Context, dryRun bool) (ReencryptStats, error) {
+	var stats ReencryptStats
+	if !secrets.Enabled() {
+		return stats, secrets.ErrDisabled
+	}
+
+	var err error
+	if stats.APIKeys, err = reencryptAPIKeyCredentials(ctx, dryRun); err != nil {
+		return stats, fmt.Errorf("api_keys: %w", err)
+	}
+	if stats.TwoFA, err = reencryptColumn(ctx, dryRun, "twofa", "user_id", "secret"); err != nil {
+		return stats, fmt.Errorf("twofa: %w", err)
+	}
+	if stats.TwoFABackupCodes, err = hashLegacyBackupCodes(ctx, dryRun); err != nil {
+		return stats, fmt.Errorf("twofa.backup_codes: %w", err)
+	}
+	if stats.IntegrationCredentials, err = reencryptColumn(ctx, dryRun, "integration_credentials", "provider", "credentials_enc"); err != nil {
+		return stats, fmt.Errorf("integration_credentials: %w", err)
+	}
+	for _, column := range []string{"imap_password_enc", "smtp_password_enc"} {
+		n, err := reencryptColumn(ctx, dryRun, "crm_mailboxes", "id", column)
+		if err != nil {
+			return stats, fmt.Errorf("crm_mailboxes.%s: %w", column, err)
+		}
+		stats.Mailboxes += n
+	}
+	if stats.WebhookEndpoints, err = reencryptColumn(ctx, dryRun, "webhook_endpoints", "id", "secret"); err != nil {
+		return stats, fmt.Errorf("webhook_endpoints: %w", err)
+	}
+	return stats, nil
+}
+
+// reencryptAPIKeyCredentials переносит старый JSONB в зашифрованную колонку
+func reencryptAPIKeyCredentials(ctx context.Context, dryRun bool) (int, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT id::text, COALESCE(provider_credentials, '{}'::jsonb)::text, provider_credentials_enc
+		FROM api_keys
+	`)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id, value string
+	}
+	var todo []pending
+	for rows.Next() {
+		var id, legacyCreds, encCreds string
+		if err := rows.Scan(&id, &legacyCreds, &encCreds); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		switch {
+		case encCreds == "" && !isEmptyCredentials([]byte(legacyCreds)):
+			todo = append(todo, pending{id, legacyCreds})
+		case secrets.NeedsReencrypt(encCreds):
+			todo = append(todo, pending{id, encCreds})
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return len(todo), nil
+	}
+
+	for _, item := range todo {
+		encCreds, err := secrets.Reencrypt(item.value)
+		if err != nil {
+			return 0, fmt.Errorf("key %s: %w", item.id, err)
+		}
+		_, err = database.Pool.Exec(ctx, `
+			UPDATE api_keys SET provider_credentials = '{}', provider_credentials_enc = $1 WHERE id = $2
+		`, encCreds, item.id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), nil
+}
+
+// reencryptColumn перешифровывает текстовую колонку с секретом.
+// Имена таблиц и колонок задаются только из кода.
+func reencryptColumn(ctx context.Context, dryRun bool, table, idColumn, column string) (int, error) {
+	rows, err := database.Pool.Query(ctx, fmt.Sprintf(
+		`SELECT %s::text, %s FROM %s WHERE %s IS NOT NULL AND %s <> ''`, idColumn, column, table, column, column))
+	if err != nil {
+		return 0, err
+	}
+	todo := make(map[string]string)
+	for rows.Next() {
+		var id, value string
+		if err := rows.Scan(&id, &value); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		if secrets.NeedsReencrypt(value) {
+			todo[id] = value
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	if dryRun {
+		return len(todo), nil
+	}
+
+	for id, value := range todo {
+		encValue, err := secrets.Reencrypt(value)
+		if err != nil {
+			return 0, fmt.Errorf("%s %s: %w", idColumn, id, err)
+		}
+		_, err = database.Pool.Exec(ctx, fmt.Sprintf(
+			`UPDATE %s SET %s = $1 WHERE %s::text = $2`, table, column, idColumn), encValue, id)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(todo), nil
+}
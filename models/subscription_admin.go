@@ -2,11 +2,17 @@ package models
 
 import (
 "context"
+"errors"
 "fmt"
 "subscription-system/database"
 "time"
+
+"github.com/jackc/pgx/v5"
 )
 
+// ErrPaymentNotPending – платёж не найден или уже проведён
+var ErrPaymentNotPending = errors.New("payment not found or not pending")
+
 // AdminSubscription – подписка с данными пользователя и тарифа для админ-панели
 type AdminSubscription struct {
 ID                 string    `json:"id"`
@@ -121,6 +127,90 @@ WHERE id = $1 AND cancel_at_period_end = true
 return err
 }
 
+// SubscriptionEventData возвращает владельца подписки и её текущее состояние для вебхуков
+func SubscriptionEventData(ctx context.Context, subID string) (string, map[string]interface{}, error) {
+var userID, status string
+var planID int
+var planName string
+var periodEnd time.Time
+var cancelAtPeriodEnd bool
+err := database.Pool.QueryRow(ctx, `
+SELECT s.user_id, s.plan_id, p.name, s.status, s.current_period_end, s.cancel_at_period_end
+FROM user_subscriptions s
+JOIN subscription_plans p ON s.plan_id = p.id
+WHERE s.id = $1
+`, subID).Scan(&userID, &planID, &planName, &status, &periodEnd, &cancelAtPeriodEnd)
+if err != nil {
+return "", nil, err
+}
+return userID, map[string]interface{}{
+"subscription_id":      subID,
+"user_id":              userID,
+"plan_id":              planID,
+"plan_name":            planName,
+"status":               status,
+"current_period_end":   periodEnd,
+"cancel_at_period_end": cancelAtPeriodEnd,
+}, nil
+}
+
+// CompletedPayment – проведённый платёж и продлённая им подписка (SubscriptionID пуст, если продлевать нечего)
+type CompletedPayment struct {
+ID             string    `json:"id"`
+UserID         string    `json:"user_id"`
+Amount         float64   `json:"amount"`
+Currency       string    `json:"currency"`
+Method         string    `json:"method"`
+PlanName       *string   `json:"plan_name,omitempty"`
+CompletedAt    time.Time `json:"completed_at"`
+SubscriptionID string    `json:"subscription_id,omitempty"`
+PeriodStart    *time.Time `json:"current_period_start,omitempty"`
+PeriodEnd      *time.Time `json:"current_period_end,omitempty"`
+}
+
+// AdminCompletePayment проводит ожидающий платёж и продлевает на месяц последнюю активную подписку пользователя
+func AdminCompletePayment(ctx context.Context, paymentID string) (*CompletedPayment, error) {
+tx, err := database.Pool.Begin(ctx)
+if err != nil {
+return nil, err
+}
+defer tx.Rollback(ctx)
+
+p := &CompletedPayment{ID: paymentID}
+err = tx.QueryRow(ctx, `
+UPDATE payments SET status = 'completed', completed_at = NOW()
+WHERE id::text = $1 AND status = 'pending'
+RETURNING user_id, amount, currency, method, plan_name, completed_at
+`, paymentID).Scan(&p.UserID, &p.Amount, &p.Currency, &p.Method, &p.PlanName, &p.CompletedAt)
+if errors.Is(err, pgx.ErrNoRows) {
+return nil, ErrPaymentNotPending
+}
+if err != nil {
+return nil, err
+}
+
+// Новый период начинается с конца текущего, а истёкшая подписка – с сегодняшнего дня
+err = tx.QueryRow(ctx, `
+UPDATE user_subscriptions s
+SET current_period_start = GREATEST(s.current_period_end, NOW()),
+    current_period_end = GREATEST(s.current_period_end, NOW()) + INTERVAL '1 month',
+    status = 'active', updated_at = NOW()
+WHERE s.id = (
+SELECT id FROM user_subscriptions
+WHERE user_id = $1 AND status IN ('active', 'past_due')
+ORDER BY current_period_end DESC LIMIT 1
+)
+RETURNING s.id, s.current_period_start, s.current_period_end
+`, p.UserID).Scan(&p.SubscriptionID, &p.PeriodStart, &p.PeriodEnd)
+if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+return nil, err
+}
+if err := tx.Commit(ctx); err != nil {
+return nil, err
+}
+return p, nil
+}
+
 // GetSubscriptionStats возвращает статистику по статусам подписок
 func GetSubscriptionStats() (map[string]int64, error) {
 stats := make(map[string]int64)
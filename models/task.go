@@ -0,0 +1,705 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+)
+
+// Задачи CRM: исполнитель, срок, приоритет, привязка к клиенту или сделке, повторение и напоминания.
+// Повторяющаяся задача хранится одной строкой с ближайшим сроком; при выполнении создаётся
+// следующая. Будущие повторы в календаре и ICS-фиде разворачиваются на лету через Occurrences.
+// Даты повторов считаются в часовом поясе сервера, чтобы «каждый день в 10:00» не сдвигался при переходе на летнее время.
+
+var (
+	ErrTaskNotFound = errors.New("task not found")
+	ErrInvalidTask  = errors.New("invalid task")
+)
+
+// invalidTaskf – ошибка валидации задачи, распознаётся через errors.Is(err, ErrInvalidTask)
+func invalidTaskf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidTask}, args...)...)
+}
+
+// Приоритеты задач
+const (
+	TaskPriorityLow    = "low"
+	TaskPriorityNormal = "normal"
+	TaskPriorityHigh   = "high"
+	TaskPriorityUrgent = "urgent"
+)
+
+// Правила повторения задач
+const (
+	TaskRepeatNone     = "none"
+	TaskRepeatDaily    = "daily"
+	TaskRepeatWeekdays = "weekdays"
+	TaskRepeatWeekly   = "weekly"
+	TaskRepeatMonthly  = "monthly"
+	TaskRepeatYearly   = "yearly"
+)
+
+const (
+	// maxReminderOffset – напоминание не раньше чем за 30 дней
+	maxReminderOffset = 30 * 24 * 60
+	// staleReminderWindow – напоминания, пропущенные дольше этого (сервис лежал), не отправляются
+	staleReminderWindow = 24 * time.Hour
+)
+
+// DefaultTaskReminderOffsets – смещения напоминаний, если ни в задаче, ни в настройках пользователя их нет
+var DefaultTaskReminderOffsets = []int{15}
+
+var taskPriorities = map[string]bool{
+	TaskPriorityLow: true, TaskPriorityNormal: true, TaskPriorityHigh: true, TaskPriorityUrgent: true,
+}
+
+var taskRepeats = map[string]bool{
+	TaskRepeatNone: true, TaskRepeatDaily: true, TaskRepeatWeekdays: true,
+	TaskRepeatWeekly: true, TaskRepeatMonthly: true, TaskRepeatYearly: true,
+}
+
+// Task – задача CRM. CustomerName, DealTitle и AssigneeName заполняются при чтении для отображения.
+type Task struct {
+	ID              string     `json:"id"`
+	UserID          *string    `json:"user_id,omitempty"`
+	AssigneeID      *string    `json:"assignee_id,omitempty"`
+	Title           string     `json:"title"`
+	Description     string     `json:"description"`
+	DueAt           time.Time  `json:"due_at"`
+	DurationMinutes int        `json:"duration_minutes"`
+	Priority        string     `json:"priority"`
+	CustomerID      *string    `json:"customer_id,omitempty"`
+	DealID          *string    `json:"deal_id,omitempty"`
+	Recurrence      string     `json:"recurrence"`
+	RecurrenceUntil *time.Time `json:"recurrence_until,omitempty"`
+	ReminderOffsets []int      `json:"reminder_offsets"`
+	Completed       bool       `json:"completed"`
+	CompletedAt     *time.Time `json:"completed_at,omitempty"`
+	CompletedBy     *string    `json:"completed_by,omitempty"`
+	CreatedAt       time.Time  `json:"created_at"`
+	UpdatedAt       time.Time  `json:"updated_at"`
+
+	CustomerName string `json:"customer_name,omitempty"`
+	DealTitle    string `json:"deal_title,omitempty"`
+	AssigneeName string `json:"assignee_name,omitempty"`
+}
+
+// Normalize подставляет значения по умолчанию и проверяет поля задачи
+func (t *Task) Normalize() error {
+	t.Title = strings.TrimSpace(t.Title)
+	if t.Title == "" {
+		return invalidTaskf("title is required")
+	}
+	if len(t.Title) > 255 {
+		return invalidTaskf("title is longer than 255 characters")
+	}
+	if t.DueAt.IsZero() {
+		return invalidTaskf("due_at is required")
+	}
+	if t.DurationMinutes == 0 {
+		t.DurationMinutes = 30
+	}
+	if t.DurationMinutes < 0 || t.DurationMinutes > 24*60 {
+		return invalidTaskf("duration_minutes must be between 1 and 1440")
+	}
+	if t.Priority == "" {
+		t.Priority = TaskPriorityNormal
+	}
+	if !taskPriorities[t.Priority] {
+		return invalidTaskf("unknown priority %q", t.Priority)
+	}
+	if t.Recurrence == "" {
+		t.Recurrence = TaskRepeatNone
+	}
+	if !taskRepeats[t.Recurrence] {
+		return invalidTaskf("unknown recurrence %q", t.Recurrence)
+	}
+	if t.Recurrence == TaskRepeatNone {
+		t.RecurrenceUntil = nil
+	}
+	if !t.withinRecurrence(t.DueAt) {
+		return invalidTaskf("recurrence_until is before due_at")
+	}
+	seen := make(map[int]bool)
+	offsets := make([]int, 0, len(t.ReminderOffsets))
+	for _, m := range t.ReminderOffsets {
+		if m < 0 || m > maxReminderOffset {
+			return invalidTaskf("reminder offset %d must be between 0 and %d minutes", m, maxReminderOffset)
+		}
+		if !seen[m] {
+			seen[m] = true
+			offsets = append(offsets, m)
+		}
+	}
+	t.ReminderOffsets = offsets
+	if t.AssigneeID != nil && *t.AssigneeID == "" {
+		t.AssigneeID = nil
+	}
+	if t.CustomerID != nil && *t.CustomerID == "" {
+		t.CustomerID = nil
+	}
+	if t.DealID != nil && *t.DealID == "" {
+		t.DealID = nil
+	}
+	return nil
+}
+
+// CanAccess – задачу видят автор, исполнитель и администратор
+func (t *Task) CanAccess(userID string, isAdmin bool) bool {
+	if isAdmin {
+		return true
+	}
+	return (t.UserID != nil && *t.UserID == userID) || (t.AssigneeID != nil && *t.AssigneeID == userID)
+}
+
+// Recipient – кому уходят напоминания: исполнитель, а без него – автор
+func (t *Task) Recipient() string {
+	if t.AssigneeID != nil {
+		return *t.AssigneeID
+	}
+	if t.UserID != nil {
+		return *t.UserID
+	}
+	return ""
+}
+
+// addMonths прибавляет месяцы, прижимая день к концу месяца (31 января + 1 месяц = 28/29 февраля)
+func addMonths(t time.Time, months int) time.Time {
+	y, m, d := t.Date()
+	first := time.Date(y, m+time.Month(months), 1, t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+	last := first.AddDate(0, 1, -1).Day()
+	if d > last {
+		d = last
+	}
+	return first.AddDate(0, 0, d-1)
+}
+
+// NextDue – следующий срок после due по правилу повторения; false – повторов больше нет.
+// Месячные и годовые повторы отсчитываются от anchor, чтобы при развороте серии 31-е не «сползало» на 28-е.
+func NextDue(anchor, due time.Time, recurrence string) (time.Time, bool) {
+	local := due.In(time.Local)
+	switch recurrence {
+	case TaskRepeatDaily:
+		return local.AddDate(0, 0, 1), true
+	case TaskRepeatWeekdays:
+		next := local.AddDate(0, 0, 1)
+		for next.Weekday() == time.Saturday || next.Weekday() == time.Sunday {
+			next = next.AddDate(0, 0, 1)
+		}
+		return next, true
+	case TaskRepeatWeekly:
+		return local.AddDate(0, 0, 7), true
+	case TaskRepeatMonthly, TaskRepeatYearly:
+		step := 1
+		if recurrence == TaskRepeatYearly {
+			step = 12
+		}
+		a := anchor.In(time.Local)
+		months := (local.Year()-a.Year())*12 + int(local.Month()-a.Month())
+		return addMonths(a, months+step), true
+	}
+	return time.Time{}, false
+}
+
+// withinRecurrence – срок не позже recurrence_until (включительно, по дню)
+func (t *Task) withinRecurrence(due time.Time) bool {
+	if t.RecurrenceUntil == nil {
+		return true
+	}
+	// recurrence_until – дата без времени, сравниваются календарные дни
+	return due.In(time.Local).Format("2006-01-02") <= t.RecurrenceUntil.Format("2006-01-02")
+}
+
+// Occurrences возвращает сроки задачи в интервале [from, to): сам срок и, для незавершённой
+// повторяющейся задачи, будущие повторы. Не больше max штук.
+func (t *Task) Occurrences(from, to time.Time, max int) []time.Time {
+	result := make([]time.Time, 0)
+	due := t.DueAt
+	for i := 0; len(result) < max && due.Before(to) && i < 10000; i++ {
+		if !due.Before(from) || due.Add(time.Duration(t.DurationMinutes)*time.Minute).After(from) {
+			result = append(result, due)
+		}
+		if t.Completed {
+			break
+		}
+		next, ok := NextDue(t.DueAt, due, t.Recurrence)
+		if !ok || !t.withinRecurrence(next) {
+			break
+		}
+		due = next
+	}
+	return result
+}
+
+const taskSelect = `
+	SELECT t.id, t.user_id, t.assignee_id, t.title, t.description, t.due_at, t.duration_minutes, t.priority,
+	       t.customer_id, t.deal_id, t.recurrence, t.recurrence_until, t.reminder_offsets,
+	       t.completed, t.completed_at, t.completed_by, t.created_at, t.updated_at,
+	       COALESCE(c.name, ''), COALESCE(d.title, ''), COALESCE(NULLIF(u.name, ''), u.email, '')
+	FROM crm_tasks t
+	LEFT JOIN crm_customers c ON c.id = t.customer_id
+	LEFT JOIN crm_deals d ON d.id = t.deal_id
+	LEFT JOIN users u ON u.id = COALESCE(t.assignee_id, t.user_id)`
+
+func scanTask(row pgx.Row) (*Task, error) {
+	var t Task
+	var offsets []int32
+	if err := row.Scan(&t.ID, &t.UserID, &t.AssigneeID, &t.Title, &t.Description, &t.DueAt, &t.DurationMinutes, &t.Priority,
+		&t.CustomerID, &t.DealID, &t.Recurrence, &t.RecurrenceUntil, &offsets,
+		&t.Completed, &t.CompletedAt, &t.CompletedBy, &t.CreatedAt, &t.UpdatedAt,
+		&t.CustomerName, &t.DealTitle, &t.AssigneeName); err != nil {
+		return nil, err
+	}
+	t.ReminderOffsets = make([]int, len(offsets))
+	for i, m := range offsets {
+		t.ReminderOffsets[i] = int(m)
+	}
+	return &t, nil
+}
+
+// TaskFilter – условия выборки задач. Status: open (по умолчанию), completed или all.
+// Без IsAdmin выбираются только задачи, где пользователь автор или исполнитель.
+type TaskFilter struct {
+	UserID     string
+	IsAdmin    bool
+	AssigneeID string
+	CustomerID string
+	DealID     string
+	Status     string
+	From       *time.Time
+	To         *time.Time
+	Limit      int
+	Offset     int
+}
+
+// where собирает WHERE для фильтра
+func (f TaskFilter) where() (string, []interface{}, error) {
+	conds := []string{"TRUE"}
+	args := []interface{}{}
+	add := func(cond string, v interface{}) {
+		args = append(args, v)
+		conds = append(conds, strings.ReplaceAll(cond, "$?", "$"+strconv.Itoa(len(args))))
+	}
+	if !f.IsAdmin {
+		add("(t.user_id = $? OR t.assignee_id = $?)", f.UserID)
+	}
+	if f.AssigneeID != "" {
+		add("COALESCE(t.assignee_id, t.user_id) = $?", f.AssigneeID)
+	}
+	if f.CustomerID != "" {
+		add("t.customer_id = $?", f.CustomerID)
+	}
+	if f.DealID != "" {
+		add("t.deal_id = $?", f.DealID)
+	}
+	switch f.Status {
+	case "", "open":
+		conds = append(conds, "NOT t.completed")
+	case "completed":
+		conds = append(conds, "t.completed")
+	case "all":
+	default:
+		return "", nil, invalidTaskf("status must be open, completed or all")
+	}
+	if f.From != nil {
+		add("t.due_at >= $?", *f.From)
+	}
+	if f.To != nil {
+		add("t.due_at < $?", *f.To)
+	}
+	return " WHERE " + strings.Join(conds, " AND "), args, nil
+}
+
+// ListTasks возвращает задачи по фильтру (ближайшие сроки первыми) и их общее число
+func ListTasks(ctx context.Context, f TaskFilter) ([]*Task, int, error) {
+	where, args, err := f.where()
+	if err != nil {
+		return nil, 0, err
+	}
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM crm_tasks t`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+
+	query := taskSelect + where + ` ORDER BY t.due_at, t.created_at`
+	if f.Limit > 0 {
+		query += fmt.Sprintf(` LIMIT %d OFFSET %d`, f.Limit, f.Offset)
+	}
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	tasks := make([]*Task, 0)
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, total, rows.Err()
+}
+
+// ListCalendarTasks – задачи для календаря: незавершённые, срок которых (или повторы) может попасть в [from, to),
+// и выполненные со сроком в этом интервале
+func ListCalendarTasks(ctx context.Context, userID string, isAdmin bool, from, to time.Time) ([]*Task, error) {
+	query := taskSelect + ` WHERE t.due_at < $1 AND (
+		(NOT t.completed AND (t.due_at >= $2 OR t.recurrence <> 'none'))
+		OR (t.completed AND t.due_at >= $2))`
+	args := []interface{}{to, from}
+	if !isAdmin {
+		query += ` AND (t.user_id = $3 OR t.assignee_id = $3)`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY t.due_at LIMIT 5000`
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	tasks := make([]*Task, 0)
+	for rows.Next() {
+		t, err := scanTask(rows)
+		if err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, t)
+	}
+	return tasks, rows.Err()
+}
+
+// GetTask загружает задачу по id
+func GetTask(ctx context.Context, id string) (*Task, error) {
+	t, err := scanTask(database.Pool.QueryRow(ctx, taskSelect+` WHERE t.id = $1`, id))
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrTaskNotFound
+	}
+	return t, err
+}
+
+// UserReminderOffsets – смещения напоминаний по умолчанию из настроек уведомлений пользователя
+func UserReminderOffsets(ctx context.Context, userID string) []int {
+	var offsets []int32
+	err := database.Pool.QueryRow(ctx, `
+		SELECT task_reminder_offsets FROM user_notification_settings WHERE user_id = $1
+	`, userID).Scan(&offsets)
+	if err != nil {
+		return append([]int{}, DefaultTaskReminderOffsets...)
+	}
+	result := make([]int, len(offsets))
+	for i, m := range offsets {
+		result[i] = int(m)
+	}
+	return result
+}
+
+func insertTask(ctx context.Context, q interface {
+	QueryRow(context.Context, string, ...interface{}) pgx.Row
+}, t *Task) error {
+	return q.QueryRow(ctx, `
+		INSERT INTO crm_tasks (user_id, assignee_id, title, description, due_at, duration_minutes, priority,
+		                       customer_id, deal_id, recurrence, recurrence_until, reminder_offsets)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12)
+		RETURNING id, created_at, updated_at
+	`, t.UserID, t.AssigneeID, t.Title, t.Description, t.DueAt, t.DurationMinutes, t.Priority,
+		t.CustomerID, t.DealID, t.Recurrence, t.RecurrenceUntil, t.ReminderOffsets).Scan(&t.ID, &t.CreatedAt, &t.UpdatedAt)
+}
+
+// CreateTask сохраняет новую задачу
+func CreateTask(ctx context.Context, t *Task) error {
+	if err := t.Normalize(); err != nil {
+		return err
+	}
+	return insertTask(ctx, database.Pool, t)
+}
+
+// UpdateTask сохраняет изменённые поля задачи (кроме выполнения – см. CompleteTask)
+func UpdateTask(ctx context.Context, t *Task) error {
+	if err := t.Normalize(); err != nil {
+		return err
+	}
+	tag, err := database.Pool.Exec(ctx, `
+		UPDATE crm_tasks
+		SET assignee_id = $2, title = $3, description = $4, due_at = $5, duration_minutes = $6, priority = $7,
+		    customer_id = $8, deal_id = $9, recurrence = $10, recurrence_until = $11, reminder_offsets = $12,
+		    updated_at = NOW()
+		WHERE id = $1
+	`, t.ID, t.AssigneeID, t.Title, t.Description, t.DueAt, t.DurationMinutes, t.Priority,
+		t.CustomerID, t.DealID, t.Recurrence, t.RecurrenceUntil, t.ReminderOffsets)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// CompleteTask отмечает задачу выполненной. Для повторяющейся задачи создаётся следующая
+// с ближайшим сроком (повтор переходит к ней) и возвращается; иначе next == nil.
+func CompleteTask(ctx context.Context, t *Task, userID string) (*Task, error) {
+	if t.Completed {
+		return nil, nil
+	}
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback(ctx)
+
+	var completedBy *string
+	if userID != "" {
+		completedBy = &userID
+	}
+	tag, err := tx.Exec(ctx, `
+		UPDATE crm_tasks SET completed = true, completed_at = NOW(), completed_by = $2, updated_at = NOW()
+		WHERE id = $1 AND NOT completed
+	`, t.ID, completedBy)
+	if err != nil {
+		return nil, err
+	}
+	if tag.RowsAffected() == 0 {
+		// задачу уже закрыли параллельно
+		return nil, nil
+	}
+
+	var next *Task
+	if due, ok := NextDue(t.DueAt, t.DueAt, t.Recurrence); ok && t.withinRecurrence(due) {
+		copied := *t
+		copied.ID = ""
+		copied.DueAt = due
+		copied.Completed = false
+		copied.CompletedAt = nil
+		copied.CompletedBy = nil
+		if err := insertTask(ctx, tx, &copied); err != nil {
+			return nil, err
+		}
+		next = &copied
+		// у выполненного экземпляра повторение снимается – оно живёт в следующем
+		if _, err := tx.Exec(ctx, `UPDATE crm_tasks SET recurrence = 'none', recurrence_until = NULL WHERE id = $1`, t.ID); err != nil {
+			return nil, err
+		}
+	}
+	if err := tx.Commit(ctx); err != nil {
+		return nil, err
+	}
+	return next, nil
+}
+
+// ReopenTask снимает отметку о выполнении
+func ReopenTask(ctx context.Context, id string) error {
+	_, err := database.Pool.Exec(ctx, `
+		UPDATE crm_tasks SET completed = false, completed_at = NULL, completed_by = NULL, updated_at = NOW()
+		WHERE id = $1
+	`, id)
+	return err
+}
+
+// DeleteTask удаляет задачу
+func DeleteTask(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM crm_tasks WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrTaskNotFound
+	}
+	return nil
+}
+
+// SyncDealNextAction ставит next_action_date сделки на срок ближайшей открытой задачи по ней.
+// Сделки без задач не трогаются: там дату ведут вручную.
+func SyncDealNextAction(ctx context.Context, dealID string) error {
+	_, err := database.Pool.Exec(ctx, `
+		UPDATE crm_deals
+		SET next_action_date = (SELECT MIN(due_at) FROM crm_tasks WHERE deal_id = $1 AND NOT completed)
+		WHERE id = $1 AND EXISTS (SELECT 1 FROM crm_tasks WHERE deal_id = $1)
+	`, dealID)
+	return err
+}
+
+// TaskReminder – напоминание, которое пора отправить, вместе с контактами получателя
+type TaskReminder struct {
+	TaskID          string
+	Title           string
+	Description     string
+	Priority        string
+	DueAt           time.Time
+	OffsetMinutes   int
+	RecipientID     string
+	Email           string
+	TelegramID      *int64
+	TelegramEnabled bool
+	EmailEnabled    bool
+	CustomerName    string
+	DealTitle       string
+}
+
+// DueTaskReminders – напоминания, время которых наступило и которые ещё не отправлены.
+// Пропущенные дольше staleReminderWindow (например, пока сервис был выключен) не возвращаются.
+func DueTaskReminders(ctx context.Context, limit int) ([]TaskReminder, error) {
+	rows, err := database.Pool.Query(ctx, `
+		SELECT t.id, t.title, t.description, t.priority, t.due_at, o.offset_minutes,
+		       u.id, u.email, u.telegram_id,
+		       COALESCE(s.telegram_enabled, false), COALESCE(s.email_enabled, true),
+		       COALESCE(c.name, ''), COALESCE(d.title, '')
+		FROM crm_tasks t
+		CROSS JOIN LATERAL unnest(t.reminder_offsets) AS o(offset_minutes)
+		JOIN users u ON u.id = COALESCE(t.assignee_id, t.user_id)
+		LEFT JOIN user_notification_settings s ON s.user_id = u.id
+		LEFT JOIN crm_customers c ON c.id = t.customer_id
+		LEFT JOIN crm_deals d ON d.id = t.deal_id
+		WHERE NOT t.completed
+		  AND c.deleted_at IS NULL AND d.deleted_at IS NULL
+		  AND t.due_at - make_interval(mins => o.offset_minutes) <= NOW()
+		  AND t.due_at - make_interval(mins => o.offset_minutes) > NOW() - $1::interval
+		  AND NOT EXISTS (
+		      SELECT 1 FROM crm_task_reminders r
+		      WHERE r.task_id = t.id AND r.due_at = t.due_at AND r.offset_minutes = o.offset_minutes
+		  )
+		ORDER BY t.due_at
+		LIMIT $2
+	`, fmt.Sprintf("%d hours", int(staleReminderWindow.Hours())), limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	reminders := make([]TaskReminder, 0)
+	for rows.Next() {
+		var r TaskReminder
+		if err := rows.Scan(&r.TaskID, &r.Title, &r.Description, &r.Priority, &r.DueAt, &r.OffsetMinutes,
+			&r.RecipientID, &r.Email, &r.TelegramID, &r.TelegramEnabled, &r.EmailEnabled,
+			&r.CustomerName, &r.DealTitle); err != nil {
+			return nil, err
+		}
+		reminders = append(reminders, r)
+	}
+	return reminders, rows.Err()
+}
+
+// ClaimTaskReminder помечает напоминание отправленным. false – его уже забрал другой экземпляр сервиса.
+func ClaimTaskReminder(ctx context.Context, r TaskReminder) (bool, error) {
+	tag, err := database.Pool.Exec(ctx, `
+		INSERT INTO crm_task_reminders (task_id, due_at, offset_minutes) VALUES ($1, $2, $3)
+		ON CONFLICT DO NOTHING
+	`, r.TaskID, r.DueAt, r.OffsetMinutes)
+	if err != nil {
+		return false, err
+	}
+	return tag.RowsAffected() == 1, nil
+}
+
+// SetTaskReminderError сохраняет ошибку отправки напоминания (повторно оно не отправляется)
+func SetTaskReminderError(ctx context.Context, r TaskReminder, msg string) error {
+	_, err := database.Pool.Exec(ctx, `
+		UPDATE crm_task_reminders SET error = $4 WHERE task_id = $1 AND due_at = $2 AND offset_minutes = $3
+	`, r.TaskID, r.DueAt, r.OffsetMinutes, msg)
+	return err
+}
+
+// CalendarDeal – сделка в календаре: ожидаемое закрытие и следующее действие
+type CalendarDeal struct {
+	ID             string     `json:"id"`
+	Title          string     `json:"title"`
+	Value          float64    `json:"value"`
+	Stage          string     `json:"stage"`
+	CustomerID     string     `json:"customer_id"`
+	Responsible    string     `json:"responsible"`
+	ExpectedClose  *time.Time `json:"expected_close,omitempty"`
+	NextActionDate *time.Time `json:"next_action_date,omitempty"`
+	UpdatedAt      time.Time  `json:"updated_at"`
+}
+
+// ListCalendarDeals – открытые сделки, у которых ожидаемое закрытие или следующее действие попадает в [from, to)
+func ListCalendarDeals(ctx context.Context, userID string, isAdmin bool, from, to time.Time) ([]CalendarDeal, error) {
+	query := `
+		SELECT id, title, value, COALESCE(stage, ''), customer_id, COALESCE(responsible, ''),
+		       expected_close::timestamp, next_action_date::timestamp, COALESCE(updated_at, created_at, NOW())
+		FROM crm_deals
+		WHERE closed_at IS NULL AND deleted_at IS NULL
+		  AND ((expected_close >= $1::date AND expected_close < $2::date)
+		       OR (next_action_date >= $1 AND next_action_date < $2))`
+	args := []interface{}{from, to}
+	if !isAdmin {
+		query += ` AND user_id = $3`
+		args = append(args, userID)
+	}
+	query += ` ORDER BY expected_close LIMIT 5000`
+	rows, err := database.Pool.Query(ctx, query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	deals := make([]CalendarDeal, 0)
+	for rows.Next() {
+		var d CalendarDeal
+		if err := rows.Scan(&d.ID, &d.Title, &d.Value, &d.Stage, &d.CustomerID, &d.Responsible,
+			&d.ExpectedClose, &d.NextActionDate, &d.UpdatedAt); err != nil {
+			return nil, err
+		}
+		deals = append(deals, d)
+	}
+	return deals, rows.Err()
+}
+
+// newCalendarToken – 32 случайных байта в hex
+func newCalendarToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// CalendarFeedToken возвращает секретный токен ICS-фида пользователя, создавая его при первом запросе
+func CalendarFeedToken(ctx context.Context, userID string) (string, error) {
+	token, err := newCalendarToken()
+	if err != nil {
+		return "", err
+	}
+	// при конфликте возвращается уже существующий токен
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO crm_calendar_feeds (user_id, token) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET user_id = EXCLUDED.user_id
+		RETURNING token
+	`, userID, token).Scan(&token)
+	return token, err
+}
+
+// ResetCalendarFeedToken выдаёт новый токен; старая ссылка перестаёт работать
+func ResetCalendarFeedToken(ctx context.Context, userID string) (string, error) {
+	token, err := newCalendarToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = database.Pool.Exec(ctx, `
+		INSERT INTO crm_calendar_feeds (user_id, token) VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET token = EXCLUDED.token, created_at = NOW()
+	`, userID, token)
+	return token, err
+}
+
+// CalendarFeedUser находит владельца ICS-фида по токену
+func CalendarFeedUser(ctx context.Context, token string) (userID string, isAdmin bool, err error) {
+	var role *string
+	err = database.Pool.QueryRow(ctx, `
+		SELECT u.id, u.role FROM crm_calendar_feeds f JOIN users u ON u.id = f.user_id WHERE f.token = $1
+	`, token).Scan(&userID, &role)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", false, ErrTaskNotFound
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return userID, role != nil && *role == "admin", nil
+}
@@ -1,13 +1,20 @@
 package models
 
 import (
+    "context"
+    "crypto/sha256"
+    "encoding/hex"
+    "strings"
     "time"
+
+    "subscription-system/database"
+    "subscription-system/internal/secrets"
 )
 
 type TwoFA struct {
     ID        string    `json:"id" db:"id"`
     UserID    string    `json:"user_id" db:"user_id"`
-    Secret    string    `json:"-" db:"secret"` // Не отдаём в JSON
+    Secret    string    `json:"-" db:"secret"` // Не отдаём в JSON, в БД хранится зашифрованным
     Enabled   bool      `json:"enabled" db:"enabled"`
     CreatedAt time.Time `json:"created_at" db:"created_at"`
     UpdatedAt time.Time `json:"updated_at" db:"updated_at"`
@@ -15,4 +22,107 @@ type TwoFA struct {
 
 func (TwoFA) TableName() string {
     return "twofa"
-}
\ No newline at end of file
+}
+
+// SaveTwoFASecret шифрует TOTP-секрет и сохраняет его (2FA остаётся выключенной до подтверждения)
+func SaveTwoFASecret(ctx context.Context, userID, secret string) error {
+    encSecret, err := secrets.EncryptString(secret)
+    if err != nil {
+        return err
+    }
+    _, err = database.Pool.Exec(ctx, `
+        INSERT INTO twofa (user_id, secret, enabled) 
+        VALUES ($1, $2, false)
+        ON CONFLICT (user_id) 
+        DO UPDATE SET secret = $2, enabled = false, updated_at = NOW()
+    `, userID, encSecret)
+    return err
+}
+
+// GetTwoFASecret возвращает расшифрованный TOTP-секрет; onlyEnabled – только при включённой 2FA
+func GetTwoFASecret(ctx context.Context, userID string, onlyEnabled bool) (string, error) {
+    query := "SELECT secret FROM twofa WHERE user_id = $1::uuid"
+    if onlyEnabled {
+        query += " AND enabled = true"
+    }
+    var encSecret string
+    if err := database.Pool.QueryRow(ctx, query, userID).Scan(&encSecret); err != nil {
+        return "", err
+    }
+    return secrets.DecryptString(encSecret)
+}
+
+// backupCodeHashPrefix отличает хеш резервного кода от кода, сохранённого до хеширования
+const backupCodeHashPrefix = "sha256:"
+
+// HashBackupCode – хеш резервного кода 2FA. Коды случайные и длинные, поэтому соль не нужна,
+// а одинаковый хеш позволяет искать код прямо в массиве backup_codes.
+func HashBackupCode(code string) string {
+    sum := sha256.Sum256([]byte(strings.TrimSpace(code)))
+    return backupCodeHashPrefix + hex.EncodeToString(sum[:])
+}
+
+// SaveTwoFABackupCodes заменяет резервные коды пользователя; в БД хранятся только хеши
+func SaveTwoFABackupCodes(ctx context.Context, userID string, codes []string) error {
+    hashes := make([]string, len(codes))
+    for i, code := range codes {
+        hashes[i] = HashBackupCode(code)
+    }
+    _, err := database.Pool.Exec(ctx, `UPDATE twofa SET backup_codes = $2 WHERE user_id = $1::uuid`, userID, hashes)
+    return err
+}
+
+// UseTwoFABackupCode гасит резервный код; false – такого кода нет или он уже использован.
+// Код удаляется тем же запросом, что и проверяется, поэтому дважды его не применить.
+// Коды, сохранённые открытым текстом до миграции, принимаются только после rotate-secrets,
+// который заменяет их хешами.
+func UseTwoFABackupCode(ctx context.Context, userID, code string) (bool, error) {
+    hash := HashBackupCode(code)
+    tag, err := database.Pool.Exec(ctx, `
+        UPDATE twofa SET backup_codes = array_remove(backup_codes, $2)
+        WHERE user_id = $1::uuid AND $2 = ANY(backup_codes)
+    `, userID, hash)
+    if err != nil {
+        return false, err
+    }
+    return tag.RowsAffected() == 1, nil
+}
+
+// hashLegacyBackupCodes заменяет резервные коды, сохранённые открытым текстом, их хешами
+func hashLegacyBackupCodes(ctx context.Context, dryRun bool) (int, error) {
+    rows, err := database.Pool.Query(ctx, `
+        SELECT user_id::text, backup_codes FROM twofa
+        WHERE EXISTS (SELECT 1 FROM unnest(backup_codes) AS c WHERE c NOT LIKE 'sha256:%')
+    `)
+    if err != nil {
+        return 0, err
+    }
+    todo := make(map[string][]string)
+    for rows.Next() {
+        var userID string
+        var codes []string
+        if err := rows.Scan(&userID, &codes); err != nil {
+            rows.Close()
+            return 0, err
+        }
+        for i, code := range codes {
+            if !strings.HasPrefix(code, backupCodeHashPrefix) {
+                codes[i] = HashBackupCode(code)
+            }
+        }
+        todo[userID] = codes
+    }
+    rows.Close()
+    if err := rows.Err(); err != nil {
+        return 0, err
+    }
+    if dryRun {
+        return len(todo), nil
+    }
+    for userID, codes := range todo {
+        if _, err := database.Pool.Exec(ctx, `UPDATE twofa SET backup_codes = $2 WHERE user_id::text = $1`, userID, codes); err != nil {
+            return 0, err
+        }
+    }
+    return len(todo), nil
+}
@@ -0,0 +1,580 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+	"subscription-system/internal/secrets"
+)
+
+// Исходящие вебхуки: пользователь подписывает свои адреса на типы событий, событие раскладывается
+// в webhook_deliveries (по строке на адрес) и отправляется фоновым диспетчером с повторами.
+// Адрес получает события своего владельца; адреса администраторов – события всех пользователей
+// (то же правило, что у живых обновлений CRM).
+
+var (
+	ErrWebhookNotFound         = errors.New("webhook not found")
+	ErrWebhookDeliveryNotFound = errors.New("webhook delivery not found")
+	ErrInvalidWebhook          = errors.New("invalid webhook")
+)
+
+func invalidWebhookf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: "+format, append([]interface{}{ErrInvalidWebhook}, args...)...)
+}
+
+// События платежей, подписок и оповещений по метрикам; события CRM – CRMEvent*
+const (
+	WebhookEventPaymentSucceeded       = "payment.succeeded"
+	WebhookEventSubscriptionRenewed    = "subscription.renewed"
+	WebhookEventSubscriptionCanceled   = "subscription.canceled"
+	WebhookEventSubscriptionReactivate = "subscription.reactivated"
+	WebhookEventAlertFired             = "alert.fired"
+	WebhookEventAlertResolved          = "alert.resolved"
+	// WebhookEventPing отправляется только кнопкой проверки и не требует подписки
+	WebhookEventPing = "ping"
+	// WebhookAllEvents в event_types – подписка на все события
+	WebhookAllEvents = "*"
+)
+
+// WebhookEventTypes – события, на которые можно подписаться
+var WebhookEventTypes = []string{
+	CRMEventDealCreated, CRMEventDealUpdated, CRMEventDealStageChanged, CRMEventDealDeleted, CRMEventDealRestored,
+	CRMEventCustomerCreated, CRMEventCustomerUpdated, CRMEventCustomerDeleted, CRMEventCustomerRestored, CRMEventCustomersMerged,
+	CRMEventActivityAdded, CRMEventAttachmentUploaded, CRMEventAttachmentDeleted,
+	CRMEventQuoteCreated, CRMEventOrderCreated,
+	CRMEventEmailSent, CRMEventEmailReceived, CRMEventEmailOpened,
+	CRMEventChurnHighRisk,
+	WebhookEventPaymentSucceeded,
+	WebhookEventSubscriptionRenewed, WebhookEventSubscriptionCanceled, WebhookEventSubscriptionReactivate,
+	WebhookEventAlertFired, WebhookEventAlertResolved,
+}
+
+// Статусы доставки
+const (
+	WebhookDeliveryPending   = "pending"
+	WebhookDeliverySucceeded = "succeeded"
+	WebhookDeliveryFailed    = "failed"
+)
+
+// webhookBackoff – пауза перед следующей попыткой; после последней доставка помечается failed
+var webhookBackoff = []time.Duration{
+	time.Minute, 5 * time.Minute, 30 * time.Minute, 2 * time.Hour, 6 * time.Hour, 12 * time.Hour, 24 * time.Hour,
+}
+
+// WebhookMaxAttempts – попыток на одну доставку (первая + повторы)
+var WebhookMaxAttempts = len(webhookBackoff) + 1
+
+const (
+	// webhookResponseLimit – сколько байт ответа сохраняется в журнале попыток
+	webhookResponseLimit = 2048
+	// WebhookDeliveryRetention – сколько хранятся завершённые доставки
+	WebhookDeliveryRetention = 30 * 24 * time.Hour
+)
+
+// WebhookEndpoint – адрес, подписанный на события. Secret заполняется только при создании
+// и перевыпуске: потом его не показать, только перевыпустить.
+type WebhookEndpoint struct {
+	ID          string    `json:"id"`
+	UserID      string    `json:"user_id"`
+	URL         string    `json:"url"`
+	Description string    `json:"description"`
+	EventTypes  []string  `json:"event_types"`
+	Active      bool      `json:"active"`
+	Secret      string    `json:"secret,omitempty"`
+	CreatedAt   time.Time `json:"created_at"`
+	UpdatedAt   time.Time `json:"updated_at"`
+	// Сводка по доставкам за срок хранения
+	Pending int `json:"pending"`
+	Failed  int `json:"failed"`
+}
+
+// Normalize проверяет адрес и список событий
+func (e *WebhookEndpoint) Normalize() error {
+	e.URL = strings.TrimSpace(e.URL)
+	u, err := url.Parse(e.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return invalidWebhookf("url must be an absolute http(s) URL")
+	}
+	if u.User != nil {
+		return invalidWebhookf("url must not contain credentials")
+	}
+	e.Description = strings.TrimSpace(e.Description)
+	if len(e.Description) > 255 {
+		return invalidWebhookf("description is too long")
+	}
+	if len(e.EventTypes) == 0 {
+		return invalidWebhookf("event_types is required")
+	}
+	seen := make(map[string]bool, len(e.EventTypes))
+	types := e.EventTypes[:0]
+	for _, t := range e.EventTypes {
+		t = strings.TrimSpace(t)
+		if t != WebhookAllEvents && !containsString(WebhookEventTypes, t) {
+			return invalidWebhookf("unknown event type %q", t)
+		}
+		if !seen[t] {
+			seen[t] = true
+			types = append(types, t)
+		}
+	}
+	e.EventTypes = types
+	return nil
+}
+
+// CanAccess – адресом управляет владелец или администратор
+func (e *WebhookEndpoint) CanAccess(userID string, isAdmin bool) bool {
+	return isAdmin || e.UserID == userID
+}
+
+func newWebhookSecret() (string, error) {
+	buf := make([]byte, 24)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	return "whsec_" + hex.EncodeToString(buf), nil
+}
+
+const webhookEndpointColumns = `e.id, e.user_id, e.url, e.description, e.event_types, e.active, e.created_at, e.updated_at,
+	(SELECT COUNT(*) FROM webhook_deliveries d WHERE d.endpoint_id = e.id AND d.status = 'pending'),
+	(SELECT COUNT(*) FROM webhook_deliveries d WHERE d.endpoint_id = e.id AND d.status = 'failed')`
+
+func scanWebhookEndpoint(row pgx.Row) (*WebhookEndpoint, error) {
+	var e WebhookEndpoint
+	err := row.Scan(&e.ID, &e.UserID, &e.URL, &e.Description, &e.EventTypes, &e.Active, &e.CreatedAt, &e.UpdatedAt,
+		&e.Pending, &e.Failed)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWebhookNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &e, nil
+}
+
+// ListWebhookEndpoints возвращает адреса пользователя (администратору – все)
+func ListWebhookEndpoints(ctx context.Context, userID string, isAdmin bool) ([]*WebhookEndpoint, error) {
+	query := `SELECT ` + webhookEndpointColumns + ` FROM webhook_endpoints e`
+	var args []interface{}
+	if !isAdmin {
+		query += ` WHERE e.user_id = $1`
+		args = append(args, userID)
+	}
+	rows, err := database.Pool.Query(ctx, query+` ORDER BY e.created_at`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	endpoints := []*WebhookEndpoint{}
+	for rows.Next() {
+		e, err := scanWebhookEndpoint(rows)
+		if err != nil {
+			return nil, err
+		}
+		endpoints = append(endpoints, e)
+	}
+	return endpoints, rows.Err()
+}
+
+// GetWebhookEndpoint возвращает адрес без секрета
+func GetWebhookEndpoint(ctx context.Context, id string) (*WebhookEndpoint, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrWebhookNotFound
+	}
+	return scanWebhookEndpoint(database.Pool.QueryRow(ctx,
+		`SELECT `+webhookEndpointColumns+` FROM webhook_endpoints e WHERE e.id = $1`, id))
+}
+
+// CreateWebhookEndpoint сохраняет адрес и выпускает секрет подписи (e.Secret)
+func CreateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error {
+	if err := e.Normalize(); err != nil {
+		return err
+	}
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return err
+	}
+	sealed, err := secrets.EncryptString(secret)
+	if err != nil {
+		return err
+	}
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO webhook_endpoints (user_id, url, description, event_types, secret, active)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at, updated_at
+	`, e.UserID, e.URL, e.Description, e.EventTypes, sealed, e.Active).Scan(&e.ID, &e.CreatedAt, &e.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	e.Secret = secret
+	return nil
+}
+
+// UpdateWebhookEndpoint меняет адрес, описание, события и активность; секрет не трогает
+func UpdateWebhookEndpoint(ctx context.Context, e *WebhookEndpoint) error {
+	if err := e.Normalize(); err != nil {
+		return err
+	}
+	tag, err := database.Pool.Exec(ctx, `
+		UPDATE webhook_endpoints
+		SET url = $2, description = $3, event_types = $4, active = $5, updated_at = NOW()
+		WHERE id = $1
+	`, e.ID, e.URL, e.Description, e.EventTypes, e.Active)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// RotateWebhookSecret выпускает новый секрет; старый перестаёт действовать сразу
+func RotateWebhookSecret(ctx context.Context, id string) (string, error) {
+	secret, err := newWebhookSecret()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := secrets.EncryptString(secret)
+	if err != nil {
+		return "", err
+	}
+	tag, err := database.Pool.Exec(ctx,
+		`UPDATE webhook_endpoints SET secret = $2, updated_at = NOW() WHERE id = $1`, id, sealed)
+	if err != nil {
+		return "", err
+	}
+	if tag.RowsAffected() == 0 {
+		return "", ErrWebhookNotFound
+	}
+	return secret, nil
+}
+
+// DeleteWebhookEndpoint удаляет адрес вместе с журналом доставок
+func DeleteWebhookEndpoint(ctx context.Context, id string) error {
+	tag, err := database.Pool.Exec(ctx, `DELETE FROM webhook_endpoints WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return ErrWebhookNotFound
+	}
+	return nil
+}
+
+// WebhookPayload – тело запроса к подписчику
+type WebhookPayload struct {
+	ID        string                 `json:"id"`
+	Type      string                 `json:"type"`
+	CreatedAt time.Time              `json:"created_at"`
+	Data      map[string]interface{} `json:"data"`
+}
+
+// EnqueueWebhookEvent ставит событие в очередь доставки всем подписанным адресам.
+// ownerID – пользователь, которому принадлежит объект события (nil – только адресам администраторов).
+// Возвращает число созданных доставок.
+func EnqueueWebhookEvent(ctx context.Context, ownerID *string, eventType string, data map[string]interface{}) (int, error) {
+	if data == nil {
+		data = map[string]interface{}{}
+	}
+	payload := WebhookPayload{ID: uuid.NewString(), Type: eventType, CreatedAt: time.Now().UTC(), Data: data}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0, err
+	}
+	tag, err := database.Pool.Exec(ctx, `
+		INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload)
+		SELECT e.id, $1, $2, $3
+		FROM webhook_endpoints e
+		JOIN users u ON u.id = e.user_id
+		WHERE e.active
+		  AND ($2 = ANY(e.event_types) OR '*' = ANY(e.event_types))
+		  AND (e.user_id = $4::uuid OR u.role = 'admin')
+	`, payload.ID, eventType, body, ownerID)
+	if err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), nil
+}
+
+// CreateWebhookPing создаёт доставку проверочного события на один адрес
+func CreateWebhookPing(ctx context.Context, endpoint *WebhookEndpoint) (string, error) {
+	payload := WebhookPayload{
+		ID:        uuid.NewString(),
+		Type:      WebhookEventPing,
+		CreatedAt: time.Now().UTC(),
+		Data:      map[string]interface{}{"endpoint_id": endpoint.ID, "message": "Проверка вебхука"},
+	}
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return "", err
+	}
+	var id string
+	err = database.Pool.QueryRow(ctx, `
+		INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id
+	`, endpoint.ID, payload.ID, payload.Type, body).Scan(&id)
+	return id, err
+}
+
+// WebhookDelivery – строка журнала доставок
+type WebhookDelivery struct {
+	ID             string          `json:"id"`
+	EndpointID     string          `json:"endpoint_id"`
+	EventID        string          `json:"event_id"`
+	EventType      string          `json:"event_type"`
+	Payload        json.RawMessage `json:"payload,omitempty"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  *time.Time      `json:"next_attempt_at,omitempty"`
+	LastStatusCode *int            `json:"last_status_code,omitempty"`
+	LastError      *string         `json:"last_error,omitempty"`
+	RedeliveryOf   *string         `json:"redelivery_of,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+
+	AttemptLog []WebhookAttempt `json:"attempt_log,omitempty"`
+
+	// Для отправки: адрес, секрет (расшифрованный) и активность адреса
+	URL            string `json:"-"`
+	Secret         string `json:"-"`
+	EndpointActive bool   `json:"-"`
+}
+
+// WebhookAttempt – результат одной попытки отправки
+type WebhookAttempt struct {
+	Attempt      int       `json:"attempt"`
+	StatusCode   *int      `json:"status_code,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	ResponseBody string    `json:"response_body,omitempty"`
+	DurationMs   int       `json:"duration_ms"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// OK – подписчик ответил 2xx
+func (a *WebhookAttempt) OK() bool {
+	return a.Error == "" && a.StatusCode != nil && *a.StatusCode >= 200 && *a.StatusCode < 300
+}
+
+const webhookDeliveryColumns = `d.id, d.endpoint_id, d.event_id, d.event_type, d.status, d.attempts,
+	CASE WHEN d.status = 'pending' THEN d.next_attempt_at END, d.last_status_code, d.last_error, d.redelivery_of::text,
+	d.created_at, d.delivered_at`
+
+func scanWebhookDelivery(row pgx.Row, extra ...interface{}) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	dest := append([]interface{}{&d.ID, &d.EndpointID, &d.EventID, &d.EventType, &d.Status, &d.Attempts,
+		&d.NextAttemptAt, &d.LastStatusCode, &d.LastError, &d.RedeliveryOf, &d.CreatedAt, &d.DeliveredAt}, extra...)
+	err := row.Scan(dest...)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, nil
+}
+
+// WebhookDeliveryFilter – фильтр журнала доставок адреса
+type WebhookDeliveryFilter struct {
+	EndpointID string
+	Status     string
+	EventType  string
+	Limit      int
+	Offset     int
+}
+
+// ListWebhookDeliveries возвращает доставки адреса, новые сначала, и общее число
+func ListWebhookDeliveries(ctx context.Context, f WebhookDeliveryFilter) ([]*WebhookDelivery, int, error) {
+	where := ` WHERE d.endpoint_id = $1`
+	args := []interface{}{f.EndpointID}
+	if f.Status != "" {
+		args = append(args, f.Status)
+		where += fmt.Sprintf(" AND d.status = $%d", len(args))
+	}
+	if f.EventType != "" {
+		args = append(args, f.EventType)
+		where += fmt.Sprintf(" AND d.event_type = $%d", len(args))
+	}
+	var total int
+	if err := database.Pool.QueryRow(ctx, `SELECT COUNT(*) FROM webhook_deliveries d`+where, args...).Scan(&total); err != nil {
+		return nil, 0, err
+	}
+	args = append(args, f.Limit, f.Offset)
+	rows, err := database.Pool.Query(ctx, `SELECT `+webhookDeliveryColumns+` FROM webhook_deliveries d`+where+
+		fmt.Sprintf(" ORDER BY d.created_at DESC LIMIT $%d OFFSET $%d", len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			return nil, 0, err
+		}
+		deliveries = append(deliveries, d)
+	}
+	return deliveries, total, rows.Err()
+}
+
+// GetWebhookDelivery возвращает доставку с телом и журналом попыток
+func GetWebhookDelivery(ctx context.Context, id string) (*WebhookDelivery, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrWebhookDeliveryNotFound
+	}
+	var payload []byte
+	d, err := scanWebhookDelivery(database.Pool.QueryRow(ctx,
+		`SELECT `+webhookDeliveryColumns+`, d.payload FROM webhook_deliveries d WHERE d.id = $1`, id), &payload)
+	if err != nil {
+		return nil, err
+	}
+	d.Payload = payload
+	rows, err := database.Pool.Query(ctx, `
+		SELECT attempt, status_code, COALESCE(error, ''), COALESCE(response_body, ''), duration_ms, created_at
+		FROM webhook_attempts WHERE delivery_id = $1 ORDER BY id
+	`, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	d.AttemptLog = []WebhookAttempt{}
+	for rows.Next() {
+		var a WebhookAttempt
+		if err := rows.Scan(&a.Attempt, &a.StatusCode, &a.Error, &a.ResponseBody, &a.DurationMs, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		d.AttemptLog = append(d.AttemptLog, a)
+	}
+	return d, rows.Err()
+}
+
+// RedeliverWebhook ставит копию доставки в очередь на немедленную отправку; исходная запись не меняется
+func RedeliverWebhook(ctx context.Context, id string) (string, error) {
+	var newID string
+	err := database.Pool.QueryRow(ctx, `
+		INSERT INTO webhook_deliveries (endpoint_id, event_id, event_type, payload, redelivery_of)
+		SELECT endpoint_id, event_id, event_type, payload, id FROM webhook_deliveries WHERE id = $1
+		RETURNING id
+	`, id).Scan(&newID)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return "", ErrWebhookDeliveryNotFound
+	}
+	return newID, err
+}
+
+// ClaimWebhookDeliveries забирает наступившие доставки (или одну конкретную, если onlyID задан).
+// Забранной доставке сразу засчитывается попытка и назначается аренда: если экземпляр упадёт
+// до записи результата, доставку подхватят после её окончания. SKIP LOCKED не даёт двум
+// экземплярам отправить одно и то же.
+func ClaimWebhookDeliveries(ctx context.Context, limit int, lease time.Duration, onlyID string) ([]*WebhookDelivery, error) {
+	due := `status = 'pending' AND next_attempt_at <= NOW()`
+	args := []interface{}{limit, int(lease.Seconds())}
+	if onlyID != "" {
+		due = `status = 'pending' AND id = $3`
+		args = append(args, onlyID)
+	}
+	rows, err := database.Pool.Query(ctx, `
+		UPDATE webhook_deliveries d
+		SET attempts = d.attempts + 1, next_attempt_at = NOW() + $2::int * INTERVAL '1 second'
+		FROM (
+			SELECT id FROM webhook_deliveries WHERE `+due+`
+			ORDER BY next_attempt_at LIMIT $1 FOR UPDATE SKIP LOCKED
+		) due, webhook_endpoints e
+		WHERE d.id = due.id AND e.id = d.endpoint_id
+		RETURNING d.id, d.endpoint_id, d.event_id, d.event_type, d.payload, d.attempts, e.url, e.secret, e.active
+	`, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var deliveries []*WebhookDelivery
+	for rows.Next() {
+		var d WebhookDelivery
+		var payload []byte
+		var sealed string
+		if err := rows.Scan(&d.ID, &d.EndpointID, &d.EventID, &d.EventType, &payload, &d.Attempts, &d.URL, &sealed, &d.EndpointActive); err != nil {
+			return nil, err
+		}
+		d.Payload = payload
+		d.Status = WebhookDeliveryPending
+		if d.Secret, err = secrets.DecryptString(sealed); err != nil {
+			return nil, fmt.Errorf("decrypt secret of webhook %s: %w", d.EndpointID, err)
+		}
+		deliveries = append(deliveries, &d)
+	}
+	return deliveries, rows.Err()
+}
+
+// RecordWebhookAttempt пишет попытку в журнал и переводит доставку в succeeded, failed
+// или назначает следующую попытку по расписанию повторов. Возвращает новый статус.
+func RecordWebhookAttempt(ctx context.Context, d *WebhookDelivery, a WebhookAttempt, retry bool) (string, error) {
+	if len(a.ResponseBody) > webhookResponseLimit {
+		a.ResponseBody = a.ResponseBody[:webhookResponseLimit]
+	}
+	a.ResponseBody = strings.ToValidUTF8(a.ResponseBody, "")
+	status := WebhookDeliveryPending
+	next := time.Now()
+	switch {
+	case a.OK():
+		status = WebhookDeliverySucceeded
+	case !retry || d.Attempts >= WebhookMaxAttempts:
+		status = WebhookDeliveryFailed
+	default:
+		next = next.Add(webhookBackoff[d.Attempts-1])
+	}
+	var lastError *string
+	if !a.OK() {
+		msg := a.Error
+		if msg == "" && a.StatusCode != nil {
+			msg = fmt.Sprintf("HTTP %d", *a.StatusCode)
+		}
+		lastError = &msg
+	}
+
+	tx, err := database.Pool.Begin(ctx)
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback(ctx)
+	_, err = tx.Exec(ctx, `
+		INSERT INTO webhook_attempts (delivery_id, attempt, status_code, error, response_body, duration_ms)
+		VALUES ($1, $2, $3, NULLIF($4, ''), NULLIF($5, ''), $6)
+	`, d.ID, d.Attempts, a.StatusCode, a.Error, a.ResponseBody, a.DurationMs)
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(ctx, `
+		UPDATE webhook_deliveries
+		SET status = $2, next_attempt_at = $3, last_status_code = $4, last_error = $5,
+			delivered_at = CASE WHEN $2 = 'succeeded' THEN NOW() END
+		WHERE id = $1
+	`, d.ID, status, next, a.StatusCode, lastError)
+	if err != nil {
+		return "", err
+	}
+	d.Status = status
+	return status, tx.Commit(ctx)
+}
+
+// PruneWebhookDeliveries удаляет завершённые доставки старше срока хранения
+func PruneWebhookDeliveries(ctx context.Context) (int64, error) {
+	tag, err := database.Pool.Exec(ctx, `
+		DELETE FROM webhook_deliveries
+		WHERE status <> 'pending' AND created_at < NOW() - make_interval(days => $1)
+	`, int(WebhookDeliveryRetention.Hours()/24))
+	if err != nil {
+		return 0, err
+	}
+	return tag.RowsAffected(), nil
+}
@@ -0,0 +1,170 @@
+package monitoring
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// RegisterDBCollectors регистрирует метрики пула соединений и бизнес-метрики из БД
+func RegisterDBCollectors(pool *pgxpool.Pool) {
+	prometheus.MustRegister(newPgxPoolCollector(pool), newBusinessCollector(pool))
+}
+
+// ========== PGXPOOL ==========
+
+type pgxPoolCollector struct {
+	pool *pgxpool.Pool
+
+	acquired, idle, total, max         *prometheus.Desc
+	acquireCount, emptyAcquire, cancel *prometheus.Desc
+	acquireDuration                    *prometheus.Desc
+}
+
+func newPgxPoolCollector(pool *pgxpool.Pool) *pgxPoolCollector {
+	desc := func(name, help string) *prometheus.Desc {
+		return prometheus.NewDesc("pgxpool_"+name, help, nil, nil)
+	}
+	return &pgxPoolCollector{
+		pool:            pool,
+		acquired:        desc("acquired_conns", "Connections currently in use"),
+		idle:            desc("idle_conns", "Idle connections"),
+		total:           desc("total_conns", "Total connections in the pool"),
+		max:             desc("max_conns", "Maximum pool size"),
+		acquireCount:    desc("acquire_total", "Successful connection acquires"),
+		emptyAcquire:    desc("empty_acquire_total", "Acquires that had to wait for a connection"),
+		cancel:          desc("canceled_acquire_total", "Acquires canceled by context"),
+		acquireDuration: desc("acquire_duration_seconds_total", "Total time spent acquiring connections"),
+	}
+}
+
+func (c *pgxPoolCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, d := range []*prometheus.Desc{c.acquired, c.idle, c.total, c.max, c.acquireCount, c.emptyAcquire, c.cancel, c.acquireDuration} {
+		ch <- d
+	}
+}
+
+func (c *pgxPoolCollector) Collect(ch chan<- prometheus.Metric) {
+	stat := c.pool.Stat()
+	ch <- prometheus.MustNewConstMetric(c.acquired, prometheus.GaugeValue, float64(stat.AcquiredConns()))
+	ch <- prometheus.MustNewConstMetric(c.idle, prometheus.GaugeValue, float64(stat.IdleConns()))
+	ch <- prometheus.MustNewConstMetric(c.total, prometheus.GaugeValue, float64(stat.TotalConns()))
+	ch <- prometheus.MustNewConstMetric(c.max, prometheus.GaugeValue, float64(stat.MaxConns()))
+	ch <- prometheus.MustNewConstMetric(c.acquireCount, prometheus.CounterValue, float64(stat.AcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.emptyAcquire, prometheus.CounterValue, float64(stat.EmptyAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.cancel, prometheus.CounterValue, float64(stat.CanceledAcquireCount()))
+	ch <- prometheus.MustNewConstMetric(c.acquireDuration, prometheus.CounterValue, stat.AcquireDuration().Seconds())
+}
+
+// ========== БИЗНЕС-МЕТРИКИ ==========
+
+// businessCacheTTL – как часто collector ходит в БД, сколько бы раз ни скрейпили /metrics
+const businessCacheTTL = 30 * time.Second
+
+type labeledValue struct {
+	labels []string
+	value  float64
+}
+
+type businessCollector struct {
+	pool *pgxpool.Pool
+
+	subscriptions, payments, paymentsAmount *prometheus.Desc
+
+	mu        sync.Mutex
+	updatedAt time.Time
+	cached    map[*prometheus.Desc][]labeledValue
+}
+
+func newBusinessCollector(pool *pgxpool.Pool) *businessCollector {
+	return &businessCollector{
+		pool:           pool,
+		subscriptions:  prometheus.NewDesc("subscriptions_active", "Active subscriptions per plan", []string{"plan"}, nil),
+		payments:       prometheus.NewDesc("payments", "Payments by status", []string{"status"}, nil),
+		paymentsAmount: prometheus.NewDesc("payments_amount", "Sum of payments by status and currency", []string{"status", "currency"}, nil),
+	}
+}
+
+func (c *businessCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.subscriptions
+	ch <- c.payments
+	ch <- c.paymentsAmount
+}
+
+func (c *businessCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if time.Since(c.updatedAt) > businessCacheTTL {
+		if err := c.refresh(); err != nil {
+			log.Printf("⚠️ Ошибка сбора бизнес-метрик: %v", err)
+		} else {
+			c.updatedAt = time.Now()
+		}
+	}
+	for desc, values := range c.cached {
+		for _, v := range values {
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, v.value, v.labels...)
+		}
+	}
+}
+
+func (c *businessCollector) refresh() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	cached := make(map[*prometheus.Desc][]labeledValue)
+
+	rows, err := c.pool.Query(ctx, `
+		SELECT p.code, COUNT(s.id)
+		FROM subscription_plans p
+		LEFT JOIN user_subscriptions s
+			ON s.plan_id = p.id AND s.status = 'active' AND s.current_period_end > NOW()
+		GROUP BY p.code
+	`)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var plan string
+		var count int64
+		if err := rows.Scan(&plan, &count); err != nil {
+			rows.Close()
+			return err
+		}
+		cached[c.subscriptions] = append(cached[c.subscriptions], labeledValue{[]string{plan}, float64(count)})
+	}
+	rows.Close()
+
+	rows, err = c.pool.Query(ctx, `
+		SELECT COALESCE(status, 'unknown'), COALESCE(currency, 'RUB'), COUNT(*), COALESCE(SUM(amount), 0)::float8
+		FROM payments
+		GROUP BY 1, 2
+	`)
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]float64)
+	for rows.Next() {
+		var status, currency string
+		var count int64
+		var amount float64
+		if err := rows.Scan(&status, &currency, &count, &amount); err != nil {
+			rows.Close()
+			return err
+		}
+		counts[status] += float64(count)
+		cached[c.paymentsAmount] = append(cached[c.paymentsAmount], labeledValue{[]string{status, currency}, amount})
+	}
+	rows.Close()
+	for status, count := range counts {
+		cached[c.payments] = append(cached[c.payments], labeledValue{[]string{status}, count})
+	}
+
+	c.cached = cached
+	return nil
+}
@@ -1,11 +1,15 @@
 package monitoring
 
 import (
+	"sync/atomic"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promauto"
 )
 
 var (
+	// path – шаблон маршрута gin (/api/crm/deals/:id), а не сырой путь, чтобы не плодить серии
 	HttpRequestsTotal = promauto.NewCounterVec(
 		prometheus.CounterOpts{
 			Name: "http_requests_total",
@@ -22,4 +26,94 @@ var (
 		},
 		[]string{"method", "path"},
 	)
+
+	HttpRequestsInFlight = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests being served",
+		},
+	)
+
+	// ========== AI ==========
+
+	AITokensTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ai_tokens_total",
+			Help: "AI tokens consumed, by provider and model",
+		},
+		[]string{"provider", "model"},
+	)
+
+	AIRequestErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ai_request_errors_total",
+			Help: "Failed AI provider calls, by provider and reason (transport, status, parse)",
+		},
+		[]string{"provider", "reason"},
+	)
+
+	AgentTasksTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "ai_agent_tasks_total",
+			Help: "Processed AI agent tasks, by task type and outcome",
+		},
+		[]string{"task_type", "outcome"},
+	)
+
+	// ========== CRM REALTIME ==========
+
+	RealtimeClients = promauto.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "crm_realtime_clients",
+			Help: "Connected CRM live update clients (SSE and WebSocket)",
+		},
+	)
+
+	RealtimeDroppedTotal = promauto.NewCounter(
+		prometheus.CounterOpts{
+			Name: "crm_realtime_dropped_clients_total",
+			Help: "CRM live update clients disconnected for falling behind",
+		},
+	)
+
+	// ========== WEBHOOKS ==========
+
+	WebhookAttemptsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "webhook_attempts_total",
+			Help: "Outbound webhook delivery attempts by result (success, retry, failed)",
+		},
+		[]string{"result"},
+	)
+
+	// ========== 1C ==========
+
+	OneCSyncErrorsTotal = promauto.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "onec_sync_errors_total",
+			Help: "1C synchronization errors, by entity",
+		},
+		[]string{"entity"},
+	)
+
+	onecLastSync atomic.Int64
+
+	_ = promauto.NewGaugeFunc(
+		prometheus.GaugeOpts{
+			Name: "onec_sync_lag_seconds",
+			Help: "Seconds since the last successful 1C synchronization (-1 if never synced)",
+		},
+		func() float64 {
+			last := onecLastSync.Load()
+			if last == 0 {
+				return -1
+			}
+			return time.Since(time.Unix(last, 0)).Seconds()
+		},
+	)
 )
+
+// MarkOneCSynced отмечает успешный цикл синхронизации с 1С
+func MarkOneCSynced() {
+	onecLastSync.Store(time.Now().Unix())
+}
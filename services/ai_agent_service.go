@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"subscription-system/database"
+	"subscription-system/monitoring"
 )
 
 // OpenRouterServiceInterface - интерфейс для AI сервисов
@@ -67,6 +68,7 @@ func (s *AIAgentService) ProcessPendingTasks() {
 		if err != nil {
 			log.Printf("❌ Ошибка AI: %v", err)
 			database.Pool.Exec(ctx, "UPDATE ai_agent_tasks SET status = 'failed' WHERE id = $1", id)
+			monitoring.AgentTasksTotal.WithLabelValues(taskType, "failed").Inc()
 			continue
 		}
 
@@ -75,6 +77,7 @@ func (s *AIAgentService) ProcessPendingTasks() {
 			SET status = 'completed', result = $1, executed_at = NOW()
 			WHERE id = $2
 		`, response, id)
+		monitoring.AgentTasksTotal.WithLabelValues(taskType, "completed").Inc()
 
 		log.Printf("✅ Задача %s выполнена", id)
 	}
@@ -7,9 +7,12 @@ import (
     "fmt"
     "io/ioutil"
     "net/http"
+    "strconv"
     "time"
 
     "subscription-system/config"
+    "subscription-system/monitoring"
+    "subscription-system/tracing"
 )
 
 type YandexAIService struct {
@@ -42,6 +45,9 @@ type YandexGPTResponse struct {
         Alternatives []struct {
             Message YandexGPTMessage `json:"message"`
         } `json:"alternatives"`
+        Usage struct {
+            TotalTokens string `json:"totalTokens"`
+        } `json:"usage"`
     } `json:"result"`
 }
 
@@ -79,9 +85,10 @@ func (s *YandexAIService) Ask(ctx context.Context, prompt string) (string, error
     req.Header.Set("Content-Type", "application/json")
     req.Header.Set("Authorization", "Api-Key "+s.cfg.YandexAPIKey)
 
-    client := &http.Client{Timeout: 30 * time.Second}
+    client := tracing.NewHTTPClient("yandexgpt", 30*time.Second)
     resp, err := client.Do(req)
     if err != nil {
+        monitoring.AIRequestErrorsTotal.WithLabelValues("yandexgpt", "transport").Inc()
         return "", fmt.Errorf("failed to send request: %w", err)
     }
     defer resp.Body.Close()
@@ -92,14 +99,20 @@ func (s *YandexAIService) Ask(ctx context.Context, prompt string) (string, error
     }
 
     if resp.StatusCode != http.StatusOK {
+        monitoring.AIRequestErrorsTotal.WithLabelValues("yandexgpt", "status").Inc()
         return "", fmt.Errorf("YandexGPT returned status %d: %s", resp.StatusCode, string(body))
     }
 
     var yandexResp YandexGPTResponse
     if err := json.Unmarshal(body, &yandexResp); err != nil {
+        monitoring.AIRequestErrorsTotal.WithLabelValues("yandexgpt", "parse").Inc()
         return "", fmt.Errorf("failed to unmarshal response: %w", err)
     }
 
+    if tokens, err := strconv.Atoi(yandexResp.Result.Usage.TotalTokens); err == nil {
+        monitoring.AITokensTotal.WithLabelValues("yandexgpt", "yandexgpt-lite").Add(float64(tokens))
+    }
+
     if len(yandexResp.Result.Alternatives) == 0 {
         return "", fmt.Errorf("no alternatives in response")
     }
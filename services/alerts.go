@@ -0,0 +1,130 @@
+package services
+
+import (
+	"context"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const alertCheckInterval = 15 * time.Minute
+
+var alertSeverityIcons = map[string]string{
+	models.AlertSeverityInfo:     "ℹ️",
+	models.AlertSeverityWarning:  "⚠️",
+	models.AlertSeverityCritical: "🚨",
+}
+
+// AlertService проверяет правила оповещений по дневным метрикам сервиса и уведомляет
+// владельца правила в Telegram и на почту (каналы задаются в правиле), а также вебхуками
+// alert.fired и alert.resolved. О повторных нарушениях открытого оповещения не уведомляет.
+type AlertService struct {
+	notifier  *NotificationService
+	publicURL string
+}
+
+func NewAlertService(cfg *config.Config) *AlertService {
+	return &AlertService{notifier: NewNotificationService(cfg), publicURL: cfg.PublicURL}
+}
+
+// Start запускает проверку правил раз в 15 минут: метрики дневные, но так отложенные
+// оповещения открываются вскоре после истечения срока
+func (s *AlertService) Start() {
+	log.Println("🚨 Оповещения по метрикам: планировщик запущен")
+	go func() {
+		ticker := time.NewTicker(alertCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.CheckAll(context.Background())
+		}
+	}()
+}
+
+// CheckAll проверяет все включённые правила
+func (s *AlertService) CheckAll(ctx context.Context) {
+	rules, err := models.EnabledAlertRules(ctx)
+	if err != nil {
+		log.Printf("❌ Ошибка получения правил оповещений: %v", err)
+		return
+	}
+	for _, rule := range rules {
+		if _, _, err := s.Check(ctx, rule); err != nil {
+			log.Printf("❌ Ошибка проверки правила оповещения %s: %v", rule.ID, err)
+		}
+	}
+}
+
+// Check проверяет правило, обновляет его оповещение и отправляет уведомление, если оповещение
+// сработало или закрылось само
+func (s *AlertService) Check(ctx context.Context, rule *models.AlertRule) (*models.AlertEvaluation, *models.AlertTransition, error) {
+	ev, err := models.EvaluateAlertRule(ctx, rule)
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := models.ApplyAlertEvaluation(ctx, rule, ev, time.Now())
+	if err != nil {
+		return ev, nil, err
+	}
+	if t.Event != "" {
+		log.Printf("🚨 Оповещение %s по правилу «%s»: %s", t.Event, rule.Name, t.Alert.Message)
+		s.notify(ctx, rule, t)
+	}
+	return ev, t, nil
+}
+
+// notify отправляет уведомление по каналам правила и ставит вебхук в очередь
+func (s *AlertService) notify(ctx context.Context, rule *models.AlertRule, t *models.AlertTransition) {
+	eventType := models.WebhookEventAlertFired
+	if t.Event == models.AlertEventResolved {
+		eventType = models.WebhookEventAlertResolved
+	}
+	if _, err := models.EnqueueWebhookEvent(ctx, &rule.UserID, eventType, map[string]interface{}{
+		"alert": t.Alert, "rule_id": rule.ID, "account_id": rule.AccountID,
+	}); err != nil {
+		log.Printf("⚠️ Не удалось поставить вебхук %s в очередь: %v", eventType, err)
+	}
+
+	if len(rule.Channels) == 0 {
+		return
+	}
+	email, telegramID, err := models.AlertOwnerContacts(ctx, rule.UserID)
+	if err != nil {
+		log.Printf("⚠️ Не удалось получить контакты владельца правила %s: %v", rule.ID, err)
+		return
+	}
+	title, text := s.format(rule, t)
+	for _, ch := range rule.Channels {
+		var err error
+		switch {
+		case ch == models.AlertChannelTelegram && telegramID != nil:
+			err = s.notifier.SendTelegramTo(ctx, *telegramID, "<b>"+html.EscapeString(title)+"</b>\n"+text)
+		case ch == models.AlertChannelEmail && email != "":
+			err = s.notifier.SendEmail(email, title, strings.ReplaceAll(text, "\n", "<br>"))
+		default:
+			continue
+		}
+		if err != nil {
+			log.Printf("⚠️ Оповещение %s не доставлено (%s): %v", t.Alert.ID, ch, err)
+		}
+	}
+}
+
+// format – заголовок (тема письма) и HTML-текст уведомления
+func (s *AlertService) format(rule *models.AlertRule, t *models.AlertTransition) (string, string) {
+	title := alertSeverityIcons[rule.Severity] + " " + rule.Name
+	if t.Event == models.AlertEventResolved {
+		title = "✅ " + rule.Name + ": метрика в норме"
+	}
+	lines := []string{html.EscapeString(t.Alert.Message)}
+	if t.Event == models.AlertEventFired && t.Alert.Occurrences > 1 {
+		lines = append(lines, "Нарушение держится с "+t.Alert.FirstMetricDate)
+	}
+	if s.publicURL != "" {
+		lines = append(lines, `<a href="`+s.publicURL+`/analytics">Открыть аналитику</a>`)
+	}
+	return title, strings.Join(lines, "\n")
+}
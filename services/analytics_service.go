@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math"
 	"time"
 
 	"subscription-system/database"
@@ -79,11 +78,8 @@ func (s *AnalyticsService) CalculateAccountMetrics(ctx context.Context, accountI
 	// 4. RFM-анализ
 	s.CalculateRFMAnalysis(ctx, accountID)  // ← ИСПРАВЛЕНО
 	
-	// 5. Прогноз оттока
-	s.predictChurn(ctx, accountID)
-	
-	// 6. Когортный анализ
-	s.calculateCohorts(ctx, accountID)
+	// Прогноз оттока ведёт ChurnService по модели, обученной на движениях MRR
+	// Когорты считает CohortService по определениям когорт
 }
 
 // calculateDailyRevenue - доход по дням
@@ -308,51 +304,6 @@ func (s *AnalyticsService) getRFMSegment(r, f, m int) (string, string) {
 	}
 }
 
-// predictChurn - прогноз оттока
-func (s *AnalyticsService) predictChurn(ctx context.Context, accountID string) {
-	// Простая модель: если нет активности > 60 дней - высокий риск
-	query := `
-		SELECT 
-			c.id,
-			EXTRACT(DAY FROM NOW() - MAX(a.created_at))::INT as days_inactive
-		FROM customers c
-		LEFT JOIN activities a ON a.entity_id = c.id AND a.entity_type = 'customer'
-		WHERE c.account_id = $1
-		GROUP BY c.id
-	`
-	
-	rows, err := database.Pool.Query(ctx, query, accountID)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var customerID string
-		var daysInactive int
-		
-		if err := rows.Scan(&customerID, &daysInactive); err != nil {
-			continue
-		}
-		
-		// Рассчитываем вероятность оттока
-		probability := math.Min(float64(daysInactive)/90.0, 1.0)
-		
-		var riskLevel string
-		switch {
-		case probability > 0.7:
-			riskLevel = "high"
-		case probability > 0.3:
-			riskLevel = "medium"
-		default:
-			riskLevel = "low"
-		}
-		
-		// Сохраняем прогноз
-		s.saveChurnPrediction(ctx, accountID, customerID, probability, riskLevel)
-	}
-}
-
 // saveMetric - сохранение метрики
 func (s *AnalyticsService) saveMetric(ctx context.Context, accountID string, date time.Time, metricType string, value float64, metadata map[string]interface{}) {
 	_, err := database.Pool.Exec(ctx, `
@@ -366,76 +317,3 @@ func (s *AnalyticsService) saveMetric(ctx context.Context, accountID string, dat
 		log.Printf("❌ Ошибка сохранения метрики: %v", err)
 	}
 }
-
-// saveChurnPrediction - сохранение прогноза оттока
-func (s *AnalyticsService) saveChurnPrediction(ctx context.Context, accountID, customerID string, probability float64, riskLevel string) {
-	factors := map[string]interface{}{
-		"inactivity_days": probability * 90,
-	}
-	
-	_, err := database.Pool.Exec(ctx, `
-		INSERT INTO analytics_churn_predictions (account_id, customer_id, churn_probability, risk_level, factors, predicted_date)
-		VALUES ($1, $2, $3, $4, $5, NOW() + INTERVAL '30 days')
-		ON CONFLICT (customer_id) 
-		DO UPDATE SET churn_probability = EXCLUDED.churn_probability, 
-		              risk_level = EXCLUDED.risk_level,
-		              factors = EXCLUDED.factors
-	`, accountID, customerID, probability, riskLevel, factors)
-	
-	if err != nil {
-		log.Printf("❌ Ошибка сохранения прогноза: %v", err)
-	}
-}
-
-// calculateCohorts - когортный анализ
-func (s *AnalyticsService) calculateCohorts(ctx context.Context, accountID string) {
-	// Очищаем старые данные
-	database.Pool.Exec(ctx, "DELETE FROM analytics_cohorts WHERE account_id = $1", accountID)
-	
-	query := `
-		WITH cohorts AS (
-			SELECT 
-				c.id,
-				DATE_TRUNC('month', c.created_at) as cohort_month,
-				EXTRACT('month' FROM AGE(p.created_at, c.created_at)) as period
-			FROM customers c
-			LEFT JOIN payments p ON p.customer_id = c.id
-			WHERE c.account_id = $1
-		)
-		SELECT 
-			cohort_month,
-			period,
-			COUNT(DISTINCT id) as cohort_size,
-			COUNT(DISTINCT CASE WHEN period = 0 THEN id END) as retained
-		FROM cohorts
-		GROUP BY cohort_month, period
-		ORDER BY cohort_month, period
-	`
-	
-	rows, err := database.Pool.Query(ctx, query, accountID)
-	if err != nil {
-		return
-	}
-	defer rows.Close()
-
-	for rows.Next() {
-		var cohortMonth time.Time
-		var period int
-		var cohortSize, retained int
-		
-		if err := rows.Scan(&cohortMonth, &period, &cohortSize, &retained); err != nil {
-			continue
-		}
-		
-		retentionRate := float64(retained) / float64(cohortSize) * 100
-		
-		_, err = database.Pool.Exec(ctx, `
-			INSERT INTO analytics_cohorts (account_id, cohort_date, period, cohort_size, retention_rate)
-			VALUES ($1, $2, $3, $4, $5)
-		`, accountID, cohortMonth, period, cohortSize, retentionRate)
-		
-		if err != nil {
-			log.Printf("❌ Ошибка сохранения когорты: %v", err)
-		}
-	}
-}
\ No newline at end of file
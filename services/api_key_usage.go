@@ -0,0 +1,67 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"subscription-system/models"
+)
+
+const (
+	apiKeyUsageFlushInterval = 10 * time.Second
+	apiKeyUsageFlushTimeout  = 5 * time.Second
+	apiKeyExpireInterval     = time.Hour
+)
+
+// APIKeyUsageService сбрасывает в БД использование API-ключей, накопленное middleware:
+// вместо двух запросов на каждый вызов API – одна пачка раз в 10 секунд.
+// Раз в час он же выключает ключи с истёкшим сроком.
+type APIKeyUsageService struct{}
+
+func NewAPIKeyUsageService() *APIKeyUsageService {
+	return &APIKeyUsageService{}
+}
+
+// Start запускает периодический сброс счётчиков и выключение просроченных ключей
+func (s *APIKeyUsageService) Start() {
+	log.Println("🔑 Учёт использования API-ключей: сброс в БД запущен")
+	go func() {
+		ticker := time.NewTicker(apiKeyUsageFlushInterval)
+		defer ticker.Stop()
+		expireTicker := time.NewTicker(apiKeyExpireInterval)
+		defer expireTicker.Stop()
+		s.DeactivateExpired()
+		for {
+			select {
+			case <-ticker.C:
+				s.Flush()
+			case <-expireTicker.C:
+				s.DeactivateExpired()
+			}
+		}
+	}()
+}
+
+// Flush записывает накопленные счётчики; при ошибке они останутся до следующего сброса
+func (s *APIKeyUsageService) Flush() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiKeyUsageFlushTimeout)
+	defer cancel()
+	if err := models.FlushAPIKeyUsage(ctx); err != nil {
+		log.Printf("⚠️ Не удалось записать использование API-ключей: %v", err)
+	}
+}
+
+// DeactivateExpired выключает ключи, срок которых истёк (в том числе после окна ротации)
+func (s *APIKeyUsageService) DeactivateExpired() {
+	ctx, cancel := context.WithTimeout(context.Background(), apiKeyUsageFlushTimeout)
+	defer cancel()
+	n, err := models.DeactivateExpiredAPIKeys(ctx)
+	if err != nil {
+		log.Printf("⚠️ Не удалось выключить просроченные API-ключи: %v", err)
+		return
+	}
+	if n > 0 {
+		log.Printf("🔑 Выключено просроченных API-ключей: %d", n)
+	}
+}
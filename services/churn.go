@@ -0,0 +1,181 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const (
+	churnCheckInterval = time.Hour
+	churnRetrainEvery  = 7 * 24 * time.Hour
+	churnScoreEvery    = 24 * time.Hour
+	// churnRetryEvery – пауза перед новой попыткой обучения, если истории пока мало
+	churnRetryEvery = 24 * time.Hour
+)
+
+// ChurnService переобучает модель оттока раз в неделю и раз в сутки пересчитывает прогнозы.
+// Подписчик, впервые попавший в высокий риск, порождает событие churn.high_risk и, если задан
+// ответственный (CHURN_TASK_ASSIGNEE_ID), задачу на удержание.
+type ChurnService struct {
+	horizonDays int
+	thresholds  models.ChurnRiskThresholds
+	assigneeID  string
+
+	mu          sync.Mutex
+	lastAttempt time.Time
+	lastScored  time.Time
+}
+
+func NewChurnService(cfg *config.Config) *ChurnService {
+	return &ChurnService{
+		horizonDays: cfg.ChurnHorizonDays,
+		thresholds: models.ChurnRiskThresholds{
+			High:   float64(cfg.ChurnHighRiskPercent) / 100,
+			Medium: float64(cfg.ChurnMediumRiskPercent) / 100,
+		},
+		assigneeID: cfg.ChurnTaskAssigneeID,
+	}
+}
+
+// Start запускает проверку раз в час: переобучение и пересчёт выполняются, когда подошёл срок.
+// Первая проверка – через час после старта, когда метрики выручки уже досчитаны.
+func (s *ChurnService) Start() {
+	log.Printf("📉 Прогноз оттока: горизонт %d дн., высокий риск от %.0f%%", s.horizonDays, s.thresholds.High*100)
+	go func() {
+		ticker := time.NewTicker(churnCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.tick(context.Background())
+		}
+	}()
+}
+
+func (s *ChurnService) tick(ctx context.Context) {
+	s.mu.Lock()
+	due := time.Since(s.lastAttempt) >= churnRetryEvery
+	s.mu.Unlock()
+	if due {
+		list, err := models.ListChurnModels(ctx)
+		if err != nil {
+			log.Printf("❌ Ошибка чтения моделей оттока: %v", err)
+			return
+		}
+		if len(list) == 0 || time.Since(list[0].TrainedAt) >= churnRetrainEvery {
+			if _, err := s.Train(ctx, nil); err != nil && !errors.Is(err, models.ErrNotEnoughChurnData) {
+				log.Printf("❌ Ошибка обучения модели оттока: %v", err)
+			}
+		}
+	}
+	s.mu.Lock()
+	due = time.Since(s.lastScored) >= churnScoreEvery
+	s.mu.Unlock()
+	if due {
+		if _, err := s.Score(ctx); err != nil && !errors.Is(err, models.ErrNoActiveChurnModel) {
+			log.Printf("❌ Ошибка расчёта прогноза оттока: %v", err)
+		}
+	}
+}
+
+// Train обучает новую версию; активная версия сразу пересчитывает прогнозы
+func (s *ChurnService) Train(ctx context.Context, createdBy *string) (*models.ChurnModel, error) {
+	s.mu.Lock()
+	s.lastAttempt = time.Now()
+	s.mu.Unlock()
+	m, err := models.TrainChurnModel(ctx, s.horizonDays, createdBy)
+	if err != nil {
+		return nil, err
+	}
+	log.Printf("📉 Модель оттока v%d: AUC %.3f, калибровка %.3f, активна – %v",
+		m.ID, m.Metrics.AUC, m.Metrics.CalibrationError, m.IsActive)
+	if m.IsActive {
+		if _, err := s.Score(ctx); err != nil {
+			log.Printf("⚠️ Не удалось пересчитать прогноз оттока после обучения: %v", err)
+		}
+	}
+	return m, nil
+}
+
+// Score пересчитывает прогнозы активной моделью и возвращает число подписчиков с прогнозом
+func (s *ChurnService) Score(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	scored, entered, err := models.ScoreChurn(ctx, s.thresholds)
+	if err != nil {
+		return 0, err
+	}
+	s.lastScored = time.Now()
+	for _, r := range entered {
+		s.onHighRisk(ctx, r)
+	}
+	if len(entered) > 0 {
+		log.Printf("📉 Прогноз оттока: подписчиков – %d, новых в высоком риске – %d", scored, len(entered))
+	}
+	return scored, nil
+}
+
+// onHighRisk публикует событие и ставит задачу ответственному за удержание
+func (s *ChurnService) onHighRisk(ctx context.Context, r models.ChurnRiskEntered) {
+	var ownerID, customerID *string
+	if s.assigneeID != "" {
+		ownerID = &s.assigneeID
+		id, err := models.ChurnCustomerFor(ctx, s.assigneeID, r.Email)
+		if err != nil {
+			log.Printf("⚠️ Не удалось найти клиента CRM для %s: %v", r.Email, err)
+		}
+		customerID = id
+	}
+	factors := make([]string, 0, len(r.Factors))
+	for _, f := range r.Factors {
+		if f.Contribution > 0 {
+			factors = append(factors, fmt.Sprintf("%s: %g", f.Label, f.Value))
+		}
+	}
+
+	e := &models.CRMEvent{Type: models.CRMEventChurnHighRisk, EntityType: "user", EntityID: r.UserID, OwnerID: ownerID,
+		Payload: map[string]interface{}{
+			"email": r.Email, "churn_probability": r.Probability, "factors": r.Factors, "customer_id": customerID,
+		}}
+	if err := models.PublishCRMEvent(ctx, e); err != nil {
+		log.Printf("⚠️ Не удалось опубликовать событие %s %s: %v", e.Type, e.EntityID, err)
+	} else {
+		data := map[string]interface{}{"entity_type": e.EntityType, "entity_id": e.EntityID}
+		for k, v := range e.Payload {
+			data[k] = v
+		}
+		if _, err := models.EnqueueWebhookEvent(ctx, e.OwnerID, e.Type, data); err != nil {
+			log.Printf("⚠️ Не удалось поставить вебхук %s в очередь: %v", e.Type, err)
+		}
+	}
+
+	if s.assigneeID == "" {
+		return
+	}
+	description := fmt.Sprintf("Вероятность ухода в ближайшие %d дн. – %.0f%%.", s.horizonDays, r.Probability*100)
+	if len(factors) > 0 {
+		description += "\nОсновные причины:\n– " + strings.Join(factors, "\n– ")
+	}
+	task := &models.Task{
+		UserID:      ownerID,
+		AssigneeID:  ownerID,
+		Title:       "Риск оттока: " + r.Email,
+		Description: description,
+		DueAt:       time.Now().Add(24 * time.Hour),
+		Priority:    models.TaskPriorityHigh,
+		CustomerID:  customerID,
+	}
+	if err := models.CreateTask(ctx, task); err != nil {
+		log.Printf("⚠️ Не удалось создать задачу по риску оттока %s: %v", r.Email, err)
+		return
+	}
+	if err := models.SetChurnPredictionTask(ctx, r.UserID, task.ID); err != nil {
+		log.Printf("⚠️ Не удалось связать задачу %s с прогнозом оттока: %v", task.ID, err)
+	}
+}
@@ -0,0 +1,52 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"subscription-system/models"
+)
+
+const cohortComputeInterval = time.Hour
+
+// CohortService досчитывает когорты всех определений по новым событиям
+type CohortService struct{}
+
+func NewCohortService() *CohortService {
+	return &CohortService{}
+}
+
+// Start запускает досчёт раз в час; матрица при запросе дополнительно досчитывается сама
+func (s *CohortService) Start() {
+	log.Println("👥 Когортный анализ: фоновый досчёт запущен")
+	go func() {
+		ticker := time.NewTicker(cohortComputeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.ComputeAll(context.Background())
+		}
+	}()
+}
+
+// ComputeAll досчитывает все определения; ошибка одного не мешает остальным
+func (s *CohortService) ComputeAll(ctx context.Context) {
+	ids, err := models.CohortDefinitionIDs(ctx)
+	if err != nil {
+		log.Printf("❌ Ошибка выборки определений когорт: %v", err)
+		return
+	}
+	var members, retained int64
+	for _, id := range ids {
+		m, r, err := models.ComputeCohorts(ctx, id)
+		if err != nil {
+			log.Printf("⚠️ Не удалось досчитать когорты %s: %v", id, err)
+			continue
+		}
+		members += m
+		retained += r
+	}
+	if members > 0 || retained > 0 {
+		log.Printf("👥 Когортный анализ: новых участников – %d, отметок удержания – %d", members, retained)
+	}
+}
@@ -0,0 +1,68 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const (
+	trashPurgeInterval = time.Hour
+	trashPurgeBatch    = 200
+)
+
+// TrashPurgeService окончательно удаляет записи корзины CRM старше срока хранения
+type TrashPurgeService struct {
+	retention time.Duration
+}
+
+func NewTrashPurgeService(cfg *config.Config) *TrashPurgeService {
+	return &TrashPurgeService{retention: time.Duration(cfg.CRMTrashRetentionDays) * 24 * time.Hour}
+}
+
+// Start запускает очистку раз в час; срок хранения 0 – корзина не очищается
+func (s *TrashPurgeService) Start() {
+	if s.retention <= 0 {
+		log.Println("🗑️ Корзина CRM: автоочистка отключена")
+		return
+	}
+	log.Printf("🗑️ Корзина CRM: записи хранятся %s", s.retention)
+	go func() {
+		ticker := time.NewTicker(trashPurgeInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.PurgeExpired(context.Background())
+		}
+	}()
+}
+
+// PurgeExpired удаляет просроченные записи корзины, пока такие есть
+func (s *TrashPurgeService) PurgeExpired(ctx context.Context) {
+	total := 0
+	for {
+		ids, err := models.ExpiredTrashItems(ctx, time.Now().Add(-s.retention), trashPurgeBatch)
+		if err != nil {
+			log.Printf("❌ Ошибка выборки просроченных записей корзины: %v", err)
+			return
+		}
+		failed := 0
+		for _, id := range ids {
+			if err := models.PurgeTrashItem(ctx, id); err != nil && !errors.Is(err, models.ErrTrashItemNotFound) {
+				log.Printf("⚠️ Не удалось очистить запись корзины %s: %v", id, err)
+				failed++
+				continue
+			}
+			total++
+		}
+		if len(ids) < trashPurgeBatch || failed == len(ids) {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("🗑️ Корзина CRM: окончательно удалено записей – %d", total)
+	}
+}
@@ -0,0 +1,396 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const (
+	// emailSyncBatch – сколько новых писем забирается из ящика за один проход
+	emailSyncBatch = 200
+	// emailMaxReferences – сколько предыдущих писем перечисляется в References ответа
+	emailMaxReferences = 20
+)
+
+// ErrMailboxBusy – ящик уже синхронизируется
+var ErrMailboxBusy = errors.New("mailbox sync already in progress")
+
+// EmailChannelService синхронизирует входящие ящиков пользователей (IMAP) и отправляет письма из CRM (SMTP)
+type EmailChannelService struct {
+	interval     time.Duration
+	initialDays  int
+	allowPrivate bool
+	publicURL    string
+
+	mu      sync.Mutex
+	syncing map[string]bool
+}
+
+func NewEmailChannelService(cfg *config.Config) *EmailChannelService {
+	return &EmailChannelService{
+		interval:     time.Duration(cfg.EmailSyncIntervalMinutes) * time.Minute,
+		initialDays:  cfg.EmailSyncInitialDays,
+		allowPrivate: cfg.EmailAllowPrivate,
+		publicURL:    cfg.PublicURL,
+		syncing:      map[string]bool{},
+	}
+}
+
+// Start запускает периодическую синхронизацию; период 0 – только ручная синхронизация
+func (s *EmailChannelService) Start() {
+	if s.interval <= 0 {
+		log.Println("📧 Почтовый канал CRM: автосинхронизация отключена")
+		return
+	}
+	log.Printf("📧 Почтовый канал CRM: синхронизация ящиков каждые %s", s.interval)
+	go func() {
+		ticker := time.NewTicker(s.interval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.SyncAll(context.Background())
+		}
+	}()
+}
+
+// SyncAll синхронизирует все ящики с включённой синхронизацией по очереди
+func (s *EmailChannelService) SyncAll(ctx context.Context) {
+	mailboxes, err := models.SyncableMailboxes(ctx)
+	if err != nil {
+		log.Printf("❌ Ошибка выборки почтовых ящиков: %v", err)
+		return
+	}
+	for _, mb := range mailboxes {
+		res, err := s.SyncMailbox(ctx, mb)
+		if err != nil && !errors.Is(err, ErrMailboxBusy) {
+			log.Printf("⚠️ Не удалось синхронизировать ящик %s: %v", mb.Email, err)
+			continue
+		}
+		if res.Stored > 0 {
+			log.Printf("📧 Ящик %s: сохранено писем – %d", mb.Email, res.Stored)
+		}
+	}
+}
+
+// EmailSyncResult – итог одного прохода синхронизации
+type EmailSyncResult struct {
+	Fetched int  `json:"fetched"` // прочитано писем из ящика
+	Stored  int  `json:"stored"`  // сохранено в переписку (письма клиентов и ответы в известных цепочках)
+	More    bool `json:"more"`    // в ящике остались новые письма – они придут следующим проходом
+}
+
+func (s *EmailChannelService) lock(id string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.syncing[id] {
+		return false
+	}
+	s.syncing[id] = true
+	return true
+}
+
+func (s *EmailChannelService) unlock(id string) {
+	s.mu.Lock()
+	delete(s.syncing, id)
+	s.mu.Unlock()
+}
+
+// SyncMailbox забирает новые письма папки ящика. Позиция – последний UID; смена UIDVALIDITY
+// на сервере начинает чтение заново (уже сохранённые письма отсекаются по Message-ID).
+// Первая синхронизация берёт письма за последние EMAIL_SYNC_INITIAL_DAYS дней.
+func (s *EmailChannelService) SyncMailbox(ctx context.Context, mb *models.Mailbox) (EmailSyncResult, error) {
+	var res EmailSyncResult
+	if !mb.CanIMAP() {
+		return res, fmt.Errorf("%w: imap is not configured", models.ErrInvalidMailbox)
+	}
+	if !s.lock(mb.ID) {
+		return res, ErrMailboxBusy
+	}
+	defer s.unlock(mb.ID)
+
+	uidValidity, lastUID := mb.UIDValidity, mb.LastUID
+	err := s.syncMailbox(ctx, mb, &uidValidity, &lastUID, &res)
+	if stateErr := models.SetMailboxSyncState(ctx, mb.ID, uidValidity, lastUID, err); stateErr != nil {
+		log.Printf("⚠️ Не удалось сохранить состояние синхронизации ящика %s: %v", mb.Email, stateErr)
+	}
+	return res, err
+}
+
+func (s *EmailChannelService) syncMailbox(ctx context.Context, mb *models.Mailbox, uidValidity, lastUID *int64, res *EmailSyncResult) error {
+	c, err := imapConnect(ctx, mb, s.allowPrivate)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	validity, err := c.selectFolder(mb.IMAPFolder)
+	if err != nil {
+		return err
+	}
+	if validity != *uidValidity {
+		*uidValidity, *lastUID = validity, 0
+	}
+	criteria := fmt.Sprintf("UID %d:*", *lastUID+1)
+	if *lastUID == 0 {
+		criteria = "SINCE " + time.Now().AddDate(0, 0, -s.initialDays).Format("02-Jan-2006")
+	}
+	found, err := c.searchUIDs(criteria)
+	if err != nil {
+		return err
+	}
+	// «n:*» всегда включает последнее письмо, даже если его UID меньше n
+	uids := found[:0]
+	for _, uid := range found {
+		if uid > *lastUID {
+			uids = append(uids, uid)
+		}
+	}
+	sort.Slice(uids, func(i, j int) bool { return uids[i] < uids[j] })
+	if len(uids) > emailSyncBatch {
+		uids, res.More = uids[:emailSyncBatch], true
+	}
+
+	for _, uid := range uids {
+		raw, err := c.fetchMessage(uid)
+		if err != nil {
+			return err
+		}
+		res.Fetched++
+		if raw != nil {
+			if err := s.storeIncoming(ctx, mb, validity, uid, raw, res); err != nil {
+				return err
+			}
+		}
+		*lastUID = uid
+	}
+	return nil
+}
+
+// storeIncoming разбирает письмо из ящика и сохраняет его, если оно относится к клиенту CRM
+func (s *EmailChannelService) storeIncoming(ctx context.Context, mb *models.Mailbox, uidValidity, uid int64, raw []byte, res *EmailSyncResult) error {
+	p, err := parseMail(raw)
+	if err != nil {
+		// Битое письмо не должно останавливать синхронизацию ящика
+		log.Printf("⚠️ Ящик %s: не удалось разобрать письмо UID %d: %v", mb.Email, uid, err)
+		return nil
+	}
+	m := &models.EmailMessage{
+		Direction:  models.EmailDirectionIn,
+		MessageID:  p.MessageID,
+		InReplyTo:  p.InReplyTo,
+		References: p.References,
+		FromAddr:   p.From.Address,
+		FromName:   p.From.Name,
+		To:         p.To,
+		Cc:         p.Cc,
+		Subject:    p.Subject,
+		BodyText:   p.Text,
+		BodyHTML:   p.HTML,
+		IMAPUID:    &uid,
+		SentAt:     p.Date,
+	}
+	if m.MessageID == "" {
+		m.MessageID = fmt.Sprintf("%d.%d@%s", uidValidity, uid, mb.IMAPHost)
+	}
+	if m.SentAt.IsZero() {
+		m.SentAt = time.Now()
+	}
+	// Письмо, отправленное владельцем из другого клиента и попавшее в синхронизируемую папку
+	if m.FromAddr == mb.Email {
+		m.Direction = models.EmailDirectionOut
+		m.SentBy = &mb.UserID
+	}
+	stored, err := models.SaveEmailMessage(ctx, mb, m, true)
+	if err != nil || !stored {
+		return err
+	}
+	res.Stored++
+	if m.CustomerID == nil {
+		return nil
+	}
+	eventType := models.CRMEventEmailReceived
+	if m.Direction == models.EmailDirectionOut {
+		eventType = models.CRMEventEmailSent
+	}
+	PublishEmailEvent(ctx, eventType, m, nil)
+	if m.ActivityType == models.ActivityEmailReplied {
+		if _, err := models.RecalculateLeadScore(ctx, *m.CustomerID); err != nil {
+			log.Printf("⚠️ Не удалось обновить lead_score для клиента %s: %v", *m.CustomerID, err)
+		}
+	}
+	return nil
+}
+
+// PublishEmailEvent публикует событие письма клиента в журнал CRM и очередь вебхуков
+func PublishEmailEvent(ctx context.Context, eventType string, m *models.EmailMessage, actorID *string) {
+	if m.CustomerID == nil {
+		return
+	}
+	e := &models.CRMEvent{Type: eventType, EntityType: "customer", EntityID: *m.CustomerID, ActorID: actorID,
+		Payload: map[string]interface{}{
+			"message_id": m.ID, "thread_id": m.ThreadID, "deal_id": m.DealID,
+			"direction": m.Direction, "subject": m.Subject, "from": m.FromAddr, "to": m.To,
+		}}
+	if err := models.PublishCRMEvent(ctx, e); err != nil {
+		log.Printf("⚠️ Не удалось опубликовать событие %s %s: %v", e.Type, e.EntityID, err)
+		return
+	}
+	data := map[string]interface{}{"entity_type": e.EntityType, "entity_id": e.EntityID, "actor_id": e.ActorID}
+	for k, v := range e.Payload {
+		data[k] = v
+	}
+	if _, err := models.EnqueueWebhookEvent(ctx, e.OwnerID, e.Type, data); err != nil {
+		log.Printf("⚠️ Не удалось поставить вебхук %s в очередь: %v", e.Type, err)
+	}
+}
+
+// EmailSendRequest – письмо из CRM; тема и HTML уже с подставленными полями шаблона
+type EmailSendRequest struct {
+	Mailbox    *models.Mailbox
+	To         []string
+	CustomerID *string
+	DealID     *string
+	ThreadID   string // ответ в существующую цепочку
+	TemplateID *string
+	Subject    string
+	HTML       string
+	TrackOpens bool
+	BaseURL    string // адрес сервиса для пикселя отслеживания (пусто – PUBLIC_URL)
+	SentBy     string
+}
+
+// EmailTrackingPixelPath – путь пикселя отслеживания открытий относительно адреса сервиса
+func EmailTrackingPixelPath(token string) string {
+	return "/api/public/email/open/" + token + ".gif"
+}
+
+// Send отправляет письмо через SMTP ящика и сохраняет его в переписку (с активностью клиента).
+// В переписке хранится HTML без пикселя отслеживания, чтобы просмотр в CRM не считался открытием.
+func (s *EmailChannelService) Send(ctx context.Context, req *EmailSendRequest) (*models.EmailMessage, error) {
+	mb := req.Mailbox
+	if !mb.CanSMTP() {
+		return nil, fmt.Errorf("%w: smtp is not configured", models.ErrInvalidMailbox)
+	}
+	if len(req.To) == 0 {
+		return nil, fmt.Errorf("%w: no recipients", models.ErrInvalidMailbox)
+	}
+	out := &outgoingMail{
+		From:      mail.Address{Name: mb.DisplayName, Address: mb.Email},
+		Subject:   req.Subject,
+		HTML:      req.HTML,
+		MessageID: models.NewEmailMessageID(mb.Email),
+		Date:      time.Now(),
+	}
+	for _, addr := range req.To {
+		out.To = append(out.To, mail.Address{Address: addr})
+	}
+	if req.ThreadID != "" {
+		last, err := models.LastEmailMessage(ctx, req.ThreadID)
+		if err != nil {
+			return nil, err
+		}
+		out.InReplyTo = last.MessageID
+		out.References = append(append([]string{}, last.References...), last.MessageID)
+		if len(out.References) > emailMaxReferences {
+			out.References = out.References[len(out.References)-emailMaxReferences:]
+		}
+	}
+
+	m := &models.EmailMessage{
+		ThreadID:   req.ThreadID,
+		CustomerID: req.CustomerID,
+		DealID:     req.DealID,
+		Direction:  models.EmailDirectionOut,
+		MessageID:  out.MessageID,
+		InReplyTo:  out.InReplyTo,
+		References: out.References,
+		FromAddr:   mb.Email,
+		FromName:   mb.DisplayName,
+		To:         req.To,
+		Subject:    req.Subject,
+		BodyText:   htmlToText(req.HTML),
+		BodyHTML:   req.HTML,
+		TemplateID: req.TemplateID,
+		SentBy:     &req.SentBy,
+		SentAt:     out.Date,
+	}
+	if req.TrackOpens {
+		token, err := models.NewEmailTrackingToken()
+		if err != nil {
+			return nil, err
+		}
+		baseURL := s.publicURL
+		if req.BaseURL != "" {
+			baseURL = req.BaseURL
+		}
+		pixel := `<img src="` + baseURL + EmailTrackingPixelPath(token) + `" width="1" height="1" alt="" style="display:none">`
+		if i := strings.LastIndex(strings.ToLower(out.HTML), "</body>"); i >= 0 {
+			out.HTML = out.HTML[:i] + pixel + out.HTML[i:]
+		} else {
+			out.HTML += pixel
+		}
+		m.TrackingToken = &token
+	}
+
+	raw, err := out.build()
+	if err != nil {
+		return nil, err
+	}
+	if err := sendSMTP(ctx, mb, req.To, raw, s.allowPrivate); err != nil {
+		return nil, err
+	}
+	if _, err := models.SaveEmailMessage(ctx, mb, m, false); err != nil {
+		return nil, fmt.Errorf("email sent but not saved: %w", err)
+	}
+	return m, nil
+}
+
+// MailboxCheck – результат проверки подключения ящика
+type MailboxCheck struct {
+	IMAP *string `json:"imap,omitempty"` // "ok" или текст ошибки
+	SMTP *string `json:"smtp,omitempty"`
+	OK   bool    `json:"ok"`
+}
+
+// TestMailbox проверяет вход на IMAP (с открытием папки) и на SMTP
+func (s *EmailChannelService) TestMailbox(ctx context.Context, mb *models.Mailbox) MailboxCheck {
+	check := MailboxCheck{OK: true}
+	result := func(err error) *string {
+		msg := "ok"
+		if err != nil {
+			msg, check.OK = err.Error(), false
+		}
+		return &msg
+	}
+	if mb.CanIMAP() {
+		check.IMAP = result(func() error {
+			c, err := imapConnect(ctx, mb, s.allowPrivate)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			_, err = c.selectFolder(mb.IMAPFolder)
+			return err
+		}())
+	}
+	if mb.CanSMTP() {
+		check.SMTP = result(func() error {
+			c, err := smtpConnect(ctx, mb, s.allowPrivate)
+			if err != nil {
+				return err
+			}
+			defer c.Close()
+			return c.Quit()
+		}())
+	}
+	return check
+}
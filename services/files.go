@@ -0,0 +1,388 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gabriel-vasile/mimetype"
+	"golang.org/x/image/draw"
+	_ "golang.org/x/image/webp"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+// FileService принимает загрузки в хранилище: поток пишется во временный файл с подсчётом SHA-256
+// и ограничением размера, тип определяется по содержимому и сверяется с разрешёнными расширениями,
+// одинаковое содержимое хранится один раз. Для изображений строится миниатюра. Раз в час удаляется
+// содержимое, на которое больше никто не ссылается.
+
+var (
+	ErrFileTooLarge       = errors.New("file too large")
+	ErrFileEmpty          = errors.New("file is empty")
+	ErrFileTypeNotAllowed = errors.New("file type not allowed")
+	ErrInvalidFileToken   = errors.New("invalid or expired file link")
+)
+
+const (
+	fileSniffLen        = 3072
+	fileCleanupInterval = time.Hour
+	fileCleanupGrace    = time.Hour // загрузка успевает сослаться на содержимое до очистки
+	fileCleanupBatch    = 200
+
+	thumbnailSize      = 320
+	thumbnailMaxPixels = 50_000_000 // защита от «бомб» распаковки
+)
+
+// UploadPolicy – разрешённые расширения и MIME-типы содержимого для них
+type UploadPolicy struct {
+	Extensions map[string][]string
+}
+
+// AllowedExtensions – список расширений для сообщений об ошибке
+func (p *UploadPolicy) AllowedExtensions() []string {
+	exts := make([]string, 0, len(p.Extensions))
+	for ext := range p.Extensions {
+		exts = append(exts, ext)
+	}
+	sort.Strings(exts)
+	return exts
+}
+
+// match возвращает MIME-тип из списка расширения, которому соответствует содержимое (с учётом
+// родительских типов: CSV – это text/plain, DOCX – zip), или пустую строку
+func (p *UploadPolicy) match(ext string, detected *mimetype.MIME) string {
+	for m := detected; m != nil; m = m.Parent() {
+		for _, allowed := range p.Extensions[ext] {
+			if m.Is(allowed) {
+				return allowed
+			}
+		}
+	}
+	return ""
+}
+
+var (
+	uploadImageTypes = map[string][]string{
+		".png":  {"image/png"},
+		".jpg":  {"image/jpeg"},
+		".jpeg": {"image/jpeg"},
+		".gif":  {"image/gif"},
+		".webp": {"image/webp"},
+	}
+	uploadAudioTypes = map[string][]string{
+		".mp3":  {"audio/mpeg"},
+		".wav":  {"audio/wav"},
+		".ogg":  {"audio/ogg", "application/ogg"},
+		".oga":  {"audio/ogg"},
+		".opus": {"audio/ogg"},
+		".m4a":  {"audio/x-m4a", "audio/mp4"},
+		".aac":  {"audio/aac"},
+		".flac": {"audio/flac"},
+		".webm": {"audio/webm"},
+	}
+	uploadDocumentTypes = map[string][]string{
+		".pdf":  {"application/pdf"},
+		".txt":  {"text/plain"},
+		".csv":  {"text/csv", "text/plain"},
+		".rtf":  {"text/rtf"},
+		".doc":  {"application/msword"},
+		".docx": {"application/vnd.openxmlformats-officedocument.wordprocessingml.document"},
+		".xls":  {"application/vnd.ms-excel"},
+		".xlsx": {"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet"},
+		".ppt":  {"application/vnd.ms-powerpoint"},
+		".pptx": {"application/vnd.openxmlformats-officedocument.presentationml.presentation"},
+		".odt":  {"application/vnd.oasis.opendocument.text"},
+		".ods":  {"application/vnd.oasis.opendocument.spreadsheet"},
+		".zip":  {"application/zip"},
+	}
+)
+
+func mergeUploadTypes(sets ...map[string][]string) map[string][]string {
+	merged := map[string][]string{}
+	for _, set := range sets {
+		for ext, types := range set {
+			merged[ext] = types
+		}
+	}
+	return merged
+}
+
+var (
+	// UploadPolicyAttachment – вложения сделок: документы, изображения, архивы, записи звонков
+	UploadPolicyAttachment = &UploadPolicy{Extensions: mergeUploadTypes(uploadDocumentTypes, uploadImageTypes, uploadAudioTypes)}
+	// UploadPolicyAudio – аудио для транскрибации
+	UploadPolicyAudio = &UploadPolicy{Extensions: uploadAudioTypes}
+	// UploadPolicyKnowledge – документы базы знаний
+	UploadPolicyKnowledge = &UploadPolicy{Extensions: map[string][]string{
+		".txt": uploadDocumentTypes[".txt"],
+		".pdf": uploadDocumentTypes[".pdf"],
+	}}
+	// UploadPolicyImport – таблицы для импорта клиентов и сделок CRM
+	UploadPolicyImport = &UploadPolicy{Extensions: map[string][]string{
+		".csv":  uploadDocumentTypes[".csv"],
+		".xlsx": uploadDocumentTypes[".xlsx"],
+	}}
+)
+
+// FileService – загрузка, выдача и очистка файлов поверх FileStore
+type FileService struct {
+	store     FileStore
+	urlSecret []byte
+}
+
+func NewFileService(cfg *config.Config, store FileStore) *FileService {
+	return &FileService{store: store, urlSecret: []byte(cfg.FileURLSecret)}
+}
+
+// Open открывает объект хранилища
+func (s *FileService) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	return s.store.Open(ctx, key)
+}
+
+// ReadAll читает объект целиком (для обработки аудио и документов)
+func (s *FileService) ReadAll(ctx context.Context, key string) ([]byte, error) {
+	rc, err := s.store.Open(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return io.ReadAll(rc)
+}
+
+// Ingest сохраняет загруженный файл: не больше limit байт, расширение и содержимое – из policy.
+// Возвращает запись о содержимом; если такой файл уже есть, повторно он не записывается.
+func (s *FileService) Ingest(ctx context.Context, r io.Reader, fileName string, limit int64, policy *UploadPolicy) (*models.FileBlob, error) {
+	ext := strings.ToLower(filepath.Ext(fileName))
+	if _, ok := policy.Extensions[ext]; !ok {
+		return nil, fmt.Errorf("%w: allowed extensions: %s", ErrFileTypeNotAllowed, strings.Join(policy.AllowedExtensions(), ", "))
+	}
+
+	tmp, err := os.CreateTemp("", "upload-*")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	n, err := io.Copy(io.MultiWriter(tmp, h), io.LimitReader(r, limit+1))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) || n > limit {
+		return nil, fmt.Errorf("%w: limit is %d MB", ErrFileTooLarge, limit>>20)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if n == 0 {
+		return nil, ErrFileEmpty
+	}
+
+	head := make([]byte, fileSniffLen)
+	m, err := tmp.ReadAt(head, 0)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	detected := mimetype.Detect(head[:m])
+	mimeType := policy.match(ext, detected)
+	if mimeType == "" {
+		return nil, fmt.Errorf("%w: content is %s, not %s", ErrFileTypeNotAllowed, detected.String(), ext)
+	}
+
+	sum := hex.EncodeToString(h.Sum(nil))
+	blob, err := models.TouchFileBlob(ctx, sum)
+	if errors.Is(err, models.ErrFileBlobNotFound) {
+		blob = &models.FileBlob{SHA256: sum, StorageKey: "blobs/" + sum[:2] + "/" + sum, Size: n, MimeType: mimeType}
+		if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err := s.store.Put(ctx, blob.StorageKey, tmp, n, mimeType); err != nil {
+			return nil, err
+		}
+		err = models.SaveFileBlob(ctx, blob)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if blob.ThumbnailKey == nil && strings.HasPrefix(blob.MimeType, "image/") {
+		if key, err := s.storeThumbnail(ctx, tmp, sum); err != nil {
+			log.Printf("⚠️ Не удалось построить миниатюру %s: %v", sum, err)
+		} else {
+			blob.ThumbnailKey = &key
+		}
+	}
+	return blob, nil
+}
+
+// storeThumbnail уменьшает изображение до thumbnailSize по большей стороне и сохраняет JPEG
+func (s *FileService) storeThumbnail(ctx context.Context, f *os.File, sum string) (string, error) {
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return "", err
+	}
+	if cfg.Width*cfg.Height > thumbnailMaxPixels {
+		return "", fmt.Errorf("image too large: %dx%d", cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return "", err
+	}
+
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w > thumbnailSize || h > thumbnailSize {
+		if w >= h {
+			w, h = thumbnailSize, max(1, h*thumbnailSize/b.Dx())
+		} else {
+			w, h = max(1, w*thumbnailSize/b.Dy()), thumbnailSize
+		}
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, w, h))
+	// Прозрачные области PNG/GIF – на белом фоне, в JPEG альфа-канала нет
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.CatmullRom.Scale(dst, dst.Bounds(), src, b, draw.Over, nil)
+
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: 80}); err != nil {
+		return "", err
+	}
+	key := "thumbs/" + sum[:2] + "/" + sum + ".jpg"
+	if err := s.store.Put(ctx, key, &buf, int64(buf.Len()), "image/jpeg"); err != nil {
+		return "", err
+	}
+	return key, models.SetFileBlobThumbnail(ctx, sum, key)
+}
+
+// ========== ВРЕМЕННЫЕ ССЫЛКИ ==========
+
+// FileToken – подписанная ссылка на объект, выданная приложением
+type FileToken struct {
+	Key         string `json:"k"`
+	FileName    string `json:"n,omitempty"`
+	ContentType string `json:"t,omitempty"`
+	Inline      bool   `json:"i,omitempty"`
+	ExpiresAt   int64  `json:"e"`
+}
+
+// Options – заголовки ответа для объекта ссылки
+func (t *FileToken) Options() DownloadOptions {
+	return DownloadOptions{FileName: t.FileName, ContentType: t.ContentType, Inline: t.Inline}
+}
+
+// SignedURL – временная ссылка на скачивание. Если хранилище умеет подписывать ссылки (S3), клиент
+// качает напрямую из него; иначе ссылка ведёт на baseURL/api/public/files/<токен>.
+func (s *FileService) SignedURL(ctx context.Context, baseURL, key string, opts DownloadOptions, ttl time.Duration) (string, time.Time, error) {
+	expiresAt := time.Now().Add(ttl)
+	u, err := s.store.PresignGet(ctx, key, opts, ttl)
+	if err == nil {
+		return u, expiresAt, nil
+	}
+	if !errors.Is(err, ErrPresignNotSupported) {
+		return "", time.Time{}, err
+	}
+	payload, err := json.Marshal(FileToken{Key: key, FileName: opts.FileName, ContentType: opts.ContentType, Inline: opts.Inline, ExpiresAt: expiresAt.Unix()})
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	token := base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(s.tokenMAC(payload))
+	return baseURL + "/api/public/files/" + token, expiresAt, nil
+}
+
+// ParseFileToken проверяет подпись и срок действия токена ссылки
+func (s *FileService) ParseFileToken(token string) (*FileToken, error) {
+	encPayload, encMAC, ok := strings.Cut(token, ".")
+	if !ok {
+		return nil, ErrInvalidFileToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(encPayload)
+	if err != nil {
+		return nil, ErrInvalidFileToken
+	}
+	mac, err := base64.RawURLEncoding.DecodeString(encMAC)
+	if err != nil || !hmac.Equal(mac, s.tokenMAC(payload)) {
+		return nil, ErrInvalidFileToken
+	}
+	var t FileToken
+	if err := json.Unmarshal(payload, &t); err != nil || time.Now().Unix() > t.ExpiresAt {
+		return nil, ErrInvalidFileToken
+	}
+	return &t, nil
+}
+
+func (s *FileService) tokenMAC(payload []byte) []byte {
+	mac := hmac.New(sha256.New, s.urlSecret)
+	mac.Write([]byte("file-url:"))
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// ========== ОЧИСТКА ==========
+
+// Start запускает ежечасное удаление содержимого без ссылок
+func (s *FileService) Start() {
+	log.Println("🗄️ Файловое хранилище: очистка неиспользуемых файлов запущена")
+	go func() {
+		ticker := time.NewTicker(fileCleanupInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.Cleanup(context.Background())
+		}
+	}()
+}
+
+// Cleanup удаляет из хранилища содержимое, на которое никто не ссылается дольше fileCleanupGrace
+func (s *FileService) Cleanup(ctx context.Context) {
+	before := time.Now().Add(-fileCleanupGrace)
+	hashes, err := models.OrphanFileBlobs(ctx, before, fileCleanupBatch)
+	if err != nil {
+		log.Printf("❌ Ошибка выборки неиспользуемых файлов: %v", err)
+		return
+	}
+	removed := 0
+	for _, sum := range hashes {
+		ok, err := models.DeleteOrphanFileBlob(ctx, sum, before, func(b *models.FileBlob) error {
+			if b.ThumbnailKey != nil {
+				if err := s.store.Delete(ctx, *b.ThumbnailKey); err != nil {
+					return err
+				}
+			}
+			return s.store.Delete(ctx, b.StorageKey)
+		})
+		if err != nil {
+			log.Printf("⚠️ Не удалось удалить файл %s: %v", sum, err)
+			continue
+		}
+		if ok {
+			removed++
+		}
+	}
+	if removed > 0 {
+		log.Printf("🗄️ Файловое хранилище: удалено неиспользуемых файлов – %d", removed)
+	}
+}
@@ -0,0 +1,166 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"subscription-system/config"
+)
+
+// Файловое хранилище: вложения сделок, аудио для транскрибации и документы базы знаний.
+// Бэкенд выбирается FILE_STORAGE: local – каталог на диске (один инстанс или общий том),
+// s3 – S3-совместимое хранилище (AWS, Yandex Object Storage, MinIO).
+
+var (
+	ErrStoredFileNotFound  = errors.New("stored file not found")
+	ErrPresignNotSupported = errors.New("file store does not support presigned urls")
+)
+
+// FileStore – бэкенд хранения объектов по ключу
+type FileStore interface {
+	// Put записывает объект; size – точный размер содержимого
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error
+	// Open открывает объект на чтение; ErrStoredFileNotFound – объекта нет
+	Open(ctx context.Context, key string) (io.ReadCloser, error)
+	// Delete удаляет объект; отсутствие объекта ошибкой не считается
+	Delete(ctx context.Context, key string) error
+	// PresignGet – временная ссылка на скачивание напрямую из хранилища;
+	// ErrPresignNotSupported – ссылку выдаёт приложение (см. FileService.SignedURL)
+	PresignGet(ctx context.Context, key string, opts DownloadOptions, ttl time.Duration) (string, error)
+}
+
+// DownloadOptions – заголовки, с которыми объект отдаётся клиенту
+type DownloadOptions struct {
+	FileName    string
+	ContentType string
+	Inline      bool
+}
+
+// ContentDisposition – значение Content-Disposition (имя файла в RFC 2231 для не-ASCII)
+func (o DownloadOptions) ContentDisposition() string {
+	disposition := "attachment"
+	if o.Inline {
+		disposition = "inline"
+	}
+	if o.FileName == "" {
+		return disposition
+	}
+	return mime.FormatMediaType(disposition, map[string]string{"filename": o.FileName})
+}
+
+// NewFileStore создаёт хранилище по конфигурации
+func NewFileStore(cfg *config.Config) (FileStore, error) {
+	switch strings.ToLower(cfg.FileStorage) {
+	case "", "local":
+		return NewLocalFileStore(cfg.FileStoragePath)
+	case "s3":
+		return NewS3FileStore(S3Config{
+			Endpoint:  cfg.S3Endpoint,
+			Region:    cfg.S3Region,
+			Bucket:    cfg.S3Bucket,
+			AccessKey: cfg.S3AccessKey,
+			SecretKey: cfg.S3SecretKey,
+			PathStyle: cfg.S3PathStyle,
+		})
+	default:
+		return nil, fmt.Errorf("unknown FILE_STORAGE %q (expected local or s3)", cfg.FileStorage)
+	}
+}
+
+// validStorageKey – ключ из сегментов без «.» и «..», через «/»
+func validStorageKey(key string) bool {
+	if key == "" || strings.HasPrefix(key, "/") || path.Clean(key) != key {
+		return false
+	}
+	for _, seg := range strings.Split(key, "/") {
+		if seg == "." || seg == ".." {
+			return false
+		}
+	}
+	return true
+}
+
+// ========== ЛОКАЛЬНЫЙ ДИСК ==========
+
+// LocalFileStore хранит объекты в каталоге; запись атомарна (временный файл + rename)
+type LocalFileStore struct {
+	root string
+}
+
+func NewLocalFileStore(root string) (*LocalFileStore, error) {
+	if root == "" {
+		return nil, errors.New("FILE_STORAGE_PATH is required for local file storage")
+	}
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &LocalFileStore{root: root}, nil
+}
+
+func (s *LocalFileStore) path(key string) (string, error) {
+	if !validStorageKey(key) {
+		return "", fmt.Errorf("invalid storage key %q", key)
+	}
+	return filepath.Join(s.root, filepath.FromSlash(key)), nil
+}
+
+func (s *LocalFileStore) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".upload-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	n, err := io.Copy(tmp, r)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if size >= 0 && n != size {
+		return fmt.Errorf("short write: %d of %d bytes", n, size)
+	}
+	return os.Rename(tmp.Name(), p)
+}
+
+func (s *LocalFileStore) Open(ctx context.Context, key string) (io.ReadCloser, error) {
+	p, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.Open(p)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrStoredFileNotFound
+	}
+	return f, err
+}
+
+func (s *LocalFileStore) Delete(ctx context.Context, key string) error {
+	p, err := s.path(key)
+	if err != nil {
+		return err
+	}
+	if err := os.Remove(p); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (s *LocalFileStore) PresignGet(ctx context.Context, key string, opts DownloadOptions, ttl time.Duration) (string, error) {
+	return "", ErrPresignNotSupported
+}
@@ -0,0 +1,65 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"subscription-system/models"
+)
+
+const (
+	leadScoringInterval = time.Hour
+	// leadScoringMaxAge – оценка старше пересчитывается, чтобы затухание и окна активности были актуальны
+	leadScoringMaxAge = 24 * time.Hour
+	leadScoringBatch  = 500
+)
+
+// LeadScoringService периодически пересчитывает устаревшие оценки лидов.
+// Изменения клиента и его сделок пересчитывают оценку сразу; фоновый проход нужен,
+// чтобы баллы «остывали» у клиентов, с которыми давно ничего не происходило.
+type LeadScoringService struct{}
+
+func NewLeadScoringService() *LeadScoringService {
+	return &LeadScoringService{}
+}
+
+// Start запускает пересчёт раз в час
+func (s *LeadScoringService) Start() {
+	log.Println("🎯 Лид-скоринг: фоновый пересчёт запущен")
+	go func() {
+		ticker := time.NewTicker(leadScoringInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.RecalculateStale(context.Background())
+		}
+	}()
+}
+
+// RecalculateStale пересчитывает оценки без расчёта или старше суток, пока такие есть
+func (s *LeadScoringService) RecalculateStale(ctx context.Context) {
+	total := 0
+	for {
+		ids, err := models.StaleLeadScoreCustomers(ctx, leadScoringMaxAge, leadScoringBatch)
+		if err != nil {
+			log.Printf("❌ Ошибка выборки клиентов для пересчёта скоринга: %v", err)
+			return
+		}
+		failed := 0
+		for _, id := range ids {
+			if _, err := models.RecalculateLeadScore(ctx, id); err != nil {
+				log.Printf("⚠️ Не удалось пересчитать скоринг клиента %s: %v", id, err)
+				failed++
+				continue
+			}
+			total++
+		}
+		// Если весь пакет упал с ошибками, следующая выборка вернёт те же записи – выходим до следующего тика
+		if len(ids) < leadScoringBatch || failed == len(ids) {
+			break
+		}
+	}
+	if total > 0 {
+		log.Printf("🎯 Лид-скоринг: пересчитано оценок – %d", total)
+	}
+}
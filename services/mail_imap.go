@@ -0,0 +1,237 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"subscription-system/models"
+)
+
+// Минимальный IMAP4rev1-клиент (RFC 3501) для синхронизации входящих: LOGIN, SELECT,
+// UID SEARCH и UID FETCH BODY.PEEK[] – письма читаются без отметки «прочитано».
+
+const (
+	mailDialTimeout = 10 * time.Second
+	// mailIOTimeout – предельное время одной команды вместе с ответом сервера
+	mailIOTimeout = 2 * time.Minute
+	// mailMaxMessageSize – письма больше этого размера пропускаются целиком
+	mailMaxMessageSize = 25 << 20
+)
+
+// ErrMailPrivateAddress – почтовый сервер находится во внутренней сети
+var ErrMailPrivateAddress = errors.New("mail server address resolves to a private network")
+
+var imapLiteralRe = regexp.MustCompile(`\{(\d+)\}$`)
+
+// dialMail открывает соединение с почтовым сервером; security=tls – TLS сразу при подключении
+func dialMail(ctx context.Context, host string, port int, security string, allowPrivate bool) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: mailDialTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			h, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(h); ip == nil || isPrivateIP(ip) {
+				return ErrMailPrivateAddress
+			}
+			return nil
+		}
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(port))
+	if security == models.MailSecurityTLS {
+		td := &tls.Dialer{NetDialer: dialer, Config: &tls.Config{ServerName: host}}
+		return td.DialContext(ctx, "tcp", address)
+	}
+	return dialer.DialContext(ctx, "tcp", address)
+}
+
+// imapResponse – строка ответа; содержимое литералов {n} вынесено в literals
+type imapResponse struct {
+	text     string
+	literals [][]byte
+}
+
+type imapClient struct {
+	conn net.Conn
+	r    *bufio.Reader
+	tag  int
+}
+
+// imapConnect подключается, при необходимости включает STARTTLS и входит в ящик
+func imapConnect(ctx context.Context, mb *models.Mailbox, allowPrivate bool) (*imapClient, error) {
+	conn, err := dialMail(ctx, mb.IMAPHost, mb.IMAPPort, mb.IMAPSecurity, allowPrivate)
+	if err != nil {
+		return nil, err
+	}
+	c := &imapClient{conn: conn, r: bufio.NewReader(conn)}
+	c.conn.SetDeadline(time.Now().Add(mailIOTimeout))
+	greeting, err := c.readResponse()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if !strings.HasPrefix(strings.ToUpper(greeting.text), "* OK") && !strings.HasPrefix(strings.ToUpper(greeting.text), "* PREAUTH") {
+		conn.Close()
+		return nil, fmt.Errorf("imap: unexpected greeting %q", greeting.text)
+	}
+	if mb.IMAPSecurity == models.MailSecurityStartTLS {
+		if _, err := c.command("STARTTLS"); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: mb.IMAPHost})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		c.conn = tlsConn
+		c.r = bufio.NewReader(tlsConn)
+	}
+	if strings.ContainsAny(string(mb.IMAPPassword), "\r\n") {
+		c.Close()
+		return nil, errors.New("imap: password contains line breaks")
+	}
+	if _, err := c.command("LOGIN " + imapQuote(mb.IMAPUsername) + " " + imapQuote(string(mb.IMAPPassword))); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// imapQuote – строка IMAP в кавычках
+func imapQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(s) + `"`
+}
+
+// readResponse читает одну строку ответа вместе с литералами
+func (c *imapClient) readResponse() (*imapResponse, error) {
+	resp := &imapResponse{}
+	var text strings.Builder
+	for {
+		line, err := c.r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+		m := imapLiteralRe.FindStringSubmatch(line)
+		if m == nil {
+			text.WriteString(line)
+			resp.text = text.String()
+			return resp, nil
+		}
+		text.WriteString(line[:len(line)-len(m[0])])
+		n, err := strconv.ParseInt(m[1], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("imap: bad literal %q", m[0])
+		}
+		if n > mailMaxMessageSize {
+			// Слишком большое письмо: вычитываем и отбрасываем, чтобы не сбить протокол
+			if _, err := io.CopyN(io.Discard, c.r, n); err != nil {
+				return nil, err
+			}
+			resp.literals = append(resp.literals, nil)
+		} else {
+			buf := make([]byte, n)
+			if _, err := io.ReadFull(c.r, buf); err != nil {
+				return nil, err
+			}
+			resp.literals = append(resp.literals, buf)
+		}
+		text.WriteString("{}")
+	}
+}
+
+// command отправляет команду и возвращает непомеченные ответы до завершающего ответа с тегом
+func (c *imapClient) command(cmd string) ([]*imapResponse, error) {
+	c.tag++
+	tag := "A" + strconv.Itoa(c.tag)
+	c.conn.SetDeadline(time.Now().Add(mailIOTimeout))
+	if _, err := io.WriteString(c.conn, tag+" "+cmd+"\r\n"); err != nil {
+		return nil, err
+	}
+	var untagged []*imapResponse
+	for {
+		resp, err := c.readResponse()
+		if err != nil {
+			return nil, err
+		}
+		if !strings.HasPrefix(resp.text, tag+" ") {
+			untagged = append(untagged, resp)
+			continue
+		}
+		status := strings.TrimPrefix(resp.text, tag+" ")
+		if !strings.HasPrefix(strings.ToUpper(status), "OK") {
+			verb, _, _ := strings.Cut(cmd, " ")
+			return untagged, fmt.Errorf("imap %s: %s", verb, status)
+		}
+		return untagged, nil
+	}
+}
+
+var imapUIDValidityRe = regexp.MustCompile(`(?i)\[UIDVALIDITY (\d+)\]`)
+
+// selectFolder открывает папку только для чтения и возвращает UIDVALIDITY
+func (c *imapClient) selectFolder(folder string) (int64, error) {
+	untagged, err := c.command("EXAMINE " + imapQuote(folder))
+	if err != nil {
+		return 0, err
+	}
+	for _, resp := range untagged {
+		if m := imapUIDValidityRe.FindStringSubmatch(resp.text); m != nil {
+			return strconv.ParseInt(m[1], 10, 64)
+		}
+	}
+	return 0, errors.New("imap: server did not report UIDVALIDITY")
+}
+
+// searchUIDs выполняет UID SEARCH и возвращает найденные UID
+func (c *imapClient) searchUIDs(criteria string) ([]int64, error) {
+	untagged, err := c.command("UID SEARCH " + criteria)
+	if err != nil {
+		return nil, err
+	}
+	var uids []int64
+	for _, resp := range untagged {
+		fields := strings.Fields(resp.text)
+		if len(fields) < 2 || !strings.EqualFold(fields[1], "SEARCH") {
+			continue
+		}
+		for _, f := range fields[2:] {
+			if uid, err := strconv.ParseInt(f, 10, 64); err == nil {
+				uids = append(uids, uid)
+			}
+		}
+	}
+	return uids, nil
+}
+
+// fetchMessage возвращает исходный текст письма; nil – письмо больше mailMaxMessageSize или уже удалено
+func (c *imapClient) fetchMessage(uid int64) ([]byte, error) {
+	untagged, err := c.command("UID FETCH " + strconv.FormatInt(uid, 10) + " (UID BODY.PEEK[])")
+	if err != nil {
+		return nil, err
+	}
+	for _, resp := range untagged {
+		if strings.Contains(strings.ToUpper(resp.text), "FETCH") && len(resp.literals) > 0 {
+			return resp.literals[0], nil
+		}
+	}
+	return nil, nil
+}
+
+// Close завершает сессию; ошибки LOGOUT не важны
+func (c *imapClient) Close() error {
+	c.command("LOGOUT")
+	return c.conn.Close()
+}
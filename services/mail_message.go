@@ -0,0 +1,410 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"regexp"
+	"strings"
+	"time"
+
+	"golang.org/x/text/encoding/htmlindex"
+
+	"subscription-system/models"
+)
+
+// Разбор входящих писем (MIME, кодировки заголовков и частей) и сборка исходящих:
+// multipart/alternative с текстовой и HTML-частью и заголовками цепочки.
+
+const (
+	mailMaxPartDepth = 10
+	// mailMaxBodySize – сколько текста одной части сохраняется в переписке
+	mailMaxBodySize = 1 << 20
+)
+
+var mailWordDecoder = &mime.WordDecoder{CharsetReader: mailCharsetReader}
+
+// mailCharsetReader перекодирует текст из кодировки письма (koi8-r, windows-1251, ...) в UTF-8
+func mailCharsetReader(charset string, input io.Reader) (io.Reader, error) {
+	charset = strings.ToLower(strings.Trim(charset, `"' `))
+	if charset == "" || charset == "utf-8" || charset == "us-ascii" || charset == "utf8" {
+		return input, nil
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return nil, fmt.Errorf("unsupported charset %q", charset)
+	}
+	return enc.NewDecoder().Reader(input), nil
+}
+
+// parsedMail – разобранное входящее письмо
+type parsedMail struct {
+	MessageID  string
+	InReplyTo  string
+	References []string
+	From       mail.Address
+	To         []string
+	Cc         []string
+	Subject    string
+	Date       time.Time
+	Text       string
+	HTML       string
+}
+
+// parseMail разбирает исходный текст письма (RFC 5322 + MIME); вложения пропускаются
+func parseMail(raw []byte) (*parsedMail, error) {
+	msg, err := mail.ReadMessage(bytes.NewReader(raw))
+	if err != nil {
+		return nil, err
+	}
+	h := msg.Header
+	p := &parsedMail{
+		MessageID:  firstMessageID(h.Get("Message-Id")),
+		InReplyTo:  firstMessageID(h.Get("In-Reply-To")),
+		References: messageIDs(h.Get("References")),
+		Subject:    decodeMailHeader(h.Get("Subject")),
+	}
+	addrParser := &mail.AddressParser{WordDecoder: mailWordDecoder}
+	if from, err := addrParser.Parse(h.Get("From")); err == nil {
+		p.From = mail.Address{Name: from.Name, Address: strings.ToLower(from.Address)}
+	}
+	p.To = parseAddressList(addrParser, h.Get("To"))
+	p.Cc = parseAddressList(addrParser, h.Get("Cc"))
+	if date, err := h.Date(); err == nil {
+		p.Date = date
+	}
+	if err := p.walkPart(textproto.MIMEHeader(h), msg.Body, 0); err != nil {
+		return nil, err
+	}
+	if p.Text == "" && p.HTML != "" {
+		p.Text = htmlToText(p.HTML)
+	}
+	return p, nil
+}
+
+func decodeMailHeader(v string) string {
+	if decoded, err := mailWordDecoder.DecodeHeader(v); err == nil {
+		return strings.TrimSpace(decoded)
+	}
+	return strings.TrimSpace(v)
+}
+
+func parseAddressList(parser *mail.AddressParser, v string) []string {
+	if strings.TrimSpace(v) == "" {
+		return []string{}
+	}
+	list, err := parser.ParseList(v)
+	if err != nil {
+		return []string{}
+	}
+	addrs := make([]string, 0, len(list))
+	for _, a := range list {
+		addrs = append(addrs, strings.ToLower(a.Address))
+	}
+	return addrs
+}
+
+var messageIDRe = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// messageIDs – идентификаторы писем из заголовка References/In-Reply-To без угловых скобок
+func messageIDs(v string) []string {
+	ids := []string{}
+	for _, m := range messageIDRe.FindAllStringSubmatch(v, -1) {
+		ids = append(ids, m[1])
+	}
+	return ids
+}
+
+func firstMessageID(v string) string {
+	if ids := messageIDs(v); len(ids) > 0 {
+		return ids[0]
+	}
+	return strings.Trim(strings.TrimSpace(v), "<>")
+}
+
+// walkPart обходит MIME-дерево и забирает первую текстовую и первую HTML-часть
+func (p *parsedMail) walkPart(h textproto.MIMEHeader, body io.Reader, depth int) error {
+	if depth > mailMaxPartDepth {
+		return nil
+	}
+	mediaType, params, err := mime.ParseMediaType(h.Get("Content-Type"))
+	if err != nil {
+		mediaType, params = "text/plain", map[string]string{}
+	}
+	if disposition, _, _ := mime.ParseMediaType(h.Get("Content-Disposition")); disposition == "attachment" {
+		return nil
+	}
+	if strings.HasPrefix(mediaType, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			// multipart.Reader уже снимает quoted-printable и удаляет заголовок
+			if err := p.walkPart(part.Header, part, depth+1); err != nil {
+				return err
+			}
+		}
+	}
+	if mediaType != "text/plain" && mediaType != "text/html" {
+		return nil
+	}
+	if (mediaType == "text/plain" && p.Text != "") || (mediaType == "text/html" && p.HTML != "") {
+		return nil
+	}
+	switch strings.ToLower(strings.TrimSpace(h.Get("Content-Transfer-Encoding"))) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	decoded, err := mailCharsetReader(params["charset"], body)
+	if err != nil {
+		decoded = body
+	}
+	text, err := io.ReadAll(io.LimitReader(decoded, mailMaxBodySize))
+	if err != nil {
+		return err
+	}
+	if mediaType == "text/plain" {
+		p.Text = strings.TrimSpace(strings.ReplaceAll(string(text), "\r\n", "\n"))
+	} else {
+		p.HTML = string(text)
+	}
+	return nil
+}
+
+var (
+	htmlDropRe  = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+	htmlBreakRe = regexp.MustCompile(`(?i)<br\s*/?>|</p>|</div>|</li>|</tr>|</h[1-6]>`)
+	htmlTagRe   = regexp.MustCompile(`<[^>]*>`)
+	blankRunRe  = regexp.MustCompile(`\n{3,}`)
+)
+
+// htmlToText – грубый текстовый вариант HTML-письма для активностей и text/plain-части
+func htmlToText(s string) string {
+	s = htmlDropRe.ReplaceAllString(s, "")
+	s = htmlBreakRe.ReplaceAllString(s, "\n")
+	s = html.UnescapeString(htmlTagRe.ReplaceAllString(s, ""))
+	lines := strings.Split(strings.ReplaceAll(s, "\r\n", "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = strings.Join(strings.Fields(line), " ")
+	}
+	return strings.TrimSpace(blankRunRe.ReplaceAllString(strings.Join(lines, "\n"), "\n\n"))
+}
+
+// outgoingMail – письмо, отправляемое из CRM или рассылкой отчётов
+type outgoingMail struct {
+	From       mail.Address
+	To         []mail.Address
+	Subject    string
+	HTML       string
+	MessageID  string
+	InReplyTo  string
+	References []string
+	Date       time.Time
+	// Unsubscribe – ссылка отписки в заголовках List-Unsubscribe (отписка в один клик, RFC 8058)
+	Unsubscribe string
+	Attachments []mailAttachment
+}
+
+// mailAttachment – вложение исходящего письма
+type mailAttachment struct {
+	Name        string
+	ContentType string
+	Data        []byte
+}
+
+// mailBase64LineLen – длина строки base64 во вложениях (RFC 2045)
+const mailBase64LineLen = 76
+
+// build собирает письмо: multipart/alternative, обе части в quoted-printable;
+// с вложениями – multipart/mixed, где первая часть – тот же multipart/alternative
+func (m *outgoingMail) build() ([]byte, error) {
+	var buf bytes.Buffer
+	to := make([]string, 0, len(m.To))
+	for _, a := range m.To {
+		to = append(to, a.String())
+	}
+	header := func(k, v string) {
+		buf.WriteString(k + ": " + v + "\r\n")
+	}
+	header("From", m.From.String())
+	header("To", strings.Join(to, ", "))
+	header("Subject", mime.QEncoding.Encode("utf-8", m.Subject))
+	header("Date", m.Date.Format(time.RFC1123Z))
+	header("Message-ID", "<"+m.MessageID+">")
+	if m.InReplyTo != "" {
+		header("In-Reply-To", "<"+m.InReplyTo+">")
+	}
+	if len(m.References) > 0 {
+		header("References", "<"+strings.Join(m.References, "> <")+">")
+	}
+	if m.Unsubscribe != "" {
+		header("List-Unsubscribe", "<"+m.Unsubscribe+">")
+		header("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+	}
+	header("MIME-Version", "1.0")
+
+	var alternative bytes.Buffer
+	boundary, err := m.writeAlternative(&alternative)
+	if err != nil {
+		return nil, err
+	}
+	if len(m.Attachments) == 0 {
+		header("Content-Type", `multipart/alternative; boundary="`+boundary+`"`)
+		buf.WriteString("\r\n")
+		buf.Write(alternative.Bytes())
+		return buf.Bytes(), nil
+	}
+
+	mw := multipart.NewWriter(&buf)
+	header("Content-Type", `multipart/mixed; boundary="`+mw.Boundary()+`"`)
+	buf.WriteString("\r\n")
+	w, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {`multipart/alternative; boundary="` + boundary + `"`},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(alternative.Bytes()); err != nil {
+		return nil, err
+	}
+	for _, a := range m.Attachments {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {mime.FormatMediaType(a.ContentType, map[string]string{"name": a.Name})},
+			"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": a.Name})},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(a.Data)
+		for len(encoded) > 0 {
+			n := min(mailBase64LineLen, len(encoded))
+			if _, err := io.WriteString(w, encoded[:n]+"\r\n"); err != nil {
+				return nil, err
+			}
+			encoded = encoded[n:]
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// writeAlternative пишет текстовую и HTML-часть и возвращает границу multipart/alternative
+func (m *outgoingMail) writeAlternative(buf *bytes.Buffer) (string, error) {
+	mw := multipart.NewWriter(buf)
+	for _, part := range []struct{ contentType, body string }{
+		{"text/plain; charset=utf-8", htmlToText(m.HTML)},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		w, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return "", err
+		}
+		qp := quotedprintable.NewWriter(w)
+		if _, err := qp.Write([]byte(part.body)); err != nil {
+			return "", err
+		}
+		if err := qp.Close(); err != nil {
+			return "", err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return "", err
+	}
+	return mw.Boundary(), nil
+}
+
+// mailPlainAuth – AUTH PLAIN без проверки TLS: режим security=none выбирается явно
+// (локальный тестовый сервер), в остальных режимах соединение уже зашифровано
+type mailPlainAuth struct {
+	username, password string
+}
+
+func (a mailPlainAuth) Start(_ *smtp.ServerInfo) (string, []byte, error) {
+	return "PLAIN", []byte("\x00" + a.username + "\x00" + a.password), nil
+}
+
+func (a mailPlainAuth) Next(_ []byte, more bool) ([]byte, error) {
+	if more {
+		return nil, errors.New("smtp: unexpected server challenge")
+	}
+	return nil, nil
+}
+
+// smtpConnect подключается к SMTP ящика и входит, если сервер требует авторизацию
+func smtpConnect(ctx context.Context, mb *models.Mailbox, allowPrivate bool) (*smtp.Client, error) {
+	conn, err := dialMail(ctx, mb.SMTPHost, mb.SMTPPort, mb.SMTPSecurity, allowPrivate)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(mailIOTimeout))
+	c, err := smtp.NewClient(conn, mb.SMTPHost)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if mb.SMTPSecurity == models.MailSecurityStartTLS {
+		if err := c.StartTLS(&tls.Config{ServerName: mb.SMTPHost}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if ok, _ := c.Extension("AUTH"); ok && len(mb.SMTPPassword) > 0 {
+		if err := c.Auth(mailPlainAuth{username: mb.SMTPUsername, password: string(mb.SMTPPassword)}); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// sendSMTP отправляет письмо через SMTP ящика
+func sendSMTP(ctx context.Context, mb *models.Mailbox, recipients []string, msg []byte, allowPrivate bool) error {
+	c, err := smtpConnect(ctx, mb, allowPrivate)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Mail(mb.Email); err != nil {
+		return err
+	}
+	for _, rcpt := range recipients {
+		if err := c.Rcpt(rcpt); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -2,14 +2,20 @@ package services
 
 import (
     "bytes"
+    "context"
     "encoding/json"
     "fmt"
     "log"
     "net/http"
     "net/smtp"
     "subscription-system/config"
+    "subscription-system/tracing"
+    "time"
 )
 
+// telegramClient – клиент Bot API с трейсингом (токен из URL в спаны не попадает)
+var telegramClient = tracing.NewHTTPClient("telegram", 10*time.Second)
+
 type NotificationService struct {
     cfg *config.Config
 }
@@ -19,21 +25,36 @@ func NewNotificationService(cfg *config.Config) *NotificationService {
 }
 
 // SendTelegram отправляет сообщение в Telegram через бота
-func (ns *NotificationService) SendTelegram(message string) error {
+func (ns *NotificationService) SendTelegram(ctx context.Context, message string) error {
     if ns.cfg.TelegramBotToken == "" || ns.cfg.TelegramChatID == "" {
         log.Println("Telegram не настроен, пропускаем уведомление")
         return nil
     }
+    return ns.SendTelegramTo(ctx, ns.cfg.TelegramChatID, message)
+}
+
+// SendTelegramTo отправляет сообщение в указанный чат (например, личный чат пользователя с ботом).
+// ctx ограничивает запрос и связывает его спан с трейсом вызывающего
+func (ns *NotificationService) SendTelegramTo(ctx context.Context, chatID interface{}, message string) error {
+    if ns.cfg.TelegramBotToken == "" {
+        log.Println("Telegram не настроен, пропускаем уведомление")
+        return nil
+    }
 
     url := fmt.Sprintf("https://api.telegram.org/bot%s/sendMessage", ns.cfg.TelegramBotToken)
     payload := map[string]interface{}{
-        "chat_id":    ns.cfg.TelegramChatID,
+        "chat_id":    chatID,
         "text":       message,
         "parse_mode": "HTML",
     }
     jsonData, _ := json.Marshal(payload)
 
-    resp, err := http.Post(url, "application/json", bytes.NewBuffer(jsonData))
+    req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewBuffer(jsonData))
+    if err != nil {
+        return err
+    }
+    req.Header.Set("Content-Type", "application/json")
+    resp, err := telegramClient.Do(req)
     if err != nil {
         return fmt.Errorf("ошибка отправки в Telegram: %w", err)
     }
@@ -69,34 +90,57 @@ func (ns *NotificationService) SendEmail(to, subject, body string) error {
     return nil
 }
 
+// EmailConfigured – заданы ли SMTP-сервер и адрес отправителя для писем сервиса
+func (ns *NotificationService) EmailConfigured() bool {
+    return ns.cfg.SMTPHost != "" && ns.cfg.SMTPUser != "" && ns.cfg.EmailFrom != ""
+}
+
+// TelegramConfigured – задан ли токен бота
+func (ns *NotificationService) TelegramConfigured() bool {
+    return ns.cfg.TelegramBotToken != ""
+}
+
+// SendRawEmail отправляет готовое письмо (заголовки и MIME-тело) через SMTP сервиса
+func (ns *NotificationService) SendRawEmail(to string, msg []byte) error {
+    if !ns.EmailConfigured() {
+        return fmt.Errorf("SMTP не настроен")
+    }
+    auth := smtp.PlainAuth("", ns.cfg.SMTPUser, ns.cfg.SMTPPassword, ns.cfg.SMTPHost)
+    addr := fmt.Sprintf("%s:%d", ns.cfg.SMTPHost, ns.cfg.SMTPPort)
+    if err := smtp.SendMail(addr, auth, ns.cfg.EmailFrom, []string{to}, msg); err != nil {
+        return fmt.Errorf("ошибка отправки email: %w", err)
+    }
+    return nil
+}
+
 // NotifyCustomerCreated уведомление о создании клиента
-func (ns *NotificationService) NotifyCustomerCreated(name, email, phone, company, responsible string) {
+func (ns *NotificationService) NotifyCustomerCreated(ctx context.Context, name, email, phone, company, responsible string) {
     msg := fmt.Sprintf("🆕 Новый клиент создан:\n<b>Имя:</b> %s\n<b>Email:</b> %s\n<b>Телефон:</b> %s\n<b>Компания:</b> %s\n<b>Ответственный:</b> %s",
         name, email, phone, company, responsible)
-    ns.SendTelegram(msg)
+    ns.SendTelegram(ctx, msg)
 
     // Можно также отправить email, если нужен
     // ns.SendEmail("manager@example.com", "Новый клиент в CRM", msg)
 }
 
 // NotifyCustomerUpdated уведомление об изменении клиента
-func (ns *NotificationService) NotifyCustomerUpdated(id, name, email, phone string) {
+func (ns *NotificationService) NotifyCustomerUpdated(ctx context.Context, id, name, email, phone string) {
     msg := fmt.Sprintf("✏️ Клиент обновлён:\n<b>ID:</b> %s\n<b>Имя:</b> %s\n<b>Email:</b> %s\n<b>Телефон:</b> %s",
         id, name, email, phone)
-    ns.SendTelegram(msg)
+    ns.SendTelegram(ctx, msg)
 }
 
 // NotifyDealCreated уведомление о создании сделки
-func (ns *NotificationService) NotifyDealCreated(title string, value float64, stage, responsible, customerID string) {
+func (ns *NotificationService) NotifyDealCreated(ctx context.Context, title string, value float64, stage, responsible, customerID string) {
     msg := fmt.Sprintf("💰 Новая сделка:\n<b>Название:</b> %s\n<b>Сумма:</b> %.2f\n<b>Стадия:</b> %s\n<b>Ответственный:</b> %s\n<b>Клиент ID:</b> %s",
         title, value, stage, responsible, customerID)
-    ns.SendTelegram(msg)
+    ns.SendTelegram(ctx, msg)
 }
 
 // NotifyDealUpdated уведомление об изменении сделки
-func (ns *NotificationService) NotifyDealUpdated(id, title string, value float64, stage string) {
+func (ns *NotificationService) NotifyDealUpdated(ctx context.Context, id, title string, value float64, stage string) {
     msg := fmt.Sprintf("🔄 Сделка обновлена:\n<b>ID:</b> %s\n<b>Название:</b> %s\n<b>Сумма:</b> %.2f\n<b>Стадия:</b> %s",
         id, title, value, stage)
-    ns.SendTelegram(msg)
+    ns.SendTelegram(ctx, msg)
 }
 
@@ -9,6 +9,8 @@ import (
 	"time"
 
 	"subscription-system/config"
+	"subscription-system/monitoring"
+	"subscription-system/tracing"
 )
 
 // OpenRouterService - сервис для работы с OpenRouter API
@@ -23,9 +25,7 @@ func NewOpenRouterService(cfg *config.Config) *OpenRouterService {
 	return &OpenRouterService{
 		APIKey:  cfg.OpenRouterAPIKey,
 		BaseURL: "https://openrouter.ai/api/v1",
-		HTTPClient: &http.Client{
-			Timeout: 60 * time.Second,
-		},
+		HTTPClient: tracing.NewHTTPClient("openrouter", 60*time.Second),
 	}
 }
 
@@ -70,6 +70,7 @@ func (s *OpenRouterService) Ask(prompt string, model string, temperature float64
 
 	resp, err := s.HTTPClient.Do(req)
 	if err != nil {
+		monitoring.AIRequestErrorsTotal.WithLabelValues("openrouter", "transport").Inc()
 		return "", fmt.Errorf("ошибка выполнения запроса: %v", err)
 	}
 	defer resp.Body.Close()
@@ -80,21 +81,33 @@ func (s *OpenRouterService) Ask(prompt string, model string, temperature float64
 	}
 
 	if resp.StatusCode != http.StatusOK {
+		monitoring.AIRequestErrorsTotal.WithLabelValues("openrouter", "status").Inc()
 		return "", fmt.Errorf("OpenRouter API вернул ошибку %d: %s", resp.StatusCode, string(body))
 	}
 
 	var response struct {
+		Model   string `json:"model"`
 		Choices []struct {
 			Message struct {
 				Content string `json:"content"`
 			} `json:"message"`
 		} `json:"choices"`
+		Usage struct {
+			TotalTokens int `json:"total_tokens"`
+		} `json:"usage"`
 	}
 
 	if err := json.Unmarshal(body, &response); err != nil {
+		monitoring.AIRequestErrorsTotal.WithLabelValues("openrouter", "parse").Inc()
 		return "", fmt.Errorf("ошибка парсинга ответа: %v", err)
 	}
 
+	// openrouter/auto выбирает модель сам – в метрику пишем фактическую
+	if response.Model != "" {
+		model = response.Model
+	}
+	monitoring.AITokensTotal.WithLabelValues("openrouter", model).Add(float64(response.Usage.TotalTokens))
+
 	if len(response.Choices) == 0 {
 		return "", fmt.Errorf("пустой ответ от OpenRouter")
 	}
@@ -0,0 +1,118 @@
+package services
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const (
+	productEventsFlushInterval = 2 * time.Second
+	productEventsFlushSize     = 500
+	productEventsQueueSize     = 10000
+	productEventsMaintenance   = 24 * time.Hour
+	// productEventsMonthsAhead – партиции создаются с прошлого месяца на столько месяцев вперёд
+	productEventsMonthsAhead = 3
+)
+
+// ProductEventService пишет серверные события продукта пакетами в фоне и ведёт помесячные
+// партиции журнала: создаёт будущие и удаляет вышедшие за срок хранения.
+type ProductEventService struct {
+	retentionMonths int
+	queue           chan *models.ProductEvent
+}
+
+// productEvents – сервис, через который пишет TrackProductEvent; nil до запуска
+var productEvents *ProductEventService
+
+func NewProductEventService(cfg *config.Config) *ProductEventService {
+	return &ProductEventService{
+		retentionMonths: cfg.ProductEventsRetentionMonths,
+		queue:           make(chan *models.ProductEvent, productEventsQueueSize),
+	}
+}
+
+// Start готовит партиции (до приёма первых событий) и запускает запись очереди и обслуживание
+func (s *ProductEventService) Start() {
+	s.maintain(context.Background())
+	productEvents = s
+	go s.run()
+	go func() {
+		ticker := time.NewTicker(productEventsMaintenance)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.maintain(context.Background())
+		}
+	}()
+	log.Printf("📊 События продукта: хранение %d мес.", s.retentionMonths)
+}
+
+// TrackProductEvent ставит серверное событие пользователя в очередь записи; не блокирует запрос
+// и молча пропускает событие, если сервис не запущен
+func TrackProductEvent(userID, event string, properties map[string]interface{}) {
+	if productEvents == nil {
+		return
+	}
+	e := &models.ProductEvent{Event: event, UserID: userID, Source: models.ProductEventSourceServer, Properties: properties}
+	if err := e.Normalize(time.Now()); err != nil {
+		log.Printf("⚠️ Событие продукта отклонено: %v", err)
+		return
+	}
+	select {
+	case productEvents.queue <- e:
+	default:
+		log.Printf("⚠️ Очередь событий продукта переполнена, событие %s пропущено", event)
+	}
+}
+
+func (s *ProductEventService) run() {
+	ticker := time.NewTicker(productEventsFlushInterval)
+	defer ticker.Stop()
+	batch := make([]*models.ProductEvent, 0, productEventsFlushSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if _, err := models.InsertProductEvents(context.Background(), batch); err != nil {
+			log.Printf("❌ Ошибка записи событий продукта (%d шт.): %v", len(batch), err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case e := <-s.queue:
+			batch = append(batch, e)
+			if len(batch) >= productEventsFlushSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+// maintain создаёт партиции на ближайшие месяцы и удаляет месяцы старше срока хранения
+func (s *ProductEventService) maintain(ctx context.Context) {
+	now := time.Now().UTC()
+	month := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+	created, err := models.EnsureProductEventPartitions(ctx, month.AddDate(0, -1, 0), productEventsMonthsAhead+1)
+	if err != nil {
+		log.Printf("❌ Ошибка создания партиций событий продукта: %v", err)
+	}
+	for _, name := range created {
+		log.Printf("📊 Создана партиция %s", name)
+	}
+	if s.retentionMonths <= 0 {
+		return
+	}
+	dropped, err := models.DropProductEventPartitionsBefore(ctx, now.AddDate(0, -s.retentionMonths, 0))
+	if err != nil {
+		log.Printf("❌ Ошибка удаления старых партиций событий продукта: %v", err)
+	}
+	for _, name := range dropped {
+		log.Printf("🗑️ Удалена партиция %s (срок хранения – %d мес.)", name, s.retentionMonths)
+	}
+}
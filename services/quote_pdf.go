@@ -0,0 +1,234 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/go-pdf/fpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+
+	"subscription-system/models"
+)
+
+// PDF коммерческого предложения. Шрифты Go встроены в бинарник и содержат кириллицу,
+// поэтому документ собирается без системных шрифтов.
+
+// QuoteSeller – продавец в шапке КП
+type QuoteSeller struct {
+	Name    string
+	Details string // ИНН, адрес, контакты – по строке на реквизит
+}
+
+const quoteFont = "gofont"
+
+// quoteColumn – колонка таблицы позиций (ширина в мм)
+type quoteColumn struct {
+	title string
+	width float64
+	align string
+}
+
+var quoteColumns = []quoteColumn{
+	{"№", 8, "C"},
+	{"Артикул", 24, "L"},
+	{"Наименование", 60, "L"},
+	{"Кол-во", 16, "R"},
+	{"Ед.", 12, "C"},
+	{"Цена", 22, "R"},
+	{"Скидка", 14, "R"},
+	{"НДС", 12, "R"},
+	{"Сумма", 22, "R"},
+}
+
+// formatMoney – «1 234 567,89» с валютой, как принято в документах
+func formatMoney(v float64, currency string) string {
+	return formatNumber(v, 2) + " " + currency
+}
+
+func formatNumber(v float64, decimals int) string {
+	s := strconv.FormatFloat(math.Abs(v), 'f', decimals, 64)
+	intPart, frac := s, ""
+	if i := strings.IndexByte(s, '.'); i >= 0 {
+		intPart, frac = s[:i], s[i+1:]
+	}
+	var b strings.Builder
+	if v < 0 {
+		b.WriteString("-")
+	}
+	for i, r := range intPart {
+		if i > 0 && (len(intPart)-i)%3 == 0 {
+			b.WriteString(" ")
+		}
+		b.WriteRune(r)
+	}
+	if frac != "" {
+		b.WriteString("," + frac)
+	}
+	return b.String()
+}
+
+// formatQuantity – количество без лишних нулей: 2, 1,5, 0,125
+func formatQuantity(v float64) string {
+	s := strconv.FormatFloat(v, 'f', -1, 64)
+	return strings.Replace(s, ".", ",", 1)
+}
+
+// formatPercent – ставка в процентах без лишних нулей
+func formatPercent(v float64) string {
+	return formatQuantity(v) + "%"
+}
+
+// RenderQuotePDF собирает PDF версии коммерческого предложения
+func RenderQuotePDF(q *models.Quote, seller QuoteSeller) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(fmt.Sprintf("Коммерческое предложение %s", q.Number), true)
+	pdf.SetCreator(seller.Name, true)
+	pdf.AddUTF8FontFromBytes(quoteFont, "", goregular.TTF)
+	pdf.AddUTF8FontFromBytes(quoteFont, "B", gobold.TTF)
+	pdf.SetMargins(10, 12, 10)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("{nb}")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont(quoteFont, "", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(0, 5, fmt.Sprintf("%s, версия %d – страница %d из {nb}", q.Number, q.Version, pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	// Продавец
+	pdf.SetFont(quoteFont, "B", 13)
+	pdf.CellFormat(0, 7, seller.Name, "", 1, "L", false, 0, "")
+	if seller.Details != "" {
+		pdf.SetFont(quoteFont, "", 9)
+		pdf.SetTextColor(90, 90, 90)
+		pdf.MultiCell(0, 4.5, seller.Details, "", "L", false)
+		pdf.SetTextColor(0, 0, 0)
+	}
+	pdf.Ln(6)
+
+	// Заголовок
+	pdf.SetFont(quoteFont, "B", 15)
+	pdf.CellFormat(0, 8, fmt.Sprintf("Коммерческое предложение № %s", q.Number), "", 1, "L", false, 0, "")
+	pdf.SetFont(quoteFont, "", 10)
+	pdf.CellFormat(0, 5, fmt.Sprintf("Версия %d от %s", q.Version, q.CreatedAt.Format("02.01.2006")), "", 1, "L", false, 0, "")
+	pdf.Ln(4)
+
+	// Клиент
+	customer := q.Customer.Name
+	if q.Customer.Company != "" {
+		customer = q.Customer.Company + ", " + customer
+	}
+	var contacts []string
+	for _, c := range []string{q.Customer.Phone, q.Customer.Email} {
+		if c != "" {
+			contacts = append(contacts, c)
+		}
+	}
+	if len(contacts) > 0 {
+		customer += " (" + strings.Join(contacts, ", ") + ")"
+	}
+	quoteLabel(pdf, "Клиент:", customer)
+	quoteLabel(pdf, "Предмет:", q.DealTitle)
+	pdf.Ln(4)
+
+	// Таблица позиций
+	pdf.SetFont(quoteFont, "B", 8.5)
+	pdf.SetFillColor(235, 238, 243)
+	for _, col := range quoteColumns {
+		pdf.CellFormat(col.width, 7, col.title, "1", 0, "C", true, 0, "")
+	}
+	pdf.Ln(-1)
+	pdf.SetFont(quoteFont, "", 8.5)
+	const lineHeight = 4.5
+	for n, item := range q.Items {
+		values := []string{
+			strconv.Itoa(n + 1),
+			item.SKU,
+			item.Name,
+			formatQuantity(item.Quantity),
+			item.Unit,
+			formatNumber(item.Price, 2),
+			formatPercent(item.Discount),
+			formatPercent(item.VATRate),
+			formatNumber(item.Total, 2),
+		}
+		// Высота строки – по самой длинной ячейке (название, артикул)
+		lines := make([][]string, len(values))
+		rows := 1
+		for i, v := range values {
+			lines[i] = pdf.SplitText(v, quoteColumns[i].width-2)
+			if len(lines[i]) == 0 {
+				lines[i] = []string{""}
+			}
+			if len(lines[i]) > rows {
+				rows = len(lines[i])
+			}
+		}
+		height := float64(rows)*lineHeight + 1.5
+		_, pageHeight := pdf.GetPageSize()
+		if pdf.GetY()+height > pageHeight-15 {
+			pdf.AddPage()
+		}
+		x, y := pdf.GetXY()
+		for i, col := range quoteColumns {
+			pdf.Rect(x, y, col.width, height, "D")
+			for l, text := range lines[i] {
+				pdf.SetXY(x, y+0.75+float64(l)*lineHeight)
+				pdf.CellFormat(col.width, lineHeight, text, "", 0, col.align, false, 0, "")
+			}
+			x += col.width
+		}
+		pdf.SetXY(10, y+height)
+	}
+	pdf.Ln(3)
+
+	// Итоги
+	totals := [][2]string{
+		{"Сумма по ценам:", formatMoney(q.Totals.Subtotal, q.Totals.Currency)},
+	}
+	if q.Totals.Discount > 0 {
+		totals = append(totals, [2]string{"Скидка:", "-" + formatMoney(q.Totals.Discount, q.Totals.Currency)})
+	}
+	totals = append(totals,
+		[2]string{"НДС:", formatMoney(q.Totals.Tax, q.Totals.Currency)},
+		[2]string{"Итого к оплате:", formatMoney(q.Totals.Total, q.Totals.Currency)},
+	)
+	for i, t := range totals {
+		style := ""
+		if i == len(totals)-1 {
+			style = "B"
+		}
+		pdf.SetFont(quoteFont, style, 10)
+		pdf.CellFormat(150, 6, t[0], "", 0, "R", false, 0, "")
+		pdf.CellFormat(40, 6, t[1], "", 1, "R", false, 0, "")
+	}
+	pdf.Ln(4)
+
+	pdf.SetFont(quoteFont, "", 10)
+	if q.ValidUntil != nil {
+		pdf.CellFormat(0, 5, fmt.Sprintf("Предложение действительно до %s.", q.ValidUntil.Format("02.01.2006")), "", 1, "L", false, 0, "")
+	}
+	if q.Notes != "" {
+		pdf.Ln(2)
+		pdf.MultiCell(0, 5, q.Notes, "", "L", false)
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// quoteLabel – строка «подпись: значение» в шапке документа
+func quoteLabel(pdf *fpdf.Fpdf, label, value string) {
+	pdf.SetFont(quoteFont, "B", 10)
+	pdf.CellFormat(22, 5, label, "", 0, "L", false, 0, "")
+	pdf.SetFont(quoteFont, "", 10)
+	pdf.MultiCell(0, 5, value, "", "L", false)
+}
@@ -0,0 +1,198 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+
+	"subscription-system/database"
+	"subscription-system/models"
+	"subscription-system/monitoring"
+)
+
+const (
+	// realtimePollInterval – как часто журнал дочитывается без NOTIFY (страховка от потерянных уведомлений)
+	realtimePollInterval = 30 * time.Second
+	realtimeBatch        = 500
+	realtimeReconnect    = 5 * time.Second
+	realtimePruneEvery   = time.Hour
+	// RealtimeBuffer – очередь событий подписчика; переполнившийся подписчик отключается и догоняет по Last-Event-ID
+	RealtimeBuffer = 256
+)
+
+// RealtimeSubscriber – одно подключение к живым обновлениям CRM
+type RealtimeSubscriber struct {
+	UserID  string
+	IsAdmin bool
+	Events  chan *models.CRMEvent
+	// Done закрывается, когда хаб отключил подписчика (медленный клиент или остановка)
+	Done chan struct{}
+	once sync.Once
+}
+
+func (s *RealtimeSubscriber) close() {
+	s.once.Do(func() { close(s.Done) })
+}
+
+// RealtimeHub раздаёт события журнала CRM подключённым клиентам этого экземпляра.
+// О новых событиях экземпляр узнаёт через LISTEN crm_events на отдельном соединении,
+// поэтому изменения, сделанные на любом экземпляре, доходят до всех клиентов.
+type RealtimeHub struct {
+	mu     sync.RWMutex
+	subs   map[*RealtimeSubscriber]struct{}
+	cursor int64
+	sent   *models.CRMEventDedup
+}
+
+func NewRealtimeHub() *RealtimeHub {
+	return &RealtimeHub{subs: make(map[*RealtimeSubscriber]struct{}), sent: models.NewCRMEventDedup()}
+}
+
+// Subscribe регистрирует подписчика; события фильтруются по правам пользователя
+func (h *RealtimeHub) Subscribe(userID string, isAdmin bool) *RealtimeSubscriber {
+	s := &RealtimeSubscriber{
+		UserID:  userID,
+		IsAdmin: isAdmin,
+		Events:  make(chan *models.CRMEvent, RealtimeBuffer),
+		Done:    make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	monitoring.RealtimeClients.Inc()
+	return s
+}
+
+// Unsubscribe снимает подписчика; повторный вызов безопасен
+func (h *RealtimeHub) Unsubscribe(s *RealtimeSubscriber) {
+	h.mu.Lock()
+	_, ok := h.subs[s]
+	delete(h.subs, s)
+	h.mu.Unlock()
+	if ok {
+		monitoring.RealtimeClients.Dec()
+	}
+	s.close()
+}
+
+// Clients – число подключённых клиентов
+func (h *RealtimeHub) Clients() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subs)
+}
+
+func (h *RealtimeHub) broadcast(e *models.CRMEvent) {
+	h.mu.RLock()
+	var slow []*RealtimeSubscriber
+	for s := range h.subs {
+		if !e.VisibleTo(s.UserID, s.IsAdmin) {
+			continue
+		}
+		select {
+		case s.Events <- e:
+		default:
+			slow = append(slow, s)
+		}
+	}
+	h.mu.RUnlock()
+	for _, s := range slow {
+		log.Printf("⚠️ Realtime: клиент %s не успевает за событиями, отключаем", s.UserID)
+		monitoring.RealtimeDroppedTotal.Inc()
+		h.Unsubscribe(s)
+	}
+}
+
+// Start запускает прослушивание NOTIFY и периодическую очистку журнала
+func (h *RealtimeHub) Start() {
+	log.Println("📡 Живые обновления CRM: слушаем канал " + models.CRMEventsChannel)
+	go h.run(context.Background())
+	go func() {
+		ticker := time.NewTicker(realtimePruneEvery)
+		defer ticker.Stop()
+		for range ticker.C {
+			if n, err := models.PruneCRMEvents(context.Background()); err != nil {
+				log.Printf("❌ Ошибка очистки журнала событий CRM: %v", err)
+			} else if n > 0 {
+				log.Printf("🧹 Удалено старых событий CRM: %d", n)
+			}
+		}
+	}()
+}
+
+func (h *RealtimeHub) run(ctx context.Context) {
+	for {
+		cursor, err := models.LatestCRMEventID(ctx)
+		if err == nil {
+			h.cursor = cursor
+			break
+		}
+		log.Printf("❌ Realtime: не удалось прочитать журнал событий: %v", err)
+		time.Sleep(realtimeReconnect)
+	}
+	for {
+		if err := h.listen(ctx); err != nil {
+			log.Printf("⚠️ Realtime: соединение LISTEN потеряно: %v, переподключение через %s", err, realtimeReconnect)
+		}
+		time.Sleep(realtimeReconnect)
+	}
+}
+
+// listen держит выделенное соединение с LISTEN (соединение из пула для этого не годится:
+// подписка живёт, пока открыто соединение) и после каждого уведомления дочитывает журнал.
+func (h *RealtimeHub) listen(ctx context.Context) error {
+	conn, err := pgx.ConnectConfig(ctx, database.Pool.Config().ConnConfig.Copy())
+	if err != nil {
+		return err
+	}
+	defer conn.Close(context.Background())
+	if _, err := conn.Exec(ctx, "LISTEN "+models.CRMEventsChannel); err != nil {
+		return err
+	}
+	// события, пришедшие, пока соединения не было
+	h.dispatch(ctx)
+	for {
+		waitCtx, cancel := context.WithTimeout(ctx, realtimePollInterval)
+		_, err := conn.WaitForNotification(waitCtx)
+		cancel()
+		if err != nil && !errors.Is(err, context.DeadlineExceeded) {
+			return err
+		}
+		h.dispatch(ctx)
+	}
+}
+
+// dispatch рассылает опоздавшие события позади курсора и все события после него.
+// Вызывается только из горутины listen.
+func (h *RealtimeHub) dispatch(ctx context.Context) {
+	late, err := models.LateCRMEvents(ctx, h.cursor)
+	if err != nil {
+		log.Printf("❌ Realtime: ошибка чтения недавних событий: %v", err)
+		return
+	}
+	for _, e := range late {
+		if h.sent.Add(e.ID) {
+			h.broadcast(e)
+		}
+	}
+	for {
+		events, err := models.CRMEventsAfter(ctx, h.cursor, realtimeBatch)
+		if err != nil {
+			log.Printf("❌ Realtime: ошибка чтения событий после %d: %v", h.cursor, err)
+			return
+		}
+		for _, e := range events {
+			if h.sent.Add(e.ID) {
+				h.broadcast(e)
+			}
+			h.cursor = e.ID
+		}
+		if len(events) < realtimeBatch {
+			return
+		}
+	}
+}
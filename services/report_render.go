@@ -0,0 +1,341 @@
+package services
+
+import (
+	"bytes"
+	"fmt"
+	"html"
+	"math"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-pdf/fpdf"
+	"github.com/xuri/excelize/v2"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+
+	"subscription-system/models"
+)
+
+// Отображение отчётов по подпискам: HTML-письмо, сообщение Telegram, XLSX и PDF.
+// Все форматы строятся из одной models.ReportData.
+
+const (
+	// reportTelegramMaxLen – с запасом до предела сообщения Telegram (4096 символов)
+	reportTelegramMaxLen = 3800
+	// reportTelegramRows – строк каждой таблицы в сообщении Telegram; полный отчёт – во вложениях письма
+	reportTelegramRows = 5
+)
+
+// formatReportValue – значение ячейки или показателя для текста, письма и PDF
+func formatReportValue(v interface{}, format, currency string) string {
+	n, ok := v.(float64)
+	if !ok {
+		return fmt.Sprint(v)
+	}
+	switch format {
+	case models.ReportValueMoney:
+		return formatMoney(n, currency)
+	case models.ReportValuePercent:
+		return formatPercent(n)
+	default:
+		if n == math.Trunc(n) {
+			return formatNumber(n, 0)
+		}
+		return formatNumber(n, 2)
+	}
+}
+
+// renderReportHTML – письмо с отчётом; unsubscribeURL – ссылка отписки получателя
+func renderReportHTML(d *models.ReportData, unsubscribeURL string) string {
+	var b strings.Builder
+	esc := html.EscapeString
+	b.WriteString(`<div style="font-family:Arial,sans-serif;font-size:14px;color:#222;max-width:760px">`)
+	b.WriteString(`<h2 style="margin:0 0 4px">` + esc(d.Title) + `</h2>`)
+	if d.Subtitle != "" {
+		b.WriteString(`<div style="color:#555">` + esc(d.Subtitle) + `</div>`)
+	}
+	b.WriteString(`<div style="color:#777;margin-bottom:16px">Период: ` + esc(d.PeriodLabel()) + `</div>`)
+
+	b.WriteString(`<table cellpadding="6" cellspacing="0" style="border-collapse:collapse;margin-bottom:20px">`)
+	for _, m := range d.Metrics {
+		b.WriteString(`<tr><td style="color:#555;border-bottom:1px solid #eee">` + esc(m.Label) + `</td>`)
+		b.WriteString(`<td style="font-weight:bold;text-align:right;border-bottom:1px solid #eee">` +
+			esc(formatReportValue(m.Value, m.Format, d.Currency)) + `</td></tr>`)
+	}
+	b.WriteString(`</table>`)
+
+	for _, t := range d.Tables {
+		b.WriteString(`<h3 style="margin:16px 0 6px">` + esc(t.Title) + `</h3>`)
+		if len(t.Rows) == 0 {
+			b.WriteString(`<div style="color:#777">Нет данных за период</div>`)
+			continue
+		}
+		b.WriteString(`<table cellpadding="5" cellspacing="0" style="border-collapse:collapse;width:100%;font-size:13px">`)
+		b.WriteString(`<tr style="background:#f0f0f0">`)
+		for _, col := range t.Columns {
+			b.WriteString(`<th style="text-align:` + reportAlign(col.Format, "left", "right") + `;border:1px solid #ddd">` + esc(col.Title) + `</th>`)
+		}
+		b.WriteString(`</tr>`)
+		for _, row := range t.Rows {
+			b.WriteString(`<tr>`)
+			for i, col := range t.Columns {
+				b.WriteString(`<td style="text-align:` + reportAlign(col.Format, "left", "right") + `;border:1px solid #ddd">` +
+					esc(formatReportValue(row[i], col.Format, d.Currency)) + `</td>`)
+			}
+			b.WriteString(`</tr>`)
+		}
+		b.WriteString(`</table>`)
+	}
+	if unsubscribeURL != "" {
+		b.WriteString(`<p style="color:#999;font-size:12px;margin-top:24px">Вы получили это письмо, потому что подписаны на отчёт. ` +
+			`<a href="` + esc(unsubscribeURL) + `" style="color:#999">Отписаться</a></p>`)
+	}
+	b.WriteString(`</div>`)
+	return b.String()
+}
+
+// reportAlign – выравнивание колонки: текст – text, числа – number
+func reportAlign(format, text, number string) string {
+	if format == models.ReportValueText {
+		return text
+	}
+	return number
+}
+
+// renderReportTelegram – сообщение Telegram (HTML): показатели и начало каждой таблицы
+func renderReportTelegram(d *models.ReportData, unsubscribeURL string) string {
+	esc := html.EscapeString
+	lines := []string{"📊 <b>" + esc(d.Title) + "</b>"}
+	if d.Subtitle != "" {
+		lines = append(lines, esc(d.Subtitle))
+	}
+	lines = append(lines, "Период: "+esc(d.PeriodLabel()), "")
+	for _, m := range d.Metrics {
+		lines = append(lines, esc(m.Label)+": <b>"+esc(formatReportValue(m.Value, m.Format, d.Currency))+"</b>")
+	}
+	for _, t := range d.Tables {
+		if len(t.Rows) == 0 {
+			continue
+		}
+		lines = append(lines, "", "<b>"+esc(t.Title)+"</b>")
+		for i, row := range t.Rows {
+			if i == reportTelegramRows {
+				lines = append(lines, fmt.Sprintf("… и ещё %d", len(t.Rows)-reportTelegramRows))
+				break
+			}
+			cells := make([]string, len(t.Columns))
+			for j, col := range t.Columns {
+				cells[j] = esc(truncateRunes(formatReportValue(row[j], col.Format, d.Currency), 80))
+			}
+			lines = append(lines, "• "+strings.Join(cells, " · "))
+		}
+	}
+	footer := ""
+	if unsubscribeURL != "" {
+		footer = "\n\n" + `<a href="` + esc(unsubscribeURL) + `">Отписаться</a>`
+	}
+	text := strings.Join(lines, "\n")
+	if limit := reportTelegramMaxLen - utf8.RuneCountInString(footer); utf8.RuneCountInString(text) > limit {
+		// Обрезка по строкам, чтобы не разорвать HTML-тег
+		for utf8.RuneCountInString(text) > limit-2 && len(lines) > 1 {
+			lines = lines[:len(lines)-1]
+			text = strings.Join(lines, "\n")
+		}
+		text += "\n…"
+	}
+	return text + footer
+}
+
+func truncateRunes(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// reportSheetName – имя листа Excel: до 31 символа без []:*?/\
+func reportSheetName(title string, used map[string]bool) string {
+	name := strings.Map(func(r rune) rune {
+		if strings.ContainsRune(`[]:*?/\`, r) {
+			return ' '
+		}
+		return r
+	}, title)
+	name = strings.TrimSpace(truncateRunes(name, 28))
+	if name == "" {
+		name = "Таблица"
+	}
+	for i, base := 2, name; used[name]; i++ {
+		name = fmt.Sprintf("%s %d", base, i)
+	}
+	used[name] = true
+	return name
+}
+
+// renderReportXLSX – книга Excel: лист «Сводка» с показателями и по листу на таблицу.
+// Числа пишутся числами, доли – долями с процентным форматом.
+func renderReportXLSX(d *models.ReportData) ([]byte, error) {
+	f := excelize.NewFile()
+	defer f.Close()
+	bold, _ := f.NewStyle(&excelize.Style{Font: &excelize.Font{Bold: true}})
+	header, _ := f.NewStyle(&excelize.Style{
+		Font: &excelize.Font{Bold: true},
+		Fill: excelize.Fill{Type: "pattern", Color: []string{"#DDDDDD"}, Pattern: 1},
+	})
+	styles := map[string]int{}
+	styles[models.ReportValueMoney], _ = f.NewStyle(&excelize.Style{NumFmt: 4})
+	styles[models.ReportValuePercent], _ = f.NewStyle(&excelize.Style{NumFmt: 10})
+	styles[models.ReportValueNumber], _ = f.NewStyle(&excelize.Style{NumFmt: 3})
+	setValue := func(sheet string, col, row int, v interface{}, format string) {
+		cell, _ := excelize.CoordinatesToCellName(col, row)
+		if n, ok := v.(float64); ok && format != models.ReportValueText {
+			if format == models.ReportValuePercent {
+				n /= 100
+			}
+			f.SetCellValue(sheet, cell, n)
+			f.SetCellStyle(sheet, cell, cell, styles[format])
+			return
+		}
+		f.SetCellValue(sheet, cell, v)
+	}
+
+	used := map[string]bool{}
+	summary := reportSheetName("Сводка", used)
+	f.SetSheetName("Sheet1", summary)
+	f.SetCellValue(summary, "A1", d.Title)
+	f.SetCellStyle(summary, "A1", "A1", bold)
+	row := 2
+	if d.Subtitle != "" {
+		f.SetCellValue(summary, "A2", d.Subtitle)
+		row++
+	}
+	f.SetCellValue(summary, fmt.Sprintf("A%d", row), "Период: "+d.PeriodLabel())
+	row += 2
+	for _, m := range d.Metrics {
+		f.SetCellValue(summary, fmt.Sprintf("A%d", row), m.Label)
+		setValue(summary, 2, row, m.Value, m.Format)
+		row++
+	}
+	f.SetColWidth(summary, "A", "A", 40)
+	f.SetColWidth(summary, "B", "B", 18)
+
+	for _, t := range d.Tables {
+		sheet := reportSheetName(t.Title, used)
+		if _, err := f.NewSheet(sheet); err != nil {
+			return nil, err
+		}
+		for j, col := range t.Columns {
+			cell, _ := excelize.CoordinatesToCellName(j+1, 1)
+			f.SetCellValue(sheet, cell, col.Title)
+		}
+		last, _ := excelize.CoordinatesToCellName(len(t.Columns), 1)
+		f.SetCellStyle(sheet, "A1", last, header)
+		for i, r := range t.Rows {
+			for j, col := range t.Columns {
+				setValue(sheet, j+1, i+2, r[j], col.Format)
+			}
+		}
+		lastCol, _ := excelize.ColumnNumberToName(len(t.Columns))
+		f.SetColWidth(sheet, "A", lastCol, 18)
+		f.SetColWidth(sheet, "A", "A", 30)
+	}
+	buf, err := f.WriteToBuffer()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// renderReportPDF – PDF с показателями и таблицами; первая колонка таблицы шире остальных
+func renderReportPDF(d *models.ReportData) ([]byte, error) {
+	pdf := fpdf.New("P", "mm", "A4", "")
+	pdf.SetTitle(d.Title, true)
+	pdf.AddUTF8FontFromBytes(quoteFont, "", goregular.TTF)
+	pdf.AddUTF8FontFromBytes(quoteFont, "B", gobold.TTF)
+	pdf.SetMargins(10, 12, 10)
+	pdf.SetAutoPageBreak(true, 15)
+	pdf.AliasNbPages("{nb}")
+	pdf.SetFooterFunc(func() {
+		pdf.SetY(-12)
+		pdf.SetFont(quoteFont, "", 8)
+		pdf.SetTextColor(120, 120, 120)
+		pdf.CellFormat(0, 5, fmt.Sprintf("%s, %s – страница %d из {nb}", d.Title, d.PeriodLabel(), pdf.PageNo()), "", 0, "C", false, 0, "")
+	})
+	pdf.AddPage()
+
+	pdf.SetFont(quoteFont, "B", 15)
+	pdf.CellFormat(0, 8, d.Title, "", 1, "L", false, 0, "")
+	pdf.SetFont(quoteFont, "", 10)
+	pdf.SetTextColor(90, 90, 90)
+	if d.Subtitle != "" {
+		pdf.CellFormat(0, 5, d.Subtitle, "", 1, "L", false, 0, "")
+	}
+	pdf.CellFormat(0, 5, "Период: "+d.PeriodLabel(), "", 1, "L", false, 0, "")
+	pdf.SetTextColor(0, 0, 0)
+	pdf.Ln(4)
+
+	pdf.SetFont(quoteFont, "", 10)
+	for _, m := range d.Metrics {
+		pdf.CellFormat(100, 6, m.Label, "B", 0, "L", false, 0, "")
+		pdf.SetFont(quoteFont, "B", 10)
+		pdf.CellFormat(50, 6, formatReportValue(m.Value, m.Format, d.Currency), "B", 1, "R", false, 0, "")
+		pdf.SetFont(quoteFont, "", 10)
+	}
+
+	pageWidth, _ := pdf.GetPageSize()
+	left, _, right, _ := pdf.GetMargins()
+	width := pageWidth - left - right
+	for _, t := range d.Tables {
+		pdf.Ln(6)
+		pdf.SetFont(quoteFont, "B", 11)
+		pdf.CellFormat(0, 7, t.Title, "", 1, "L", false, 0, "")
+		if len(t.Rows) == 0 {
+			pdf.SetFont(quoteFont, "", 9)
+			pdf.CellFormat(0, 5, "Нет данных за период", "", 1, "L", false, 0, "")
+			continue
+		}
+		widths := make([]float64, len(t.Columns))
+		first := width * 0.34
+		if len(t.Columns) == 1 {
+			first = width
+		}
+		widths[0] = first
+		for j := 1; j < len(widths); j++ {
+			widths[j] = (width - first) / float64(len(widths)-1)
+		}
+		pdf.SetFont(quoteFont, "B", 8.5)
+		pdf.SetFillColor(230, 230, 230)
+		for j, col := range t.Columns {
+			pdf.CellFormat(widths[j], 6, pdfFit(pdf, col.Title, widths[j]), "1", 0, reportAlign(col.Format, "L", "R"), true, 0, "")
+		}
+		pdf.Ln(-1)
+		pdf.SetFont(quoteFont, "", 8.5)
+		for _, r := range t.Rows {
+			for j, col := range t.Columns {
+				text := formatReportValue(r[j], col.Format, d.Currency)
+				pdf.CellFormat(widths[j], 5.5, pdfFit(pdf, text, widths[j]), "1", 0, reportAlign(col.Format, "L", "R"), false, 0, "")
+			}
+			pdf.Ln(-1)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := pdf.Output(&buf); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// pdfFit обрезает текст под ширину ячейки текущим шрифтом
+func pdfFit(pdf *fpdf.Fpdf, text string, width float64) string {
+	text = strings.Join(strings.Fields(text), " ")
+	limit := width - 2
+	if pdf.GetStringWidth(text) <= limit {
+		return text
+	}
+	r := []rune(text)
+	for len(r) > 0 && pdf.GetStringWidth(string(r)+"…") > limit {
+		r = r[:len(r)-1]
+	}
+	return string(r) + "…"
+}
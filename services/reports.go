@@ -0,0 +1,215 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/mail"
+	"strconv"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const (
+	reportCheckInterval = time.Minute
+	reportBatch         = 20
+	reportDateLayout    = "2006-01-02"
+)
+
+// ErrReportNoRecipients – все получатели подписки отписались
+var ErrReportNoRecipients = errors.New("report subscription has no active recipients")
+
+// ReportService рассылает отчёты по подпискам: HTML-письмо с вложениями XLSX/PDF и сообщение
+// Telegram через бота. Каждая доставка пишется в историю, у каждого получателя своя ссылка отписки.
+type ReportService struct {
+	notifier  *NotificationService
+	from      string
+	publicURL string
+}
+
+func NewReportService(cfg *config.Config) *ReportService {
+	return &ReportService{notifier: NewNotificationService(cfg), from: cfg.EmailFrom, publicURL: cfg.PublicURL}
+}
+
+// Start запускает проверку расписания раз в минуту
+func (s *ReportService) Start() {
+	log.Println("📬 Отчёты по расписанию: планировщик запущен")
+	go func() {
+		ticker := time.NewTicker(reportCheckInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.SendDue(context.Background())
+		}
+	}()
+}
+
+// SendDue отправляет наступившие отчёты. Подписка переносится на следующий срок до отправки,
+// поэтому сбой доставки не повторяется каждую минуту, а видна в истории.
+func (s *ReportService) SendDue(ctx context.Context) {
+	for {
+		runs, err := models.ClaimDueReportSubscriptions(ctx, time.Now(), reportBatch)
+		if err != nil {
+			log.Printf("❌ Ошибка получения отчётов по расписанию: %v", err)
+			return
+		}
+		for _, run := range runs {
+			from, to := run.Subscription.Period(run.ScheduledAt)
+			if _, err := s.Deliver(ctx, run.Subscription, from, to); err != nil && !errors.Is(err, ErrReportNoRecipients) {
+				log.Printf("❌ Отчёт %s не отправлен: %v", run.Subscription.ID, err)
+			}
+		}
+		if len(runs) < reportBatch {
+			return
+		}
+	}
+}
+
+// Preview собирает отчёт подписки за последний закончившийся период, не отправляя его
+func (s *ReportService) Preview(ctx context.Context, sub *models.ReportSubscription) (*models.ReportData, error) {
+	from, to := sub.Period(time.Now())
+	return s.build(ctx, sub, from, to)
+}
+
+func (s *ReportService) build(ctx context.Context, sub *models.ReportSubscription, from, to time.Time) (*models.ReportData, error) {
+	owner, err := models.GetUserByID(sub.UserID)
+	if err != nil {
+		return nil, err
+	}
+	return models.BuildReport(ctx, sub, owner.Role == "admin", from, to)
+}
+
+// Deliver собирает отчёт за [from, to) и отправляет его всем неотписавшимся получателям;
+// возвращает записи истории. Ошибка – только если отчёт не удалось собрать.
+func (s *ReportService) Deliver(ctx context.Context, sub *models.ReportSubscription, from, to time.Time) ([]models.ReportDelivery, error) {
+	recipients := sub.Active()
+	if len(recipients) == 0 {
+		return nil, ErrReportNoRecipients
+	}
+	data, err := s.build(ctx, sub, from, to)
+	if err != nil {
+		// Отчёт не собрался – это тоже доставка с ошибкой для каждого получателя
+		deliveries := make([]models.ReportDelivery, 0, len(recipients))
+		for _, r := range recipients {
+			deliveries = append(deliveries, s.log(ctx, sub, r, from, to, err))
+		}
+		return deliveries, err
+	}
+
+	var attachments []mailAttachment
+	var renderErr error
+	for _, format := range sub.Formats {
+		a, err := renderReportAttachment(data, sub.Report, format)
+		if err != nil {
+			renderErr = fmt.Errorf("%s: %w", format, err)
+			break
+		}
+		attachments = append(attachments, a)
+	}
+
+	deliveries := make([]models.ReportDelivery, 0, len(recipients))
+	for _, r := range recipients {
+		err := renderErr
+		if err == nil {
+			switch r.Channel {
+			case models.ReportChannelEmail:
+				err = s.sendEmail(sub, data, r, attachments)
+			case models.ReportChannelTelegram:
+				err = s.sendTelegram(ctx, data, r)
+			}
+		}
+		deliveries = append(deliveries, s.log(ctx, sub, r, from, to, err))
+	}
+	return deliveries, nil
+}
+
+// log пишет результат доставки получателю в историю
+func (s *ReportService) log(ctx context.Context, sub *models.ReportSubscription, r models.ReportRecipient, from, to time.Time, sendErr error) models.ReportDelivery {
+	recipientID := r.ID
+	d := models.ReportDelivery{
+		SubscriptionID: sub.ID,
+		RecipientID:    &recipientID,
+		Channel:        r.Channel,
+		Address:        r.Address,
+		Status:         models.ReportDeliverySent,
+		PeriodFrom:     from.Format(reportDateLayout),
+		PeriodTo:       to.Format(reportDateLayout),
+	}
+	if sendErr != nil {
+		msg := sendErr.Error()
+		d.Status, d.Error = models.ReportDeliveryFailed, &msg
+		log.Printf("⚠️ Отчёт %s не доставлен (%s %s): %s", sub.ID, r.Channel, r.Address, msg)
+	}
+	if err := models.LogReportDelivery(ctx, &d); err != nil {
+		log.Printf("❌ Не удалось сохранить доставку отчёта %s: %v", sub.ID, err)
+	}
+	return d
+}
+
+// unsubscribeURL – ссылка отписки получателя; без PUBLIC_URL ссылки нет
+func (s *ReportService) unsubscribeURL(r models.ReportRecipient) string {
+	if s.publicURL == "" {
+		return ""
+	}
+	return s.publicURL + "/api/public/reports/unsubscribe/" + r.UnsubscribeToken
+}
+
+func (s *ReportService) sendEmail(sub *models.ReportSubscription, data *models.ReportData, r models.ReportRecipient, attachments []mailAttachment) error {
+	if !s.notifier.EmailConfigured() {
+		return errors.New("SMTP не настроен")
+	}
+	unsubscribe := s.unsubscribeURL(r)
+	msg := &outgoingMail{
+		From:        mail.Address{Name: "Отчёты", Address: s.from},
+		To:          []mail.Address{{Address: r.Address}},
+		Subject:     sub.Name + " – " + data.PeriodLabel(),
+		HTML:        renderReportHTML(data, unsubscribe),
+		MessageID:   models.NewEmailMessageID(s.from),
+		Date:        time.Now(),
+		Unsubscribe: unsubscribe,
+		Attachments: attachments,
+	}
+	raw, err := msg.build()
+	if err != nil {
+		return err
+	}
+	return s.notifier.SendRawEmail(r.Address, raw)
+}
+
+func (s *ReportService) sendTelegram(ctx context.Context, data *models.ReportData, r models.ReportRecipient) error {
+	if !s.notifier.TelegramConfigured() {
+		return errors.New("Telegram-бот не настроен")
+	}
+	chatID, err := strconv.ParseInt(r.Address, 10, 64)
+	if err != nil {
+		return err
+	}
+	return s.notifier.SendTelegramTo(ctx, chatID, renderReportTelegram(data, s.unsubscribeURL(r)))
+}
+
+// renderReportAttachment – вложение письма в формате xlsx или pdf
+func renderReportAttachment(data *models.ReportData, report, format string) (mailAttachment, error) {
+	name := report + "_" + data.From.Format(reportDateLayout) + "." + format
+	switch format {
+	case models.ReportFormatXLSX:
+		b, err := renderReportXLSX(data)
+		return mailAttachment{Name: name, ContentType: "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet", Data: b}, err
+	case models.ReportFormatPDF:
+		b, err := renderReportPDF(data)
+		return mailAttachment{Name: name, ContentType: "application/pdf", Data: b}, err
+	}
+	return mailAttachment{}, fmt.Errorf("unknown report format %q", format)
+}
+
+// RenderReportFile – отчёт файлом (xlsx или pdf) для скачивания предпросмотра
+func RenderReportFile(data *models.ReportData, report, format string) (name, contentType string, body []byte, err error) {
+	a, err := renderReportAttachment(data, report, format)
+	return a.Name, a.ContentType, a.Data, err
+}
+
+// RenderReportHTML – HTML письма отчёта без ссылки отписки (предпросмотр)
+func RenderReportHTML(data *models.ReportData) string {
+	return renderReportHTML(data, "")
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const revenueMetricsInterval = time.Hour
+
+// RevenueMetricsService досчитывает дневные метрики выручки подписок.
+// Считаются только завершившиеся дни (по вчерашний включительно); первый запуск
+// восстанавливает историю с самой ранней подписки.
+type RevenueMetricsService struct {
+	graceDays int
+	mu        sync.Mutex
+}
+
+func NewRevenueMetricsService(cfg *config.Config) *RevenueMetricsService {
+	return &RevenueMetricsService{graceDays: cfg.RevenueGraceDays}
+}
+
+// Start запускает досчёт при старте и затем раз в час
+func (s *RevenueMetricsService) Start() {
+	log.Printf("💰 Метрики выручки: льготный период неоплаченной подписки – %d дн.", s.graceDays)
+	go func() {
+		s.CatchUp(context.Background())
+		ticker := time.NewTicker(revenueMetricsInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.CatchUp(context.Background())
+		}
+	}()
+}
+
+// CatchUp считает все непосчитанные завершившиеся дни и возвращает их число
+func (s *RevenueMetricsService) CatchUp(ctx context.Context) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	until := time.Now().AddDate(0, 0, -1)
+	processed := 0
+	for {
+		day, err := models.ProcessNextRevenueDay(ctx, until, s.graceDays)
+		if err != nil {
+			log.Printf("❌ Ошибка расчёта метрик выручки: %v", err)
+			break
+		}
+		if day == nil {
+			break
+		}
+		processed++
+	}
+	if processed > 0 {
+		log.Printf("💰 Метрики выручки: посчитано дней – %d", processed)
+	}
+	return processed
+}
+
+// Rebuild стирает посчитанную историю и считает её заново
+func (s *RevenueMetricsService) Rebuild(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	err := models.RebuildRevenueMetrics(ctx)
+	s.mu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return s.CatchUp(ctx), nil
+}
@@ -10,6 +10,7 @@ import (
 	"time"
 
 	"subscription-system/config"
+	"subscription-system/tracing"
 )
 
 // SpeechKitService - сервис для работы с Yandex SpeechKit
@@ -24,9 +25,7 @@ func NewSpeechKitService(cfg *config.Config) *SpeechKitService {
 	return &SpeechKitService{
 		APIKey:   cfg.YandexAPIKey,
 		FolderID: cfg.YandexFolderID,
-		HTTPClient: &http.Client{
-			Timeout: 5 * time.Minute, // Для аудио нужно больше времени
-		},
+		HTTPClient: tracing.NewHTTPClient("speechkit", 5*time.Minute), // Для аудио нужно больше времени
 	}
 }
 
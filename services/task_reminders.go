@@ -0,0 +1,129 @@
+package services
+
+import (
+	"context"
+	"fmt"
+	"html"
+	"log"
+	"strings"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+)
+
+const (
+	taskReminderInterval = time.Minute
+	taskReminderBatch    = 200
+)
+
+var taskPriorityLabels = map[string]string{
+	models.TaskPriorityLow:    "низкий",
+	models.TaskPriorityNormal: "обычный",
+	models.TaskPriorityHigh:   "высокий",
+	models.TaskPriorityUrgent: "🔥 срочно",
+}
+
+// TaskReminderService рассылает напоминания о задачах CRM в Telegram и на почту.
+// Каналы берутся из настроек уведомлений исполнителя (user_notification_settings).
+type TaskReminderService struct {
+	notifier  *NotificationService
+	publicURL string
+}
+
+func NewTaskReminderService(cfg *config.Config) *TaskReminderService {
+	return &TaskReminderService{notifier: NewNotificationService(cfg), publicURL: cfg.PublicURL}
+}
+
+// Start запускает проверку напоминаний раз в минуту
+func (s *TaskReminderService) Start() {
+	log.Println("⏰ Напоминания о задачах CRM: планировщик запущен")
+	go func() {
+		ticker := time.NewTicker(taskReminderInterval)
+		defer ticker.Stop()
+		for range ticker.C {
+			s.SendDue(context.Background())
+		}
+	}()
+}
+
+// SendDue отправляет все наступившие напоминания. Каждое сначала помечается отправленным,
+// поэтому при нескольких экземплярах сервиса оно уходит один раз.
+func (s *TaskReminderService) SendDue(ctx context.Context) {
+	reminders, err := models.DueTaskReminders(ctx, taskReminderBatch)
+	if err != nil {
+		log.Printf("❌ Ошибка получения напоминаний о задачах: %v", err)
+		return
+	}
+	for _, r := range reminders {
+		claimed, err := models.ClaimTaskReminder(ctx, r)
+		if err != nil {
+			log.Printf("❌ Ошибка фиксации напоминания по задаче %s: %v", r.TaskID, err)
+			continue
+		}
+		if !claimed {
+			continue
+		}
+		if errs := s.send(ctx, r); len(errs) > 0 {
+			msg := strings.Join(errs, "; ")
+			log.Printf("⚠️ Напоминание по задаче %s не доставлено: %s", r.TaskID, msg)
+			if err := models.SetTaskReminderError(ctx, r, msg); err != nil {
+				log.Printf("❌ Не удалось сохранить ошибку напоминания %s: %v", r.TaskID, err)
+			}
+		}
+	}
+}
+
+// send отправляет напоминание по включённым каналам и возвращает ошибки доставки
+func (s *TaskReminderService) send(ctx context.Context, r models.TaskReminder) []string {
+	var errs []string
+	if r.TelegramEnabled && r.TelegramID != nil {
+		if err := s.notifier.SendTelegramTo(ctx, *r.TelegramID, s.format(r, "\n")); err != nil {
+			errs = append(errs, "telegram: "+err.Error())
+		}
+	}
+	if r.EmailEnabled && r.Email != "" {
+		subject := "Напоминание: " + r.Title
+		if err := s.notifier.SendEmail(r.Email, subject, s.format(r, "<br>")); err != nil {
+			errs = append(errs, "email: "+err.Error())
+		}
+	}
+	return errs
+}
+
+// format собирает текст напоминания; Telegram и письмо оба понимают HTML, отличается только перенос строки
+func (s *TaskReminderService) format(r models.TaskReminder, br string) string {
+	lines := []string{
+		"⏰ <b>" + html.EscapeString(r.Title) + "</b>",
+		"<b>Срок:</b> " + r.DueAt.In(time.Local).Format("02.01.2006 15:04") + " (" + reminderLead(r.DueAt) + ")",
+		"<b>Приоритет:</b> " + taskPriorityLabels[r.Priority],
+	}
+	if r.DealTitle != "" {
+		lines = append(lines, "<b>Сделка:</b> "+html.EscapeString(r.DealTitle))
+	}
+	if r.CustomerName != "" {
+		lines = append(lines, "<b>Клиент:</b> "+html.EscapeString(r.CustomerName))
+	}
+	if r.Description != "" {
+		lines = append(lines, html.EscapeString(r.Description))
+	}
+	if s.publicURL != "" {
+		lines = append(lines, `<a href="`+s.publicURL+`/calendar">Открыть календарь</a>`)
+	}
+	return strings.Join(lines, br)
+}
+
+// reminderLead – сколько осталось до срока: «через 15 мин», «через 2 ч», «сейчас»
+func reminderLead(due time.Time) string {
+	left := time.Until(due).Round(time.Minute)
+	switch {
+	case left <= 0:
+		return "сейчас"
+	case left < time.Hour:
+		return fmt.Sprintf("через %d мин", int(left.Minutes()))
+	case left < 48*time.Hour:
+		return fmt.Sprintf("через %d ч", int(left.Hours()))
+	default:
+		return fmt.Sprintf("через %d дн", int(left.Hours()/24))
+	}
+}
@@ -0,0 +1,202 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+	"time"
+
+	"subscription-system/config"
+	"subscription-system/models"
+	"subscription-system/monitoring"
+)
+
+const (
+	webhookInterval = 5 * time.Second
+	webhookBatch    = 50
+	webhookTimeout  = 10 * time.Second
+	// webhookLease – доставка, забранная упавшим экземпляром, вернётся в очередь через это время
+	webhookLease      = 2 * time.Minute
+	webhookPruneEvery = 6 * time.Hour
+	webhookUserAgent  = "SaaSPro-Webhooks/1.0"
+)
+
+// ErrWebhookPrivateAddress – адрес вебхука указывает во внутреннюю сеть
+var ErrWebhookPrivateAddress = errors.New("webhook address resolves to a private network")
+
+// WebhookDispatcher отправляет доставки из очереди webhook_deliveries.
+// Каждый запрос подписан HMAC-SHA256 секретом адреса: заголовок X-Webhook-Signature
+// вида "t=<unix>,v1=<hex>", где подписывается строка "<unix>.<тело запроса>".
+type WebhookDispatcher struct {
+	client *http.Client
+}
+
+func NewWebhookDispatcher(cfg *config.Config) *WebhookDispatcher {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if !cfg.WebhookAllowPrivate {
+		// Проверяется уже разрешённый IP, поэтому DNS-имя, указывающее на внутренний адрес, тоже не пройдёт
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateIP(ip) {
+				return ErrWebhookPrivateAddress
+			}
+			return nil
+		}
+	}
+	transport := &http.Transport{
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: 5 * time.Second,
+		MaxIdleConnsPerHost: 2,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &WebhookDispatcher{client: &http.Client{
+		Timeout:   webhookTimeout,
+		Transport: transport,
+		// Редирект – тоже ответ подписчика: следовать за ним значит отправить событие на чужой адрес
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}}
+}
+
+func isPrivateIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsUnspecified() || ip.IsMulticast() || ip.IsInterfaceLocalMulticast()
+}
+
+// SignWebhookPayload – подпись тела запроса для заголовка X-Webhook-Signature
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "t=" + strconv.FormatInt(timestamp, 10) + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Start запускает отправку очереди раз в несколько секунд и очистку старого журнала
+func (s *WebhookDispatcher) Start() {
+	log.Println("🪝 Исходящие вебхуки: диспетчер запущен")
+	go func() {
+		ticker := time.NewTicker(webhookInterval)
+		defer ticker.Stop()
+		lastPrune := time.Time{}
+		for range ticker.C {
+			s.DeliverDue(context.Background())
+			if time.Since(lastPrune) > webhookPruneEvery {
+				lastPrune = time.Now()
+				if n, err := models.PruneWebhookDeliveries(context.Background()); err != nil {
+					log.Printf("❌ Ошибка очистки журнала вебхуков: %v", err)
+				} else if n > 0 {
+					log.Printf("🧹 Удалено старых доставок вебхуков: %d", n)
+				}
+			}
+		}
+	}()
+}
+
+// DeliverDue отправляет все наступившие доставки
+func (s *WebhookDispatcher) DeliverDue(ctx context.Context) {
+	for {
+		deliveries, err := models.ClaimWebhookDeliveries(ctx, webhookBatch, webhookLease, "")
+		if err != nil {
+			log.Printf("❌ Ошибка выборки доставок вебхуков: %v", err)
+			return
+		}
+		for _, d := range deliveries {
+			s.deliver(ctx, d)
+		}
+		if len(deliveries) < webhookBatch {
+			return
+		}
+	}
+}
+
+// DeliverNow сразу отправляет одну доставку (проверка адреса, ручная повторная отправка)
+// и возвращает её состояние с журналом попыток
+func (s *WebhookDispatcher) DeliverNow(ctx context.Context, deliveryID string) (*models.WebhookDelivery, error) {
+	deliveries, err := models.ClaimWebhookDeliveries(ctx, 1, webhookLease, deliveryID)
+	if err != nil {
+		return nil, err
+	}
+	// Пусто – доставку уже забрал фоновый диспетчер; возвращаем как есть
+	for _, d := range deliveries {
+		s.deliver(ctx, d)
+	}
+	return models.GetWebhookDelivery(ctx, deliveryID)
+}
+
+func (s *WebhookDispatcher) deliver(ctx context.Context, d *models.WebhookDelivery) {
+	var attempt models.WebhookAttempt
+	var retry bool
+	if !d.EndpointActive && d.EventType != models.WebhookEventPing {
+		attempt.Error = "endpoint is disabled"
+	} else {
+		attempt, retry = s.send(ctx, d)
+	}
+	status, err := models.RecordWebhookAttempt(ctx, d, attempt, retry)
+	if err != nil {
+		log.Printf("❌ Не удалось сохранить результат доставки вебхука %s: %v", d.ID, err)
+		return
+	}
+	switch {
+	case attempt.OK():
+		monitoring.WebhookAttemptsTotal.WithLabelValues("success").Inc()
+	case status == models.WebhookDeliveryPending:
+		monitoring.WebhookAttemptsTotal.WithLabelValues("retry").Inc()
+	default:
+		monitoring.WebhookAttemptsTotal.WithLabelValues("failed").Inc()
+	}
+	if status == models.WebhookDeliveryFailed {
+		log.Printf("⚠️ Вебхук %s (%s) не доставлен на %s после %d попыток: %s", d.ID, d.EventType, d.URL, d.Attempts, attempt.Error)
+	}
+}
+
+// send выполняет одну попытку; retry=false – повторять бессмысленно
+func (s *WebhookDispatcher) send(ctx context.Context, d *models.WebhookDelivery) (attempt models.WebhookAttempt, retry bool) {
+	attempt.Attempt = d.Attempts
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		attempt.Error = err.Error()
+		return attempt, false
+	}
+	now := time.Now().Unix()
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", webhookUserAgent)
+	req.Header.Set("X-Webhook-Event", d.EventType)
+	req.Header.Set("X-Webhook-Event-Id", d.EventID)
+	req.Header.Set("X-Webhook-Delivery", d.ID)
+	req.Header.Set("X-Webhook-Attempt", strconv.Itoa(d.Attempts))
+	req.Header.Set("X-Webhook-Signature", SignWebhookPayload(d.Secret, now, d.Payload))
+
+	started := time.Now()
+	resp, err := s.client.Do(req)
+	attempt.DurationMs = int(time.Since(started).Milliseconds())
+	if err != nil {
+		// Адрес во внутренней сети не станет внешним от повторов
+		if errors.Is(err, ErrWebhookPrivateAddress) {
+			attempt.Error = ErrWebhookPrivateAddress.Error()
+			return attempt, false
+		}
+		attempt.Error = err.Error()
+		return attempt, true
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+	attempt.StatusCode = &resp.StatusCode
+	attempt.ResponseBody = string(body)
+	if !attempt.OK() && resp.StatusCode >= 300 && resp.StatusCode < 400 {
+		attempt.Error = fmt.Sprintf("redirect to %s is not followed", resp.Header.Get("Location"))
+	}
+	return attempt, true
+}
@@ -0,0 +1,73 @@
+// Отправка событий продукта пакетами в /api/events/batch.
+// Подключение: <script src="/static/js/track.js" data-source="web|miniapp"></script>,
+// затем productEvents.track('report.exported', { format: 'xlsx' }).
+(function () {
+    const ENDPOINT = '/api/events/batch';
+    const MAX_BATCH = 100;
+    const FLUSH_MS = 5000;
+    const SESSION_IDLE_MS = 30 * 60 * 1000;
+
+    const script = document.currentScript;
+    const source = (script && script.dataset.source) || 'web';
+    let queue = [];
+    let timer = null;
+
+    function uuid() {
+        if (window.crypto && crypto.randomUUID) return crypto.randomUUID();
+        return 'xxxxxxxx-xxxx-4xxx-yxxx-xxxxxxxxxxxx'.replace(/[xy]/g, c => {
+            const r = Math.random() * 16 | 0;
+            return (c === 'x' ? r : (r & 0x3 | 0x8)).toString(16);
+        });
+    }
+
+    // Сессия продолжается, пока между событиями меньше 30 минут
+    function sessionId() {
+        const now = Date.now();
+        let session = null;
+        try { session = JSON.parse(sessionStorage.getItem('productEventsSession')); } catch (e) { }
+        if (!session || now - session.last > SESSION_IDLE_MS) {
+            session = { id: uuid(), last: now };
+        }
+        session.last = now;
+        sessionStorage.setItem('productEventsSession', JSON.stringify(session));
+        return session.id;
+    }
+
+    function flush(keepalive) {
+        clearTimeout(timer);
+        timer = null;
+        const token = localStorage.getItem('access_token');
+        if (!queue.length || !token) return;
+        const batch = queue.splice(0, MAX_BATCH);
+        fetch(ENDPOINT, {
+            method: 'POST',
+            keepalive: !!keepalive,
+            headers: { 'Content-Type': 'application/json', 'Authorization': 'Bearer ' + token },
+            body: JSON.stringify({ events: batch })
+        }).then(response => {
+            // Сетевые и серверные ошибки – вернуть пакет в очередь; insert_id защищает от дублей
+            if (response.status >= 500) queue = batch.concat(queue);
+        }).catch(() => { queue = batch.concat(queue); });
+        if (queue.length) flush(keepalive);
+    }
+
+    function track(event, properties) {
+        queue.push({
+            insert_id: uuid(),
+            event: event,
+            session_id: sessionId(),
+            source: source,
+            properties: properties || {},
+            occurred_at: new Date().toISOString()
+        });
+        if (queue.length >= MAX_BATCH) flush();
+        else if (!timer) timer = setTimeout(flush, FLUSH_MS);
+    }
+
+    document.addEventListener('visibilitychange', () => {
+        if (document.visibilityState === 'hidden') flush(true);
+    });
+
+    window.productEvents = { track: track, flush: flush };
+    track('page.viewed', { path: location.pathname });
+})();